@@ -0,0 +1,136 @@
+// Package bench benchmarks, load-tests and soak-tests the pools of package
+// taskqueue, and reports and compares the results
+package bench
+
+import (
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// Config describes a benchmark run
+type Config struct {
+	// Workers lists the pool sizes to benchmark; each is run separately
+	Workers []int
+	// Tasks is the number of tasks submitted per trial
+	Tasks int
+	// Duration is the simulated duration of each task
+	Duration taskqueue.Distribution
+	// Warmup is the number of untimed trials run before the measured ones
+	Warmup int
+	// Trials is the number of measured trials per pool and size
+	Trials int
+	// Seed makes task durations reproducible across runs
+	Seed uint64
+	// Options are passed to every pool the benchmark creates
+	Options []taskqueue.Option
+}
+
+// Trial is the outcome of one measured trial
+type Trial struct {
+	Elapsed   time.Duration
+	Completed int64
+	Stats     taskqueue.PoolStats
+	// Allocs and AllocBytes are the heap allocations of the whole process
+	// during the trial, the pool's and the tasks' alike
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+// Throughput returns the completed tasks per second over the whole trial
+func (t Trial) Throughput() float64 {
+	if t.Elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Completed) / t.Elapsed.Seconds()
+}
+
+// Result aggregates the trials of one pool at one size
+type Result struct {
+	Pool    string
+	Workers int
+	Trials  []Trial
+	Mean    time.Duration
+	StdDev  time.Duration
+}
+
+// Run runs every pool at every configured size and returns one result
+// per combination, in order
+func Run(cfg Config, pools []taskqueue.BenchPool) []Result {
+	if cfg.Duration == nil {
+		cfg.Duration = taskqueue.FixedDuration(0)
+	}
+	cfg.Trials = max(cfg.Trials, 1)
+
+	var results []Result
+	for _, workers := range cfg.Workers {
+		for _, pool := range pools {
+			for range cfg.Warmup {
+				runTrial(cfg, pool, workers)
+			}
+			result := Result{Pool: pool.Name, Workers: workers}
+			for range cfg.Trials {
+				result.Trials = append(result.Trials, runTrial(cfg, pool, workers))
+			}
+			result.Mean, result.StdDev = meanStdDev(result.Trials)
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// runTrial submits cfg.Tasks tasks to a fresh pool and times them until the
+// last one finishes; durations are drawn before the clock starts
+func runTrial(cfg Config, pool taskqueue.BenchPool, workers int) Trial {
+	r := rand.New(rand.NewPCG(cfg.Seed, uint64(workers)))
+	work := make(taskqueue.Workload, cfg.Tasks)
+	for i := range work {
+		d := cfg.Duration.Sample(r)
+		work[i] = func() { time.Sleep(d) }
+	}
+
+	p := pool.New(workers, cfg.Options...)
+	defer p.Shutdown()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	taskqueue.RunWorkload(p, work)
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	return Trial{
+		Elapsed:    elapsed,
+		Completed:  p.GetCompletedTasks(),
+		Stats:      p.Stats(),
+		Allocs:     after.Mallocs - before.Mallocs,
+		AllocBytes: after.TotalAlloc - before.TotalAlloc,
+	}
+}
+
+// AllocsPerTask returns the allocations of the trial per completed task
+func (t Trial) AllocsPerTask() float64 {
+	if t.Completed <= 0 {
+		return 0
+	}
+	return float64(t.Allocs) / float64(t.Completed)
+}
+
+// meanStdDev returns the mean and sample standard deviation of trial times
+func meanStdDev(trials []Trial) (time.Duration, time.Duration) {
+	var sum float64
+	for _, t := range trials {
+		sum += float64(t.Elapsed)
+	}
+	mean := sum / float64(len(trials))
+	if len(trials) < 2 {
+		return time.Duration(mean), 0
+	}
+	var sq float64
+	for _, t := range trials {
+		sq += (float64(t.Elapsed) - mean) * (float64(t.Elapsed) - mean)
+	}
+	return time.Duration(mean), time.Duration(math.Sqrt(sq / float64(len(trials)-1)))
+}
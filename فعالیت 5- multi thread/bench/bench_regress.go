@@ -0,0 +1,262 @@
+package bench
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Record is a benchmark run stored for later comparison, keyed by the
+// commit it measured
+type Record struct {
+	Commit string    `json:"commit"`
+	Time   time.Time `json:"time"`
+	// Tasks, Duration and Seed are the configuration results are only
+	// comparable under
+	Tasks    int          `json:"tasks"`
+	Duration string       `json:"duration"`
+	Seed     uint64       `json:"seed"`
+	Results  []ResultJSON `json:"results"`
+}
+
+// NewRecord records results run under cfg at commit
+func NewRecord(commit string, cfg Config, results []Result) *Record {
+	duration := "fixed:0s"
+	if cfg.Duration != nil {
+		duration = fmt.Sprint(cfg.Duration)
+	}
+	return &Record{
+		Commit:   commit,
+		Time:     time.Now().UTC(),
+		Tasks:    cfg.Tasks,
+		Duration: duration,
+		Seed:     cfg.Seed,
+		Results:  ResultsJSON(results),
+	}
+}
+
+// GitCommit returns the commit checked out in the working directory, with
+// "-dirty" appended if the tree has uncommitted changes, since those are
+// measured too
+func GitCommit() (string, error) {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("bench: finding the git commit: %w", err)
+	}
+	commit := strings.TrimSpace(string(out))
+	status, err := exec.Command("git", "status", "--porcelain", "--untracked-files=no").Output()
+	if err != nil {
+		return "", fmt.Errorf("bench: checking the git tree: %w", err)
+	}
+	if len(strings.TrimSpace(string(status))) > 0 {
+		commit += "-dirty"
+	}
+	return commit, nil
+}
+
+// SaveRecord writes r to dir as <commit>.json, replacing an earlier
+// record of the same commit
+func SaveRecord(dir string, r *Record) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, r.Commit+".json"), append(b, '\n'), 0o644)
+}
+
+// LoadRecord reads the record of commit from dir. commit may be
+// anything git resolves to a commit, such as a branch, a tag or HEAD~1, if
+// no record is stored under that exact name; the commit's dirty record is
+// taken if it has no clean one
+func LoadRecord(dir, commit string) (*Record, error) {
+	b, err := os.ReadFile(filepath.Join(dir, commit+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		if out, gerr := exec.Command("git", "rev-parse", "--verify", "--quiet", commit+"^{commit}").Output(); gerr == nil {
+			hash := strings.TrimSpace(string(out))
+			b, err = os.ReadFile(filepath.Join(dir, hash+".json"))
+			if errors.Is(err, os.ErrNotExist) {
+				b, err = os.ReadFile(filepath.Join(dir, hash+"-dirty.json"))
+			}
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("bench: no record of %q in %s; run the benchmark at that commit first", commit, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r Record
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("bench: reading the record of %q: %w", commit, err)
+	}
+	return &r, nil
+}
+
+// Comparison compares the throughput of one pool at one size between a
+// baseline and a current run
+type Comparison struct {
+	Pool    string
+	Workers int
+	// Baseline and Current are the mean throughputs, in tasks per second
+	Baseline, Current float64
+	// Change is the relative change of the mean throughput
+	Change float64
+	// P is the probability of trials differing at least this much if both
+	// runs had the same throughput, by a two-sided Mann-Whitney U test
+	P float64
+	// Regressed and Improved are set when the change is beyond the
+	// threshold in either direction and significant
+	Regressed, Improved bool
+}
+
+// Compare compares every pool and size run in both base and current,
+// flagging changes beyond threshold, a fraction such as 0.05, whose p-value
+// is below alpha. It fails if the runs were configured differently, and
+// returns ErrRegression along with the comparisons if any throughput
+// regressed
+func Compare(base, current *Record, threshold, alpha float64) ([]Comparison, error) {
+	if base.Tasks != current.Tasks || base.Duration != current.Duration || base.Seed != current.Seed {
+		return nil, fmt.Errorf("bench: baseline %s ran %d tasks of %s with seed %d, but the current run %d tasks of %s with seed %d",
+			base.Commit, base.Tasks, base.Duration, base.Seed, current.Tasks, current.Duration, current.Seed)
+	}
+	var out []Comparison
+	regressed := false
+	for _, cur := range current.Results {
+		i := slices.IndexFunc(base.Results, func(r ResultJSON) bool {
+			return r.Pool == cur.Pool && r.Workers == cur.Workers
+		})
+		if i < 0 {
+			continue
+		}
+		x, y := trialThroughputs(base.Results[i]), trialThroughputs(cur)
+		c := Comparison{Pool: cur.Pool, Workers: cur.Workers, Baseline: mean(x), Current: mean(y), P: mannWhitneyP(x, y)}
+		if c.Baseline > 0 {
+			c.Change = (c.Current - c.Baseline) / c.Baseline
+		}
+		significant := c.P < alpha
+		c.Regressed = significant && c.Change < -threshold
+		c.Improved = significant && c.Change > threshold
+		regressed = regressed || c.Regressed
+		out = append(out, c)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("bench: baseline %s ran none of the pools and sizes of the current run", base.Commit)
+	}
+	if regressed {
+		return out, ErrRegression
+	}
+	return out, nil
+}
+
+// WriteComparison writes comparisons as a table, one line per pool and
+// size
+func WriteComparison(w io.Writer, base, current string, comparisons []Comparison) error {
+	fmt.Fprintf(w, "baseline %s\ncurrent  %s\n\n", base, current)
+	fmt.Fprintf(w, "%-14s %8s %14s %14s %9s %7s\n", "pool", "workers", "base tasks/s", "tasks/s", "change", "p")
+	for _, c := range comparisons {
+		verdict := "~"
+		switch {
+		case c.Regressed:
+			verdict = "REGRESSION"
+		case c.Improved:
+			verdict = "improvement"
+		}
+		if _, err := fmt.Fprintf(w, "%-14s %8d %14.1f %14.1f %+8.2f%% %7.3f  %s\n",
+			c.Pool, c.Workers, c.Baseline, c.Current, c.Change*100, c.P, verdict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trialThroughputs returns the throughput of each trial of r
+func trialThroughputs(r ResultJSON) []float64 {
+	out := make([]float64, len(r.Trials))
+	for i, t := range r.Trials {
+		out[i] = t.Throughput
+	}
+	return out
+}
+
+// mean returns the mean of xs, or 0 if there are none
+func mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// mannWhitneyP returns the two-sided p-value of a Mann-Whitney U test that
+// x and y come from the same distribution, by the normal approximation with
+// corrections for ties and continuity. It makes no assumption about the
+// shape of the distribution, which for throughputs is often skewed; with
+// 3 trials or fewer on a side no difference is significant at 0.05
+func mannWhitneyP(x, y []float64) float64 {
+	n1, n2 := float64(len(x)), float64(len(y))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	type sample struct {
+		v     float64
+		fromX bool
+	}
+	all := make([]sample, 0, len(x)+len(y))
+	for _, v := range x {
+		all = append(all, sample{v, true})
+	}
+	for _, v := range y {
+		all = append(all, sample{v, false})
+	}
+	slices.SortFunc(all, func(a, b sample) int {
+		switch {
+		case a.v < b.v:
+			return -1
+		case a.v > b.v:
+			return 1
+		}
+		return 0
+	})
+	// Rank the samples, giving tied ones the mean of their ranks
+	var rankX, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for _, s := range all[i:j] {
+			if s.fromX {
+				rankX += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	u := rankX - n1*(n1+1)/2
+	n := n1 + n2
+	sd := math.Sqrt(n1 * n2 / 12 * (n + 1 - ties/(n*(n-1))))
+	if sd == 0 {
+		return 1
+	}
+	z := (math.Abs(u-n1*n2/2) - 0.5) / sd
+	if z <= 0 {
+		return 1
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
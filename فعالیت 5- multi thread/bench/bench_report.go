@@ -0,0 +1,205 @@
+package bench
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// TrialJSON is the JSON form of one measured trial
+type TrialJSON struct {
+	ElapsedNs  int64   `json:"elapsed_ns"`
+	Completed  int64   `json:"completed"`
+	Throughput float64 `json:"throughput"`
+	P50Ns      int64   `json:"p50_ns"`
+	P95Ns      int64   `json:"p95_ns"`
+	P99Ns      int64   `json:"p99_ns"`
+	Allocs     uint64  `json:"allocs"`
+	AllocBytes uint64  `json:"alloc_bytes"`
+}
+
+// ResultJSON is the JSON form of a Result
+type ResultJSON struct {
+	Pool     string      `json:"pool"`
+	Workers  int         `json:"workers"`
+	MeanNs   int64       `json:"mean_ns"`
+	StdDevNs int64       `json:"stddev_ns"`
+	Trials   []TrialJSON `json:"trials"`
+}
+
+// WriteText writes results as human-readable text, comparing every pool
+// against the first one benchmarked at the same size
+func WriteText(w io.Writer, results []Result) error {
+	var baseline time.Duration
+	for i, r := range results {
+		first := i == 0 || results[i-1].Workers != r.Workers
+		if first {
+			baseline = r.Mean
+		}
+		fmt.Fprintf(w, "%s pool, %d workers (%d trials):\n", r.Pool, r.Workers, len(r.Trials))
+		fmt.Fprintf(w, "Completed Tasks: %d\n", r.Trials[len(r.Trials)-1].Completed)
+		fmt.Fprintf(w, "Total Time: %v ± %v\n", r.Mean, r.StdDev)
+		if !first && baseline > 0 {
+			diff := float64(r.Mean-baseline) / float64(baseline) * 100
+			fmt.Fprintf(w, "Performance Difference: %.2f%%\n", diff)
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes results as a JSON array with one object per pool and size
+func WriteJSON(w io.Writer, results []Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ResultsJSON(results))
+}
+
+// ResultsJSON converts results to the form WriteJSON writes
+func ResultsJSON(results []Result) []ResultJSON {
+	out := make([]ResultJSON, len(results))
+	for i, r := range results {
+		out[i] = ResultJSON{
+			Pool:     r.Pool,
+			Workers:  r.Workers,
+			MeanNs:   int64(r.Mean),
+			StdDevNs: int64(r.StdDev),
+		}
+		for _, t := range r.Trials {
+			out[i].Trials = append(out[i].Trials, TrialJSON{
+				ElapsedNs:  int64(t.Elapsed),
+				Completed:  t.Completed,
+				Throughput: t.Throughput(),
+				P50Ns:      int64(t.Stats.P50),
+				P95Ns:      int64(t.Stats.P95),
+				P99Ns:      int64(t.Stats.P99),
+				Allocs:     t.Allocs,
+				AllocBytes: t.AllocBytes,
+			})
+		}
+	}
+	return out
+}
+
+// WriteCSV writes results as CSV with a header and one row per trial
+func WriteCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"pool", "workers", "trial", "elapsed_ns", "completed", "throughput", "p50_ns", "p95_ns", "p99_ns", "allocs", "alloc_bytes"})
+	for _, r := range results {
+		for i, t := range r.Trials {
+			cw.Write([]string{
+				r.Pool,
+				strconv.Itoa(r.Workers),
+				strconv.Itoa(i + 1),
+				strconv.FormatInt(int64(t.Elapsed), 10),
+				strconv.FormatInt(t.Completed, 10),
+				strconv.FormatFloat(t.Throughput(), 'f', 2, 64),
+				strconv.FormatInt(int64(t.Stats.P50), 10),
+				strconv.FormatInt(int64(t.Stats.P95), 10),
+				strconv.FormatInt(int64(t.Stats.P99), 10),
+				strconv.FormatUint(t.Allocs, 10),
+				strconv.FormatUint(t.AllocBytes, 10),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadJSON reads a report written by WriteJSON, such as a golden
+// report saved from an earlier run
+func ReadJSON(r io.Reader) ([]ResultJSON, error) {
+	var results []ResultJSON
+	if err := json.NewDecoder(r).Decode(&results); err != nil {
+		return nil, fmt.Errorf("bench report: %w", err)
+	}
+	return results, nil
+}
+
+// benchFields are the fields DiffReports compares, each averaged over
+// the trials of a result, and whether a higher value is better
+var benchFields = []struct {
+	name   string
+	higher bool
+	value  func(TrialJSON) float64
+	format func(float64) string
+}{
+	{"throughput", true, func(t TrialJSON) float64 { return t.Throughput },
+		func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) + "/s" }},
+	{"p99", false, func(t TrialJSON) float64 { return float64(t.P99Ns) },
+		func(v float64) string { return time.Duration(v).String() }},
+	{"allocs/task", false, func(t TrialJSON) float64 {
+		if t.Completed <= 0 {
+			return 0
+		}
+		return float64(t.Allocs) / float64(t.Completed)
+	}, func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }},
+	{"bytes/task", false, func(t TrialJSON) float64 {
+		if t.Completed <= 0 {
+			return 0
+		}
+		return float64(t.AllocBytes) / float64(t.Completed)
+	}, func(v float64) string { return strconv.FormatFloat(v, 'f', 0, 64) + "B" }},
+}
+
+// DiffReports writes a table comparing current against golden field
+// by field for every pool and size, with the relative change of each and
+// whether it is better or worse; results only one side has are listed as
+// such. Changes within 2% are considered noise and left unmarked
+func DiffReports(w io.Writer, golden, current []ResultJSON) error {
+	fmt.Fprintf(w, "%-14s %8s  %-12s %14s %14s %9s\n", "pool", "workers", "field", "golden", "current", "delta")
+	find := func(results []ResultJSON, pool string, workers int) *ResultJSON {
+		for i := range results {
+			if results[i].Pool == pool && results[i].Workers == workers {
+				return &results[i]
+			}
+		}
+		return nil
+	}
+	average := func(r *ResultJSON, value func(TrialJSON) float64) float64 {
+		if len(r.Trials) == 0 {
+			return 0
+		}
+		var sum float64
+		for _, t := range r.Trials {
+			sum += value(t)
+		}
+		return sum / float64(len(r.Trials))
+	}
+	for _, cur := range current {
+		old := find(golden, cur.Pool, cur.Workers)
+		if old == nil {
+			fmt.Fprintf(w, "%-14s %8d  %-12s\n", cur.Pool, cur.Workers, "not in the golden report")
+			continue
+		}
+		for _, field := range benchFields {
+			before, after := average(old, field.value), average(&cur, field.value)
+			delta, verdict := "", ""
+			if before != 0 {
+				change := (after - before) / before
+				delta = fmt.Sprintf("%+.2f%%", change*100)
+				switch better := change > 0 == field.higher; {
+				case change > -0.02 && change < 0.02:
+				case better:
+					verdict = "better"
+				default:
+					verdict = "worse"
+				}
+			}
+			fmt.Fprintf(w, "%-14s %8d  %-12s %14s %14s %9s  %s\n",
+				cur.Pool, cur.Workers, field.name, field.format(before), field.format(after), delta, verdict)
+		}
+	}
+	for _, old := range golden {
+		if find(current, old.Pool, old.Workers) == nil {
+			fmt.Fprintf(w, "%-14s %8d  %-12s\n", old.Pool, old.Workers, "not run this time")
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
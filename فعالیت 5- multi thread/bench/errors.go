@@ -0,0 +1,11 @@
+package bench
+
+import "errors"
+
+// ErrRegression is reported by Compare when a pool's throughput dropped
+// significantly below its baseline
+var ErrRegression = errors.New("bench: throughput regressed")
+
+// ErrSoakFailed is reported by RunSoak when a pool leaked or its counters
+// drifted over a soak run
+var ErrSoakFailed = errors.New("soak: pool did not hold up")
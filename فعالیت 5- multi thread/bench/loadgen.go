@@ -0,0 +1,274 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// Arrivals is when the tasks of an open-loop load arrive, regardless of how
+// fast the pool gets through them
+type Arrivals interface {
+	// Next returns the gap before the next arrival and how many tasks
+	// arrive together then
+	Next(r *rand.Rand) (gap time.Duration, tasks int)
+	// PerSecond returns the mean number of tasks arriving per second
+	PerSecond() float64
+	String() string
+}
+
+// PoissonArrivals are independent arrivals at a mean rate per second, with
+// exponential gaps between them, as of requests from many unrelated clients
+type PoissonArrivals float64
+
+// Next implements Arrivals
+func (a PoissonArrivals) Next(r *rand.Rand) (time.Duration, int) {
+	return time.Duration(r.ExpFloat64() / float64(a) * float64(time.Second)), 1
+}
+
+// PerSecond implements Arrivals
+func (a PoissonArrivals) PerSecond() float64 { return float64(a) }
+
+// String implements Arrivals
+func (a PoissonArrivals) String() string { return fmt.Sprintf("poisson:%g", float64(a)) }
+
+// ConstantArrivals are arrivals evenly spaced at a rate per second
+type ConstantArrivals float64
+
+// Next implements Arrivals
+func (a ConstantArrivals) Next(*rand.Rand) (time.Duration, int) {
+	return time.Duration(float64(time.Second) / float64(a)), 1
+}
+
+// PerSecond implements Arrivals
+func (a ConstantArrivals) PerSecond() float64 { return float64(a) }
+
+// String implements Arrivals
+func (a ConstantArrivals) String() string { return fmt.Sprintf("constant:%g", float64(a)) }
+
+// BurstyArrivals are bursts of tasks arriving together, such as a fan-out
+// or a batch job kicking in: bursts are independent, and their sizes
+// geometric with mean Burst, so the tasks average Rate per second
+type BurstyArrivals struct {
+	Rate  float64
+	Burst float64
+}
+
+// Next implements Arrivals
+func (a BurstyArrivals) Next(r *rand.Rand) (time.Duration, int) {
+	gap := time.Duration(r.ExpFloat64() * a.Burst / a.Rate * float64(time.Second))
+	// Geometric on 1, 2, ... with mean Burst
+	n := 1
+	if a.Burst > 1 {
+		n += int(math.Floor(math.Log(1-r.Float64()) / math.Log(1-1/a.Burst)))
+	}
+	return gap, n
+}
+
+// PerSecond implements Arrivals
+func (a BurstyArrivals) PerSecond() float64 { return a.Rate }
+
+// String implements Arrivals
+func (a BurstyArrivals) String() string { return fmt.Sprintf("bursty:%g,%g", a.Rate, a.Burst) }
+
+// ParseArrivals parses "poisson:500" or "constant:500" for a rate per
+// second, or "bursty:500,20" for a rate and a mean burst size
+func ParseArrivals(spec string) (Arrivals, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("arrivals %q: expected kind:rate", spec)
+	}
+	rateArg, burstArg, bursty := strings.Cut(arg, ",")
+	rate, err := strconv.ParseFloat(rateArg, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("arrivals %q: rate must be a positive number", spec)
+	}
+	switch kind {
+	case "poisson":
+		return PoissonArrivals(rate), nil
+	case "constant":
+		return ConstantArrivals(rate), nil
+	case "bursty":
+		if !bursty {
+			return nil, fmt.Errorf("arrivals %q: expected bursty:rate,burst", spec)
+		}
+		burst, err := strconv.ParseFloat(burstArg, 64)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("arrivals %q: burst must be a number of at least 1", spec)
+		}
+		return BurstyArrivals{Rate: rate, Burst: burst}, nil
+	}
+	return nil, fmt.Errorf("arrivals %q: unknown kind %q", spec, kind)
+}
+
+// LoadConfig describes a load to generate against a pool. It is open loop,
+// tasks arriving by Arrivals whether or not the pool keeps up, unless
+// Clients is set: then it is closed loop, each client submitting a task,
+// waiting for it and thinking before the next, so the load eases as the
+// pool slows down
+type LoadConfig struct {
+	// Arrivals schedules the tasks of an open-loop load
+	Arrivals Arrivals
+	// Clients is the number of clients of a closed-loop load, and Think
+	// how long each waits between a task finishing and submitting the next
+	Clients int
+	Think   taskqueue.Distribution
+	// Tasks is the number of tasks to submit in all
+	Tasks int
+	// Duration is the simulated duration of each task
+	Duration taskqueue.Distribution
+	// Seed makes arrivals and durations reproducible
+	Seed uint64
+	// Options are passed to every pool the load runs on
+	Options []taskqueue.Option
+}
+
+// LoadResult is the outcome of a load against one pool
+type LoadResult struct {
+	Pool    string
+	Workers int
+	Tasks   int
+	Elapsed time.Duration
+	// Offered is the rate at which an open-loop load meant to submit tasks,
+	// per second; 0 for a closed loop
+	Offered float64
+	// Latency is the time from each task's arrival to its end. For an open
+	// loop that is its scheduled arrival, so a generator falling behind
+	// counts against the pool rather than hiding its slowness
+	Latency *taskqueue.Histogram
+	// QueueWait and Execution split the latency of the pool's tasks into
+	// how long they waited for a worker and how long they ran, telling a
+	// saturated pool apart from slow tasks; nil for pools that keep no
+	// latency histograms
+	QueueWait *taskqueue.Histogram
+	Execution *taskqueue.Histogram
+}
+
+// Throughput returns the tasks completed per second
+func (r LoadResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Tasks) / r.Elapsed.Seconds()
+}
+
+// RunLoad runs the load of cfg on a fresh pool of pool with workers workers
+func RunLoad(cfg LoadConfig, pool taskqueue.BenchPool, workers int) LoadResult {
+	if cfg.Duration == nil {
+		cfg.Duration = taskqueue.FixedDuration(0)
+	}
+	if cfg.Think == nil {
+		cfg.Think = taskqueue.FixedDuration(0)
+	}
+	if cfg.Arrivals == nil && cfg.Clients <= 0 {
+		cfg.Arrivals = PoissonArrivals(1000)
+	}
+	p := pool.New(workers, cfg.Options...)
+	defer p.Shutdown()
+
+	result := LoadResult{Pool: pool.Name, Workers: workers, Tasks: cfg.Tasks, Latency: &taskqueue.Histogram{}}
+	r := rand.New(rand.NewPCG(cfg.Seed, uint64(workers)))
+	durations := make([]time.Duration, cfg.Tasks)
+	for i := range durations {
+		durations[i] = cfg.Duration.Sample(r)
+	}
+	task := func(i int, arrived time.Time) taskqueue.Task {
+		d := durations[i]
+		return func() {
+			time.Sleep(d)
+			result.Latency.Record(time.Since(arrived))
+		}
+	}
+
+	start := time.Now()
+	if cfg.Clients > 0 {
+		runClosedLoop(cfg, p, task, r)
+	} else {
+		result.Offered = cfg.Arrivals.PerSecond()
+		runOpenLoop(cfg, p, task, r)
+	}
+	p.WaitForCompletion()
+	result.Elapsed = time.Since(start)
+	if source, ok := p.(taskqueue.HistogramSource); ok {
+		l := source.Latencies()
+		result.QueueWait, result.Execution = l.QueueWait, l.Execution
+	}
+	return result
+}
+
+// runOpenLoop submits the tasks at the times cfg.Arrivals schedules from
+// now; tasks already due are submitted at once, so the schedule does not
+// slip when the generator is late
+func runOpenLoop(cfg LoadConfig, p taskqueue.Executor, task func(int, time.Time) taskqueue.Task, r *rand.Rand) {
+	next := time.Now()
+	for i := 0; i < cfg.Tasks; {
+		gap, n := cfg.Arrivals.Next(r)
+		next = next.Add(gap)
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+		for ; n > 0 && i < cfg.Tasks; n-- {
+			p.Submit(task(i, next))
+			i++
+		}
+	}
+}
+
+// runClosedLoop has cfg.Clients clients take turns through the tasks, each
+// waiting for its task to finish and thinking before submitting another
+func runClosedLoop(cfg LoadConfig, p taskqueue.Executor, task func(int, time.Time) taskqueue.Task, r *rand.Rand) {
+	think := make([]time.Duration, cfg.Tasks)
+	for i := range think {
+		think[i] = cfg.Think.Sample(r)
+	}
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range cfg.Clients {
+		wg.Go(func() {
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= cfg.Tasks {
+					return
+				}
+				<-p.Submit(task(i, time.Now())).Done()
+				time.Sleep(think[i])
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// WriteLoadText writes results as a table, one line per pool and size,
+// with the p99 of the queue wait and execution time beside the latency's
+func WriteLoadText(w io.Writer, results []LoadResult) error {
+	fmt.Fprintf(w, "%-14s %8s %8s %10s %10s %10s %10s %10s %10s %10s %10s\n",
+		"pool", "workers", "tasks", "offered/s", "tasks/s", "p50", "p95", "p99", "max", "wait p99", "exec p99")
+	p99 := func(h *taskqueue.Histogram) string {
+		if h == nil {
+			return "-"
+		}
+		return h.Quantile(0.99).Round(time.Microsecond).String()
+	}
+	for _, r := range results {
+		offered := "closed"
+		if r.Offered > 0 {
+			offered = strconv.FormatFloat(r.Offered, 'f', 1, 64)
+		}
+		if _, err := fmt.Fprintf(w, "%-14s %8d %8d %10s %10.1f %10v %10v %10v %10v %10s %10s\n",
+			r.Pool, r.Workers, r.Tasks, offered, r.Throughput(),
+			r.Latency.Quantile(0.50).Round(time.Microsecond), r.Latency.Quantile(0.95).Round(time.Microsecond),
+			r.Latency.Quantile(0.99).Round(time.Microsecond), r.Latency.Max().Round(time.Microsecond),
+			p99(r.QueueWait), p99(r.Execution)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
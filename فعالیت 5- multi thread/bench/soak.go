@@ -0,0 +1,221 @@
+package bench
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// SoakConfig describes a soak run: a pool kept under steady load for a long
+// time, with snapshots of its process taken throughout to catch what only
+// shows over hours, such as leaks
+type SoakConfig struct {
+	// Length is how long the load lasts
+	Length time.Duration
+	// Interval is the time between snapshots, 1m by default
+	Interval time.Duration
+	// Arrivals schedules the tasks, 1000 a second by Poisson by default
+	Arrivals Arrivals
+	// Duration is the simulated duration of each task
+	Duration taskqueue.Distribution
+	// Seed makes arrivals and durations reproducible
+	Seed uint64
+	// Options are passed to the pool
+	Options []taskqueue.Option
+	// MaxGoroutineGrowth is how many more goroutines the last third of the
+	// run may keep than the first, 8 by default
+	MaxGoroutineGrowth int
+	// MaxHeapGrowth is how many more bytes of live heap the last third of
+	// the run may keep than the first, 16MiB by default
+	MaxHeapGrowth uint64
+	// OnSnapshot, if set, is called with every snapshot as it is taken
+	OnSnapshot func(SoakSnapshot)
+}
+
+// SoakSnapshot is the state of a soak run at one point
+type SoakSnapshot struct {
+	Elapsed    time.Duration
+	Goroutines int
+	// HeapAlloc is the live heap, measured right after a collection
+	HeapAlloc uint64
+	// Submitted and Executed are the tasks the run submitted and the tasks
+	// that ran to their end, counted by the run itself; Metrics are the
+	// pool's own counts, which must agree with them
+	Submitted, Executed int64
+	Metrics             taskqueue.MetricsSnapshot
+}
+
+// String implements fmt.Stringer
+func (s SoakSnapshot) String() string {
+	return fmt.Sprintf("%10v  goroutines %5d  heap %8.2fMiB  submitted %9d  completed %9d  queued %6d",
+		s.Elapsed.Round(time.Second), s.Goroutines, float64(s.HeapAlloc)/(1<<20), s.Submitted, s.Metrics.Completed, s.Metrics.QueueDepth)
+}
+
+// SoakResult is the outcome of a soak run
+type SoakResult struct {
+	Pool      string
+	Workers   int
+	Snapshots []SoakSnapshot
+	// Problems describes every leak and drift found, none if the pool held
+	// up
+	Problems []string
+}
+
+// RunSoak runs a fresh pool of pool with workers workers under the load of
+// cfg for cfg.Length, taking a snapshot every cfg.Interval. It reports a
+// problem if goroutines or the live heap grew from the first third of the
+// snapshots to the last, comparing the least of each third so bursts of
+// load are not taken for growth; if the pool's counters ever disagree with
+// the run's own; and if goroutines are left over once the pool shuts down.
+// Trends need at least 6 snapshots. The result's error is ErrSoakFailed,
+// with the problems, if there were any
+func RunSoak(cfg SoakConfig, pool taskqueue.BenchPool, workers int) (SoakResult, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Arrivals == nil {
+		cfg.Arrivals = PoissonArrivals(1000)
+	}
+	if cfg.Duration == nil {
+		cfg.Duration = taskqueue.FixedDuration(0)
+	}
+	if cfg.MaxGoroutineGrowth <= 0 {
+		cfg.MaxGoroutineGrowth = 8
+	}
+	if cfg.MaxHeapGrowth == 0 {
+		cfg.MaxHeapGrowth = 16 << 20
+	}
+	result := SoakResult{Pool: pool.Name, Workers: workers}
+	problem := func(format string, args ...any) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+	}
+
+	runtime.GC()
+	before := runtime.NumGoroutine()
+	p := pool.New(workers, cfg.Options...)
+	r := rand.New(rand.NewPCG(cfg.Seed, uint64(workers)))
+	var submitted, executed atomic.Int64
+
+	start := time.Now()
+	snapshot := func() SoakSnapshot {
+		// The pool's counts are read first: a task counts as executed
+		// before the pool counts it completed, so Executed can only be
+		// ahead of Completed
+		m := p.Metrics()
+		runtime.GC()
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		s := SoakSnapshot{
+			Elapsed:    time.Since(start),
+			Goroutines: runtime.NumGoroutine(),
+			HeapAlloc:  mem.HeapAlloc,
+			Submitted:  submitted.Load(),
+			Executed:   executed.Load(),
+			Metrics:    m,
+		}
+		result.Snapshots = append(result.Snapshots, s)
+		if cfg.OnSnapshot != nil {
+			cfg.OnSnapshot(s)
+		}
+		return s
+	}
+	checkCounters := func(s SoakSnapshot) {
+		switch {
+		case s.Metrics.Submitted != s.Submitted:
+			problem("at %v the pool counted %d tasks submitted, but %d were", s.Elapsed.Round(time.Second), s.Metrics.Submitted, s.Submitted)
+		case s.Metrics.Completed > s.Executed:
+			problem("at %v the pool counted %d tasks completed, but %d had run", s.Elapsed.Round(time.Second), s.Metrics.Completed, s.Executed)
+		}
+	}
+
+	// The snapshots are taken between submissions, which keeps the run's
+	// count of submitted tasks in step with the pool's
+	next, nextSnapshot := start, start.Add(cfg.Interval)
+	for end := start.Add(cfg.Length); next.Before(end); {
+		gap, n := cfg.Arrivals.Next(r)
+		next = next.Add(gap)
+		for !nextSnapshot.After(next) && nextSnapshot.Before(end) {
+			if wait := time.Until(nextSnapshot); wait > 0 {
+				time.Sleep(wait)
+			}
+			checkCounters(snapshot())
+			nextSnapshot = nextSnapshot.Add(cfg.Interval)
+		}
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+		for range n {
+			d := cfg.Duration.Sample(r)
+			p.Submit(func() {
+				time.Sleep(d)
+				executed.Add(1)
+			})
+			submitted.Add(1)
+		}
+	}
+	p.WaitForCompletion()
+	last := snapshot()
+	checkCounters(last)
+	if last.Metrics.Completed != last.Submitted || last.Executed != last.Submitted {
+		problem("after the load the pool counted %d tasks completed and %d ran, of %d submitted", last.Metrics.Completed, last.Executed, last.Submitted)
+	}
+
+	if n := len(result.Snapshots) / 3; n >= 2 {
+		first, final := result.Snapshots[:n], result.Snapshots[len(result.Snapshots)-n:]
+		least := func(snaps []SoakSnapshot, f func(SoakSnapshot) uint64) uint64 {
+			return f(slices.MinFunc(snaps, func(a, b SoakSnapshot) int { return cmp.Compare(f(a), f(b)) }))
+		}
+		goroutines := func(s SoakSnapshot) uint64 { return uint64(s.Goroutines) }
+		heap := func(s SoakSnapshot) uint64 { return s.HeapAlloc }
+		if g0, g1 := least(first, goroutines), least(final, goroutines); g1 > g0+uint64(cfg.MaxGoroutineGrowth) {
+			problem("goroutines grew from %d to %d over the run: a goroutine leak", g0, g1)
+		}
+		if h0, h1 := least(first, heap), least(final, heap); h1 > h0+cfg.MaxHeapGrowth {
+			problem("the live heap grew from %.2fMiB to %.2fMiB over the run: a memory leak", float64(h0)/(1<<20), float64(h1)/(1<<20))
+		}
+	}
+
+	p.Shutdown()
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(5 * time.Second); after > before && time.Now().Before(deadline); after = runtime.NumGoroutine() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after > before {
+		problem("%d goroutines were left after the pool shut down", after-before)
+	}
+	if len(result.Problems) > 0 {
+		return result, fmt.Errorf("%w: %s", ErrSoakFailed, strings.Join(result.Problems, "; "))
+	}
+	return result, nil
+}
+
+// Soak runs RunSoak on each of pools in turn, writing the snapshots and the
+// outcome of each to w, and returns the failures of all of them
+func Soak(w io.Writer, cfg SoakConfig, pools []taskqueue.BenchPool, workers int) error {
+	var errs []error
+	for _, pool := range pools {
+		fmt.Fprintf(w, "%s pool, %d workers, soaking for %v:\n", pool.Name, workers, cfg.Length)
+		cfg := cfg
+		cfg.OnSnapshot = func(s SoakSnapshot) { fmt.Fprintln(w, s) }
+		result, err := RunSoak(cfg, pool, workers)
+		if err != nil {
+			for _, p := range result.Problems {
+				fmt.Fprintf(w, "FAIL  %s\n", p)
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", pool.Name, err))
+		} else {
+			fmt.Fprintf(w, "ok    no leaks or drift over %d snapshots\n", len(result.Snapshots))
+		}
+		fmt.Fprintln(w)
+	}
+	return errors.Join(errs...)
+}
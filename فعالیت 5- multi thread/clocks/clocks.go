@@ -0,0 +1,345 @@
+// Package clocks orders events across nodes without synchronized time:
+// Lamport clocks, vector clocks and hybrid logical clocks
+package clocks
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multithread/internal/wire"
+)
+
+// Lamport is a Lamport logical clock: a counter that grows with every local
+// event and jumps past the time of every message received, so that if one
+// event happened before another it has the lower time. The converse does not
+// hold; equal or ordered times say nothing about concurrent events. The zero
+// value starts at time 0 and is safe for concurrent use
+type Lamport struct {
+	time atomic.Uint64
+}
+
+// Now returns the current time without advancing it
+func (c *Lamport) Now() uint64 {
+	return c.time.Load()
+}
+
+// Tick advances the clock for a local event and returns the event's time
+func (c *Lamport) Tick() uint64 {
+	return c.time.Add(1)
+}
+
+// Merge advances the clock past remote, the time of a received message, and
+// returns the time of the receive event
+func (c *Lamport) Merge(remote uint64) uint64 {
+	for {
+		cur := c.time.Load()
+		next := max(cur, remote) + 1
+		if c.time.CompareAndSwap(cur, next) {
+			return next
+		}
+	}
+}
+
+// Order is how two vector clocks relate
+type Order int
+
+const (
+	// Equal clocks record the same history
+	Equal Order = iota
+	// Before means the first clock happened before the second
+	Before
+	// After means the first clock happened after the second
+	After
+	// Concurrent clocks saw events the other did not: neither happened
+	// before the other, so their writes conflict
+	Concurrent
+)
+
+// String returns the order name
+func (o Order) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	case Concurrent:
+		return "concurrent"
+	default:
+		return fmt.Sprintf("Order(%d)", int(o))
+	}
+}
+
+// Vector counts the events seen from each node. Unlike a Lamport time it
+// captures causality exactly: one clock happened before another if and only
+// if no counter of it is higher and they differ, so concurrent updates are
+// detected rather than ordered arbitrarily. Missing nodes count as zero. A
+// Vector is not safe for concurrent use
+type Vector map[string]uint64
+
+// Tick counts a local event of node and returns its counter
+func (v Vector) Tick(node string) uint64 {
+	v[node]++
+	return v[node]
+}
+
+// Merge raises every counter of v to at least its value in o, as on
+// receiving a message or state stamped with o
+func (v Vector) Merge(o Vector) {
+	for node, n := range o {
+		if n > v[node] {
+			v[node] = n
+		}
+	}
+}
+
+// Clone returns a copy of v
+func (v Vector) Clone() Vector {
+	c := make(Vector, len(v))
+	for node, n := range v {
+		c[node] = n
+	}
+	return c
+}
+
+// Compare returns how v relates to o
+func (v Vector) Compare(o Vector) Order {
+	less, greater := false, false
+	for node, n := range v {
+		switch m := o[node]; {
+		case n < m:
+			less = true
+		case n > m:
+			greater = true
+		}
+	}
+	for node, m := range o {
+		if _, ok := v[node]; !ok && m > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
+
+// HappenedBefore reports whether v happened before o
+func (v Vector) HappenedBefore(o Vector) bool {
+	return v.Compare(o) == Before
+}
+
+// Concurrent reports whether neither of v and o happened before the other
+func (v Vector) Concurrent(o Vector) bool {
+	return v.Compare(o) == Concurrent
+}
+
+// Prune drops the counters of nodes that left the group, keeping clocks from
+// growing with churn. Only prune a node once every clock it will be compared
+// with has seen its last event; otherwise a pruned clock compares as older
+// than, rather than equal to or newer than, an unpruned one
+func (v Vector) Prune(nodes ...string) {
+	for _, node := range nodes {
+		delete(v, node)
+	}
+}
+
+// nodes returns the nodes with a non-zero counter, sorted
+func (v Vector) nodes() []string {
+	nodes := make([]string, 0, len(v))
+	for node, n := range v {
+		if n > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+// String formats v as {node:counter ...} in node order
+func (v Vector) String() string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, node := range v.nodes() {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s:%d", node, v[node])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// MarshalBinary encodes v compactly for the wire: the entry count, then per
+// node in sorted order the length of the prefix it shares with the previous
+// node, the rest of its name and its counter, all as uvarints or
+// uvarint-prefixed bytes. Zero counters are left out
+func (v Vector) MarshalBinary() ([]byte, error) {
+	nodes := v.nodes()
+	b := binary.AppendUvarint(nil, uint64(len(nodes)))
+	prev := ""
+	for _, node := range nodes {
+		shared := 0
+		for shared < min(len(prev), len(node)) && prev[shared] == node[shared] {
+			shared++
+		}
+		b = binary.AppendUvarint(b, uint64(shared))
+		b = wire.AppendBytes(b, []byte(node[shared:]))
+		b = binary.AppendUvarint(b, v[node])
+		prev = node
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a clock encoded by MarshalBinary into v, which
+// must not be nil; existing entries are replaced
+func (v Vector) UnmarshalBinary(b []byte) error {
+	clear(v)
+	r := wire.Reader{B: b}
+	n := r.Uvarint()
+	// Every entry takes at least three bytes
+	if n > uint64(len(r.B))/3 {
+		return wire.ErrMalformed
+	}
+	prev := ""
+	for range n {
+		shared := r.Uvarint()
+		rest := r.Bytes()
+		counter := r.Uvarint()
+		if r.Err != nil {
+			return r.Err
+		}
+		if shared > uint64(len(prev)) {
+			return wire.ErrMalformed
+		}
+		node := prev[:shared] + string(rest)
+		v[node] = counter
+		prev = node
+	}
+	return r.Err
+}
+
+// HLCTimestamp is a hybrid logical clock time: the highest physical time, in
+// nanoseconds since the Unix epoch, any causally preceding event saw, and a
+// logical counter ordering events that share it
+type HLCTimestamp struct {
+	Wall    int64
+	Logical uint32
+}
+
+// HLCTimestampSize is the length of an encoded HLCTimestamp
+const HLCTimestampSize = 12
+
+// Compare returns -1, 0 or +1 as t is before, equal to or after o
+func (t HLCTimestamp) Compare(o HLCTimestamp) int {
+	return cmp.Or(cmp.Compare(t.Wall, o.Wall), cmp.Compare(t.Logical, o.Logical))
+}
+
+// Before reports whether t is ordered before o
+func (t HLCTimestamp) Before(o HLCTimestamp) bool {
+	return t.Compare(o) < 0
+}
+
+// Time returns the wall clock part of t
+func (t HLCTimestamp) Time() time.Time {
+	return time.Unix(0, t.Wall)
+}
+
+// String formats t as its wall time and logical counter
+func (t HLCTimestamp) String() string {
+	return fmt.Sprintf("%s+%d", t.Time().UTC().Format(time.RFC3339Nano), t.Logical)
+}
+
+// MarshalBinary encodes t as 12 big-endian bytes, the wall time then the
+// logical counter, so encoded timestamps sort like the timestamps
+func (t HLCTimestamp) MarshalBinary() ([]byte, error) {
+	b := make([]byte, HLCTimestampSize)
+	binary.BigEndian.PutUint64(b, uint64(t.Wall))
+	binary.BigEndian.PutUint32(b[8:], t.Logical)
+	return b, nil
+}
+
+// UnmarshalBinary decodes a timestamp encoded by MarshalBinary
+func (t *HLCTimestamp) UnmarshalBinary(b []byte) error {
+	if len(b) != HLCTimestampSize {
+		return wire.ErrMalformed
+	}
+	t.Wall = int64(binary.BigEndian.Uint64(b))
+	t.Logical = binary.BigEndian.Uint32(b[8:])
+	return nil
+}
+
+// HLC is a hybrid logical clock. Like a Lamport clock it orders every event
+// after the ones that causally precede it, but its timestamps stay within
+// the clock drift of physical time, so they also read as wall clock times
+// and order unrelated events roughly as they happened. It is safe for
+// concurrent use
+type HLC struct {
+	maxDrift time.Duration
+	physical func() time.Time
+
+	mu   sync.Mutex
+	last HLCTimestamp
+}
+
+// NewHLC creates a clock reading physical time from physical, or time.Now
+// if nil. Remote timestamps more than maxDrift ahead of physical time are
+// rejected so that one node's bad clock cannot drag every clock forward;
+// zero or less accepts any drift
+func NewHLC(maxDrift time.Duration, physical func() time.Time) *HLC {
+	if physical == nil {
+		physical = time.Now
+	}
+	return &HLC{maxDrift: maxDrift, physical: physical}
+}
+
+// Now returns the timestamp of a local or send event
+func (c *HLC) Now() HLCTimestamp {
+	pt := c.physical().UnixNano()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt > c.last.Wall {
+		c.last = HLCTimestamp{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update merges remote, the timestamp of a received message, and returns the
+// timestamp of the receive event. It fails with ErrClockDrift, leaving the
+// clock alone, if remote is further ahead of physical time than the drift
+// bound allows
+func (c *HLC) Update(remote HLCTimestamp) (HLCTimestamp, error) {
+	pt := c.physical().UnixNano()
+	if c.maxDrift > 0 && time.Duration(remote.Wall-pt) > c.maxDrift {
+		return HLCTimestamp{}, fmt.Errorf("%w: remote clock %v ahead, bound is %v", ErrClockDrift, time.Duration(remote.Wall-pt), c.maxDrift)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := max(c.last.Wall, remote.Wall, pt)
+	var logical uint32
+	switch {
+	case wall == c.last.Wall && wall == remote.Wall:
+		logical = max(c.last.Logical, remote.Logical) + 1
+	case wall == c.last.Wall:
+		logical = c.last.Logical + 1
+	case wall == remote.Wall:
+		logical = remote.Logical + 1
+	}
+	c.last = HLCTimestamp{Wall: wall, Logical: logical}
+	return c.last, nil
+}
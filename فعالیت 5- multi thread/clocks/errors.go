@@ -0,0 +1,7 @@
+package clocks
+
+import "errors"
+
+// ErrClockDrift is reported for a remote hybrid logical clock timestamp
+// further ahead of local physical time than the configured drift bound
+var ErrClockDrift = errors.New("clock drift exceeds bound")
@@ -0,0 +1,1298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"multithread/bench"
+	"multithread/config"
+	"multithread/election"
+	"multithread/kv"
+	"multithread/linearize"
+	"multithread/paxos"
+	"multithread/pubsub"
+	"multithread/raft"
+	"multithread/taskqueue"
+)
+
+// logLevels are the levels of slog's default logger
+var logLevels = taskqueue.NewLogLevelVar(taskqueue.LogLevels{})
+
+// setupLogging makes slog's default logger, which the log package writes
+// through as well, follow the environment: LOG_LEVEL holds levels as
+// ParseLogLevels reads them, such as info,raft=debug, and LOG_FORMAT=json
+// switches from text to JSON lines
+func setupLogging() {
+	levels, err := taskqueue.ParseLogLevels(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	logLevels.Set(levels)
+	slog.SetDefault(taskqueue.NewLogger(os.Stderr, logLevels, os.Getenv("LOG_FORMAT") == "json"))
+}
+
+// runCoordinator listens for workers, waits for the requested number to
+// register and then benchmarks them with sleep tasks
+func runCoordinator(args []string) {
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	listen := fs.String("listen", settings.Cluster.Listen, "`address` to accept workers on")
+	workers := fs.Int("workers", 1, "number of workers to wait for")
+	tasks := fs.Int("tasks", settings.Pool.Tasks, "number of tasks to dispatch")
+	duration := fs.Duration("duration", settings.Pool.TaskDuration, "simulated duration of each task")
+	grpcDefault, quicDefault, webSocketDefault := transportFlags(settings.Transport)
+	useGRPC := fs.Bool("grpc", grpcDefault, "accept workers and clients over gRPC instead of TCP")
+	useQUIC := fs.Bool("quic", quicDefault, "accept and dial workers over QUIC instead of TCP")
+	useWebSocket := fs.Bool("websocket", webSocketDefault, "accept and dial workers over WebSocket instead of TCP")
+	faultSpec := fs.String("faults", "", "inject faults into the coordinator's messages as `rule` says, such as drop=0.01,delay=0.1:10ms-50ms")
+	latency := fs.String("latency", "", "delay every message the coordinator receives by a latency drawn from `distribution`, such as pareto:1ms,1.5")
+	gateway := fs.String("gateway", "", "also let WebSocket clients, such as browsers, submit tasks at `address`")
+	adminAddr := fs.String("admin", "", "serve the admin API workerctl talks to at `address`, and keep serving it once the -tasks finished")
+	wire := fs.String("wire", settings.Transport.Wire, "`format` of the TCP connections this node dials: binary, protobuf, gob, msgpack or json; accepted ones use the dialer's")
+	lease := fs.Duration("lease", settings.Cluster.Lease, "redeliver tasks not acknowledged within this long (0 disables leases)")
+	logPath := fs.String("log", settings.Storage.Log, "persist tasks to the write-ahead log at `file` and resume unfinished ones")
+	heartbeat := fs.Duration("heartbeat", settings.Cluster.Heartbeat, "expected worker heartbeat `interval`; silent workers are suspected and then dropped (0 disables)")
+	registry := fs.String("registry", settings.Cluster.Registry, "also dial the workers advertised in the registry at `URL`")
+	selector := fs.String("selector", "", "only discover workers with these comma-separated key=value `labels`")
+	nodeID := fs.Uint64("node-id", settings.Cluster.NodeID, "this coordinator's ID in leader elections; the highest live ID leads")
+	electionAddr := fs.String("election-listen", ":7200", "`address` to take part in leader elections on")
+	peerList := fs.String("peers", strings.Join(settings.Cluster.Peers, ","), "comma-separated id=address `list` of the other coordinators; when set, only the elected leader serves")
+	breakerRate := fs.Float64("breaker", 0, "stop dispatching to a worker for a while once this `fraction` of its recent tasks failed (0 disables)")
+	tracePath := fs.String("trace", settings.Storage.Trace, "append a JSON line per task span to `file`")
+	healthAddr := fs.String("health", "", "serve liveness and readiness probes at /healthz and /readyz on `address`, and the -config settings at /config")
+	drainTimeout := fs.Duration("drain", settings.Cluster.Drain, "on SIGINT or SIGTERM, wait this long for running tasks before exiting; queued ones stay in the -log")
+	dashboardAddr := fs.String("dashboard", "", "serve a dashboard of the registered workers at `address`, and the unfinished tasks at /tasks")
+	tlsOpts := addTLSFlags(fs)
+	tokenKey := fs.String("token-key", "", "require workers and gRPC clients to present tokens signed with the HMAC secret or Ed25519 key in `file`")
+	balancer := fs.String("balancer", "", "choose among idle workers with the `strategy` round-robin, least-connections, weighted or p2c (default first to ask)")
+	fs.Parse(args)
+	labels, err := taskqueue.ParseLabels(*selector)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tlsConfig := tlsOpts.config()
+	transport := withLatency(withFaults(newTransport(*useGRPC, *useQUIC, *useWebSocket, *wire, tlsConfig), *faultSpec), *latency)
+	reloader := watchSettings(context.Background())
+	health := taskqueue.NewHealth(0)
+	if *logPath != "" {
+		health.AddReadiness("storage", taskqueue.StorageCheck(filepath.Dir(*logPath)))
+	}
+	if *healthAddr != "" {
+		mux := http.NewServeMux()
+		health.Mount(mux)
+		mountSettings(mux, reloader)
+		go func() { log.Fatal(serveHTTP(*healthAddr, mux, tlsConfig)) }()
+	}
+	if *peerList != "" {
+		peers, err := taskqueue.ParsePeers(*peerList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		elector := election.NewBully(election.Config{
+			ID:        *nodeID,
+			Addr:      *electionAddr,
+			Peers:     peers,
+			Transport: transport,
+			OnEvent: func(ev election.Event) {
+				if ev.Kind != election.Started {
+					slog.Info("election", "event", ev.Kind, "leader", ev.Leader, taskqueue.LogKeyNode, *nodeID)
+				}
+			},
+		})
+		go func() { log.Fatal(elector.Run(context.Background())) }()
+		health.AddReadiness("leader", taskqueue.LeaderCheck(elector.IsLeader))
+		slog.Info("standing by until elected", taskqueue.LogKeyNode, *nodeID)
+		for !elector.IsLeader() {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	l, err := transport.Listen(*listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []taskqueue.CoordinatorOption{taskqueue.WithCoordinatorLogger(slog.Default().With(taskqueue.LogKeyNode, *nodeID))}
+	if *tokenKey != "" {
+		key, err := taskqueue.LoadTokenKey(*tokenKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, taskqueue.WithTokenAuth(key))
+	}
+	if *tracePath != "" {
+		exporter, closeTrace := openSpanExporter(*tracePath)
+		defer closeTrace()
+		opts = append(opts, taskqueue.WithTracerProvider(taskqueue.NewBasicTracerProvider(exporter)))
+	}
+	if *balancer != "" {
+		picker, err := taskqueue.NewPicker(*balancer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, taskqueue.WithPicker(picker))
+	}
+	if *breakerRate > 0 {
+		opts = append(opts, taskqueue.WithCircuitBreaker(taskqueue.BreakerConfig{
+			FailureRate: *breakerRate,
+			OnChange: func(worker string, from, to taskqueue.BreakerState) {
+				slog.Info("breaker changed", taskqueue.LogKeyWorker, worker, "from", from, "to", to)
+			},
+		}))
+	}
+	if *lease > 0 {
+		opts = append(opts, taskqueue.WithLease(*lease))
+	}
+	if *heartbeat > 0 {
+		opts = append(opts, taskqueue.WithHeartbeat(taskqueue.HeartbeatConfig{Interval: *heartbeat}))
+	}
+	if *logPath != "" {
+		taskLog, err := taskqueue.OpenTaskLog(*logPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer taskLog.Close()
+		opts = append(opts, taskqueue.WithTaskLog(taskLog))
+	}
+	coord := taskqueue.NewCoordinator(opts...)
+	defer coord.Close()
+	if n := len(coord.Recovered()); n > 0 {
+		slog.Info("resuming unfinished tasks", "tasks", n, "log", *logPath)
+	}
+	go coord.Serve(l)
+	drainStarted, drained := make(chan struct{}), make(chan struct{})
+	onDrainSignal(func() {
+		close(drainStarted)
+		defer close(drained)
+		ctx, stop := context.WithTimeout(context.Background(), *drainTimeout)
+		defer stop()
+		left, err := coord.Drain(ctx)
+		if err != nil {
+			slog.Warn("drain cut short", "error", err)
+		}
+		switch {
+		case left > 0 && *logPath == "":
+			slog.Warn("unfinished tasks lost without a task log", "tasks", left)
+		case left > 0:
+			slog.Info("unfinished tasks kept in the task log", "tasks", left, "log", *logPath)
+		}
+	})
+	health.AddReadiness("drain", func(context.Context) error {
+		select {
+		case <-drainStarted:
+			return taskqueue.ErrCoordinatorDraining
+		default:
+			return nil
+		}
+	})
+	if *dashboardAddr != "" {
+		dashboard := taskqueue.NewDashboard(taskqueue.DashboardConfig{})
+		dashboard.Watch("coordinator", taskqueue.CoordinatorMembers(coord))
+		dashboard.Start()
+		defer dashboard.Stop()
+		inspector := taskqueue.NewTaskInspector()
+		inspector.Register("coordinator", coord)
+		mux := http.NewServeMux()
+		mux.Handle("/", dashboard)
+		mux.Handle("/tasks", inspector)
+		go func() { log.Fatal(serveHTTP(*dashboardAddr, mux, tlsConfig)) }()
+	}
+	if *gateway != "" {
+		go func() { log.Fatal(serveHTTP(*gateway, taskqueue.NewWebSocketGateway(coord), tlsConfig)) }()
+	}
+	if *adminAddr != "" {
+		go func() { log.Fatal(serveHTTP(*adminAddr, taskqueue.AdminHandler(coord), tlsConfig)) }()
+	}
+	if *registry != "" {
+		reg := taskqueue.NewHTTPRegistry(*registry)
+		if tlsConfig != nil {
+			reg.SetTLSConfig(tlsConfig)
+		}
+		go coord.Discover(context.Background(), reg, transport, labels, time.Second)
+	}
+
+	slog.Info("coordinator listening", "addr", l.Addr(), "workers", *workers)
+	for len(coord.Workers()) < *workers {
+		select {
+		case <-drained:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	start := time.Now()
+	futures := coord.Recovered()
+	for range *tasks {
+		futures = append(futures, coord.Submit(context.Background(), "sleep", []byte(duration.String())))
+	}
+	var failed, unfinished int
+	for _, f := range futures {
+		_, err := f.Get()
+		switch {
+		case errors.Is(err, taskqueue.ErrCoordinatorClosed) || errors.Is(err, taskqueue.ErrCoordinatorDraining):
+			unfinished++
+		case err != nil:
+			failed++
+		}
+	}
+	select {
+	case <-drainStarted:
+		<-drained
+	default:
+	}
+
+	fmt.Printf("Distributed Results (%d workers):\n", len(coord.Workers()))
+	fmt.Printf("Completed Tasks: %d (%d failed, %d redelivered)\n", len(futures)-unfinished, failed, coord.Redeliveries())
+	if unfinished > 0 {
+		fmt.Printf("Unfinished Tasks: %d, left by the drain\n", unfinished)
+	}
+	fmt.Printf("Total Time: %v\n", time.Since(start))
+	if *adminAddr != "" {
+		slog.Info("serving the admin API until SIGINT or SIGTERM", "addr", *adminAddr)
+		<-drained
+	}
+}
+
+// settingsReloadInterval is how often watchSettings checks the -config
+// file for changes
+const settingsReloadInterval = 5 * time.Second
+
+// watchSettings reloads the settings from the -config file whenever it
+// changes or the process gets SIGHUP, until ctx is done, and makes slog's
+// default logger follow log.level. It returns nil if no file was given
+func watchSettings(ctx context.Context) *config.Reloader {
+	if settingsPath == "" {
+		return nil
+	}
+	r := config.NewReloader(settingsPath, settings, slog.Default())
+	r.OnChange(func(old, c config.Config) {
+		if c.Log.Level != old.Log.Level {
+			applyLogSettings(c)
+		}
+	})
+	go r.Watch(ctx, settingsReloadInterval)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if _, err := r.Reload(); err != nil {
+					slog.Warn("keeping the settings in use", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// applyLogSettings makes slog's default logger log at the levels of
+// log.level, if it sets any
+func applyLogSettings(c config.Config) {
+	if c.Log.Level == "" {
+		return
+	}
+	levels, err := taskqueue.ParseLogLevels(c.Log.Level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logLevels.Set(levels)
+}
+
+// mountSettings serves the settings r reloads at /config on mux, if r is
+// not nil
+func mountSettings(mux *http.ServeMux, r *config.Reloader) {
+	if r != nil {
+		mux.Handle("/config", r)
+	}
+}
+
+// flagsSet returns the names of the flags given on fs's command line, whose
+// values a reload must not override
+func flagsSet(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// onDrainSignal calls drain on a goroutine of its own once the process gets
+// SIGINT or SIGTERM, as orchestrators send a while before they kill it; a
+// second signal kills the process at once
+func onDrainSignal(drain func()) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		drain()
+	}()
+}
+
+// runWorker connects to a coordinator, or advertises itself in a registry
+// for coordinators to connect to, and serves the built-in handlers
+func runWorker(args []string) {
+	host, _ := os.Hostname()
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	addr := fs.String("coordinator", settings.Cluster.Coordinator, "coordinator `address`")
+	id := fs.String("id", fmt.Sprintf("%s-%d", host, os.Getpid()), "worker ID")
+	capacity := fs.Int("capacity", settings.Pool.Workers, "tasks run concurrently")
+	grpcDefault, quicDefault, webSocketDefault := transportFlags(settings.Transport)
+	useGRPC := fs.Bool("grpc", grpcDefault, "connect over gRPC instead of TCP")
+	useQUIC := fs.Bool("quic", quicDefault, "connect over QUIC instead of TCP")
+	useWebSocket := fs.Bool("websocket", webSocketDefault, "connect over WebSocket instead of TCP")
+	faultSpec := fs.String("faults", "", "inject faults into the worker's messages as `rule` says, such as drop=0.01,delay=0.1:10ms-50ms")
+	latency := fs.String("latency", "", "delay every message the worker receives by a latency drawn from `distribution`, such as pareto:1ms,1.5")
+	wire := fs.String("wire", settings.Transport.Wire, "`format` of the TCP connections this node dials: binary, protobuf, gob, msgpack or json; accepted ones use the dialer's")
+	registry := fs.String("registry", settings.Cluster.Registry, "register with the registry at `URL` and wait for coordinators instead of dialing one")
+	listen := fs.String("listen", ":7001", "`address` to accept coordinators on when using a registry")
+	advertise := fs.String("advertise", "", "`address` coordinators should dial (defaults to the listen address)")
+	labelList := fs.String("labels", "", "comma-separated key=value `labels` to register with")
+	ttl := fs.Duration("ttl", 10*time.Second, "registry lease `duration`, renewed every third of it")
+	tracePath := fs.String("trace", settings.Storage.Trace, "append a JSON line per task span to `file`")
+	token := fs.String("token", "", "`token` to present when registering, such as one printed by the token command")
+	tokenFile := fs.String("token-file", "", "read the registration token from `file` instead")
+	drainTimeout := fs.Duration("drain", settings.Cluster.Drain, "on SIGINT or SIGTERM, take no more tasks and wait this long for running ones before exiting")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	tlsConfig := tlsOpts.config()
+	transport := withLatency(withFaults(newTransport(*useGRPC, *useQUIC, *useWebSocket, *wire, tlsConfig), *faultSpec), *latency)
+	node := taskqueue.NewWorkerNode(*id, *capacity, transport)
+	node.SetLogger(slog.Default())
+	registerBuiltinHandlers(node)
+	if *tokenFile != "" {
+		b, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*token = strings.TrimSpace(string(b))
+	}
+	node.SetToken(*token)
+	node.SetRateLimit(settings.Pool.RateLimit, settings.Pool.RateBurst)
+	node.SetQueueCapacity(settings.Pool.QueueCapacity)
+	if *tracePath != "" {
+		exporter, closeTrace := openSpanExporter(*tracePath)
+		defer closeTrace()
+		node.SetTracerProvider(taskqueue.NewBasicTracerProvider(exporter))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if reloader := watchSettings(ctx); reloader != nil {
+		set := flagsSet(fs)
+		reloader.OnChange(func(old, c config.Config) {
+			if c.Pool.Workers != old.Pool.Workers && !set["capacity"] {
+				node.SetCapacity(c.Pool.Workers)
+			}
+			if c.Pool.RateLimit != old.Pool.RateLimit || c.Pool.RateBurst != old.Pool.RateBurst {
+				node.SetRateLimit(c.Pool.RateLimit, c.Pool.RateBurst)
+			}
+			if c.Pool.QueueCapacity != old.Pool.QueueCapacity {
+				node.SetQueueCapacity(c.Pool.QueueCapacity)
+			}
+		})
+	}
+	drain := func() {
+		ctx, stop := context.WithTimeout(context.Background(), *drainTimeout)
+		defer stop()
+		if err := node.Drain(ctx); err != nil {
+			slog.Warn("drain cut short", taskqueue.LogKeyWorker, *id, "error", err)
+		}
+		cancel()
+	}
+	if *registry == "" {
+		onDrainSignal(drain)
+		slog.Info("connecting", taskqueue.LogKeyWorker, *id, "coordinator", *addr)
+		if err := node.Run(ctx, *addr); err != nil && ctx.Err() == nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	labels, err := taskqueue.ParseLabels(*labelList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := transport.Listen(*listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	info := taskqueue.WorkerInfo{ID: *id, Addr: *advertise, Capacity: *capacity, Labels: labels}
+	if info.Addr == "" {
+		info.Addr = l.Addr()
+	}
+	reg := taskqueue.NewHTTPRegistry(*registry)
+	if tlsConfig != nil {
+		reg.SetTLSConfig(tlsConfig)
+	}
+	if err := reg.RegisterLease(ctx, info, *ttl); err != nil {
+		log.Fatal(err)
+	}
+	defer reg.Deregister(context.Background(), *id)
+	keepCtx, leave := context.WithCancel(ctx)
+	go taskqueue.KeepRegistered(keepCtx, reg, info, *ttl)
+	onDrainSignal(func() {
+		// No coordinator should discover the worker while it drains
+		leave()
+		reg.Deregister(context.Background(), *id)
+		drain()
+	})
+
+	slog.Info("registered", taskqueue.LogKeyWorker, *id, "registry", *registry, "addr", info.Addr)
+	if err := node.Listen(ctx, l); err != nil && ctx.Err() == nil {
+		slog.Error("serving coordinators failed", taskqueue.LogKeyWorker, *id, "error", err)
+	}
+}
+
+// runConfig prints the settings the other commands take their flag
+// defaults from, after the -config file and the environment, as YAML
+func runConfig(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Parse(args)
+
+	if err := settings.WriteYAML(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runToken prints a token signed with a key file, for workers and clients
+// of a coordinator run with -token-key
+func runToken(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	keyPath := fs.String("key", "", "sign with the HMAC secret or Ed25519 private key in `file`")
+	subject := fs.String("sub", "", "`name` of the token's holder")
+	scopes := fs.String("scope", taskqueue.ScopeWorker, "comma-separated `scopes` to grant: submit, worker or admin")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the token is valid (0 for ever)")
+	fs.Parse(args)
+
+	key, err := taskqueue.LoadTokenKey(*keyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	claims := taskqueue.TokenClaims{Subject: *subject, Scopes: strings.Split(*scopes, ","), IssuedAt: time.Now()}
+	if *ttl > 0 {
+		claims.ExpiresAt = claims.IssuedAt.Add(*ttl)
+	}
+	token, err := key.Sign(claims)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(token)
+}
+
+// workerctlUsage describes the workerctl subcommands
+const workerctlUsage = `usage: workerctl [flags] command [arguments]
+
+commands:
+  submit [-wait] [-correlation id] [-key key] name [payload]
+                                 submit a task
+  status [id]                    an overview of the coordinator, or the status of a task
+  nodes                          list the registered workers
+  drain-node id                  stop dispatching to a worker
+  cancel-task id                 cancel a task
+  bench [-n N] [-c C] name [payload]
+                                 submit N tasks from C clients, waiting for each, and report the latency
+
+flags:
+`
+
+// runWorkerctl manages a coordinator run with -admin from the shell
+func runWorkerctl(args []string) {
+	fs := flag.NewFlagSet("workerctl", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), workerctlUsage)
+		fs.PrintDefaults()
+	}
+	addr := fs.String("coordinator", "http://localhost:7600", "`URL` of the coordinator's admin API")
+	token := fs.String("token", "", "`token` to present, such as one printed by the token command")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client := taskqueue.NewAdminClient(*addr)
+	client.SetToken(*token)
+	if tlsConfig := tlsOpts.config(); tlsConfig != nil {
+		client.SetTLSConfig(tlsConfig)
+	}
+	ctx := context.Background()
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	var err error
+	switch cmd {
+	case "submit":
+		sub := flag.NewFlagSet("submit", flag.ExitOnError)
+		wait := sub.Bool("wait", false, "wait for the task to finish and print its outcome")
+		correlation := sub.String("correlation", "", "give the task this correlation `ID` instead of a generated one")
+		key := sub.String("key", "", "route the task by this `key` on a coordinator with key routing")
+		sub.Parse(args)
+		if sub.NArg() < 1 {
+			log.Fatal("submit: missing task name")
+		}
+		if *correlation != "" {
+			ctx = taskqueue.WithCorrelationID(ctx, *correlation)
+		}
+		var t taskqueue.AdminTask
+		if t, err = client.SubmitKeyed(ctx, *key, sub.Arg(0), []byte(sub.Arg(1)), *wait); err == nil {
+			printAdminTask(t)
+		}
+	case "status":
+		if len(args) == 0 {
+			var s taskqueue.AdminStatus
+			if s, err = client.Status(ctx); err == nil {
+				fmt.Printf("workers: %d\nqueued: %d\nrunning: %d\nredeliveries: %d\n", len(s.Workers), s.Queued, s.Running, s.Redeliveries)
+				printLatencies(s.Latencies)
+			}
+			break
+		}
+		var t taskqueue.AdminTask
+		if t, err = client.Task(ctx, parseTaskID(args[0])); err == nil {
+			printAdminTask(t)
+		}
+	case "nodes":
+		var nodes []taskqueue.WorkerStatus
+		if nodes, err = client.Nodes(ctx); err == nil {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tADDR\tSTATE\tCAPACITY\tINFLIGHT\tDRAINING")
+			for _, n := range nodes {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%t\n", n.ID, n.Addr, n.State, n.Capacity, n.Inflight, n.Draining)
+			}
+			tw.Flush()
+		}
+	case "drain-node":
+		if len(args) != 1 {
+			log.Fatal("drain-node: want a worker ID")
+		}
+		if err = client.Drain(ctx, args[0]); err == nil {
+			fmt.Printf("draining %s\n", args[0])
+		}
+	case "cancel-task":
+		if len(args) != 1 {
+			log.Fatal("cancel-task: want a task ID")
+		}
+		if err = client.Cancel(ctx, parseTaskID(args[0])); err == nil {
+			fmt.Printf("cancelled %s\n", args[0])
+		}
+	case "bench":
+		sub := flag.NewFlagSet("bench", flag.ExitOnError)
+		n := sub.Int("n", 1000, "number of tasks to submit")
+		clients := sub.Int("c", 16, "number of concurrent clients")
+		sub.Parse(args)
+		if sub.NArg() < 1 {
+			log.Fatal("bench: missing task name")
+		}
+		err = benchAdmin(ctx, client, sub.Arg(0), []byte(sub.Arg(1)), *n, *clients)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseTaskID parses a task ID given to workerctl
+func parseTaskID(s string) uint64 {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		log.Fatalf("invalid task ID %q", s)
+	}
+	return id
+}
+
+// printAdminTask prints the status of a task, one field a line
+func printAdminTask(t taskqueue.AdminTask) {
+	fmt.Printf("id: %d\nname: %s\ncorrelation: %s\nstate: %s\n", t.ID, t.Name, t.Correlation, t.State)
+	if t.Worker != "" {
+		fmt.Printf("worker: %s\n", t.Worker)
+	}
+	if t.Attempt > 0 {
+		fmt.Printf("attempt: %d\n", t.Attempt)
+	}
+	if t.Output != "" {
+		fmt.Printf("output: %s\n", t.Output)
+	}
+	if t.Error != "" {
+		fmt.Printf("error: %s\n", t.Error)
+	}
+}
+
+// printLatencies prints a line of quantiles for each phase of latency
+func printLatencies(l taskqueue.PhaseLatencies) {
+	for _, phase := range []struct {
+		name    string
+		latency taskqueue.LatencySummary
+	}{{"queue wait", l.QueueWait}, {"execution", l.Execution}, {"end to end", l.EndToEnd}} {
+		s := phase.latency
+		fmt.Printf("%s: %d tasks, mean %.2fms, p50 %.2fms, p99 %.2fms, max %.2fms\n", phase.name, s.Count, s.Mean, s.P50, s.P99, s.Max)
+	}
+}
+
+// benchAdmin submits n calls of the named task from the given number of
+// concurrent clients, each waiting for its task before submitting the
+// next, and prints the throughput and latency through the admin API. Tasks
+// that fail count as such; the first submit the API refuses stops the run
+func benchAdmin(ctx context.Context, client *taskqueue.AdminClient, name string, payload []byte, n, clients int) error {
+	var latency taskqueue.Histogram
+	var failed, next atomic.Int64
+	var refused error
+	var once sync.Once
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range max(clients, 1) {
+		wg.Go(func() {
+			for next.Add(1) <= int64(n) {
+				began := time.Now()
+				t, err := client.Submit(ctx, name, payload, true)
+				if err != nil {
+					once.Do(func() { refused = err })
+					next.Store(int64(n))
+					return
+				}
+				if t.State != "succeeded" {
+					failed.Add(1)
+				}
+				latency.Record(time.Since(began))
+			}
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if refused != nil {
+		return fmt.Errorf("bench: %w", refused)
+	}
+	fmt.Printf("Tasks: %d (%d failed) from %d clients\n", n, failed.Load(), max(clients, 1))
+	fmt.Printf("Total Time: %v\n", elapsed)
+	fmt.Printf("Throughput: %.1f tasks/s\n", float64(n)/elapsed.Seconds())
+	fmt.Printf("Latency: p50 %v, p99 %v, max %v\n", latency.Quantile(0.5), latency.Quantile(0.99), latency.Max())
+	return nil
+}
+
+// openSpanExporter opens path for appending spans as JSON lines
+func openSpanExporter(path string) (taskqueue.SpanExporter, func()) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return taskqueue.NewJSONSpanExporter(f), func() { f.Close() }
+}
+
+// runRegistry serves an in-memory worker registry over HTTP
+func runRegistry(args []string) {
+	fs := flag.NewFlagSet("registry", flag.ExitOnError)
+	listen := fs.String("listen", ":7100", "`address` to serve the registry on")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	slog.Info("registry listening", "addr", *listen)
+	log.Fatal(serveHTTP(*listen, taskqueue.RegistryHandler(taskqueue.NewMemoryRegistry()), tlsOpts.config()))
+}
+
+// runLockServer serves an in-memory lock manager over HTTP
+func runLockServer(args []string) {
+	fs := flag.NewFlagSet("locks", flag.ExitOnError)
+	listen := fs.String("listen", ":7200", "`address` to serve the locks on")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	slog.Info("lock server listening", "addr", *listen)
+	log.Fatal(serveHTTP(*listen, taskqueue.LockHandler(taskqueue.NewLockManager()), tlsOpts.config()))
+}
+
+// runBroker serves an in-memory pub/sub broker to publishers and subscribers
+func runBroker(args []string) {
+	fs := flag.NewFlagSet("broker", flag.ExitOnError)
+	listen := fs.String("listen", ":7300", "`address` to accept publishers and subscribers on")
+	useGRPC := fs.Bool("grpc", false, "accept connections over gRPC instead of TCP")
+	workers := fs.Int("workers", 16, "number of workers delivering publications")
+	backlog := fs.Int("backlog", 1024, "publications queued per subscription before the oldest is dropped")
+	healthAddr := fs.String("health", "", "serve liveness and readiness probes at /healthz and /readyz on `address`, and the -config settings at /config")
+	maxQueued := fs.Int("max-queued", 1024, "deliveries that may wait for a busy worker before the broker reports it is not ready")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	reloader := watchSettings(context.Background())
+	pool := taskqueue.NewApacheThreadPool(*workers, taskqueue.WithName("broker"), taskqueue.WithLogger(slog.Default()))
+	defer pool.Shutdown()
+	if *healthAddr != "" {
+		health := taskqueue.NewHealth(0)
+		health.AddReadiness("pool", taskqueue.PoolCheck(pool, *maxQueued))
+		mux := http.NewServeMux()
+		health.Mount(mux)
+		mountSettings(mux, reloader)
+		go func() { log.Fatal(serveHTTP(*healthAddr, mux, tlsOpts.config())) }()
+	}
+	broker := pubsub.NewBroker(pool, pubsub.Config{Backlog: *backlog})
+	defer broker.Close()
+
+	slog.Info("broker listening", "addr", *listen)
+	if err := pubsub.NewServer(broker).Serve(context.Background(), newTransport(*useGRPC, false, false, "binary", tlsOpts.config()), *listen); err != nil {
+		slog.Error("broker failed", "error", err)
+	}
+}
+
+// runKVServer runs one node of a Raft-replicated key-value store and serves
+// it over HTTP
+func runKVServer(args []string) {
+	fs := flag.NewFlagSet("kv", flag.ExitOnError)
+	id := fs.Uint64("id", 1, "this node's Raft ID")
+	raftAddr := fs.String("raft-listen", ":7401", "`address` to accept Raft RPCs from the other nodes on")
+	listen := fs.String("listen", ":7400", "`address` to serve the store over HTTP on")
+	peerList := fs.String("peers", "", "comma-separated id=address `list` of the other nodes' Raft addresses")
+	dir := fs.String("dir", settings.Storage.Dir, "persist the Raft term, vote and log in `directory`")
+	tlsOpts := addTLSFlags(fs)
+	fs.Parse(args)
+
+	peers, err := taskqueue.ParsePeers(*peerList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig := tlsOpts.config()
+	node, err := kv.NewNode(raft.Config{ID: *id, Addr: *raftAddr, Peers: peers, Transport: &taskqueue.TCPTransport{TLS: tlsConfig}, Dir: *dir, Logger: slog.Default()})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		log.Fatal(node.Run(context.Background()))
+	}()
+
+	health := taskqueue.NewHealth(0)
+	health.AddReadiness("raft", raft.Check(node.Raft()))
+	if *dir != "" {
+		health.AddReadiness("storage", taskqueue.StorageCheck(*dir))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", kv.Handler(node))
+	health.Mount(mux)
+	mountSettings(mux, watchSettings(context.Background()))
+
+	slog.Info("kv node listening", taskqueue.LogKeyNode, *id, "addr", *listen)
+	log.Fatal(serveHTTP(*listen, mux, tlsConfig))
+}
+
+// runLamportDemo prints the events of simulated nodes in Lamport order
+func runLamportDemo(args []string) {
+	fs := flag.NewFlagSet("lamport", flag.ExitOnError)
+	nodes := fs.Int("nodes", 3, "number of simulated nodes")
+	steps := fs.Int("steps", 5, "events per node")
+	seed := fs.Uint64("seed", 1, "random seed for the events")
+	fs.Parse(args)
+
+	if err := taskqueue.SimulateLamport(os.Stdout, *nodes, *steps, *seed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// simScenarios are the simulations the paxos command records and replay
+// runs again, by the name in their trace header
+var simScenarios = map[string]taskqueue.SimScenario{
+	"paxos": func(w io.Writer, s *taskqueue.Sim, params []int) error {
+		if len(params) != 2 {
+			return fmt.Errorf("paxos trace: want 2 parameters, got %d", len(params))
+		}
+		return paxos.SimulateOn(w, s, params[0], params[1])
+	},
+}
+
+// runPaxosDemo has simulated proposers compete for a Paxos decision on a
+// deterministic schedule
+func runPaxosDemo(args []string) {
+	fs := flag.NewFlagSet("paxos", flag.ExitOnError)
+	proposers := fs.Int("proposers", 3, "number of competing proposers")
+	acceptors := fs.Int("acceptors", 5, "number of acceptors")
+	seed := fs.Uint64("seed", 1, "random seed for the schedule and message delays")
+	record := fs.String("record", "", "write a trace of every scheduling event to `file`, for the replay command")
+	fs.Parse(args)
+
+	var trace io.Writer
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		trace = f
+	}
+	header := taskqueue.SimTraceHeader{Scenario: "paxos", Params: []int{*proposers, *acceptors}, Seed: *seed}
+	if err := taskqueue.RunSimScenario(os.Stdout, simScenarios[header.Scenario], header, trace); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runReplay runs a recorded simulation again, checking it takes the same
+// path, optionally printing or stepping through its events
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "print every event")
+	step := fs.Bool("step", false, "pause before every event until Enter is pressed; c and Enter continues to the end")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: replay [-v] [-step] trace-file")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	trace, err := taskqueue.ReadSimTrace(f)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	scenario, ok := simScenarios[trace.Header.Scenario]
+	if !ok {
+		log.Fatalf("replay: unknown scenario %q", trace.Header.Scenario)
+	}
+	slog.Info("replaying", "scenario", trace.Header.Scenario, "params", trace.Header.Params, "seed", trace.Header.Seed, "events", len(trace.Events))
+
+	var onEvent func(taskqueue.SimEvent)
+	if *verbose || *step {
+		stdin := bufio.NewScanner(os.Stdin)
+		stepping := *step
+		onEvent = func(e taskqueue.SimEvent) {
+			fmt.Fprintln(os.Stderr, e)
+			if stepping {
+				if !stdin.Scan() || strings.TrimSpace(stdin.Text()) == "c" {
+					stepping = false
+				}
+			}
+		}
+	}
+	if err := taskqueue.ReplaySimTrace(os.Stdout, scenario, trace, onEvent); err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("replay matched", "events", len(trace.Events))
+}
+
+// runScenarioDemo runs a scripted failure scenario against simulated Paxos
+func runScenarioDemo(args []string) {
+	fs := flag.NewFlagSet("scenario", flag.ExitOnError)
+	seed := fs.Uint64("seed", 1, "random seed for the schedule and message delays")
+	fs.Parse(args)
+
+	if err := paxos.SimulateScenario(os.Stdout, *seed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runPartitionDemo checks consensus, quorums and membership across a network
+// partition
+func runPartitionDemo(args []string) {
+	fs := flag.NewFlagSet("partition", flag.ExitOnError)
+	nodes := fs.Int("nodes", 5, "number of simulated hosts")
+	fs.Parse(args)
+
+	if err := linearize.SimulatePartitions(os.Stdout, *nodes); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runLinearizeDemo checks the history of concurrent clients of a simulated
+// replicated KV store for linearizability
+func runLinearizeDemo(args []string) {
+	fs := flag.NewFlagSet("linearize", flag.ExitOnError)
+	nodes := fs.Int("nodes", 3, "number of simulated store nodes")
+	clients := fs.Int("clients", 4, "number of concurrent clients")
+	operations := fs.Int("ops", 100, "operations per client")
+	stale := fs.Bool("stale", false, "read replicas' applied state instead of through the leader")
+	seed := fs.Uint64("seed", 1, "random seed for the operations")
+	fs.Parse(args)
+
+	if err := linearize.Simulate(os.Stdout, *nodes, *clients, *operations, *stale, *seed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runOracleDemo checks the history of clients of a simulated replicated KV
+// store, partitioned midway, against what the partition allows
+func runOracleDemo(args []string) {
+	fs := flag.NewFlagSet("oracle", flag.ExitOnError)
+	nodes := fs.Int("nodes", 5, "number of simulated store nodes")
+	clients := fs.Int("clients", 6, "number of concurrent clients")
+	operations := fs.Int("ops", 100, "operations per client")
+	seed := fs.Uint64("seed", 1, "random seed for the operations")
+	fs.Parse(args)
+
+	if err := linearize.SimulateOracle(os.Stdout, *nodes, *clients, *operations, *seed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runClusterDemo crashes, stops and restarts the nodes of an in-process
+// cluster while it runs tasks
+func runClusterDemo(args []string) {
+	fs := flag.NewFlagSet("cluster", flag.ExitOnError)
+	workers := fs.Int("workers", 3, "number of worker nodes")
+	tasks := fs.Int("tasks", 500, "tasks per batch")
+	seed := fs.Uint64("seed", 1, "random seed for the task durations")
+	fs.Parse(args)
+
+	if err := taskqueue.SimulateCluster(os.Stdout, *workers, *tasks, *seed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runDashboardDemo serves the dashboard of pools under load and of an
+// in-process cluster whose workers crash and restart
+func runDashboardDemo(args []string) {
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:7500", "`address` to serve the dashboard on")
+	workers := fs.Int("workers", 8, "workers of each pool")
+	length := fs.Duration("for", 0, "stop after this long (0 runs until interrupted)")
+	seed := fs.Uint64("seed", 1, "random seed for the load and the crashes")
+	fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := taskqueue.SimulateDashboard(ctx, os.Stdout, *listen, *workers, *length, *seed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runBenchRegress runs the pool benchmarks, stores the results under the
+// current git commit and compares them against a baseline commit's, exiting
+// with an error if throughput regressed
+func runBenchRegress(args []string) {
+	fs := flag.NewFlagSet("regress", flag.ExitOnError)
+	dir := fs.String("dir", ".bench", "directory of stored results, one file per commit")
+	baseline := fs.String("baseline", "", "commit to compare against; without it the results are only stored")
+	threshold := fs.Float64("threshold", 0.05, "largest throughput drop tolerated, as a fraction")
+	alpha := fs.Float64("alpha", 0.05, "significance level of the comparison")
+	compareOnly := fs.Bool("compare", false, "compare the stored results of -commit against -baseline without running the benchmark")
+	commit := fs.String("commit", "", "commit to store the results under, the checked out one by default")
+	workers := fs.String("workers", "4,16", "comma-separated pool `sizes` to benchmark")
+	tasks := fs.Int("tasks", 2000, "number of tasks per trial")
+	duration := fs.String("duration", "fixed:0s", "task duration `distribution`, as for bench")
+	warmup := fs.Int("warmup", 1, "untimed warm-up trials per pool")
+	trials := fs.Int("trials", 10, "measured trials per pool")
+	seed := fs.Uint64("seed", 1, "random seed for task durations")
+	fs.Parse(args)
+
+	if *commit == "" {
+		c, err := bench.GitCommit()
+		if err != nil {
+			log.Fatal(err)
+		}
+		*commit = c
+	}
+	var current *bench.Record
+	if *compareOnly {
+		r, err := bench.LoadRecord(*dir, *commit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		current = r
+	} else {
+		cfg := bench.Config{Tasks: *tasks, Warmup: *warmup, Trials: *trials, Seed: *seed}
+		for _, s := range strings.Split(*workers, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				log.Fatalf("invalid -workers: %v", err)
+			}
+			cfg.Workers = append(cfg.Workers, n)
+		}
+		dist, err := taskqueue.ParseDistribution(*duration)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Duration = dist
+		current = bench.NewRecord(*commit, cfg, bench.Run(cfg, taskqueue.DefaultBenchPools()))
+		if err := bench.SaveRecord(*dir, current); err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("stored bench results", "commit", *commit, "dir", *dir)
+	}
+	if *baseline == "" {
+		return
+	}
+	base, err := bench.LoadRecord(*dir, *baseline)
+	if err != nil {
+		log.Fatal(err)
+	}
+	comparisons, err := bench.Compare(base, current, *threshold, *alpha)
+	if comparisons != nil {
+		bench.WriteComparison(os.Stdout, base.Commit, current.Commit, comparisons)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runLoadGen runs every pool under a generated load: tasks arriving by an
+// arrival process, or submitted by closed-loop clients with -clients
+func runLoadGen(args []string) {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	arrivals := fs.String("arrivals", "poisson:2000", "task arrival `process`: poisson:RATE, constant:RATE or bursty:RATE,BURST, in tasks per second")
+	clients := fs.Int("clients", 0, "run a closed loop of this many clients instead of -arrivals")
+	think := fs.String("think", "fixed:0s", "think time `distribution` of closed-loop clients")
+	workers := fs.String("workers", "16", "comma-separated pool `sizes` to load")
+	tasks := fs.Int("tasks", 5000, "number of tasks to submit")
+	duration := fs.String("duration", "exp:5ms", "task duration `distribution`, as for bench")
+	seed := fs.Uint64("seed", 1, "random seed for arrivals and durations")
+	only := fs.String("pool", "", "load only the pool of this name")
+	fs.Parse(args)
+
+	cfg := bench.LoadConfig{Clients: *clients, Tasks: *tasks, Seed: *seed}
+	var err error
+	if cfg.Clients <= 0 {
+		if cfg.Arrivals, err = bench.ParseArrivals(*arrivals); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.Think, err = taskqueue.ParseDistribution(*think); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Duration, err = taskqueue.ParseDistribution(*duration); err != nil {
+		log.Fatal(err)
+	}
+	pools := taskqueue.DefaultBenchPools()
+	if *only != "" {
+		pools = slices.DeleteFunc(pools, func(p taskqueue.BenchPool) bool { return p.Name != *only })
+		if len(pools) == 0 {
+			log.Fatalf("unknown pool %q", *only)
+		}
+	}
+	var results []bench.LoadResult
+	for _, s := range strings.Split(*workers, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			log.Fatalf("invalid -workers: %v", err)
+		}
+		for _, pool := range pools {
+			results = append(results, bench.RunLoad(cfg, pool, n))
+		}
+	}
+	if err := bench.WriteLoadText(os.Stdout, results); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runStallDemo deadlocks a simple pool on purpose to show what the stall
+// detector reports
+func runStallDemo(args []string) {
+	fs := flag.NewFlagSet("stall", flag.ExitOnError)
+	workers := fs.Int("workers", 4, "worker slots of the deadlocked pool")
+	after := fs.Duration("after", 2*time.Second, "time without progress that counts as a stall")
+	fs.Parse(args)
+
+	if err := taskqueue.SimulateStall(os.Stdout, *workers, *after); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runChaos either keeps copies of the command given after the flags running
+// while killing and restarting them, as in
+//
+//	chaos -n 3 -interval 5s -- ./app worker -coordinator host:7000
+//
+// or, with no command, checks that tasks survive in-process worker churn
+func runChaos(args []string) {
+	fs := flag.NewFlagSet("chaos", flag.ExitOnError)
+	copies := fs.Int("n", 3, "copies of the command to keep running")
+	workers := fs.Int("workers", 4, "in-process workers, without a command")
+	tasks := fs.Int("tasks", 500, "tasks to submit, without a command")
+	interval := fs.Duration("interval", 200*time.Millisecond, "mean time between kills")
+	downtime := fs.Duration("downtime", time.Second, "longest time a killed member stays down")
+	maxDown := fs.Int("max-down", 1, "most members down at once, with a command")
+	latency := fs.String("latency", "", "message latency distribution, without a command, as for bench")
+	loss := fs.Float64("loss", 0, "probability that a message is lost, without a command")
+	seed := fs.Uint64("seed", 1, "random seed for the kills")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		link := taskqueue.MemoryLink{Loss: *loss}
+		if *latency != "" {
+			dist, err := taskqueue.ParseDistribution(*latency)
+			if err != nil {
+				log.Fatal(err)
+			}
+			link.Latency = dist
+		}
+		if err := taskqueue.SimulateChurn(os.Stdout, *workers, *tasks, *interval, link, *seed); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	monkey := taskqueue.NewChaosMonkey(taskqueue.ChaosConfig{
+		Interval: *interval, MaxDowntime: *downtime, MaxDown: *maxDown, Seed: *seed,
+		OnEvent: func(e taskqueue.ChaosEvent) {
+			if e.Err != nil {
+				slog.Info("chaos", "event", e.Kind, "member", e.Member, "error", e.Err)
+			} else {
+				slog.Info("chaos", "event", e.Kind, "member", e.Member)
+			}
+		},
+	})
+	for i := range *copies {
+		monkey.Add(fmt.Sprintf("%s#%d", fs.Arg(0), i+1), taskqueue.ChaosProcess(fs.Arg(0), fs.Args()[1:]...))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	monkey.Run(ctx)
+}
+
+// runSkewDemo checks HLC ordering and lease fencing between simulated nodes
+// whose clocks disagree
+func runSkewDemo(args []string) {
+	fs := flag.NewFlagSet("skew", flag.ExitOnError)
+	nodes := fs.Int("nodes", 3, "number of simulated nodes")
+	skew := fs.Duration("skew", 200*time.Millisecond, "largest initial clock offset")
+	drift := fs.Float64("drift", 1e-3, "largest clock drift rate, in seconds gained or lost per second")
+	bound := fs.Duration("bound", 250*time.Millisecond, "largest clock difference the HLCs accept")
+	seed := fs.Uint64("seed", 1, "random seed for the simulation")
+	fs.Parse(args)
+
+	if err := taskqueue.SimulateClockSkew(os.Stdout, *nodes, *skew, *drift, *bound, *seed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runSnapshotDemo takes Chandy-Lamport snapshots of simulated bank accounts
+func runSnapshotDemo(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	nodes := fs.Int("nodes", 4, "number of simulated accounts")
+	snapshots := fs.Int("snapshots", 5, "number of snapshots to take")
+	seed := fs.Uint64("seed", 1, "random seed for the transfers")
+	fs.Parse(args)
+
+	if err := taskqueue.SimulateSnapshots(os.Stdout, *nodes, *snapshots, *seed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// registerBuiltinHandlers installs the tasks the coordinator command dispatches
+func registerBuiltinHandlers(node *taskqueue.WorkerNode) {
+	node.Handle("sleep", func(ctx context.Context, payload []byte) ([]byte, error) {
+		d, err := time.ParseDuration(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(d):
+			return nil, nil
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	})
+	node.Handle("echo", func(ctx context.Context, payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+}
+
+// newTransport returns the transport selected by the command-line flags,
+// secured with tlsConfig if it is set
+func newTransport(useGRPC, useQUIC, useWebSocket bool, wire string, tlsConfig *tls.Config) taskqueue.Transport {
+	if useGRPC {
+		return &taskqueue.GRPCTransport{TLS: tlsConfig}
+	}
+	if useQUIC {
+		return &taskqueue.QUICTransport{TLS: tlsConfig}
+	}
+	if useWebSocket {
+		return &taskqueue.WebSocketTransport{TLS: tlsConfig}
+	}
+	format, err := taskqueue.ParseWireFormat(wire)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &taskqueue.TCPTransport{Format: format, TLS: tlsConfig}
+}
+
+// withFaults wraps t to inject the faults of the -faults rule, if one is set
+func withFaults(t taskqueue.Transport, spec string) taskqueue.Transport {
+	if spec == "" {
+		return t
+	}
+	rule, err := taskqueue.ParseFaultRule(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return taskqueue.NewFaultTransport(t, rand.Uint64(), rule)
+}
+
+// withLatency wraps t to delay the messages it receives as the -latency
+// distribution says, if one is set
+func withLatency(t taskqueue.Transport, spec string) taskqueue.Transport {
+	if spec == "" {
+		return t
+	}
+	dist, err := taskqueue.ParseDistribution(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return taskqueue.NewLatencyTransport(t, dist, rand.Uint64())
+}
+
+// tlsFlags are the TLS flags of the commands that serve or dial over the
+// network
+type tlsFlags struct {
+	cert, key, ca *string
+	clientAuth    *bool
+}
+
+// addTLSFlags defines the TLS flags on fs
+func addTLSFlags(fs *flag.FlagSet) *tlsFlags {
+	return &tlsFlags{
+		cert:       fs.String("tls-cert", settings.Transport.TLSCert, "serve and dial over TLS with the PEM certificate chain in `file`"),
+		key:        fs.String("tls-key", settings.Transport.TLSKey, "PEM private key `file` of the TLS certificate"),
+		ca:         fs.String("tls-ca", settings.Transport.TLSCA, "verify peers against the PEM authorities in `file` instead of the system roots; enables TLS without a certificate of one's own"),
+		clientAuth: fs.Bool("mtls", settings.Transport.MTLS, "require connecting nodes to present a certificate signed by the TLS authorities"),
+	}
+}
+
+// config loads the credentials the flags name and keeps reloading them as
+// their files change; it returns nil if TLS is off
+func (f *tlsFlags) config() *tls.Config {
+	if *f.cert == "" && *f.ca == "" {
+		return nil
+	}
+	creds, err := taskqueue.LoadTLSCredentials(taskqueue.TLSConfig{
+		CertFile:   *f.cert,
+		KeyFile:    *f.key,
+		CAFile:     *f.ca,
+		ClientAuth: *f.clientAuth,
+		OnReload: func(err error) {
+			if err != nil {
+				slog.Warn("keeping the old TLS credentials", "error", err)
+			} else {
+				slog.Info("reloaded TLS credentials")
+			}
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go creds.Watch(context.Background())
+	return creds.Config()
+}
+
+// serveHTTP serves h on addr, over TLS if tlsConfig is set
+func serveHTTP(addr string, h http.Handler, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return http.ListenAndServe(addr, h)
+	}
+	srv := &http.Server{Addr: addr, Handler: h, TLSConfig: tlsConfig}
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,335 @@
+// Package config loads the settings of the commands from a YAML file and
+// the environment, and reloads them while the commands run
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// EnvPrefix prefixes the environment variables overriding settings, as in
+// TASKQUEUE_POOL_WORKERS
+const EnvPrefix = "TASKQUEUE"
+
+// Config holds the settings of every command, loaded by Read. They are the
+// defaults of the commands' flags, so a flag overrides the environment,
+// which overrides the file, which overrides the built-in defaults of
+// Default. The settings tagged reload can be changed by a Reloader while a
+// command runs; the others take a restart
+type Config struct {
+	Pool      PoolSettings      `yaml:"pool"`
+	Transport TransportSettings `yaml:"transport"`
+	Storage   StorageSettings   `yaml:"storage"`
+	Cluster   ClusterSettings   `yaml:"cluster"`
+	Log       LogSettings       `yaml:"log"`
+}
+
+// PoolSettings size the benchmarked pools, the worker nodes' pools and the
+// simulated workload
+type PoolSettings struct {
+	// Workers is the size of the benchmarked pools and the capacity of a
+	// worker node
+	Workers int `yaml:"workers" reload:"true"`
+	// Tasks is the number of tasks a benchmark trial or a coordinator runs
+	Tasks int `yaml:"tasks"`
+	// TaskDuration is how long each simulated task of a coordinator sleeps
+	TaskDuration time.Duration `yaml:"task_duration"`
+	// RateLimit is how many tasks a second a worker node starts, with
+	// bursts of up to RateBurst, and QueueCapacity how many may wait in its
+	// pool for a worker; each is unlimited at 0
+	RateLimit     float64 `yaml:"rate_limit" reload:"true"`
+	RateBurst     int     `yaml:"rate_burst" reload:"true"`
+	QueueCapacity int     `yaml:"queue_capacity" reload:"true"`
+}
+
+// TransportSettings choose how nodes connect
+type TransportSettings struct {
+	// Protocol is tcp, grpc, quic or websocket
+	Protocol string `yaml:"protocol"`
+	// Wire is the format of TCP connections, as ParseWireFormat names it
+	Wire string `yaml:"wire"`
+	// TLSCert, TLSKey and TLSCA are the PEM files of the TLS credentials,
+	// and MTLS requires connecting nodes to present a certificate
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	TLSCA   string `yaml:"tls_ca"`
+	MTLS    bool   `yaml:"mtls"`
+}
+
+// StorageSettings say where nodes persist their state
+type StorageSettings struct {
+	// Log is the write-ahead log of a coordinator's tasks
+	Log string `yaml:"log"`
+	// Dir is the directory of a key-value node's Raft state
+	Dir string `yaml:"dir"`
+	// Trace is the file task spans are appended to
+	Trace string `yaml:"trace"`
+}
+
+// ClusterSettings place a node in its cluster
+type ClusterSettings struct {
+	// Listen is the address a coordinator accepts workers on
+	Listen string `yaml:"listen"`
+	// Coordinator is the address a worker dials
+	Coordinator string `yaml:"coordinator"`
+	// Registry is the URL of the worker registry
+	Registry string `yaml:"registry"`
+	// NodeID is a coordinator's ID in leader elections
+	NodeID uint64 `yaml:"node_id"`
+	// Peers are the other coordinators as id=address pairs
+	Peers []string `yaml:"peers"`
+	// Heartbeat is the expected worker heartbeat interval, Lease how long a
+	// task may go unacknowledged and Drain how long a node waits for its
+	// running tasks on SIGINT or SIGTERM, each 0 to disable
+	Heartbeat time.Duration `yaml:"heartbeat"`
+	Lease     time.Duration `yaml:"lease"`
+	Drain     time.Duration `yaml:"drain"`
+}
+
+// LogSettings control what is logged
+type LogSettings struct {
+	// Level holds levels as ParseLogLevels reads them, and replaces
+	// LOG_LEVEL if set
+	Level string `yaml:"level" reload:"true"`
+}
+
+// Default returns the built-in settings
+func Default() Config {
+	return Config{
+		Pool:      PoolSettings{Workers: 1000, Tasks: 1000, TaskDuration: 100 * time.Millisecond},
+		Transport: TransportSettings{Protocol: "tcp", Wire: "binary"},
+		Cluster: ClusterSettings{
+			Listen:      ":7000",
+			Coordinator: "localhost:7000",
+			NodeID:      1,
+			Drain:       30 * time.Second,
+		},
+	}
+}
+
+// Read returns the default settings overridden by the YAML file at
+// path, if path is not empty, and then by the environment: each setting
+// can be set by a variable named after it, such as TASKQUEUE_POOL_WORKERS
+// or TASKQUEUE_CLUSTER_PEERS, lists being comma-separated. The result is
+// validated
+func Read(path string) (Config, error) {
+	c := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		m, err := decodeYAML(data)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := decodeSettings(reflect.ValueOf(&c).Elem(), m, ""); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := envSettings(reflect.ValueOf(&c).Elem(), EnvPrefix, os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+	if err := c.Validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Validate reports every setting out of range, joined
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("config: "+format, args...))
+		}
+	}
+	check(c.Pool.Workers > 0, "pool.workers must be positive, got %d", c.Pool.Workers)
+	check(c.Pool.Tasks >= 0, "pool.tasks must not be negative, got %d", c.Pool.Tasks)
+	check(c.Pool.TaskDuration >= 0, "pool.task_duration must not be negative, got %v", c.Pool.TaskDuration)
+	check(c.Pool.RateLimit >= 0, "pool.rate_limit must not be negative, got %v", c.Pool.RateLimit)
+	check(c.Pool.RateBurst >= 0, "pool.rate_burst must not be negative, got %d", c.Pool.RateBurst)
+	check(c.Pool.QueueCapacity >= 0, "pool.queue_capacity must not be negative, got %d", c.Pool.QueueCapacity)
+
+	switch c.Transport.Protocol {
+	case "tcp", "grpc", "quic", "websocket":
+	default:
+		check(false, "transport.protocol %q: want tcp, grpc, quic or websocket", c.Transport.Protocol)
+	}
+	if _, err := taskqueue.ParseWireFormat(c.Transport.Wire); err != nil {
+		check(false, "transport.wire: %v", err)
+	}
+	check((c.Transport.TLSCert == "") == (c.Transport.TLSKey == ""), "transport.tls_cert and transport.tls_key must be set together")
+	check(!c.Transport.MTLS || c.Transport.TLSCert != "", "transport.mtls needs transport.tls_cert")
+
+	if _, _, err := net.SplitHostPort(c.Cluster.Listen); err != nil {
+		check(false, "cluster.listen: %v", err)
+	}
+	if _, _, err := net.SplitHostPort(c.Cluster.Coordinator); err != nil {
+		check(false, "cluster.coordinator: %v", err)
+	}
+	check(c.Cluster.NodeID > 0, "cluster.node_id must be positive")
+	if _, err := taskqueue.ParsePeers(strings.Join(c.Cluster.Peers, ",")); err != nil {
+		check(false, "cluster.peers: %v", err)
+	}
+	check(c.Cluster.Heartbeat >= 0, "cluster.heartbeat must not be negative, got %v", c.Cluster.Heartbeat)
+	check(c.Cluster.Lease >= 0, "cluster.lease must not be negative, got %v", c.Cluster.Lease)
+	check(c.Cluster.Drain >= 0, "cluster.drain must not be negative, got %v", c.Cluster.Drain)
+	if _, err := taskqueue.ParseLogLevels(c.Log.Level); err != nil {
+		check(false, "log.level: %v", err)
+	}
+	return errors.Join(errs...)
+}
+
+// WriteYAML writes c as a YAML file Read reads back
+func (c Config) WriteYAML(w io.Writer) error {
+	var b strings.Builder
+	v := reflect.ValueOf(c)
+	for i := range v.NumField() {
+		section := v.Field(i)
+		fmt.Fprintf(&b, "%s:\n", v.Type().Field(i).Tag.Get("yaml"))
+		for j := range section.NumField() {
+			name := section.Type().Field(j).Tag.Get("yaml")
+			switch field := section.Field(j); {
+			case field.Kind() == reflect.Slice && field.Len() == 0:
+				fmt.Fprintf(&b, "  %s: []\n", name)
+			case field.Kind() == reflect.Slice:
+				fmt.Fprintf(&b, "  %s:\n", name)
+				for _, item := range field.Interface().([]string) {
+					fmt.Fprintf(&b, "    - %s\n", strconv.Quote(item))
+				}
+			case field.Kind() == reflect.String:
+				fmt.Fprintf(&b, "  %s: %s\n", name, strconv.Quote(field.String()))
+			default:
+				fmt.Fprintf(&b, "  %s: %v\n", name, field.Interface())
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// decodeSettings sets the fields of the struct v from the decoded YAML
+// mapping m, whose keys are the fields' yaml tags; prefix names v in errors
+func decodeSettings(v reflect.Value, m map[string]any, prefix string) error {
+	fields := make(map[string]reflect.Value, v.NumField())
+	for i := range v.NumField() {
+		fields[v.Type().Field(i).Tag.Get("yaml")] = v.Field(i)
+	}
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		value := m[key]
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown setting %s%s", prefix, key)
+		}
+		name := prefix + key
+		switch value := value.(type) {
+		case nil:
+		case map[string]any:
+			if field.Kind() != reflect.Struct {
+				return fmt.Errorf("setting %s takes a value, not a mapping", name)
+			}
+			if err := decodeSettings(field, value, name+"."); err != nil {
+				return err
+			}
+		case []string:
+			if field.Kind() != reflect.Slice {
+				return fmt.Errorf("setting %s takes a value, not a list", name)
+			}
+			field.Set(reflect.ValueOf(value))
+		case string:
+			if field.Kind() == reflect.Struct {
+				return fmt.Errorf("setting %s takes a mapping, not a value", name)
+			}
+			if err := setSetting(field, value); err != nil {
+				return fmt.Errorf("setting %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// envSettings sets the fields of the struct v from the environment, each
+// from the variable named by prefix and its yaml tag, upper-cased
+func envSettings(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := range v.NumField() {
+		name := prefix + "_" + strings.ToUpper(v.Type().Field(i).Tag.Get("yaml"))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := envSettings(field, name, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		if s, ok := lookup(name); ok {
+			if err := setSetting(field, s); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setSetting parses s into field, a duration, string, integer, number,
+// boolean or comma-separated list of strings
+func setSetting(field reflect.Value, s string) error {
+	s = strings.TrimSpace(s)
+	if field.Type() == reflect.TypeFor[time.Duration]() {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("want an integer, got %q", s)
+		}
+		field.SetInt(int64(n))
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("want a non-negative integer, got %q", s)
+		}
+		field.SetUint(n)
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("want a number, got %q", s)
+		}
+		field.SetFloat(x)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("want true or false, got %q", s)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		items := []string{}
+		for item := range strings.SplitSeq(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %v", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// Reloader keeps the settings of a running command in step with its config
+// file. Each reload applies the settings that changed and are tagged
+// reload, calling the functions given to OnChange; the other changed
+// settings are logged as needing a restart and keep their values. As an
+// http.Handler it answers GET with the settings in use, as YAML, and POST
+// by reloading at once. It is safe for concurrent use
+type Reloader struct {
+	path string
+	log  *slog.Logger
+
+	mu       sync.Mutex
+	current  Config
+	stamp    string
+	onChange []func(old, new Config)
+}
+
+// NewReloader creates a reloader of the file at path, from which current
+// was loaded, logging reloads to l as component "config"
+func NewReloader(path string, current Config, l *slog.Logger) *Reloader {
+	stamp, _ := fileStamp(path)
+	return &Reloader{path: path, log: taskqueue.ComponentLogger(l, "config"), current: current, stamp: stamp}
+}
+
+// OnChange adds fn to the functions called when a reload changed settings,
+// with the settings before and after it. They are called one reload at a
+// time, in the order they were added, and must not call r
+func (r *Reloader) OnChange(fn func(old, new Config)) {
+	r.mu.Lock()
+	r.onChange = append(r.onChange, fn)
+	r.mu.Unlock()
+}
+
+// Config returns the settings in use
+func (r *Reloader) Config() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload reads the file again and applies the settings that changed and
+// can change at runtime, returning their names. A file that does not load
+// or validate changes nothing
+func (r *Reloader) Reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stamp, err := fileStamp(r.path)
+	if err != nil {
+		return nil, err
+	}
+	next, err := Read(r.path)
+	if err != nil {
+		return nil, err
+	}
+	r.stamp = stamp
+	merged, live, restart := mergeSettings(r.current, next)
+	if len(restart) > 0 {
+		r.log.Warn("settings changed that take a restart", "settings", restart)
+	}
+	if len(live) == 0 {
+		return nil, nil
+	}
+	old := r.current
+	r.current = merged
+	for _, fn := range r.onChange {
+		fn(old, merged)
+	}
+	r.log.Info("settings reloaded", "settings", live)
+	return live, nil
+}
+
+// Watch reloads the file whenever it changes, checking every interval
+// until ctx is done. A file that does not load is logged and retried once
+// it changes again
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			stamp, err := fileStamp(r.path)
+			changed := err == nil && stamp != r.stamp
+			if changed {
+				r.stamp = stamp
+			}
+			r.mu.Unlock()
+			if !changed {
+				continue
+			}
+			if _, err := r.Reload(); err != nil {
+				r.log.Warn("keeping the settings in use", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/yaml")
+		r.Config().WriteYAML(w)
+	case http.MethodPost:
+		changed, err := r.Reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Changed []string `json:"changed"`
+		}{append([]string{}, changed...)})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// mergeSettings returns old with the settings tagged reload taken from
+// next, with the names of those that changed, and the names of the other
+// settings next changes
+func mergeSettings(old, next Config) (merged Config, live, restart []string) {
+	merged = old
+	m, n := reflect.ValueOf(&merged).Elem(), reflect.ValueOf(next)
+	for i := range m.NumField() {
+		section := m.Type().Field(i)
+		for j := range section.Type.NumField() {
+			field := section.Type.Field(j)
+			to := n.Field(i).Field(j)
+			if reflect.DeepEqual(m.Field(i).Field(j).Interface(), to.Interface()) {
+				continue
+			}
+			name := section.Tag.Get("yaml") + "." + field.Tag.Get("yaml")
+			if field.Tag.Get("reload") != "true" {
+				restart = append(restart, name)
+				continue
+			}
+			m.Field(i).Field(j).Set(to)
+			live = append(live, name)
+		}
+	}
+	return merged, live, restart
+}
+
+// fileStamp returns the size and modification time of the file at path
+func fileStamp(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d@%d", fi.Size(), fi.ModTime().UnixNano()), nil
+}
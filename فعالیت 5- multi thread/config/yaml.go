@@ -0,0 +1,222 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a YAML document with its comment and indentation
+// stripped
+type yamlLine struct {
+	n      int
+	indent int
+	text   string
+}
+
+// decodeYAML decodes the subset of YAML configuration files use: nested
+// block mappings, block sequences of scalars, flow sequences of scalars
+// such as [a, b], plain, single- and double-quoted scalars, and comments.
+// Mappings decode into map[string]any, sequences into []string and scalars
+// into string; a key without a value, or with ~ or null, decodes into nil.
+// Anchors, multi-line scalars, flow mappings and multiple documents are not
+// supported
+func decodeYAML(data []byte) (map[string]any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, " \r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs may not indent YAML", i+1)
+		}
+		text = strings.TrimRight(stripYAMLComment(text), " ")
+		if text == "" || len(lines) == 0 && text == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{n: i + 1, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	m, i, err := parseYAMLMap(lines, 0, lines[0].indent)
+	if err == nil && i < len(lines) {
+		err = fmt.Errorf("line %d: unexpected indentation", lines[i].n)
+	}
+	return m, err
+}
+
+// parseYAMLMap parses the mapping whose keys are indented by indent,
+// starting at lines[i], and returns it with the index of the line after it
+func parseYAMLMap(lines []yamlLine, i, indent int) (map[string]any, int, error) {
+	m := make(map[string]any)
+	for i < len(lines) && lines[i].indent >= indent {
+		l := lines[i]
+		if l.indent > indent {
+			return nil, i, fmt.Errorf("line %d: unexpected indentation", l.n)
+		}
+		if isYAMLItem(l.text) {
+			return nil, i, fmt.Errorf("line %d: sequence item where a key was expected", l.n)
+		}
+		key, rest, err := cutYAMLKey(l.text)
+		if err != nil {
+			return nil, i, fmt.Errorf("line %d: %w", l.n, err)
+		}
+		if _, dup := m[key]; dup {
+			return nil, i, fmt.Errorf("line %d: key %q repeated", l.n, key)
+		}
+		i++
+		switch {
+		case rest != "":
+			m[key], err = parseYAMLValue(rest)
+		case i < len(lines) && isYAMLItem(lines[i].text) && lines[i].indent >= indent:
+			m[key], i, err = parseYAMLSeq(lines, i, lines[i].indent)
+		case i < len(lines) && lines[i].indent > indent:
+			m[key], i, err = parseYAMLMap(lines, i, lines[i].indent)
+		default:
+			m[key] = nil
+		}
+		if err != nil {
+			if rest != "" {
+				err = fmt.Errorf("line %d: %w", l.n, err)
+			}
+			return nil, i, err
+		}
+	}
+	return m, i, nil
+}
+
+// parseYAMLSeq parses the block sequence whose items are indented by
+// indent, starting at lines[i], and returns it with the index of the line
+// after it
+func parseYAMLSeq(lines []yamlLine, i, indent int) ([]string, int, error) {
+	items := []string{}
+	for i < len(lines) && lines[i].indent == indent && isYAMLItem(lines[i].text) {
+		l := lines[i]
+		text := strings.TrimSpace(l.text[1:])
+		if isYAMLItem(text) || strings.HasPrefix(text, "[") || yamlKeyEnd(text) >= 0 {
+			return nil, i, fmt.Errorf("line %d: only sequences of scalars are supported", l.n)
+		}
+		item, err := parseYAMLScalar(text)
+		if err != nil {
+			return nil, i, fmt.Errorf("line %d: %w", l.n, err)
+		}
+		items = append(items, item)
+		i++
+	}
+	return items, i, nil
+}
+
+// parseYAMLValue parses what follows a key on its line: a flow sequence,
+// null, or a scalar
+func parseYAMLValue(s string) (any, error) {
+	if s == "~" || s == "null" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "[") {
+		return parseYAMLScalar(s)
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated flow sequence %q", s)
+	}
+	items := []string{}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return items, nil
+	}
+	for field := range strings.SplitSeq(inner, ",") {
+		item, err := parseYAMLScalar(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseYAMLScalar parses a plain or quoted scalar
+func parseYAMLScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("malformed double-quoted scalar %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") || strings.Contains(strings.ReplaceAll(s[1:len(s)-1], "''", ""), "'") {
+			return "", fmt.Errorf("malformed single-quoted scalar %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "{"), strings.HasPrefix(s, "&"), strings.HasPrefix(s, "*"),
+		strings.HasPrefix(s, "|"), strings.HasPrefix(s, ">"):
+		return "", fmt.Errorf("unsupported YAML %q", s)
+	default:
+		return s, nil
+	}
+}
+
+// cutYAMLKey splits "key: value" into key and value, the value empty for a
+// key that opens a block
+func cutYAMLKey(s string) (key, value string, err error) {
+	end := yamlKeyEnd(s)
+	if end < 0 {
+		return "", "", fmt.Errorf("want key: value, got %q", s)
+	}
+	key, err = parseYAMLScalar(strings.TrimSpace(s[:end]))
+	if err != nil {
+		return "", "", err
+	}
+	return key, strings.TrimSpace(s[end+1:]), nil
+}
+
+// yamlKeyEnd returns the index of the colon ending the key at the start of
+// s, or -1 if s does not start with a key. The colon must be followed by a
+// space or end the line, so values such as localhost:7000 are not keys
+func yamlKeyEnd(s string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			switch {
+			case c == '\\' && quote == '"', c == '\'' && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+				i++
+			case c == quote:
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i+1 == len(s) || s[i+1] == ' '):
+			return i
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment removes a comment from s, which starts with a # at the
+// start of s or after a space, outside a quoted scalar
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			switch {
+			case c == '\\' && quote == '"', c == '\'' && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+				i++
+			case c == quote:
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" :-[,", rune(s[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// isYAMLItem reports whether s is a block sequence item
+func isYAMLItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
@@ -0,0 +1,440 @@
+// Package crdt provides state-based CRDTs: replicas update their own copy
+// without coordination, ship it whole with MarshalBinary, and Merge the
+// copies they receive. Merge is commutative, associative and idempotent, so
+// replicas that have seen the same updates agree no matter the order or how
+// often states were exchanged. Each is bound to the ID of the node that
+// updates it, and is safe for concurrent use
+package crdt
+
+import (
+	"cmp"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"sync"
+
+	"multithread/clocks"
+	"multithread/internal/wire"
+)
+
+// GCounter is a grow-only counter: every node counts its own increments and
+// the value is their sum
+type GCounter struct {
+	node string
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// NewGCounter creates a zero counter updated by node
+func NewGCounter(node string) *GCounter {
+	return &GCounter{node: node, counts: make(map[string]uint64)}
+}
+
+// Inc adds n to the counter
+func (c *GCounter) Inc(n uint64) {
+	c.mu.Lock()
+	c.counts[c.node] += n
+	c.mu.Unlock()
+}
+
+// Value returns the sum of all nodes' increments
+func (c *GCounter) Value() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum uint64
+	for _, n := range c.counts {
+		sum += n
+	}
+	return sum
+}
+
+// Merge folds another replica's state into c, keeping the higher count of
+// every node
+func (c *GCounter) Merge(o *GCounter) {
+	counts := o.snapshot()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for node, n := range counts {
+		c.counts[node] = max(c.counts[node], n)
+	}
+}
+
+// snapshot returns a copy of the per-node counts
+func (c *GCounter) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.counts)
+}
+
+// MarshalBinary encodes the per-node counts as a uvarint count followed by
+// the uvarint-prefixed node names and uvarint counts, in node order
+func (c *GCounter) MarshalBinary() ([]byte, error) {
+	return appendCounts(nil, c.snapshot()), nil
+}
+
+// UnmarshalBinary replaces c's state with one encoded by MarshalBinary
+func (c *GCounter) UnmarshalBinary(b []byte) error {
+	r := wire.Reader{B: b}
+	counts := readCounts(&r)
+	if r.Err != nil {
+		return r.Err
+	}
+	c.mu.Lock()
+	c.counts = counts
+	c.mu.Unlock()
+	return nil
+}
+
+// appendCounts appends per-node counts in node order
+func appendCounts(b []byte, counts map[string]uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(len(counts)))
+	for _, node := range slices.Sorted(maps.Keys(counts)) {
+		b = wire.AppendBytes(b, []byte(node))
+		b = binary.AppendUvarint(b, counts[node])
+	}
+	return b
+}
+
+// readCounts reads counts written by appendCounts
+func readCounts(r *wire.Reader) map[string]uint64 {
+	n := r.Uvarint()
+	// Every entry takes at least two bytes
+	if n > uint64(len(r.B))/2 {
+		r.Err = wire.ErrMalformed
+		return nil
+	}
+	counts := make(map[string]uint64, n)
+	for range n {
+		node := string(r.Bytes())
+		counts[node] = r.Uvarint()
+	}
+	return counts
+}
+
+// PNCounter is a counter that can also go down: a pair of grow-only
+// counters for the increments and the decrements
+type PNCounter struct {
+	inc *GCounter
+	dec *GCounter
+}
+
+// NewPNCounter creates a zero counter updated by node
+func NewPNCounter(node string) *PNCounter {
+	return &PNCounter{inc: NewGCounter(node), dec: NewGCounter(node)}
+}
+
+// Add adds delta, which may be negative, to the counter
+func (c *PNCounter) Add(delta int64) {
+	if delta >= 0 {
+		c.inc.Inc(uint64(delta))
+	} else {
+		c.dec.Inc(uint64(-delta))
+	}
+}
+
+// Value returns the increments minus the decrements
+func (c *PNCounter) Value() int64 {
+	return int64(c.inc.Value() - c.dec.Value())
+}
+
+// Merge folds another replica's state into c
+func (c *PNCounter) Merge(o *PNCounter) {
+	c.inc.Merge(o.inc)
+	c.dec.Merge(o.dec)
+}
+
+// MarshalBinary encodes the increments followed by the decrements, each as
+// GCounter.MarshalBinary does
+func (c *PNCounter) MarshalBinary() ([]byte, error) {
+	b := appendCounts(nil, c.inc.snapshot())
+	return appendCounts(b, c.dec.snapshot()), nil
+}
+
+// UnmarshalBinary replaces c's state with one encoded by MarshalBinary
+func (c *PNCounter) UnmarshalBinary(b []byte) error {
+	r := wire.Reader{B: b}
+	inc := readCounts(&r)
+	dec := readCounts(&r)
+	if r.Err != nil {
+		return r.Err
+	}
+	c.inc.mu.Lock()
+	c.inc.counts = inc
+	c.inc.mu.Unlock()
+	c.dec.mu.Lock()
+	c.dec.counts = dec
+	c.dec.mu.Unlock()
+	return nil
+}
+
+// orTag identifies one addition to an ORSet
+type orTag struct {
+	node string
+	seq  uint64
+}
+
+// ORSet is an observed-remove set of strings: every addition gets a unique
+// tag and a removal deletes only the tags it observed, so an element added
+// concurrently with its removal stays in the set. Removed tags are kept as
+// tombstones to stop merges from bringing them back
+type ORSet struct {
+	node string
+
+	mu         sync.Mutex
+	seq        uint64
+	adds       map[string]map[orTag]bool
+	tombstones map[orTag]bool
+}
+
+// NewORSet creates an empty set updated by node
+func NewORSet(node string) *ORSet {
+	return &ORSet{node: node, adds: make(map[string]map[orTag]bool), tombstones: make(map[orTag]bool)}
+}
+
+// Add adds e to the set
+func (s *ORSet) Add(e string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	tags := s.adds[e]
+	if tags == nil {
+		tags = make(map[orTag]bool)
+		s.adds[e] = tags
+	}
+	tags[orTag{s.node, s.seq}] = true
+}
+
+// Remove removes e as far as this replica has seen it added
+func (s *ORSet) Remove(e string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tag := range s.adds[e] {
+		s.tombstones[tag] = true
+	}
+	delete(s.adds, e)
+}
+
+// Contains reports whether e is in the set
+func (s *ORSet) Contains(e string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.adds[e]) > 0
+}
+
+// Elements returns the elements of the set, sorted
+func (s *ORSet) Elements() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(maps.Keys(s.adds))
+}
+
+// Merge folds another replica's state into s: the union of the additions
+// minus the union of the removals
+func (s *ORSet) Merge(o *ORSet) {
+	o.mu.Lock()
+	adds := make(map[string][]orTag, len(o.adds))
+	for e, tags := range o.adds {
+		adds[e] = slices.Collect(maps.Keys(tags))
+	}
+	tombstones := slices.Collect(maps.Keys(o.tombstones))
+	o.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tag := range tombstones {
+		s.tombstones[tag] = true
+	}
+	for e, tags := range adds {
+		for _, tag := range tags {
+			if s.tombstones[tag] {
+				continue
+			}
+			if s.adds[e] == nil {
+				s.adds[e] = make(map[orTag]bool)
+			}
+			s.adds[e][tag] = true
+		}
+	}
+	for e, tags := range s.adds {
+		for tag := range tags {
+			if s.tombstones[tag] {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.adds, e)
+		}
+	}
+	// Keep our own tags unique even after restoring an older state
+	for _, tags := range s.adds {
+		for tag := range tags {
+			if tag.node == s.node {
+				s.seq = max(s.seq, tag.seq)
+			}
+		}
+	}
+	for tag := range s.tombstones {
+		if tag.node == s.node {
+			s.seq = max(s.seq, tag.seq)
+		}
+	}
+}
+
+// MarshalBinary encodes the elements, each with its tags, followed by the
+// tombstones; a tag is its uvarint-prefixed node name and uvarint sequence
+// number
+func (s *ORSet) MarshalBinary() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := binary.AppendUvarint(nil, uint64(len(s.adds)))
+	for _, e := range slices.Sorted(maps.Keys(s.adds)) {
+		b = wire.AppendBytes(b, []byte(e))
+		b = appendTags(b, s.adds[e])
+	}
+	return appendTags(b, s.tombstones), nil
+}
+
+// UnmarshalBinary replaces s's state with one encoded by MarshalBinary
+func (s *ORSet) UnmarshalBinary(b []byte) error {
+	r := wire.Reader{B: b}
+	n := r.Uvarint()
+	if n > uint64(len(r.B))/2 {
+		return wire.ErrMalformed
+	}
+	adds := make(map[string]map[orTag]bool, n)
+	for range n {
+		e := string(r.Bytes())
+		adds[e] = readTags(&r)
+	}
+	tombstones := readTags(&r)
+	if r.Err != nil {
+		return r.Err
+	}
+	fresh := &ORSet{node: s.node, adds: adds, tombstones: tombstones}
+	s.mu.Lock()
+	s.adds, s.tombstones = make(map[string]map[orTag]bool), make(map[orTag]bool)
+	s.mu.Unlock()
+	s.Merge(fresh)
+	return nil
+}
+
+// appendTags appends a set of tags in a stable order
+func appendTags(b []byte, tags map[orTag]bool) []byte {
+	sorted := slices.SortedFunc(maps.Keys(tags), func(a, b orTag) int {
+		return cmp.Or(cmp.Compare(a.node, b.node), cmp.Compare(a.seq, b.seq))
+	})
+	b = binary.AppendUvarint(b, uint64(len(sorted)))
+	for _, tag := range sorted {
+		b = wire.AppendBytes(b, []byte(tag.node))
+		b = binary.AppendUvarint(b, tag.seq)
+	}
+	return b
+}
+
+// readTags reads tags written by appendTags
+func readTags(r *wire.Reader) map[orTag]bool {
+	n := r.Uvarint()
+	if n > uint64(len(r.B))/2 {
+		r.Err = wire.ErrMalformed
+		return nil
+	}
+	tags := make(map[orTag]bool, n)
+	for range n {
+		node := string(r.Bytes())
+		tags[orTag{node, r.Uvarint()}] = true
+	}
+	return tags
+}
+
+// LWWRegister is a last-writer-wins register: a value stamped with the
+// hybrid logical clock time of its write, where merging keeps the later
+// write and breaks ties by node ID. Concurrent writes are resolved by
+// discarding all but one
+type LWWRegister struct {
+	node  string
+	clock *clocks.HLC
+
+	mu     sync.Mutex
+	value  []byte
+	stamp  clocks.HLCTimestamp
+	writer string
+}
+
+// NewLWWRegister creates an unset register written by node, stamping writes
+// with clock
+func NewLWWRegister(node string, clock *clocks.HLC) *LWWRegister {
+	return &LWWRegister{node: node, clock: clock}
+}
+
+// Set writes v
+func (r *LWWRegister) Set(v []byte) {
+	stamp := r.clock.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.value, r.stamp, r.writer = slices.Clone(v), stamp, r.node
+}
+
+// Get returns the value and the time it was written; the time is zero if
+// the register was never set
+func (r *LWWRegister) Get() ([]byte, clocks.HLCTimestamp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.value), r.stamp
+}
+
+// Merge folds another replica's state into r, keeping the later write and
+// moving r's clock past it so that r's next write wins over it
+func (r *LWWRegister) Merge(o *LWWRegister) {
+	o.mu.Lock()
+	value, stamp, writer := o.value, o.stamp, o.writer
+	o.mu.Unlock()
+	r.merge(value, stamp, writer)
+}
+
+// merge keeps the write of value at stamp by writer if it is the later one
+func (r *LWWRegister) merge(value []byte, stamp clocks.HLCTimestamp, writer string) {
+	if writer == "" {
+		return
+	}
+	// A remote stamp beyond the drift bound still orders the write; the
+	// clock just stays put
+	r.clock.Update(stamp)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c := stamp.Compare(r.stamp); c > 0 || c == 0 && writer > r.writer {
+		r.value, r.stamp, r.writer = slices.Clone(value), stamp, writer
+	}
+}
+
+// MarshalBinary encodes the write time as clocks.HLCTimestamp.MarshalBinary
+// does, then the uvarint-prefixed writer and value
+func (r *LWWRegister) MarshalBinary() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, _ := r.stamp.MarshalBinary()
+	b = wire.AppendBytes(b, []byte(r.writer))
+	return wire.AppendBytes(b, r.value), nil
+}
+
+// UnmarshalBinary replaces r's state with one encoded by MarshalBinary
+func (r *LWWRegister) UnmarshalBinary(b []byte) error {
+	if len(b) < clocks.HLCTimestampSize {
+		return wire.ErrMalformed
+	}
+	var stamp clocks.HLCTimestamp
+	if err := stamp.UnmarshalBinary(b[:clocks.HLCTimestampSize]); err != nil {
+		return err
+	}
+	mr := wire.Reader{B: b[clocks.HLCTimestampSize:]}
+	writer := string(mr.Bytes())
+	value := mr.Bytes()
+	if mr.Err != nil {
+		return mr.Err
+	}
+	r.mu.Lock()
+	r.value, r.stamp, r.writer = nil, clocks.HLCTimestamp{}, ""
+	r.mu.Unlock()
+	r.merge(value, stamp, writer)
+	return nil
+}
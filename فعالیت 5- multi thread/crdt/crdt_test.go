@@ -0,0 +1,197 @@
+package crdt
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"multithread/clocks"
+)
+
+// state is a replica of any of the CRDTs
+type state interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// crdtType describes one CRDT to the property tests
+type crdtType struct {
+	name string
+	// replicas returns three replicas that took different updates
+	replicas func() []state
+	// empty returns a replica of node that saw no updates
+	empty func(node string) state
+	// merge folds b into a
+	merge func(a, b state)
+	// value reads a replica, and want is the value of all three merged
+	value func(state) string
+	want  string
+}
+
+// fixedClock returns a clock whose physical time never moves, so that
+// concurrent writes tie on their stamps and the writer breaks the tie
+func fixedClock() *clocks.HLC {
+	now := time.Unix(1_700_000_000, 0)
+	return clocks.NewHLC(0, func() time.Time { return now })
+}
+
+var crdtTypes = []crdtType{
+	{
+		name: "GCounter",
+		replicas: func() []state {
+			a, b, c := NewGCounter("a"), NewGCounter("b"), NewGCounter("c")
+			a.Inc(3)
+			b.Inc(5)
+			c.Merge(a)
+			c.Inc(2)
+			return []state{a, b, c}
+		},
+		empty: func(node string) state { return NewGCounter(node) },
+		merge: func(a, b state) { a.(*GCounter).Merge(b.(*GCounter)) },
+		value: func(s state) string { return fmt.Sprint(s.(*GCounter).Value()) },
+		want:  "10",
+	},
+	{
+		name: "PNCounter",
+		replicas: func() []state {
+			a, b, c := NewPNCounter("a"), NewPNCounter("b"), NewPNCounter("c")
+			a.Add(5)
+			b.Add(-3)
+			c.Merge(a)
+			c.Add(4)
+			c.Add(-1)
+			return []state{a, b, c}
+		},
+		empty: func(node string) state { return NewPNCounter(node) },
+		merge: func(a, b state) { a.(*PNCounter).Merge(b.(*PNCounter)) },
+		value: func(s state) string { return fmt.Sprint(s.(*PNCounter).Value()) },
+		want:  "5",
+	},
+	{
+		name: "ORSet",
+		replicas: func() []state {
+			a, b, c := NewORSet("a"), NewORSet("b"), NewORSet("c")
+			a.Add("x")
+			a.Add("y")
+			b.Merge(a)
+			b.Remove("x")
+			b.Add("w")
+			// Added again concurrently with b's removal, so x stays
+			a.Add("x")
+			c.Add("y")
+			c.Add("z")
+			c.Remove("z")
+			return []state{a, b, c}
+		},
+		empty: func(node string) state { return NewORSet(node) },
+		merge: func(a, b state) { a.(*ORSet).Merge(b.(*ORSet)) },
+		value: func(s state) string { return strings.Join(s.(*ORSet).Elements(), ",") },
+		want:  "w,x,y",
+	},
+	{
+		name: "LWWRegister",
+		replicas: func() []state {
+			a := NewLWWRegister("a", fixedClock())
+			b := NewLWWRegister("b", fixedClock())
+			c := NewLWWRegister("c", fixedClock())
+			// a and b write at the same time; c writes after seeing a
+			a.Set([]byte("x"))
+			b.Set([]byte("y"))
+			c.Merge(a)
+			c.Set([]byte("z"))
+			return []state{a, b, c}
+		},
+		empty: func(node string) state { return NewLWWRegister(node, fixedClock()) },
+		merge: func(a, b state) { a.(*LWWRegister).Merge(b.(*LWWRegister)) },
+		value: func(s state) string {
+			v, _ := s.(*LWWRegister).Get()
+			return string(v)
+		},
+		want: "z",
+	},
+}
+
+// encode returns the encoding of s, which is deterministic and so compares
+// replica states
+func encode(t *testing.T, s state) []byte {
+	t.Helper()
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// clone returns a fresh replica of node holding the state of s
+func (tt crdtType) clone(t *testing.T, node string, s state) state {
+	t.Helper()
+	c := tt.empty(node)
+	if err := c.UnmarshalBinary(encode(t, s)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// merged returns a copy of the first of states with the rest merged into it
+// in order
+func (tt crdtType) merged(t *testing.T, states ...state) state {
+	t.Helper()
+	m := tt.clone(t, "m", states[0])
+	for _, s := range states[1:] {
+		tt.merge(m, s)
+	}
+	return m
+}
+
+func TestMergeProperties(t *testing.T) {
+	for _, tt := range crdtTypes {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.replicas()
+			a, b, c := r[0], r[1], r[2]
+			same := func(what string, x, y state) {
+				t.Helper()
+				if ex, ey := encode(t, x), encode(t, y); !bytes.Equal(ex, ey) {
+					t.Errorf("%s: states differ: %s is %q, the other %q", what, tt.name, tt.value(x), tt.value(y))
+				}
+			}
+
+			same("commutative", tt.merged(t, a, b), tt.merged(t, b, a))
+			same("associative", tt.merged(t, tt.merged(t, a, b), c), tt.merged(t, a, tt.merged(t, b, c)))
+			same("idempotent", tt.merged(t, a, a), a)
+			same("idempotent after a merge", tt.merged(t, a, b, b), tt.merged(t, a, b))
+
+			for _, order := range [][]state{{a, b, c}, {c, a, b}, {b, c, a}, {c, b, a}} {
+				if got := tt.value(tt.merged(t, order...)); got != tt.want {
+					t.Errorf("replicas merged read %s, want %s", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, tt := range crdtTypes {
+		t.Run(tt.name, func(t *testing.T) {
+			states := append(tt.replicas(), tt.empty("e"))
+			states = append(states, tt.merged(t, states...))
+			for i, s := range states {
+				b := encode(t, s)
+				decoded := tt.clone(t, "d", s)
+				if got := encode(t, decoded); !bytes.Equal(got, b) {
+					t.Errorf("state %d: %x encodes back as %x", i, b, got)
+				}
+				if got, want := tt.value(decoded), tt.value(s); got != want {
+					t.Errorf("state %d: decoded replica reads %s, want %s", i, got, want)
+				}
+				if len(b) > 1 {
+					if err := tt.empty("d").UnmarshalBinary(b[:len(b)-1]); err == nil {
+						t.Errorf("state %d: truncated encoding %x accepted", i, b[:len(b)-1])
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+// Package election elects a leader among a fixed set of nodes over a
+// taskqueue Transport with the Bully algorithm
+package election
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// EventKind identifies an Event
+type EventKind int
+
+const (
+	// Started is reported when the node starts an election
+	Started EventKind = iota
+	// LeaderElected is reported when the node learns of a new leader,
+	// including itself
+	LeaderElected
+	// LeaderLost is reported when the node stops hearing from the leader
+	LeaderLost
+)
+
+// String returns the event kind name
+func (k EventKind) String() string {
+	switch k {
+	case Started:
+		return "election started"
+	case LeaderElected:
+		return "leader elected"
+	case LeaderLost:
+		return "leader lost"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event is a change in a node's view of the leadership
+type Event struct {
+	Kind EventKind
+	// Leader is the elected or lost leader; zero for Started
+	Leader uint64
+}
+
+// Config configures a Bully elector
+type Config struct {
+	// ID identifies the node; the live node with the highest ID leads
+	ID uint64
+	// Addr is the address the node accepts election messages on
+	Addr string
+	// Peers maps the IDs of the other nodes to their addresses
+	Peers map[uint64]string
+	// Transport carries the election messages
+	Transport taskqueue.Transport
+	// Timeout bounds each exchange with a peer and how long to wait for a
+	// higher node that answered to announce its victory; defaults to 500ms
+	Timeout time.Duration
+	// PingInterval is how often followers check that the leader is alive;
+	// defaults to one second
+	PingInterval time.Duration
+	// OnEvent, if set, is called for every election event
+	OnEvent func(Event)
+}
+
+// Bully elects a leader among a fixed set of nodes with the Bully algorithm:
+// a node that suspects the leader asks every higher node to take over and
+// declares itself leader if none answers
+type Bully struct {
+	cfg     Config
+	kick    chan struct{}
+	victory chan struct{}
+
+	mu        sync.Mutex
+	leader    uint64
+	hasLeader bool
+}
+
+// NewBully creates an elector; Run starts it
+func NewBully(cfg Config) *Bully {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 500 * time.Millisecond
+	}
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = time.Second
+	}
+	return &Bully{
+		cfg:     cfg,
+		kick:    make(chan struct{}, 1),
+		victory: make(chan struct{}, 1),
+	}
+}
+
+// Leader returns the current leader, if one is known
+func (e *Bully) Leader() (uint64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader, e.hasLeader
+}
+
+// IsLeader reports whether this node is the leader
+func (e *Bully) IsLeader() bool {
+	leader, ok := e.Leader()
+	return ok && leader == e.cfg.ID
+}
+
+// Run takes part in elections until ctx is cancelled; elections are run one
+// at a time from this goroutine
+func (e *Bully) Run(ctx context.Context) error {
+	l, err := e.cfg.Transport.Listen(e.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	go e.serve(l)
+
+	e.elect(ctx)
+	ticker := time.NewTicker(e.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-e.kick:
+			e.elect(ctx)
+		case <-ticker.C:
+			if !e.leaderAlive(ctx) {
+				e.elect(ctx)
+			}
+		}
+	}
+}
+
+// elect runs elections until this node wins or a higher one announces its
+// victory
+func (e *Bully) elect(ctx context.Context) {
+	for ctx.Err() == nil {
+		e.emit(Event{Kind: Started})
+		select {
+		case <-e.victory:
+		default:
+		}
+
+		if !e.higherAnswered(ctx) {
+			e.setLeader(e.cfg.ID)
+			e.broadcast(ctx, &taskqueue.Message{Type: taskqueue.MsgVictory, ID: e.cfg.ID})
+			return
+		}
+		select {
+		case <-e.victory:
+			if leader, _ := e.Leader(); leader > e.cfg.ID {
+				return
+			}
+		case <-time.After(e.cfg.Timeout):
+			// The node that answered died before announcing; start over
+		case <-ctx.Done():
+		}
+	}
+}
+
+// higherAnswered asks every node with a higher ID to take over and reports
+// whether any of them answered
+func (e *Bully) higherAnswered(ctx context.Context) bool {
+	answers := make(chan bool, len(e.cfg.Peers))
+	var wg sync.WaitGroup
+	for id, addr := range e.cfg.Peers {
+		if id <= e.cfg.ID {
+			continue
+		}
+		wg.Go(func() {
+			reply, err := e.exchange(ctx, addr, &taskqueue.Message{Type: taskqueue.MsgElection, ID: e.cfg.ID}, true)
+			answers <- err == nil && reply.Type == taskqueue.MsgAnswer
+		})
+	}
+	wg.Wait()
+	close(answers)
+	answered := false
+	for ok := range answers {
+		answered = answered || ok
+	}
+	return answered
+}
+
+// leaderAlive pings the leader, forgetting it if it does not answer as leader
+func (e *Bully) leaderAlive(ctx context.Context) bool {
+	leader, ok := e.Leader()
+	if !ok {
+		return false
+	}
+	if leader == e.cfg.ID {
+		return true
+	}
+	reply, err := e.exchange(ctx, e.cfg.Peers[leader], &taskqueue.Message{Type: taskqueue.MsgHeartbeat, ID: e.cfg.ID}, true)
+	if err == nil && reply.ID == leader {
+		return true
+	}
+
+	e.mu.Lock()
+	lost := e.hasLeader && e.leader == leader
+	if lost {
+		e.hasLeader = false
+	}
+	e.mu.Unlock()
+	if lost {
+		e.emit(Event{Kind: LeaderLost, Leader: leader})
+	}
+	return false
+}
+
+// broadcast sends m to every peer without waiting for replies
+func (e *Bully) broadcast(ctx context.Context, m *taskqueue.Message) {
+	var wg sync.WaitGroup
+	for _, addr := range e.cfg.Peers {
+		wg.Go(func() { e.exchange(ctx, addr, m, false) })
+	}
+	wg.Wait()
+}
+
+// exchange sends m to the node at addr and, if wantReply is set, waits for
+// its reply, all within the timeout
+func (e *Bully) exchange(ctx context.Context, addr string, m *taskqueue.Message, wantReply bool) (*taskqueue.Message, error) {
+	return taskqueue.RoundTrip(ctx, e.cfg.Transport, addr, m, wantReply, e.cfg.Timeout)
+}
+
+// serve answers election messages from other nodes until l is closed
+func (e *Bully) serve(l taskqueue.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go e.handle(conn)
+	}
+}
+
+// handle answers the one message sent on conn
+func (e *Bully) handle(conn taskqueue.Conn) {
+	defer conn.Close()
+	m, err := conn.Recv()
+	if err != nil {
+		return
+	}
+
+	switch m.Type {
+	case taskqueue.MsgElection:
+		// A lower node is electing; bully it and take over
+		conn.Send(&taskqueue.Message{Type: taskqueue.MsgAnswer, ID: e.cfg.ID})
+		e.startElection()
+	case taskqueue.MsgVictory:
+		e.setLeader(m.ID)
+		select {
+		case e.victory <- struct{}{}:
+		default:
+		}
+		if m.ID < e.cfg.ID {
+			e.startElection()
+		}
+	case taskqueue.MsgHeartbeat:
+		leader, _ := e.Leader()
+		conn.Send(&taskqueue.Message{Type: taskqueue.MsgHeartbeat, ID: leader})
+	}
+}
+
+// startElection asks Run to hold an election unless one is already pending
+func (e *Bully) startElection() {
+	select {
+	case e.kick <- struct{}{}:
+	default:
+	}
+}
+
+// setLeader records leader, reporting it if it changed
+func (e *Bully) setLeader(leader uint64) {
+	e.mu.Lock()
+	changed := !e.hasLeader || e.leader != leader
+	e.leader, e.hasLeader = leader, true
+	e.mu.Unlock()
+	if changed {
+		e.emit(Event{Kind: LeaderElected, Leader: leader})
+	}
+}
+
+// emit reports ev to the OnEvent hook
+func (e *Bully) emit(ev Event) {
+	if e.cfg.OnEvent != nil {
+		e.cfg.OnEvent(ev)
+	}
+}
@@ -0,0 +1,3 @@
+module multithread
+
+go 1.25
@@ -0,0 +1,155 @@
+// Package hashring implements consistent hashing with virtual nodes, which
+// the task queue routes keyed tasks and places replicas with
+package hashring
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// defaultVirtualNodes is how many points each node gets on a Ring
+const defaultVirtualNodes = 128
+
+// Ring maps keys to nodes by consistent hashing: every node owns the
+// arcs of the ring ending at its virtual nodes, so adding or removing a node
+// only moves the keys on its own arcs, about 1/n of them. It is safe for
+// concurrent use
+type Ring struct {
+	vnodes int
+
+	mu     sync.RWMutex
+	points []uint64
+	owners map[uint64]string
+	nodes  map[string]bool
+}
+
+// New creates an empty ring placing vnodes virtual nodes per node;
+// zero or less uses the default of 128
+func New(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+	return &Ring{vnodes: vnodes, owners: make(map[uint64]string), nodes: make(map[string]bool)}
+}
+
+// Add places nodes on the ring; nodes already on it are left alone
+func (r *Ring) Add(nodes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, node := range nodes {
+		if r.nodes[node] {
+			continue
+		}
+		r.nodes[node] = true
+		for i := range r.vnodes {
+			p := Hash(node + "#" + strconv.Itoa(i))
+			// On the rare collision the lower name keeps the point, so every
+			// ring with the same nodes agrees
+			if owner, taken := r.owners[p]; taken {
+				if owner < node {
+					continue
+				}
+			} else {
+				r.points = append(r.points, p)
+			}
+			r.owners[p] = node
+		}
+	}
+	slices.Sort(r.points)
+}
+
+// Remove takes node off the ring, handing its keys to the nodes that follow
+// its virtual nodes
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	r.points = slices.DeleteFunc(r.points, func(p uint64) bool {
+		if r.owners[p] != node {
+			return false
+		}
+		delete(r.owners, p)
+		return true
+	})
+	// Points we lost a collision for belong to node's rival again
+	for other := range r.nodes {
+		for i := range r.vnodes {
+			p := Hash(other + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[p]; !taken {
+				r.owners[p] = other
+				r.points = append(r.points, p)
+			}
+		}
+	}
+	slices.Sort(r.points)
+}
+
+// Get returns the node that owns key, or false if the ring is empty
+func (r *Ring) Get(key string) (string, bool) {
+	nodes := r.GetN(key, 1)
+	if len(nodes) == 0 {
+		return "", false
+	}
+	return nodes[0], true
+}
+
+// GetN returns up to n distinct nodes for key in ring order, starting with
+// its owner; the later ones are the natural replicas, and the next owners
+// should the earlier ones leave
+func (r *Ring) GetN(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+	nodes := make([]string, 0, n)
+	start, _ := slices.BinarySearch(r.points, Hash(key))
+	for i := 0; len(nodes) < n; i++ {
+		node := r.owners[r.points[(start+i)%len(r.points)]]
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Nodes returns the nodes on the ring, sorted
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+// Len returns the number of nodes on the ring
+func (r *Ring) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.nodes)
+}
+
+// Hash places s on the ring, and serves as a well-mixed 64-bit hash of s
+// elsewhere, such as for partitioning keys. FNV-1a alone clusters similar
+// strings such as the virtual node names, so its output is run through the
+// splitmix64 finalizer
+func Hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,131 @@
+package hashring
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// keys returns n distinct keys
+func keys(n int) []string {
+	ks := make([]string, n)
+	for i := range ks {
+		ks[i] = "key-" + strconv.Itoa(i)
+	}
+	return ks
+}
+
+// nodes returns the names node-0 to node-(n-1)
+func nodes(n int) []string {
+	ns := make([]string, n)
+	for i := range ns {
+		ns[i] = "node-" + strconv.Itoa(i)
+	}
+	return ns
+}
+
+// owners maps every key to its owner on r
+func owners(r *Ring, ks []string) map[string]string {
+	m := make(map[string]string, len(ks))
+	for _, k := range ks {
+		m[k], _ = r.Get(k)
+	}
+	return m
+}
+
+func TestSameNodesSameOwners(t *testing.T) {
+	ns := nodes(8)
+	a, b := New(0), New(0)
+	a.Add(ns...)
+	for _, n := range slices.Backward(ns) {
+		b.Add(n)
+	}
+	for _, k := range keys(1000) {
+		if ga, gb := a.GetN(k, 3), b.GetN(k, 3); !slices.Equal(ga, gb) {
+			t.Fatalf("%s maps to %v on one ring and %v on another with the same nodes", k, ga, gb)
+		}
+	}
+}
+
+func TestGetN(t *testing.T) {
+	r := New(0)
+	if _, ok := r.Get("k"); ok {
+		t.Error("an empty ring owns a key")
+	}
+	if got := r.GetN("k", 3); got != nil {
+		t.Errorf("empty ring returned %v", got)
+	}
+	r.Add(nodes(5)...)
+	for _, k := range keys(200) {
+		got := r.GetN(k, 3)
+		if len(got) != 3 || len(slices.Compact(slices.Sorted(slices.Values(got)))) != 3 {
+			t.Fatalf("GetN(%s, 3) = %v, want 3 distinct nodes", k, got)
+		}
+		if owner, _ := r.Get(k); got[0] != owner {
+			t.Fatalf("GetN(%s, 3) = %v does not start with the owner %s", k, got, owner)
+		}
+		if all := r.GetN(k, 10); len(all) != 5 || !slices.Equal(all[:3], got) {
+			t.Fatalf("GetN(%s, 10) = %v, want all 5 nodes extending %v", k, all, got)
+		}
+	}
+}
+
+func TestMembershipChangesMoveAboutOneNth(t *testing.T) {
+	const n = 10
+	ks := keys(20000)
+	r := New(0)
+	r.Add(nodes(n)...)
+	before := owners(r, ks)
+
+	// check fails unless about one key in of moved, each as allowed
+	check := func(what string, after map[string]string, of int, allowed func(from, to string) bool) {
+		t.Helper()
+		moved := 0
+		for k, from := range before {
+			if to := after[k]; to != from {
+				if !allowed(from, to) {
+					t.Fatalf("%s moved %s from %s to %s", what, k, from, to)
+				}
+				moved++
+			}
+		}
+		share, want := float64(moved)/float64(len(ks)), 1/float64(of)
+		if share < want/2 || share > want*3/2 {
+			t.Errorf("%s moved %.3f of the keys, want about %.3f", what, share, want)
+		}
+	}
+
+	r.Add("node-new")
+	check("adding a node", owners(r, ks), n+1, func(_, to string) bool { return to == "node-new" })
+	r.Remove("node-new")
+	if after := owners(r, ks); !maps.Equal(after, before) {
+		t.Fatal("removing the added node did not restore the owners")
+	}
+
+	r.Remove("node-3")
+	check("removing a node", owners(r, ks), n, func(from, _ string) bool { return from == "node-3" })
+}
+
+func TestRemoveRestoresCollisionRival(t *testing.T) {
+	r := New(16)
+	r.Add("a", "b")
+
+	// Real 64-bit collisions are out of reach, so hand one of b's points
+	// to a as though a had won it in a collision
+	lost := Hash("b#5")
+	r.owners[lost] = "a"
+	if owner, _ := r.Get("b#5"); owner == "b" {
+		t.Fatal("set up: b still owns its lost point")
+	}
+
+	r.Remove("a")
+	fresh := New(16)
+	fresh.Add("b")
+	if !slices.Equal(r.points, fresh.points) || !maps.Equal(r.owners, fresh.owners) {
+		t.Fatalf("after removing a the ring holds %d points, want b's %d back", len(r.points), len(fresh.points))
+	}
+	if r.owners[lost] != "b" {
+		t.Errorf("the point b lost belongs to %q after its rival left", r.owners[lost])
+	}
+}
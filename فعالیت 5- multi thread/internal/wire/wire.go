@@ -0,0 +1,104 @@
+// Package wire holds the binary encoding shared by the messages of the
+// task queue and of the packages replicated with it, and the checksummed
+// records their logs are made of
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ErrMalformed is reported for encoded data that does not decode
+var ErrMalformed = errors.New("malformed message")
+
+// AppendBytes appends v prefixed with its length
+func AppendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// Reader decodes fields in order from B, remembering the first error in Err
+type Reader struct {
+	B   []byte
+	Err error
+}
+
+// Uvarint decodes a uvarint
+func (r *Reader) Uvarint() uint64 {
+	if r.Err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.B)
+	if n <= 0 {
+		r.Err = ErrMalformed
+		return 0
+	}
+	r.B = r.B[n:]
+	return v
+}
+
+// Bytes decodes a value appended by AppendBytes; the result aliases B
+func (r *Reader) Bytes() []byte {
+	n := r.Uvarint()
+	if r.Err != nil {
+		return nil
+	}
+	if n > uint64(len(r.B)) {
+		r.Err = ErrMalformed
+		return nil
+	}
+	v := r.B[:n:n]
+	r.B = r.B[n:]
+	if n == 0 {
+		return nil
+	}
+	return v
+}
+
+// RecordHeaderSize is the length of the header preceding each record body
+const RecordHeaderSize = 8
+
+// MaxRecordSize bounds the body of a record
+const MaxRecordSize = 16 << 20
+
+// Errors reported for a record whose header claims a body above
+// MaxRecordSize, and for one whose body does not match its checksum
+var (
+	ErrRecordTooLarge = errors.New("record exceeds maximum size")
+	ErrRecordChecksum = errors.New("record checksum mismatch")
+)
+
+// WriteRecord writes one record: the body's length, a CRC-32 of the body,
+// then the body
+func WriteRecord(w io.Writer, body []byte) error {
+	var header [RecordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(body))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// ReadRecord reads the body of one record, failing on a short or corrupt one
+func ReadRecord(r io.Reader) ([]byte, error) {
+	var header [RecordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n > MaxRecordSize {
+		return nil, ErrRecordTooLarge
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, ErrRecordChecksum
+	}
+	return body, nil
+}
@@ -0,0 +1,279 @@
+// Package kv is a key-value store replicated by Raft, with an HTTP API
+package kv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"multithread/internal/wire"
+	"multithread/raft"
+)
+
+// kvOp is the operation of a replicated key-value command
+type kvOp uint8
+
+const (
+	kvPut kvOp = iota + 1
+	kvDelete
+	kvCAS
+)
+
+// kvCommand is a write to a Store as proposed through Raft
+type kvCommand struct {
+	op    kvOp
+	key   string
+	value []byte
+	// old is the value a CAS expects, absent if it expects no value at all
+	old    []byte
+	absent bool
+}
+
+// marshal encodes the command as its operation, then the key, value and
+// expected value as uvarint-prefixed bytes, then the absent flag
+func (c *kvCommand) marshal() []byte {
+	b := []byte{byte(c.op)}
+	b = wire.AppendBytes(b, []byte(c.key))
+	b = wire.AppendBytes(b, c.value)
+	b = wire.AppendBytes(b, c.old)
+	var absent uint64
+	if c.absent {
+		absent = 1
+	}
+	return binary.AppendUvarint(b, absent)
+}
+
+// unmarshal decodes a command encoded by marshal
+func (c *kvCommand) unmarshal(b []byte) error {
+	if len(b) == 0 {
+		return wire.ErrMalformed
+	}
+	c.op = kvOp(b[0])
+	r := wire.Reader{B: b[1:]}
+	c.key = string(r.Bytes())
+	c.value = r.Bytes()
+	c.old = r.Bytes()
+	c.absent = r.Uvarint() == 1
+	return r.Err
+}
+
+// Store is the state machine of a replicated key-value store: a map that
+// only changes through the commands Raft applies to it
+type Store struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{data: make(map[string][]byte)}
+}
+
+// Apply implements raft.StateMachine. A put reports nothing; a delete or a
+// compare-and-swap reports whether it changed the store as one byte
+func (s *Store) Apply(index uint64, command []byte) []byte {
+	var c kvCommand
+	if c.unmarshal(command) != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch c.op {
+	case kvPut:
+		s.data[c.key] = c.value
+		return nil
+	case kvDelete:
+		_, ok := s.data[c.key]
+		delete(s.data, c.key)
+		return kvBool(ok)
+	case kvCAS:
+		current, ok := s.data[c.key]
+		if c.absent && ok || !c.absent && (!ok || string(current) != string(c.old)) {
+			return kvBool(false)
+		}
+		s.data[c.key] = c.value
+		return kvBool(true)
+	}
+	return nil
+}
+
+// Get returns the value of key as of the last applied command
+func (s *Store) Get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+// Len returns the number of keys
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.data)
+}
+
+// kvBool encodes a command outcome
+func kvBool(ok bool) []byte {
+	if ok {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Node is a member of a key-value store replicated by Raft. Writes are
+// proposed to the leader and applied on every node in log order; reads go
+// through the leader's read index, so Get is linearizable: it sees every
+// write that completed before it was called, even across a leader change.
+// Only the leader serves requests; the others fail with a
+// *raft.NotLeaderError naming it
+type Node struct {
+	node  *raft.Node
+	store *Store
+}
+
+// NewNode creates a node of the store; cfg.StateMachine is replaced by the
+// store's own. Run starts it
+func NewNode(cfg raft.Config) (*Node, error) {
+	store := NewStore()
+	cfg.StateMachine = store
+	node, err := raft.NewNode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{node: node, store: store}, nil
+}
+
+// Run runs the node's Raft member until ctx is cancelled
+func (kv *Node) Run(ctx context.Context) error {
+	return kv.node.Run(ctx)
+}
+
+// Raft returns the underlying Raft node
+func (kv *Node) Raft() *raft.Node {
+	return kv.node
+}
+
+// Get returns the value of key, reading it once the node has applied every
+// write committed before the call
+func (kv *Node) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if _, err := kv.node.ReadIndex(ctx); err != nil {
+		return nil, false, err
+	}
+	v, ok := kv.store.Get(key)
+	return v, ok, nil
+}
+
+// StaleGet returns the value of key as this node last applied it, without
+// contacting the cluster; it may miss recent writes, even on the leader
+func (kv *Node) StaleGet(key string) ([]byte, bool) {
+	return kv.store.Get(key)
+}
+
+// Put sets key to value
+func (kv *Node) Put(ctx context.Context, key string, value []byte) error {
+	_, err := kv.propose(ctx, &kvCommand{op: kvPut, key: key, value: value})
+	return err
+}
+
+// Delete removes key, reporting whether it was present
+func (kv *Node) Delete(ctx context.Context, key string) (bool, error) {
+	return kv.propose(ctx, &kvCommand{op: kvDelete, key: key})
+}
+
+// CompareAndSwap sets key to value if its current value is old, or if it has
+// no value when old is nil, and reports whether it did
+func (kv *Node) CompareAndSwap(ctx context.Context, key string, old, value []byte) (bool, error) {
+	return kv.propose(ctx, &kvCommand{op: kvCAS, key: key, value: value, old: old, absent: old == nil})
+}
+
+// propose replicates c and decodes its outcome
+func (kv *Node) propose(ctx context.Context, c *kvCommand) (bool, error) {
+	result, err := kv.node.Propose(ctx, c.marshal())
+	if err != nil {
+		return false, err
+	}
+	return len(result) == 1 && result[0] == 1, nil
+}
+
+// Handler serves kv over HTTP:
+//
+//	GET    /kv/{key}   the value, or 404 Not Found
+//	PUT    /kv/{key}   sets the value to the body; with an "old" query
+//	                   parameter, or "absent", only if the value matches,
+//	                   answering 412 Precondition Failed otherwise
+//	DELETE /kv/{key}   removes the key, or answers 404 Not Found
+//
+// A node that is not the leader answers 503 Service Unavailable with the ID
+// of the leader it knows of in the X-Raft-Leader header
+func Handler(kv *Node) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kv/{key}", func(w http.ResponseWriter, req *http.Request) {
+		v, ok, err := kv.Get(req.Context(), req.PathValue("key"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(v)
+	})
+	mux.HandleFunc("PUT /kv/{key}", func(w http.ResponseWriter, req *http.Request) {
+		value, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key, query := req.PathValue("key"), req.URL.Query()
+		if !query.Has("old") && !query.Has("absent") {
+			if err := kv.Put(req.Context(), key, value); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var old []byte
+		if query.Has("old") {
+			old = []byte(query.Get("old"))
+		}
+		swapped, err := kv.CompareAndSwap(req.Context(), key, old, value)
+		switch {
+		case err != nil:
+			writeError(w, err)
+		case !swapped:
+			http.Error(w, "value does not match", http.StatusPreconditionFailed)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("DELETE /kv/{key}", func(w http.ResponseWriter, req *http.Request) {
+		deleted, err := kv.Delete(req.Context(), req.PathValue("key"))
+		switch {
+		case err != nil:
+			writeError(w, err)
+		case !deleted:
+			http.Error(w, "no such key", http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	return mux
+}
+
+// writeError answers with the status matching err
+func writeError(w http.ResponseWriter, err error) {
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) {
+		w.Header().Set("X-Raft-Leader", strconv.FormatUint(notLeader.Leader, 10))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
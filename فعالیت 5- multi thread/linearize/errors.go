@@ -0,0 +1,11 @@
+package linearize
+
+import "errors"
+
+// ErrNotLinearizable is reported by Check for a history no single copy of
+// the store could have produced
+var ErrNotLinearizable = errors.New("history is not linearizable")
+
+// ErrIllegalOutcome is reported by Oracle.Check for an operation
+// whose outcome the partitions it ran across rule out
+var ErrIllegalOutcome = errors.New("outcome not allowed across the partitions")
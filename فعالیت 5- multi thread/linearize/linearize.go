@@ -0,0 +1,677 @@
+// Package linearize checks histories of key-value operations for
+// linearizability and simulates partitions of a replicated store to judge
+package linearize
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multithread/kv"
+	"multithread/raft"
+	"multithread/taskqueue"
+	"multithread/testutil"
+)
+
+// OpKind is the kind of an Operation
+type OpKind uint8
+
+const (
+	OpGet OpKind = iota + 1
+	OpPut
+	OpDelete
+	OpCAS
+)
+
+// String implements fmt.Stringer
+func (k OpKind) String() string {
+	switch k {
+	case OpGet:
+		return "get"
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpCAS:
+		return "cas"
+	}
+	return "kvop(" + strconv.Itoa(int(k)) + ")"
+}
+
+// KV is a key-value store as its clients see it, such as a kv.Node
+type KV interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Put(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) (bool, error)
+	CompareAndSwap(ctx context.Context, key string, old, value []byte) (bool, error)
+}
+
+// Operation is one call a client made to a KV, as a History records it
+type Operation struct {
+	Client int
+	Kind   OpKind
+	Key    string
+	// Value is what a put or a compare-and-swap writes, or what a get
+	// returned
+	Value []byte
+	// Old is the value a compare-and-swap expects, nil if it expects the
+	// key to be absent
+	Old []byte
+	// OK is whether a get found the key, a delete removed it or a
+	// compare-and-swap swapped
+	OK bool
+	// Call and Return order the operation against the others in its
+	// history: it began after every operation whose Return is below its
+	// Call had ended
+	Call, Return uint64
+	// Unknown marks a call that failed. A failed write may still take
+	// effect, at any time after it was called; a failed get says nothing
+	Unknown bool
+	// Stale marks a get served from one replica's applied state without
+	// consulting the cluster, which may miss recent writes
+	Stale bool
+}
+
+// String implements fmt.Stringer
+func (op Operation) String() string {
+	s := fmt.Sprintf("client %d %v %q", op.Client, op.Kind, op.Key)
+	switch op.Kind {
+	case OpGet:
+		if op.OK {
+			s += fmt.Sprintf(" = %q", op.Value)
+		} else {
+			s += " = absent"
+		}
+	case OpPut:
+		s += fmt.Sprintf(" %q", op.Value)
+	case OpDelete:
+		s += fmt.Sprintf(" = %v", op.OK)
+	case OpCAS:
+		if op.Old == nil {
+			s += fmt.Sprintf(" absent->%q = %v", op.Value, op.OK)
+		} else {
+			s += fmt.Sprintf(" %q->%q = %v", op.Old, op.Value, op.OK)
+		}
+	}
+	if op.Unknown {
+		s += " (failed)"
+	}
+	if op.Stale {
+		s += " (stale)"
+	}
+	return s
+}
+
+// History records the operations concurrent clients make on a KV, with
+// the order in which they were called and returned, for Check.
+// It is safe for concurrent use
+type History struct {
+	mu     sync.Mutex
+	events uint64
+	ops    []Operation
+}
+
+// NewHistory creates an empty history
+func NewHistory() *History {
+	return &History{}
+}
+
+// Client returns kv with every call client id makes through it recorded.
+// Each client should make one call at a time, like a single-threaded user
+// of the store
+func (h *History) Client(id int, kv KV) KV {
+	return &historyKV{history: h, client: id, kv: kv}
+}
+
+// Operations returns the operations recorded so far, in the order they were
+// called; ones still running are left out
+func (h *History) Operations() []Operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ops []Operation
+	for _, op := range h.ops {
+		if op.Return != 0 {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// Event runs fn as one event of the history, with no operation called or
+// returning meanwhile, and returns its place in the history's order:
+// operations whose Return is below it ended before fn ran, and those whose
+// Call is above it began after. It places things done to the store, such
+// as a partition, against the operations
+func (h *History) Event(fn func()) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fn()
+	h.events++
+	return h.events
+}
+
+// call records the start of op and returns its index
+func (h *History) call(op Operation) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events++
+	op.Call = h.events
+	h.ops = append(h.ops, op)
+	return len(h.ops) - 1
+}
+
+// finish records the outcome of the operation at index i; value and stale
+// are only kept for gets
+func (h *History) finish(i int, value []byte, ok, stale bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events++
+	op := &h.ops[i]
+	op.Return = h.events
+	op.OK = ok
+	op.Unknown = err != nil
+	if op.Kind == OpGet {
+		op.Value = slices.Clone(value)
+		op.Stale = stale
+	}
+}
+
+// staleReadKey is the context key of the flag a KV sets to report that it
+// served a get from a replica's applied state
+type staleReadKey struct{}
+
+// markStaleRead reports to a History recording the get of ctx, if any,
+// that the get was served from a replica's applied state
+func markStaleRead(ctx context.Context) {
+	if stale, ok := ctx.Value(staleReadKey{}).(*bool); ok {
+		*stale = true
+	}
+}
+
+// historyKV is a KV recording into a history
+type historyKV struct {
+	history *History
+	client  int
+	kv      KV
+}
+
+func (c *historyKV) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	i := c.history.call(Operation{Client: c.client, Kind: OpGet, Key: key})
+	var stale bool
+	v, ok, err := c.kv.Get(context.WithValue(ctx, staleReadKey{}, &stale), key)
+	c.history.finish(i, v, ok, stale, err)
+	return v, ok, err
+}
+
+func (c *historyKV) Put(ctx context.Context, key string, value []byte) error {
+	i := c.history.call(Operation{Client: c.client, Kind: OpPut, Key: key, Value: slices.Clone(value)})
+	err := c.kv.Put(ctx, key, value)
+	c.history.finish(i, nil, false, false, err)
+	return err
+}
+
+func (c *historyKV) Delete(ctx context.Context, key string) (bool, error) {
+	i := c.history.call(Operation{Client: c.client, Kind: OpDelete, Key: key})
+	ok, err := c.kv.Delete(ctx, key)
+	c.history.finish(i, nil, ok, false, err)
+	return ok, err
+}
+
+func (c *historyKV) CompareAndSwap(ctx context.Context, key string, old, value []byte) (bool, error) {
+	i := c.history.call(Operation{Client: c.client, Kind: OpCAS, Key: key, Value: slices.Clone(value), Old: slices.Clone(old)})
+	ok, err := c.kv.CompareAndSwap(ctx, key, old, value)
+	c.history.finish(i, nil, ok, false, err)
+	return ok, err
+}
+
+// Check reports whether ops, a history of concurrent calls to a
+// key-value store, could have come from a single copy of the store applying
+// each operation at one instant between its call and its return. It fails
+// with an error wrapping ErrNotLinearizable that names the key whose
+// operations no order explains. Keys are independent, so each is checked on
+// its own, by a Wing-Gong search for an order that skips states it has
+// already ruled out
+func Check(ops []Operation) error {
+	byKey := make(map[string][]Operation)
+	for _, op := range ops {
+		if op.Unknown && op.Kind == OpGet {
+			continue
+		}
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := checkKey(key, byKey[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kvModel is the state of one key of the store's specification
+type kvModel struct {
+	value   string
+	present bool
+}
+
+// step applies op to m, reporting false if op's outcome could not have come
+// from m. An operation of unknown outcome is only applied for its effect
+func (m kvModel) step(op *Operation) (kvModel, bool) {
+	switch op.Kind {
+	case OpGet:
+		return m, op.OK == m.present && (!op.OK || string(op.Value) == m.value)
+	case OpPut:
+		return kvModel{value: string(op.Value), present: true}, true
+	case OpDelete:
+		return kvModel{}, op.Unknown || op.OK == m.present
+	case OpCAS:
+		match := op.Old == nil && !m.present || op.Old != nil && m.present && string(op.Old) == m.value
+		if !op.Unknown && op.OK != match {
+			return m, false
+		}
+		if match {
+			return kvModel{value: string(op.Value), present: true}, true
+		}
+		return m, true
+	}
+	return m, false
+}
+
+// linearizer searches for a linearization of the operations on one key
+type linearizer struct {
+	ops []Operation
+	// done marks the operations placed so far, one bit each
+	done  []byte
+	depth int
+	// seen holds the placed sets and resulting states already explored
+	seen map[string]bool
+	// best and blocker are the most operations placed at once, and the
+	// operation that had to come next but could not
+	best, blocker int
+}
+
+// checkKey checks the operations on key
+func checkKey(key string, ops []Operation) error {
+	slices.SortFunc(ops, func(a, b Operation) int { return cmp.Compare(a.Call, b.Call) })
+	l := &linearizer{ops: ops, done: make([]byte, (len(ops)+7)/8), seen: make(map[string]bool), blocker: -1}
+	known := 0
+	for _, op := range ops {
+		if !op.Unknown {
+			known++
+		}
+	}
+	if l.search(kvModel{}, known) {
+		return nil
+	}
+	return fmt.Errorf("%w: key %q: after ordering %d of its %d operations, none explains %v",
+		ErrNotLinearizable, key, l.best, len(ops), ops[l.blocker])
+}
+
+// search places the remaining operations after those in l.done, starting
+// from state. An operation can go next if it was called before every
+// operation still pending returned; failed writes never have to be placed,
+// since they may never have taken effect
+func (l *linearizer) search(state kvModel, remaining int) bool {
+	if remaining == 0 {
+		return true
+	}
+	first, next := uint64(math.MaxUint64), -1
+	for i := range l.ops {
+		if !l.isDone(i) && !l.ops[i].Unknown && l.ops[i].Return < first {
+			first, next = l.ops[i].Return, i
+		}
+	}
+	if l.depth >= l.best {
+		l.best, l.blocker = l.depth, next
+	}
+	for i := range l.ops {
+		op := &l.ops[i]
+		if op.Call > first {
+			break
+		}
+		if l.isDone(i) {
+			continue
+		}
+		after, ok := state.step(op)
+		if !ok {
+			continue
+		}
+		l.mark(i, true)
+		key := string(l.done) + strconv.FormatBool(after.present) + after.value
+		if !l.seen[key] {
+			l.seen[key] = true
+			left := remaining
+			if !op.Unknown {
+				left--
+			}
+			if l.search(after, left) {
+				return true
+			}
+		}
+		l.mark(i, false)
+	}
+	return false
+}
+
+func (l *linearizer) isDone(i int) bool {
+	return l.done[i/8]&(1<<(i%8)) != 0
+}
+
+func (l *linearizer) mark(i int, done bool) {
+	if done {
+		l.done[i/8] |= 1 << (i % 8)
+		l.depth++
+	} else {
+		l.done[i/8] &^= 1 << (i % 8)
+		l.depth--
+	}
+}
+
+// leaderKV is a client of a kv.Node cluster that sends each call to the
+// node it believes leads, following NotLeaderErrors to the actual leader
+type leaderKV struct {
+	nodes  []*kv.Node
+	leader int
+	// stale makes gets read a random node's applied state instead
+	stale bool
+	rng   *rand.Rand
+	// reach, if set, reports whether the client can reach node i; calls
+	// only go to nodes it can
+	reach func(i int) bool
+	// degrade makes gets read a random reachable node's applied state
+	// while the client cannot reach a quorum, rather than fail
+	degrade bool
+}
+
+// quorum reports whether the client can reach a majority of the nodes
+func (c *leaderKV) quorum() bool {
+	if c.reach == nil {
+		return true
+	}
+	n := 0
+	for i := range c.nodes {
+		if c.reach(i) {
+			n++
+		}
+	}
+	return n > len(c.nodes)/2
+}
+
+// do calls f on the leader until it stops answering that it is not. Any
+// other failure moves on to another node for the next call
+func (c *leaderKV) do(ctx context.Context, f func(node *kv.Node) error) error {
+	for {
+		for tries := 0; c.reach != nil && !c.reach(c.leader); tries++ {
+			if tries == len(c.nodes) {
+				return fmt.Errorf("no node reachable: %w", taskqueue.ErrPartitioned)
+			}
+			c.leader = (c.leader + 1) % len(c.nodes)
+		}
+		err := f(c.nodes[c.leader])
+		var notLeader *raft.NotLeaderError
+		if !errors.As(err, &notLeader) {
+			if err != nil {
+				c.leader = (c.leader + 1) % len(c.nodes)
+			}
+			return err
+		}
+		if notLeader.Leader != 0 {
+			c.leader = int(notLeader.Leader - 1)
+		} else {
+			c.leader = (c.leader + 1) % len(c.nodes)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (c *leaderKV) Get(ctx context.Context, key string) (v []byte, ok bool, err error) {
+	if c.stale || c.degrade && !c.quorum() {
+		var reachable []*kv.Node
+		for i, node := range c.nodes {
+			if c.reach == nil || c.reach(i) {
+				reachable = append(reachable, node)
+			}
+		}
+		if len(reachable) == 0 {
+			return nil, false, fmt.Errorf("no node reachable: %w", taskqueue.ErrPartitioned)
+		}
+		v, ok = reachable[c.rng.IntN(len(reachable))].StaleGet(key)
+		markStaleRead(ctx)
+		return v, ok, nil
+	}
+	err = c.do(ctx, func(node *kv.Node) (err error) {
+		v, ok, err = node.Get(ctx, key)
+		return err
+	})
+	return v, ok, err
+}
+
+func (c *leaderKV) Put(ctx context.Context, key string, value []byte) error {
+	return c.do(ctx, func(node *kv.Node) error { return node.Put(ctx, key, value) })
+}
+
+func (c *leaderKV) Delete(ctx context.Context, key string) (ok bool, err error) {
+	err = c.do(ctx, func(node *kv.Node) (err error) {
+		ok, err = node.Delete(ctx, key)
+		return err
+	})
+	return ok, err
+}
+
+func (c *leaderKV) CompareAndSwap(ctx context.Context, key string, old, value []byte) (ok bool, err error) {
+	err = c.do(ctx, func(node *kv.Node) (err error) {
+		ok, err = node.CompareAndSwap(ctx, key, old, value)
+		return err
+	})
+	return ok, err
+}
+
+// kvCluster is a kv.Node cluster on a MemoryNetwork, node i on host
+// hosts[i]
+type kvCluster struct {
+	hosts []string
+	kvs   []*kv.Node
+}
+
+// startKVCluster starts a cluster of nodes nodes on network, running until
+// ctx is done, and waits for it to elect a leader
+func startKVCluster(ctx context.Context, network *taskqueue.MemoryNetwork, nodes int) (*kvCluster, error) {
+	c := &kvCluster{hosts: make([]string, nodes), kvs: make([]*kv.Node, nodes)}
+	for i := range c.hosts {
+		c.hosts[i] = fmt.Sprintf("n%d", i+1)
+	}
+	for i, host := range c.hosts {
+		peers := make(map[uint64]string)
+		for j, other := range c.hosts {
+			if j != i {
+				peers[uint64(j+1)] = other + "/raft"
+			}
+		}
+		node, err := kv.NewNode(raft.Config{ID: uint64(i + 1), Addr: host + "/raft", Peers: peers, Transport: network.Host(host)})
+		if err != nil {
+			return nil, err
+		}
+		c.kvs[i] = node
+		go node.Run(ctx)
+	}
+	if !waitUntil(5*time.Second, func() bool { return c.leader() >= 0 }) {
+		return nil, errors.New("no leader elected")
+	}
+	return c, nil
+}
+
+// leader returns the index of a node that believes it leads, or -1
+func (c *kvCluster) leader() int {
+	for i, node := range c.kvs {
+		if node.Raft().Status().Role == raft.Leader {
+			return i
+		}
+	}
+	return -1
+}
+
+// kvWorkload is a set of clients making random calls on a few keys
+type kvWorkload struct {
+	keys       []string
+	operations int
+	total      int64
+	completed  atomic.Int64
+	wg         sync.WaitGroup
+}
+
+// newKVWorkload creates a workload of clients clients making operations
+// calls each
+func newKVWorkload(clients, operations int) *kvWorkload {
+	return &kvWorkload{keys: []string{"a", "b", "c"}, operations: operations, total: int64(clients * operations)}
+}
+
+// start runs client c, making its calls on kv with choices drawn from rng
+func (wl *kvWorkload) start(ctx context.Context, c int, kv KV, rng *rand.Rand) {
+	wl.wg.Go(func() {
+		// last is the value the client last saw for each key, which its
+		// compare-and-swaps expect
+		last := make(map[string][]byte)
+		for n := range wl.operations {
+			key := wl.keys[rng.IntN(len(wl.keys))]
+			value := fmt.Appendf(nil, "c%d-%d", c, n)
+			octx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			switch p := rng.IntN(20); {
+			case p < 10:
+				if v, ok, err := kv.Get(octx, key); err == nil {
+					last[key] = nil
+					if ok {
+						last[key] = v
+					}
+				}
+			case p < 15:
+				kv.Put(octx, key, value)
+			case p < 18:
+				if ok, _ := kv.CompareAndSwap(octx, key, last[key], value); ok {
+					last[key] = value
+				}
+			default:
+				kv.Delete(octx, key)
+			}
+			cancel()
+			wl.completed.Add(1)
+		}
+	})
+}
+
+// waitFor waits until num/den of the workload's calls have been made
+func (wl *kvWorkload) waitFor(num, den int64) {
+	waitUntil(time.Minute, func() bool { return wl.completed.Load() >= num*wl.total/den })
+}
+
+// Simulate runs clients concurrent clients making operations calls each,
+// seeded with seed, against a replicated KV store of nodes nodes on a
+// MemoryNetwork, cuts the leader off midway and heals the network, then
+// checks the recorded history with Check and writes the results to w. As a
+// check of the checker, the history with one read altered to a value nobody
+// wrote must then fail. With stale, reads go to a random node's applied
+// state instead of through the leader, which is not linearizable; the result
+// is reported, since a run may not catch it
+func Simulate(w io.Writer, nodes, clients, operations int, stale bool, seed uint64) error {
+	if nodes < 3 {
+		return fmt.Errorf("linearize: need at least 3 nodes, got %d", nodes)
+	}
+	if clients < 1 || operations < 1 {
+		return fmt.Errorf("linearize: need at least one client and operation")
+	}
+	network := taskqueue.NewMemoryNetwork()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cluster, err := startKVCluster(ctx, network, nodes)
+	if err != nil {
+		return fmt.Errorf("linearize: %w", err)
+	}
+
+	history := NewHistory()
+	workload := newKVWorkload(clients, operations)
+	for c := range clients {
+		rng := rand.New(rand.NewPCG(seed, uint64(c)))
+		workload.start(ctx, c, history.Client(c, &leaderKV{nodes: cluster.kvs, leader: c % nodes, stale: stale, rng: rng}), rng)
+	}
+
+	// Cut the leader off a third of the way through and heal the network
+	// two thirds of the way
+	workload.waitFor(1, 3)
+	cut := cluster.leader()
+	if cut >= 0 {
+		var rest []string
+		for i, host := range cluster.hosts {
+			if i != cut {
+				rest = append(rest, host)
+			}
+		}
+		network.Partition([]string{cluster.hosts[cut]}, rest)
+	}
+	workload.waitFor(2, 3)
+	network.Heal()
+	workload.wg.Wait()
+
+	ops := history.Operations()
+	failed := 0
+	for _, op := range ops {
+		if op.Unknown {
+			failed++
+		}
+	}
+	partitioned := "without a leader to cut off"
+	if cut >= 0 {
+		partitioned = "across a partition of leader " + cluster.hosts[cut]
+	}
+	fmt.Fprintf(w, "ok  %d clients made %d operations on %d keys %s, %d of which failed\n", clients, len(ops), len(workload.keys), partitioned, failed)
+
+	err = Check(ops)
+	switch {
+	case stale && err != nil:
+		fmt.Fprintf(w, "ok  reading stale replicas is caught: %v\n", err)
+	case stale:
+		fmt.Fprintln(w, "ok  this run's stale reads happened to be linearizable")
+	case err != nil:
+		return err
+	default:
+		fmt.Fprintln(w, "ok  the history is linearizable")
+	}
+
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].Kind == OpGet && !ops[i].Unknown {
+			altered := slices.Clone(ops)
+			altered[i].OK, altered[i].Value = true, []byte("never written")
+			if err := Check(altered); !errors.Is(err, ErrNotLinearizable) {
+				return fmt.Errorf("linearize: the checker accepted a read of a value nobody wrote: %v", err)
+			}
+			fmt.Fprintln(w, "ok  the history with a read of a value nobody wrote is not")
+			break
+		}
+	}
+	return nil
+}
+
+// waitUntil polls cond until it holds or timeout passes, reporting which
+func waitUntil(timeout time.Duration, cond func() bool) bool {
+	return testutil.Eventually(timeout, func() error {
+		if !cond() {
+			return errors.New("condition does not hold")
+		}
+		return nil
+	}) == nil
+}
@@ -0,0 +1,222 @@
+package linearize
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// get records a get by client of key between call and ret that found
+// value, or found the key absent if value is empty
+func get(client int, key, value string, call, ret uint64) Operation {
+	op := Operation{Client: client, Kind: OpGet, Key: key, Call: call, Return: ret}
+	if value != "" {
+		op.Value, op.OK = []byte(value), true
+	}
+	return op
+}
+
+// put records a put by client of value under key between call and ret
+func put(client int, key, value string, call, ret uint64) Operation {
+	return Operation{Client: client, Kind: OpPut, Key: key, Value: []byte(value), Call: call, Return: ret}
+}
+
+// del records a delete by client of key between call and ret
+func del(client int, key string, ok bool, call, ret uint64) Operation {
+	return Operation{Client: client, Kind: OpDelete, Key: key, OK: ok, Call: call, Return: ret}
+}
+
+// cas records a compare-and-swap by client of key from old, absent if
+// empty, to value between call and ret
+func cas(client int, key, old, value string, ok bool, call, ret uint64) Operation {
+	op := Operation{Client: client, Kind: OpCAS, Key: key, Value: []byte(value), OK: ok, Call: call, Return: ret}
+	if old != "" {
+		op.Old = []byte(old)
+	}
+	return op
+}
+
+// failed marks op as a call that returned an error
+func failed(op Operation) Operation {
+	op.Unknown = true
+	return op
+}
+
+func TestCheckRecordedHistories(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []Operation
+		ok   bool
+	}{
+		{"empty", nil, true},
+		{"sequential", []Operation{put(0, "a", "x", 1, 2), get(1, "a", "x", 3, 4), del(0, "a", true, 5, 6), get(1, "a", "", 7, 8)}, true},
+		{"concurrent get sees the old value", []Operation{put(0, "a", "x", 1, 2), put(0, "a", "y", 3, 6), get(1, "a", "x", 4, 5)}, true},
+		{"concurrent get sees the new value", []Operation{put(0, "a", "x", 1, 2), put(0, "a", "y", 3, 6), get(1, "a", "y", 4, 5)}, true},
+		{"get after a put returned sees the old value", []Operation{put(0, "a", "x", 1, 2), put(0, "a", "y", 3, 4), get(1, "a", "x", 5, 6)}, false},
+		{"get of a value nobody wrote", []Operation{put(0, "a", "x", 1, 2), get(1, "a", "z", 3, 4)}, false},
+		{"reads go back in time", []Operation{
+			put(0, "a", "x", 1, 2), put(0, "a", "y", 3, 8), get(1, "a", "y", 4, 5), get(2, "a", "x", 6, 7),
+		}, false},
+		{"failed put takes effect later", []Operation{failed(put(0, "a", "x", 1, 2)), get(1, "a", "", 3, 4), get(1, "a", "x", 5, 6)}, true},
+		{"failed put never takes effect", []Operation{failed(put(0, "a", "x", 1, 2)), get(1, "a", "", 3, 4)}, true},
+		{"failed put takes effect only once", []Operation{
+			failed(put(0, "a", "x", 1, 2)), get(1, "a", "x", 3, 4), get(1, "a", "", 5, 6),
+		}, false},
+		{"failed get says nothing", []Operation{put(0, "a", "x", 1, 2), failed(get(1, "a", "z", 3, 4))}, true},
+		{"one of two racing swaps wins", []Operation{cas(0, "a", "", "x", true, 1, 4), cas(1, "a", "", "y", false, 2, 3)}, true},
+		{"both racing swaps win", []Operation{cas(0, "a", "", "x", true, 1, 4), cas(1, "a", "", "y", true, 2, 3)}, false},
+		{"swap of the value read", []Operation{put(0, "a", "x", 1, 2), cas(1, "a", "x", "y", true, 3, 4), get(0, "a", "y", 5, 6)}, true},
+		{"delete of an absent key", []Operation{del(0, "a", true, 1, 2)}, false},
+		{"keys are independent", []Operation{put(0, "a", "x", 1, 4), put(1, "b", "y", 2, 3), get(0, "b", "y", 5, 6), get(1, "a", "x", 7, 8)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(tt.ops)
+			if tt.ok && err != nil {
+				t.Fatalf("Check rejected a linearizable history: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrNotLinearizable) {
+				t.Fatalf("Check returned %v for a history that is not linearizable", err)
+			}
+		})
+	}
+}
+
+func TestCheckNamesTheKey(t *testing.T) {
+	ops := []Operation{put(0, "a", "x", 1, 2), get(1, "a", "x", 3, 4), put(0, "b", "x", 5, 6), get(1, "b", "y", 7, 8)}
+	err := Check(ops)
+	if !errors.Is(err, ErrNotLinearizable) || !strings.Contains(err.Error(), `key "b"`) {
+		t.Fatalf("Check returned %v, want an error naming key b", err)
+	}
+}
+
+// lockedKV is a KV applying each call atomically under a mutex, which is
+// trivially linearizable
+type lockedKV struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newLockedKV() *lockedKV {
+	return &lockedKV{values: make(map[string][]byte)}
+}
+
+func (s *lockedKV) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return slices.Clone(v), ok, nil
+}
+
+func (s *lockedKV) Put(_ context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = slices.Clone(value)
+	return nil
+}
+
+func (s *lockedKV) Delete(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.values[key]
+	delete(s.values, key)
+	return ok, nil
+}
+
+func (s *lockedKV) CompareAndSwap(_ context.Context, key string, old, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if old == nil && ok || old != nil && (!ok || string(v) != string(old)) {
+		return false, nil
+	}
+	s.values[key] = slices.Clone(value)
+	return true, nil
+}
+
+// laggingKV is a lockedKV whose gets answer from the state before the
+// latest write, as a replica one entry behind would
+type laggingKV struct {
+	*lockedKV
+	previous map[string][]byte
+}
+
+func (s *laggingKV) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.previous[key]
+	return slices.Clone(v), ok, nil
+}
+
+func (s *laggingKV) Put(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	s.previous = maps.Clone(s.values)
+	s.mu.Unlock()
+	return s.lockedKV.Put(ctx, key, value)
+}
+
+func TestCheckGeneratedHistories(t *testing.T) {
+	for seed := range uint64(5) {
+		store := newLockedKV()
+		history := NewHistory()
+		workload := newKVWorkload(4, 100)
+		for c := range 4 {
+			rng := rand.New(rand.NewPCG(seed, uint64(c)))
+			workload.start(context.Background(), c, history.Client(c, store), rng)
+		}
+		workload.wg.Wait()
+		ops := history.Operations()
+		if len(ops) != 400 {
+			t.Fatalf("seed %d: history holds %d operations, want 400", seed, len(ops))
+		}
+		if err := Check(ops); err != nil {
+			t.Fatalf("seed %d: Check rejected the history of a locked store: %v", seed, err)
+		}
+
+		// Alter the last successful read to a value nobody wrote, as the
+		// demo does to check the checker
+		i := len(ops) - 1
+		for ops[i].Kind != OpGet {
+			i--
+		}
+		altered := slices.Clone(ops)
+		altered[i].OK, altered[i].Value = true, []byte("never written")
+		if err := Check(altered); !errors.Is(err, ErrNotLinearizable) {
+			t.Fatalf("seed %d: Check accepted a read of a value nobody wrote: %v", seed, err)
+		}
+	}
+}
+
+func TestCheckCatchesLaggingReads(t *testing.T) {
+	ctx := context.Background()
+	history := NewHistory()
+	client := history.Client(0, &laggingKV{lockedKV: newLockedKV()})
+	client.Put(ctx, "a", []byte("x"))
+	client.Put(ctx, "a", []byte("y"))
+	if v, _, _ := client.Get(ctx, "a"); string(v) != "x" {
+		t.Fatalf("lagging store read %q, want x", v)
+	}
+	if err := Check(history.Operations()); !errors.Is(err, ErrNotLinearizable) {
+		t.Fatalf("Check returned %v for a read one write behind", err)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a Raft cluster")
+	}
+	var out strings.Builder
+	if err := Simulate(&out, 3, 3, 40, false, 1); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	for _, want := range []string{"the history is linearizable", "a read of a value nobody wrote is not"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package linearize
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"multithread/membership"
+	"multithread/raft"
+	"multithread/taskqueue"
+	"multithread/testutil"
+)
+
+// commandLog is a state machine that only records the commands applied
+type commandLog struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+// Apply implements raft.StateMachine
+func (l *commandLog) Apply(_ uint64, command []byte) []byte {
+	l.mu.Lock()
+	l.commands = append(l.commands, string(command))
+	l.mu.Unlock()
+	return nil
+}
+
+// has reports whether command was applied
+func (l *commandLog) has(command string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Contains(l.commands, command)
+}
+
+// SimulatePartitions runs a Raft cluster, a quorum store and a SWIM group
+// across nodes hosts of a MemoryNetwork, cuts the Raft leader and one other
+// host off from the rest and later heals the network, writing each check to
+// w. It fails unless only the majority side elects a leader and commits,
+// writes from the minority side fail their quorum, each side's membership
+// sees the other fail, and after healing the cluster settles on one leader
+// with the majority's writes and a full membership
+func SimulatePartitions(w io.Writer, nodes int) error {
+	if nodes < 3 {
+		return fmt.Errorf("partition: need at least 3 nodes, got %d", nodes)
+	}
+	network := taskqueue.NewMemoryNetwork()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := make([]string, nodes)
+	var kvAddrs, swimAddrs []string
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("n%d", i+1)
+		kvAddrs = append(kvAddrs, hosts[i]+"/kv")
+		swimAddrs = append(swimAddrs, hosts[i]+"/swim")
+	}
+	rafts := make([]*raft.Node, nodes)
+	logs := make([]*commandLog, nodes)
+	clients := make([]*taskqueue.QuorumClient, nodes)
+	members := make([]*membership.Group, nodes)
+	for i, host := range hosts {
+		t := network.Host(host)
+		peers := make(map[uint64]string)
+		for j, other := range hosts {
+			if j != i {
+				peers[uint64(j+1)] = other + "/raft"
+			}
+		}
+		logs[i] = new(commandLog)
+		node, err := raft.NewNode(raft.Config{ID: uint64(i + 1), Addr: host + "/raft", Peers: peers, Transport: t, StateMachine: logs[i]})
+		if err != nil {
+			return err
+		}
+		rafts[i] = node
+		go node.Run(ctx)
+		go taskqueue.NewQuorumReplica(kvAddrs[i], t).Run(ctx)
+		clients[i], err = taskqueue.NewQuorumClient(taskqueue.QuorumConfig{ID: host, Replicas: kvAddrs, Transport: t, N: nodes, Timeout: 300 * time.Millisecond})
+		if err != nil {
+			return err
+		}
+		members[i] = membership.NewGroup(membership.Config{
+			Name: host, Addr: swimAddrs[i], Seeds: swimAddrs, Transport: t,
+			ProbeInterval: 100 * time.Millisecond, ProbeTimeout: 50 * time.Millisecond, SuspicionTimeout: 500 * time.Millisecond,
+		})
+		go members[i].Run(ctx)
+	}
+
+	check := func(ok bool, format string, args ...any) error {
+		what := fmt.Sprintf(format, args...)
+		if !ok {
+			return fmt.Errorf("partition: %s", what)
+		}
+		fmt.Fprintf(w, "ok  %s\n", what)
+		return nil
+	}
+	// leaders returns the indexes of the nodes among group that lead
+	leaders := func(group []int) []int {
+		var found []int
+		for _, i := range group {
+			if rafts[i].Status().Role == raft.Leader {
+				found = append(found, i)
+			}
+		}
+		return found
+	}
+	// sees reports whether every node of group counts exactly the hosts of
+	// want as members
+	sees := func(group, want []int) bool {
+		var names []string
+		for _, i := range want {
+			names = append(names, hosts[i])
+		}
+		slices.Sort(names)
+		for _, i := range group {
+			var got []string
+			for _, m := range members[i].Members() {
+				got = append(got, m.Name)
+			}
+			if !slices.Equal(got, names) {
+				return false
+			}
+		}
+		return true
+	}
+	propose := func(i int, command string) error {
+		pctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		_, err := rafts[i].Propose(pctx, []byte(command))
+		return err
+	}
+	put := func(i int, value string) error {
+		pctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		return clients[i].Put(pctx, "key", []byte(value))
+	}
+	all := make([]int, nodes)
+	for i := range all {
+		all[i] = i
+	}
+
+	var leader int
+	if err := check(waitUntil(5*time.Second, func() bool { return len(leaders(all)) == 1 }), "the cluster elects a leader"); err != nil {
+		return err
+	}
+	leader = leaders(all)[0]
+	if err := check(propose(leader, "before") == nil && put(0, "before") == nil, "%s commits and the store takes a write", hosts[leader]); err != nil {
+		return err
+	}
+	if err := check(waitUntil(5*time.Second, func() bool { return sees(all, all) }), "every member sees all %d", nodes); err != nil {
+		return err
+	}
+
+	// Cut the leader off with the hosts after it, leaving it in the largest
+	// minority there is
+	var minority, majority []int
+	var cut []string
+	for k := range nodes {
+		i := (leader + k) % nodes
+		if k < (nodes-1)/2 {
+			minority = append(minority, i)
+			cut = append(cut, hosts[i])
+		} else {
+			majority = append(majority, i)
+		}
+	}
+	network.Partition(cut)
+	fmt.Fprintf(w, "--  partitioned %v from the rest\n", cut)
+
+	var elected int
+	if err := check(waitUntil(5*time.Second, func() bool { return len(leaders(majority)) == 1 }), "the majority elects a leader of its own"); err != nil {
+		return err
+	}
+	elected = leaders(majority)[0]
+	if err := check(propose(elected, "during") == nil, "%s commits on the majority side", hosts[elected]); err != nil {
+		return err
+	}
+	if err := check(propose(leader, "stranded") != nil, "the old leader %s cannot commit", hosts[leader]); err != nil {
+		return err
+	}
+	// A write that misses its quorum is not rolled back on the replicas it
+	// reached, so it must be older than the majority's for that to win
+	if err := check(put(minority[len(minority)-1], "minority") != nil, "a write on the minority side misses its quorum"); err != nil {
+		return err
+	}
+	if err := check(put(majority[0], "majority") == nil, "a later write on the majority side reaches its quorum"); err != nil {
+		return err
+	}
+	if err := check(waitUntil(5*time.Second, func() bool { return sees(majority, majority) && sees(minority, minority) }), "each side's membership drops the other"); err != nil {
+		return err
+	}
+
+	network.Heal()
+	fmt.Fprintf(w, "--  healed the partition\n")
+	if err := check(waitUntil(5*time.Second, func() bool {
+		found := leaders(all)
+		return len(found) == 1 && found[0] != leader
+	}), "the old leader steps down and one leader remains"); err != nil {
+		return err
+	}
+	if err := check(waitUntil(5*time.Second, func() bool {
+		return !slices.ContainsFunc(logs, func(l *commandLog) bool { return !l.has("during") || l.has("stranded") })
+	}), "every node applies the majority's commands and none of the stranded ones"); err != nil {
+		return err
+	}
+	reads := make([]func() (string, error), len(all))
+	for i := range reads {
+		reads[i] = func() (string, error) {
+			gctx, gcancel := context.WithTimeout(ctx, time.Second)
+			defer gcancel()
+			value, _, err := clients[i].Get(gctx, "key")
+			return string(value), err
+		}
+	}
+	value, err := testutil.EventuallyConsistent(5*time.Second, reads...)
+	if err := check(err == nil && value == "majority", "every node, the minority side's included, reads the majority's newer write"); err != nil {
+		return err
+	}
+	return check(waitUntil(10*time.Second, func() bool { return sees(all, all) }), "every member sees all %d again", nodes)
+}
@@ -0,0 +1,214 @@
+package linearize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+
+	"multithread/taskqueue"
+)
+
+// Oracle judges the history of a replicated KV store that was partitioned
+// while its clients used it. A client cut off with a minority of the nodes
+// cannot reach a quorum, so nothing it is told may claim one: a write it saw
+// succeed or a linearizable read it got answered there is illegal. It may
+// read a replica's applied state instead, and such a stale read is legal if
+// it returns a value that was being written when it returned, or finds the
+// key absent, as a replica that applied nothing would. Every other
+// operation, stale reads on the majority side included, must be
+// linearizable. Partitions are placed in the history with History.Event
+type Oracle struct {
+	hosts map[int]string
+	cuts  []oracleCut
+}
+
+// oracleCut is one partition: the points of the history at which it began
+// and was healed, end 0 while it lasts, and the hosts on its minority side
+type oracleCut struct {
+	start, end uint64
+	minority   map[string]bool
+}
+
+// NewOracle creates an oracle for clients that reach the store from
+// hosts[client]
+func NewOracle(hosts map[int]string) *Oracle {
+	return &Oracle{hosts: hosts}
+}
+
+// Partition records that from the point at on, minority were cut off from
+// a quorum, until the next Heal
+func (o *Oracle) Partition(at uint64, minority ...string) {
+	cut := oracleCut{start: at, minority: make(map[string]bool)}
+	for _, host := range minority {
+		cut.minority[host] = true
+	}
+	o.cuts = append(o.cuts, cut)
+}
+
+// Heal records that the last partition ended at the point at
+func (o *Oracle) Heal(at uint64) {
+	if n := len(o.cuts); n > 0 && o.cuts[n-1].end == 0 {
+		o.cuts[n-1].end = at
+	}
+}
+
+// cutOff reports whether op's client was on the minority side of a
+// partition for the whole of op, or, with overlap, for any of it
+func (o *Oracle) cutOff(op Operation, overlap bool) bool {
+	host := o.hosts[op.Client]
+	for _, cut := range o.cuts {
+		if !cut.minority[host] {
+			continue
+		}
+		healed := cut.end != 0
+		if overlap && op.Return > cut.start && (!healed || op.Call < cut.end) {
+			return true
+		}
+		if !overlap && op.Call > cut.start && (!healed || op.Return < cut.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check judges ops. It fails with an error wrapping ErrIllegalOutcome that
+// names the first operation the partitions rule out, or with the error of
+// Check for the operations left to it
+func (o *Oracle) Check(ops []Operation) error {
+	var illegal []string
+	var linear []Operation
+	for _, op := range ops {
+		switch {
+		case op.Kind == OpGet && op.Stale && o.cutOff(op, true):
+			if op.OK && !o.written(ops, op) {
+				illegal = append(illegal, fmt.Sprintf("%v read a value no write had been called with", op))
+			}
+			continue
+		case !op.Unknown && !op.Stale && o.cutOff(op, false):
+			illegal = append(illegal, fmt.Sprintf("%v was answered on the minority side of a partition", op))
+		}
+		linear = append(linear, op)
+	}
+	if len(illegal) > 0 {
+		more := ""
+		if len(illegal) > 1 {
+			more = fmt.Sprintf(" (and %d more)", len(illegal)-1)
+		}
+		return fmt.Errorf("%w: %s%s", ErrIllegalOutcome, illegal[0], more)
+	}
+	return Check(linear)
+}
+
+// written reports whether a put or compare-and-swap of ops wrote the value
+// read returned to its key, having been called before read returned
+func (o *Oracle) written(ops []Operation, read Operation) bool {
+	return slices.ContainsFunc(ops, func(op Operation) bool {
+		return (op.Kind == OpPut || op.Kind == OpCAS) && op.Key == read.Key &&
+			op.Call < read.Return && string(op.Value) == string(read.Value)
+	})
+}
+
+// SimulateOracle runs clients concurrent clients making operations calls
+// each, seeded with seed, against a replicated KV store of nodes nodes on a
+// MemoryNetwork, and checks the history with an Oracle, writing the results
+// to w. Each client reaches the store from one of the nodes' hosts. A third
+// of the way through, the leader and as many other nodes as stay short of a
+// quorum are cut off, and two thirds of the way the network heals; clients
+// that cannot reach a quorum meanwhile read their side's replicas rather
+// than fail. As a check of the oracle, the history with a write on the
+// minority side altered to have succeeded, and with a stale read altered to
+// a value nobody wrote, must then fail
+func SimulateOracle(w io.Writer, nodes, clients, operations int, seed uint64) error {
+	if nodes < 3 {
+		return fmt.Errorf("oracle: need at least 3 nodes, got %d", nodes)
+	}
+	if clients < 1 || operations < 1 {
+		return fmt.Errorf("oracle: need at least one client and operation")
+	}
+	network := taskqueue.NewMemoryNetwork()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cluster, err := startKVCluster(ctx, network, nodes)
+	if err != nil {
+		return fmt.Errorf("oracle: %w", err)
+	}
+
+	history := NewHistory()
+	workload := newKVWorkload(clients, operations)
+	homes := make(map[int]string)
+	for c := range clients {
+		home := c % nodes
+		homes[c] = cluster.hosts[home]
+		rng := rand.New(rand.NewPCG(seed, uint64(c)))
+		client := &leaderKV{nodes: cluster.kvs, leader: home, rng: rng, degrade: true,
+			reach: func(i int) bool { return network.Reachable(cluster.hosts[home], cluster.hosts[i]) }}
+		workload.start(ctx, c, history.Client(c, client), rng)
+	}
+	oracle := NewOracle(homes)
+
+	workload.waitFor(1, 3)
+	cut := max(cluster.leader(), 0)
+	var minority, majority []string
+	for i, host := range cluster.hosts {
+		if (i-cut+nodes)%nodes < (nodes-1)/2 {
+			minority = append(minority, host)
+		} else {
+			majority = append(majority, host)
+		}
+	}
+	oracle.Partition(history.Event(func() { network.Partition(minority, majority) }), minority...)
+	workload.waitFor(2, 3)
+	oracle.Heal(history.Event(network.Heal))
+	workload.wg.Wait()
+
+	ops := history.Operations()
+	var stale, failed int
+	for _, op := range ops {
+		switch {
+		case op.Stale:
+			stale++
+		case op.Unknown:
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "ok  %d clients made %d operations on %d keys across a partition of %v from %v\n",
+		clients, len(ops), len(workload.keys), minority, majority)
+	fmt.Fprintf(w, "ok  %d operations failed and %d reads were served stale\n", failed, stale)
+	if err := oracle.Check(ops); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "ok  every outcome is legal under the partition")
+
+	checked := false
+	for i, op := range ops {
+		if op.Kind == OpPut && op.Unknown && oracle.cutOff(op, false) {
+			altered := slices.Clone(ops)
+			altered[i].Unknown = false
+			if err := oracle.Check(altered); !errors.Is(err, ErrIllegalOutcome) {
+				return fmt.Errorf("oracle: accepted a write that succeeded on the minority side: %v", err)
+			}
+			fmt.Fprintln(w, "ok  the history with a write that succeeded on the minority side is not")
+			checked = true
+			break
+		}
+	}
+	for i, op := range ops {
+		if op.Stale {
+			altered := slices.Clone(ops)
+			altered[i].OK, altered[i].Value = true, []byte("never written")
+			if err := oracle.Check(altered); !errors.Is(err, ErrIllegalOutcome) {
+				return fmt.Errorf("oracle: accepted a stale read of a value nobody wrote: %v", err)
+			}
+			fmt.Fprintln(w, "ok  the history with a stale read of a value nobody wrote is not")
+			checked = true
+			break
+		}
+	}
+	if !checked {
+		fmt.Fprintln(w, "--  no write or stale read fell on the minority side, so the oracle's rules were not exercised")
+	}
+	return nil
+}
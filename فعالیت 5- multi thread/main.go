@@ -1,134 +1,226 @@
 package main
 
 import (
-	"fmt"
-	"sync"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"runtime/trace"
+	"strconv"
+	"strings"
 	"time"
-)
 
-const (
-	numWorkers = 1000
-	numTasks   = 1000
+	"multithread/bench"
+	"multithread/taskqueue"
 )
 
-// SimpleThreadPool represents a basic worker pool implementation
-type SimpleThreadPool struct {
-	wg            sync.WaitGroup
-	workerChan    chan struct{}
-	completedTasks int64
-}
-
-// NewSimpleThreadPool creates a new simple thread pool
-func NewSimpleThreadPool(numWorkers int) *SimpleThreadPool {
-	return &SimpleThreadPool{
-		workerChan: make(chan struct{}, numWorkers),
+func main() {
+	setupLogging()
+	args, err := loadSettings(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-// ExecuteTasks runs the specified number of tasks
-func (p *SimpleThreadPool) ExecuteTasks() {
-	for i := 0; i < numTasks; i++ {
-		p.wg.Add(1)
-		p.workerChan <- struct{}{} // Acquire worker slot
-		go func(taskID int) {
-			defer p.wg.Done()
-			defer func() { <-p.workerChan }() // Release worker slot
-			
-			// Simulate work
-			time.Sleep(100 * time.Millisecond)
-			p.completedTasks++
-		}(i)
+	applyLogSettings(settings)
+	if len(args) > 0 {
+		switch args[0] {
+		case "coordinator":
+			runCoordinator(args[1:])
+			return
+		case "worker":
+			runWorker(args[1:])
+			return
+		case "registry":
+			runRegistry(args[1:])
+			return
+		case "locks":
+			runLockServer(args[1:])
+			return
+		case "lamport":
+			runLamportDemo(args[1:])
+			return
+		case "broker":
+			runBroker(args[1:])
+			return
+		case "kv":
+			runKVServer(args[1:])
+			return
+		case "snapshot":
+			runSnapshotDemo(args[1:])
+			return
+		case "paxos":
+			runPaxosDemo(args[1:])
+			return
+		case "scenario":
+			runScenarioDemo(args[1:])
+			return
+		case "partition":
+			runPartitionDemo(args[1:])
+			return
+		case "linearize":
+			runLinearizeDemo(args[1:])
+			return
+		case "oracle":
+			runOracleDemo(args[1:])
+			return
+		case "cluster":
+			runClusterDemo(args[1:])
+			return
+		case "dashboard":
+			runDashboardDemo(args[1:])
+			return
+		case "loadgen":
+			runLoadGen(args[1:])
+			return
+		case "stall":
+			runStallDemo(args[1:])
+			return
+		case "regress":
+			runBenchRegress(args[1:])
+			return
+		case "chaos":
+			runChaos(args[1:])
+			return
+		case "replay":
+			runReplay(args[1:])
+			return
+		case "skew":
+			runSkewDemo(args[1:])
+			return
+		case "token":
+			runToken(args[1:])
+			return
+		case "config":
+			runConfig(args[1:])
+			return
+		case "workerctl":
+			runWorkerctl(args[1:])
+			return
+		}
 	}
-}
 
-// WaitForCompletion waits for all tasks to complete
-func (p *SimpleThreadPool) WaitForCompletion() {
-	p.wg.Wait()
-}
-
-// GetCompletedTasks returns the number of completed tasks
-func (p *SimpleThreadPool) GetCompletedTasks() int64 {
-	return p.completedTasks
-}
+	traceFile := flag.String("trace", "", "write a runtime execution trace of the benchmark to `file`")
+	workers := flag.String("workers", strconv.Itoa(settings.Pool.Workers), "comma-separated pool `sizes` to benchmark")
+	tasks := flag.Int("tasks", settings.Pool.Tasks, "number of tasks per trial")
+	duration := flag.String("duration", "fixed:100ms", "task duration `distribution`: fixed:D, uniform:MIN-MAX, exp:MEAN, normal:MEAN,STDDEV or pareto:SCALE,SHAPE")
+	latency := flag.String("latency", "", "delay every task by a latency drawn from `distribution`, like -duration does, on top of its duration")
+	warmup := flag.Int("warmup", 0, "untimed warm-up trials per pool")
+	trials := flag.Int("trials", 1, "measured trials per pool")
+	seed := flag.Uint64("seed", 1, "random seed for task durations")
+	format := flag.String("format", "text", "result `format`: text, json or csv")
+	output := flag.String("o", "", "write results to `file` instead of stdout")
+	saveGolden := flag.String("save-golden", "", "also save the results as a golden report to `file`")
+	golden := flag.String("golden", "", "compare the results with the golden report in `file`, writing the differences after them")
+	soak := flag.Duration("soak", 0, "instead of trials, load each pool at the first of -workers for this long, checking for leaks and drift")
+	soakEvery := flag.Duration("soak-every", time.Minute, "time between soak snapshots")
+	soakRate := flag.String("soak-arrivals", "poisson:1000", "task arrival `process` of a soak run, as for loadgen")
+	flag.CommandLine.Parse(args)
 
-// ApacheThreadPool represents a more sophisticated worker pool implementation
-type ApacheThreadPool struct {
-	wg            sync.WaitGroup
-	workerPool    chan *Worker
-	completedTasks int64
-}
+	cfg := bench.Config{
+		Tasks:  *tasks,
+		Warmup: *warmup,
+		Trials: *trials,
+		Seed:   *seed,
+	}
+	for _, s := range strings.Split(*workers, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			log.Fatalf("invalid -workers: %v", err)
+		}
+		cfg.Workers = append(cfg.Workers, n)
+	}
+	dist, err := taskqueue.ParseDistribution(*duration)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Duration = dist
+	if *latency != "" {
+		extra, err := taskqueue.ParseDistribution(*latency)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Options = append(cfg.Options, taskqueue.WithMiddleware(taskqueue.LatencyMiddleware(extra, *seed)))
+	}
 
-// Worker represents a worker in the pool
-type Worker struct {
-	ID int
-}
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if err := trace.Start(f); err != nil {
+			log.Fatal(err)
+		}
+		defer trace.Stop()
+		cfg.Options = append(cfg.Options, taskqueue.WithExecutionTracing())
+	}
 
-// NewApacheThreadPool creates a new Apache-style thread pool
-func NewApacheThreadPool(numWorkers int) *ApacheThreadPool {
-	pool := &ApacheThreadPool{
-		workerPool: make(chan *Worker, numWorkers),
+	var write func(io.Writer, []bench.Result) error
+	switch *format {
+	case "text":
+		write = bench.WriteText
+	case "json":
+		write = bench.WriteJSON
+	case "csv":
+		write = bench.WriteCSV
+	default:
+		log.Fatalf("invalid -format %q: want text, json or csv", *format)
 	}
-	
-	// Initialize worker pool
-	for i := 0; i < numWorkers; i++ {
-		pool.workerPool <- &Worker{ID: i}
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
 	}
-	
-	return pool
-}
 
-// ExecuteTasks runs the specified number of tasks
-func (p *ApacheThreadPool) ExecuteTasks() {
-	for i := 0; i < numTasks; i++ {
-		p.wg.Add(1)
-		go func(taskID int) {
-			defer p.wg.Done()
-			
-			// Get worker from pool
-			worker := <-p.workerPool
-			defer func() { p.workerPool <- worker }() // Return worker to pool
-			
-			// Simulate work
-			time.Sleep(100 * time.Millisecond)
-			p.completedTasks++
-		}(i)
+	if *soak > 0 {
+		arrivals, err := bench.ParseArrivals(*soakRate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		soakCfg := bench.SoakConfig{
+			Length: *soak, Interval: *soakEvery, Arrivals: arrivals,
+			Duration: cfg.Duration, Seed: cfg.Seed, Options: cfg.Options,
+		}
+		if err := bench.Soak(out, soakCfg, taskqueue.DefaultBenchPools(), cfg.Workers[0]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	var goldenResults []bench.ResultJSON
+	if *golden != "" {
+		f, err := os.Open(*golden)
+		if err != nil {
+			log.Fatal(err)
+		}
+		goldenResults, err = bench.ReadJSON(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-}
-
-// WaitForCompletion waits for all tasks to complete
-func (p *ApacheThreadPool) WaitForCompletion() {
-	p.wg.Wait()
-}
 
-// GetCompletedTasks returns the number of completed tasks
-func (p *ApacheThreadPool) GetCompletedTasks() int64 {
-	return p.completedTasks
+	results := bench.Run(cfg, taskqueue.DefaultBenchPools())
+	if err := write(out, results); err != nil {
+		log.Fatal(err)
+	}
+	if *saveGolden != "" {
+		f, err := os.Create(*saveGolden)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := bench.WriteJSON(f, results); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if goldenResults != nil {
+		if err := bench.DiffReports(out, goldenResults, bench.ResultsJSON(results)); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
-
-func main() {
-	// Benchmark Simple Thread Pool
-	start := time.Now()
-	simplePool := NewSimpleThreadPool(numWorkers)
-	simplePool.ExecuteTasks()
-	simplePool.WaitForCompletion()
-	simpleDuration := time.Since(start)
-	
-	fmt.Printf("Simple Thread Pool Results:\n")
-	fmt.Printf("Completed Tasks: %d\n", simplePool.GetCompletedTasks())
-	fmt.Printf("Total Time: %v\n\n", simpleDuration)
-	
-	// Benchmark Apache Thread Pool
-	start = time.Now()
-	apachePool := NewApacheThreadPool(numWorkers)
-	apachePool.ExecuteTasks()
-	apachePool.WaitForCompletion()
-	apacheDuration := time.Since(start)
-	
-	fmt.Printf("Apache Thread Pool Results:\n")
-	fmt.Printf("Completed Tasks: %d\n", apachePool.GetCompletedTasks())
-	fmt.Printf("Total Time: %v\n\n", apacheDuration)
-	
-	// Calculate and display performance difference
-	diff := float64(apacheDuration-simpleDuration) / float64(simpleDuration) * 100
-	fmt.Printf("Performance Difference: %.2f%%\n", diff)
-}
\ No newline at end of file
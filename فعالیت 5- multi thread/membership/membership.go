@@ -0,0 +1,592 @@
+// Package membership tracks the members of a group over a taskqueue
+// Transport with the SWIM protocol
+package membership
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"multithread/internal/wire"
+	"multithread/taskqueue"
+)
+
+// maxPiggyback caps the membership updates carried by one SWIM message
+const maxPiggyback = 8
+
+// EventKind identifies an Event
+type EventKind int
+
+const (
+	// Joined is reported when a member is first seen, or seen again
+	// after it was dead or left
+	Joined EventKind = iota
+	// Suspected is reported when a member becomes suspect
+	Suspected
+	// Recovered is reported when a suspect member refutes the suspicion
+	Recovered
+	// Failed is reported when a member is declared dead
+	Failed
+	// Departed is reported when a member leaves the group
+	Departed
+)
+
+// String returns the event kind name
+func (k EventKind) String() string {
+	switch k {
+	case Joined:
+		return "joined"
+	case Suspected:
+		return "suspected"
+	case Recovered:
+		return "recovered"
+	case Failed:
+		return "failed"
+	case Departed:
+		return "departed"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event is a change in the local node's view of the group
+type Event struct {
+	Kind   EventKind
+	Member taskqueue.Member
+}
+
+// Config configures a Group
+type Config struct {
+	// Name identifies the node within the group
+	Name string
+	// Addr is the address the node accepts SWIM messages on, and the one
+	// other members reach it at
+	Addr string
+	// Seeds are addresses of existing members to join through; a node
+	// without seeds starts a new group
+	Seeds []string
+	// Transport carries the SWIM messages
+	Transport taskqueue.Transport
+	// ProbeInterval is how often the node probes one member; defaults to
+	// one second
+	ProbeInterval time.Duration
+	// ProbeTimeout bounds the wait for a direct ack; defaults to 300ms and
+	// must be shorter than ProbeInterval, which bounds the indirect probes
+	ProbeTimeout time.Duration
+	// IndirectProbes is how many members are asked to probe a member that
+	// missed a direct probe; defaults to 3
+	IndirectProbes int
+	// SuspicionTimeout is how long a member stays suspect before it is
+	// declared dead; defaults to five probe intervals
+	SuspicionTimeout time.Duration
+	// ReconnectInterval is how often the node tries to reach a random
+	// member it believes dead or seed it has no live member at, so that the
+	// sides of a network partition, each having declared the other dead,
+	// merge again once it heals, as do groups formed by nodes that joined
+	// through different seeds at once; defaults to the suspicion timeout
+	ReconnectInterval time.Duration
+	// OnEvent, if set, is called for every membership change
+	OnEvent func(Event)
+}
+
+// swimMsg is the payload of SWIM messages: a ping, a ping request naming a
+// Target to probe, or an ack saying whether that probe succeeded, each
+// carrying membership updates
+type swimMsg struct {
+	Join    bool
+	OK      bool
+	Target  string
+	Updates []taskqueue.Member
+}
+
+// marshal encodes m as flags and a length-prefixed target followed by the
+// update count and updates
+func (m *swimMsg) marshal() []byte {
+	var flags uint64
+	if m.Join {
+		flags |= 1
+	}
+	if m.OK {
+		flags |= 2
+	}
+	b := binary.AppendUvarint(nil, flags)
+	b = wire.AppendBytes(b, []byte(m.Target))
+	b = binary.AppendUvarint(b, uint64(len(m.Updates)))
+	for _, u := range m.Updates {
+		b = wire.AppendBytes(b, []byte(u.Name))
+		b = wire.AppendBytes(b, []byte(u.Addr))
+		b = binary.AppendUvarint(b, uint64(u.State))
+		b = binary.AppendUvarint(b, u.Incarnation)
+	}
+	return b
+}
+
+// unmarshal decodes a message encoded by marshal
+func (m *swimMsg) unmarshal(b []byte) error {
+	r := wire.Reader{B: b}
+	flags := r.Uvarint()
+	m.Join, m.OK = flags&1 != 0, flags&2 != 0
+	m.Target = string(r.Bytes())
+	n := r.Uvarint()
+	// Every update takes at least four bytes
+	if n > uint64(len(r.B))/4 {
+		return wire.ErrMalformed
+	}
+	m.Updates = make([]taskqueue.Member, n)
+	for i := range m.Updates {
+		m.Updates[i] = taskqueue.Member{
+			Name:        string(r.Bytes()),
+			Addr:        string(r.Bytes()),
+			State:       taskqueue.MemberState(r.Uvarint()),
+			Incarnation: r.Uvarint(),
+		}
+	}
+	return r.Err
+}
+
+// memberEntry is the local record of another member
+type memberEntry struct {
+	taskqueue.Member
+	// suspicion declares the member dead when it fires; set while suspect
+	suspicion *time.Timer
+}
+
+// gossipUpdate is a membership update waiting to be piggybacked
+type gossipUpdate struct {
+	member taskqueue.Member
+	sends  int
+}
+
+// Group tracks the members of a group with the SWIM protocol: every probe
+// interval it pings one member, asks a few others to ping it indirectly when
+// the ping goes unanswered, and suspects it if nobody gets through. Joins,
+// suspicions, failures and departures spread by piggybacking on the probe
+// traffic, so the cost per member stays constant as the group grows. A
+// registry or failure detector can be built on its view and events
+type Group struct {
+	cfg Config
+	// emit serializes OnEvent calls so they arrive in order
+	emit sync.Mutex
+
+	mu      sync.Mutex
+	self    taskqueue.Member
+	members map[string]*memberEntry
+	gossip  []*gossipUpdate
+	order   []string
+	next    int
+	events  []Event
+}
+
+// NewGroup creates a member of a group; Run starts it
+func NewGroup(cfg Config) *Group {
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = 300 * time.Millisecond
+	}
+	if cfg.IndirectProbes <= 0 {
+		cfg.IndirectProbes = 3
+	}
+	if cfg.SuspicionTimeout <= 0 {
+		cfg.SuspicionTimeout = 5 * cfg.ProbeInterval
+	}
+	if cfg.ReconnectInterval <= 0 {
+		cfg.ReconnectInterval = cfg.SuspicionTimeout
+	}
+	m := &Group{
+		cfg:     cfg,
+		self:    taskqueue.Member{Name: cfg.Name, Addr: cfg.Addr},
+		members: make(map[string]*memberEntry),
+	}
+	m.spread(m.self)
+	return m
+}
+
+// AliveAddrs returns the addresses of the alive members of g other than
+// self, for taskqueue.GossipConfig.Peers
+func AliveAddrs(g *Group, self string) func() []string {
+	return func() []string {
+		var addrs []string
+		for _, member := range g.Members() {
+			if member.State == taskqueue.MemberAlive && member.Addr != self {
+				addrs = append(addrs, member.Addr)
+			}
+		}
+		return addrs
+	}
+}
+
+// Run joins the group through the seeds and probes members until ctx is
+// cancelled; while no other member is known it keeps retrying the seeds
+func (m *Group) Run(ctx context.Context) error {
+	errc := make(chan error, 1)
+	go func() { errc <- taskqueue.ServeRequests(ctx, m.cfg.Transport, m.cfg.Addr, m.handle) }()
+
+	m.join(ctx)
+	ticker := time.NewTicker(m.cfg.ProbeInterval)
+	defer ticker.Stop()
+	reconnect := time.NewTicker(m.cfg.ReconnectInterval)
+	defer reconnect.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.probe(ctx)
+		case <-reconnect.C:
+			m.reconnect(ctx)
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return <-errc
+		}
+	}
+}
+
+// Members returns the local node and the members it believes alive or
+// suspect, ordered by name
+func (m *Group) Members() []taskqueue.Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []taskqueue.Member{m.self}
+	for _, e := range m.members {
+		if e.State == taskqueue.MemberAlive || e.State == taskqueue.MemberSuspect {
+			members = append(members, e.Member)
+		}
+	}
+	slices.SortFunc(members, func(a, b taskqueue.Member) int { return cmp.Compare(a.Name, b.Name) })
+	return members
+}
+
+// Leave tells the other members that the node is leaving and stops it from
+// probing them; cancel Run's context afterwards
+func (m *Group) Leave(ctx context.Context) error {
+	m.mu.Lock()
+	m.self.State = taskqueue.MemberLeft
+	m.self.Incarnation++
+	m.spread(m.self)
+	msg := &swimMsg{Updates: []taskqueue.Member{m.self}}
+	var addrs []string
+	for _, e := range m.members {
+		if e.State == taskqueue.MemberAlive || e.State == taskqueue.MemberSuspect {
+			addrs = append(addrs, e.Addr)
+		}
+	}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Go(func() {
+			m.send(ctx, addr, &taskqueue.Message{Type: taskqueue.MsgPing, Worker: m.cfg.Name, Payload: msg.marshal()})
+		})
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// join pings the seeds in turn until one answers with its view of the group
+func (m *Group) join(ctx context.Context) {
+	for _, seed := range m.cfg.Seeds {
+		if seed == m.cfg.Addr {
+			continue
+		}
+		if _, err := m.request(ctx, seed, taskqueue.MsgPing, &swimMsg{Join: true}, m.cfg.ProbeTimeout); err == nil {
+			return
+		}
+	}
+}
+
+// probe runs one protocol period against the next member in turn
+func (m *Group) probe(ctx context.Context) {
+	m.mu.Lock()
+	left := m.self.State == taskqueue.MemberLeft
+	m.mu.Unlock()
+	if left {
+		return
+	}
+	target, ok := m.target()
+	if !ok {
+		m.join(ctx)
+		return
+	}
+	if _, err := m.request(ctx, target.Addr, taskqueue.MsgPing, &swimMsg{}, m.cfg.ProbeTimeout); err == nil {
+		return
+	}
+
+	// Rule out a lossy link between the two of us by asking others to try
+	helpers := m.helpers(target.Name)
+	acked := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func() {
+			resp, err := m.request(ctx, h.Addr, taskqueue.MsgPingReq, &swimMsg{Target: target.Addr}, m.cfg.ProbeInterval)
+			acked <- err == nil && resp.OK
+		}()
+	}
+	for range helpers {
+		if <-acked {
+			return
+		}
+	}
+
+	m.mu.Lock()
+	if e, ok := m.members[target.Name]; ok && e.State == taskqueue.MemberAlive && e.Incarnation == target.Incarnation {
+		suspect := e.Member
+		suspect.State = taskqueue.MemberSuspect
+		m.apply(suspect)
+	}
+	m.mu.Unlock()
+	m.flush()
+}
+
+// reconnect tries a random dead member or seed not known to be live and, if
+// it answers, exchanges whole views with it, each side then learning of the
+// members it missed and refuting the other's news of its death
+func (m *Group) reconnect(ctx context.Context) {
+	m.mu.Lock()
+	live := map[string]bool{m.cfg.Addr: true}
+	var addrs []string
+	for _, e := range m.members {
+		switch e.State {
+		case taskqueue.MemberAlive, taskqueue.MemberSuspect:
+			live[e.Addr] = true
+		case taskqueue.MemberDead:
+			addrs = append(addrs, e.Addr)
+		}
+	}
+	for _, seed := range m.cfg.Seeds {
+		if !live[seed] && !slices.Contains(addrs, seed) {
+			addrs = append(addrs, seed)
+		}
+	}
+	left := m.self.State == taskqueue.MemberLeft
+	m.mu.Unlock()
+	if left || len(addrs) == 0 {
+		return
+	}
+	m.request(ctx, addrs[rand.IntN(len(addrs))], taskqueue.MsgPing, &swimMsg{Join: true}, m.cfg.ProbeTimeout)
+}
+
+// target picks the next member to probe, visiting every live member once
+// per round in a random order
+func (m *Group) target() (taskqueue.Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for range 2 {
+		for ; m.next < len(m.order); m.next++ {
+			e, ok := m.members[m.order[m.next]]
+			if ok && (e.State == taskqueue.MemberAlive || e.State == taskqueue.MemberSuspect) {
+				m.next++
+				return e.Member, true
+			}
+		}
+		m.order = m.order[:0]
+		for name := range m.members {
+			m.order = append(m.order, name)
+		}
+		rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		m.next = 0
+	}
+	return taskqueue.Member{}, false
+}
+
+// helpers picks up to IndirectProbes alive members other than exclude
+func (m *Group) helpers(exclude string) []taskqueue.Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var alive []taskqueue.Member
+	for _, e := range m.members {
+		if e.State == taskqueue.MemberAlive && e.Name != exclude {
+			alive = append(alive, e.Member)
+		}
+	}
+	rand.Shuffle(len(alive), func(i, j int) { alive[i], alive[j] = alive[j], alive[i] })
+	return alive[:min(len(alive), m.cfg.IndirectProbes)]
+}
+
+// request sends a message with piggybacked updates to addr and applies the
+// updates carried by the reply
+func (m *Group) request(ctx context.Context, addr string, t taskqueue.MessageType, req *swimMsg, timeout time.Duration) (*swimMsg, error) {
+	req.Updates = append(req.Updates, m.piggyback(req.Join)...)
+	reply, err := taskqueue.RoundTrip(ctx, m.cfg.Transport, addr, &taskqueue.Message{Type: t, Worker: m.cfg.Name, Payload: req.marshal()}, true, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var resp swimMsg
+	if err := resp.unmarshal(reply.Payload); err != nil {
+		return nil, err
+	}
+	m.receive(resp.Updates)
+	return &resp, nil
+}
+
+// send delivers a message without waiting for a reply
+func (m *Group) send(ctx context.Context, addr string, msg *taskqueue.Message) error {
+	_, err := taskqueue.RoundTrip(ctx, m.cfg.Transport, addr, msg, false, m.cfg.ProbeTimeout)
+	return err
+}
+
+// handle answers one ping or ping request
+func (m *Group) handle(ctx context.Context, conn taskqueue.Conn, msg *taskqueue.Message) {
+	var req swimMsg
+	if req.unmarshal(msg.Payload) != nil {
+		return
+	}
+	m.receive(req.Updates)
+
+	resp := swimMsg{OK: true}
+	switch msg.Type {
+	case taskqueue.MsgPing:
+	case taskqueue.MsgPingReq:
+		_, err := m.request(ctx, req.Target, taskqueue.MsgPing, &swimMsg{}, m.cfg.ProbeTimeout)
+		resp.OK = err == nil
+	default:
+		return
+	}
+	// A joining node gets the whole view so it need not wait for gossip
+	resp.Updates = m.piggyback(req.Join)
+	conn.Send(&taskqueue.Message{Type: taskqueue.MsgAck, Worker: m.cfg.Name, Payload: resp.marshal()})
+}
+
+// piggyback returns the updates to carry on an outgoing message: the least
+// sent pending updates, or every known member for a joining node. Updates
+// are dropped once they have been sent often enough to have reached the
+// whole group with high probability
+func (m *Group) piggyback(all bool) []taskqueue.Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if all {
+		updates := []taskqueue.Member{m.self}
+		for _, e := range m.members {
+			updates = append(updates, e.Member)
+		}
+		return updates
+	}
+
+	slices.SortStableFunc(m.gossip, func(a, b *gossipUpdate) int { return cmp.Compare(a.sends, b.sends) })
+	limit := 3 * bits.Len(uint(len(m.members)+1))
+	var updates []taskqueue.Member
+	for _, g := range m.gossip[:min(len(m.gossip), maxPiggyback)] {
+		updates = append(updates, g.member)
+		g.sends++
+	}
+	m.gossip = slices.DeleteFunc(m.gossip, func(g *gossipUpdate) bool { return g.sends >= limit })
+	return updates
+}
+
+// spread queues u for dissemination, replacing older news about the same
+// member; the caller holds m.mu
+func (m *Group) spread(u taskqueue.Member) {
+	m.gossip = slices.DeleteFunc(m.gossip, func(g *gossipUpdate) bool { return g.member.Name == u.Name })
+	m.gossip = append(m.gossip, &gossipUpdate{member: u})
+}
+
+// receive applies updates from another member and reports the resulting
+// events
+func (m *Group) receive(updates []taskqueue.Member) {
+	m.mu.Lock()
+	for _, u := range updates {
+		m.apply(u)
+	}
+	m.mu.Unlock()
+	m.flush()
+}
+
+// apply merges one update into the local view, queueing any event for
+// flush; the caller holds m.mu
+func (m *Group) apply(u taskqueue.Member) {
+	if u.Name == m.cfg.Name {
+		// Refute rumours that we are suspect or dead by outliving them
+		if m.self.State == taskqueue.MemberAlive && u.State != taskqueue.MemberAlive && u.Incarnation >= m.self.Incarnation {
+			m.self.Incarnation = u.Incarnation + 1
+			m.spread(m.self)
+		}
+		return
+	}
+
+	e, known := m.members[u.Name]
+	if known && !supersedes(u, e.Member) {
+		return
+	}
+	var prev taskqueue.MemberState
+	if known {
+		prev = e.State
+	} else {
+		prev = taskqueue.MemberDead
+		e = &memberEntry{}
+		m.members[u.Name] = e
+	}
+	e.Member = u
+	m.spread(u)
+
+	if e.suspicion != nil {
+		e.suspicion.Stop()
+		e.suspicion = nil
+	}
+	if u.State == taskqueue.MemberSuspect {
+		e.suspicion = time.AfterFunc(m.cfg.SuspicionTimeout, func() { m.expire(u) })
+	}
+
+	ended := prev == taskqueue.MemberDead || prev == taskqueue.MemberLeft
+	switch {
+	case u.State == taskqueue.MemberAlive && ended, u.State == taskqueue.MemberSuspect && ended:
+		m.events = append(m.events, Event{Kind: Joined, Member: u})
+	case u.State == taskqueue.MemberAlive && prev == taskqueue.MemberSuspect:
+		m.events = append(m.events, Event{Kind: Recovered, Member: u})
+	case u.State == taskqueue.MemberSuspect && prev == taskqueue.MemberAlive:
+		m.events = append(m.events, Event{Kind: Suspected, Member: u})
+	case u.State == taskqueue.MemberDead && !ended:
+		m.events = append(m.events, Event{Kind: Failed, Member: u})
+	case u.State == taskqueue.MemberLeft && !ended:
+		m.events = append(m.events, Event{Kind: Departed, Member: u})
+	}
+}
+
+// expire declares a member dead if it is still suspect at the incarnation
+// it was suspected at
+func (m *Group) expire(suspect taskqueue.Member) {
+	m.mu.Lock()
+	if e, ok := m.members[suspect.Name]; ok && e.Member == suspect {
+		dead := suspect
+		dead.State = taskqueue.MemberDead
+		m.apply(dead)
+	}
+	m.mu.Unlock()
+	m.flush()
+}
+
+// flush reports queued events outside the lock, in the order they occurred
+func (m *Group) flush() {
+	m.emit.Lock()
+	defer m.emit.Unlock()
+	m.mu.Lock()
+	events := m.events
+	m.events = nil
+	m.mu.Unlock()
+	if m.cfg.OnEvent == nil {
+		return
+	}
+	for _, ev := range events {
+		m.cfg.OnEvent(ev)
+	}
+}
+
+// supersedes reports whether update u replaces what is known as cur. Within
+// an incarnation alive < suspect < dead; a left member only comes back by
+// rejoining with a higher incarnation
+func supersedes(u, cur taskqueue.Member) bool {
+	switch {
+	case cur.State == taskqueue.MemberLeft:
+		return u.State == taskqueue.MemberAlive && u.Incarnation > cur.Incarnation
+	case u.State == taskqueue.MemberLeft:
+		return true
+	case u.Incarnation != cur.Incarnation:
+		return u.Incarnation > cur.Incarnation
+	default:
+		return u.State > cur.State
+	}
+}
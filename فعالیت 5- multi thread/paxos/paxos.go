@@ -0,0 +1,432 @@
+// Package paxos is single-decree Paxos: acceptors, proposers and a learner
+// choosing one value over a taskqueue Transport, or as tasks of a
+// taskqueue.Sim with a deterministic schedule
+package paxos
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"multithread/internal/wire"
+	"multithread/taskqueue"
+)
+
+// exchangeTimeout bounds each Paxos exchange with another node
+const exchangeTimeout = 500 * time.Millisecond
+
+// Ballot orders Paxos proposals: the higher round wins and ties go to the
+// higher node, so no two proposers ever use the same ballot
+type Ballot struct {
+	Round uint64
+	Node  uint64
+}
+
+// Less reports whether b is ordered before o
+func (b Ballot) Less(o Ballot) bool {
+	return b.Round < o.Round || b.Round == o.Round && b.Node < o.Node
+}
+
+// IsZero reports whether b is the zero ballot, which no proposal uses
+func (b Ballot) IsZero() bool {
+	return b == Ballot{}
+}
+
+// message is the payload of prepare, accept and learn messages and their
+// replies. A promise carries the acceptor's accepted ballot and value; a
+// rejection carries the ballot the acceptor promised instead in Ballot
+type message struct {
+	Ballot   Ballot
+	Accepted Ballot
+	Value    []byte
+	OK       bool
+}
+
+// marshal encodes m as uvarints followed by its length-prefixed value
+func (m *message) marshal() []byte {
+	var ok uint64
+	if m.OK {
+		ok = 1
+	}
+	var b []byte
+	for _, v := range []uint64{m.Ballot.Round, m.Ballot.Node, m.Accepted.Round, m.Accepted.Node, ok} {
+		b = binary.AppendUvarint(b, v)
+	}
+	return wire.AppendBytes(b, m.Value)
+}
+
+// unmarshal decodes a message encoded by marshal
+func (m *message) unmarshal(b []byte) error {
+	r := wire.Reader{B: b}
+	m.Ballot = Ballot{Round: r.Uvarint(), Node: r.Uvarint()}
+	m.Accepted = Ballot{Round: r.Uvarint(), Node: r.Uvarint()}
+	m.OK = r.Uvarint() == 1
+	m.Value = r.Bytes()
+	return r.Err
+}
+
+// Acceptor is the memory of single-decree Paxos: it promises to ignore
+// ballots lower than the highest it has prepared and remembers the last
+// value it accepted, telling the learners about each acceptance
+type Acceptor struct {
+	addr      string
+	transport taskqueue.Transport
+	learners  []string
+	// sim, if set, runs the acceptor as tasks of a simulation
+	sim *taskqueue.Sim
+
+	mu       sync.Mutex
+	promised Ballot
+	accepted Ballot
+	value    []byte
+}
+
+// NewAcceptor creates an acceptor that will listen on addr and report
+// acceptances to the learners at the given addresses
+func NewAcceptor(addr string, transport taskqueue.Transport, learners []string) *Acceptor {
+	return &Acceptor{addr: addr, transport: transport, learners: learners}
+}
+
+// Run answers proposers until ctx is cancelled
+func (a *Acceptor) Run(ctx context.Context) error {
+	if a.sim != nil {
+		return taskqueue.SimServeRequests(ctx, a.sim, a.transport, a.addr, handler(a.handle))
+	}
+	return taskqueue.ServeRequests(ctx, a.transport, a.addr, handler(a.handle))
+}
+
+// handle answers one prepare or accept message
+func (a *Acceptor) handle(ctx context.Context, conn taskqueue.Conn, m *taskqueue.Message, req *message) {
+	a.mu.Lock()
+	var resp message
+	switch m.Type {
+	case taskqueue.MsgPrepare:
+		if a.promised.Less(req.Ballot) {
+			a.promised = req.Ballot
+			resp = message{Ballot: req.Ballot, Accepted: a.accepted, Value: a.value, OK: true}
+		} else {
+			resp = message{Ballot: a.promised}
+		}
+	case taskqueue.MsgAccept:
+		if !req.Ballot.Less(a.promised) {
+			a.promised, a.accepted, a.value = req.Ballot, req.Ballot, req.Value
+			resp = message{Ballot: req.Ballot, OK: true}
+		} else {
+			resp = message{Ballot: a.promised}
+		}
+	default:
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+
+	conn.Send(&taskqueue.Message{Type: m.Type, Payload: resp.marshal()})
+	if m.Type == taskqueue.MsgAccept && resp.OK {
+		learn := &taskqueue.Message{Type: taskqueue.MsgLearn, Worker: a.addr, Payload: req.marshal()}
+		for _, addr := range a.learners {
+			if a.sim != nil {
+				a.sim.Go("learn "+addr, func() { taskqueue.SimRoundTrip(ctx, a.sim, a.transport, addr, learn, false, exchangeTimeout) })
+			} else {
+				go taskqueue.RoundTrip(ctx, a.transport, addr, learn, false, exchangeTimeout)
+			}
+		}
+	}
+}
+
+// Proposer drives single-decree Paxos rounds against a set of acceptors
+// until a value is chosen
+type Proposer struct {
+	id        uint64
+	acceptors []string
+	transport taskqueue.Transport
+	sim       *taskqueue.Sim
+
+	mu    sync.Mutex
+	round uint64
+}
+
+// NewProposer creates a proposer; id must be unique among proposers
+func NewProposer(id uint64, acceptors []string, transport taskqueue.Transport) *Proposer {
+	return &Proposer{id: id, acceptors: acceptors, transport: transport}
+}
+
+// Propose runs rounds until a value is chosen and returns it; that is value
+// unless another proposal got further first, in which case the value already
+// chosen, or about to be, wins. Rounds that fail to reach a majority are
+// retried after a random backoff with a higher ballot
+func (p *Proposer) Propose(ctx context.Context, value []byte) ([]byte, error) {
+	for {
+		p.mu.Lock()
+		p.round++
+		b := Ballot{Round: p.round, Node: p.id}
+		p.mu.Unlock()
+
+		// Phase 1: collect promises, adopting the highest accepted value
+		promises, highest := 0, Ballot{}
+		chosen := value
+		for _, resp := range p.broadcast(ctx, taskqueue.MsgPrepare, &message{Ballot: b}) {
+			if !resp.OK {
+				p.observe(resp.Ballot)
+				continue
+			}
+			promises++
+			if highest.Less(resp.Accepted) {
+				highest, chosen = resp.Accepted, resp.Value
+			}
+		}
+
+		// Phase 2: ask the acceptors to accept the value
+		if p.majority(promises) {
+			accepts := 0
+			for _, resp := range p.broadcast(ctx, taskqueue.MsgAccept, &message{Ballot: b, Value: chosen}) {
+				if resp.OK {
+					accepts++
+				} else {
+					p.observe(resp.Ballot)
+				}
+			}
+			if p.majority(accepts) {
+				return chosen, nil
+			}
+		}
+
+		if p.sim != nil {
+			p.sim.Sleep(p.sim.Duration(0, exchangeTimeout))
+			if ctx.Err() != nil {
+				return nil, context.Cause(ctx)
+			}
+			continue
+		}
+		select {
+		case <-time.After(rand.N(exchangeTimeout)):
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// observe moves the proposer's round past a ballot an acceptor promised
+func (p *Proposer) observe(b Ballot) {
+	p.mu.Lock()
+	p.round = max(p.round, b.Round)
+	p.mu.Unlock()
+}
+
+// majority reports whether n acceptors are a majority
+func (p *Proposer) majority(n int) bool {
+	return 2*n > len(p.acceptors)
+}
+
+// broadcast sends req to every acceptor and returns the replies that arrived
+// within the timeout
+func (p *Proposer) broadcast(ctx context.Context, t taskqueue.MessageType, req *message) []message {
+	m := &taskqueue.Message{Type: t, Payload: req.marshal()}
+	if p.sim != nil {
+		return p.simBroadcast(ctx, m)
+	}
+	var mu sync.Mutex
+	var replies []message
+	var wg sync.WaitGroup
+	for _, addr := range p.acceptors {
+		wg.Go(func() {
+			reply, err := taskqueue.RoundTrip(ctx, p.transport, addr, m, true, exchangeTimeout)
+			var resp message
+			if err != nil || resp.unmarshal(reply.Payload) != nil {
+				return
+			}
+			mu.Lock()
+			replies = append(replies, resp)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	return replies
+}
+
+// simBroadcast is broadcast run as tasks of the proposer's simulation
+func (p *Proposer) simBroadcast(ctx context.Context, m *taskqueue.Message) []message {
+	results := taskqueue.NewSimQueue[*taskqueue.Message](p.sim)
+	for _, addr := range p.acceptors {
+		p.sim.Go("exchange "+addr, func() {
+			reply, _ := taskqueue.SimRoundTrip(ctx, p.sim, p.transport, addr, m, true, exchangeTimeout)
+			results.Send(reply)
+		})
+	}
+	var replies []message
+	deadline := p.sim.Now().Add(exchangeTimeout)
+	for range p.acceptors {
+		reply, ok := results.Recv(deadline.Sub(p.sim.Now()))
+		if !ok {
+			break
+		}
+		var resp message
+		if reply != nil && resp.unmarshal(reply.Payload) == nil {
+			replies = append(replies, resp)
+		}
+	}
+	return replies
+}
+
+// Learner finds out which value was chosen: a value is chosen once a
+// majority of acceptors report accepting it under the same ballot
+type Learner struct {
+	addr      string
+	transport taskqueue.Transport
+	acceptors int
+	done      chan struct{}
+	sim       *taskqueue.Sim
+
+	mu     sync.Mutex
+	votes  map[Ballot]map[string]bool
+	chosen []byte
+}
+
+// NewLearner creates a learner for a group of acceptors of the given size
+// that will listen on addr
+func NewLearner(addr string, transport taskqueue.Transport, acceptors int) *Learner {
+	return &Learner{
+		addr:      addr,
+		transport: transport,
+		acceptors: acceptors,
+		done:      make(chan struct{}),
+		votes:     make(map[Ballot]map[string]bool),
+	}
+}
+
+// Run receives acceptances until ctx is cancelled
+func (l *Learner) Run(ctx context.Context) error {
+	if l.sim != nil {
+		return taskqueue.SimServeRequests(ctx, l.sim, l.transport, l.addr, handler(l.handle))
+	}
+	return taskqueue.ServeRequests(ctx, l.transport, l.addr, handler(l.handle))
+}
+
+// handle counts one acceptance
+func (l *Learner) handle(_ context.Context, _ taskqueue.Conn, m *taskqueue.Message, req *message) {
+	if m.Type != taskqueue.MsgLearn {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.chosen != nil {
+		return
+	}
+	voters := l.votes[req.Ballot]
+	if voters == nil {
+		voters = make(map[string]bool)
+		l.votes[req.Ballot] = voters
+	}
+	voters[m.Worker] = true
+	if 2*len(voters) > l.acceptors {
+		l.chosen = req.Value
+		if l.chosen == nil {
+			l.chosen = []byte{}
+		}
+		close(l.done)
+	}
+}
+
+// Value returns the chosen value, if it is known yet
+func (l *Learner) Value() ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.chosen, l.chosen != nil
+}
+
+// Wait blocks until the chosen value is known or ctx is done
+func (l *Learner) Wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-l.done:
+		v, _ := l.Value()
+		return v, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// handler adapts handle to taskqueue.ServeRequests, decoding the Paxos
+// payload and dropping messages that do not carry one
+func handler(handle func(context.Context, taskqueue.Conn, *taskqueue.Message, *message)) func(context.Context, taskqueue.Conn, *taskqueue.Message) {
+	return func(ctx context.Context, conn taskqueue.Conn, m *taskqueue.Message) {
+		var req message
+		if req.unmarshal(m.Payload) == nil {
+			handle(ctx, conn, m, &req)
+		}
+	}
+}
+
+// Simulate has proposers proposers compete to choose a value among acceptors
+// acceptors on a deterministic simulation seeded with seed, and writes each
+// proposal and its outcome to w, followed by the schedule's fingerprint: the
+// same arguments always print the same lines. It fails if the proposers or
+// the learner disagree on the value chosen
+func Simulate(w io.Writer, proposers, acceptors int, seed uint64) error {
+	return SimulateOn(w, taskqueue.NewSim(seed), proposers, acceptors)
+}
+
+// SimulateOn is Simulate on sim, which may be observed, such as by a
+// taskqueue.SimRecorder
+func SimulateOn(w io.Writer, sim *taskqueue.Sim, proposers, acceptors int) error {
+	if proposers < 1 || acceptors < 1 {
+		return fmt.Errorf("paxos: need proposers and acceptors, got %d and %d", proposers, acceptors)
+	}
+	network := taskqueue.NewSimNetwork(sim)
+	ctx := context.Background()
+	logf := func(format string, args ...any) {
+		fmt.Fprintf(w, "%10v  "+format+"\n", append([]any{sim.Elapsed()}, args...)...)
+	}
+
+	learner := NewLearner("learner", network, acceptors)
+	learner.sim = sim
+	addrs := make([]string, acceptors)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("acceptor-%d", i)
+		a := NewAcceptor(addrs[i], network, []string{learner.addr})
+		a.sim = sim
+		sim.Go(addrs[i], func() { a.Run(ctx) })
+	}
+	sim.Go(learner.addr, func() { learner.Run(ctx) })
+
+	chosen := make([][]byte, proposers)
+	remaining := proposers
+	for i := range proposers {
+		p := NewProposer(uint64(i+1), addrs, network)
+		p.sim = sim
+		sim.Go(fmt.Sprintf("proposer-%d", p.id), func() {
+			sim.Sleep(sim.Duration(0, 20*time.Millisecond))
+			value := fmt.Sprintf("value-%d", p.id)
+			logf("proposer %d proposes %q", p.id, value)
+			chosen[i], _ = p.Propose(ctx, []byte(value))
+			p.mu.Lock()
+			rounds := p.round
+			p.mu.Unlock()
+			logf("proposer %d learns %q was chosen after %d rounds", p.id, chosen[i], rounds)
+			if remaining--; remaining == 0 {
+				// Let the last acceptances reach the learner
+				sim.Sleep(exchangeTimeout)
+				sim.Stop()
+			}
+		})
+	}
+	if err := sim.Run(time.Hour); err != nil {
+		return err
+	}
+
+	learned, ok := learner.Value()
+	if !ok {
+		return errors.New("paxos: the learner never learned a value")
+	}
+	for i, v := range chosen {
+		if !bytes.Equal(v, learned) {
+			return fmt.Errorf("paxos: proposer %d chose %q but the learner learned %q", i+1, v, learned)
+		}
+	}
+	fmt.Fprintf(w, "all agree on %q after %v in %d steps, fingerprint %016x\n", learned, sim.Elapsed(), sim.Steps(), sim.Fingerprint())
+	return nil
+}
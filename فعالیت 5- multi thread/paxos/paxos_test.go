@@ -0,0 +1,121 @@
+package paxos
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// cluster runs acceptors acceptors, each on a host of its own, and a
+// learner on network until the test ends, returning the acceptor addresses
+// and the learner
+func cluster(t *testing.T, network *taskqueue.MemoryNetwork, acceptors int) ([]string, *Learner) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	learner := NewLearner("learner", network.Host("learner"), acceptors)
+	wg.Go(func() { learner.Run(ctx) })
+	addrs := make([]string, acceptors)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("acceptor-%d", i)
+		a := NewAcceptor(addrs[i], network.Host(addrs[i]), []string{"learner"})
+		wg.Go(func() { a.Run(ctx) })
+	}
+	return addrs, learner
+}
+
+// proposeAll has proposers proposers propose a value of their own at once
+// and returns what each was told was chosen
+func proposeAll(t *testing.T, network *taskqueue.MemoryNetwork, addrs []string, proposers int) [][]byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	chosen := make([][]byte, proposers)
+	var wg sync.WaitGroup
+	for i := range proposers {
+		host := fmt.Sprintf("proposer-%d", i+1)
+		p := NewProposer(uint64(i+1), addrs, network.Host(host))
+		wg.Go(func() {
+			v, err := p.Propose(ctx, fmt.Appendf(nil, "value-%d", i+1))
+			if err != nil {
+				t.Errorf("proposer %d: %v", i+1, err)
+			}
+			chosen[i] = v
+		})
+	}
+	wg.Wait()
+	return chosen
+}
+
+// agree fails the test unless every proposer and the learner hold the same
+// value
+func agree(t *testing.T, chosen [][]byte, learner *Learner) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	learned, err := learner.Wait(ctx)
+	if err != nil {
+		t.Fatalf("the learner learned nothing: %v", err)
+	}
+	for i, v := range chosen {
+		if !bytes.Equal(v, learned) {
+			t.Errorf("proposer %d was told %q was chosen, the learner learned %q", i+1, v, learned)
+		}
+	}
+}
+
+func TestCompetingProposersAgree(t *testing.T) {
+	for round := range 5 {
+		t.Run(fmt.Sprint(round), func(t *testing.T) {
+			network := taskqueue.NewMemoryNetwork()
+			addrs, learner := cluster(t, network, 5)
+			agree(t, proposeAll(t, network, addrs, 4), learner)
+		})
+	}
+}
+
+func TestProgressWithMinorityDown(t *testing.T) {
+	network := taskqueue.NewMemoryNetwork()
+	addrs, learner := cluster(t, network, 5)
+	network.Crash(addrs[0])
+	network.Crash(addrs[3])
+	agree(t, proposeAll(t, network, addrs, 2), learner)
+}
+
+func TestNoChoiceWithMajorityDown(t *testing.T) {
+	network := taskqueue.NewMemoryNetwork()
+	addrs, learner := cluster(t, network, 5)
+	for _, addr := range addrs[:3] {
+		network.Crash(addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p := NewProposer(1, addrs, network.Host("proposer-1"))
+	if v, err := p.Propose(ctx, []byte("value")); err == nil {
+		t.Fatalf("two of five acceptors chose %q", v)
+	}
+	if v, ok := learner.Value(); ok {
+		t.Fatalf("the learner learned %q from a minority", v)
+	}
+}
+
+func TestSimulatedAgreement(t *testing.T) {
+	for seed := range uint64(10) {
+		if err := Simulate(io.Discard, 1+int(seed)%4, 3+2*int(seed%2), seed); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+		}
+		if err := SimulateScenario(io.Discard, seed); err != nil {
+			t.Errorf("scenario seed %d: %v", seed, err)
+		}
+	}
+}
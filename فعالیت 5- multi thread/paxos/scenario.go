@@ -0,0 +1,79 @@
+package paxos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// SimulateScenario runs a Paxos cluster through a failure script on a
+// simulation seeded with seed, writing each step to w: a proposer is cut
+// off, two of five acceptors and another proposer crash, and later the
+// network heals and the crashed nodes restart. Acceptors keep their
+// promises across a restart, as they would on disk; a restarted proposer
+// proposes under a new ID. Every proposer and the learner must agree
+func SimulateScenario(w io.Writer, seed uint64) error {
+	const acceptors, proposers = 5, 3
+	sim := taskqueue.NewSim(seed)
+	network := taskqueue.NewSimNetwork(sim)
+	ctx := context.Background()
+	sc := taskqueue.NewScenario(sim, network).Log(w)
+
+	learner := NewLearner("learner", network.Host("learner"), acceptors)
+	learner.sim = sim
+	sc.Node("learner", func(int) { learner.Run(ctx) })
+	addrs := make([]string, acceptors)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("acceptor-%d", i)
+		a := NewAcceptor(addrs[i], network.Host(addrs[i]), []string{learner.addr})
+		a.sim = sim
+		sc.Node(addrs[i], func(int) { a.Run(ctx) })
+	}
+	chosen := make([][]byte, proposers)
+	for i := range proposers {
+		host := fmt.Sprintf("proposer-%d", i+1)
+		sc.Node(host, func(life int) {
+			p := NewProposer(uint64(i+1+10*life), addrs, network.Host(host))
+			p.sim = sim
+			sim.Sleep(sim.Duration(0, 10*time.Millisecond))
+			if v, err := p.Propose(ctx, fmt.Appendf(nil, "value-%d", p.id)); err == nil {
+				chosen[i] = v
+			}
+		})
+	}
+
+	agree := func() error {
+		learned, ok := learner.Value()
+		if !ok {
+			return errors.New("the learner learned no value")
+		}
+		for i, v := range chosen {
+			if v == nil {
+				return fmt.Errorf("proposer %d has not finished", i+1)
+			}
+			if !bytes.Equal(v, learned) {
+				return fmt.Errorf("proposer %d chose %q but the learner learned %q", i+1, v, learned)
+			}
+		}
+		return nil
+	}
+	err := sc.
+		At(2*time.Millisecond).Partition("proposer-1").
+		At(5*time.Millisecond).KillNode("acceptor-0").KillNode("acceptor-1").
+		At(15*time.Millisecond).KillNode("proposer-2").
+		At(time.Second).Heal().RestartNode("acceptor-0").RestartNode("acceptor-1").
+		After(100*time.Millisecond).RestartNode("proposer-2").
+		At(5*time.Second).Check("every proposer and the learner agree", agree).
+		Run(time.Minute)
+	if err != nil {
+		return err
+	}
+	learned, _ := learner.Value()
+	fmt.Fprintf(w, "all agree on %q, fingerprint %016x\n", learned, sim.Fingerprint())
+	return nil
+}
@@ -0,0 +1,7 @@
+package pubsub
+
+import "errors"
+
+// ErrClosed is returned for publishing to or subscribing on a closed
+// pub/sub broker
+var ErrClosed = errors.New("broker is closed")
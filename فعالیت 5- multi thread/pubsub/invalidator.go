@@ -0,0 +1,55 @@
+package pubsub
+
+import (
+	"context"
+
+	"multithread/internal/wire"
+)
+
+// appendInvalidation encodes an invalidation of key by node as both
+// strings, uvarint-prefixed
+func appendInvalidation(b []byte, node, key string) []byte {
+	b = wire.AppendBytes(b, []byte(node))
+	return wire.AppendBytes(b, []byte(key))
+}
+
+// parseInvalidation decodes an invalidation encoded by appendInvalidation
+func parseInvalidation(b []byte) (node, key string, err error) {
+	r := wire.Reader{B: b}
+	node = string(r.Bytes())
+	key = string(r.Bytes())
+	return node, key, r.Err
+}
+
+// Invalidator broadcasts the invalidations of a taskqueue.DistributedCache
+// through a topic of a broker: every node publishes its changes and
+// subscribes to everyone's
+type Invalidator struct {
+	client *Client
+	topic  string
+	node   string
+}
+
+// NewInvalidator creates an invalidator for the named node publishing
+// on topic through client
+func NewInvalidator(client *Client, topic, node string) *Invalidator {
+	return &Invalidator{client: client, topic: topic, node: node}
+}
+
+// Invalidate implements taskqueue.CacheInvalidator
+func (b *Invalidator) Invalidate(ctx context.Context, key string) error {
+	_, err := b.client.Publish(ctx, b.topic, appendInvalidation(nil, b.node, key))
+	return err
+}
+
+// Listen implements taskqueue.CacheInvalidator with an ephemeral
+// subscription, so invalidations published while the node is disconnected
+// are missed
+func (b *Invalidator) Listen(ctx context.Context, fn func(key string)) error {
+	return b.client.Subscribe(ctx, b.topic, "", func(ctx context.Context, p *Publication) error {
+		if node, key, err := parseInvalidation(p.Payload); err == nil && node != b.node {
+			fn(key)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,592 @@
+// Package pubsub is a topic-based publish/subscribe broker running its
+// deliveries on a taskqueue Executor, and a server and client serving it
+// over a taskqueue Transport
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// Publication is a message published to a topic, as handed to subscribers
+type Publication struct {
+	Topic string
+	// Seq numbers the topic's publications from 1 in publish order
+	Seq     uint64
+	Payload []byte
+	// Redeliveries counts the earlier deliveries of the publication to the
+	// same durable subscription that failed
+	Redeliveries int
+}
+
+// SubscriberFunc handles a publication; an error asks a durable subscription
+// to deliver it again, and drops it from an ephemeral one
+type SubscriberFunc func(ctx context.Context, p *Publication) error
+
+// Config configures a Broker
+type Config struct {
+	// Backlog caps the publications queued for each subscription; when it is
+	// full the oldest is dropped. Defaults to 1024
+	Backlog int
+	// RedeliveryDelay is how long a durable subscription waits before
+	// delivering a failed publication again. Defaults to 100ms
+	RedeliveryDelay time.Duration
+	// MaxRedeliveries is how many times a failed publication is delivered
+	// again before it is dropped. Defaults to 10
+	MaxRedeliveries int
+}
+
+// Broker fans publications out to the subscriptions of their topic. Each
+// delivery is a task on the broker's executor, and the deliveries of one
+// subscription run one at a time in publish order, so subscriptions make
+// progress in parallel without reordering what each one sees.
+//
+// Ephemeral subscriptions only see what is published while they exist.
+// Durable subscriptions are named, outlive their subscriber and keep queuing
+// publications, delivered when a subscriber attaches to the name again;
+// their subscriber is retried until it accepts a publication, so delivery is
+// at least once
+type Broker struct {
+	exec   taskqueue.Executor
+	cfg    Config
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	topics map[string]*pubsubTopic
+}
+
+// pubsubTopic holds the subscriptions of one topic
+type pubsubTopic struct {
+	name string
+	// publishMu is held from numbering a publication until it is queued for
+	// every subscription, so concurrent publishes queue in publish order
+	publishMu sync.Mutex
+	seq       uint64 // guarded by publishMu and b.mu
+	subs      map[*Subscription]struct{}
+	durable   map[string]*Subscription
+}
+
+// NewBroker creates a broker delivering on exec; the broker must be closed
+// before exec is shut down
+func NewBroker(exec taskqueue.Executor, cfg Config) *Broker {
+	if cfg.Backlog <= 0 {
+		cfg.Backlog = 1024
+	}
+	if cfg.RedeliveryDelay <= 0 {
+		cfg.RedeliveryDelay = 100 * time.Millisecond
+	}
+	if cfg.MaxRedeliveries <= 0 {
+		cfg.MaxRedeliveries = 10
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Broker{exec: exec, cfg: cfg, ctx: ctx, cancel: cancel, topics: make(map[string]*pubsubTopic)}
+}
+
+// topic returns the named topic, creating it; the caller holds b.mu
+func (b *Broker) topic(name string) *pubsubTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &pubsubTopic{name: name, subs: make(map[*Subscription]struct{}), durable: make(map[string]*Subscription)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// Publish queues payload for every subscription of topic and returns its
+// sequence number; it does not wait for the deliveries
+func (b *Broker) Publish(topic string, payload []byte) (uint64, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return 0, ErrClosed
+	}
+	t := b.topic(topic)
+	b.mu.Unlock()
+
+	t.publishMu.Lock()
+	defer t.publishMu.Unlock()
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return 0, ErrClosed
+	}
+	t.seq++
+	seq := t.seq
+	subs := make([]*Subscription, 0, len(t.subs))
+	for s := range t.subs {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.enqueue(&Publication{Topic: topic, Seq: seq, Payload: payload})
+	}
+	return seq, nil
+}
+
+// Subscribe adds an ephemeral subscription to topic delivering to fn
+func (b *Broker) Subscribe(topic string, fn SubscriberFunc) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	t := b.topic(topic)
+	s := &Subscription{broker: b, topic: t, fn: fn}
+	t.subs[s] = struct{}{}
+	return s, nil
+}
+
+// SubscribeDurable attaches fn to the durable subscription name of topic,
+// creating it, and delivers the publications it queued while detached. Only
+// one subscriber can be attached to a name at a time
+func (b *Broker) SubscribeDurable(topic, name string, fn SubscriberFunc) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	t := b.topic(topic)
+	s, ok := t.durable[name]
+	if !ok {
+		s = &Subscription{broker: b, topic: t, name: name, durable: true}
+		t.durable[name] = s
+		t.subs[s] = struct{}{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fn != nil {
+		return nil, fmt.Errorf("durable subscription %q of topic %q already has a subscriber", name, topic)
+	}
+	s.fn = fn
+	s.pump()
+	return s, nil
+}
+
+// Topics returns the names of the topics published or subscribed to, sorted
+func (b *Broker) Topics() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close stops the broker: publishing and subscribing fail with ErrClosed,
+// queued publications are dropped and the context of running deliveries is
+// cancelled
+func (b *Broker) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	var subs []*Subscription
+	for _, t := range b.topics {
+		for s := range t.subs {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.Unlock()
+
+	b.cancel()
+	for _, s := range subs {
+		s.mu.Lock()
+		s.removed, s.fn, s.queue = true, nil, nil
+		s.mu.Unlock()
+	}
+}
+
+// Subscription is a topic subscription of a Broker
+type Subscription struct {
+	broker  *Broker
+	topic   *pubsubTopic
+	name    string
+	durable bool
+
+	mu      sync.Mutex
+	fn      SubscriberFunc // nil while a durable subscription is detached
+	queue   []*Publication
+	busy    bool // a delivery or redelivery wait is scheduled
+	removed bool
+	dropped int64
+}
+
+// Topic returns the subscribed topic
+func (s *Subscription) Topic() string { return s.topic.name }
+
+// Name returns the name of a durable subscription, or "" for an ephemeral one
+func (s *Subscription) Name() string { return s.name }
+
+// Pending returns the number of publications queued and not yet delivered
+func (s *Subscription) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Dropped returns the number of publications dropped from a full backlog or
+// after failed deliveries
+func (s *Subscription) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close detaches the subscriber. An ephemeral subscription is removed; a
+// durable one keeps queuing publications for the next subscriber. A
+// delivery already running is not interrupted
+func (s *Subscription) Close() {
+	if !s.durable {
+		s.Unsubscribe()
+		return
+	}
+	s.mu.Lock()
+	s.fn = nil
+	s.mu.Unlock()
+}
+
+// Unsubscribe removes the subscription and drops what it queued
+func (s *Subscription) Unsubscribe() {
+	b := s.broker
+	b.mu.Lock()
+	delete(s.topic.subs, s)
+	if s.durable && s.topic.durable[s.name] == s {
+		delete(s.topic.durable, s.name)
+	}
+	b.mu.Unlock()
+
+	s.mu.Lock()
+	s.removed, s.fn, s.queue = true, nil, nil
+	s.mu.Unlock()
+}
+
+// enqueue queues p, dropping the oldest publication of a full backlog
+func (s *Subscription) enqueue(p *Publication) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.removed {
+		return
+	}
+	if len(s.queue) >= s.broker.cfg.Backlog {
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.queue = append(s.queue, p)
+	s.pump()
+}
+
+// pump submits the delivery of the next queued publication unless one is
+// already scheduled or there is no subscriber; the caller holds s.mu
+func (s *Subscription) pump() {
+	if s.busy || s.fn == nil || len(s.queue) == 0 {
+		return
+	}
+	p, fn := s.queue[0], s.fn
+	s.queue = s.queue[1:]
+	s.busy = true
+
+	// Whichever of the delivery and a failed future claims p first handles
+	// it, so a delivery the executor rejects or drops unblocks the queue
+	// and one that times out while running is not handled twice
+	var claimed atomic.Bool
+	f := s.broker.exec.Submit(func() {
+		if claimed.CompareAndSwap(false, true) {
+			s.deliver(fn, p)
+		}
+	})
+	go func() {
+		if _, err := f.Get(); err != nil && claimed.CompareAndSwap(false, true) {
+			s.rejected(p)
+		}
+	}()
+}
+
+// rejected handles p after the executor refused or dropped its delivery: a
+// durable subscription queues it again at the front and retries after the
+// redelivery delay, an ephemeral one counts it as dropped
+func (s *Subscription) rejected(p *Publication) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = false
+	if s.removed {
+		return
+	}
+	if !s.durable {
+		s.dropped++
+		s.pump()
+		return
+	}
+	s.queue = append([]*Publication{p}, s.queue...)
+	s.retryAfter(s.broker.cfg.RedeliveryDelay)
+}
+
+// deliver runs fn on p, then queues p again at the front if a durable
+// subscription should retry it, and moves on to the next publication
+func (s *Subscription) deliver(fn SubscriberFunc, p *Publication) {
+	err := s.call(fn, p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = false
+	if err == nil || s.removed {
+		s.pump()
+		return
+	}
+	cfg := s.broker.cfg
+	if !s.durable || p.Redeliveries >= cfg.MaxRedeliveries {
+		s.dropped++
+		s.pump()
+		return
+	}
+	p.Redeliveries++
+	s.queue = append([]*Publication{p}, s.queue...)
+	s.retryAfter(cfg.RedeliveryDelay)
+}
+
+// retryAfter holds off deliveries for delay, then pumps the queue again;
+// the caller holds s.mu
+func (s *Subscription) retryAfter(delay time.Duration) {
+	s.busy = true
+	s.broker.exec.SubmitAfter(delay, func() {
+		s.mu.Lock()
+		s.busy = false
+		s.pump()
+		s.mu.Unlock()
+	})
+}
+
+// call runs fn, treating a panic as a failed delivery
+func (s *Subscription) call(fn SubscriberFunc, p *Publication) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("subscriber panicked: %v", r)
+		}
+	}()
+	return fn(s.broker.ctx, p)
+}
+
+// Server serves a Broker to other processes over a taskqueue.Transport, so
+// publishers and subscribers can connect over TCP or, with
+// taskqueue.GRPCTransport, over gRPC streams.
+//
+// A connection carries either publishes or one subscription. A publisher
+// sends MsgPublish messages naming the topic in Key, each answered in order
+// with a MsgAck carrying the publication's sequence number as ID, or an
+// Error. A subscriber sends one MsgSubscribe naming the topic in Key and,
+// for a durable subscription, its name in Worker; once acknowledged the
+// server streams MsgPublish deliveries, with the sequence number as ID, and
+// the subscriber answers each with MsgAck, or MsgNack to have it delivered
+// again
+type Server struct {
+	broker *Broker
+	// AckTimeout is how long the server waits for a subscriber to answer a
+	// delivery before counting it as failed. Defaults to 30s
+	AckTimeout time.Duration
+}
+
+// NewServer creates a server for b
+func NewServer(b *Broker) *Server {
+	return &Server{broker: b, AckTimeout: 30 * time.Second}
+}
+
+// Serve accepts connections on addr until ctx is cancelled
+func (s *Server) Serve(ctx context.Context, t taskqueue.Transport, addr string) error {
+	l, err := t.Listen(addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+		go s.serve(ctx, conn)
+	}
+}
+
+// serve handles one connection until it fails or ctx is cancelled
+func (s *Server) serve(ctx context.Context, conn taskqueue.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	for {
+		m, err := conn.Recv()
+		if err != nil {
+			return
+		}
+		switch m.Type {
+		case taskqueue.MsgPublish:
+			seq, err := s.broker.Publish(m.Key, m.Payload)
+			reply := &taskqueue.Message{Type: taskqueue.MsgAck, ID: seq}
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			if conn.Send(reply) != nil {
+				return
+			}
+		case taskqueue.MsgSubscribe:
+			s.subscribe(conn, m)
+			return
+		default:
+			conn.Send(&taskqueue.Message{Type: taskqueue.MsgAck, Error: "unexpected " + m.Type.String() + " message"})
+			return
+		}
+	}
+}
+
+// subscribe attaches the connection to the subscription m asks for and
+// relays deliveries until the connection fails
+func (s *Server) subscribe(conn taskqueue.Conn, m *taskqueue.Message) {
+	acks := make(chan *taskqueue.Message)
+	gone := make(chan struct{})
+	fn := func(ctx context.Context, p *Publication) error {
+		d := &taskqueue.Message{Type: taskqueue.MsgPublish, ID: p.Seq, Key: p.Topic, Payload: p.Payload, Redeliveries: p.Redeliveries}
+		if err := conn.Send(d); err != nil {
+			return err
+		}
+		timer := time.NewTimer(s.AckTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case a := <-acks:
+				if a.ID != p.Seq {
+					continue // a late answer to an earlier, timed out delivery
+				}
+				if a.Type == taskqueue.MsgNack {
+					return fmt.Errorf("%w: %s", taskqueue.ErrNack, a.Error)
+				}
+				return nil
+			case <-timer.C:
+				return fmt.Errorf("subscriber did not acknowledge publication %d within %v", p.Seq, s.AckTimeout)
+			case <-gone:
+				return errors.New("subscriber connection lost")
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+		}
+	}
+
+	var sub *Subscription
+	var err error
+	if m.Worker != "" {
+		sub, err = s.broker.SubscribeDurable(m.Key, m.Worker, fn)
+	} else {
+		sub, err = s.broker.Subscribe(m.Key, fn)
+	}
+	reply := &taskqueue.Message{Type: taskqueue.MsgAck}
+	if err != nil {
+		reply.Error = err.Error()
+		conn.Send(reply)
+		return
+	}
+	defer sub.Close()
+	if conn.Send(reply) != nil {
+		close(gone)
+		return
+	}
+
+	for {
+		a, err := conn.Recv()
+		if err != nil {
+			close(gone)
+			return
+		}
+		if a.Type != taskqueue.MsgAck && a.Type != taskqueue.MsgNack {
+			continue
+		}
+		select {
+		case acks <- a:
+		case <-time.After(s.AckTimeout):
+			// Nothing is waiting for it: the delivery it answers timed out
+		}
+	}
+}
+
+// Client publishes to and subscribes on a Server
+type Client struct {
+	addr      string
+	transport taskqueue.Transport
+	// Timeout bounds each publish. Defaults to 5s
+	Timeout time.Duration
+}
+
+// NewClient creates a client for the server at addr
+func NewClient(addr string, t taskqueue.Transport) *Client {
+	return &Client{addr: addr, transport: t, Timeout: 5 * time.Second}
+}
+
+// Publish publishes payload to topic and returns its sequence number
+func (c *Client) Publish(ctx context.Context, topic string, payload []byte) (uint64, error) {
+	reply, err := taskqueue.RoundTrip(ctx, c.transport, c.addr, &taskqueue.Message{Type: taskqueue.MsgPublish, Key: topic, Payload: payload}, true, c.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	if reply.Error != "" {
+		return 0, errors.New(reply.Error)
+	}
+	return reply.ID, nil
+}
+
+// Subscribe subscribes to topic, durably under name unless it is empty, and
+// calls fn for every delivery until ctx is cancelled or the connection
+// fails. A publication fn returns an error for is nacked
+func (c *Client) Subscribe(ctx context.Context, topic, name string, fn SubscriberFunc) error {
+	conn, err := c.transport.Dial(ctx, c.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := conn.Send(&taskqueue.Message{Type: taskqueue.MsgSubscribe, Key: topic, Worker: name}); err != nil {
+		return err
+	}
+	reply, err := conn.Recv()
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	for {
+		d, err := conn.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+		if d.Type != taskqueue.MsgPublish {
+			continue
+		}
+		p := &Publication{Topic: d.Key, Seq: d.ID, Payload: d.Payload, Redeliveries: d.Redeliveries}
+		ack := &taskqueue.Message{Type: taskqueue.MsgAck, ID: d.ID}
+		if err := fn(ctx, p); err != nil {
+			ack.Type, ack.Error = taskqueue.MsgNack, err.Error()
+		}
+		if err := conn.Send(ack); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+func TestBrokerKeepsPublishOrder(t *testing.T) {
+	pool := taskqueue.NewApacheThreadPool(4)
+	defer pool.Shutdown()
+	b := NewBroker(pool, Config{})
+	defer b.Close()
+
+	const publishes = 400
+	seqs := make(chan uint64, publishes)
+	if _, err := b.Subscribe("t", func(_ context.Context, p *Publication) error {
+		seqs <- p.Seq
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range publishes / 8 {
+				if _, err := b.Publish("t", nil); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	for want := uint64(1); want <= publishes; want++ {
+		select {
+		case seq := <-seqs:
+			if seq != want {
+				t.Fatalf("delivered publication %d, want %d", seq, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("publication %d never delivered", want)
+		}
+	}
+}
+
+func TestBrokerRejectedDelivery(t *testing.T) {
+	pool := taskqueue.NewApacheThreadPool(1, taskqueue.WithQueueCapacity(2, taskqueue.RejectPolicy))
+	defer pool.Shutdown()
+	b := NewBroker(pool, Config{RedeliveryDelay: 10 * time.Millisecond})
+	defer b.Close()
+
+	ephemeralSeqs, durableSeqs := make(chan uint64, 2), make(chan uint64, 2)
+	record := func(seqs chan<- uint64) SubscriberFunc {
+		return func(_ context.Context, p *Publication) error {
+			seqs <- p.Seq
+			return nil
+		}
+	}
+	ephemeral, err := b.Subscribe("t", record(ephemeralSeqs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	durable, err := b.SubscribeDurable("t", "d", record(durableSeqs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Saturate the pool so both deliveries are rejected
+	release := make(chan struct{})
+	free := sync.OnceFunc(func() { close(release) })
+	defer free()
+	started := make(chan struct{})
+	pool.Submit(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	pool.Submit(func() {})
+	pool.Submit(func() {})
+	if _, err := b.Publish("t", nil); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ephemeral.Dropped() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := ephemeral.Dropped(); n != 1 {
+		t.Fatalf("ephemeral subscription dropped %d rejected deliveries, want 1", n)
+	}
+	free()
+
+	// The durable subscription retries its publication, and neither
+	// subscription is left waiting on the rejected delivery
+	expect := func(name string, seqs <-chan uint64, want uint64) {
+		t.Helper()
+		select {
+		case seq := <-seqs:
+			if seq != want {
+				t.Fatalf("%s subscription delivered publication %d, want %d", name, seq, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s subscription never delivered publication %d", name, want)
+		}
+	}
+	expect("durable", durableSeqs, 1)
+	if _, err := b.Publish("t", nil); err != nil {
+		t.Fatal(err)
+	}
+	expect("ephemeral", ephemeralSeqs, 2)
+	expect("durable", durableSeqs, 2)
+	if n := durable.Dropped(); n != 0 {
+		t.Errorf("durable subscription dropped %d publications, want 0", n)
+	}
+}
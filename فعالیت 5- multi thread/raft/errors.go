@@ -0,0 +1,27 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrStopped is reported for proposals to a node that has stopped
+var ErrStopped = errors.New("raft node stopped")
+
+// ErrProposalDropped is reported for a proposal whose log entry was replaced
+// by a new leader's before it committed
+var ErrProposalDropped = errors.New("raft proposal dropped by a leader change")
+
+// NotLeaderError is reported for a proposal made to a node that is not the
+// leader; Leader is the leader it knows of, or zero
+type NotLeaderError struct {
+	Leader uint64
+}
+
+// Error implements the error interface
+func (e *NotLeaderError) Error() string {
+	if e.Leader == 0 {
+		return "not the raft leader (leader unknown)"
+	}
+	return fmt.Sprintf("not the raft leader (leader is %d)", e.Leader)
+}
@@ -0,0 +1,873 @@
+// Package raft is a Raft consensus node replicating a log of commands to
+// a state machine over a taskqueue Transport
+package raft
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"multithread/internal/wire"
+	"multithread/taskqueue"
+)
+
+// raftMaxBatch bounds the entries sent in one AppendEntries call
+const raftMaxBatch = 64
+
+// Role is a node's role in its current term
+type Role int
+
+const (
+	// Follower accepts entries from the leader
+	Follower Role = iota
+	// Candidate is campaigning to become leader
+	Candidate
+	// Leader accepts proposals and replicates them
+	Leader
+)
+
+// String returns the role name
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+}
+
+// StateMachine is the replicated state a Node drives. Apply is called
+// from a single goroutine, in log order, once for every committed command;
+// its result is returned to the proposer if the command was proposed on this
+// node
+type StateMachine interface {
+	Apply(index uint64, command []byte) []byte
+}
+
+// Config configures a Node
+type Config struct {
+	// ID identifies the node and must not be zero
+	ID uint64
+	// Addr is the address the node accepts RPCs from its peers on
+	Addr string
+	// Peers maps the IDs of the other nodes to their addresses
+	Peers map[uint64]string
+	// Transport carries the RPCs
+	Transport taskqueue.Transport
+	// StateMachine receives the committed commands
+	StateMachine StateMachine
+	// Dir holds the node's term, vote and log; when empty they are kept in
+	// memory only and a restarted node rejoins with an empty log
+	Dir string
+	// ElectionTimeout is the least time a follower waits to hear from a
+	// leader before campaigning; each wait is drawn at random between it and
+	// twice it so that candidates rarely collide. Defaults to 300ms
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often the leader replicates to followers when
+	// it has nothing new to send; defaults to 50ms
+	HeartbeatInterval time.Duration
+	// Logger, if set, receives the node's log as component "raft", with
+	// its ID under taskqueue.LogKeyNode: elections at debug, and winning and
+	// losing the leadership at info
+	Logger *slog.Logger
+}
+
+// Status is a snapshot of a node's view of the cluster
+type Status struct {
+	ID        uint64
+	Term      uint64
+	Role      Role
+	Leader    uint64
+	LastIndex uint64
+	Commit    uint64
+	Applied   uint64
+}
+
+// Node is one member of a Raft cluster: it elects a leader with its
+// peers, replicates the leader's log and applies committed entries to its
+// state machine. Coordinators can replicate their task queue by proposing
+// each submission and completion as a command. The commit index is not
+// persisted, so a restarted node applies its log again from the start as the
+// leader re-establishes what is committed
+type Node struct {
+	cfg     Config
+	storage raftStorage
+	peers   map[uint64]*raftPeer
+	kick    chan struct{}
+
+	mu        sync.Mutex
+	applied   *sync.Cond
+	term      uint64
+	votedFor  uint64
+	log       []raftEntry // log[0] is a sentinel at index 0
+	commit    uint64
+	lastApply uint64
+	role      Role
+	leader    uint64
+	deadline  time.Time
+	next      map[uint64]uint64
+	match     map[uint64]uint64
+	waiters   map[uint64]*raftProposal
+	stopped   bool
+	logger    *slog.Logger
+}
+
+// raftProposal is a command proposed on this node waiting to be applied
+type raftProposal struct {
+	term uint64
+	// done receives the outcome once the command is applied or dropped
+	done chan proposalResult
+}
+
+// proposalResult is the outcome of a proposal
+type proposalResult struct {
+	value []byte
+	err   error
+}
+
+// complete reports the outcome to the proposer, which may have given up; a
+// proposal leaves the waiters before it is completed, so only once
+func (p *raftProposal) complete(value []byte, err error) {
+	p.done <- proposalResult{value, err}
+}
+
+// NewNode creates a node, restoring its persistent state from cfg.Dir;
+// Run starts it
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ID == 0 {
+		return nil, fmt.Errorf("raft: node ID must not be zero")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+	}
+
+	var storage raftStorage = memoryRaftStorage{}
+	if cfg.Dir != "" {
+		s, err := openFileRaftStorage(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		storage = s
+	}
+	term, vote, entries, err := storage.load()
+	if err != nil {
+		storage.close()
+		return nil, err
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		storage:  storage,
+		peers:    make(map[uint64]*raftPeer, len(cfg.Peers)),
+		kick:     make(chan struct{}, 1),
+		term:     term,
+		votedFor: vote,
+		log:      append([]raftEntry{{}}, entries...),
+		next:     make(map[uint64]uint64),
+		match:    make(map[uint64]uint64),
+		waiters:  make(map[uint64]*raftProposal),
+		logger:   taskqueue.ComponentLogger(cfg.Logger, "raft", taskqueue.LogKeyNode, cfg.ID),
+	}
+	n.applied = sync.NewCond(&n.mu)
+	for id, addr := range cfg.Peers {
+		n.peers[id] = &raftPeer{id: id, addr: addr, transport: cfg.Transport, timeout: cfg.ElectionTimeout}
+	}
+	return n, nil
+}
+
+// Status returns the node's current view of the cluster
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:        n.cfg.ID,
+		Term:      n.term,
+		Role:      n.role,
+		Leader:    n.leader,
+		LastIndex: n.lastIndex(),
+		Commit:    n.commit,
+		Applied:   n.lastApply,
+	}
+}
+
+// Check fails with taskqueue.ErrNotLeader while n neither leads nor knows
+// a leader to redirect to, as during an election or when cut off from a
+// quorum
+func Check(n *Node) taskqueue.HealthCheck {
+	return func(context.Context) error {
+		s := n.Status()
+		if s.Role != Leader && s.Leader == 0 {
+			return fmt.Errorf("%w: no leader known in term %d", taskqueue.ErrNotLeader, s.Term)
+		}
+		return nil
+	}
+}
+
+// Propose appends command to the replicated log and waits until it has been
+// committed and applied, returning the state machine's result. It fails with
+// a *NotLeaderError on a node that is not the leader, and with
+// ErrProposalDropped if leadership changed before the command committed
+func (n *Node) Propose(ctx context.Context, command []byte) ([]byte, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != Leader {
+		leader := n.leader
+		n.mu.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+	index, err := n.appendLocal(raftEntry{term: n.term, command: command})
+	if err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	p := &raftProposal{term: n.term, done: make(chan proposalResult, 1)}
+	n.waiters[index] = p
+	n.advanceCommit()
+	n.mu.Unlock()
+	n.replicateNow()
+
+	select {
+	case r := <-p.done:
+		return r.value, r.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		if n.waiters[index] == p {
+			delete(n.waiters, index)
+		}
+		n.mu.Unlock()
+		return nil, context.Cause(ctx)
+	}
+}
+
+// ReadIndex returns a log index such that a read of the state machine, once
+// it has applied the index, reflects every write committed before the call:
+// the leader's commit index, taken after an entry of its own term committed
+// and confirmed by a heartbeat round a majority answered, so a deposed leader
+// cannot serve a stale read. It waits until the index has been applied, and
+// fails with a *NotLeaderError on a node that is not, or stops being, the
+// leader
+func (n *Node) ReadIndex(ctx context.Context) (uint64, error) {
+	stop := context.AfterFunc(ctx, func() {
+		n.mu.Lock()
+		n.applied.Broadcast()
+		n.mu.Unlock()
+	})
+	defer stop()
+
+	// A new leader only knows what is committed once its no-op entry is
+	n.mu.Lock()
+	for n.role == Leader && !n.stopped && ctx.Err() == nil && n.log[n.commit].term != n.term {
+		n.applied.Wait()
+	}
+	if err := n.readable(ctx); err != nil {
+		n.mu.Unlock()
+		return 0, err
+	}
+	term, index := n.term, n.commit
+	reqs := make(map[*raftPeer]raftRPC, len(n.peers))
+	for _, p := range n.peers {
+		prev := n.next[p.id] - 1
+		reqs[p] = raftRPC{Term: term, From: n.cfg.ID, Index: prev, LogTerm: n.log[prev].term, Commit: n.commit}
+	}
+	n.mu.Unlock()
+
+	// Any answer that does not carry a newer term acknowledges the leader
+	acks := make(chan bool, len(reqs))
+	for p, req := range reqs {
+		go func() {
+			resp, err := p.call(ctx, taskqueue.MsgAppendEntries, &req)
+			if err == nil && resp.Term > term {
+				n.mu.Lock()
+				n.stepDown(resp.Term)
+				n.mu.Unlock()
+			}
+			acks <- err == nil && resp.Term <= term
+		}()
+	}
+	votes := 1
+	for range reqs {
+		if n.quorum(votes) {
+			break
+		}
+		if <-acks {
+			votes++
+		}
+	}
+	if !n.quorum(votes) {
+		if err := ctx.Err(); err != nil {
+			return 0, context.Cause(ctx)
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return 0, &NotLeaderError{Leader: n.leader}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.lastApply < index && !n.stopped && ctx.Err() == nil {
+		n.applied.Wait()
+	}
+	if err := n.readable(ctx); err != nil {
+		return 0, err
+	}
+	if n.term != term {
+		return 0, &NotLeaderError{Leader: n.leader}
+	}
+	return index, nil
+}
+
+// readable reports why a read cannot be served on this node, if it cannot;
+// n.mu must be held
+func (n *Node) readable(ctx context.Context) error {
+	switch {
+	case n.stopped:
+		return ErrStopped
+	case ctx.Err() != nil:
+		return context.Cause(ctx)
+	case n.role != Leader:
+		return &NotLeaderError{Leader: n.leader}
+	}
+	return nil
+}
+
+// Run serves the node's peers and takes part in elections and replication
+// until ctx is cancelled; proposals still waiting then fail with
+// ErrStopped
+func (n *Node) Run(ctx context.Context) error {
+	l, err := n.cfg.Transport.Listen(n.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	go n.serve(l)
+	go n.apply()
+	defer n.stop()
+
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-ticker.C:
+		case <-n.kick:
+		}
+
+		n.mu.Lock()
+		role, expired := n.role, time.Now().After(n.deadline)
+		n.mu.Unlock()
+		switch {
+		case role == Leader:
+			for _, p := range n.peers {
+				go n.replicate(ctx, p)
+			}
+		case expired:
+			go n.campaign(ctx)
+		}
+	}
+}
+
+// stop fails the waiting proposals and releases the storage and connections
+func (n *Node) stop() {
+	n.mu.Lock()
+	n.stopped = true
+	waiters := n.waiters
+	n.waiters = make(map[uint64]*raftProposal)
+	n.mu.Unlock()
+	n.applied.Broadcast()
+
+	for _, p := range waiters {
+		p.complete(nil, ErrStopped)
+	}
+	for _, p := range n.peers {
+		p.close()
+	}
+	n.storage.close()
+}
+
+// replicateNow wakes Run to replicate without waiting for the next heartbeat
+func (n *Node) replicateNow() {
+	select {
+	case n.kick <- struct{}{}:
+	default:
+	}
+}
+
+// lastIndex returns the index of the last log entry; n.mu must be held
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+// resetDeadline draws a new election deadline; n.mu must be held
+func (n *Node) resetDeadline() {
+	t := n.cfg.ElectionTimeout
+	n.deadline = time.Now().Add(t + rand.N(t))
+}
+
+// quorum reports whether votes nodes make a majority of the cluster
+func (n *Node) quorum(votes int) bool {
+	return 2*votes > len(n.peers)+1
+}
+
+// persistState saves the term and vote; n.mu must be held
+func (n *Node) persistState() error {
+	return n.storage.saveState(n.term, n.votedFor)
+}
+
+// appendLocal appends e to the log and persists it, returning its index;
+// n.mu must be held
+func (n *Node) appendLocal(e raftEntry) (uint64, error) {
+	index := uint64(len(n.log))
+	if err := n.storage.storeLog(index, []raftEntry{e}); err != nil {
+		return 0, err
+	}
+	n.log = append(n.log, e)
+	return index, nil
+}
+
+// stepDown moves to term as a follower if it is newer than the current one;
+// n.mu must be held
+func (n *Node) stepDown(term uint64) error {
+	if term <= n.term {
+		return nil
+	}
+	if n.role == Leader {
+		n.logger.Info("lost the leadership", "term", n.term, "newer", term)
+	}
+	n.term, n.votedFor = term, 0
+	n.role, n.leader = Follower, 0
+	n.applied.Broadcast() // wakes reads waiting on the leadership
+	return n.persistState()
+}
+
+// campaign starts an election for the next term and becomes leader if a
+// majority votes for this node
+func (n *Node) campaign(ctx context.Context) {
+	n.mu.Lock()
+	if n.role == Leader || n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.term++
+	n.role, n.leader, n.votedFor = Candidate, 0, n.cfg.ID
+	n.resetDeadline()
+	if err := n.persistState(); err != nil {
+		n.mu.Unlock()
+		return
+	}
+	term := n.term
+	n.logger.Debug("campaigning", "term", term)
+	req := raftRPC{Term: term, From: n.cfg.ID, Index: n.lastIndex(), LogTerm: n.log[n.lastIndex()].term}
+	votes := 1
+	if n.quorum(votes) {
+		n.becomeLeader()
+	}
+	n.mu.Unlock()
+
+	for _, p := range n.peers {
+		go func() {
+			resp, err := p.call(ctx, taskqueue.MsgRequestVote, &req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != Candidate || n.term != term || !resp.Success {
+				return
+			}
+			votes++
+			if n.quorum(votes) {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over the cluster for the current term, appending a
+// no-op entry so that entries of earlier terms can commit; if the no-op
+// cannot be stored the node stays a follower and campaigns again once its
+// election timeout passes. n.mu must be held
+func (n *Node) becomeLeader() {
+	for id := range n.peers {
+		n.next[id] = n.lastIndex() + 1
+		n.match[id] = 0
+	}
+	if _, err := n.appendLocal(raftEntry{term: n.term, noop: true}); err != nil {
+		n.logger.Warn("cannot take over the leadership", "term", n.term, "error", err)
+		n.role, n.leader = Follower, 0
+		n.resetDeadline()
+		return
+	}
+	n.logger.Info("became leader", "term", n.term)
+	n.role, n.leader = Leader, n.cfg.ID
+	n.advanceCommit()
+	n.replicateNow()
+}
+
+// replicate sends p the entries it is missing, or an empty heartbeat, until
+// it has caught up; calls for a peer that is already being replicated to
+// return at once
+func (n *Node) replicate(ctx context.Context, p *raftPeer) {
+	if !p.mu.TryLock() {
+		return
+	}
+	defer p.mu.Unlock()
+
+	for {
+		n.mu.Lock()
+		if n.role != Leader || n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		term := n.term
+		prev := n.next[p.id] - 1
+		end := min(uint64(len(n.log)), prev+1+raftMaxBatch)
+		req := raftRPC{
+			Term:    term,
+			From:    n.cfg.ID,
+			Index:   prev,
+			LogTerm: n.log[prev].term,
+			Commit:  n.commit,
+			Entries: slices.Clone(n.log[prev+1 : end]),
+		}
+		n.mu.Unlock()
+
+		resp, err := p.exchange(ctx, taskqueue.MsgAppendEntries, &req)
+		if err != nil {
+			return
+		}
+
+		n.mu.Lock()
+		if resp.Term > n.term {
+			n.stepDown(resp.Term)
+			n.mu.Unlock()
+			return
+		}
+		if n.role != Leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		if resp.Success {
+			match := prev + uint64(len(req.Entries))
+			n.match[p.id] = max(n.match[p.id], match)
+			n.next[p.id] = match + 1
+			n.advanceCommit()
+		} else {
+			n.next[p.id] = max(1, min(prev, resp.Index+1))
+		}
+		caughtUp := n.next[p.id] > n.lastIndex()
+		n.mu.Unlock()
+		if caughtUp && resp.Success {
+			return
+		}
+	}
+}
+
+// advanceCommit commits the newest entry of the current term stored on a
+// majority; n.mu must be held
+func (n *Node) advanceCommit() {
+	if n.role != Leader {
+		return
+	}
+	for index := n.lastIndex(); index > n.commit && n.log[index].term == n.term; index-- {
+		votes := 1
+		for _, m := range n.match {
+			if m >= index {
+				votes++
+			}
+		}
+		if n.quorum(votes) {
+			n.commit = index
+			n.applied.Broadcast()
+			return
+		}
+	}
+}
+
+// apply feeds committed entries to the state machine and completes the
+// proposals waiting for them, until the node stops
+func (n *Node) apply() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.stopped && n.lastApply >= n.commit {
+			n.applied.Wait()
+		}
+		if n.stopped {
+			return
+		}
+		from := n.lastApply + 1
+		entries := slices.Clone(n.log[from : n.commit+1])
+		n.mu.Unlock()
+
+		for i, e := range entries {
+			index := from + uint64(i)
+			var result []byte
+			if !e.noop {
+				result = n.cfg.StateMachine.Apply(index, e.command)
+			}
+			n.mu.Lock()
+			p := n.waiters[index]
+			delete(n.waiters, index)
+			n.lastApply = index
+			n.applied.Broadcast()
+			n.mu.Unlock()
+			if p == nil {
+				continue
+			}
+			if p.term == e.term {
+				p.complete(result, nil)
+			} else {
+				p.complete(nil, ErrProposalDropped)
+			}
+		}
+		n.mu.Lock()
+	}
+}
+
+// serve answers RPCs from peers until l is closed
+func (n *Node) serve(l taskqueue.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				m, err := conn.Recv()
+				if err != nil {
+					return
+				}
+				var req raftRPC
+				if err := req.unmarshal(m.Payload); err != nil {
+					return
+				}
+				var resp raftRPC
+				switch m.Type {
+				case taskqueue.MsgRequestVote:
+					resp = n.handleRequestVote(&req)
+				case taskqueue.MsgAppendEntries:
+					resp = n.handleAppendEntries(&req)
+				default:
+					return
+				}
+				if conn.Send(&taskqueue.Message{Type: m.Type, Payload: resp.marshal()}) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handleRequestVote grants the vote to a candidate whose log is at least as
+// up to date as this node's, if the node has not voted for another this term
+func (n *Node) handleRequestVote(req *raftRPC) raftRPC {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stepDown(req.Term) != nil {
+		return raftRPC{Term: n.term}
+	}
+
+	last := n.lastIndex()
+	upToDate := req.LogTerm > n.log[last].term || req.LogTerm == n.log[last].term && req.Index >= last
+	granted := req.Term == n.term && (n.votedFor == 0 || n.votedFor == req.From) && upToDate
+	if granted {
+		n.votedFor = req.From
+		if n.persistState() != nil {
+			granted = false
+		} else {
+			n.resetDeadline()
+		}
+	}
+	return raftRPC{Term: n.term, Success: granted}
+}
+
+// handleAppendEntries accepts the leader's entries if the log matches at the
+// entry preceding them, overwriting any conflicting suffix. A rejection
+// carries the index the leader should retry from in Index
+func (n *Node) handleAppendEntries(req *raftRPC) raftRPC {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term || n.stepDown(req.Term) != nil {
+		return raftRPC{Term: n.term}
+	}
+	n.role, n.leader = Follower, req.From
+	n.resetDeadline()
+
+	resp := raftRPC{Term: n.term}
+	if req.Index > n.lastIndex() {
+		resp.Index = n.lastIndex()
+		return resp
+	}
+	if n.log[req.Index].term != req.LogTerm {
+		resp.Index = req.Index - 1
+		return resp
+	}
+
+	for i, e := range req.Entries {
+		index := req.Index + 1 + uint64(i)
+		if index <= n.lastIndex() && n.log[index].term == e.term {
+			continue
+		}
+		if n.storage.storeLog(index, req.Entries[i:]) != nil {
+			return resp
+		}
+		n.log = append(n.log[:index], req.Entries[i:]...)
+		break
+	}
+
+	last := req.Index + uint64(len(req.Entries))
+	// The entries after last may be stale, so commit no further than last,
+	// but never move the commit index back
+	if commit := min(req.Commit, last); commit > n.commit {
+		n.commit = commit
+		n.applied.Broadcast()
+	}
+	resp.Success, resp.Index = true, last
+	return resp
+}
+
+// raftPeer is the connection to one peer; RPCs to it are made one at a time
+type raftPeer struct {
+	id        uint64
+	addr      string
+	transport taskqueue.Transport
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	conn taskqueue.Conn
+}
+
+// call makes one RPC to the peer
+func (p *raftPeer) call(ctx context.Context, t taskqueue.MessageType, req *raftRPC) (*raftRPC, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.exchange(ctx, t, req)
+}
+
+// exchange makes one RPC within the timeout, dialing the peer if needed;
+// p.mu must be held
+func (p *raftPeer) exchange(ctx context.Context, t taskqueue.MessageType, req *raftRPC) (*raftRPC, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	if p.conn == nil {
+		conn, err := p.transport.Dial(ctx, p.addr)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+	}
+	conn := p.conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var m *taskqueue.Message
+	err := conn.Send(&taskqueue.Message{Type: t, Payload: req.marshal()})
+	if err == nil {
+		m, err = conn.Recv()
+	}
+	var resp raftRPC
+	if err == nil {
+		err = resp.unmarshal(m.Payload)
+	}
+	if err != nil {
+		conn.Close()
+		p.conn = nil
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// close drops the connection
+func (p *raftPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// raftRPC carries the arguments and results of RequestVote and
+// AppendEntries in a Message payload. For RequestVote, Index and LogTerm
+// describe the candidate's last entry; for AppendEntries they describe the
+// entry preceding Entries. In replies, Success is the vote or the append's
+// outcome and Index the follower's last matching entry
+type raftRPC struct {
+	Term    uint64
+	From    uint64
+	Index   uint64
+	LogTerm uint64
+	Commit  uint64
+	Success bool
+	Entries []raftEntry
+}
+
+// marshal encodes r as uvarints followed by its length-prefixed entries
+func (r *raftRPC) marshal() []byte {
+	var b []byte
+	for _, v := range []uint64{r.Term, r.From, r.Index, r.LogTerm, r.Commit} {
+		b = binary.AppendUvarint(b, v)
+	}
+	var success uint64
+	if r.Success {
+		success = 1
+	}
+	b = binary.AppendUvarint(b, success)
+	b = binary.AppendUvarint(b, uint64(len(r.Entries)))
+	for _, e := range r.Entries {
+		b = wire.AppendBytes(b, e.marshal())
+	}
+	return b
+}
+
+// unmarshal decodes an RPC encoded by marshal
+func (r *raftRPC) unmarshal(b []byte) error {
+	rd := wire.Reader{B: b}
+	r.Term = rd.Uvarint()
+	r.From = rd.Uvarint()
+	r.Index = rd.Uvarint()
+	r.LogTerm = rd.Uvarint()
+	r.Commit = rd.Uvarint()
+	r.Success = rd.Uvarint() == 1
+	count := rd.Uvarint()
+	if rd.Err != nil {
+		return rd.Err
+	}
+	if count > uint64(len(rd.B)) {
+		return wire.ErrMalformed
+	}
+	r.Entries = make([]raftEntry, 0, count)
+	for range count {
+		e, err := unmarshalRaftEntry(rd.Bytes())
+		if rd.Err != nil || err != nil {
+			return wire.ErrMalformed
+		}
+		r.Entries = append(r.Entries, e)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"multithread/internal/wire"
+)
+
+// raftEntry is one entry of the replicated log
+type raftEntry struct {
+	term    uint64
+	command []byte
+	// noop marks the entry a new leader appends to commit earlier terms; it
+	// is never applied
+	noop bool
+}
+
+// marshal encodes e as a flag byte, its term as a uvarint and its command
+// prefixed with its length
+func (e raftEntry) marshal() []byte {
+	b := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(e.command))
+	var flags byte
+	if e.noop {
+		flags = 1
+	}
+	b = append(b, flags)
+	b = binary.AppendUvarint(b, e.term)
+	return wire.AppendBytes(b, e.command)
+}
+
+// unmarshalRaftEntry decodes an entry encoded by marshal
+func unmarshalRaftEntry(b []byte) (raftEntry, error) {
+	if len(b) == 0 {
+		return raftEntry{}, wire.ErrMalformed
+	}
+	r := wire.Reader{B: b[1:]}
+	e := raftEntry{noop: b[0] == 1}
+	e.term = r.Uvarint()
+	e.command = r.Bytes()
+	return e, r.Err
+}
+
+// raftStorage persists the state a node must not forget across restarts:
+// its term, its vote and its log
+type raftStorage interface {
+	// load returns the persisted term, vote and log entries; entry i of the
+	// returned slice has log index i+1
+	load() (term, vote uint64, entries []raftEntry, err error)
+	// saveState durably records the term and vote
+	saveState(term, vote uint64) error
+	// storeLog durably replaces the entries from index from on with entries
+	storeLog(from uint64, entries []raftEntry) error
+	close() error
+}
+
+// memoryRaftStorage keeps nothing; the node's in-memory copy is all there is
+type memoryRaftStorage struct{}
+
+func (memoryRaftStorage) load() (uint64, uint64, []raftEntry, error) { return 0, 0, nil, nil }
+func (memoryRaftStorage) saveState(uint64, uint64) error             { return nil }
+func (memoryRaftStorage) storeLog(uint64, []raftEntry) error         { return nil }
+func (memoryRaftStorage) close() error                               { return nil }
+
+// fileRaftStorage keeps the term and vote in a small file that is replaced
+// atomically, and the log in an append-only file of records that is
+// truncated when a leader overwrites a conflicting suffix
+type fileRaftStorage struct {
+	dir  string
+	file *os.File
+	// offsets[i] is the file offset of log index i; offsets[0] is unused
+	offsets []int64
+	size    int64
+}
+
+// openFileRaftStorage opens or creates the storage in dir
+func openFileRaftStorage(dir string) (*fileRaftStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "raft.log"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileRaftStorage{dir: dir, file: file, offsets: []int64{0}}, nil
+}
+
+// load implements raftStorage; a torn record at the end of the log is cut off
+func (s *fileRaftStorage) load() (term, vote uint64, entries []raftEntry, err error) {
+	state, err := os.ReadFile(filepath.Join(s.dir, "raft.state"))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return 0, 0, nil, err
+	case len(state) != 20 || crc32.ChecksumIEEE(state[:16]) != binary.BigEndian.Uint32(state[16:]):
+		return 0, 0, nil, errors.New("raft: corrupt state file")
+	default:
+		term = binary.BigEndian.Uint64(state[:8])
+		vote = binary.BigEndian.Uint64(state[8:16])
+	}
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, nil, err
+	}
+	r := bufio.NewReader(s.file)
+	for {
+		body, err := wire.ReadRecord(r)
+		if err != nil {
+			break
+		}
+		e, err := unmarshalRaftEntry(body)
+		if err != nil {
+			break
+		}
+		entries = append(entries, e)
+		s.offsets = append(s.offsets, s.size)
+		s.size += int64(wire.RecordHeaderSize + len(body))
+	}
+	if err := s.file.Truncate(s.size); err != nil {
+		return 0, 0, nil, err
+	}
+	return term, vote, entries, nil
+}
+
+// saveState implements raftStorage
+func (s *fileRaftStorage) saveState(term, vote uint64) error {
+	var state [20]byte
+	binary.BigEndian.PutUint64(state[:8], term)
+	binary.BigEndian.PutUint64(state[8:16], vote)
+	binary.BigEndian.PutUint32(state[16:], crc32.ChecksumIEEE(state[:16]))
+
+	path := filepath.Join(s.dir, "raft.state")
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(state[:])
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err := errors.Join(err, tmp.Close()); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// storeLog implements raftStorage
+func (s *fileRaftStorage) storeLog(from uint64, entries []raftEntry) error {
+	if from < uint64(len(s.offsets)) {
+		s.size = s.offsets[from]
+		s.offsets = s.offsets[:from]
+		if err := s.file.Truncate(s.size); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.Seek(s.size, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(s.file)
+	for _, e := range entries {
+		body := e.marshal()
+		if err := wire.WriteRecord(w, body); err != nil {
+			return err
+		}
+		s.offsets = append(s.offsets, s.size)
+		s.size += int64(wire.RecordHeaderSize + len(body))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// close implements raftStorage
+func (s *fileRaftStorage) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,366 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"multithread/taskqueue"
+	"multithread/testutil"
+)
+
+// commandLog is a StateMachine recording the commands it applies
+type commandLog struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (l *commandLog) Apply(_ uint64, command []byte) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commands = append(l.commands, string(command))
+	return command
+}
+
+func (l *commandLog) applied() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.commands)
+}
+
+// testCluster runs a Raft cluster on hosts n1, n2, ... of a memory network,
+// checking until the test ends that no node's commit index goes backwards
+type testCluster struct {
+	t       *testing.T
+	network *taskqueue.MemoryNetwork
+	hosts   []string
+	dirs    []string // empty for nodes keeping their state in memory
+
+	mu      sync.Mutex
+	nodes   []*Node
+	logs    []*commandLog
+	cancels []context.CancelFunc
+	done    []chan struct{}
+	commits map[*Node]uint64
+	regress error
+}
+
+// newTestCluster starts size nodes, keeping their state on disk if durable
+func newTestCluster(t *testing.T, size int, durable bool) *testCluster {
+	c := &testCluster{
+		t:       t,
+		network: taskqueue.NewMemoryNetwork(),
+		nodes:   make([]*Node, size),
+		logs:    make([]*commandLog, size),
+		cancels: make([]context.CancelFunc, size),
+		done:    make([]chan struct{}, size),
+		commits: make(map[*Node]uint64),
+	}
+	for i := range size {
+		c.hosts = append(c.hosts, fmt.Sprintf("n%d", i+1))
+		if durable {
+			c.dirs = append(c.dirs, t.TempDir())
+		}
+	}
+	for i := range size {
+		c.start(i)
+	}
+
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		c.watchCommits(stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-watched
+		for i := range size {
+			c.stop(i)
+		}
+		if c.regress != nil {
+			t.Error(c.regress)
+		}
+	})
+	return c
+}
+
+// start runs node i with a fresh state machine, restoring its state from
+// disk in a durable cluster
+func (c *testCluster) start(i int) {
+	c.t.Helper()
+	peers := make(map[uint64]string)
+	for j, host := range c.hosts {
+		if j != i {
+			peers[uint64(j+1)] = host + "/raft"
+		}
+	}
+	cfg := Config{
+		ID:                uint64(i + 1),
+		Addr:              c.hosts[i] + "/raft",
+		Peers:             peers,
+		Transport:         c.network.Host(c.hosts[i]),
+		StateMachine:      new(commandLog),
+		ElectionTimeout:   100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+	if c.dirs != nil {
+		cfg.Dir = c.dirs[i]
+	}
+	n, err := NewNode(cfg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.Run(ctx)
+	}()
+
+	c.mu.Lock()
+	c.nodes[i], c.logs[i] = n, cfg.StateMachine.(*commandLog)
+	c.cancels[i], c.done[i] = cancel, done
+	c.mu.Unlock()
+}
+
+// stop stops node i, if it runs, and waits for it to release its storage
+func (c *testCluster) stop(i int) {
+	c.mu.Lock()
+	cancel, done := c.cancels[i], c.done[i]
+	c.cancels[i] = nil
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// crash takes node i down with its host, as if its machine failed
+func (c *testCluster) crash(i int) {
+	c.network.Crash(c.hosts[i])
+	c.stop(i)
+}
+
+// restart brings the host of node i back and starts the node again
+func (c *testCluster) restart(i int) {
+	c.network.Restore(c.hosts[i])
+	c.start(i)
+}
+
+// node returns the Node running as node i
+func (c *testCluster) node(i int) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[i]
+}
+
+// applied returns the commands the state machine of node i applied
+func (c *testCluster) applied(i int) []string {
+	c.mu.Lock()
+	l := c.logs[i]
+	c.mu.Unlock()
+	return l.applied()
+}
+
+// watchCommits samples the commit index of every node until stop closes;
+// each node starts from zero, as it does not persist its commit index
+func (c *testCluster) watchCommits(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for i := range c.hosts {
+			n := c.node(i)
+			commit := n.Status().Commit
+			c.mu.Lock()
+			if last := c.commits[n]; commit < last && c.regress == nil {
+				c.regress = fmt.Errorf("%s: commit index went back from %d to %d", c.hosts[i], last, commit)
+			}
+			c.commits[n] = max(c.commits[n], commit)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// leader waits until exactly one of the nodes among leads, in a term after
+// since, and returns it
+func (c *testCluster) leader(since uint64, among ...int) int {
+	c.t.Helper()
+	if among == nil {
+		for i := range c.hosts {
+			among = append(among, i)
+		}
+	}
+	var found int
+	err := testutil.Eventually(5*time.Second, func() error {
+		var leaders []int
+		for _, i := range among {
+			if s := c.node(i).Status(); s.Role == Leader && s.Term > since {
+				leaders = append(leaders, i)
+			}
+		}
+		if len(leaders) != 1 {
+			return fmt.Errorf("nodes %v lead after term %d", leaders, since)
+		}
+		found = leaders[0]
+		return nil
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return found
+}
+
+// propose proposes command on node i, failing the test unless it commits
+func (c *testCluster) propose(i int, command string) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.node(i).Propose(ctx, []byte(command)); err != nil {
+		c.t.Fatalf("%s: proposing %q: %v", c.hosts[i], command, err)
+	}
+}
+
+// converge waits until the state machine of every node among has applied
+// want
+func (c *testCluster) converge(want []string, among ...int) {
+	c.t.Helper()
+	err := testutil.Eventually(5*time.Second, func() error {
+		for _, i := range among {
+			if got := c.applied(i); !slices.Equal(got, want) {
+				return fmt.Errorf("%s applied %q, want %q", c.hosts[i], got, want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestElectionAfterLeaderDies(t *testing.T) {
+	c := newTestCluster(t, 3, false)
+	old := c.leader(0)
+	c.propose(old, "a")
+	term := c.node(old).Status().Term
+
+	c.crash(old)
+	var rest []int
+	for i := range c.hosts {
+		if i != old {
+			rest = append(rest, i)
+		}
+	}
+	elected := c.leader(term, rest...)
+	c.propose(elected, "b")
+	c.converge([]string{"a", "b"}, rest...)
+
+	// The old leader rejoins as a follower and catches up
+	c.restart(old)
+	c.converge([]string{"a", "b"}, 0, 1, 2)
+	if s := c.node(old).Status(); s.Role == Leader && s.Term <= term {
+		t.Errorf("restarted node leads in its old term %d", s.Term)
+	}
+}
+
+func TestLaggingFollowerLogIsRepaired(t *testing.T) {
+	c := newTestCluster(t, 5, false)
+	old := c.leader(0)
+	c.propose(old, "a")
+	c.converge([]string{"a"}, 0, 1, 2, 3, 4)
+	term := c.node(old).Status().Term
+
+	// Cut the leader off with one follower. It keeps appending proposals
+	// it cannot commit while the majority commits entries of its own
+	// under a new leader
+	follower := (old + 1) % 5
+	c.network.Partition([]string{c.hosts[old], c.hosts[follower]})
+	for _, command := range []string{"stranded-1", "stranded-2", "stranded-3"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := c.node(old).Propose(ctx, []byte(command))
+		cancel()
+		if err == nil {
+			t.Fatalf("the cut-off leader committed %q", command)
+		}
+	}
+	var majority []int
+	for i := range c.hosts {
+		if i != old && i != follower {
+			majority = append(majority, i)
+		}
+	}
+	elected := c.leader(term, majority...)
+	var want []string
+	for k := range 2 * raftMaxBatch {
+		command := fmt.Sprintf("b%d", k)
+		c.propose(elected, command)
+		want = append(want, command)
+	}
+
+	// After healing, both logs are repaired to the new leader's: the
+	// stranded entries are overwritten and the missing ones sent
+	c.network.Heal()
+	want = append([]string{"a"}, want...)
+	c.converge(want, 0, 1, 2, 3, 4)
+	lead := c.node(elected).Status()
+	for _, i := range []int{old, follower} {
+		if s := c.node(i).Status(); s.LastIndex < lead.Commit {
+			t.Errorf("%s holds %d entries, want the %d committed", c.hosts[i], s.LastIndex, lead.Commit)
+		}
+	}
+}
+
+func TestRestartFromDisk(t *testing.T) {
+	c := newTestCluster(t, 3, true)
+	leader := c.leader(0)
+	want := []string{"a", "b", "c"}
+	for _, command := range want {
+		c.propose(leader, command)
+	}
+	c.converge(want, 0, 1, 2)
+	term := c.node(leader).Status().Term
+
+	for i := range c.hosts {
+		c.crash(i)
+	}
+	for i := range c.hosts {
+		c.restart(i)
+	}
+	for i := range c.hosts {
+		if s := c.node(i).Status(); s.Term < term || s.LastIndex < 4 {
+			t.Errorf("%s restored term %d and %d entries, want at least term %d and 4 entries", c.hosts[i], s.Term, s.LastIndex, term)
+		}
+	}
+
+	// A restarted node does not persist its commit index, so it applies its
+	// log again as the new leader commits it
+	leader = c.leader(term)
+	c.propose(leader, "d")
+	c.converge(append(want, "d"), 0, 1, 2)
+}
+
+func TestProposeOnFollower(t *testing.T) {
+	c := newTestCluster(t, 3, false)
+	leader := c.leader(0)
+	follower := (leader + 1) % 3
+	err := testutil.Eventually(5*time.Second, func() error {
+		_, err := c.node(follower).Propose(context.Background(), []byte("a"))
+		var notLeader *NotLeaderError
+		if !errors.As(err, &notLeader) || notLeader.Leader != uint64(leader+1) {
+			return fmt.Errorf("proposing on a follower returned %v, want a redirect to node %d", err, leader+1)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,11 @@
+package saga
+
+import "errors"
+
+// ErrAborted is reported for a saga that had a step fail and was
+// compensated
+var ErrAborted = errors.New("saga aborted")
+
+// ErrCompensationFailed is reported, alongside ErrAborted, for a saga
+// whose compensations did not all succeed
+var ErrCompensationFailed = errors.New("saga compensation failed")
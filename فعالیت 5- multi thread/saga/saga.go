@@ -0,0 +1,388 @@
+// Package saga runs sagas: sequences of steps that either all happen or,
+// when one fails, are undone by compensating the steps that completed
+package saga
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"multithread/internal/wire"
+	"multithread/taskqueue"
+)
+
+// Action runs one step of a saga on the saga's input and returns the output
+// its compensation will need
+type Action func(ctx context.Context, input []byte) ([]byte, error)
+
+// Compensation undoes a step of a saga given the saga's input and the step's
+// output. It may be retried, and after a crash it is also called for a step
+// whose action may never have run, with a nil output, so it must be
+// idempotent and tolerate undoing nothing
+type Compensation func(ctx context.Context, input, output []byte) error
+
+// Status is the state of a saga execution
+type Status int
+
+const (
+	// Running sagas are running their steps forward
+	Running Status = iota
+	// Completed sagas ran every step
+	Completed
+	// Compensating sagas are undoing their completed steps
+	Compensating
+	// Compensated sagas had a step fail and undid every completed step
+	Compensated
+	// Stuck sagas had a compensation fail even after retries; they stay
+	// in the log and are compensated again by the next Recover
+	Stuck
+)
+
+// String returns the status name
+func (s Status) String() string {
+	switch s {
+	case Running:
+		return "running"
+	case Completed:
+		return "completed"
+	case Compensating:
+		return "compensating"
+	case Compensated:
+		return "compensated"
+	case Stuck:
+		return "stuck"
+	default:
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+}
+
+// Saga is a named sequence of steps, each with an action and a compensating
+// action that undoes it. Running a saga runs the actions in order; when one
+// fails, the compensations of the steps that completed run in reverse order,
+// so the saga as a whole either happens or is undone without holding locks
+// across the participants the way two-phase commit does
+type Saga struct {
+	name  string
+	steps []sagaStep
+}
+
+// sagaStep is one step of a saga
+type sagaStep struct {
+	name       string
+	action     Action
+	compensate Compensation
+}
+
+// New creates a saga with no steps
+func New(name string) *Saga {
+	return &Saga{name: name}
+}
+
+// Add appends a step; compensate may be nil for a step with nothing to undo,
+// such as a final notification
+func (s *Saga) Add(name string, action Action, compensate Compensation) error {
+	for _, step := range s.steps {
+		if step.name == name {
+			return fmt.Errorf("saga %s: step %q already exists", s.name, name)
+		}
+	}
+	s.steps = append(s.steps, sagaStep{name: name, action: action, compensate: compensate})
+	return nil
+}
+
+// Result reports how a saga execution ended
+type Result struct {
+	ID     string
+	Saga   string
+	Status Status
+	// Outputs holds the output of every step that completed, by step name
+	Outputs map[string][]byte
+	// Failed names the step whose failure triggered compensation, if any
+	Failed string
+}
+
+// Config configures a Orchestrator
+type Config struct {
+	// LogPath is the file saga states are logged to, so that Recover can
+	// finish the sagas a crash interrupted; empty keeps no log
+	LogPath string
+	// Retry governs how failed compensations are retried; the zero value
+	// tries five times starting with a 100ms backoff
+	Retry taskqueue.RetryPolicy
+}
+
+// sagaState is the persisted state of one execution: the saga's input, the
+// output of every completed step and the next step to run or compensate
+type sagaState struct {
+	status  Status
+	next    int
+	failed  string
+	input   []byte
+	outputs [][]byte
+	done    []bool
+}
+
+// marshal encodes the state as the status, next step and step count as
+// uvarints, then the failed step and input as uvarint-prefixed bytes, then
+// a done flag and output per step
+func (s *sagaState) marshal() []byte {
+	b := binary.AppendUvarint(nil, uint64(s.status))
+	b = binary.AppendUvarint(b, uint64(s.next+1))
+	b = binary.AppendUvarint(b, uint64(len(s.done)))
+	b = wire.AppendBytes(b, []byte(s.failed))
+	b = wire.AppendBytes(b, s.input)
+	for i, done := range s.done {
+		var flag uint64
+		if done {
+			flag = 1
+		}
+		b = binary.AppendUvarint(b, flag)
+		b = wire.AppendBytes(b, s.outputs[i])
+	}
+	return b
+}
+
+// unmarshal decodes a state encoded by marshal
+func (s *sagaState) unmarshal(b []byte) error {
+	r := wire.Reader{B: b}
+	s.status = Status(r.Uvarint())
+	s.next = int(r.Uvarint()) - 1
+	n := r.Uvarint()
+	s.failed = string(r.Bytes())
+	s.input = r.Bytes()
+	if n > uint64(len(r.B)) {
+		return wire.ErrMalformed
+	}
+	s.done, s.outputs = make([]bool, n), make([][]byte, n)
+	for i := range s.done {
+		s.done[i] = r.Uvarint() == 1
+		s.outputs[i] = r.Bytes()
+	}
+	return r.Err
+}
+
+// Orchestrator runs sagas, logging the state of each one before every step
+// and compensation so that a restarted orchestrator can finish it
+type Orchestrator struct {
+	cfg Config
+	log *taskqueue.StateLog
+
+	mu      sync.Mutex
+	sagas   map[string]*Saga
+	running map[string]bool
+	pending []*taskqueue.Message
+}
+
+// NewOrchestrator opens the orchestrator's log; the sagas it left unfinished
+// are kept for Recover
+func NewOrchestrator(cfg Config) (*Orchestrator, error) {
+	if cfg.Retry.MaxAttempts <= 0 {
+		cfg.Retry.MaxAttempts = 5
+	}
+	if cfg.Retry.BaseDelay <= 0 {
+		cfg.Retry.BaseDelay = 100 * time.Millisecond
+	}
+	l, open, err := taskqueue.OpenStateLog(cfg.LogPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Orchestrator{cfg: cfg, log: l, sagas: make(map[string]*Saga), running: make(map[string]bool), pending: open}, nil
+}
+
+// Register makes s available to Execute and Recover under its name; sagas
+// must be registered under the same names, with the same steps in the same
+// order, for a restarted orchestrator to recover them
+func (o *Orchestrator) Register(s *Saga) {
+	o.mu.Lock()
+	o.sagas[s.name] = s
+	o.mu.Unlock()
+}
+
+// Execute runs the saga registered under name as execution id with input.
+// The error is nil if every step completed; otherwise it wraps ErrAborted
+// and the step's error, and also ErrCompensationFailed if the saga could not
+// be fully undone. It refuses the ID of an execution the log left
+// unfinished until Recover has finished it
+func (o *Orchestrator) Execute(ctx context.Context, name, id string, input []byte) (*Result, error) {
+	o.mu.Lock()
+	s, ok := o.sagas[name]
+	if !ok {
+		o.mu.Unlock()
+		return nil, fmt.Errorf("saga %q is not registered", name)
+	}
+	if o.running[id] {
+		o.mu.Unlock()
+		return nil, fmt.Errorf("saga execution %q is already running", id)
+	}
+	// Running it afresh would overwrite the logged state Recover needs
+	if slices.ContainsFunc(o.pending, func(m *taskqueue.Message) bool { return m.Key == id }) {
+		o.mu.Unlock()
+		return nil, fmt.Errorf("saga execution %q is unfinished; Recover it first", id)
+	}
+	o.running[id] = true
+	o.mu.Unlock()
+	defer o.finish(id)
+
+	st := &sagaState{input: input, outputs: make([][]byte, len(s.steps)), done: make([]bool, len(s.steps))}
+	return o.run(ctx, s, id, st)
+}
+
+// Recover finishes the sagas the log recorded as unfinished: a saga that was
+// running forward is compensated, starting with the step that was in
+// flight, since it cannot tell whether that step's action ran; a saga that
+// was compensating carries on. It returns the result of each, and an error
+// joining the failures
+func (o *Orchestrator) Recover(ctx context.Context) ([]*Result, error) {
+	o.mu.Lock()
+	pending := slices.Clone(o.pending)
+	o.mu.Unlock()
+
+	var results []*Result
+	var errs []error
+	for _, m := range pending {
+		// Each execution stays pending, so Execute refuses its ID, until it
+		// is marked running
+		o.mu.Lock()
+		s, ok := o.sagas[m.Task]
+		busy := o.running[m.Key]
+		i := slices.Index(o.pending, m)
+		if ok && !busy && i >= 0 {
+			o.pending = slices.Delete(o.pending, i, i+1)
+			o.running[m.Key] = true
+		}
+		o.mu.Unlock()
+		if i < 0 {
+			// Another Recover took it
+			continue
+		}
+		if !ok || busy {
+			// Keep it for a later Recover once the saga is registered
+			errs = append(errs, fmt.Errorf("saga execution %q: saga %q is not registered or is running", m.Key, m.Task))
+			continue
+		}
+
+		st := new(sagaState)
+		err := st.unmarshal(m.Payload)
+		if err == nil && len(st.done) != len(s.steps) {
+			err = fmt.Errorf("log has %d steps, saga has %d", len(st.done), len(s.steps))
+		}
+		if err != nil {
+			o.finish(m.Key)
+			errs = append(errs, fmt.Errorf("saga execution %q: %w", m.Key, err))
+			continue
+		}
+		if st.status == Running {
+			st.status, st.failed = Compensating, s.steps[st.next].name
+		}
+		if st.status == Stuck {
+			st.status = Compensating
+		}
+		res, err := o.run(ctx, s, m.Key, st)
+		o.finish(m.Key)
+		results = append(results, res)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// finish marks execution id as no longer running
+func (o *Orchestrator) finish(id string) {
+	o.mu.Lock()
+	delete(o.running, id)
+	o.mu.Unlock()
+}
+
+// run drives st forward or through compensation until it ends
+func (o *Orchestrator) run(ctx context.Context, s *Saga, id string, st *sagaState) (*Result, error) {
+	save := func() error {
+		return o.log.Write(&taskqueue.Message{Type: taskqueue.MsgDispatch, Key: id, Task: s.name, Payload: st.marshal()}, true)
+	}
+
+	var cause error
+	if st.status == Running {
+		for st.next = 0; st.next < len(s.steps); st.next++ {
+			if err := save(); err != nil {
+				return o.result(s, id, st), err
+			}
+			step := s.steps[st.next]
+			out, err := step.action(ctx, st.input)
+			if err != nil {
+				cause = fmt.Errorf("saga %s: step %q: %w", s.name, step.name, err)
+				st.status, st.failed = Compensating, step.name
+				st.next--
+				break
+			}
+			st.outputs[st.next], st.done[st.next] = out, true
+		}
+		if st.status == Running {
+			// Synced, or a restart would undo a saga that completed
+			st.status = Completed
+			err := o.log.Write(&taskqueue.Message{Type: taskqueue.MsgResult, Key: id}, true)
+			return o.result(s, id, st), err
+		}
+	} else if st.failed != "" {
+		cause = fmt.Errorf("saga %s: step %q failed or was interrupted before a restart", s.name, st.failed)
+	}
+
+	// Undo in reverse order, persisting progress before each compensation
+	for ; st.next >= 0; st.next-- {
+		if err := save(); err != nil {
+			return o.result(s, id, st), errors.Join(fmt.Errorf("%w: %w", ErrAborted, cause), err)
+		}
+		step := s.steps[st.next]
+		if step.compensate == nil {
+			continue
+		}
+		if err := o.compensate(ctx, step, st); err != nil {
+			st.status = Stuck
+			save()
+			return o.result(s, id, st), errors.Join(
+				fmt.Errorf("%w: %w", ErrAborted, cause),
+				fmt.Errorf("%w: step %q: %w", ErrCompensationFailed, step.name, err))
+		}
+		st.outputs[st.next], st.done[st.next] = nil, false
+	}
+	st.status = Compensated
+	o.log.Write(&taskqueue.Message{Type: taskqueue.MsgResult, Key: id}, true)
+	return o.result(s, id, st), fmt.Errorf("%w: %w", ErrAborted, cause)
+}
+
+// compensate runs a step's compensation, retrying it under the policy. It
+// keeps going when ctx is cancelled, since a half-undone saga is worse than
+// a late one
+func (o *Orchestrator) compensate(ctx context.Context, step sagaStep, st *sagaState) error {
+	ctx = context.WithoutCancel(ctx)
+	var outputs []byte
+	if st.done[st.next] {
+		outputs = st.outputs[st.next]
+	}
+	for attempt := 1; ; attempt++ {
+		err := step.compensate(ctx, st.input, outputs)
+		if err == nil || !o.cfg.Retry.ShouldRetry(attempt, err) {
+			return err
+		}
+		time.Sleep(o.cfg.Retry.Backoff(attempt))
+	}
+}
+
+// result reports st as a Result
+func (o *Orchestrator) result(s *Saga, id string, st *sagaState) *Result {
+	res := &Result{ID: id, Saga: s.name, Status: st.status, Failed: st.failed, Outputs: make(map[string][]byte)}
+	for i, done := range st.done {
+		if done {
+			res.Outputs[s.steps[i].name] = st.outputs[i]
+		}
+	}
+	return res
+}
+
+// Close closes the orchestrator's log
+func (o *Orchestrator) Close() error {
+	return o.log.Close()
+}
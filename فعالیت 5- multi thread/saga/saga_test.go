@@ -0,0 +1,203 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"multithread/taskqueue"
+)
+
+// journal records the actions and compensations a saga runs
+type journal struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (j *journal) add(format string, args ...any) {
+	j.mu.Lock()
+	j.entries = append(j.entries, fmt.Sprintf(format, args...))
+	j.mu.Unlock()
+}
+
+func (j *journal) read() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.entries)
+}
+
+// booking returns a saga of steps a, b, c and d whose actions output their
+// name and record themselves in j, as do the compensations with the output
+// they undo; the action of the step named fail fails
+func booking(j *journal, fail string) *Saga {
+	s := New("booking")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		action := func(_ context.Context, input []byte) ([]byte, error) {
+			j.add("do %s", name)
+			if name == fail {
+				return nil, errors.New("no seats")
+			}
+			return []byte(name + ":" + string(input)), nil
+		}
+		compensate := func(_ context.Context, input, output []byte) error {
+			j.add("undo %s %q", name, output)
+			return nil
+		}
+		if err := s.Add(name, action, compensate); err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+// openOrchestrator opens an orchestrator on the log at path with s
+// registered
+func openOrchestrator(t *testing.T, path string, s *Saga) *Orchestrator {
+	t.Helper()
+	o, err := NewOrchestrator(Config{LogPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+	o.Register(s)
+	return o
+}
+
+// crashedLog writes the log an orchestrator leaves when it crashes with
+// execution id of booking in state st
+func crashedLog(t *testing.T, path, id string, st *sagaState) {
+	t.Helper()
+	l, _, err := taskqueue.OpenStateLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &taskqueue.Message{Type: taskqueue.MsgDispatch, Key: id, Task: "booking", Payload: st.marshal()}
+	if err := l.Write(m, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecuteCompletes(t *testing.T) {
+	var j journal
+	o := openOrchestrator(t, filepath.Join(t.TempDir(), "saga.log"), booking(&j, ""))
+	res, err := o.Execute(context.Background(), "booking", "trip-1", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != Completed || len(res.Outputs) != 4 || string(res.Outputs["c"]) != "c:x" {
+		t.Errorf("completed saga reported %v with outputs %q", res.Status, res.Outputs)
+	}
+	if got, want := j.read(), []string{"do a", "do b", "do c", "do d"}; !slices.Equal(got, want) {
+		t.Errorf("saga ran %q, want %q", got, want)
+	}
+}
+
+func TestCompensationRunsInReverse(t *testing.T) {
+	var j journal
+	o := openOrchestrator(t, filepath.Join(t.TempDir(), "saga.log"), booking(&j, "c"))
+	res, err := o.Execute(context.Background(), "booking", "trip-1", []byte("x"))
+	if !errors.Is(err, ErrAborted) || errors.Is(err, ErrCompensationFailed) {
+		t.Fatalf("Execute returned %v for a failing step, want ErrAborted alone", err)
+	}
+	if res.Status != Compensated || res.Failed != "c" || len(res.Outputs) != 0 {
+		t.Errorf("aborted saga reported %v, failed %q, outputs %q", res.Status, res.Failed, res.Outputs)
+	}
+	// The failed step did nothing to undo, and d never ran
+	want := []string{"do a", "do b", "do c", `undo b "b:x"`, `undo a "a:x"`}
+	if got := j.read(); !slices.Equal(got, want) {
+		t.Errorf("saga ran %q, want %q", got, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name  string
+		state *sagaState
+		want  []string
+	}{
+		{
+			// Crashed while b's action was in flight: b may have run, so it
+			// is compensated too, with no output
+			name: "running",
+			state: &sagaState{
+				status:  Running,
+				next:    1,
+				input:   []byte("x"),
+				done:    []bool{true, false, false, false},
+				outputs: [][]byte{[]byte("a:x"), nil, nil, nil},
+			},
+			want: []string{`undo b ""`, `undo a "a:x"`},
+		},
+		{
+			// Crashed compensating after c failed and b was undone
+			name: "compensating",
+			state: &sagaState{
+				status:  Compensating,
+				next:    0,
+				failed:  "c",
+				input:   []byte("x"),
+				done:    []bool{true, false, false, false},
+				outputs: [][]byte{[]byte("a:x"), nil, nil, nil},
+			},
+			want: []string{`undo a "a:x"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "saga.log")
+			crashedLog(t, path, "trip-1", tt.state)
+
+			var j journal
+			o := openOrchestrator(t, path, booking(&j, ""))
+			results, err := o.Recover(context.Background())
+			if !errors.Is(err, ErrAborted) || len(results) != 1 {
+				t.Fatalf("Recover returned %d results and %v, want one aborted saga", len(results), err)
+			}
+			if res := results[0]; res.ID != "trip-1" || res.Status != Compensated {
+				t.Errorf("recovered saga %q reported %v", res.ID, res.Status)
+			}
+			if got := j.read(); !slices.Equal(got, tt.want) {
+				t.Errorf("recovery ran %q, want %q", got, tt.want)
+			}
+			o.Close()
+
+			// Finished, the saga is gone from the log
+			again := openOrchestrator(t, path, booking(&j, ""))
+			if results, err := again.Recover(context.Background()); len(results) != 0 || err != nil {
+				t.Errorf("second recovery returned %d results and %v", len(results), err)
+			}
+		})
+	}
+}
+
+func TestExecuteRefusesUnrecoveredID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "saga.log")
+	crashedLog(t, path, "trip-1", &sagaState{
+		status:  Running,
+		next:    1,
+		done:    []bool{true, false, false, false},
+		outputs: [][]byte{[]byte("a:"), nil, nil, nil},
+	})
+
+	var j journal
+	o := openOrchestrator(t, path, booking(&j, ""))
+	if _, err := o.Execute(context.Background(), "booking", "trip-1", nil); err == nil {
+		t.Fatal("Execute reused the ID of an unrecovered execution")
+	}
+	if entries := j.read(); len(entries) > 0 {
+		t.Fatalf("the refused execution ran %q", entries)
+	}
+	if _, err := o.Recover(context.Background()); !errors.Is(err, ErrAborted) {
+		t.Fatalf("Recover returned %v, want the interrupted saga aborted", err)
+	}
+	if _, err := o.Execute(context.Background(), "booking", "trip-1", nil); err != nil {
+		t.Fatalf("Execute refused an ID after its recovery: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"multithread/config"
+)
+
+// settings is the configuration main loads, which the commands take their
+// flag defaults from, and settingsPath the file it was loaded from, if any
+var (
+	settings     = config.Default()
+	settingsPath string
+)
+
+// loadSettings loads settings from the file named by a leading -config
+// flag, or by TASKQUEUE_CONFIG, and returns the arguments after the flag
+func loadSettings(args []string) ([]string, error) {
+	path := os.Getenv(config.EnvPrefix + "_CONFIG")
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[0], "-"), "=")
+		switch {
+		case name != "config":
+		case hasValue:
+			path, args = value, args[1:]
+		case len(args) > 1:
+			path, args = args[1], args[2:]
+		default:
+			return nil, errors.New("flag needs an argument: -config")
+		}
+	}
+	c, err := config.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	settings, settingsPath = c, path
+	return args, nil
+}
+
+// transportFlags returns the defaults of the -grpc, -quic and -websocket
+// flags the transport settings imply
+func transportFlags(t config.TransportSettings) (useGRPC, useQUIC, useWebSocket bool) {
+	return t.Protocol == "grpc", t.Protocol == "quic", t.Protocol == "websocket"
+}
@@ -0,0 +1,352 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// correlationHeader is the header an admin API client names the correlation
+// ID of the task it submits with
+const correlationHeader = "X-Correlation-ID"
+
+// adminResultLimit is how many finished tasks an AdminHandler remembers the
+// outcome of, the oldest forgotten first
+const adminResultLimit = 1024
+
+// AdminTask is the status of a task, as the admin API reports it
+type AdminTask struct {
+	ID          uint64 `json:"id"`
+	Name        string `json:"name,omitempty"`
+	Correlation string `json:"correlation,omitempty"`
+	// State is "queued" or "running" while the task is unfinished, and then
+	// "succeeded", "failed" or "cancelled"
+	State string `json:"state"`
+	// Worker is the worker running the task
+	Worker  string `json:"worker,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	// Output is the output of a task that succeeded, as text
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AdminStatus is an overview of a coordinator, as the admin API reports it
+type AdminStatus struct {
+	Workers      []WorkerStatus `json:"workers"`
+	Queued       int            `json:"queued"`
+	Running      int            `json:"running"`
+	Redeliveries uint64         `json:"redeliveries"`
+	Latencies    PhaseLatencies `json:"latencies"`
+}
+
+// adminResults remembers the outcomes of the last adminResultLimit tasks
+// submitted through an AdminHandler
+type adminResults struct {
+	mu    sync.Mutex
+	tasks map[uint64]AdminTask
+	order []uint64
+}
+
+// add records the outcome of a finished task
+func (r *adminResults) add(t AdminTask) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.order) == adminResultLimit {
+		delete(r.tasks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.tasks[t.ID] = t
+	r.order = append(r.order, t.ID)
+}
+
+// get returns the outcome of the finished task with the given ID
+func (r *adminResults) get(id uint64) (AdminTask, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tasks[id]
+	return t, ok
+}
+
+// finishedTask returns the status of the finished task t
+func finishedTask(t *remoteTask, value any, err error) AdminTask {
+	status := AdminTask{ID: t.id, Name: t.name, Correlation: t.correlation, State: "succeeded"}
+	switch {
+	case errors.Is(err, ErrTaskCancelled):
+		status.State, status.Error = "cancelled", err.Error()
+	case err != nil:
+		status.State, status.Error = "failed", err.Error()
+	default:
+		out, _ := value.([]byte)
+		status.Output = string(out)
+	}
+	return status
+}
+
+// AdminHandler serves the admin API of c, through which operators submit,
+// inspect and cancel tasks and list and drain workers:
+//
+//	POST   /tasks?name=sleep[&key=k][&wait=true]  submit a task, the body its payload
+//	GET    /tasks/{id}                            the status of a task
+//	DELETE /tasks/{id}                            cancel a task
+//	GET    /nodes                                 the registered workers
+//	POST   /nodes/{id}/drain                      stop dispatching to a worker
+//	GET    /status                                an overview of the coordinator
+//
+// Submitting answers with the task's ID, or with wait its outcome once it
+// finishes; key routes the task as SubmitKeyed does, and a client may name
+// the task's correlation ID in the X-Correlation-ID header. The outcomes of
+// the tasks submitted through the handler are kept for a while, those of
+// other tasks only while they are unfinished.
+// If c requires tokens, cancelling and draining take one granting
+// ScopeAdmin and the rest one granting ScopeSubmit, as a bearer token
+func AdminHandler(c *Coordinator) http.Handler {
+	results := &adminResults{tasks: make(map[uint64]AdminTask)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tasks", func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "missing task name", http.StatusBadRequest)
+			return
+		}
+		payload, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The task outlives the request, which only waits for it
+		ctx := context.Background()
+		if id := req.Header.Get(correlationHeader); id != "" {
+			ctx = WithCorrelationID(ctx, id)
+		}
+		t := &remoteTask{route: req.URL.Query().Get("key"), name: name, payload: payload, ctx: ctx, future: newFuture()}
+		future := c.submit(t)
+		if t.id == 0 {
+			http.Error(w, future.Err().Error(), http.StatusServiceUnavailable)
+			return
+		}
+		go func() {
+			value, err := future.Get()
+			results.add(finishedTask(t, value, err))
+		}()
+		if wait, _ := strconv.ParseBool(req.URL.Query().Get("wait")); wait {
+			select {
+			case <-future.Done():
+			case <-req.Context().Done():
+				return
+			}
+			value, err := future.Get()
+			writeJSON(w, http.StatusOK, finishedTask(t, value, err))
+			return
+		}
+		writeJSON(w, http.StatusAccepted, AdminTask{ID: t.id, Name: name, Correlation: t.correlation, State: TaskQueued.String()})
+	})
+	mux.HandleFunc("GET /tasks/{id}", func(w http.ResponseWriter, req *http.Request) {
+		id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid task ID", http.StatusBadRequest)
+			return
+		}
+		for _, t := range c.Tasks() {
+			if t.ID == id {
+				writeJSON(w, http.StatusOK, AdminTask{
+					ID: id, Name: t.Name, Correlation: t.Correlation, State: t.State.String(),
+					Worker: t.Worker, Attempt: t.Attempt,
+				})
+				return
+			}
+		}
+		if t, ok := results.get(id); ok {
+			writeJSON(w, http.StatusOK, t)
+			return
+		}
+		http.Error(w, fmt.Sprintf("%v: %d", ErrUnknownTask, id), http.StatusNotFound)
+	})
+	mux.HandleFunc("DELETE /tasks/{id}", func(w http.ResponseWriter, req *http.Request) {
+		id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid task ID", http.StatusBadRequest)
+			return
+		}
+		if err := c.Cancel(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /nodes", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, c.WorkerStatuses())
+	})
+	mux.HandleFunc("POST /nodes/{id}/drain", func(w http.ResponseWriter, req *http.Request) {
+		if err := c.DrainWorker(req.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		status := AdminStatus{Workers: c.WorkerStatuses(), Redeliveries: c.Redeliveries(), Latencies: c.Latencies().Summary()}
+		for _, t := range c.Tasks() {
+			if t.State == TaskQueued {
+				status.Queued++
+			} else {
+				status.Running++
+			}
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		scope := ScopeSubmit
+		if req.Method == http.MethodDelete || strings.HasSuffix(req.URL.Path, "/drain") {
+			scope = ScopeAdmin
+		}
+		if err := c.authorize(bearerToken(req), scope); err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrPermissionDenied) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// writeJSON answers with v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// AdminClient is a client of a coordinator's admin API, as served by
+// AdminHandler
+type AdminClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// NewAdminClient creates a client for the admin API at baseURL
+func NewAdminClient(baseURL string) *AdminClient {
+	return &AdminClient{base: strings.TrimSuffix(baseURL, "/"), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// SetToken makes the client present token as a bearer token
+func (a *AdminClient) SetToken(token string) {
+	a.token = token
+}
+
+// SetTLSConfig makes the client connect to https:// admin APIs with cfg
+func (a *AdminClient) SetTLSConfig(cfg *tls.Config) {
+	a.client.Transport = &http.Transport{TLSClientConfig: cfg}
+}
+
+// Submit submits a call of the named task with payload and returns its
+// status: queued, or its outcome with wait. Waiting is bounded by ctx
+// rather than the client's timeout. The task gets the correlation ID ctx
+// carries, if any
+func (a *AdminClient) Submit(ctx context.Context, name string, payload []byte, wait bool) (AdminTask, error) {
+	return a.SubmitKeyed(ctx, "", name, payload, wait)
+}
+
+// SubmitKeyed is like Submit, but the coordinator routes the task by key;
+// see Coordinator.SubmitKeyed
+func (a *AdminClient) SubmitKeyed(ctx context.Context, key, name string, payload []byte, wait bool) (AdminTask, error) {
+	query := url.Values{"name": {name}}
+	if key != "" {
+		query.Set("key", key)
+	}
+	if wait {
+		query.Set("wait", "true")
+	}
+	var t AdminTask
+	err := a.do(ctx, http.MethodPost, "/tasks?"+query.Encode(), payload, !wait, &t)
+	return t, err
+}
+
+// Task returns the status of the task with the given ID
+func (a *AdminClient) Task(ctx context.Context, id uint64) (AdminTask, error) {
+	var t AdminTask
+	err := a.do(ctx, http.MethodGet, "/tasks/"+strconv.FormatUint(id, 10), nil, true, &t)
+	return t, err
+}
+
+// Cancel cancels the task with the given ID
+func (a *AdminClient) Cancel(ctx context.Context, id uint64) error {
+	return a.do(ctx, http.MethodDelete, "/tasks/"+strconv.FormatUint(id, 10), nil, true, nil)
+}
+
+// Nodes returns the workers registered with the coordinator
+func (a *AdminClient) Nodes(ctx context.Context) ([]WorkerStatus, error) {
+	var nodes []WorkerStatus
+	err := a.do(ctx, http.MethodGet, "/nodes", nil, true, &nodes)
+	return nodes, err
+}
+
+// Drain stops the coordinator dispatching to the worker with the given ID
+func (a *AdminClient) Drain(ctx context.Context, id string) error {
+	return a.do(ctx, http.MethodPost, "/nodes/"+url.PathEscape(id)+"/drain", nil, true, nil)
+}
+
+// Status returns an overview of the coordinator
+func (a *AdminClient) Status(ctx context.Context) (AdminStatus, error) {
+	var s AdminStatus
+	err := a.do(ctx, http.MethodGet, "/status", nil, true, &s)
+	return s, err
+}
+
+// do sends a request and decodes the answer into out, unless it is nil.
+// Answers of 404 report ErrUnknownTask or ErrUnknownWorker, as the message
+// starts with the sentinel's text. Requests without timeout are bounded by
+// ctx alone
+func (a *AdminClient) do(ctx context.Context, method, path string, body []byte, timeout bool, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, a.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	if id := CorrelationID(ctx); id != "" {
+		req.Header.Set(correlationHeader, id)
+	}
+	client := a.client
+	if !timeout {
+		client = &http.Client{Transport: a.client.Transport}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	msg := strings.TrimSpace(string(b))
+	if resp.StatusCode == http.StatusNotFound {
+		for _, sentinel := range []error{ErrUnknownTask, ErrUnknownWorker} {
+			if rest, ok := strings.CutPrefix(msg, sentinel.Error()+": "); ok {
+				return fmt.Errorf("%w: %s", sentinel, rest)
+			}
+		}
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("admin: %s %s: %s: %s", method, path, resp.Status, msg)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
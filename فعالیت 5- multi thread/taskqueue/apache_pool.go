@@ -0,0 +1,417 @@
+package taskqueue
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ApacheThreadPool represents a more sophisticated worker pool implementation
+type ApacheThreadPool struct {
+	poolCore
+	mu         sync.Mutex
+	cond       *sync.Cond
+	notFull    *sync.Cond
+	queue      jobQueue
+	size       int
+	coreSize   int
+	maxSize    int
+	idle       int
+	retiring   int
+	nextWorker int
+	saturated  bool
+	closed     bool
+}
+
+// Worker represents a worker in the pool
+type Worker struct {
+	ID int
+}
+
+// NewApacheThreadPool creates a new Apache-style thread pool
+func NewApacheThreadPool(numWorkers int, opts ...Option) *ApacheThreadPool {
+	pool := &ApacheThreadPool{
+		poolCore: newPoolCore("apache", opts),
+	}
+	pool.dispatch = pool.enqueue
+	pool.batch = pool.enqueueBatch
+	pool.cond = sync.NewCond(&pool.mu)
+	pool.notFull = sync.NewCond(&pool.mu)
+
+	switch {
+	case pool.config.queue != nil:
+		pool.queue = jobQueue{pool.config.queue}
+	case pool.config.priorityDispatch:
+		pool.queue = jobQueue{newPriorityQueue(pool.config.priorityAging)}
+	default:
+		pool.queue = jobQueue{&fifoQueue{}}
+	}
+	if bound := pool.queue.capacity(); bound > 0 {
+		if pool.config.queueCapacity == 0 || pool.config.queueCapacity > bound {
+			pool.config.queueCapacity = bound
+		}
+	}
+
+	// Initialize worker pool
+	pool.maxSize = pool.config.maxWorkers
+	pool.Resize(numWorkers)
+
+	context.AfterFunc(pool.ctx, pool.close)
+	pool.config.events.poolStarted(pool.config.name, numWorkers)
+	return pool
+}
+
+// SubmitWithPriority queues task at the given priority; higher values run
+// first when the pool was created with WithPriorityDispatch
+func (p *ApacheThreadPool) SubmitWithPriority(priority int, task Task) *Future {
+	j := p.newJob(context.Background(), task.run)
+	j.priority = priority
+	p.enqueue(j)
+	return j.future
+}
+
+// enqueue places j on the queue and wakes up an idle worker
+func (p *ApacheThreadPool) enqueue(j *job) {
+	if !p.admit(j) {
+		p.abort(j, ErrPoolShutdown)
+		return
+	}
+
+	p.mu.Lock()
+	var dropped *job
+wait:
+	for !p.closed && p.full() {
+		if !p.saturated {
+			p.saturated = true
+			depth := p.queue.len()
+			p.mu.Unlock()
+			p.config.events.queueSaturated(p.config.name, depth)
+			p.mu.Lock()
+			continue
+		}
+		switch p.config.rejection {
+		case RejectPolicy:
+			p.mu.Unlock()
+			p.abort(j, ErrQueueFull)
+			p.wg.Done()
+			return
+		case CallerRunsPolicy:
+			p.mu.Unlock()
+			j.callerRuns = true
+			j.worker = nil
+			p.run(j)
+			p.wg.Done()
+			return
+		case DropOldestPolicy:
+			// Make room for j alone: a queue above a lowered bound shrinks as
+			// the workers drain it, not by dropping all the excess at once
+			dropped = p.queue.dropOldest()
+			break wait
+		default:
+			if !p.waitForSpace(j) {
+				p.mu.Unlock()
+				p.abort(j, context.Cause(j.ctx))
+				p.wg.Done()
+				return
+			}
+		}
+	}
+	if p.closed {
+		p.mu.Unlock()
+		p.abort(j, context.Cause(p.ctx))
+		p.wg.Done()
+		return
+	}
+	if !p.queue.push(j) {
+		p.mu.Unlock()
+		p.abort(j, ErrQueueFull)
+		p.wg.Done()
+		return
+	}
+	if p.queue.len() > p.idle && p.size < p.maxSize {
+		// Every worker is busy; grow beyond the core size up to the maximum
+		p.size++
+		p.spawn()
+	}
+	p.mu.Unlock()
+	p.cond.Signal()
+
+	if dropped != nil {
+		p.abort(dropped, ErrTaskDropped)
+		p.wg.Done()
+	}
+
+	// Fail the future as soon as the caller gives up, even while still queued
+	context.AfterFunc(j.ctx, func() { j.future.complete(nil, context.Cause(j.ctx)) })
+}
+
+// enqueueBatch places every job on the queue under a single lock; when a
+// bounded queue cannot take the whole batch, the jobs go through enqueue one
+// by one so the rejection policy applies to each
+func (p *ApacheThreadPool) enqueueBatch(jobs []*job) {
+	admitted := jobs[:0:0]
+	for _, j := range jobs {
+		if p.admit(j) {
+			admitted = append(admitted, j)
+		} else {
+			p.abort(j, ErrPoolShutdown)
+		}
+	}
+
+	p.mu.Lock()
+	capacity := p.config.queueCapacity
+	if capacity > 0 && p.queue.len()+len(admitted) > capacity {
+		p.mu.Unlock()
+		for _, j := range admitted {
+			// Already admitted above; enqueue admits again
+			p.enqueue(j)
+			p.wg.Done()
+		}
+		return
+	}
+	if p.closed {
+		p.mu.Unlock()
+		for _, j := range admitted {
+			p.abort(j, context.Cause(p.ctx))
+			p.wg.Done()
+		}
+		return
+	}
+	for i, j := range admitted {
+		if !p.queue.push(j) {
+			// The backend filled up; hand the rest to the rejection policy
+			p.mu.Unlock()
+			for _, j := range admitted[i:] {
+				p.enqueue(j)
+				p.wg.Done()
+			}
+			p.mu.Lock()
+			admitted = admitted[:i]
+			break
+		}
+	}
+	for p.queue.len() > p.idle && p.size < p.maxSize {
+		p.size++
+		p.spawn()
+	}
+	p.mu.Unlock()
+	p.cond.Broadcast()
+
+	for _, j := range admitted {
+		context.AfterFunc(j.ctx, func() { j.future.complete(nil, context.Cause(j.ctx)) })
+	}
+}
+
+// full reports whether a bounded queue has reached its capacity; p.mu must be held
+func (p *ApacheThreadPool) full() bool {
+	return p.config.queueCapacity > 0 && p.queue.len() >= p.config.queueCapacity
+}
+
+// waitForSpace blocks until a worker takes a job off the queue, returning
+// false if j is cancelled first; p.mu must be held
+func (p *ApacheThreadPool) waitForSpace(j *job) bool {
+	stop := context.AfterFunc(j.ctx, func() {
+		p.mu.Lock()
+		p.notFull.Broadcast()
+		p.mu.Unlock()
+	})
+	defer stop()
+
+	for !p.closed && p.full() {
+		if j.ctx.Err() != nil {
+			return false
+		}
+		p.notFull.Wait()
+	}
+	return true
+}
+
+// work runs queued jobs on behalf of worker until the pool is closed
+func (p *ApacheThreadPool) work(worker *Worker) {
+	p.config.events.workerSpawned(p.config.name, worker.ID)
+	defer p.config.events.workerRetired(p.config.name, worker.ID)
+
+	for {
+		j := p.next()
+		if j == nil {
+			return
+		}
+		j.worker = worker
+		p.run(j)
+		p.wg.Done()
+	}
+}
+
+// next blocks until a job is queued; it returns nil once the pool is closed
+// or the worker should retire
+func (p *ApacheThreadPool) next() *job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idleSince := time.Now()
+	for p.queue.len() == 0 || p.retiring > 0 {
+		if p.closed {
+			return nil
+		}
+		if p.retiring > 0 {
+			p.retiring--
+			return nil
+		}
+
+		keepAlive := p.config.keepAlive
+		if p.size <= p.coreSize || keepAlive <= 0 {
+			p.idle++
+			p.cond.Wait()
+			p.idle--
+			continue
+		}
+
+		// Above the core size, workers idle for longer than keepAlive retire
+		remaining := keepAlive - time.Since(idleSince)
+		if remaining <= 0 {
+			p.size--
+			return nil
+		}
+		timer := time.AfterFunc(remaining, func() {
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		})
+		p.idle++
+		p.cond.Wait()
+		p.idle--
+		timer.Stop()
+	}
+	p.notFull.Signal()
+	j := p.queue.pop()
+	if p.saturated && p.queue.len() <= p.config.queueCapacity/2 {
+		p.saturated = false
+	}
+	return j
+}
+
+// spawn starts a new worker goroutine; p.mu must be held and p.size already
+// account for it
+func (p *ApacheThreadPool) spawn() {
+	worker := &Worker{ID: p.nextWorker}
+	p.nextWorker++
+	go p.work(worker)
+}
+
+// Resize sets the core number of workers, raising the maximum if needed;
+// surplus workers retire after finishing their current task
+func (p *ApacheThreadPool) Resize(n int) {
+	n = max(n, 1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.coreSize = n
+	p.maxSize = max(p.maxSize, n)
+	p.noteCapacity(p.maxSize)
+
+	// Cancel pending retirements first, then spawn whatever is still missing
+	for p.size < n && p.retiring > 0 {
+		p.retiring--
+		p.size++
+	}
+	for p.size < n {
+		p.size++
+		p.spawn()
+	}
+	if p.size > n {
+		p.retiring += p.size - n
+		p.size = n
+		p.cond.Broadcast()
+	}
+}
+
+// SetQueueCapacity bounds the queue to capacity tasks, as WithQueueCapacity
+// does with the policy it was given, or lifts the bound if capacity is not
+// positive; tasks queued beyond a lowered bound stay queued, and under
+// DropOldestPolicy each submit then replaces only the oldest of them. The
+// bound of a bounded TaskQueue still applies
+func (p *ApacheThreadPool) SetQueueCapacity(capacity int) {
+	capacity = max(capacity, 0)
+	p.mu.Lock()
+	if bound := p.queue.capacity(); bound > 0 && (capacity == 0 || capacity > bound) {
+		capacity = bound
+	}
+	p.config.queueCapacity = capacity
+	p.mu.Unlock()
+	p.notFull.Broadcast()
+}
+
+// Size returns the number of workers
+func (p *ApacheThreadPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// QueueDepth returns the number of tasks waiting for a worker
+func (p *ApacheThreadPool) QueueDepth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queue.len()
+}
+
+// Shutdown stops accepting new tasks, waits for the queue to drain and then
+// stops the workers
+func (p *ApacheThreadPool) Shutdown() {
+	p.stopAccepting()
+	p.wg.Wait()
+	p.cancel(ErrPoolShutdown)
+}
+
+// ShutdownNow stops accepting new tasks, cancels the running ones and returns
+// the tasks that were still queued
+func (p *ApacheThreadPool) ShutdownNow() []ContextTask {
+	p.stopAccepting()
+	pending := p.closeQueue()
+	p.cancel(ErrPoolShutdown)
+
+	for _, j := range pending {
+		p.abort(j, ErrPoolShutdown)
+		p.wg.Done()
+	}
+	return unexecuted(pending)
+}
+
+// close stops the workers and fails every job that is still queued
+func (p *ApacheThreadPool) close() {
+	for _, j := range p.closeQueue() {
+		p.abort(j, context.Cause(p.ctx))
+		p.wg.Done()
+	}
+}
+
+// closeQueue marks the pool closed, wakes the workers so they exit and
+// returns the jobs that never started
+func (p *ApacheThreadPool) closeQueue() []*job {
+	p.mu.Lock()
+	p.closed = true
+	var pending []*job
+	for j := p.queue.pop(); j != nil; j = p.queue.pop() {
+		pending = append(pending, j)
+	}
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	p.notFull.Broadcast()
+	return pending
+}
+
+// Metrics returns a snapshot of the pool metrics
+func (p *ApacheThreadPool) Metrics() MetricsSnapshot {
+	return p.metrics.snapshot(p.QueueDepth())
+}
+
+// ExecuteTasks runs n simulated tasks
+func (p *ApacheThreadPool) ExecuteTasks(n int) {
+	for i := 0; i < n && p.ctx.Err() == nil; i++ {
+		// Simulate work
+		p.Submit(func() { time.Sleep(100 * time.Millisecond) })
+	}
+}
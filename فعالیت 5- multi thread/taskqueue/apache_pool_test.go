@@ -0,0 +1,91 @@
+package taskqueue
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// shutdownWithin fails the test unless p.Shutdown returns within timeout
+func shutdownWithin(t *testing.T, p Executor, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		p.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+// waitFutures fails the test unless every one of futures completes within
+// timeout, and counts those failing with ErrTaskDropped
+func waitFutures(t *testing.T, futures []*Future, timeout time.Duration) (dropped int) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for i, f := range futures {
+		select {
+		case <-f.Done():
+		case <-deadline:
+			t.Fatalf("future %d never completed", i)
+		}
+		if errors.Is(f.Err(), ErrTaskDropped) {
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func TestApacheDropOldestPastTheBound(t *testing.T) {
+	p := NewApacheThreadPool(1, WithQueueCapacity(2, DropOldestPolicy))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	futures := []*Future{p.Submit(func() {
+		close(started)
+		<-release
+	})}
+	<-started
+	for range 10 {
+		futures = append(futures, p.Submit(func() {}))
+	}
+	if depth := p.QueueDepth(); depth != 2 {
+		t.Errorf("queue depth %d past a bound of 2", depth)
+	}
+	close(release)
+	if dropped := waitFutures(t, futures, 5*time.Second); dropped != 8 {
+		t.Errorf("%d tasks dropped, want 8", dropped)
+	}
+	shutdownWithin(t, p, 5*time.Second)
+}
+
+func TestApacheDropOldestLoweredBound(t *testing.T) {
+	p := NewApacheThreadPool(1, WithQueueCapacity(6, DropOldestPolicy))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	futures := []*Future{p.Submit(func() {
+		close(started)
+		<-release
+	})}
+	<-started
+	for range 6 {
+		futures = append(futures, p.Submit(func() {}))
+	}
+
+	// A reload lowering the bound leaves the excess queued, each submit
+	// past it replacing only the oldest task
+	p.SetQueueCapacity(2)
+	for range 3 {
+		futures = append(futures, p.Submit(func() {}))
+	}
+	if depth := p.QueueDepth(); depth != 6 {
+		t.Errorf("queue depth %d after 3 submits over a lowered bound, want 6", depth)
+	}
+	close(release)
+	if dropped := waitFutures(t, futures, 5*time.Second); dropped != 3 {
+		t.Errorf("%d tasks dropped, want 3", dropped)
+	}
+	shutdownWithin(t, p, 5*time.Second)
+}
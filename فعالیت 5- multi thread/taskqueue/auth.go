@@ -0,0 +1,265 @@
+package taskqueue
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes a token may grant
+const (
+	// ScopeSubmit allows submitting tasks and collecting their results
+	ScopeSubmit = "submit"
+	// ScopeWorker allows registering as a worker
+	ScopeWorker = "worker"
+	// ScopeAdmin allows everything, including what the other scopes allow
+	ScopeAdmin = "admin"
+)
+
+// TokenClaims is what a token says about its holder
+type TokenClaims struct {
+	// Subject names the holder, such as a worker ID
+	Subject string
+	Scopes  []string
+	// IssuedAt is when the token was signed; ExpiresAt, if set, is when it
+	// stops being valid
+	IssuedAt, ExpiresAt time.Time
+}
+
+// HasScope reports whether the claims grant scope, which ScopeAdmin always
+// does
+func (c TokenClaims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope) || slices.Contains(c.Scopes, ScopeAdmin)
+}
+
+// TokenVerifier checks tokens and returns their claims, failing with
+// ErrInvalidToken for tokens that are malformed, forged or expired
+type TokenVerifier interface {
+	Verify(token string) (TokenClaims, error)
+}
+
+// Authorize verifies token with v and checks that it grants scope, failing
+// with ErrPermissionDenied if it does not
+func Authorize(v TokenVerifier, token, scope string) (TokenClaims, error) {
+	if token == "" {
+		return TokenClaims{}, fmt.Errorf("%w: no token", ErrInvalidToken)
+	}
+	claims, err := v.Verify(token)
+	if err != nil {
+		return TokenClaims{}, err
+	}
+	if !claims.HasScope(scope) {
+		return TokenClaims{}, fmt.Errorf("%w: token of %q lacks scope %q", ErrPermissionDenied, claims.Subject, scope)
+	}
+	return claims, nil
+}
+
+// Token signature algorithms, as named in the token header
+const (
+	tokenHS256 = "HS256"
+	tokenEdDSA = "EdDSA"
+)
+
+// tokenHeader and tokenPayload are the JSON parts of a token, with the
+// claim names of a JWT
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type tokenPayload struct {
+	Sub   string `json:"sub,omitempty"`
+	Scope string `json:"scope,omitempty"`
+	Iat   int64  `json:"iat,omitempty"`
+	Exp   int64  `json:"exp,omitempty"`
+}
+
+// TokenKey signs and verifies tokens, which are JSON Web Tokens signed with
+// HMAC-SHA256 or Ed25519, so that tokens can also be checked by tools
+// outside this program. A key verifies only tokens of its own algorithm
+type TokenKey struct {
+	alg     string
+	secret  []byte
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+// NewHMACTokenKey creates a key that signs and verifies tokens with the
+// shared secret; every node holding it can mint tokens
+func NewHMACTokenKey(secret []byte) *TokenKey {
+	return &TokenKey{alg: tokenHS256, secret: bytes.Clone(secret)}
+}
+
+// NewEd25519TokenKey creates a key that verifies tokens with public and, if
+// private is given, signs them, so that coordinators can check tokens
+// without being able to mint them
+func NewEd25519TokenKey(public ed25519.PublicKey, private ed25519.PrivateKey) *TokenKey {
+	return &TokenKey{alg: tokenEdDSA, public: public, private: private}
+}
+
+// LoadTokenKey reads a key from path: an Ed25519 private or public key in
+// PEM, or else an HMAC secret made of the file's contents without
+// surrounding whitespace
+func LoadTokenKey(path string) (*TokenKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		secret := bytes.TrimSpace(b)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%s: empty token secret", path)
+		}
+		return NewHMACTokenKey(secret), nil
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: %T is not an Ed25519 key", path, key)
+		}
+		return NewEd25519TokenKey(private.Public().(ed25519.PublicKey), private), nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: %T is not an Ed25519 key", path, key)
+		}
+		return NewEd25519TokenKey(public, nil), nil
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", path, block.Type)
+	}
+}
+
+// Sign returns a token carrying claims
+func (k *TokenKey) Sign(claims TokenClaims) (string, error) {
+	if k.alg == tokenEdDSA && k.private == nil {
+		return "", errors.New("token key can only verify")
+	}
+	header, err := json.Marshal(tokenHeader{Alg: k.alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload := tokenPayload{Sub: claims.Subject, Scope: strings.Join(claims.Scopes, " ")}
+	if !claims.IssuedAt.IsZero() {
+		payload.Iat = claims.IssuedAt.Unix()
+	}
+	if !claims.ExpiresAt.IsZero() {
+		payload.Exp = claims.ExpiresAt.Unix()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(body)
+	return signed + "." + enc.EncodeToString(k.signature([]byte(signed))), nil
+}
+
+// signature signs the header and payload of a token
+func (k *TokenKey) signature(signed []byte) []byte {
+	if k.alg == tokenEdDSA {
+		return ed25519.Sign(k.private, signed)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
+
+// Verify implements TokenVerifier
+func (k *TokenKey) Verify(token string) (TokenClaims, error) {
+	enc := base64.RawURLEncoding
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenClaims{}, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	var header tokenHeader
+	headerJSON, err := enc.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(headerJSON, &header)
+	}
+	if err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+	// Trusting the header's algorithm would let a token signed with the
+	// public key as an HMAC secret pass
+	if header.Alg != k.alg {
+		return TokenClaims{}, fmt.Errorf("%w: algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	var valid bool
+	if k.alg == tokenEdDSA {
+		valid = ed25519.Verify(k.public, signed, sig)
+	} else {
+		valid = hmac.Equal(sig, k.signature(signed))
+	}
+	if !valid {
+		return TokenClaims{}, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var payload tokenPayload
+	body, err := enc.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(body, &payload)
+	}
+	if err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+	claims := TokenClaims{Subject: payload.Sub, Scopes: strings.Fields(payload.Scope)}
+	if payload.Iat != 0 {
+		claims.IssuedAt = time.Unix(payload.Iat, 0)
+	}
+	if payload.Exp != 0 {
+		claims.ExpiresAt = time.Unix(payload.Exp, 0)
+		if !time.Now().Before(claims.ExpiresAt) {
+			return TokenClaims{}, fmt.Errorf("%w: expired at %s", ErrInvalidToken, claims.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+	return claims, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// RequireScope serves h only to requests whose bearer token v accepts and
+// which grants scope, answering 401 or 403 otherwise
+func RequireScope(v TokenVerifier, scope string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Authorize(v, bearerToken(r), scope); err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrPermissionDenied) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package taskqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// Scalable is a pool whose worker count can change at runtime
+type Scalable interface {
+	// Resize sets the number of workers
+	Resize(n int)
+	// Size returns the current number of workers
+	Size() int
+	// QueueDepth returns the number of tasks waiting for a worker
+	QueueDepth() int
+	// ActiveWorkers returns the number of workers currently running a task
+	ActiveWorkers() int
+	// AverageLatency returns a moving average of task execution time
+	AverageLatency() time.Duration
+}
+
+// AutoscalerConfig controls how an Autoscaler sizes its pool
+type AutoscalerConfig struct {
+	MinWorkers int
+	MaxWorkers int
+	// Interval is both the sampling period and the time the scaler aims to
+	// drain the current backlog in
+	Interval time.Duration
+}
+
+// Autoscaler periodically resizes a pool based on queue depth and task latency
+type Autoscaler struct {
+	pool   Scalable
+	config AutoscalerConfig
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewAutoscaler creates an autoscaler for pool; call Start to begin sampling
+func NewAutoscaler(pool Scalable, config AutoscalerConfig) *Autoscaler {
+	if config.MinWorkers < 1 {
+		config.MinWorkers = 1
+	}
+	if config.MaxWorkers < config.MinWorkers {
+		config.MaxWorkers = config.MinWorkers
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	return &Autoscaler{
+		pool:   pool,
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start launches the sampling loop
+func (a *Autoscaler) Start() {
+	go a.loop()
+}
+
+// Stop ends the sampling loop and waits for it to exit
+func (a *Autoscaler) Stop() {
+	a.once.Do(func() { close(a.stop) })
+	<-a.done
+}
+
+// loop resizes the pool once per interval
+func (a *Autoscaler) loop() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.scale()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// scale applies a single sizing decision
+func (a *Autoscaler) scale() {
+	size := a.pool.Size()
+	target := a.desiredWorkers(size)
+	if target != size {
+		a.pool.Resize(target)
+	}
+}
+
+// desiredWorkers estimates how many workers are needed to finish the running
+// and queued tasks within one interval, shrinking by at most a quarter per step
+func (a *Autoscaler) desiredWorkers(size int) int {
+	demand := a.pool.QueueDepth() + a.pool.ActiveWorkers()
+	target := demand
+	if latency := a.pool.AverageLatency(); latency > 0 {
+		perWorker := float64(a.config.Interval) / float64(latency)
+		target = int(float64(demand)/perWorker + 0.999)
+	}
+
+	if floor := size - max(1, size/4); target < floor {
+		target = floor
+	}
+	return min(max(target, a.config.MinWorkers), a.config.MaxWorkers)
+}
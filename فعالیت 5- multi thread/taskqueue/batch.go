@@ -0,0 +1,94 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchHandle tracks a group of tasks submitted together
+type BatchHandle struct {
+	futures   []*Future
+	completed atomic.Int64
+	failed    atomic.Int64
+	done      chan struct{}
+	mu        sync.Mutex
+	errs      []error
+}
+
+// SubmitBatch enqueues every task in tasks in one step and returns a handle
+// tracking them as a group
+func (c *poolCore) SubmitBatch(tasks []Task) *BatchHandle {
+	b := &BatchHandle{
+		futures: make([]*Future, len(tasks)),
+		done:    make(chan struct{}),
+	}
+	if len(tasks) == 0 {
+		close(b.done)
+		return b
+	}
+
+	jobs := make([]*job, len(tasks))
+	for i, task := range tasks {
+		j := c.newJob(context.Background(), task.run)
+		j.onDone = func() { b.finish(i, j.future.Err()) }
+		jobs[i] = j
+		b.futures[i] = j.future
+	}
+	c.dispatchBatch(jobs)
+	return b
+}
+
+// finish records the outcome of the i-th task of the batch
+func (b *BatchHandle) finish(i int, err error) {
+	if err != nil {
+		b.failed.Add(1)
+		b.mu.Lock()
+		b.errs = append(b.errs, fmt.Errorf("batch task %d: %w", i, err))
+		b.mu.Unlock()
+	}
+	if b.completed.Add(1) == int64(len(b.futures)) {
+		close(b.done)
+	}
+}
+
+// Wait blocks until every task of the batch has finished and returns their
+// errors joined together
+func (b *BatchHandle) Wait() error {
+	<-b.done
+	return b.Err()
+}
+
+// Done returns a channel that is closed once every task has finished
+func (b *BatchHandle) Done() <-chan struct{} {
+	return b.done
+}
+
+// Err returns the errors of the tasks that have failed so far
+func (b *BatchHandle) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return errors.Join(b.errs...)
+}
+
+// Total returns the number of tasks in the batch
+func (b *BatchHandle) Total() int {
+	return len(b.futures)
+}
+
+// Completed returns the number of tasks that have finished, successfully or not
+func (b *BatchHandle) Completed() int {
+	return int(b.completed.Load())
+}
+
+// Failed returns the number of tasks that have failed
+func (b *BatchHandle) Failed() int {
+	return int(b.failed.Load())
+}
+
+// Futures returns the per-task futures in submission order
+func (b *BatchHandle) Futures() []*Future {
+	return b.futures
+}
@@ -0,0 +1,259 @@
+package taskqueue
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// breakerBuckets is how many slices a circuit breaker's failure window is
+// counted in; older slices drop out of the window as a whole
+const breakerBuckets = 10
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through while counting failures
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every call until the cooldown has passed
+	BreakerOpen
+	// BreakerHalfOpen lets a few probe calls through to decide whether to
+	// close again
+	BreakerHalfOpen
+)
+
+// String returns the state name
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// BreakerConfig configures a CircuitBreaker
+type BreakerConfig struct {
+	// Window is how far back calls count towards the failure rate; defaults
+	// to 10s
+	Window time.Duration
+	// MinCalls is how many calls the window must hold before the breaker may
+	// open, so that a couple of early failures do not trip it; defaults to 5
+	MinCalls int
+	// FailureRate is the fraction of failed calls in the window that opens
+	// the breaker; defaults to 0.5
+	FailureRate float64
+	// OpenFor is how long the breaker stays open before probing; defaults to
+	// 5s
+	OpenFor time.Duration
+	// Probes is how many calls the half-open breaker lets through at once,
+	// all of which must succeed for it to close; defaults to 1
+	Probes int
+	// OnChange, if set, is called on every state change, outside the
+	// breaker's lock
+	OnChange func(name string, from, to BreakerState)
+}
+
+// withDefaults fills in the unset fields
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.Window <= 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.MinCalls <= 0 {
+		c.MinCalls = 5
+	}
+	if c.FailureRate <= 0 {
+		c.FailureRate = 0.5
+	}
+	if c.OpenFor <= 0 {
+		c.OpenFor = 5 * time.Second
+	}
+	if c.Probes <= 0 {
+		c.Probes = 1
+	}
+	return c
+}
+
+// breakerBucket counts the outcomes of one slice of the window
+type breakerBucket struct {
+	slice     int64
+	successes int
+	failures  int
+}
+
+// CircuitBreaker stops calls to a failing dependency for a while instead of
+// letting every caller wait for it to fail again. Closed, it counts the
+// outcomes of recent calls and opens once too many failed; open, it rejects
+// calls with ErrCircuitOpen for the cooldown; half-open, it lets a few probe
+// calls through and closes if they all succeed or opens again on the first
+// failure. It is safe for concurrent use
+type CircuitBreaker struct {
+	name string
+	cfg  BreakerConfig
+
+	mu      sync.Mutex
+	state   BreakerState
+	opened  time.Time
+	buckets [breakerBuckets]breakerBucket
+	// generation counts state changes, so that the outcome of a call let
+	// through in an earlier state is ignored
+	generation uint64
+	probing    int
+	probed     int
+}
+
+// NewCircuitBreaker creates a closed breaker; name identifies it to OnChange
+func NewCircuitBreaker(name string, cfg BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{name: name, cfg: cfg.withDefaults()}
+}
+
+// State returns the current state
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	state, change := b.refresh(time.Now())
+	b.mu.Unlock()
+	b.changed(change)
+	return state
+}
+
+// Ready reports whether Allow would let a call through, without reserving a
+// probe
+func (b *CircuitBreaker) Ready() bool {
+	b.mu.Lock()
+	state, change := b.refresh(time.Now())
+	ready := state == BreakerClosed || state == BreakerHalfOpen && b.probing < b.cfg.Probes
+	b.mu.Unlock()
+	b.changed(change)
+	return ready
+}
+
+// Allow lets a call through, or fails with ErrCircuitOpen. The caller must
+// report the call's outcome to done exactly once
+func (b *CircuitBreaker) Allow() (done func(success bool), err error) {
+	b.mu.Lock()
+	state, change := b.refresh(time.Now())
+	switch {
+	case state == BreakerOpen, state == BreakerHalfOpen && b.probing >= b.cfg.Probes:
+		b.mu.Unlock()
+		b.changed(change)
+		return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, b.name)
+	case state == BreakerHalfOpen:
+		b.probing++
+	}
+	generation := b.generation
+	b.mu.Unlock()
+	b.changed(change)
+
+	var once sync.Once
+	return func(success bool) {
+		once.Do(func() { b.record(generation, success) })
+	}, nil
+}
+
+// Do runs fn if the breaker allows it, counting an error as a failure
+func (b *CircuitBreaker) Do(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err == nil)
+	return err
+}
+
+// record counts the outcome of a call let through in the given generation
+func (b *CircuitBreaker) record(generation uint64, success bool) {
+	b.mu.Lock()
+	if generation != b.generation {
+		b.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	var change *breakerChange
+	switch b.state {
+	case BreakerClosed:
+		bucket := b.bucket(now)
+		if success {
+			bucket.successes++
+		} else {
+			bucket.failures++
+		}
+		successes, failures := b.counts(now)
+		if total := successes + failures; total >= b.cfg.MinCalls && float64(failures) >= b.cfg.FailureRate*float64(total) {
+			change = b.transition(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		b.probing--
+		if !success {
+			change = b.transition(BreakerOpen, now)
+		} else if b.probed++; b.probed >= b.cfg.Probes {
+			change = b.transition(BreakerClosed, now)
+		}
+	}
+	b.mu.Unlock()
+	b.changed(change)
+}
+
+// bucket returns the bucket counting calls at now, clearing it if it last
+// counted an earlier slice; b.mu must be held
+func (b *CircuitBreaker) bucket(now time.Time) *breakerBucket {
+	slice := now.UnixNano() / int64(b.cfg.Window/breakerBuckets)
+	bucket := &b.buckets[slice%breakerBuckets]
+	if bucket.slice != slice {
+		*bucket = breakerBucket{slice: slice}
+	}
+	return bucket
+}
+
+// counts sums the outcomes in the window ending at now; b.mu must be held
+func (b *CircuitBreaker) counts(now time.Time) (successes, failures int) {
+	slice := now.UnixNano() / int64(b.cfg.Window/breakerBuckets)
+	for _, bucket := range b.buckets {
+		if slice-bucket.slice < breakerBuckets {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+	return successes, failures
+}
+
+// breakerChange is a state change to report to OnChange
+type breakerChange struct {
+	from, to BreakerState
+}
+
+// refresh half-opens the breaker once its cooldown has passed and returns
+// the current state; b.mu must be held
+func (b *CircuitBreaker) refresh(now time.Time) (BreakerState, *breakerChange) {
+	if b.state == BreakerOpen && now.Sub(b.opened) >= b.cfg.OpenFor {
+		return BreakerHalfOpen, b.transition(BreakerHalfOpen, now)
+	}
+	return b.state, nil
+}
+
+// transition moves the breaker to state; b.mu must be held
+func (b *CircuitBreaker) transition(state BreakerState, now time.Time) *breakerChange {
+	change := &breakerChange{from: b.state, to: state}
+	b.state = state
+	b.generation++
+	b.probing, b.probed = 0, 0
+	switch state {
+	case BreakerOpen:
+		b.opened = now
+	case BreakerClosed:
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+	return change
+}
+
+// changed reports change, if any, to OnChange
+func (b *CircuitBreaker) changed(change *breakerChange) {
+	if change != nil && b.cfg.OnChange != nil {
+		b.cfg.OnChange(b.name, change.from, change.to)
+	}
+}
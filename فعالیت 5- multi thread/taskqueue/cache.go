@@ -0,0 +1,334 @@
+package taskqueue
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats counts the outcomes of a cache's lookups and removals
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	// Evictions counts entries dropped to make room
+	Evictions int64
+	// Expirations counts entries dropped because their TTL ran out
+	Expirations int64
+	// Invalidations counts entries dropped because another node changed them
+	Invalidations int64
+}
+
+// HitRatio returns the fraction of lookups that hit, or 0 before any lookup
+func (s CacheStats) HitRatio() float64 {
+	if total := s.Hits + s.Misses; total > 0 {
+		return float64(s.Hits) / float64(total)
+	}
+	return 0
+}
+
+// cacheEntry is an element of an LRUCache's recency list
+type cacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time // zero for an entry that does not expire
+}
+
+// LRUCache is a bounded in-memory cache that evicts the least recently used
+// entry when full. Entries may also expire after a TTL; expired entries are
+// dropped when they are next looked up or reach the end of the list. It is
+// safe for concurrent use
+type LRUCache struct {
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+
+	hits, misses, evictions, expirations, invalidations atomic.Int64
+}
+
+// NewLRUCache creates a cache holding up to capacity entries, which expire
+// ttl after they are set; zero ttl keeps them until evicted
+func NewLRUCache(capacity int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		capacity: max(capacity, 1),
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the value cached under key and marks it recently used
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && c.expired(el) {
+		c.remove(el)
+		c.expirations.Add(1)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+// Set caches value under key with the cache's TTL
+func (c *LRUCache) Set(key string, value []byte) {
+	c.SetTTL(key, value, c.ttl)
+}
+
+// SetTTL caches value under key, expiring after ttl unless it is zero
+func (c *LRUCache) SetTTL(key string, value []byte, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.remove(oldest)
+		if c.expired(oldest) {
+			c.expirations.Add(1)
+		} else {
+			c.evictions.Add(1)
+		}
+	}
+}
+
+// Delete drops key, reporting whether it was cached
+func (c *LRUCache) Delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok {
+		c.remove(el)
+	}
+	return ok
+}
+
+// invalidate drops key on behalf of another node
+func (c *LRUCache) invalidate(key string) {
+	if c.Delete(key) {
+		c.invalidations.Add(1)
+	}
+}
+
+// Len returns the number of entries, counting expired ones not yet dropped
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Stats returns the cache's counters
+func (c *LRUCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Expirations:   c.expirations.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
+
+// expired reports whether el's TTL ran out; the caller holds c.mu
+func (c *LRUCache) expired(el *list.Element) bool {
+	e := el.Value.(*cacheEntry)
+	return !e.expires.IsZero() && !c.now().Before(e.expires)
+}
+
+// remove drops el; the caller holds c.mu
+func (c *LRUCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// CacheInvalidator tells the other nodes of a cluster which keys changed,
+// so that they drop their stale copies
+type CacheInvalidator interface {
+	// Invalidate announces that key changed on this node
+	Invalidate(ctx context.Context, key string) error
+	// Listen calls fn with every key another node invalidates until ctx is
+	// cancelled or the invalidator fails
+	Listen(ctx context.Context, fn func(key string)) error
+}
+
+// DistributedCache is a per-node LRUCache kept coherent across a cluster:
+// every Set and Delete invalidates the key on the other nodes, which then
+// miss and reload it. Invalidations are asynchronous, so another node may
+// serve its old value for as long as the invalidation takes to arrive; the
+// TTL bounds how stale a value can get if an invalidation is lost
+type DistributedCache struct {
+	local       *LRUCache
+	invalidator CacheInvalidator
+}
+
+// NewDistributedCache creates a cache over local, announcing changes through
+// invalidator; Run applies the other nodes' invalidations
+func NewDistributedCache(local *LRUCache, invalidator CacheInvalidator) *DistributedCache {
+	return &DistributedCache{local: local, invalidator: invalidator}
+}
+
+// Run drops the keys other nodes invalidate until ctx is cancelled
+func (c *DistributedCache) Run(ctx context.Context) error {
+	return c.invalidator.Listen(ctx, c.local.invalidate)
+}
+
+// Get returns the value this node caches under key
+func (c *DistributedCache) Get(key string) ([]byte, bool) {
+	return c.local.Get(key)
+}
+
+// GetOrLoad returns the value cached under key, loading and caching it on a
+// miss
+func (c *DistributedCache) GetOrLoad(ctx context.Context, key string, load func(ctx context.Context, key string) ([]byte, error)) ([]byte, error) {
+	if v, ok := c.local.Get(key); ok {
+		return v, nil
+	}
+	v, err := load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	c.local.Set(key, v)
+	return v, nil
+}
+
+// Set caches value under key here and invalidates it on the other nodes
+func (c *DistributedCache) Set(ctx context.Context, key string, value []byte) error {
+	c.local.Set(key, value)
+	return c.invalidator.Invalidate(ctx, key)
+}
+
+// Delete drops key here and on the other nodes
+func (c *DistributedCache) Delete(ctx context.Context, key string) error {
+	c.local.Delete(key)
+	return c.invalidator.Invalidate(ctx, key)
+}
+
+// Stats returns the counters of this node's cache
+func (c *DistributedCache) Stats() CacheStats {
+	return c.local.Stats()
+}
+
+// GossipConfig configures a GossipInvalidator
+type GossipConfig struct {
+	// Node names this node; invalidations carry it so nodes ignore their own
+	Node string
+	// Addr is the address the node receives invalidations on
+	Addr      string
+	Transport Transport
+	// Peers returns the addresses of the other nodes, for example the alive
+	// members of a membership.Group; see membership.AliveAddrs
+	Peers func() []string
+	// Fanout is how many random peers each node forwards an invalidation to
+	// the first time it sees it; defaults to 3
+	Fanout int
+	// Seen bounds how many recent invalidations a node remembers in order to
+	// forward each only once; defaults to 4096
+	Seen int
+}
+
+// GossipInvalidator spreads invalidations epidemically, without a broker: a
+// node sends each of its invalidations to a few random peers, and every node
+// forwards an invalidation it has not seen before to a few more, so it
+// reaches the cluster in a logarithmic number of rounds even as nodes come
+// and go
+type GossipInvalidator struct {
+	cfg GossipConfig
+	seq atomic.Uint64
+
+	mu   sync.Mutex
+	seen map[gossipID]bool
+	ring []gossipID // seen IDs, oldest first, to forget them in order
+}
+
+// gossipID identifies an invalidation by its origin and sequence number
+type gossipID struct {
+	node string
+	seq  uint64
+}
+
+// NewGossipInvalidator creates an invalidator; Listen starts receiving
+func NewGossipInvalidator(cfg GossipConfig) *GossipInvalidator {
+	if cfg.Fanout <= 0 {
+		cfg.Fanout = 3
+	}
+	if cfg.Seen <= 0 {
+		cfg.Seen = 4096
+	}
+	return &GossipInvalidator{cfg: cfg, seen: make(map[gossipID]bool)}
+}
+
+// Invalidate implements CacheInvalidator, gossiping key to Fanout peers
+func (g *GossipInvalidator) Invalidate(ctx context.Context, key string) error {
+	m := &Message{Type: MsgInvalidate, Worker: g.cfg.Node, ID: g.seq.Add(1), Key: key}
+	g.markSeen(gossipID{node: m.Worker, seq: m.ID})
+	return g.forward(ctx, m)
+}
+
+// Listen implements CacheInvalidator, receiving and forwarding invalidations
+// on the configured address
+func (g *GossipInvalidator) Listen(ctx context.Context, fn func(key string)) error {
+	return ServeRequests(ctx, g.cfg.Transport, g.cfg.Addr, func(ctx context.Context, conn Conn, m *Message) {
+		if m.Type != MsgInvalidate || !g.markSeen(gossipID{node: m.Worker, seq: m.ID}) {
+			return
+		}
+		if m.Worker != g.cfg.Node {
+			fn(m.Key)
+		}
+		g.forward(ctx, m)
+	})
+}
+
+// markSeen records id, reporting whether it is new
+func (g *GossipInvalidator) markSeen(id gossipID) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.seen[id] {
+		return false
+	}
+	g.seen[id] = true
+	g.ring = append(g.ring, id)
+	if len(g.ring) > g.cfg.Seen {
+		delete(g.seen, g.ring[0])
+		g.ring = g.ring[1:]
+	}
+	return true
+}
+
+// forward sends m to Fanout random peers, failing only if none received it
+func (g *GossipInvalidator) forward(ctx context.Context, m *Message) error {
+	peers := g.cfg.Peers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	peers = peers[:min(len(peers), g.cfg.Fanout)]
+	var errs []error
+	for _, addr := range peers {
+		if _, err := RoundTrip(ctx, g.cfg.Transport, addr, m, false, time.Second); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(peers) > 0 && len(errs) == len(peers) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
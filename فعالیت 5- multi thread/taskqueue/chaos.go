@@ -0,0 +1,299 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChaosConfig configures a ChaosMonkey
+type ChaosConfig struct {
+	// Interval is the mean time between kills, which are spaced
+	// exponentially like independent failures; 1s by default
+	Interval time.Duration
+	// MinDowntime and MaxDowntime bound how long a killed member stays down
+	// before it is restarted, 100ms to 1s by default. A member that stops on
+	// its own is restarted after MinDowntime
+	MinDowntime, MaxDowntime time.Duration
+	// MaxDown is the most members down at once, 1 by default, so the
+	// system always keeps the others
+	MaxDown int
+	// Seed seeds the choice of victims and downtimes
+	Seed uint64
+	// OnEvent, if set, is called for every kill, exit and restart
+	OnEvent func(ChaosEvent)
+}
+
+// ChaosEvent is something a ChaosMonkey did or saw
+type ChaosEvent struct {
+	Member string
+	// Kind is "kill", "exit" when the member stopped on its own, or
+	// "restart"
+	Kind string
+	// Err is what the member's run returned, for kills and exits
+	Err error
+}
+
+// ChaosMonkey keeps a set of members running, such as worker nodes or
+// worker processes, while killing random ones and restarting them after a
+// while, so the failure handling around them is exercised all the time
+type ChaosMonkey struct {
+	config ChaosConfig
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	members []*chaosMember
+	down    int
+
+	kills, restarts atomic.Uint64
+}
+
+// chaosMember is a member of a ChaosMonkey's set
+type chaosMember struct {
+	name string
+	run  func(ctx context.Context) error
+	// cancel kills the current run, and downtime is how long the member
+	// stays down once it returns; both are set while it runs, guarded by
+	// the monkey's mu
+	cancel   context.CancelFunc
+	downtime time.Duration
+	killed   bool
+}
+
+// NewChaosMonkey creates a monkey with no members
+func NewChaosMonkey(cfg ChaosConfig) *ChaosMonkey {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.MinDowntime <= 0 {
+		cfg.MinDowntime = 100 * time.Millisecond
+	}
+	if cfg.MaxDowntime < cfg.MinDowntime {
+		cfg.MaxDowntime = max(time.Second, cfg.MinDowntime)
+	}
+	if cfg.MaxDown <= 0 {
+		cfg.MaxDown = 1
+	}
+	return &ChaosMonkey{config: cfg, rng: rand.New(rand.NewPCG(cfg.Seed, 0))}
+}
+
+// Add makes name a member that Run starts with run, which should run until
+// its context is cancelled. Killing the member cancels that context;
+// restarting it calls run again. Add must be called before Run
+func (m *ChaosMonkey) Add(name string, run func(ctx context.Context) error) {
+	m.members = append(m.members, &chaosMember{name: name, run: run})
+}
+
+// ChaosProcess returns a run function for Add that starts the program name
+// with args, its output going to the monkey's own, and kills it with
+// SIGKILL, as a crash would, when the member is killed
+func ChaosProcess(name string, args ...string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		return cmd.Run()
+	}
+}
+
+// Run starts every member and kills and restarts them until ctx is
+// cancelled, then stops them all and returns once they have
+func (m *ChaosMonkey) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, member := range m.members {
+		wg.Go(func() { m.supervise(ctx, member) })
+	}
+	defer wg.Wait()
+
+	timer := time.NewTimer(m.nextKill())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-timer.C:
+		}
+		m.killOne()
+		timer.Reset(m.nextKill())
+	}
+}
+
+// Kills returns how many members were killed
+func (m *ChaosMonkey) Kills() uint64 {
+	return m.kills.Load()
+}
+
+// Restarts returns how many members were restarted after a kill or exit
+func (m *ChaosMonkey) Restarts() uint64 {
+	return m.restarts.Load()
+}
+
+// nextKill draws the time until the next kill
+func (m *ChaosMonkey) nextKill() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Duration(m.rng.ExpFloat64() * float64(m.config.Interval))
+}
+
+// killOne cancels a random running member, unless MaxDown are down already
+func (m *ChaosMonkey) killOne() {
+	m.mu.Lock()
+	if m.down >= m.config.MaxDown {
+		m.mu.Unlock()
+		return
+	}
+	var up []*chaosMember
+	for _, member := range m.members {
+		if member.cancel != nil {
+			up = append(up, member)
+		}
+	}
+	if len(up) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	victim := up[m.rng.IntN(len(up))]
+	victim.killed = true
+	victim.downtime = m.config.MinDowntime + time.Duration(m.rng.Int64N(int64(m.config.MaxDowntime-m.config.MinDowntime)+1))
+	cancel := victim.cancel
+	victim.cancel = nil
+	m.down++
+	m.mu.Unlock()
+	m.kills.Add(1)
+	cancel()
+}
+
+// supervise runs member until ctx is cancelled, restarting it after every
+// kill or exit
+func (m *ChaosMonkey) supervise(ctx context.Context, member *chaosMember) {
+	for started := false; ; started = true {
+		if started {
+			m.restarts.Add(1)
+			m.event(ChaosEvent{Member: member.name, Kind: "restart"})
+		}
+		runCtx, cancel := context.WithCancel(ctx)
+		m.mu.Lock()
+		member.cancel, member.killed = cancel, false
+		member.downtime = m.config.MinDowntime
+		m.mu.Unlock()
+
+		err := member.run(runCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.mu.Lock()
+		killed, downtime := member.killed, member.downtime
+		if !killed {
+			// Stopped on its own; it counts as down until it restarts
+			member.cancel = nil
+			m.down++
+		}
+		m.mu.Unlock()
+		kind := "exit"
+		if killed {
+			kind = "kill"
+		}
+		m.event(ChaosEvent{Member: member.name, Kind: kind, Err: err})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(downtime):
+		}
+		m.mu.Lock()
+		m.down--
+		m.mu.Unlock()
+	}
+}
+
+// event reports e to the configured callback
+func (m *ChaosMonkey) event(e ChaosEvent) {
+	if m.config.OnEvent != nil {
+		m.config.OnEvent(e)
+	}
+}
+
+// SimulateChurn runs a coordinator and workers in-process workers on a
+// MemoryNetwork under a ChaosMonkey killing one worker every interval on
+// average, submits tasks tasks taking up to 50ms each and writes the outcome
+// to w. Every message fares as link sets. It fails unless every task
+// completes despite the churn: the tasks of killed workers must be
+// reassigned, and those whose results were lost in flight recovered by
+// their leases
+func SimulateChurn(w io.Writer, workers, tasks int, interval time.Duration, link MemoryLink, seed uint64) error {
+	if workers < 2 {
+		return fmt.Errorf("chaos: need at least 2 workers, got %d", workers)
+	}
+	network := NewMemoryNetwork()
+	network.SetLink("", "", link)
+	network.SetSeed(seed)
+	coord := NewCoordinator(WithLease(time.Second))
+	defer coord.Close()
+	l, err := network.Listen("coordinator")
+	if err != nil {
+		return err
+	}
+	go coord.Serve(l)
+
+	var executions atomic.Int64
+	monkey := NewChaosMonkey(ChaosConfig{Interval: interval, MaxDown: workers - 1, Seed: seed})
+	for i := range workers {
+		node := NewWorkerNode(fmt.Sprintf("worker-%d", i+1), 4, network)
+		node.Handle("work", func(ctx context.Context, payload []byte) ([]byte, error) {
+			executions.Add(1)
+			d, err := time.ParseDuration(string(payload))
+			if err != nil {
+				return nil, err
+			}
+			select {
+			case <-time.After(d):
+				return payload, nil
+			case <-ctx.Done():
+				return nil, context.Cause(ctx)
+			}
+		})
+		monkey.Add(fmt.Sprintf("worker-%d", i+1), func(ctx context.Context) error { return node.Run(ctx, "coordinator") })
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- monkey.Run(ctx) }()
+
+	rng := rand.New(rand.NewPCG(seed, 1))
+	start := time.Now()
+	futures := make([]*Future, tasks)
+	for i := range futures {
+		d := time.Duration(rng.Int64N(int64(50 * time.Millisecond)))
+		futures[i] = coord.Submit(ctx, "work", []byte(d.String()))
+	}
+	failed := 0
+	var firstErr error
+	for _, f := range futures {
+		if _, err := f.Get(); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	elapsed := time.Since(start)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("chaos: %d of %d tasks failed, first with %w", failed, tasks, firstErr)
+	}
+	fmt.Fprintf(w, "ok  %d tasks completed in %v while %d workers were killed %d times and restarted %d times\n",
+		tasks, elapsed.Round(time.Millisecond), workers, monkey.Kills(), monkey.Restarts())
+	fmt.Fprintf(w, "ok  %d redeliveries, %d executions for %d tasks\n", coord.Redeliveries(), executions.Load(), tasks)
+	return nil
+}
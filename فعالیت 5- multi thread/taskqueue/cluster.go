@@ -0,0 +1,463 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ClusterConfig configures a Cluster
+type ClusterConfig struct {
+	// Heartbeat is the failure detector of every coordinator, which is how
+	// a coordinator notices that a worker crashed; its Interval, 50ms by
+	// default, is also how often workers send heartbeats
+	Heartbeat HeartbeatConfig
+	// Redial is how long a worker waits before connecting to its
+	// coordinator again after losing it, 20ms by default
+	Redial time.Duration
+	// Logger, if set, receives the log of every node, a coordinator's with
+	// its name under LogKeyNode
+	Logger *slog.Logger
+}
+
+// Cluster runs coordinator and worker nodes in one process over a
+// MemoryNetwork, each on a host of its own name, for tests and demos of
+// the distributed pieces. Nodes are declared with AddCoordinator and
+// AddWorker, then started, stopped, crashed and restarted by name; every
+// start creates the node afresh, as a new process would, so only what its
+// options keep, such as a TaskLog, survives. Workers connect to their
+// coordinator again whenever they lose it. It is safe for concurrent use
+type Cluster struct {
+	network *MemoryNetwork
+	config  ClusterConfig
+
+	mu       sync.Mutex
+	nodes    map[string]*clusterNode
+	names    []string
+	handlers map[string]Handler
+}
+
+// clusterNode is a node of a Cluster and its current incarnation
+type clusterNode struct {
+	name string
+	// coordinatorOpts configure a coordinator node; a worker node has the
+	// coordinator it connects to, its capacity and pool options instead
+	coordinator     bool
+	coordinatorOpts []CoordinatorOption
+	connectTo       string
+	capacity        int
+	workerOpts      []Option
+
+	// The current incarnation, set while the node runs
+	coord  *Coordinator
+	worker *WorkerNode
+	cancel context.CancelFunc
+	done   chan struct{}
+	starts int
+}
+
+// NewCluster creates a cluster with no nodes on a network of its own
+func NewCluster(config ClusterConfig) *Cluster {
+	if config.Heartbeat.Interval <= 0 {
+		config.Heartbeat.Interval = 50 * time.Millisecond
+	}
+	if config.Redial <= 0 {
+		config.Redial = 20 * time.Millisecond
+	}
+	return &Cluster{
+		network:  NewMemoryNetwork(),
+		config:   config,
+		nodes:    make(map[string]*clusterNode),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Network returns the network the nodes run on, to partition them or set
+// the links between them
+func (c *Cluster) Network() *MemoryNetwork {
+	return c.network
+}
+
+// AddCoordinator declares a coordinator node, which listens on the address
+// name; opts follow the cluster's failure detector and so override it
+func (c *Cluster) AddCoordinator(name string, opts ...CoordinatorOption) error {
+	return c.add(&clusterNode{name: name, coordinator: true, coordinatorOpts: opts})
+}
+
+// AddWorker declares a worker node running up to capacity tasks at once
+// for the coordinator node coordinator; opts configure its local pool
+func (c *Cluster) AddWorker(name, coordinator string, capacity int, opts ...Option) error {
+	return c.add(&clusterNode{name: name, connectTo: coordinator, capacity: capacity, workerOpts: opts})
+}
+
+// add declares n
+func (c *Cluster) add(n *clusterNode) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, taken := c.nodes[n.name]; taken {
+		return fmt.Errorf("cluster: node %q already exists", n.name)
+	}
+	c.nodes[n.name] = n
+	c.names = append(c.names, n.name)
+	return nil
+}
+
+// Handle registers h for tasks submitted under name on every worker,
+// from their next start on
+func (c *Cluster) Handle(name string, h Handler) {
+	c.mu.Lock()
+	c.handlers[name] = h
+	c.mu.Unlock()
+}
+
+// Nodes returns the names of the nodes in the order they were added
+func (c *Cluster) Nodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.names)
+}
+
+// Coordinators returns the names of the coordinator nodes in the order
+// they were added
+func (c *Cluster) Coordinators() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for _, name := range c.names {
+		if c.nodes[name].coordinator {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Running reports whether the node name is running
+func (c *Cluster) Running(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nodes[name]
+	return ok && n.done != nil
+}
+
+// Coordinator returns the running incarnation of the coordinator node
+// name, or nil if it is not running
+func (c *Cluster) Coordinator(name string) *Coordinator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.nodes[name]; ok {
+		return n.coord
+	}
+	return nil
+}
+
+// Worker returns the running incarnation of the worker node name, or nil
+// if it is not running
+func (c *Cluster) Worker(name string) *WorkerNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.nodes[name]; ok {
+		return n.worker
+	}
+	return nil
+}
+
+// node returns the node name; c.mu must be held
+func (c *Cluster) node(name string) (*clusterNode, error) {
+	n, ok := c.nodes[name]
+	if !ok {
+		return nil, fmt.Errorf("cluster: no node %q", name)
+	}
+	return n, nil
+}
+
+// StartAll starts every node that is not running, coordinators first
+func (c *Cluster) StartAll() error {
+	names := c.Nodes()
+	for _, coordinators := range []bool{true, false} {
+		for _, name := range names {
+			c.mu.Lock()
+			n := c.nodes[name]
+			skip := n.coordinator != coordinators || n.done != nil
+			c.mu.Unlock()
+			if skip {
+				continue
+			}
+			if err := c.Start(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Start starts a new incarnation of the node name
+func (c *Cluster) Start(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.node(name)
+	if err != nil {
+		return err
+	}
+	if n.done != nil {
+		return fmt.Errorf("cluster: node %q is already running", name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	host := c.network.Host(name)
+	if n.coordinator {
+		l, err := host.Listen(name)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("cluster: start %s: %w", name, err)
+		}
+		opts := []CoordinatorOption{WithHeartbeat(c.config.Heartbeat)}
+		if c.config.Logger != nil {
+			opts = append(opts, WithCoordinatorLogger(c.config.Logger.With(LogKeyNode, name)))
+		}
+		coord := NewCoordinator(append(opts, n.coordinatorOpts...)...)
+		go coord.Serve(l)
+		go func() {
+			<-ctx.Done()
+			coord.Close()
+			close(done)
+		}()
+		n.coord = coord
+	} else {
+		worker := NewWorkerNode(name, n.capacity, host, n.workerOpts...)
+		worker.HeartbeatEvery(c.config.Heartbeat.Interval)
+		if c.config.Logger != nil {
+			worker.SetLogger(c.config.Logger)
+		}
+		for task, h := range c.handlers {
+			worker.Handle(task, h)
+		}
+		go func() {
+			defer close(done)
+			for ctx.Err() == nil {
+				worker.Run(ctx, n.connectTo)
+				select {
+				case <-ctx.Done():
+				case <-time.After(c.config.Redial):
+				}
+			}
+		}()
+		n.worker = worker
+	}
+	n.cancel, n.done = cancel, done
+	n.starts++
+	return nil
+}
+
+// Stop shuts the node name down in an orderly way: its connections close,
+// so its peers learn at once that it left
+func (c *Cluster) Stop(name string) error {
+	return c.halt(name, false)
+}
+
+// Crash stops the node name as if its machine failed: its host goes down
+// first, so its peers only hear its connections fall silent, and stays
+// down until Restart
+func (c *Cluster) Crash(name string) error {
+	return c.halt(name, true)
+}
+
+// halt ends the current incarnation of the node name, crashing its host
+// first if crash is set
+func (c *Cluster) halt(name string, crash bool) error {
+	c.mu.Lock()
+	n, err := c.node(name)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if n.done == nil {
+		c.mu.Unlock()
+		return fmt.Errorf("cluster: node %q is not running", name)
+	}
+	cancel, done := n.cancel, n.done
+	n.coord, n.worker, n.cancel, n.done = nil, nil, nil, nil
+	c.mu.Unlock()
+
+	if crash {
+		c.network.Crash(name)
+	}
+	cancel()
+	<-done
+	return nil
+}
+
+// Restart brings the node name back with a new incarnation, restoring its
+// host if it crashed; a running node is stopped first
+func (c *Cluster) Restart(name string) error {
+	if c.Running(name) {
+		if err := c.Stop(name); err != nil {
+			return err
+		}
+	}
+	c.network.Restore(name)
+	return c.Start(name)
+}
+
+// Starts returns how many times the node name has been started
+func (c *Cluster) Starts(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n, ok := c.nodes[name]; ok {
+		return n.starts
+	}
+	return 0
+}
+
+// WaitForWorkers waits until the coordinator node name is running with
+// every running worker node that connects to it registered
+func (c *Cluster) WaitForWorkers(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := c.workersRegistered(name)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("after %v: %w", timeout, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// workersRegistered reports the first running worker node connecting to
+// the coordinator node name that has not registered with it
+func (c *Cluster) workersRegistered(name string) error {
+	coord := c.Coordinator(name)
+	if coord == nil {
+		return fmt.Errorf("cluster: coordinator %q is not running", name)
+	}
+	registered := coord.Workers()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.nodes {
+		if n.connectTo == name && n.done != nil && !slices.Contains(registered, n.name) {
+			return fmt.Errorf("cluster: worker %q has not registered with %q", n.name, name)
+		}
+	}
+	return nil
+}
+
+// Close stops every running node
+func (c *Cluster) Close() error {
+	var errs []error
+	for _, name := range c.Nodes() {
+		if c.Running(name) {
+			errs = append(errs, c.Stop(name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SimulateCluster runs a coordinator and workers workers in a Cluster,
+// seeded with seed, and writes each step to w: a batch of tasks runs while
+// one worker crashes and another is stopped, both coming back midway, and
+// a second batch runs after the coordinator itself crashes and restarts,
+// which the workers must find again. Every task of both batches must
+// complete
+func SimulateCluster(w io.Writer, workers, tasks int, seed uint64) error {
+	if workers < 2 {
+		return fmt.Errorf("cluster: need at least 2 workers, got %d", workers)
+	}
+	cluster := NewCluster(ClusterConfig{Logger: slog.Default()})
+	defer cluster.Close()
+	log := func(format string, args ...any) {
+		fmt.Fprintf(w, "--  "+format+"\n", args...)
+	}
+
+	cluster.AddCoordinator("coordinator", WithLease(time.Second))
+	for i := range workers {
+		cluster.AddWorker(fmt.Sprintf("worker-%d", i+1), "coordinator", 4)
+	}
+	cluster.Handle("work", func(ctx context.Context, payload []byte) ([]byte, error) {
+		d, err := time.ParseDuration(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(d):
+			return payload, nil
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	})
+	if err := cluster.StartAll(); err != nil {
+		return err
+	}
+	if err := cluster.WaitForWorkers("coordinator", 5*time.Second); err != nil {
+		return err
+	}
+	log("started %v", cluster.Nodes())
+
+	rng := rand.New(rand.NewPCG(seed, 0))
+	batch := func() error {
+		coord := cluster.Coordinator("coordinator")
+		futures := make([]*Future, tasks)
+		for i := range futures {
+			d := time.Duration(rng.Int64N(int64(20 * time.Millisecond)))
+			futures[i] = coord.Submit(context.Background(), "work", []byte(d.String()))
+		}
+		for i, f := range futures {
+			if _, err := f.Get(); err != nil {
+				return fmt.Errorf("cluster: task %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() { errc <- batch() }()
+	time.Sleep(50 * time.Millisecond)
+	for _, step := range []struct {
+		what string
+		do   func(string) error
+		node string
+	}{
+		{"crash", cluster.Crash, "worker-1"},
+		{"stop", cluster.Stop, "worker-2"},
+		{"restart", cluster.Restart, "worker-1"},
+		{"restart", cluster.Restart, "worker-2"},
+	} {
+		if err := step.do(step.node); err != nil {
+			return err
+		}
+		log("%s %s", step.what, step.node)
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "ok  %d tasks completed in %v across a worker crash and a worker stop, %d redeliveries\n",
+		tasks, time.Since(start).Round(time.Millisecond), cluster.Coordinator("coordinator").Redeliveries())
+
+	if err := cluster.Crash("coordinator"); err != nil {
+		return err
+	}
+	log("crash coordinator")
+	time.Sleep(100 * time.Millisecond)
+	if err := cluster.Restart("coordinator"); err != nil {
+		return err
+	}
+	log("restart coordinator")
+	if err := cluster.WaitForWorkers("coordinator", 5*time.Second); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "ok  all %d workers registered with the restarted coordinator\n", workers)
+	start = time.Now()
+	if err := batch(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "ok  %d more tasks completed in %v\n", tasks, time.Since(start).Round(time.Millisecond))
+	return nil
+}
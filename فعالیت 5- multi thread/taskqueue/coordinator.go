@@ -0,0 +1,1077 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"multithread/hashring"
+)
+
+// Coordinator queues remote tasks and dispatches them to the workers that
+// register with it, each receiving at most as many tasks as its capacity.
+// A task leaves the coordinator once a worker acknowledges it with a result;
+// a nacked task is queued again, and the tasks a lost or dead worker owned,
+// or that outlived their lease, are reassigned ahead of the queued ones
+type Coordinator struct {
+	config      coordinatorConfig
+	mu          sync.Mutex
+	cond        *sync.Cond
+	queue       []*remoteTask
+	workers     map[string]*workerConn
+	breakers    map[string]*CircuitBreaker
+	listeners   []Listener
+	recovered   []*Future
+	dedup       *dedupStore
+	heartbeats  HeartbeatStats
+	done        chan struct{}
+	nextID      uint64
+	redelivered uint64
+	draining    bool
+	closed      bool
+	log         *slog.Logger
+	// queueWait, execution and endToEnd are the histograms Latencies returns
+	queueWait Histogram
+	execution Histogram
+	endToEnd  Histogram
+}
+
+// remoteTask is a task waiting for, or running on, a remote worker
+type remoteTask struct {
+	id      uint64
+	key     string // idempotency key
+	route   string // routing key
+	name    string
+	payload []byte
+	ctx     context.Context
+	future  *Future
+	// correlation ties together the log lines of the task wherever it runs
+	correlation string
+	// submitted is when the task was queued first, on this coordinator
+	submitted time.Time
+
+	// Guarded by Coordinator.mu
+	redeliveries int
+	queued       time.Time // when its current wait in the queue began
+	dispatched   time.Time // when its current delivery began
+	lease        *time.Timer
+	picked       string
+	outcome      func(success bool) // reports the delivery to its worker's breaker
+	span         Span               // the task, under WithTracerProvider
+	phase        Span               // its current wait in the queue or delivery
+}
+
+// workerConn is the coordinator's view of one registered worker
+type workerConn struct {
+	id      string
+	conn    Conn
+	breaker *CircuitBreaker
+	slots   *semaphore
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+
+	// Guarded by Coordinator.mu
+	capacity int // changed by MsgCapacity, as slots is
+	inflight map[uint64]*remoteTask
+	lastSeen time.Time
+	state    WorkerState
+	waiting  bool // its dispatcher has a free slot and waits in next
+	draining bool // it sent MsgDrain and takes no more tasks
+}
+
+// CoordinatorOption configures a Coordinator at construction time
+type CoordinatorOption func(*coordinatorConfig)
+
+// coordinatorConfig collects the coordinator settings
+type coordinatorConfig struct {
+	log             *TaskLog
+	lease           time.Duration
+	maxRedeliveries int
+	atMostOnce      bool
+	dedupTTL        time.Duration
+	heartbeat       HeartbeatConfig
+	ring            *hashring.Ring
+	picker          Picker
+	breaker         *BreakerConfig
+	tracer          Tracer
+	tokens          TokenVerifier
+	logger          *slog.Logger
+}
+
+// WithTaskLog makes the coordinator log every task to l before accepting it
+// and requeue the tasks l recorded as unfinished
+func WithTaskLog(l *TaskLog) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.log = l
+	}
+}
+
+// WithLease gives each dispatched task d to be acknowledged before it is
+// cancelled on its worker and reassigned, which catches workers that hang
+// without disconnecting
+func WithLease(d time.Duration) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.lease = d
+	}
+}
+
+// WithMaxRedeliveries fails a task with ErrRedeliveryLimit instead of
+// redelivering it once it has been redelivered n times
+func WithMaxRedeliveries(n int) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.maxRedeliveries = n
+	}
+}
+
+// WithAtMostOnce fails the tasks of a lost worker with ErrWorkerLost instead
+// of reassigning them, for handlers that must not run twice; a worker
+// declared dead may still have been running them
+func WithAtMostOnce() CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.atMostOnce = true
+	}
+}
+
+// WithKeyRouting sends every task submitted with SubmitKeyed to the worker that
+// owns the key on a consistent hashing ring of the connected workers, placing
+// vnodes virtual nodes per worker, so tasks for the same key land on the same
+// worker and only the keys of a joining or leaving worker move. While the
+// owner is suspect the next worker on the ring takes its keys
+func WithKeyRouting(vnodes int) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.ring = hashring.New(vnodes)
+	}
+}
+
+// WithPicker lets p choose which of the workers with a free slot takes each
+// task, instead of the first worker to ask for one. Routed tasks under
+// WithKeyRouting still go to their owner
+func WithPicker(p Picker) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.picker = p
+	}
+}
+
+// WithCircuitBreaker gives every worker a circuit breaker configured by cfg,
+// which counts a delivery that returned a result as a success and one that
+// failed, was nacked, outlived its lease or was lost with its worker as a
+// failure. A worker whose breaker is open gets no new tasks until it is
+// probed, and keeps its breaker when it reconnects, so a flapping worker is
+// shut out for the cooldown. OnChange is called on a goroutine of its own
+func WithCircuitBreaker(cfg BreakerConfig) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.breaker = &cfg
+	}
+}
+
+// WithTracerProvider traces every submitted task with a tracer from tp: a
+// span for the task, a child of the span in the submitter's context, covers
+// it from submission until its future completes, with a child span for each
+// wait in the queue and each delivery to a worker. Dispatches carry the
+// delivery span's context, under which a worker with a tracer of its own
+// records the task's execution and acknowledgement
+func WithTracerProvider(tp TracerProvider) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.tracer = tracerOf(tp, "coordinator")
+	}
+}
+
+// WithTokenAuth requires tokens v accepts: workers must register with one
+// granting ScopeWorker, and clients of a GRPCServer in front of the
+// coordinator must send one granting ScopeSubmit. A rejected worker is told
+// why in a register message carrying the error before it is disconnected
+func WithTokenAuth(v TokenVerifier) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.tokens = v
+	}
+}
+
+// WithCoordinatorLogger makes the coordinator log to l as component
+// "coordinator": workers registering and being lost at info and warn,
+// expired leases at warn, and tasks being dispatched and redelivered at
+// debug, with the worker under LogKeyWorker and the task ID under
+// LogKeyTask. Give l a LogKeyNode attribute to tell coordinators apart
+func WithCoordinatorLogger(l *slog.Logger) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.logger = l
+	}
+}
+
+// NewCoordinator creates a coordinator with no workers
+func NewCoordinator(opts ...CoordinatorOption) *Coordinator {
+	c := &Coordinator{
+		config:   coordinatorConfig{dedupTTL: defaultDedupTTL},
+		workers:  make(map[string]*workerConn),
+		breakers: make(map[string]*CircuitBreaker),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.dedup = newDedupStore(c.config.dedupTTL)
+	c.log = ComponentLogger(c.config.logger, "coordinator")
+	if c.config.heartbeat.Interval > 0 {
+		go c.monitor()
+	}
+
+	if l := c.config.log; l != nil {
+		c.nextID = l.maxID
+		for _, m := range l.Pending() {
+			t := &remoteTask{
+				id: m.ID, key: m.Key, route: m.Route, correlation: m.Correlation, name: m.Task, payload: m.Payload,
+				ctx: context.Background(), future: newFuture(), submitted: time.Now(),
+			}
+			t.queued = t.submitted
+			if t.key != "" {
+				c.dedup.claim(t.key, t.future)
+			}
+			c.queue = append(c.queue, t)
+			c.recovered = append(c.recovered, t.future)
+			c.logCompletion(t)
+		}
+	}
+	return c
+}
+
+// Recovered returns the futures of the tasks replayed from the task log, in
+// their original submission order
+func (c *Coordinator) Recovered() []*Future {
+	return slices.Clone(c.recovered)
+}
+
+// logCompletion records t in the task log once it has a result or was
+// cancelled by its submitter; tasks failed only because the coordinator
+// closed or their worker was lost stay unfinished and are replayed
+func (c *Coordinator) logCompletion(t *remoteTask) {
+	go func() {
+		_, err := t.future.Get()
+		if errors.Is(err, ErrCoordinatorClosed) || errors.Is(err, ErrWorkerLost) {
+			return
+		}
+		c.config.log.logDone(t.id)
+	}()
+}
+
+// Serve accepts worker connections on l until l or the coordinator is closed
+func (c *Coordinator) Serve(l Listener) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		l.Close()
+		return ErrCoordinatorClosed
+	}
+	c.listeners = append(c.listeners, l)
+	c.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				return ErrCoordinatorClosed
+			}
+			return err
+		}
+		go c.handshake(conn)
+	}
+}
+
+// handshake waits for conn to register and then serves it as a worker
+func (c *Coordinator) handshake(conn Conn) {
+	m, err := conn.Recv()
+	if err != nil || m.Type != MsgRegister || m.Worker == "" {
+		conn.Close()
+		return
+	}
+	if err := c.authorize(m.Token, ScopeWorker); err != nil {
+		c.log.Warn("worker refused", LogKeyWorker, m.Worker, "error", err)
+		conn.Send(&Message{Type: MsgRegister, Error: err.Error()})
+		conn.Close()
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	w := &workerConn{
+		id:       m.Worker,
+		conn:     conn,
+		capacity: max(m.Capacity, 1),
+		slots:    newSemaphore(int64(max(m.Capacity, 1))),
+		ctx:      ctx,
+		cancel:   cancel,
+		inflight: make(map[uint64]*remoteTask),
+		lastSeen: time.Now(),
+	}
+
+	c.mu.Lock()
+	if _, taken := c.workers[w.id]; taken || c.closed {
+		c.mu.Unlock()
+		if taken {
+			c.log.Warn("worker refused", LogKeyWorker, w.id, "error", "already registered")
+		}
+		conn.Close()
+		return
+	}
+	c.workers[w.id] = w
+	if r := c.config.ring; r != nil {
+		r.Add(w.id)
+	}
+	if c.config.breaker != nil {
+		w.breaker = c.breakerFor(w.id)
+	}
+	c.mu.Unlock()
+	c.log.Info("worker registered", LogKeyWorker, w.id, "capacity", w.capacity)
+	c.notify(stateChange{w.id, WorkerAlive})
+
+	go c.dispatchTo(w)
+	c.receiveFrom(w)
+}
+
+// authorize checks that token grants scope, if the coordinator requires
+// tokens
+func (c *Coordinator) authorize(token, scope string) error {
+	if c.config.tokens == nil {
+		return nil
+	}
+	_, err := Authorize(c.config.tokens, token, scope)
+	return err
+}
+
+// breakerFor returns the circuit breaker of the worker with the given ID,
+// creating it on the worker's first connection; the caller holds c.mu
+func (c *Coordinator) breakerFor(id string) *CircuitBreaker {
+	if b, ok := c.breakers[id]; ok {
+		return b
+	}
+	cfg := *c.config.breaker
+	onChange := cfg.OnChange
+	cfg.OnChange = func(name string, from, to BreakerState) {
+		// Breakers change state under c.mu, and an open one must wake its
+		// worker's dispatcher once the cooldown has passed
+		if to == BreakerOpen {
+			time.AfterFunc(cfg.withDefaults().OpenFor, func() {
+				c.mu.Lock()
+				c.cond.Broadcast()
+				c.mu.Unlock()
+			})
+		}
+		if onChange != nil {
+			go onChange(name, from, to)
+		}
+	}
+	b := NewCircuitBreaker(id, cfg)
+	c.breakers[id] = b
+	return b
+}
+
+// BreakerStates returns the state of every worker's circuit breaker under
+// WithCircuitBreaker, including disconnected workers
+func (c *Coordinator) BreakerStates() map[string]BreakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make(map[string]BreakerState, len(c.breakers))
+	for id, b := range c.breakers {
+		states[id] = b.State()
+	}
+	return states
+}
+
+// Submit queues a call of the named handler with payload; the future holds
+// the handler's output as a []byte
+func (c *Coordinator) Submit(ctx context.Context, task string, payload []byte) *Future {
+	return c.submit(&remoteTask{name: task, payload: payload, ctx: ctx, future: newFuture()})
+}
+
+// SubmitKeyed is like Submit, but under WithKeyRouting the task goes to the
+// worker that owns key, with every other task submitted under key. Unlike
+// the key of SubmitIdempotent, key does not deduplicate the tasks
+func (c *Coordinator) SubmitKeyed(ctx context.Context, key, task string, payload []byte) *Future {
+	return c.submit(&remoteTask{route: key, name: task, payload: payload, ctx: ctx, future: newFuture()})
+}
+
+// submit assigns t an ID and a correlation ID, the one its context carries
+// if any, logs it and queues it
+func (c *Coordinator) submit(t *remoteTask) *Future {
+	c.mu.Lock()
+	if err := c.refusal(); err != nil {
+		c.mu.Unlock()
+		t.future.complete(nil, err)
+		return t.future
+	}
+	c.nextID++
+	t.id = c.nextID
+	t.submitted = time.Now()
+	c.mu.Unlock()
+	if t.correlation = CorrelationID(t.ctx); t.correlation == "" {
+		t.correlation = newCorrelationID()
+	}
+	if c.config.tracer != nil {
+		c.traceTask(t)
+	}
+
+	if l := c.config.log; l != nil {
+		if err := l.logSubmit(t.id, t.key, t.route, t.correlation, t.name, t.payload); err != nil {
+			t.future.complete(nil, err)
+			return t.future
+		}
+		c.logCompletion(t)
+	}
+
+	c.mu.Lock()
+	if err := c.refusal(); err != nil {
+		c.mu.Unlock()
+		t.future.complete(nil, err)
+		return t.future
+	}
+	t.queued = time.Now()
+	c.queue = append(c.queue, t)
+	c.startPhase(t, "queue")
+	c.mu.Unlock()
+	c.cond.Broadcast()
+
+	context.AfterFunc(t.ctx, func() { c.cancelTask(t) })
+	return t.future
+}
+
+// refusal returns the error new tasks fail with, nil while the coordinator
+// takes them; c.mu must be held
+func (c *Coordinator) refusal() error {
+	switch {
+	case c.closed:
+		return ErrCoordinatorClosed
+	case c.draining:
+		return ErrCoordinatorDraining
+	}
+	return nil
+}
+
+// traceTask starts the span of t, ending it with any phase still open once
+// t's future completes
+func (c *Coordinator) traceTask(t *remoteTask) {
+	t.ctx, t.span = c.config.tracer.Start(t.ctx, "task "+t.name)
+	t.span.SetAttributes(Attribute{"task.name", t.name}, Attribute{"task.id", strconv.FormatUint(t.id, 10)}, Attribute{"task.correlation", t.correlation})
+	go func() {
+		_, err := t.future.Get()
+		c.mu.Lock()
+		c.endPhase(t, err)
+		c.mu.Unlock()
+		t.span.RecordError(err)
+		t.span.End()
+	}()
+}
+
+// startPhase starts a span named name for the next phase of a traced task;
+// the caller holds c.mu
+func (c *Coordinator) startPhase(t *remoteTask, name string, attrs ...Attribute) {
+	if t.span == nil {
+		return
+	}
+	_, t.phase = c.config.tracer.Start(t.ctx, name)
+	t.phase.SetAttributes(append(attrs, Attribute{"task.redeliveries", strconv.Itoa(t.redeliveries)})...)
+}
+
+// endPhase ends the current phase of t, if any, as failed with err unless it
+// is nil; the caller holds c.mu
+func (c *Coordinator) endPhase(t *remoteTask, err error) {
+	if t.phase == nil {
+		return
+	}
+	t.phase.RecordError(err)
+	t.phase.End()
+	t.phase = nil
+}
+
+// cancelTask fails t once its context is done, telling its worker to stop
+// it if it was already dispatched
+func (c *Coordinator) cancelTask(t *remoteTask) {
+	c.mu.Lock()
+	var owner *workerConn
+	for _, w := range c.workers {
+		if w.inflight[t.id] == t {
+			owner = w
+			break
+		}
+	}
+	delivery := t.redeliveries
+	c.mu.Unlock()
+
+	t.future.complete(nil, context.Cause(t.ctx))
+	if owner != nil {
+		owner.conn.Send(&Message{Type: MsgCancel, ID: t.id, Redeliveries: delivery})
+	}
+}
+
+// dispatchTo sends queued tasks to w whenever it has a free slot
+func (c *Coordinator) dispatchTo(w *workerConn) {
+	for {
+		if err := w.slots.acquire(w.ctx, 1); err != nil {
+			return
+		}
+		t := c.next(w)
+		if t == nil {
+			return
+		}
+		if c.log.Enabled(t.ctx, slog.LevelDebug) {
+			c.log.Debug("task dispatched", LogKeyTask, t.id, LogKeyCorrelation, t.correlation, LogKeyWorker, w.id, "name", t.name)
+		}
+		if err := w.conn.Send(c.dispatchMessage(t)); err != nil {
+			c.drop(w, err)
+			return
+		}
+	}
+}
+
+// next blocks until a task is queued and assigns it to w; it returns nil
+// once w or the coordinator is closed
+func (c *Coordinator) next(w *workerConn) *remoteTask {
+	stop := context.AfterFunc(w.ctx, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.waiting = true
+	defer func() {
+		w.waiting = false
+		if c.config.picker != nil && len(c.queue) > 0 {
+			// Tasks picked for w need another pick
+			c.cond.Broadcast()
+		}
+	}()
+	for {
+		if c.closed || w.ctx.Err() != nil {
+			return nil
+		}
+		// Suspect workers and those with an open breaker wait without taking
+		// tasks, and keyed tasks wait for their owner, which is why queueing a
+		// task wakes every dispatcher rather than one
+		for i := 0; i < len(c.queue) && c.accepting(w); {
+			t := c.queue[i]
+			if t.ctx.Err() != nil {
+				c.queue = slices.Delete(c.queue, i, i+1)
+				continue
+			}
+			if !c.routesTo(t, w) {
+				i++
+				continue
+			}
+			c.queue = slices.Delete(c.queue, i, i+1)
+			w.inflight[t.id] = t
+			t.dispatched = time.Now()
+			c.queueWait.Record(t.dispatched.Sub(t.queued))
+			c.endPhase(t, nil)
+			c.startPhase(t, "dispatch", Attribute{"worker.id", w.id})
+			if w.breaker != nil {
+				// accepting checked that the breaker lets the task through
+				t.outcome, _ = w.breaker.Allow()
+			}
+			if d := c.config.lease; d > 0 {
+				delivery := t.redeliveries
+				t.lease = time.AfterFunc(d, func() { c.expire(w, t, delivery) })
+			}
+			return t
+		}
+		c.cond.Wait()
+	}
+}
+
+// accepting reports whether w may take a task: neither it nor the
+// coordinator is draining, it is not suspect and its breaker, if any, lets
+// the task through; the caller holds c.mu
+func (c *Coordinator) accepting(w *workerConn) bool {
+	return !c.draining && !w.draining && w.state != WorkerSuspect && (w.breaker == nil || w.breaker.Ready())
+}
+
+// routesTo reports whether w may take t: a routed task under WithKeyRouting
+// goes to the first worker on the ring for its key that is not suspect, any
+// other task to the worker the picker chose among those waiting for one, or
+// to any worker without WithPicker; the caller holds c.mu
+func (c *Coordinator) routesTo(t *remoteTask, w *workerConn) bool {
+	if r := c.config.ring; r != nil && t.route != "" {
+		for _, id := range r.GetN(t.route, r.Len()) {
+			if o, ok := c.workers[id]; ok && o.state != WorkerSuspect {
+				return o == w
+			}
+		}
+		return false
+	}
+	p := c.config.picker
+	if p == nil {
+		return true
+	}
+	// Keep the pick while the chosen worker still waits, so that it is made
+	// once per task rather than once per dispatcher scanning the queue
+	if o, ok := c.workers[t.picked]; !ok || !o.waiting || !c.accepting(o) {
+		candidates := c.candidates()
+		if len(candidates) == 0 {
+			// w is being dropped
+			return false
+		}
+		t.picked = candidates[p.Pick(candidates)].ID
+		if t.picked != w.id {
+			c.cond.Broadcast()
+		}
+	}
+	return t.picked == w.id
+}
+
+// candidates returns the workers a picker may choose from, sorted by ID; the
+// caller holds c.mu
+func (c *Coordinator) candidates() []Candidate {
+	var candidates []Candidate
+	for _, w := range c.workers {
+		if w.waiting && c.accepting(w) {
+			candidates = append(candidates, Candidate{ID: w.id, Capacity: w.capacity, Inflight: len(w.inflight)})
+		}
+	}
+	slices.SortFunc(candidates, func(a, b Candidate) int { return strings.Compare(a.ID, b.ID) })
+	return candidates
+}
+
+// dispatchMessage returns the message handing t to a worker
+func (c *Coordinator) dispatchMessage(t *remoteTask) *Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := &Message{Type: MsgDispatch, ID: t.id, Key: t.key, Task: t.name, Payload: t.payload, Redeliveries: t.redeliveries, Correlation: t.correlation, Route: t.route}
+	if t.phase != nil {
+		m.Trace = t.phase.SpanContext().Traceparent()
+	}
+	return m
+}
+
+// receiveFrom completes tasks with the results w sends back, and redelivers
+// the ones it nacks, until its connection fails
+func (c *Coordinator) receiveFrom(w *workerConn) {
+	for {
+		m, err := w.conn.Recv()
+		if err != nil {
+			c.drop(w, err)
+			return
+		}
+		if c.config.heartbeat.Interval > 0 {
+			c.heard(w)
+		}
+		if m.Type == MsgDrain {
+			c.mu.Lock()
+			c.stopDispatching(w)
+			c.mu.Unlock()
+			c.cond.Broadcast()
+			c.log.Info("worker draining", LogKeyWorker, w.id)
+			continue
+		}
+		if m.Type == MsgCapacity {
+			capacity := max(m.Capacity, 1)
+			c.mu.Lock()
+			w.capacity = capacity
+			c.mu.Unlock()
+			w.slots.resize(int64(capacity))
+			c.log.Info("worker capacity changed", LogKeyWorker, w.id, "capacity", capacity)
+			continue
+		}
+		if m.Type != MsgResult && m.Type != MsgNack {
+			continue
+		}
+
+		var failure error
+		if m.Type == MsgNack || m.Error != "" {
+			failure = &RemoteError{Worker: w.id, Message: m.Error}
+		}
+		t := c.release(w, m.ID, m.Redeliveries, failure)
+		if t == nil {
+			// Late reply for a delivery whose lease expired
+			continue
+		}
+		if c.log.Enabled(t.ctx, slog.LevelDebug) {
+			c.log.Debug("task reported", LogKeyTask, t.id, LogKeyCorrelation, t.correlation, LogKeyWorker, w.id, "type", m.Type, "error", m.Error)
+		}
+		if m.Type != MsgNack {
+			c.endToEnd.Record(time.Since(t.submitted))
+		}
+		switch {
+		case m.Type == MsgNack:
+			c.redeliver(t, failure, false)
+		case failure != nil:
+			t.future.complete(nil, failure)
+		default:
+			t.future.complete(m.Payload, nil)
+		}
+	}
+}
+
+// release ends w's delivery of the task with the given ID after the given
+// number of redeliveries, which failed with failure unless it is nil, and
+// frees its slot; it returns nil if w does not hold that delivery
+func (c *Coordinator) release(w *workerConn, id uint64, delivery int, failure error) *remoteTask {
+	c.mu.Lock()
+	t, ok := w.inflight[id]
+	ok = ok && t.redeliveries == delivery
+	if ok {
+		delete(w.inflight, id)
+		if t.lease != nil {
+			t.lease.Stop()
+		}
+		c.settle(t, failure)
+		// Only deliveries w reported on ran for as long as they took
+		var remote *RemoteError
+		if failure == nil || errors.As(failure, &remote) {
+			c.execution.Record(time.Since(t.dispatched))
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	w.slots.release(1)
+	return t
+}
+
+// settle reports the outcome of t's delivery, which failed with failure
+// unless it is nil, to its worker's breaker and its trace; the caller holds
+// c.mu
+func (c *Coordinator) settle(t *remoteTask, failure error) {
+	if t.outcome != nil {
+		// Neither a task its submitter cancelled nor a coordinator closing
+		// tells anything about the worker
+		t.outcome(failure == nil || t.ctx.Err() != nil || errors.Is(failure, ErrCoordinatorClosed))
+		t.outcome = nil
+	}
+	c.endPhase(t, failure)
+}
+
+// expire redelivers t if w still holds the delivery whose lease ran out
+func (c *Coordinator) expire(w *workerConn, t *remoteTask, delivery int) {
+	expired := fmt.Errorf("%w on worker %s", ErrLeaseExpired, w.id)
+	if c.release(w, t.id, delivery, expired) == nil {
+		return
+	}
+	c.log.Warn("lease expired", LogKeyTask, t.id, LogKeyCorrelation, t.correlation, LogKeyWorker, w.id)
+	w.conn.Send(&Message{Type: MsgCancel, ID: t.id, Redeliveries: delivery})
+	c.redeliver(t, expired, true)
+}
+
+// redeliver queues t again after cause ended its delivery, at the front of
+// the queue when it is being reassigned from a failed worker, or fails it with
+// ErrRedeliveryLimit once it has been redelivered the maximum number of times
+func (c *Coordinator) redeliver(t *remoteTask, cause error, reassign bool) {
+	select {
+	case <-t.future.Done():
+		// Already cancelled, or completed by an earlier delivery
+		return
+	default:
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		t.future.complete(nil, ErrCoordinatorClosed)
+		return
+	}
+	if limit := c.config.maxRedeliveries; limit > 0 && t.redeliveries >= limit {
+		n := t.redeliveries
+		c.mu.Unlock()
+		c.log.Warn("task failed: redelivery limit reached", LogKeyTask, t.id, LogKeyCorrelation, t.correlation, "redeliveries", n, "error", cause)
+		t.future.complete(nil, fmt.Errorf("%w after %d redeliveries: %w", ErrRedeliveryLimit, n, cause))
+		return
+	}
+	t.redeliveries++
+	c.redelivered++
+	if c.log.Enabled(t.ctx, slog.LevelDebug) {
+		c.log.Debug("task redelivered", LogKeyTask, t.id, LogKeyCorrelation, t.correlation, "redeliveries", t.redeliveries, "error", cause)
+	}
+	t.queued = time.Now()
+	if reassign {
+		c.queue = slices.Insert(c.queue, 0, t)
+	} else {
+		c.queue = append(c.queue, t)
+	}
+	c.startPhase(t, "queue")
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// drop disconnects w and reassigns the tasks it owned to the remaining
+// workers, or fails them under WithAtMostOnce
+func (c *Coordinator) drop(w *workerConn, err error) {
+	lost := fmt.Errorf("%w: %s: %w", ErrWorkerLost, w.id, err)
+	c.mu.Lock()
+	current := c.workers[w.id] == w
+	if current {
+		delete(c.workers, w.id)
+		w.state = WorkerDead
+		c.heartbeats.Dead++
+		if r := c.config.ring; r != nil {
+			// Queued tasks w owned have a new owner to wake
+			r.Remove(w.id)
+			c.cond.Broadcast()
+		}
+	}
+	inflight, draining := w.inflight, w.draining
+	w.inflight = make(map[uint64]*remoteTask)
+	for _, t := range inflight {
+		if t.lease != nil {
+			t.lease.Stop()
+		}
+		c.settle(t, lost)
+	}
+	c.mu.Unlock()
+
+	w.cancel(err)
+	w.conn.Close()
+	if current {
+		level := slog.LevelWarn
+		switch {
+		case errors.Is(err, ErrCoordinatorClosed):
+			level = slog.LevelDebug
+		case draining && len(inflight) == 0:
+			// It drained and left, as it said it would
+			level = slog.LevelInfo
+		}
+		c.log.Log(context.Background(), level, "worker lost", LogKeyWorker, w.id, "tasks", len(inflight), "error", err)
+		c.notify(stateChange{w.id, WorkerDead})
+	}
+	for _, t := range inflight {
+		if c.config.atMostOnce || errors.Is(err, ErrCoordinatorClosed) {
+			t.future.complete(nil, lost)
+		} else {
+			c.redeliver(t, lost, true)
+		}
+	}
+}
+
+// Workers returns the IDs of the connected workers
+func (c *Coordinator) Workers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.workers))
+	for id := range c.workers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Redeliveries returns the number of times a task was queued again after a
+// nack, an expired lease or the loss of its worker
+func (c *Coordinator) Redeliveries() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.redelivered
+}
+
+// QueueDepth returns the number of tasks waiting for a worker
+func (c *Coordinator) QueueDepth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+// Latencies returns the histograms of the coordinator's task latencies by
+// phase. A delivery executes from its dispatch until its worker reports on
+// it, so the execution time includes the round trip to the worker; a task
+// ends once a worker reports its outcome
+func (c *Coordinator) Latencies() LatencyHistograms {
+	return LatencyHistograms{QueueWait: &c.queueWait, Execution: &c.execution, EndToEnd: &c.endToEnd}
+}
+
+// Tasks returns the tasks waiting for a worker, in the order they will be
+// offered, and then those delivered to a worker that has not returned
+// their result
+func (c *Coordinator) Tasks() []TaskSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tasks := make([]TaskSnapshot, 0, len(c.queue))
+	for _, t := range c.queue {
+		tasks = append(tasks, TaskSnapshot{
+			ID: t.id, Name: t.name, Correlation: t.correlation, State: TaskQueued,
+			Enqueued: t.submitted, Attempt: t.redeliveries + 1,
+		})
+	}
+	for _, w := range c.workers {
+		for _, t := range w.inflight {
+			tasks = append(tasks, TaskSnapshot{
+				ID: t.id, Name: t.name, Correlation: t.correlation, State: TaskRunning, Enqueued: t.submitted,
+				Started: t.dispatched, Worker: w.id, Attempt: t.redeliveries + 1,
+			})
+		}
+	}
+	return tasks
+}
+
+// stopDispatching marks w as draining, so that it gets no more tasks; the
+// caller holds c.mu and broadcasts c.cond
+func (c *Coordinator) stopDispatching(w *workerConn) {
+	w.draining = true
+	if r := c.config.ring; r != nil {
+		// Its keys move to the workers that stay
+		r.Remove(w.id)
+	}
+}
+
+// DrainWorker stops dispatching to the worker with the given ID, as if it
+// had sent MsgDrain, so that it can be stopped once the tasks it holds
+// returned; it returns ErrUnknownWorker if no such worker is registered
+func (c *Coordinator) DrainWorker(id string) error {
+	c.mu.Lock()
+	w, ok := c.workers[id]
+	if ok {
+		c.stopDispatching(w)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownWorker, id)
+	}
+	c.cond.Broadcast()
+	c.log.Info("worker draining", LogKeyWorker, id, "by", "operator")
+	return nil
+}
+
+// Cancel fails the unfinished task with the given ID with ErrTaskCancelled,
+// taking it off the queue or telling the worker holding it to stop it; it
+// returns ErrUnknownTask if there is no such task
+func (c *Coordinator) Cancel(id uint64) error {
+	c.mu.Lock()
+	var t *remoteTask
+	var owner *workerConn
+	if i := slices.IndexFunc(c.queue, func(t *remoteTask) bool { return t.id == id }); i >= 0 {
+		t = c.queue[i]
+		c.queue = slices.Delete(c.queue, i, i+1)
+		c.endPhase(t, ErrTaskCancelled)
+	} else {
+		for _, w := range c.workers {
+			if t = w.inflight[id]; t != nil {
+				owner = w
+				break
+			}
+		}
+	}
+	if t == nil {
+		c.mu.Unlock()
+		return fmt.Errorf("%w: %d", ErrUnknownTask, id)
+	}
+	delivery := t.redeliveries
+	c.mu.Unlock()
+
+	t.future.complete(nil, ErrTaskCancelled)
+	if owner != nil {
+		owner.conn.Send(&Message{Type: MsgCancel, ID: t.id, Redeliveries: delivery})
+	}
+	c.log.Info("task cancelled", LogKeyTask, id, LogKeyCorrelation, t.correlation)
+	return nil
+}
+
+// WorkerStatus describes a registered worker, as WorkerStatuses lists it
+type WorkerStatus struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	State    string `json:"state"`
+	Capacity int    `json:"capacity"`
+	// Inflight is the number of tasks dispatched to the worker whose results
+	// it has not returned
+	Inflight int  `json:"inflight"`
+	Draining bool `json:"draining"`
+}
+
+// WorkerStatuses returns the registered workers, sorted by ID
+func (c *Coordinator) WorkerStatuses() []WorkerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	workers := make([]WorkerStatus, 0, len(c.workers))
+	for _, w := range c.workers {
+		workers = append(workers, WorkerStatus{
+			ID: w.id, Addr: w.conn.RemoteAddr(), State: w.state.String(),
+			Capacity: w.capacity, Inflight: len(w.inflight), Draining: w.draining,
+		})
+	}
+	slices.SortFunc(workers, func(a, b WorkerStatus) int { return strings.Compare(a.ID, b.ID) })
+	return workers
+}
+
+// Drain stops the coordinator taking tasks and waits for the workers to
+// return the results of the ones they hold, or for ctx to be done, and
+// then closes it. Submit fails with ErrCoordinatorDraining meanwhile, and
+// queued tasks are not dispatched; they, and any tasks still held once ctx
+// is done, then fail with ErrCoordinatorClosed, which leaves them
+// unfinished in the task log for the next coordinator on it to resume.
+// Drain returns the number of tasks left so, and an error wrapping the
+// cause of ctx if any were still held
+func (c *Coordinator) Drain(ctx context.Context) (int, error) {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+	c.log.Info("draining")
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for err == nil && c.held() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = context.Cause(ctx)
+		}
+	}
+	held := c.held()
+	c.mu.Lock()
+	queued := len(c.queue)
+	c.mu.Unlock()
+	c.log.Info("drained", "queued", queued, "running", held)
+	c.Close()
+	if err != nil {
+		return queued + held, fmt.Errorf("coordinator: drain: %d tasks still running: %w", held, err)
+	}
+	return queued, nil
+}
+
+// held returns the number of tasks delivered to workers that have not
+// returned their result
+func (c *Coordinator) held() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, w := range c.workers {
+		n += len(w.inflight)
+	}
+	return n
+}
+
+// Close stops accepting workers, disconnects the connected ones and fails
+// every task that has not returned a result
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	queued := c.queue
+	c.queue = nil
+	workers := make([]*workerConn, 0, len(c.workers))
+	for _, w := range c.workers {
+		workers = append(workers, w)
+	}
+	listeners := c.listeners
+	c.mu.Unlock()
+	c.cond.Broadcast()
+
+	var errs []error
+	for _, l := range listeners {
+		errs = append(errs, l.Close())
+	}
+	for _, w := range workers {
+		c.drop(w, ErrCoordinatorClosed)
+	}
+	for _, t := range queued {
+		t.future.complete(nil, ErrCoordinatorClosed)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,32 @@
+package taskqueue
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+)
+
+// correlationKey is the context key under which a task's correlation ID
+// travels
+type correlationKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the correlation ID id.
+// A coordinator gives the tasks submitted with it that ID instead of
+// generating one, and a worker passes the ID of the task a handler runs to
+// it this way
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID ctx carries, or "" if it carries
+// none. Loggers created with NewLevelHandler add it to the records logged
+// with ctx, so a handler's own log lines can be told apart by task
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// newCorrelationID returns a random correlation ID of 16 hex digits
+func newCorrelationID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
@@ -0,0 +1,270 @@
+package taskqueue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule computes when a recurring task should next run
+type Schedule interface {
+	// Next returns the first activation strictly after t, or the zero time if
+	// there is none
+	Next(t time.Time) time.Time
+}
+
+// Cron submits recurring tasks to a pool according to their schedules
+type Cron struct {
+	pool    Executor
+	timers  *timerQueue
+	mu      sync.Mutex
+	entries map[int]*cronEntry
+	nextID  int
+	stopped bool
+}
+
+// cronEntry is a registered recurring task
+type cronEntry struct {
+	id       int
+	schedule Schedule
+	task     Task
+}
+
+// NewCron creates a cron scheduler that runs its tasks on pool
+func NewCron(pool Executor) *Cron {
+	return &Cron{
+		pool:    pool,
+		timers:  newTimerQueue(),
+		entries: make(map[int]*cronEntry),
+	}
+}
+
+// Add registers task under a cron expression and returns its entry ID; see
+// ParseCron for the accepted syntax
+func (c *Cron) Add(spec string, task Task) (int, error) {
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		return 0, err
+	}
+	return c.Schedule(schedule, task), nil
+}
+
+// Every registers task to run once per interval and returns its entry ID
+func (c *Cron) Every(interval time.Duration, task Task) int {
+	return c.Schedule(everySchedule{interval: interval}, task)
+}
+
+// Schedule registers task under an arbitrary schedule and returns its entry ID
+func (c *Cron) Schedule(schedule Schedule, task Task) int {
+	c.mu.Lock()
+	c.nextID++
+	entry := &cronEntry{id: c.nextID, schedule: schedule, task: task}
+	c.entries[entry.id] = entry
+	c.mu.Unlock()
+
+	c.arm(entry, time.Now())
+	return entry.id
+}
+
+// Remove unregisters an entry; an activation already submitted still runs
+func (c *Cron) Remove(id int) {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.mu.Unlock()
+}
+
+// Stop unregisters every entry and stops the scheduler
+func (c *Cron) Stop() {
+	c.mu.Lock()
+	c.stopped = true
+	c.entries = make(map[int]*cronEntry)
+	c.mu.Unlock()
+	c.timers.close()
+}
+
+// arm schedules the activation of entry following from
+func (c *Cron) arm(entry *cronEntry, from time.Time) {
+	next := entry.schedule.Next(from)
+	if next.IsZero() {
+		c.Remove(entry.id)
+		return
+	}
+	c.timers.schedule(next, func() { c.fire(entry, next) })
+}
+
+// fire submits entry's task to the pool and arms its next activation
+func (c *Cron) fire(entry *cronEntry, at time.Time) {
+	c.mu.Lock()
+	active := !c.stopped && c.entries[entry.id] == entry
+	c.mu.Unlock()
+	if !active {
+		return
+	}
+
+	c.pool.Submit(entry.task)
+	c.arm(entry, at)
+}
+
+// everySchedule activates at a fixed interval
+type everySchedule struct {
+	interval time.Duration
+}
+
+// Next implements Schedule
+func (s everySchedule) Next(t time.Time) time.Time {
+	if s.interval <= 0 {
+		return time.Time{}
+	}
+	return t.Add(s.interval)
+}
+
+// cronSchedule is a parsed five-field cron expression stored as bit sets
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// A restricted day-of-month or day-of-week field matches either one,
+	// following the traditional cron semantics
+	domAny, dowAny bool
+}
+
+// ParseCron parses a standard five-field cron expression
+// ("minute hour day-of-month month day-of-week") supporting *, ranges, steps
+// and lists, as well as the @yearly, @monthly, @weekly, @daily, @hourly and
+// "@every <duration>" descriptors
+func ParseCron(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", spec, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("cron %q: interval must be positive", spec)
+		}
+		return everySchedule{interval: interval}, nil
+	}
+	switch spec {
+	case "@yearly", "@annually":
+		spec = "0 0 1 1 *"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@hourly":
+		spec = "0 * * * *"
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	var s cronSchedule
+	var err error
+	bounds := []struct {
+		dst      *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		if *b.dst, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("cron %q: %w", spec, err)
+		}
+	}
+
+	// Sunday may be written as 0 or 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return &s, nil
+}
+
+// parseCronField parses one comma-separated cron field into a bit set
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		start, end := lo, hi
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			a, b, _ := strings.Cut(rangePart, "-")
+			var errA, errB error
+			start, errA = strconv.Atoi(a)
+			end, errB = strconv.Atoi(b)
+			if errA != nil || errB != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			start, end = n, n
+			if step > 1 {
+				end = hi
+			}
+		}
+
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Next implements Schedule by walking forward field by field from the
+// following whole minute, giving up after five years without a match
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+		y, mo, d := t.Date()
+		switch {
+		case s.month&(1<<uint(mo)) == 0:
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, mo, d, t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = time.Date(y, mo, d, t.Hour(), t.Minute()+1, 0, 0, loc)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches applies the day-of-month and day-of-week fields to t
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
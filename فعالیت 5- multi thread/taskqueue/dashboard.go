@@ -0,0 +1,538 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DashboardConfig controls how a Dashboard samples what it shows
+type DashboardConfig struct {
+	// Interval is the time between samples of the pools, and between the
+	// updates pushed to the page, 1s by default
+	Interval time.Duration
+	// History is the number of samples kept of each pool, 60 by default
+	History int
+}
+
+// Dashboard serves a live view of registered pools and of the cluster
+// membership seen by watched nodes: an HTML page at its root, the current
+// state as JSON at "state", and the state again at every sample as
+// server-sent events at "events", which the page listens to, polling
+// "state" instead where it cannot. The paths are relative, so the
+// dashboard can be mounted under a prefix with http.StripPrefix. Rates and
+// recent latencies are taken between samples, so call Start to begin
+// sampling
+type Dashboard struct {
+	config DashboardConfig
+
+	mu    sync.Mutex
+	pools map[string]*dashboardPool
+	views map[string]func() []Member
+	// updated is closed, and replaced, at every sample, waking the streams
+	updated chan struct{}
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// dashboardPool is a registered pool and its recent samples
+type dashboardPool struct {
+	pool    Executor
+	last    MetricsSnapshot
+	count   int64
+	sum     time.Duration
+	samples []DashboardSample
+}
+
+// DashboardState is everything the dashboard shows at one point
+type DashboardState struct {
+	At    time.Time       `json:"at"`
+	Pools []DashboardPool `json:"pools"`
+	Nodes []DashboardNode `json:"nodes"`
+}
+
+// DashboardPool is the state of one pool: its totals since it started and
+// its recent samples, oldest first
+type DashboardPool struct {
+	Name      string            `json:"name"`
+	Workers   int               `json:"workers"`
+	Busy      int               `json:"busy"`
+	Queued    int               `json:"queued"`
+	Submitted int64             `json:"submitted"`
+	Completed int64             `json:"completed"`
+	Failed    int64             `json:"failed"`
+	TimedOut  int64             `json:"timedOut"`
+	Retried   int64             `json:"retried"`
+	P50       float64           `json:"p50Ms"`
+	P95       float64           `json:"p95Ms"`
+	P99       float64           `json:"p99Ms"`
+	Samples   []DashboardSample `json:"samples"`
+}
+
+// DashboardSample is a pool at one sample, with what it did since the one
+// before
+type DashboardSample struct {
+	At     time.Time `json:"at"`
+	Busy   int       `json:"busy"`
+	Queued int       `json:"queued"`
+	// Throughput is the tasks completed per second since the last sample
+	Throughput float64 `json:"throughput"`
+	// ErrorRate is the share of the tasks completed since the last sample
+	// that failed
+	ErrorRate float64 `json:"errorRate"`
+	// Latency is the mean execution time of the tasks that completed since
+	// the last sample, in milliseconds, 0 if none did
+	Latency float64 `json:"latencyMs"`
+}
+
+// DashboardNode is the membership of the cluster as one node sees it
+type DashboardNode struct {
+	Name    string            `json:"name"`
+	Members []DashboardMember `json:"members"`
+}
+
+// DashboardMember is one member of a DashboardNode's view
+type DashboardMember struct {
+	Name  string `json:"name"`
+	Addr  string `json:"addr,omitempty"`
+	State string `json:"state"`
+}
+
+// NewDashboard creates a dashboard with no pools registered and no nodes
+// watched
+func NewDashboard(config DashboardConfig) *Dashboard {
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.History <= 0 {
+		config.History = 60
+	}
+	return &Dashboard{
+		config:  config,
+		pools:   make(map[string]*dashboardPool),
+		views:   make(map[string]func() []Member),
+		updated: make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Register shows pool under the given name, replacing any pool with the
+// same name
+func (d *Dashboard) Register(name string, pool Executor) {
+	p := &dashboardPool{pool: pool, last: pool.Metrics()}
+	if source, ok := pool.(HistogramSource); ok {
+		h := source.Latencies().Execution
+		p.count, p.sum = h.Count(), h.Sum()
+	}
+	d.mu.Lock()
+	d.pools[name] = p
+	d.mu.Unlock()
+}
+
+// Unregister stops showing the pool with the given name
+func (d *Dashboard) Unregister(name string) {
+	d.mu.Lock()
+	delete(d.pools, name)
+	d.mu.Unlock()
+}
+
+// Watch shows the cluster as the node name sees it, as members lists it
+// whenever the state is taken, replacing any view of the same name. A
+// membership.Group's Members method will do, as will CoordinatorMembers
+func (d *Dashboard) Watch(name string, members func() []Member) {
+	d.mu.Lock()
+	d.views[name] = members
+	d.mu.Unlock()
+}
+
+// Unwatch stops showing the view of the node name
+func (d *Dashboard) Unwatch(name string) {
+	d.mu.Lock()
+	delete(d.views, name)
+	d.mu.Unlock()
+}
+
+// WatchCluster shows, for the in-process cluster c, which of its nodes are
+// running, under the name "cluster", and the workers each of its
+// coordinators has registered, under the coordinator's name. A coordinator
+// that is not running shows no workers
+func (d *Dashboard) WatchCluster(c *Cluster) {
+	d.Watch("cluster", func() []Member {
+		var members []Member
+		for _, name := range c.Nodes() {
+			state := MemberDead
+			if c.Running(name) {
+				state = MemberAlive
+			}
+			members = append(members, Member{Name: name, State: state})
+		}
+		return members
+	})
+	for _, name := range c.Coordinators() {
+		d.Watch(name, func() []Member {
+			if coord := c.Coordinator(name); coord != nil {
+				return CoordinatorMembers(coord)()
+			}
+			return nil
+		})
+	}
+}
+
+// CoordinatorMembers returns a membership view of the workers registered
+// with c, alive or suspect as its failure detector judges them
+func CoordinatorMembers(c *Coordinator) func() []Member {
+	return func() []Member {
+		var members []Member
+		for id, state := range c.WorkerStates() {
+			m := Member{Name: id, State: MemberAlive}
+			if state == WorkerSuspect {
+				m.State = MemberSuspect
+			}
+			members = append(members, m)
+		}
+		return members
+	}
+}
+
+// Start launches the sampling loop
+func (d *Dashboard) Start() {
+	go d.loop()
+}
+
+// Stop ends the sampling loop, and the event streams with it, and waits for
+// the loop to exit
+func (d *Dashboard) Stop() {
+	d.once.Do(func() { close(d.stop) })
+	<-d.done
+}
+
+// loop samples the pools once per interval
+func (d *Dashboard) loop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			d.sample(now)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// sample takes a sample of every pool and wakes the event streams
+func (d *Dashboard) sample(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.pools {
+		m, stats := p.pool.Metrics(), p.pool.Stats()
+		s := DashboardSample{At: now, Busy: stats.Running, Queued: stats.Queued}
+		completed := m.Completed - p.last.Completed
+		if completed > 0 {
+			s.Throughput = float64(completed) / d.config.Interval.Seconds()
+			s.ErrorRate = float64(m.Failed-p.last.Failed) / float64(completed)
+		}
+		if source, ok := p.pool.(HistogramSource); ok {
+			h := source.Latencies().Execution
+			count, sum := h.Count(), h.Sum()
+			if count > p.count {
+				s.Latency = milliseconds((sum - p.sum) / time.Duration(count-p.count))
+			}
+			p.count, p.sum = count, sum
+		}
+		p.last = m
+		p.samples = append(p.samples, s)
+		if n := len(p.samples) - d.config.History; n > 0 {
+			p.samples = slices.Delete(p.samples, 0, n)
+		}
+	}
+	close(d.updated)
+	d.updated = make(chan struct{})
+}
+
+// milliseconds returns d in fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// State returns what the dashboard shows now, the pools and nodes sorted by
+// name
+func (d *Dashboard) State() DashboardState {
+	d.mu.Lock()
+	state := DashboardState{At: time.Now()}
+	for name, p := range d.pools {
+		m, stats := p.pool.Metrics(), p.pool.Stats()
+		state.Pools = append(state.Pools, DashboardPool{
+			Name:      name,
+			Workers:   stats.Workers,
+			Busy:      stats.Running,
+			Queued:    stats.Queued,
+			Submitted: m.Submitted,
+			Completed: m.Completed,
+			Failed:    m.Failed,
+			TimedOut:  m.TimedOut,
+			Retried:   m.Retried,
+			P50:       milliseconds(stats.P50),
+			P95:       milliseconds(stats.P95),
+			P99:       milliseconds(stats.P99),
+			Samples:   slices.Clone(p.samples),
+		})
+	}
+	views := make(map[string]func() []Member, len(d.views))
+	for name, members := range d.views {
+		views[name] = members
+	}
+	d.mu.Unlock()
+
+	// The views are read outside the lock, as they take locks of their own
+	for name, members := range views {
+		node := DashboardNode{Name: name, Members: []DashboardMember{}}
+		for _, m := range members() {
+			node.Members = append(node.Members, DashboardMember{Name: m.Name, Addr: m.Addr, State: m.State.String()})
+		}
+		sort.Slice(node.Members, func(i, j int) bool { return node.Members[i].Name < node.Members[j].Name })
+		state.Nodes = append(state.Nodes, node)
+	}
+	sort.Slice(state.Pools, func(i, j int) bool { return state.Pools[i].Name < state.Pools[j].Name })
+	sort.Slice(state.Nodes, func(i, j int) bool { return state.Nodes[i].Name < state.Nodes[j].Name })
+	return state
+}
+
+// ServeHTTP implements http.Handler
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "", "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, dashboardPage)
+	case "state", "/state":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.State())
+	case "events", "/events":
+		d.serveEvents(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveEvents streams the state as server-sent events, once right away and
+// again at every sample, until the client goes or the dashboard stops
+func (d *Dashboard) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: %d\n\n", d.config.Interval.Milliseconds())
+	for {
+		d.mu.Lock()
+		updated := d.updated
+		d.mu.Unlock()
+		data, err := json.Marshal(d.State())
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// SimulateDashboard serves a Dashboard on addr for length, or until ctx is
+// done if length is 0, showing the pools of this package with workers
+// workers each under a steady random load, a few tasks of which fail, and
+// an in-process cluster of a coordinator and three workers, one of which
+// is crashed and restarted at random, also given tasks. The unfinished
+// tasks of the pools and the coordinator are listed by a TaskInspector at
+// "/tasks". It writes the dashboard's address to w once it is listening
+func SimulateDashboard(ctx context.Context, w io.Writer, addr string, workers int, length time.Duration, seed uint64) error {
+	if length > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, length)
+		defer cancel()
+	}
+	dashboard := NewDashboard(DashboardConfig{})
+	dashboard.Start()
+	defer dashboard.Stop()
+	inspector := NewTaskInspector()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i, bench := range DefaultBenchPools() {
+		pool := bench.New(workers, WithTaskTracking())
+		dashboard.Register(bench.Name, pool)
+		inspector.Register(bench.Name, pool.(TaskLister))
+		rng := rand.New(rand.NewPCG(seed, uint64(i)))
+		wg.Go(func() {
+			defer pool.Shutdown()
+			for ctx.Err() == nil {
+				d := time.Duration(rng.ExpFloat64() * float64(20*time.Millisecond))
+				fail := rng.Float64() < 0.05
+				pool.SubmitCtx(ctx, func(ctx context.Context) error {
+					time.Sleep(d)
+					if fail {
+						return errors.New("simulated failure")
+					}
+					return nil
+				})
+				time.Sleep(time.Duration(rng.ExpFloat64() * float64(time.Second) / float64(20*workers)))
+			}
+		})
+	}
+
+	cluster := NewCluster(ClusterConfig{})
+	defer cluster.Close()
+	cluster.AddCoordinator("coordinator")
+	for i := range 3 {
+		cluster.AddWorker(fmt.Sprintf("worker-%d", i+1), "coordinator", 2)
+	}
+	cluster.Handle("work", func(ctx context.Context, payload []byte) ([]byte, error) {
+		d, err := time.ParseDuration(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(d):
+			return payload, nil
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	})
+	dashboard.WatchCluster(cluster)
+	if err := cluster.StartAll(); err != nil {
+		return err
+	}
+	coord := cluster.Coordinator("coordinator")
+	inspector.Register("coordinator", coord)
+	rng := rand.New(rand.NewPCG(seed, 0))
+	submitter := rand.New(rand.NewPCG(seed, 1))
+	wg.Go(func() {
+		for ctx.Err() == nil {
+			d := time.Duration(submitter.Int64N(int64(500 * time.Millisecond)))
+			coord.Submit(ctx, "work", []byte(d.String()))
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	wg.Go(func() {
+		for ctx.Err() == nil {
+			name := fmt.Sprintf("worker-%d", rng.IntN(3)+1)
+			cluster.Crash(name)
+			select {
+			case <-time.After(time.Duration(2+rng.IntN(4)) * time.Second):
+			case <-ctx.Done():
+			}
+			cluster.Restart(name)
+			select {
+			case <-time.After(time.Duration(3+rng.IntN(5)) * time.Second):
+			case <-ctx.Done():
+			}
+		}
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", dashboard)
+	mux.Handle("/tasks", inspector)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	fmt.Fprintf(w, "dashboard at http://%s/\n", addr)
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	// The event streams end with the sampling loop, letting Shutdown finish
+	dashboard.Stop()
+	return srv.Shutdown(context.Background())
+}
+
+// dashboardPage is the dashboard's page. It renders every state it gets
+// from the event stream, falling back to polling if the stream fails
+// before it has delivered anything
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Pool dashboard</title>
+<style>
+body { font: 14px sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 4px 12px; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child { text-align: left; }
+.spark { font-family: monospace; letter-spacing: -1px; color: #36c; }
+.alive { color: #080; } .suspect { color: #c80; } .dead, .left { color: #c00; }
+#status { color: #888; }
+</style>
+</head>
+<body>
+<h1>Pools</h1>
+<table>
+<thead><tr><th>pool</th><th>busy</th><th>queued</th><th>tasks/s</th><th>errors</th><th>latency</th><th>recent latency</th><th>p50</th><th>p99</th><th>completed</th><th>failed</th></tr></thead>
+<tbody id="pools"></tbody>
+</table>
+<h1>Cluster</h1>
+<div id="nodes"></div>
+<p id="status">connecting</p>
+<script>
+const blocks = "▁▂▃▄▅▆▇█";
+function spark(values) {
+  const top = Math.max(...values, 1e-9);
+  return values.map(v => blocks[Math.min(blocks.length - 1, Math.floor(v / top * blocks.length))]).join("");
+}
+function ms(v) { return v.toFixed(v < 10 ? 2 : 0) + "ms"; }
+function esc(s) { return String(s).replace(/[&<>"]/g, c => "&#" + c.charCodeAt(0) + ";"); }
+function render(state) {
+  document.getElementById("pools").innerHTML = state.pools.map(p => {
+    const last = p.samples[p.samples.length - 1] || {throughput: 0, errorRate: 0, latencyMs: 0};
+    return "<tr><td>" + esc(p.name) + "</td><td>" + p.busy + "/" + p.workers + "</td><td>" + p.queued +
+      "</td><td>" + last.throughput.toFixed(1) + "</td><td>" + (100 * last.errorRate).toFixed(1) + "%</td><td>" +
+      ms(last.latencyMs) + "</td><td class=spark>" + spark(p.samples.map(s => s.latencyMs)) + "</td><td>" +
+      ms(p.p50Ms) + "</td><td>" + ms(p.p99Ms) + "</td><td>" + p.completed + "</td><td>" + p.failed + "</td></tr>";
+  }).join("");
+  document.getElementById("nodes").innerHTML = state.nodes.map(n =>
+    "<h3>" + esc(n.name) + "</h3><table><tbody>" + (n.members.length ? n.members.map(m =>
+      "<tr><td>" + esc(m.name) + "</td><td>" + esc(m.addr || "") + "</td><td class=" + esc(m.state) + ">" + esc(m.state) + "</td></tr>").join("") :
+      "<tr><td>no members</td></tr>") + "</tbody></table>").join("");
+  document.getElementById("status").textContent = "updated " + new Date(state.at).toLocaleTimeString();
+}
+function poll() {
+  fetch("state").then(r => r.json()).then(render).catch(() => {
+    document.getElementById("status").textContent = "disconnected";
+  });
+}
+let streamed = false;
+if (window.EventSource) {
+  const events = new EventSource("events");
+  events.onmessage = e => { streamed = true; render(JSON.parse(e.data)); };
+  events.onerror = () => {
+    if (!streamed) { events.close(); poll(); setInterval(poll, 1000); }
+  };
+} else {
+  poll(); setInterval(poll, 1000);
+}
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,143 @@
+package taskqueue
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Distribution produces the simulated duration of each benchmark task
+type Distribution interface {
+	// Sample returns the next task duration
+	Sample(r *rand.Rand) time.Duration
+	// String describes the distribution in the syntax ParseDistribution accepts
+	String() string
+}
+
+// FixedDuration makes every task take the same time
+type FixedDuration time.Duration
+
+// Sample implements Distribution
+func (d FixedDuration) Sample(*rand.Rand) time.Duration { return time.Duration(d) }
+
+// String implements Distribution
+func (d FixedDuration) String() string { return "fixed:" + time.Duration(d).String() }
+
+// UniformDuration spreads task durations evenly between Min and Max
+type UniformDuration struct {
+	Min, Max time.Duration
+}
+
+// Sample implements Distribution
+func (d UniformDuration) Sample(r *rand.Rand) time.Duration {
+	if d.Max <= d.Min {
+		return d.Min
+	}
+	return d.Min + time.Duration(r.Int64N(int64(d.Max-d.Min)))
+}
+
+// String implements Distribution
+func (d UniformDuration) String() string { return fmt.Sprintf("uniform:%v-%v", d.Min, d.Max) }
+
+// ExponentialDuration draws task durations from an exponential distribution,
+// producing many short tasks and a long tail of slow ones
+type ExponentialDuration time.Duration
+
+// Sample implements Distribution
+func (d ExponentialDuration) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(d))
+}
+
+// String implements Distribution
+func (d ExponentialDuration) String() string { return "exp:" + time.Duration(d).String() }
+
+// NormalDuration draws durations from a normal distribution around Mean,
+// clamped at zero
+type NormalDuration struct {
+	Mean, StdDev time.Duration
+}
+
+// Sample implements Distribution
+func (d NormalDuration) Sample(r *rand.Rand) time.Duration {
+	return max(time.Duration(float64(d.Mean)+r.NormFloat64()*float64(d.StdDev)), 0)
+}
+
+// String implements Distribution
+func (d NormalDuration) String() string { return fmt.Sprintf("normal:%v,%v", d.Mean, d.StdDev) }
+
+// ParetoDuration draws durations from a Pareto distribution: never below
+// Scale, with a heavy tail that grows as Shape shrinks. A Shape of 2 or less
+// has infinite variance, like the service times behind tail latency
+type ParetoDuration struct {
+	Scale time.Duration
+	Shape float64
+}
+
+// Sample implements Distribution
+func (d ParetoDuration) Sample(r *rand.Rand) time.Duration {
+	// Inverse transform sampling; 1-Float64 is in (0, 1]
+	return time.Duration(float64(d.Scale) / math.Pow(1-r.Float64(), 1/d.Shape))
+}
+
+// String implements Distribution
+func (d ParetoDuration) String() string { return fmt.Sprintf("pareto:%v,%v", d.Scale, d.Shape) }
+
+// ParseDistribution parses "fixed:100ms", "uniform:50ms-150ms", "exp:100ms",
+// "normal:100ms,20ms" for a mean and standard deviation, or "pareto:10ms,1.5"
+// for a scale and shape; a bare duration means fixed
+func ParseDistribution(spec string) (Distribution, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok {
+		kind, arg = "fixed", spec
+	}
+	switch kind {
+	case "fixed", "exp":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %q: %w", spec, err)
+		}
+		if kind == "exp" {
+			return ExponentialDuration(d), nil
+		}
+		return FixedDuration(d), nil
+	case "uniform":
+		lo, hi, ok := strings.Cut(arg, "-")
+		if !ok {
+			return nil, fmt.Errorf("distribution %q: expected uniform:min-max", spec)
+		}
+		minD, err := time.ParseDuration(lo)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %q: %w", spec, err)
+		}
+		maxD, err := time.ParseDuration(hi)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %q: %w", spec, err)
+		}
+		return UniformDuration{Min: minD, Max: maxD}, nil
+	case "normal", "pareto":
+		first, second, ok := strings.Cut(arg, ",")
+		if !ok {
+			return nil, fmt.Errorf("distribution %q: expected normal:mean,stddev or pareto:scale,shape", spec)
+		}
+		d, err := time.ParseDuration(first)
+		if err != nil {
+			return nil, fmt.Errorf("distribution %q: %w", spec, err)
+		}
+		if kind == "normal" {
+			stddev, err := time.ParseDuration(second)
+			if err != nil {
+				return nil, fmt.Errorf("distribution %q: %w", spec, err)
+			}
+			return NormalDuration{Mean: d, StdDev: stddev}, nil
+		}
+		shape, err := strconv.ParseFloat(second, 64)
+		if err != nil || shape <= 0 {
+			return nil, fmt.Errorf("distribution %q: shape must be a positive number", spec)
+		}
+		return ParetoDuration{Scale: d, Shape: shape}, nil
+	}
+	return nil, fmt.Errorf("distribution %q: unknown kind %q", spec, kind)
+}
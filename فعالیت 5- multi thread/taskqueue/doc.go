@@ -0,0 +1,5 @@
+// Package taskqueue implements the thread pools, the distributed task queue
+// of coordinators and worker nodes, and the transports, storage and
+// coordination primitives they are built from; the command in the parent
+// directory benchmarks and runs them
+package taskqueue
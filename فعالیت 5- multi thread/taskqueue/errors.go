@@ -0,0 +1,182 @@
+package taskqueue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPoolShutdown is reported for tasks submitted to, or cancelled by, a pool
+// that has been shut down
+var ErrPoolShutdown = errors.New("pool is shut down")
+
+// ErrQueueFull is reported for tasks rejected by a full bounded queue
+var ErrQueueFull = errors.New("task queue is full")
+
+// ErrTaskTimeout is reported for tasks that ran past their timeout
+var ErrTaskTimeout = errors.New("task timed out")
+
+// ErrTaskDropped is reported for queued tasks evicted to make room for newer ones
+var ErrTaskDropped = errors.New("task dropped from full queue")
+
+// PanicError is the error reported for a task that panicked
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+// Error implements the error interface
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v", e.Value)
+}
+
+// Unwrap exposes the panic value when the task panicked with an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// ErrWorkerLost is reported for remote tasks whose worker disconnected
+// before returning a result
+var ErrWorkerLost = errors.New("worker connection lost")
+
+// ErrCoordinatorClosed is reported for remote tasks submitted to, or still
+// pending in, a closed coordinator
+var ErrCoordinatorClosed = errors.New("coordinator is closed")
+
+// ErrCoordinatorDraining is reported for remote tasks submitted to a
+// coordinator that is draining before it closes
+var ErrCoordinatorDraining = errors.New("coordinator is draining")
+
+// ErrTaskCancelled is reported for remote tasks an operator cancelled with
+// Coordinator.Cancel
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// ErrUnknownTask is reported for task IDs a coordinator holds no
+// unfinished task under
+var ErrUnknownTask = errors.New("unknown task")
+
+// ErrUnknownWorker is reported for worker IDs not registered with a
+// coordinator
+var ErrUnknownWorker = errors.New("unknown worker")
+
+// ErrFrameTooLarge is reported when a peer sends a message above maxFrameSize
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// RemoteError is the error reported for a remote task that failed on its worker
+type RemoteError struct {
+	Worker  string
+	Message string
+}
+
+// Error implements the error interface
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("worker %s: %s", e.Worker, e.Message)
+}
+
+// GRPCStatusError is the error reported for a gRPC call that ended with a
+// non-OK status
+type GRPCStatusError struct {
+	Code    int
+	Message string
+}
+
+// Error implements the error interface
+func (e *GRPCStatusError) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", e.Code, e.Message)
+}
+
+// Unwrap returns ErrInvalidToken or ErrPermissionDenied for the statuses the
+// server answers rejected tokens with
+func (e *GRPCStatusError) Unwrap() error {
+	switch e.Code {
+	case grpcUnauthorized:
+		return ErrInvalidToken
+	case grpcDenied:
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// ErrLeaseExpired is reported when acknowledging a task whose lease ran out,
+// after which it may already have been handed to someone else
+var ErrLeaseExpired = errors.New("task lease expired")
+
+// ErrHeartbeatTimeout is reported when a worker is disconnected for missing
+// its heartbeats
+var ErrHeartbeatTimeout = errors.New("worker heartbeat timeout")
+
+// ErrPartitioned is reported when dialing a host that a simulated network
+// partition cuts off
+var ErrPartitioned = errors.New("network partitioned")
+
+// ErrReplayDiverged is reported when a replayed Sim run does not take the
+// path its trace recorded
+var ErrReplayDiverged = errors.New("sim: replay diverged from the trace")
+
+// ErrPoolSaturated is reported by PoolCheck for a pool whose workers are
+// all busy with more tasks queued than it allows
+var ErrPoolSaturated = errors.New("pool is saturated")
+
+// ErrNotLeader is reported by LeaderCheck and raft.Check for a node that
+// has no leader to follow, or is not the leader it must be to serve
+var ErrNotLeader = errors.New("not the leader")
+
+// ErrSimDeadlock is returned by Sim.Run when every task is blocked and no
+// timer is left to wake any of them
+var ErrSimDeadlock = errors.New("sim: all tasks blocked")
+
+// ErrIdleTimeout is reported by QUIC connections whose peer sent nothing for
+// the idle timeout
+var ErrIdleTimeout = errors.New("quic: idle timeout")
+
+// ErrNack is returned by a Handler, possibly wrapped, to hand its task back
+// to the coordinator for redelivery instead of failing it
+var ErrNack = errors.New("task nacked")
+
+// ErrRedeliveryLimit is reported for a task that was redelivered the maximum
+// number of times without a worker reporting its result
+var ErrRedeliveryLimit = errors.New("task redelivery limit reached")
+
+// ErrLockHeld is reported when acquiring a lock that another owner holds
+var ErrLockHeld = errors.New("lock is held by another owner")
+
+// ErrLockLost is reported when renewing or releasing a lock whose lease ran
+// out, after which another owner may hold it
+var ErrLockLost = errors.New("lock lease lost")
+
+// ErrQuorumNotReached is reported for a quorum read or write that too few
+// replicas answered
+var ErrQuorumNotReached = errors.New("quorum not reached")
+
+// ErrNotRegistered is reported when renewing the lease of a worker missing
+// from a registry, such as one whose lease already ran out
+var ErrNotRegistered = errors.New("worker is not registered")
+
+// ErrCircuitOpen is reported for calls rejected by an open circuit breaker
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// ErrRetryBudgetExhausted is reported for a failed call that was not retried
+// because its client's retry budget had no room left
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// ErrUnknownMethod is reported for an RPC call to a method the server has
+// not registered
+var ErrUnknownMethod = errors.New("unknown rpc method")
+
+// ErrInvalidToken is reported for a request whose token is missing,
+// malformed, forged or expired
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrPermissionDenied is reported for a request whose token does not grant
+// the scope it needs
+var ErrPermissionDenied = errors.New("permission denied")
+
+// RedisError is the error reply of a Redis command
+type RedisError struct {
+	Message string
+}
+
+// Error implements the error interface
+func (e *RedisError) Error() string {
+	return "redis: " + e.Message
+}
@@ -0,0 +1,71 @@
+package taskqueue
+
+// EventListener is notified of pool lifecycle changes; events are delivered
+// synchronously on pool goroutines, never while a pool lock is held, and
+// listeners must be quick. Embed NopEventListener to handle only some events
+type EventListener interface {
+	// PoolStarted is called once a pool has been constructed
+	PoolStarted(pool string, workers int)
+	// WorkerSpawned is called when a worker goroutine starts
+	WorkerSpawned(pool string, worker int)
+	// WorkerRetired is called when a worker goroutine exits, whether it was
+	// retired by Resize or keep-alive or the pool stopped
+	WorkerRetired(pool string, worker int)
+	// QueueSaturated is called when a bounded queue fills up; it is not called
+	// again until the queue has drained to half its capacity
+	QueueSaturated(pool string, depth int)
+	// PoolStopped is called once the pool context is cancelled, by Shutdown,
+	// ShutdownNow, fail-fast or the parent context
+	PoolStopped(pool string)
+}
+
+// NopEventListener ignores every event
+type NopEventListener struct{}
+
+// PoolStarted implements EventListener
+func (NopEventListener) PoolStarted(string, int) {}
+
+// WorkerSpawned implements EventListener
+func (NopEventListener) WorkerSpawned(string, int) {}
+
+// WorkerRetired implements EventListener
+func (NopEventListener) WorkerRetired(string, int) {}
+
+// QueueSaturated implements EventListener
+func (NopEventListener) QueueSaturated(string, int) {}
+
+// PoolStopped implements EventListener
+func (NopEventListener) PoolStopped(string) {}
+
+// listenerList fans each event out to every registered listener
+type listenerList []EventListener
+
+func (l listenerList) poolStarted(pool string, workers int) {
+	for _, listener := range l {
+		listener.PoolStarted(pool, workers)
+	}
+}
+
+func (l listenerList) workerSpawned(pool string, worker int) {
+	for _, listener := range l {
+		listener.WorkerSpawned(pool, worker)
+	}
+}
+
+func (l listenerList) workerRetired(pool string, worker int) {
+	for _, listener := range l {
+		listener.WorkerRetired(pool, worker)
+	}
+}
+
+func (l listenerList) queueSaturated(pool string, depth int) {
+	for _, listener := range l {
+		listener.QueueSaturated(pool, depth)
+	}
+}
+
+func (l listenerList) poolStopped(pool string) {
+	for _, listener := range l {
+		listener.PoolStopped(pool)
+	}
+}
@@ -0,0 +1,90 @@
+package taskqueue
+
+import (
+	"context"
+	"time"
+)
+
+// Task is a unit of work that can be submitted to a pool
+type Task func()
+
+// ContextTask is a task that observes cancellation through its context
+type ContextTask func(ctx context.Context) error
+
+// call adapts a ContextTask to the pool's internal job signature
+func (t ContextTask) call(ctx context.Context) (any, error) {
+	return nil, t(ctx)
+}
+
+// run adapts a plain Task to the pool's internal job signature
+func (t Task) run(context.Context) (any, error) {
+	t()
+	return nil, nil
+}
+
+// Executor is implemented by every pool in this package
+type Executor interface {
+	// Submit enqueues task for execution on the pool
+	Submit(task Task) *Future
+	// Call enqueues fn and returns a future holding its result
+	Call(fn Callable) *Future
+	// SubmitCtx enqueues task, dropping it if ctx is cancelled before it starts
+	SubmitCtx(ctx context.Context, task ContextTask) *Future
+	// SubmitWithTimeout enqueues task and fails it with ErrTaskTimeout if it
+	// runs for longer than timeout
+	SubmitWithTimeout(timeout time.Duration, task ContextTask) *Future
+	// SubmitBatch enqueues tasks in one step and tracks them as a group
+	SubmitBatch(tasks []Task) *BatchHandle
+	// SubmitKeyed enqueues task behind every earlier task with the same key
+	SubmitKeyed(key string, task Task) *Future
+	// SubmitWeighted enqueues task with a weight counted against the pool's
+	// weight budget
+	SubmitWeighted(weight int64, task Task) *Future
+	// SubmitAfter enqueues task once delay has elapsed
+	SubmitAfter(delay time.Duration, task Task) *Future
+	// SubmitAt enqueues task at the given time
+	SubmitAt(at time.Time, task Task) *Future
+	// WaitForCompletion blocks until every submitted task has finished or the
+	// pool context is cancelled
+	WaitForCompletion()
+	// Wait blocks until every submitted task has finished and returns the
+	// first task error of a pool created with WithFailFast
+	Wait() error
+	// GetCompletedTasks returns the number of tasks that have finished
+	GetCompletedTasks() int64
+	// Metrics returns a snapshot of the pool metrics
+	Metrics() MetricsSnapshot
+	// Stats returns the current load and latency of the pool
+	Stats() PoolStats
+	// Shutdown stops accepting tasks and waits for submitted ones to finish
+	Shutdown()
+	// ShutdownNow stops accepting tasks, cancels running ones and returns
+	// those that never started
+	ShutdownNow() []ContextTask
+}
+
+// Workload is a list of possibly heterogeneous tasks run as one unit
+type Workload []Task
+
+// RunWorkload submits every task of w to p and waits for all of them to finish
+func RunWorkload(p Executor, w Workload) {
+	for _, task := range w {
+		p.Submit(task)
+	}
+	p.WaitForCompletion()
+}
+
+// BenchPool names a pool implementation and how to construct it
+type BenchPool struct {
+	Name string
+	New  func(workers int, opts ...Option) Executor
+}
+
+// DefaultBenchPools returns the pool implementations of this package
+func DefaultBenchPools() []BenchPool {
+	return []BenchPool{
+		{"simple", func(n int, opts ...Option) Executor { return NewSimpleThreadPool(n, opts...) }},
+		{"apache", func(n int, opts ...Option) Executor { return NewApacheThreadPool(n, opts...) }},
+		{"work-stealing", func(n int, opts ...Option) Executor { return NewWorkStealingPool(n, opts...) }},
+	}
+}
@@ -0,0 +1,443 @@
+package taskqueue
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// faultReorderWindow is how long an outgoing message held back to be
+// reordered waits for a later one to overtake it before it is sent anyway
+const faultReorderWindow = 10 * time.Millisecond
+
+// FaultDirection selects which messages of a connection a FaultRule applies
+// to, relative to the side using the FaultTransport
+type FaultDirection int
+
+const (
+	// FaultBoth applies a rule to messages sent and received
+	FaultBoth FaultDirection = iota
+	// FaultOutbound applies a rule to messages sent
+	FaultOutbound
+	// FaultInbound applies a rule to messages received
+	FaultInbound
+)
+
+// FaultRule describes the faults injected into the messages it matches;
+// every probability is drawn on its own, so a message can be both delayed
+// and duplicated
+type FaultRule struct {
+	// Direction limits the rule to messages sent or received
+	Direction FaultDirection
+	// Types, if set, limits the rule to messages of these types
+	Types []MessageType
+	// Match, if set, limits the rule to the messages it accepts; addr is
+	// the connection's remote address
+	Match func(addr string, m *Message) bool
+
+	// Drop is the probability that a message is lost
+	Drop float64
+	// Duplicate is the probability that a message is delivered twice
+	Duplicate float64
+	// Reorder is the probability that a message is held back until the
+	// next one on its connection has gone past it
+	Reorder float64
+	// Corrupt is the probability that a bit of a message's payload, or of
+	// its ID if it has none, is flipped
+	Corrupt float64
+	// Delay is the probability that a message is held for a random time
+	// between MinDelay and MaxDelay
+	Delay              float64
+	MinDelay, MaxDelay time.Duration
+}
+
+// matches reports whether r applies to m travelling in dir
+func (r *FaultRule) matches(dir FaultDirection, addr string, m *Message) bool {
+	if r.Direction != FaultBoth && r.Direction != dir {
+		return false
+	}
+	if len(r.Types) > 0 && !slices.Contains(r.Types, m.Type) {
+		return false
+	}
+	return r.Match == nil || r.Match(addr, m)
+}
+
+// ParseFaultRule parses a rule written as comma-separated settings, such as
+// "drop=0.01,dup=0.01,reorder=0.05,corrupt=0.001,delay=0.1:10ms-50ms,dir=out":
+// each fault takes a probability, delay also the range of its delays, and
+// dir, which is in, out or both, the messages the rule applies to
+func ParseFaultRule(spec string) (FaultRule, error) {
+	var r FaultRule
+	for setting := range strings.SplitSeq(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return FaultRule{}, fmt.Errorf("fault rule %q: expected key=value, got %q", spec, setting)
+		}
+		if key == "dir" {
+			switch value {
+			case "both":
+				r.Direction = FaultBoth
+			case "out":
+				r.Direction = FaultOutbound
+			case "in":
+				r.Direction = FaultInbound
+			default:
+				return FaultRule{}, fmt.Errorf("fault rule %q: unknown direction %q", spec, value)
+			}
+			continue
+		}
+		if key == "delay" {
+			p, delays, ok := strings.Cut(value, ":")
+			if !ok {
+				return FaultRule{}, fmt.Errorf("fault rule %q: expected delay=probability:min-max", spec)
+			}
+			lo, hi, ok := strings.Cut(delays, "-")
+			if !ok {
+				hi = lo
+			}
+			var err error
+			if r.MinDelay, err = time.ParseDuration(lo); err != nil {
+				return FaultRule{}, fmt.Errorf("fault rule %q: %w", spec, err)
+			}
+			if r.MaxDelay, err = time.ParseDuration(hi); err != nil {
+				return FaultRule{}, fmt.Errorf("fault rule %q: %w", spec, err)
+			}
+			value = p
+		}
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil || p < 0 || p > 1 {
+			return FaultRule{}, fmt.Errorf("fault rule %q: %s needs a probability between 0 and 1, got %q", spec, key, value)
+		}
+		switch key {
+		case "drop":
+			r.Drop = p
+		case "dup":
+			r.Duplicate = p
+		case "reorder":
+			r.Reorder = p
+		case "corrupt":
+			r.Corrupt = p
+		case "delay":
+			r.Delay = p
+		default:
+			return FaultRule{}, fmt.Errorf("fault rule %q: unknown fault %q", spec, key)
+		}
+	}
+	return r, nil
+}
+
+// FaultStats counts the faults a FaultTransport injected
+type FaultStats struct {
+	Dropped, Duplicated, Reordered, Corrupted, Delayed uint64
+}
+
+// FaultTransport wraps a Transport, injecting faults into the messages of
+// the connections it dials and accepts as its rules say, to exercise
+// distributed components under an unreliable network. Each message is
+// judged by the first rule that matches it. Faults are drawn at random from
+// Seed, or from Sim when the wrapped transport is a SimNetwork, so that a
+// simulated run stays reproducible
+type FaultTransport struct {
+	Transport Transport
+	Rules     []FaultRule
+	Seed      uint64
+	// Sim, if set, supplies the randomness and the virtual time delays are
+	// served on
+	Sim *Sim
+
+	once                                               sync.Once
+	mu                                                 sync.Mutex
+	rng                                                *rand.Rand
+	dropped, duplicated, reordered, corrupted, delayed atomic.Uint64
+}
+
+// NewFaultTransport wraps t, injecting faults by rules drawn from seed
+func NewFaultTransport(t Transport, seed uint64, rules ...FaultRule) *FaultTransport {
+	return &FaultTransport{Transport: t, Seed: seed, Rules: rules}
+}
+
+// Dial implements Transport
+func (t *FaultTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(conn), nil
+}
+
+// Listen implements Transport
+func (t *FaultTransport) Listen(addr string) (Listener, error) {
+	l, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &faultListener{Listener: l, t: t}, nil
+}
+
+// Stats returns the faults injected so far
+func (t *FaultTransport) Stats() FaultStats {
+	return FaultStats{
+		Dropped:    t.dropped.Load(),
+		Duplicated: t.duplicated.Load(),
+		Reordered:  t.reordered.Load(),
+		Corrupted:  t.corrupted.Load(),
+		Delayed:    t.delayed.Load(),
+	}
+}
+
+// wrap makes conn subject to the transport's faults
+func (t *FaultTransport) wrap(conn Conn) *faultConn {
+	return &faultConn{Conn: conn, t: t, done: make(chan struct{})}
+}
+
+// faults is what happens to one message
+type faults struct {
+	drop, duplicate, reorder, corrupt bool
+	delay                             time.Duration
+}
+
+// judge draws the faults of m travelling in dir on a connection to addr
+func (t *FaultTransport) judge(dir FaultDirection, addr string, m *Message) faults {
+	var f faults
+	i := slices.IndexFunc(t.Rules, func(r FaultRule) bool { return r.matches(dir, addr, m) })
+	if i < 0 {
+		return f
+	}
+	r := &t.Rules[i]
+	f.drop = t.chance(r.Drop)
+	f.duplicate = t.chance(r.Duplicate)
+	f.reorder = t.chance(r.Reorder)
+	f.corrupt = t.chance(r.Corrupt)
+	if t.chance(r.Delay) {
+		f.delay = r.MinDelay
+		if r.MaxDelay > r.MinDelay {
+			f.delay += time.Duration(t.float64() * float64(r.MaxDelay-r.MinDelay))
+		}
+	}
+	if f.drop {
+		t.dropped.Add(1)
+		return f
+	}
+	if f.duplicate {
+		t.duplicated.Add(1)
+	}
+	if f.reorder {
+		t.reordered.Add(1)
+	}
+	if f.corrupt {
+		t.corrupted.Add(1)
+	}
+	if f.delay > 0 {
+		t.delayed.Add(1)
+	}
+	return f
+}
+
+// chance reports true with probability p; p of zero draws nothing, so
+// rules that leave a fault out do not disturb the others' randomness
+func (t *FaultTransport) chance(p float64) bool {
+	return p > 0 && t.float64() < p
+}
+
+// float64 draws from the transport's random source
+func (t *FaultTransport) float64() float64 {
+	if t.Sim != nil {
+		return t.Sim.Float64()
+	}
+	t.once.Do(func() { t.rng = rand.New(rand.NewPCG(t.Seed, t.Seed^0x5deece66d)) })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rng.Float64()
+}
+
+// corrupt returns a copy of m with one bit flipped
+func (t *FaultTransport) corrupt(m *Message) *Message {
+	cp := *m
+	if len(m.Payload) == 0 {
+		cp.ID ^= 1 << int(t.float64()*64)
+		return &cp
+	}
+	cp.Payload = slices.Clone(m.Payload)
+	bit := int(t.float64() * float64(8*len(cp.Payload)))
+	cp.Payload[bit/8] ^= 1 << (bit % 8)
+	return &cp
+}
+
+// after runs fn once d has passed, on the simulation's clock if there is one
+func (t *FaultTransport) after(d time.Duration, fn func()) {
+	if t.Sim != nil {
+		t.Sim.AfterFunc(d, "fault delay", fn)
+		return
+	}
+	time.AfterFunc(d, fn)
+}
+
+// sleep blocks for d, on the simulation's clock if there is one
+func (t *FaultTransport) sleep(d time.Duration) {
+	if t.Sim != nil {
+		t.Sim.Sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// faultListener wraps the connections a FaultTransport accepts
+type faultListener struct {
+	Listener
+	t *FaultTransport
+}
+
+func (l *faultListener) Accept() (Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.t.wrap(conn), nil
+}
+
+// faultConn injects faults into the messages of one connection. Outgoing
+// messages that are delayed or reordered are sent later from another
+// goroutine, or are lost if the connection closes first; incoming ones are
+// held up in Recv, so a delay there also delays the messages behind it, as
+// on a stream
+type faultConn struct {
+	Conn
+	t    *FaultTransport
+	done chan struct{}
+	once sync.Once
+
+	mu sync.Mutex
+	// held is an outgoing message waiting to be overtaken
+	held *Message
+	// heldIn is an incoming message waiting to be overtaken; it is lost if
+	// nothing follows it
+	heldIn *Message
+	// pending are incoming messages to return before reading more
+	pending []*Message
+}
+
+func (c *faultConn) Send(m *Message) error {
+	f := c.t.judge(FaultOutbound, c.RemoteAddr(), m)
+	if f.drop {
+		return nil
+	}
+	if f.corrupt {
+		m = c.t.corrupt(m)
+	}
+	if f.delay > 0 {
+		cp := *m
+		cp.Payload = slices.Clone(m.Payload)
+		c.t.after(f.delay, func() { c.deliver(&cp, f.duplicate) })
+		return nil
+	}
+	if f.reorder {
+		c.mu.Lock()
+		if c.held == nil {
+			cp := *m
+			cp.Payload = slices.Clone(m.Payload)
+			c.held = &cp
+			c.mu.Unlock()
+			c.t.after(faultReorderWindow, c.release)
+			return nil
+		}
+		c.mu.Unlock()
+	}
+	if err := c.send(m, f.duplicate); err != nil {
+		return err
+	}
+	c.release()
+	return nil
+}
+
+// send sends m, twice if duplicate is set
+func (c *faultConn) send(m *Message, duplicate bool) error {
+	if err := c.Conn.Send(m); err != nil {
+		return err
+	}
+	if duplicate {
+		return c.Conn.Send(m)
+	}
+	return nil
+}
+
+// deliver sends a message that was held back unless the connection has
+// closed since
+func (c *faultConn) deliver(m *Message, duplicate bool) {
+	select {
+	case <-c.done:
+	default:
+		c.send(m, duplicate)
+	}
+}
+
+// release sends the message held back for reordering, if there is one
+func (c *faultConn) release() {
+	c.mu.Lock()
+	m := c.held
+	c.held = nil
+	c.mu.Unlock()
+	if m != nil {
+		c.deliver(m, false)
+	}
+}
+
+func (c *faultConn) Recv() (*Message, error) {
+	for {
+		c.mu.Lock()
+		if len(c.pending) > 0 {
+			m := c.pending[0]
+			c.pending = c.pending[1:]
+			c.mu.Unlock()
+			return m, nil
+		}
+		c.mu.Unlock()
+
+		m, err := c.Conn.Recv()
+		if err != nil {
+			return nil, err
+		}
+		f := c.t.judge(FaultInbound, c.RemoteAddr(), m)
+		if f.drop {
+			continue
+		}
+		if f.corrupt {
+			m = c.t.corrupt(m)
+		}
+		if f.delay > 0 {
+			c.t.sleep(f.delay)
+		}
+		c.mu.Lock()
+		if f.reorder && c.heldIn == nil {
+			c.heldIn = m
+			c.mu.Unlock()
+			continue
+		}
+		if f.duplicate {
+			cp := *m
+			cp.Payload = slices.Clone(m.Payload)
+			c.pending = append(c.pending, &cp)
+		}
+		if c.heldIn != nil {
+			c.pending = append(c.pending, c.heldIn)
+			c.heldIn = nil
+		}
+		c.mu.Unlock()
+		return m, nil
+	}
+}
+
+func (c *faultConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// Peer passes through the identity of the wrapped connection
+func (c *faultConn) Peer() (PeerIdentity, bool) {
+	return PeerOf(c.Conn)
+}
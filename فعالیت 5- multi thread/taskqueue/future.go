@@ -0,0 +1,76 @@
+package taskqueue
+
+import "sync"
+
+// Callable is a task that produces a result or an error
+type Callable func() (any, error)
+
+// Future is a handle to the eventual result of a submitted task
+type Future struct {
+	once  sync.Once
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// newFuture creates a pending future
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// complete records the task outcome and releases waiters; later calls are ignored
+func (f *Future) complete(value any, err error) {
+	f.once.Do(func() {
+		f.value = value
+		f.err = err
+		close(f.done)
+	})
+}
+
+// Get blocks until the task has finished and returns its result
+func (f *Future) Get() (any, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// Done returns a channel that is closed once the task has finished
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the task error, or nil while the task is still pending
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// TypedFuture is a Future whose result has the static type T
+type TypedFuture[T any] struct {
+	future *Future
+}
+
+// CallTyped submits fn to p and returns a future carrying its typed result
+func CallTyped[T any](p Executor, fn func() (T, error)) *TypedFuture[T] {
+	return &TypedFuture[T]{future: p.Call(func() (any, error) { return fn() })}
+}
+
+// Get blocks until the task has finished and returns its typed result
+func (f *TypedFuture[T]) Get() (T, error) {
+	v, err := f.future.Get()
+	result, _ := v.(T)
+	return result, err
+}
+
+// Done returns a channel that is closed once the task has finished
+func (f *TypedFuture[T]) Done() <-chan struct{} {
+	return f.future.Done()
+}
+
+// Err returns the task error, or nil while the task is still pending
+func (f *TypedFuture[T]) Err() error {
+	return f.future.Err()
+}
@@ -0,0 +1,135 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// WebSocketGateway lets clients that only speak WebSocket, browsers among
+// them, submit tasks to a coordinator and have the results pushed back as
+// they complete, through the same dispatch path as the gRPC service. Every
+// text message is a JSON gatewayFrame: clients send submits, which are
+// answered with an accepted frame carrying the task's ID and later a result
+// frame. The tasks of a connection are cancelled when it closes
+type WebSocketGateway struct {
+	coord *Coordinator
+	// Origins lists the origins, such as "https://example.com", whose pages
+	// may connect. By default only pages served from the gateway's own host
+	// may; clients outside browsers send no origin and are not checked
+	Origins []string
+}
+
+// NewWebSocketGateway creates a gateway submitting to coord. If coord
+// requires tokens, clients present one granting ScopeSubmit as a bearer
+// token or, since browsers cannot set headers on WebSocket handshakes, in
+// the token query parameter
+func NewWebSocketGateway(coord *Coordinator) *WebSocketGateway {
+	return &WebSocketGateway{coord: coord}
+}
+
+// gatewayFrame is a message between a gateway and its client. Payloads are
+// strings, so the tasks served through a gateway should take and produce
+// text
+type gatewayFrame struct {
+	// Op is "submit" from clients, and "accepted", "result" or "error"
+	// from the gateway
+	Op string `json:"op"`
+	// Ref is chosen by the client and repeated in the frames answering its
+	// submit, to tell them apart before the ID is known
+	Ref     string `json:"ref,omitempty"`
+	ID      uint64 `json:"id,omitempty"`
+	Task    string `json:"task,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// allowOrigin reports whether a page from the origin of r may connect
+func (g *WebSocketGateway) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(g.Origins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// ServeHTTP upgrades r and serves the client until it disconnects
+func (g *WebSocketGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.allowOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if err := g.coord.authorize(token, ScopeSubmit); err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, ErrPermissionDenied) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.close()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// The tasks outlive the request's context, which ends once the
+	// connection is taken over, until the client is gone
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	send := func(f gatewayFrame) {
+		b, _ := json.Marshal(f)
+		ws.writeFrame(wsText, b)
+	}
+
+	var nextID uint64
+	for {
+		b, text, err := ws.readMessage()
+		if err != nil {
+			return
+		}
+		var req gatewayFrame
+		if !text || json.Unmarshal(b, &req) != nil {
+			send(gatewayFrame{Op: "error", Error: "expected a JSON text message"})
+			continue
+		}
+		if req.Op != "submit" || req.Task == "" {
+			send(gatewayFrame{Op: "error", Ref: req.Ref, Error: "expected a submit naming a task"})
+			continue
+		}
+
+		nextID++
+		id := nextID
+		var future *Future
+		if req.Key != "" {
+			future = g.coord.SubmitIdempotent(ctx, req.Key, req.Task, []byte(req.Payload))
+		} else {
+			future = g.coord.Submit(ctx, req.Task, []byte(req.Payload))
+		}
+		send(gatewayFrame{Op: "accepted", Ref: req.Ref, ID: id, Task: req.Task})
+		wg.Go(func() {
+			res := gatewayFrame{Op: "result", Ref: req.Ref, ID: id}
+			if v, err := future.Get(); err != nil {
+				res.Error = err.Error()
+			} else {
+				out, _ := v.([]byte)
+				res.Payload = string(out)
+			}
+			if ctx.Err() == nil {
+				send(res)
+			}
+		})
+	}
+}
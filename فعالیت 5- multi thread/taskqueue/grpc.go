@@ -0,0 +1,651 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// grpcService is the path prefix of the TaskQueue service methods
+const grpcService = "/distributed.TaskQueue/"
+
+// gRPC status codes used by the service
+const (
+	grpcOK            = 0
+	grpcInvalidArg    = 3
+	grpcDenied        = 7
+	grpcUnimplemented = 12
+	grpcUnavailable   = 14
+	grpcUnauthorized  = 16
+)
+
+// GRPCServer serves the TaskQueue service of proto/taskqueue.proto over
+// HTTP/2, without TLS unless served with ServeTLS. Workers joining through RegisterWorker are handed to
+// the coordinator like TCP workers, since each stream is a Conn
+type GRPCServer struct {
+	coord   *Coordinator
+	http    *http.Server
+	streams chan Conn
+	done    chan struct{}
+	close   sync.Once
+	addr    string
+	// ResultTTL is how long StreamResults can still fetch the result of a
+	// completed task. Defaults to 10m
+	ResultTTL time.Duration
+
+	mu      sync.Mutex
+	nextID  uint64
+	results map[uint64]*Future // submitted tasks whose results were not streamed yet
+}
+
+// NewGRPCServer creates a server submitting to coord and registering its
+// workers with it; a nil coord serves only RegisterWorker
+func NewGRPCServer(coord *Coordinator) *GRPCServer {
+	s := &GRPCServer{
+		coord:     coord,
+		streams:   make(chan Conn),
+		done:      make(chan struct{}),
+		ResultTTL: 10 * time.Minute,
+		results:   make(map[uint64]*Future),
+	}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	protocols.SetHTTP2(true)
+	s.http = &http.Server{Handler: s, Protocols: &protocols}
+	if coord != nil {
+		go coord.Serve(s)
+	}
+	return s
+}
+
+// ListenAndServe serves the service on addr until the server is closed
+func (s *GRPCServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the service on l until the server is closed
+func (s *GRPCServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.addr = l.Addr().String()
+	s.mu.Unlock()
+	err := s.http.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// ServeTLS serves the service over TLS with cfg on l until the server is
+// closed; cfg may come from TLSCredentials.Config
+func (s *GRPCServer) ServeTLS(l net.Listener, cfg *tls.Config) error {
+	return s.Serve(tls.NewListener(l, tlsWithNextProtos(cfg, "h2")))
+}
+
+// Accept implements Listener, returning the next RegisterWorker stream
+func (s *GRPCServer) Accept() (Conn, error) {
+	select {
+	case c := <-s.streams:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements Listener, stopping the HTTP server and every open stream
+func (s *GRPCServer) Close() error {
+	var err error
+	s.close.Do(func() {
+		close(s.done)
+		err = s.http.Close()
+	})
+	return err
+}
+
+// Addr implements Listener
+func (s *GRPCServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// ServeHTTP routes gRPC calls to the service methods
+func (s *GRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2 POST", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	switch r.URL.Path {
+	case grpcService + "SubmitTask":
+		s.submitTask(w, r)
+	case grpcService + "StreamResults":
+		s.streamResults(w, r)
+	case grpcService + "RegisterWorker":
+		s.registerWorker(w, r)
+	default:
+		grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+	}
+}
+
+// authorized checks the bearer token of a client call if the coordinator
+// requires tokens, answering with the status of a refused one; workers prove
+// themselves in their register envelope instead
+func (s *GRPCServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.coord == nil {
+		return true
+	}
+	err := s.coord.authorize(bearerToken(r), ScopeSubmit)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrPermissionDenied):
+		grpcStatus(w, grpcDenied, err.Error())
+	default:
+		grpcStatus(w, grpcUnauthorized, err.Error())
+	}
+	return false
+}
+
+// submitTask queues the task of a unary request and replies with its ID
+func (s *GRPCServer) submitTask(w http.ResponseWriter, r *http.Request) {
+	if s.coord == nil {
+		grpcStatus(w, grpcUnimplemented, "no coordinator")
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+	b, err := readGRPCMessage(r.Body)
+	var req Message
+	if err == nil {
+		err = req.UnmarshalProto(b)
+	}
+	if err != nil || req.Task == "" {
+		grpcStatus(w, grpcInvalidArg, "expected an envelope naming a task")
+		return
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.mu.Unlock()
+
+	// The task outlives the call, unless the call is cancelled before the
+	// client learns the ID it would stream the result under
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	var future *Future
+	if req.Key != "" {
+		future = s.coord.SubmitIdempotent(ctx, req.Key, req.Task, req.Payload)
+	} else {
+		future = s.coord.Submit(ctx, req.Task, req.Payload)
+	}
+	s.mu.Lock()
+	s.results[id] = future
+	s.mu.Unlock()
+	go s.expire(id, future, cancel)
+
+	reply := &Message{Type: MsgDispatch, ID: id, Task: req.Task}
+	if writeGRPCMessage(w, reply.MarshalProto()) != nil || r.Context().Err() != nil {
+		cancel()
+		return
+	}
+	grpcStatus(w, grpcOK, "")
+}
+
+// expire releases the context of task id once it completes and forgets its
+// result ResultTTL later, if StreamResults has not taken it by then
+func (s *GRPCServer) expire(id uint64, future *Future, cancel context.CancelFunc) {
+	<-future.Done()
+	cancel()
+	time.AfterFunc(s.ResultTTL, func() {
+		s.mu.Lock()
+		if s.results[id] == future {
+			delete(s.results, id)
+		}
+		s.mu.Unlock()
+	})
+}
+
+// streamResults sends the result of every requested task as it completes
+func (s *GRPCServer) streamResults(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(w, r) {
+		return
+	}
+	b, err := readGRPCMessage(r.Body)
+	var ids []uint64
+	if err == nil {
+		ids, err = parseResultsRequest(b)
+	}
+	if err != nil {
+		grpcStatus(w, grpcInvalidArg, "expected a results request")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	results := make(chan *Message)
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		s.mu.Lock()
+		future, ok := s.results[id]
+		delete(s.results, id)
+		s.mu.Unlock()
+		wg.Go(func() {
+			m := &Message{Type: MsgResult, ID: id}
+			if !ok {
+				m.Error = "unknown task"
+			} else if v, err := future.Get(); err != nil {
+				m.Error = err.Error()
+			} else {
+				m.Payload, _ = v.([]byte)
+			}
+			select {
+			case results <- m:
+			case <-r.Context().Done():
+			}
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for m := range results {
+		if err := writeGRPCMessage(w, m.MarshalProto()); err != nil {
+			return
+		}
+		flush(w)
+	}
+	grpcStatus(w, grpcOK, "")
+}
+
+// registerWorker hands the stream to the coordinator and holds it open until
+// either side closes it
+func (s *GRPCServer) registerWorker(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+	stream := &grpcStream{
+		r:      r.Body,
+		w:      w,
+		flush:  func() { flush(w) },
+		remote: r.RemoteAddr,
+		tls:    r.TLS,
+		closed: make(chan struct{}),
+	}
+	select {
+	case s.streams <- stream:
+	case <-s.done:
+		grpcStatus(w, grpcUnavailable, "server is closed")
+		return
+	}
+
+	select {
+	case <-stream.closed:
+	case <-r.Context().Done():
+	case <-s.done:
+	}
+	stream.Close()
+	grpcStatus(w, grpcOK, "")
+}
+
+// grpcStream is a Conn over one bidirectional gRPC stream
+type grpcStream struct {
+	r      io.Reader
+	w      io.Writer
+	flush  func()
+	remote string
+	tls    *tls.ConnectionState
+	cancel func() // client side: aborts the request
+
+	wmu       sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *grpcStream) Send(m *Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	if err := writeGRPCMessage(c.w, m.MarshalProto()); err != nil {
+		return err
+	}
+	c.flush()
+	return nil
+}
+
+func (c *grpcStream) Recv() (*Message, error) {
+	b, err := readGRPCMessage(c.r)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Message)
+	if err := m.UnmarshalProto(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Close ends the stream; once it returns no further writes reach the
+// underlying response or request body
+func (c *grpcStream) Close() error {
+	c.closeOnce.Do(func() {
+		c.wmu.Lock()
+		close(c.closed)
+		c.wmu.Unlock()
+		if closer, ok := c.w.(io.Closer); ok {
+			closer.Close()
+		}
+		if c.cancel != nil {
+			c.cancel()
+		}
+	})
+	return nil
+}
+
+func (c *grpcStream) RemoteAddr() string { return c.remote }
+
+// Peer returns the identity the other end proved during the TLS handshake
+func (c *grpcStream) Peer() (PeerIdentity, bool) { return peerIdentity(c.tls) }
+
+// GRPCTransport connects workers to a GRPCServer through RegisterWorker
+type GRPCTransport struct {
+	// TLS, if set, secures the streams Dial opens and the server Listen
+	// starts
+	TLS *tls.Config
+	// Client defaults to a client speaking HTTP/2, over TLS if TLS is set
+	Client *http.Client
+}
+
+// Dial implements Transport by opening a RegisterWorker stream
+func (t *GRPCTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	client := t.Client
+	if client == nil {
+		client = grpcHTTPClient(t.TLS)
+	}
+	resp, err := grpcCall(ctx, client, grpcBaseURL(addr, t.TLS), "", "RegisterWorker", pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &grpcStream{
+		r:      resp.Body,
+		w:      pw,
+		flush:  func() {},
+		remote: addr,
+		tls:    resp.TLS,
+		cancel: func() {
+			cancel()
+			resp.Body.Close()
+		},
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Listen implements Transport with a server that only accepts workers
+func (t *GRPCTransport) Listen(addr string) (Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := NewGRPCServer(nil)
+	s.addr = l.Addr().String()
+	if t.TLS != nil {
+		go s.ServeTLS(l, t.TLS)
+	} else {
+		go s.Serve(l)
+	}
+	return s, nil
+}
+
+// GRPCClient submits tasks to a GRPCServer and collects their results
+type GRPCClient struct {
+	base   string
+	client *http.Client
+	token  string
+}
+
+// NewGRPCClient creates a client for the server at addr
+func NewGRPCClient(addr string) *GRPCClient {
+	return NewGRPCTLSClient(addr, nil)
+}
+
+// NewGRPCTLSClient creates a client for the server at addr that connects
+// over TLS with cfg, or without TLS if cfg is nil
+func NewGRPCTLSClient(addr string, cfg *tls.Config) *GRPCClient {
+	return &GRPCClient{base: grpcBaseURL(addr, cfg), client: grpcHTTPClient(cfg)}
+}
+
+// SetToken makes the client send token with its calls, for servers whose
+// coordinator was created with WithTokenAuth; it must grant ScopeSubmit. It
+// must not be called concurrently with calls
+func (c *GRPCClient) SetToken(token string) {
+	c.token = token
+}
+
+// SubmitTask queues a call of the named handler and returns its task ID
+func (c *GRPCClient) SubmitTask(ctx context.Context, task string, payload []byte) (uint64, error) {
+	return c.submit(ctx, &Message{Task: task, Payload: payload})
+}
+
+// SubmitIdempotentTask is like SubmitTask, but the coordinator runs the task
+// at most once for all submissions under key; see Coordinator.SubmitIdempotent
+func (c *GRPCClient) SubmitIdempotentTask(ctx context.Context, key, task string, payload []byte) (uint64, error) {
+	return c.submit(ctx, &Message{Key: key, Task: task, Payload: payload})
+}
+
+// submit sends req as a SubmitTask call
+func (c *GRPCClient) submit(ctx context.Context, req *Message) (uint64, error) {
+	var body bytes.Buffer
+	writeGRPCMessage(&body, req.MarshalProto())
+
+	resp, err := grpcCall(ctx, c.client, c.base, c.token, "SubmitTask", &body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := readGRPCMessage(resp.Body)
+	if err != nil {
+		return 0, grpcTrailerError(resp, err)
+	}
+	var reply Message
+	if err := reply.UnmarshalProto(b); err != nil {
+		return 0, err
+	}
+	return reply.ID, nil
+}
+
+// StreamResults calls fn with the result of each task in ids as it
+// completes; a result's Error is set if the task failed
+func (c *GRPCClient) StreamResults(ctx context.Context, ids []uint64, fn func(result *Message)) error {
+	var body bytes.Buffer
+	writeGRPCMessage(&body, appendResultsRequest(nil, ids))
+
+	resp, err := grpcCall(ctx, c.client, c.base, c.token, "StreamResults", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for {
+		b, err := readGRPCMessage(resp.Body)
+		if err != nil {
+			return grpcTrailerError(resp, err)
+		}
+		m := new(Message)
+		if err := m.UnmarshalProto(b); err != nil {
+			return err
+		}
+		fn(m)
+	}
+}
+
+// appendResultsRequest encodes a ResultsRequest with packed IDs
+func appendResultsRequest(b []byte, ids []uint64) []byte {
+	var packed []byte
+	for _, id := range ids {
+		packed = binary.AppendUvarint(packed, id)
+	}
+	return appendProtoBytes(b, 1, packed)
+}
+
+// parseResultsRequest decodes a ResultsRequest, packed or not
+func parseResultsRequest(b []byte) ([]uint64, error) {
+	var ids []uint64
+	err := parseProto(b, func(f protoField) error {
+		if f.Num != 1 {
+			return nil
+		}
+		if f.Type == protoVarint {
+			ids = append(ids, f.Varint)
+			return nil
+		}
+		for p := f.Bytes; len(p) > 0; {
+			id, n := binary.Uvarint(p)
+			if n <= 0 {
+				return errMalformedProto
+			}
+			ids = append(ids, id)
+			p = p[n:]
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// grpcCall starts a call of method on the server at base with body as the
+// request stream, sending token as a bearer token if it is set, and returns
+// once the response headers arrive
+func grpcCall(ctx context.Context, client *http.Client, base, token, method string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+grpcService+method, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("grpc %s: HTTP status %s", method, resp.Status)
+	}
+	return resp, nil
+}
+
+// grpcBaseURL returns the URL of the server at addr, reached over TLS if
+// cfg is set
+func grpcBaseURL(addr string, cfg *tls.Config) string {
+	if cfg != nil {
+		return "https://" + addr
+	}
+	return "http://" + addr
+}
+
+// grpcHTTPClient returns an HTTP client speaking HTTP/2 over TLS with cfg,
+// or without TLS if cfg is nil
+func grpcHTTPClient(cfg *tls.Config) *http.Client {
+	var protocols http.Protocols
+	if cfg == nil {
+		protocols.SetUnencryptedHTTP2(true)
+		return &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	}
+	protocols.SetHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: &protocols, TLSClientConfig: cfg}}
+}
+
+// grpcTrailerError turns the end of a response stream into the call's
+// error: nil on a clean end with status OK, the status otherwise
+func grpcTrailerError(resp *http.Response, readErr error) error {
+	if readErr != io.EOF {
+		return readErr
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("grpc: missing status: %w", io.ErrUnexpectedEOF)
+	}
+	if code == grpcOK {
+		return nil
+	}
+	msg := resp.Trailer.Get("Grpc-Message")
+	if msg == "" {
+		msg = resp.Header.Get("Grpc-Message")
+	}
+	return &GRPCStatusError{Code: code, Message: msg}
+}
+
+// grpcStatus ends a response with the given status trailers
+func grpcStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", msg)
+	}
+}
+
+// flush sends buffered response data to the client
+func flush(w http.ResponseWriter) {
+	http.NewResponseController(w).Flush()
+}
+
+// writeGRPCMessage writes b as an uncompressed gRPC length-prefixed message
+func writeGRPCMessage(w io.Writer, b []byte) error {
+	if len(b) > maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(b)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readGRPCMessage reads one gRPC length-prefixed message; compressed
+// messages are rejected since the service never negotiates compression
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("grpc: compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
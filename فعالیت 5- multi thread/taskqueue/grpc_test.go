@@ -0,0 +1,81 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// grpcSubmit calls SubmitTask of s for task with ctx, returning the ID it
+// answered with
+func grpcSubmit(t *testing.T, s *GRPCServer, ctx context.Context, task string) uint64 {
+	t.Helper()
+	var body bytes.Buffer
+	req := &Message{Task: task}
+	if err := writeGRPCMessage(&body, req.MarshalProto()); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, grpcService+"SubmitTask", &body)
+	r.ProtoMajor = 2
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	b, err := readGRPCMessage(w.Body)
+	var reply Message
+	if err == nil {
+		err = reply.UnmarshalProto(b)
+	}
+	if err != nil {
+		t.Fatalf("SubmitTask reply: %v", err)
+	}
+	return reply.ID
+}
+
+// grpcResult returns the future the server holds for task id, if any
+func grpcResult(s *GRPCServer, id uint64) (*Future, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.results[id]
+	return f, ok
+}
+
+func TestGRPCServerCancelledSubmit(t *testing.T) {
+	coord := NewCoordinator()
+	defer coord.Close()
+	s := NewGRPCServer(coord)
+	defer s.Close()
+	s.ResultTTL = 10 * time.Millisecond
+
+	// Without workers the tasks stay queued until cancelled
+	pending := grpcSubmit(t, s, context.Background(), "echo")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := grpcSubmit(t, s, ctx, "echo")
+
+	f, ok := grpcResult(s, cancelled)
+	if !ok {
+		t.Fatal("no result held for the cancelled call")
+	}
+	select {
+	case <-f.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task of a cancelled call kept running")
+	}
+	if !errors.Is(f.Err(), context.Canceled) {
+		t.Errorf("task of a cancelled call failed with %v, want context.Canceled", f.Err())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, ok := grpcResult(s, cancelled); ok && time.Now().Before(deadline); _, ok = grpcResult(s, cancelled) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := grpcResult(s, cancelled); ok {
+		t.Error("result kept past ResultTTL")
+	}
+	if f, ok := grpcResult(s, pending); !ok || f.Err() != nil {
+		t.Error("pending task dropped or failed")
+	}
+}
@@ -0,0 +1,195 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// HealthCheck is one check of a node's health; it returns nil while the
+// node passes it, and must return once ctx is done
+type HealthCheck func(ctx context.Context) error
+
+// Health serves the probes of an orchestrator: "healthz" is the liveness
+// probe, failing while a liveness check fails, after which the node should
+// be restarted, and "readyz" the readiness probe, failing while any check
+// fails, liveness or readiness, during which the node should get no
+// traffic. Requests are routed by the last element of their path, so both
+// can be mounted with the one handler. Each answers 200 or 503, with the
+// outcome of every check as JSON
+type Health struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	live  map[string]HealthCheck
+	ready map[string]HealthCheck
+}
+
+// HealthReport is the outcome of a probe
+type HealthReport struct {
+	// Status is "ok" if every check passed, and "failing" otherwise
+	Status string `json:"status"`
+	// Checks is "ok" or the error of each check, by name
+	Checks map[string]string `json:"checks"`
+}
+
+// NewHealth creates a Health with no checks, which gives each check
+// timeout to pass, 2s if it is not positive
+func NewHealth(timeout time.Duration) *Health {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &Health{timeout: timeout, live: make(map[string]HealthCheck), ready: make(map[string]HealthCheck)}
+}
+
+// AddLiveness adds a liveness check under name, replacing any with the
+// same name
+func (h *Health) AddLiveness(name string, check HealthCheck) {
+	h.mu.Lock()
+	h.live[name] = check
+	h.mu.Unlock()
+}
+
+// AddReadiness adds a readiness check under name, replacing any with the
+// same name
+func (h *Health) AddReadiness(name string, check HealthCheck) {
+	h.mu.Lock()
+	h.ready[name] = check
+	h.mu.Unlock()
+}
+
+// Live runs the liveness checks
+func (h *Health) Live(ctx context.Context) HealthReport {
+	return h.run(ctx, false)
+}
+
+// Ready runs every check
+func (h *Health) Ready(ctx context.Context) HealthReport {
+	return h.run(ctx, true)
+}
+
+// run runs the liveness checks, and the readiness checks with ready, all
+// at once
+func (h *Health) run(ctx context.Context, ready bool) HealthReport {
+	h.mu.Lock()
+	checks := make(map[string]HealthCheck, len(h.live)+len(h.ready))
+	for name, check := range h.live {
+		checks[name] = check
+	}
+	if ready {
+		for name, check := range h.ready {
+			checks[name] = check
+		}
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	report := HealthReport{Status: "ok", Checks: make(map[string]string, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Go(func() {
+			result := "ok"
+			if err := runHealthCheck(ctx, check); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			report.Checks[name] = result
+			if result != "ok" {
+				report.Status = "failing"
+			}
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	return report
+}
+
+// runHealthCheck runs check, failing it if it has not returned once ctx is
+// done, as a hung dependency should fail the probe rather than hang it
+func runHealthCheck(ctx context.Context, check HealthCheck) error {
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check did not finish: %w", context.Cause(ctx))
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var report HealthReport
+	switch path.Base(r.URL.Path) {
+	case "healthz":
+		report = h.Live(r.Context())
+	case "readyz":
+		report = h.Ready(r.Context())
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Mount registers h on mux at /healthz and /readyz
+func (h *Health) Mount(mux *http.ServeMux) {
+	mux.Handle("/healthz", h)
+	mux.Handle("/readyz", h)
+}
+
+// PoolCheck fails with ErrPoolSaturated while every worker of pool is busy
+// and more than maxQueued tasks wait for one
+func PoolCheck(pool Executor, maxQueued int) HealthCheck {
+	return func(context.Context) error {
+		s := pool.Stats()
+		if s.Running >= s.Workers && s.Queued > maxQueued {
+			return fmt.Errorf("%w: all %d workers busy and %d tasks queued", ErrPoolSaturated, s.Workers, s.Queued)
+		}
+		return nil
+	}
+}
+
+// LeaderCheck fails with ErrNotLeader while isLeader reports false, for a
+// node that serves only while it leads, such as a coordinator standing by
+// under an election.Bully
+func LeaderCheck(isLeader func() bool) HealthCheck {
+	return func(context.Context) error {
+		if !isLeader() {
+			return fmt.Errorf("%w: standing by", ErrNotLeader)
+		}
+		return nil
+	}
+}
+
+// StorageCheck fails while a file cannot be created, written, synced and
+// removed in dir, as when its disk is full, read-only or gone
+func StorageCheck(dir string) HealthCheck {
+	return func(context.Context) error {
+		f, err := os.CreateTemp(dir, ".healthz-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write([]byte("ok"))
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,207 @@
+package taskqueue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// defaultHeartbeatInterval is how often a WorkerNode sends heartbeats unless
+// HeartbeatEvery says otherwise
+const defaultHeartbeatInterval = time.Second
+
+// WorkerState is the coordinator's verdict on a worker's health
+type WorkerState int
+
+const (
+	// WorkerAlive means the worker was heard from recently
+	WorkerAlive WorkerState = iota
+	// WorkerSuspect means the worker missed enough heartbeats to be
+	// suspected; it is given no new tasks until it is heard from again
+	WorkerSuspect
+	// WorkerDead means the worker stayed silent past the dead threshold, or
+	// its connection failed, and it was disconnected
+	WorkerDead
+)
+
+// String returns the state name
+func (s WorkerState) String() string {
+	switch s {
+	case WorkerAlive:
+		return "alive"
+	case WorkerSuspect:
+		return "suspect"
+	case WorkerDead:
+		return "dead"
+	default:
+		return fmt.Sprintf("WorkerState(%d)", int(s))
+	}
+}
+
+// HeartbeatConfig configures the coordinator's failure detector. Any message
+// from a worker counts as a heartbeat
+type HeartbeatConfig struct {
+	// Interval is how often workers are expected to send heartbeats; it must
+	// not be shorter than the workers' HeartbeatEvery setting
+	Interval time.Duration
+	// Suspicion is the number of missed intervals after which a worker is
+	// suspected; defaults to 3
+	Suspicion int
+	// Dead is the number of missed intervals after which a worker is
+	// disconnected; defaults to twice Suspicion
+	Dead int
+	// OnChange, if set, is called on every state change of a worker, outside
+	// the coordinator lock
+	OnChange func(worker string, state WorkerState)
+}
+
+// HeartbeatStats counts the failure detector's verdicts
+type HeartbeatStats struct {
+	// Alive and Suspect are the connected workers in each state
+	Alive, Suspect int
+	// Suspected, Recovered and Dead count transitions since the coordinator
+	// started
+	Suspected, Recovered, Dead uint64
+}
+
+// WithHeartbeat enables failure detection of remote workers
+func WithHeartbeat(cfg HeartbeatConfig) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		if cfg.Suspicion <= 0 {
+			cfg.Suspicion = 3
+		}
+		if cfg.Dead <= cfg.Suspicion {
+			cfg.Dead = 2 * cfg.Suspicion
+		}
+		c.heartbeat = cfg
+	}
+}
+
+// stateChange is a worker state change waiting to be reported
+type stateChange struct {
+	worker string
+	state  WorkerState
+}
+
+// notify reports changes to the OnChange hook
+func (c *Coordinator) notify(changes ...stateChange) {
+	for _, ch := range changes {
+		level := slog.LevelDebug
+		if ch.state == WorkerSuspect {
+			level = slog.LevelWarn
+		}
+		c.log.Log(context.Background(), level, "worker state changed", LogKeyWorker, ch.worker, "state", ch.state)
+	}
+	if fn := c.config.heartbeat.OnChange; fn != nil {
+		for _, ch := range changes {
+			fn(ch.worker, ch.state)
+		}
+	}
+}
+
+// heard records that w is alive, clearing any suspicion
+func (c *Coordinator) heard(w *workerConn) {
+	c.mu.Lock()
+	w.lastSeen = time.Now()
+	recovered := w.state == WorkerSuspect
+	if recovered {
+		w.state = WorkerAlive
+		c.heartbeats.Recovered++
+	}
+	c.mu.Unlock()
+
+	if recovered {
+		c.cond.Broadcast()
+		c.notify(stateChange{w.id, WorkerAlive})
+	}
+}
+
+// monitor checks every interval how long each worker has been silent,
+// suspecting and disconnecting the quiet ones, until the coordinator closes
+func (c *Coordinator) monitor() {
+	cfg := c.config.heartbeat
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			var changes []stateChange
+			var dead []*workerConn
+			c.mu.Lock()
+			for _, w := range c.workers {
+				missed := int(now.Sub(w.lastSeen) / cfg.Interval)
+				switch {
+				case missed >= cfg.Dead:
+					dead = append(dead, w)
+				case missed >= cfg.Suspicion && w.state == WorkerAlive:
+					w.state = WorkerSuspect
+					c.heartbeats.Suspected++
+					changes = append(changes, stateChange{w.id, WorkerSuspect})
+				}
+			}
+			c.mu.Unlock()
+
+			if len(changes) > 0 && c.config.ring != nil {
+				// Keyed tasks of a suspect owner pass to the next worker
+				c.cond.Broadcast()
+			}
+			c.notify(changes...)
+			for _, w := range dead {
+				c.drop(w, fmt.Errorf("%w after %v", ErrHeartbeatTimeout, time.Duration(cfg.Dead)*cfg.Interval))
+			}
+		}
+	}
+}
+
+// WorkerStates returns the state of every connected worker
+func (c *Coordinator) WorkerStates() map[string]WorkerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make(map[string]WorkerState, len(c.workers))
+	for id, w := range c.workers {
+		states[id] = w.state
+	}
+	return states
+}
+
+// HeartbeatStats returns the failure detector counters
+func (c *Coordinator) HeartbeatStats() HeartbeatStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.heartbeats
+	for _, w := range c.workers {
+		if w.state == WorkerSuspect {
+			stats.Suspect++
+		} else {
+			stats.Alive++
+		}
+	}
+	return stats
+}
+
+// HeartbeatEvery sets how often the worker sends heartbeats to its
+// coordinators; zero or less disables them
+func (n *WorkerNode) HeartbeatEvery(d time.Duration) {
+	n.mu.Lock()
+	n.heartbeat = d
+	n.mu.Unlock()
+}
+
+// sendHeartbeats sends a heartbeat on conn every interval until done closes
+func sendHeartbeats(conn Conn, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if conn.Send(&Message{Type: MsgHeartbeat}) != nil {
+				return
+			}
+		}
+	}
+}
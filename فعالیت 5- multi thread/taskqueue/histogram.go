@@ -0,0 +1,211 @@
+package taskqueue
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// histogramSubBuckets is the number of linear buckets per power of two,
+	// giving a relative error of about 1/histogramSubBuckets
+	histogramSubBuckets = 16
+	histogramBuckets    = (64 - 3) * histogramSubBuckets
+)
+
+// Histogram records durations in log-linear buckets, in the spirit of HDR
+// histograms; recording is lock-free and safe for concurrent use
+type Histogram struct {
+	counts [histogramBuckets]atomic.Int64
+	total  atomic.Int64
+	sum    atomic.Int64
+	max    atomic.Int64
+}
+
+// histogramIndex maps a non-negative value to its bucket
+func histogramIndex(v uint64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 5 // keeps v>>shift in [16, 32)
+	return (shift+1)*histogramSubBuckets + int(v>>uint(shift)) - histogramSubBuckets
+}
+
+// histogramUpperBound returns the largest value mapped to bucket i
+func histogramUpperBound(i int) uint64 {
+	if i < histogramSubBuckets {
+		return uint64(i)
+	}
+	shift := i/histogramSubBuckets - 1
+	sub := uint64(i%histogramSubBuckets + histogramSubBuckets)
+	return (sub+1)<<uint(shift) - 1
+}
+
+// Record adds a single observation
+func (h *Histogram) Record(d time.Duration) {
+	v := max(int64(d), 0)
+	h.counts[histogramIndex(uint64(v))].Add(1)
+	h.total.Add(1)
+	h.sum.Add(v)
+	for {
+		old := h.max.Load()
+		if v <= old || h.max.CompareAndSwap(old, v) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() int64 {
+	return h.total.Load()
+}
+
+// Sum returns the total of all observations
+func (h *Histogram) Sum() time.Duration {
+	return time.Duration(h.sum.Load())
+}
+
+// Max returns the largest observation
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max.Load())
+}
+
+// Mean returns the average observation
+func (h *Histogram) Mean() time.Duration {
+	n := h.total.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(h.sum.Load() / n)
+}
+
+// Quantile returns an upper estimate of the q-th quantile, 0 <= q <= 1
+func (h *Histogram) Quantile(q float64) time.Duration {
+	n := h.total.Load()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(q*float64(n) + 0.5)
+	rank = min(max(rank, 1), n)
+
+	var seen int64
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= rank {
+			return min(time.Duration(histogramUpperBound(i)), h.Max())
+		}
+	}
+	return h.Max()
+}
+
+// Buckets returns cumulative counts at the given upper bounds, as used by
+// Prometheus-style histograms
+func (h *Histogram) Buckets(bounds []time.Duration) []int64 {
+	cumulative := make([]int64, len(bounds))
+	var seen int64
+	b := 0
+	for i := range h.counts {
+		upper := time.Duration(histogramUpperBound(i))
+		for b < len(bounds) && upper > bounds[b] {
+			cumulative[b] = seen
+			b++
+		}
+		if b == len(bounds) {
+			break
+		}
+		seen += h.counts[i].Load()
+	}
+	for ; b < len(bounds); b++ {
+		cumulative[b] = seen
+	}
+	return cumulative
+}
+
+// rateWindow counts events per second over a sliding window
+type rateWindow struct {
+	mu      sync.Mutex
+	seconds []int64
+	counts  []int64
+}
+
+// throughputWindow is the length of the sliding window used for throughput
+const throughputWindow = 10
+
+// record counts one event at now
+func (w *rateWindow) record(now time.Time) {
+	sec := now.Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.counts == nil {
+		w.seconds = make([]int64, throughputWindow)
+		w.counts = make([]int64, throughputWindow)
+	}
+	slot := int(sec % throughputWindow)
+	if w.seconds[slot] != sec {
+		w.seconds[slot] = sec
+		w.counts[slot] = 0
+	}
+	w.counts[slot]++
+}
+
+// rate returns events per second over the window ending at now
+func (w *rateWindow) rate(now time.Time) float64 {
+	sec := now.Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var total int64
+	for i := range w.counts {
+		if sec-w.seconds[i] < throughputWindow {
+			total += w.counts[i]
+		}
+	}
+	return float64(total) / throughputWindow
+}
+
+// LatencyHistograms are the latencies of tasks split by phase, which tell
+// saturation, showing as long queue waits, apart from slow tasks, showing
+// as long executions
+type LatencyHistograms struct {
+	// QueueWait is how long attempts waited to start, from being queued, or
+	// queued again for a retry or redelivery, until a worker took them
+	QueueWait *Histogram
+	// Execution is how long attempts ran
+	Execution *Histogram
+	// EndToEnd is how long tasks took from submission to their outcome,
+	// every attempt and wait between them included
+	EndToEnd *Histogram
+}
+
+// LatencySummary is a histogram reduced to its count and a few quantiles,
+// in milliseconds
+type LatencySummary struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"meanMs"`
+	P50   float64 `json:"p50Ms"`
+	P99   float64 `json:"p99Ms"`
+	Max   float64 `json:"maxMs"`
+}
+
+// PhaseLatencies summarizes each of a set of LatencyHistograms
+type PhaseLatencies struct {
+	QueueWait LatencySummary `json:"queueWait"`
+	Execution LatencySummary `json:"execution"`
+	EndToEnd  LatencySummary `json:"endToEnd"`
+}
+
+// Summary summarizes each histogram of l
+func (l LatencyHistograms) Summary() PhaseLatencies {
+	return PhaseLatencies{QueueWait: summarize(l.QueueWait), Execution: summarize(l.Execution), EndToEnd: summarize(l.EndToEnd)}
+}
+
+// summarize reduces h to a LatencySummary
+func summarize(h *Histogram) LatencySummary {
+	return LatencySummary{
+		Count: h.Count(),
+		Mean:  milliseconds(h.Mean()),
+		P50:   milliseconds(h.Quantile(0.50)),
+		P99:   milliseconds(h.Quantile(0.99)),
+		Max:   milliseconds(h.Max()),
+	}
+}
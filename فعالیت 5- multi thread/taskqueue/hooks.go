@@ -0,0 +1,82 @@
+package taskqueue
+
+import (
+	"context"
+	"time"
+)
+
+// TaskFunc is the signature every task is reduced to before it runs
+type TaskFunc func(ctx context.Context) (any, error)
+
+// Middleware wraps task execution; the first middleware registered is the
+// outermost one
+type Middleware func(next TaskFunc) TaskFunc
+
+// TaskInfo describes a task to hooks and middleware
+type TaskInfo struct {
+	ID        uint64
+	Attempt   int
+	Priority  int
+	Submitted time.Time
+}
+
+// Hooks are optional callbacks invoked as tasks move through a pool; they
+// run synchronously on the submitting or worker goroutine and must be quick
+type Hooks struct {
+	OnSubmit   func(info TaskInfo)
+	OnStart    func(info TaskInfo)
+	OnComplete func(info TaskInfo, err error, elapsed time.Duration)
+	OnPanic    func(info TaskInfo, panicErr *PanicError)
+}
+
+// taskInfoKey is the context key under which running tasks find their TaskInfo
+type taskInfoKey struct{}
+
+// TaskInfoFromContext returns the TaskInfo of the task owning ctx
+func TaskInfoFromContext(ctx context.Context) (TaskInfo, bool) {
+	info, ok := ctx.Value(taskInfoKey{}).(TaskInfo)
+	return info, ok
+}
+
+// hookList fans each event out to every registered Hooks value
+type hookList []Hooks
+
+func (l hookList) submit(info TaskInfo) {
+	for _, h := range l {
+		if h.OnSubmit != nil {
+			h.OnSubmit(info)
+		}
+	}
+}
+
+func (l hookList) start(info TaskInfo) {
+	for _, h := range l {
+		if h.OnStart != nil {
+			h.OnStart(info)
+		}
+	}
+}
+
+func (l hookList) complete(info TaskInfo, err error, elapsed time.Duration) {
+	for _, h := range l {
+		if h.OnComplete != nil {
+			h.OnComplete(info, err, elapsed)
+		}
+	}
+}
+
+func (l hookList) panic(info TaskInfo, panicErr *PanicError) {
+	for _, h := range l {
+		if h.OnPanic != nil {
+			h.OnPanic(info, panicErr)
+		}
+	}
+}
+
+// chain wraps fn in every middleware
+func chain(middleware []Middleware, fn TaskFunc) TaskFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		fn = middleware[i](fn)
+	}
+	return fn
+}
@@ -0,0 +1,114 @@
+package taskqueue
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDedupTTL is how long a successful result is remembered under its
+// idempotency key unless WithDedupTTL says otherwise
+const defaultDedupTTL = 10 * time.Minute
+
+// DedupStats reports how idempotency keys were resolved
+type DedupStats struct {
+	// Hits counts submissions answered with an earlier task's future
+	Hits uint64
+	// Misses counts submissions that started a new task
+	Misses uint64
+	// Keys is the number of keys currently remembered
+	Keys int
+}
+
+// dedupStore maps idempotency keys to the future of the task first submitted
+// under them. A key is remembered while its task runs and for ttl after it
+// succeeds; a failed task's key is forgotten at once so a retry runs it again
+type dedupStore struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*Future
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+// newDedupStore creates an empty store
+func newDedupStore(ttl time.Duration) *dedupStore {
+	return &dedupStore{ttl: ttl, entries: make(map[string]*Future)}
+}
+
+// claim returns the future already stored under key and true, or stores f
+// under key and returns it with false
+func (d *dedupStore) claim(key string, f *Future) (*Future, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if prev, ok := d.entries[key]; ok {
+		return prev, true
+	}
+	d.entries[key] = f
+	go func() {
+		var delay time.Duration
+		if _, err := f.Get(); err == nil {
+			delay = d.ttl
+		}
+		time.AfterFunc(delay, func() { d.forget(key, f) })
+	}()
+	return f, false
+}
+
+// forget removes key if it still refers to f
+func (d *dedupStore) forget(key string, f *Future) {
+	d.mu.Lock()
+	if d.entries[key] == f {
+		delete(d.entries, key)
+	}
+	d.mu.Unlock()
+}
+
+// stats returns the store's counters
+func (d *dedupStore) stats() DedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DedupStats{Hits: d.hits.Load(), Misses: d.misses.Load(), Keys: len(d.entries)}
+}
+
+// WithDedupTTL sets how long the coordinator remembers the result of a task
+// submitted with an idempotency key
+func WithDedupTTL(ttl time.Duration) CoordinatorOption {
+	return func(c *coordinatorConfig) {
+		c.dedupTTL = ttl
+	}
+}
+
+// SubmitIdempotent is like Submit, but while a task submitted under key is
+// running, or within the dedup TTL after it succeeded, it returns that task's
+// future instead of running the task again; the task runs under the context
+// of the submission that started it. The key travels with the task to
+// its worker, where handlers read it with IdempotencyKey
+func (c *Coordinator) SubmitIdempotent(ctx context.Context, key, task string, payload []byte) *Future {
+	t := &remoteTask{key: key, name: task, payload: payload, ctx: ctx, future: newFuture()}
+	if f, dup := c.dedup.claim(key, t.future); dup {
+		c.dedup.hits.Add(1)
+		return f
+	}
+	c.dedup.misses.Add(1)
+	return c.submit(t)
+}
+
+// DedupStats returns the idempotency key counters
+func (c *Coordinator) DedupStats() DedupStats {
+	return c.dedup.stats()
+}
+
+// idempotencyKey is the context key under which a worker passes a task's
+// idempotency key to its handler
+type idempotencyKey struct{}
+
+// IdempotencyKey returns the idempotency key of the remote task a handler is
+// running, or "" if it was submitted without one. Handlers whose effects
+// must happen once can record the key with them, since a redelivered task
+// may already have run
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
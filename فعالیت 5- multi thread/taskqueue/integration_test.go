@@ -0,0 +1,184 @@
+package taskqueue_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"multithread/taskqueue"
+	"multithread/testutil"
+)
+
+// startCoordinator serves coord on host "coord" of network until the test
+// ends, returning the address workers dial
+func startCoordinator(t *testing.T, network *taskqueue.MemoryNetwork, coord *taskqueue.Coordinator) string {
+	t.Helper()
+	l, err := network.Host("coord").Listen("coord/tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go coord.Serve(l)
+	t.Cleanup(func() { coord.Close() })
+	return "coord/tasks"
+}
+
+// startWorker runs worker id on a host of its own until the test ends, its
+// "whoami" handler answering with id
+func startWorker(t *testing.T, network *taskqueue.MemoryNetwork, addr, id string, capacity int) {
+	t.Helper()
+	worker := taskqueue.NewWorkerNode(id, capacity, network.Host(id))
+	worker.Handle("whoami", func(context.Context, []byte) ([]byte, error) { return []byte(id), nil })
+	worker.Handle("double", func(_ context.Context, payload []byte) ([]byte, error) {
+		n, err := strconv.Atoi(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(2 * n)), nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		worker.Run(ctx, addr)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitForWorkers waits until coord has registered every one of ids
+func waitForWorkers(t *testing.T, coord *taskqueue.Coordinator, ids ...string) {
+	t.Helper()
+	err := testutil.Eventually(5*time.Second, func() error {
+		got := coord.Workers()
+		slices.Sort(got)
+		if !slices.Equal(got, ids) {
+			return fmt.Errorf("workers %v registered, want %v", got, ids)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// result waits for f and returns its output as a string
+func result(t *testing.T, f *taskqueue.Future) string {
+	t.Helper()
+	select {
+	case <-f.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("task did not finish")
+	}
+	v, err := f.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(v.([]byte))
+}
+
+func TestCoordinatorRunsTasksOnWorkers(t *testing.T) {
+	network := taskqueue.NewMemoryNetwork()
+	coord := taskqueue.NewCoordinator()
+	addr := startCoordinator(t, network, coord)
+	startWorker(t, network, addr, "w1", 2)
+	startWorker(t, network, addr, "w2", 2)
+	waitForWorkers(t, coord, "w1", "w2")
+
+	var futures []*taskqueue.Future
+	for i := range 50 {
+		futures = append(futures, coord.Submit(context.Background(), "double", []byte(strconv.Itoa(i))))
+	}
+	for i, f := range futures {
+		if got, want := result(t, f), strconv.Itoa(2*i); got != want {
+			t.Errorf("task %d returned %s, want %s", i, got, want)
+		}
+	}
+	if depth := coord.QueueDepth(); depth != 0 {
+		t.Errorf("queue depth %d after every task finished, want 0", depth)
+	}
+}
+
+func TestSubmitKeyedRoutesByKey(t *testing.T) {
+	network := taskqueue.NewMemoryNetwork()
+	coord := taskqueue.NewCoordinator(taskqueue.WithKeyRouting(64))
+	addr := startCoordinator(t, network, coord)
+	for _, id := range []string{"w1", "w2", "w3"} {
+		startWorker(t, network, addr, id, 4)
+	}
+	waitForWorkers(t, coord, "w1", "w2", "w3")
+
+	owners := make(map[string]string)
+	used := make(map[string]bool)
+	for round := range 5 {
+		for k := range 12 {
+			key := "key-" + strconv.Itoa(k)
+			got := result(t, coord.SubmitKeyed(context.Background(), key, "whoami", nil))
+			if owner, ok := owners[key]; ok && owner != got {
+				t.Fatalf("round %d: %s ran on %s, earlier on %s", round, key, got, owner)
+			}
+			owners[key] = got
+			used[got] = true
+		}
+	}
+	if len(used) < 2 {
+		t.Errorf("12 keys all routed to %v, want them spread over the workers", owners)
+	}
+}
+
+func TestCrashedWorkerTaskIsRedelivered(t *testing.T) {
+	cluster := taskqueue.NewCluster(taskqueue.ClusterConfig{})
+	var calls atomic.Int32
+	started := make(chan struct{})
+	cluster.Handle("slow", func(ctx context.Context, _ []byte) ([]byte, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []byte("done"), nil
+	})
+	if err := cluster.AddCoordinator("coord"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"w1", "w2"} {
+		if err := cluster.AddWorker(id, "coord", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"coord", "w1"} {
+		if err := cluster.Start(name); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cluster.Stop(name) })
+	}
+	if err := cluster.WaitForWorkers("coord", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	coord := cluster.Coordinator("coord")
+
+	f := coord.Submit(context.Background(), "slow", nil)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("w1 never started the task")
+	}
+	if err := cluster.Start("w2"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Stop("w2") })
+	if err := cluster.Crash("w1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := result(t, f); got != "done" {
+		t.Errorf("redelivered task returned %q, want done", got)
+	}
+	if n := coord.Redeliveries(); n < 1 {
+		t.Errorf("%d redeliveries after w1 crashed, want at least 1", n)
+	}
+}
@@ -0,0 +1,311 @@
+package taskqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TaskState says where a listed task is
+type TaskState int
+
+const (
+	// TaskQueued tasks wait for a worker, to start or, after a failure, to
+	// be retried or redelivered
+	TaskQueued TaskState = iota
+	// TaskRunning tasks are running on a worker
+	TaskRunning
+)
+
+func (s TaskState) String() string {
+	switch s {
+	case TaskQueued:
+		return "queued"
+	case TaskRunning:
+		return "running"
+	default:
+		return fmt.Sprintf("TaskState(%d)", int(s))
+	}
+}
+
+// MarshalText encodes the state as its name
+func (s TaskState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a state encoded by MarshalText
+func (s *TaskState) UnmarshalText(b []byte) error {
+	for state := TaskQueued; state <= TaskRunning; state++ {
+		if state.String() == string(b) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown task state %q", b)
+}
+
+// TaskSnapshot describes a task that has not finished, as Tasks lists it
+type TaskSnapshot struct {
+	// Source is the name a TaskInspector knows the task's pool or
+	// coordinator by, set only in its listings
+	Source string `json:"source,omitempty"`
+	ID     uint64 `json:"id"`
+	// Name is the task name of a coordinator's task
+	Name string `json:"name,omitempty"`
+	// Correlation is the correlation ID of a coordinator's task
+	Correlation string    `json:"correlation,omitempty"`
+	State       TaskState `json:"state"`
+	Priority    int       `json:"priority"`
+	// Enqueued is when the task was submitted
+	Enqueued time.Time `json:"enqueued"`
+	// Started is when the running attempt started, zero while queued
+	Started time.Time `json:"started,omitzero"`
+	// Worker is the worker running the task, empty while queued or when the
+	// pool does not run tasks on workers of its own
+	Worker string `json:"worker,omitempty"`
+	// Attempt counts the task's attempts or deliveries, the running or next
+	// one included
+	Attempt int `json:"attempt"`
+}
+
+// TaskLister is implemented by what can list its unfinished tasks: every
+// pool created WithTaskTracking, and a Coordinator
+type TaskLister interface {
+	Tasks() []TaskSnapshot
+}
+
+// TaskFilter selects and pages listed tasks. Its zero value selects all of
+// them
+type TaskFilter struct {
+	// State, if set, selects the tasks in that state
+	State *TaskState
+	// Worker and Name, if set, select the tasks on that worker and of that
+	// name
+	Worker string
+	Name   string
+	// OlderThan, if set, selects the tasks enqueued at least that long ago
+	OlderThan time.Duration
+	// Offset is the number of selected tasks skipped, and Limit the most
+	// returned after them, all if 0
+	Offset, Limit int
+}
+
+// ParseTaskFilter reads a filter from the query parameters state, worker,
+// name, older_than, a duration such as "30s", offset and limit
+func ParseTaskFilter(query url.Values) (TaskFilter, error) {
+	f := TaskFilter{Worker: query.Get("worker"), Name: query.Get("name")}
+	if s := query.Get("state"); s != "" {
+		var state TaskState
+		if err := state.UnmarshalText([]byte(s)); err != nil {
+			return TaskFilter{}, err
+		}
+		f.State = &state
+	}
+	if s := query.Get("older_than"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return TaskFilter{}, fmt.Errorf("older_than: %w", err)
+		}
+		f.OlderThan = d
+	}
+	for _, p := range []struct {
+		name string
+		to   *int
+	}{{"offset", &f.Offset}, {"limit", &f.Limit}} {
+		if s := query.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return TaskFilter{}, fmt.Errorf("%s: want a non-negative integer, got %q", p.name, s)
+			}
+			*p.to = n
+		}
+	}
+	return f, nil
+}
+
+// TaskPage is one page of the tasks a filter selected
+type TaskPage struct {
+	// Total is the number of tasks the filter selected, on every page
+	Total  int            `json:"total"`
+	Offset int            `json:"offset"`
+	Tasks  []TaskSnapshot `json:"tasks"`
+}
+
+// Apply returns the page of tasks f selects, the longest waiting first,
+// as of now
+func (f TaskFilter) Apply(tasks []TaskSnapshot, now time.Time) TaskPage {
+	selected := make([]TaskSnapshot, 0, len(tasks))
+	for _, t := range tasks {
+		switch {
+		case f.State != nil && t.State != *f.State:
+		case f.Worker != "" && t.Worker != f.Worker:
+		case f.Name != "" && t.Name != f.Name:
+		case f.OlderThan > 0 && now.Sub(t.Enqueued) < f.OlderThan:
+		default:
+			selected = append(selected, t)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		a, b := selected[i], selected[j]
+		if !a.Enqueued.Equal(b.Enqueued) {
+			return a.Enqueued.Before(b.Enqueued)
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.ID < b.ID
+	})
+	page := TaskPage{Total: len(selected), Offset: f.Offset}
+	selected = selected[min(f.Offset, len(selected)):]
+	if f.Limit > 0 {
+		selected = selected[:min(f.Limit, len(selected))]
+	}
+	page.Tasks = selected
+	return page
+}
+
+// TaskInspector serves the unfinished tasks of registered pools and
+// coordinators as JSON, for operators looking for what is stuck. GET
+// requests take the parameters of ParseTaskFilter, and source to list the
+// tasks of one registered name; a page holds 100 tasks unless limit says
+// otherwise, and at most 1000
+type TaskInspector struct {
+	mu      sync.Mutex
+	sources map[string]TaskLister
+}
+
+// taskPageLimit and maxTaskPageLimit are the default and largest page
+// sizes of a TaskInspector
+const (
+	taskPageLimit    = 100
+	maxTaskPageLimit = 1000
+)
+
+// NewTaskInspector creates an inspector with nothing registered
+func NewTaskInspector() *TaskInspector {
+	return &TaskInspector{sources: make(map[string]TaskLister)}
+}
+
+// Register lists the tasks of source under the given name, replacing any
+// source with the same name
+func (i *TaskInspector) Register(name string, source TaskLister) {
+	i.mu.Lock()
+	i.sources[name] = source
+	i.mu.Unlock()
+}
+
+// Unregister stops listing the tasks of the source with the given name
+func (i *TaskInspector) Unregister(name string) {
+	i.mu.Lock()
+	delete(i.sources, name)
+	i.mu.Unlock()
+}
+
+// ServeHTTP implements http.Handler
+func (i *TaskInspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter, err := ParseTaskFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = taskPageLimit
+	}
+	filter.Limit = min(filter.Limit, maxTaskPageLimit)
+
+	i.mu.Lock()
+	sources := make(map[string]TaskLister, len(i.sources))
+	for name, source := range i.sources {
+		sources[name] = source
+	}
+	i.mu.Unlock()
+	only := query.Get("source")
+	if _, ok := sources[only]; only != "" && !ok {
+		http.Error(w, fmt.Sprintf("no source %q", only), http.StatusNotFound)
+		return
+	}
+
+	var tasks []TaskSnapshot
+	for name, source := range sources {
+		if only != "" && name != only {
+			continue
+		}
+		for _, t := range source.Tasks() {
+			t.Source = name
+			tasks = append(tasks, t)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filter.Apply(tasks, time.Now()))
+}
+
+// taskTable tracks the unfinished tasks of a pool created
+// WithTaskTracking. Its methods do nothing on a nil table, which is what
+// every other pool has
+type taskTable struct {
+	mu    sync.Mutex
+	tasks map[uint64]TaskSnapshot
+}
+
+// newTaskTable creates an empty table
+func newTaskTable() *taskTable {
+	return &taskTable{tasks: make(map[uint64]TaskSnapshot)}
+}
+
+// queued records that j waits for its next attempt
+func (t *taskTable) queued(j *job) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.tasks[j.id] = TaskSnapshot{ID: j.id, State: TaskQueued, Priority: j.priority, Enqueued: j.submitted, Attempt: j.attempts + 1}
+	t.mu.Unlock()
+}
+
+// running records that j's latest attempt started
+func (t *taskTable) running(j *job) {
+	if t == nil {
+		return
+	}
+	s := TaskSnapshot{ID: j.id, State: TaskRunning, Priority: j.priority, Enqueued: j.submitted, Started: time.Now(), Attempt: j.attempts}
+	if j.worker != nil {
+		s.Worker = strconv.Itoa(j.worker.ID)
+	}
+	t.mu.Lock()
+	t.tasks[j.id] = s
+	t.mu.Unlock()
+}
+
+// done forgets j, which finished for good
+func (t *taskTable) done(j *job) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.tasks, j.id)
+	t.mu.Unlock()
+}
+
+// list returns the tracked tasks, none for a nil table
+func (t *taskTable) list() []TaskSnapshot {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tasks := make([]TaskSnapshot, 0, len(t.tasks))
+	for _, s := range t.tasks {
+		tasks = append(tasks, s)
+	}
+	return tasks
+}
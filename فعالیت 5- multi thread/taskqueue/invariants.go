@@ -0,0 +1,102 @@
+package taskqueue
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Invariant checks are compiled in only with the pooldebug build tag, as in
+//
+//	go build -tags pooldebug -race
+//
+// and cost nothing otherwise: every check sits behind the invariantChecks
+// constant, so the compiler drops it. A broken invariant panics with an
+// *InvariantViolation, which is not recovered like a task's panic, so the
+// process stops where the state went wrong
+
+// InvariantViolation is the panic value of a broken invariant
+type InvariantViolation struct {
+	// Invariant names what should have held, and Detail the state that
+	// broke it
+	Invariant string
+	Detail    string
+	// Stack is the stack of the goroutine that found the violation
+	Stack []byte
+}
+
+// Error implements the error interface
+func (v *InvariantViolation) Error() string {
+	return fmt.Sprintf("invariant violated: %s: %s\n\n%s", v.Invariant, v.Detail, v.Stack)
+}
+
+// violated panics with an InvariantViolation; call it only behind
+// invariantChecks
+func violated(invariant, format string, args ...any) {
+	panic(&InvariantViolation{Invariant: invariant, Detail: fmt.Sprintf(format, args...), Stack: debug.Stack()})
+}
+
+// poolInvariants is the state a pool keeps for its invariant checks
+type poolInvariants struct {
+	// running counts the tasks running on the pool's own workers, as
+	// opposed to submitters running them under CallerRunsPolicy
+	running atomic.Int64
+	// capacity is the most workers the pool has ever been allowed; tasks
+	// of retiring workers may still run after a shrink
+	capacity atomic.Int64
+}
+
+// noteCapacity records that c may run up to n tasks at once
+func (c *poolCore) noteCapacity(n int) {
+	if !invariantChecks {
+		return
+	}
+	for {
+		old := c.invariants.capacity.Load()
+		if int64(n) <= old || c.invariants.capacity.CompareAndSwap(old, int64(n)) {
+			return
+		}
+	}
+}
+
+// checkStarted asserts that the task just started on a worker keeps the
+// pool within its capacity, and returns a function asserting what must
+// hold once it has finished
+func (c *poolCore) checkStarted(j *job) func() {
+	if j.callerRuns {
+		return func() {}
+	}
+	n := c.invariants.running.Add(1)
+	if limit := c.invariants.capacity.Load(); n > limit {
+		violated("running tasks never exceed the workers", "pool %s runs %d tasks on at most %d workers, starting task %d; %d active of %d submitted",
+			c.config.name, n, limit, j.id, c.metrics.active.Load(), c.metrics.submitted.Load())
+	}
+	return func() {
+		if n := c.invariants.running.Add(-1); n < 0 {
+			violated("running tasks never go negative", "pool %s counts %d running after task %d finished", c.config.name, n, j.id)
+		}
+		if n := c.metrics.active.Load(); n < 0 {
+			violated("active tasks never go negative", "pool %s counts %d active after task %d finished", c.config.name, n, j.id)
+		}
+	}
+}
+
+// checkSnapshot asserts that s, just taken from m, is consistent with
+// itself and with the snapshots before it
+func (m *PoolMetrics) checkSnapshot(s MetricsSnapshot) {
+	if s.Completed+s.Cancelled > s.Submitted {
+		violated("tasks never finish more often than they are submitted", "%d completed and %d cancelled of %d submitted", s.Completed, s.Cancelled, s.Submitted)
+	}
+	if s.Failed > s.Completed || s.Active < 0 {
+		violated("counters stay in range", "%d failed of %d completed, %d active", s.Failed, s.Completed, s.Active)
+	}
+	for {
+		seen := m.seenCompleted.Load()
+		if s.Completed < seen {
+			violated("completed never decreases", "%d tasks completed after %d had been", s.Completed, seen)
+		}
+		if s.Completed == seen || m.seenCompleted.CompareAndSwap(seen, s.Completed) {
+			return
+		}
+	}
+}
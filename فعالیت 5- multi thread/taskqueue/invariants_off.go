@@ -0,0 +1,7 @@
+//go:build !pooldebug
+
+package taskqueue
+
+// invariantChecks disables the invariant assertions of this build; build
+// with -tags pooldebug to enable them
+const invariantChecks = false
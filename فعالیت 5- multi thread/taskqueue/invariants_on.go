@@ -0,0 +1,6 @@
+//go:build pooldebug
+
+package taskqueue
+
+// invariantChecks enables the invariant assertions of this build
+const invariantChecks = true
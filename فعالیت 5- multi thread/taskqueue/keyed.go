@@ -0,0 +1,68 @@
+package taskqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// keyedQueues serializes jobs sharing a key; a key present in the map has a
+// job in flight and its slice holds the jobs waiting behind it
+type keyedQueues struct {
+	mu     sync.Mutex
+	queues map[string][]*job
+}
+
+// SubmitKeyed enqueues task so that tasks with the same key run one at a time
+// in submission order, while tasks with different keys still run in parallel
+func (c *poolCore) SubmitKeyed(key string, task Task) *Future {
+	j := c.newJob(context.Background(), task.run)
+	if !c.admit(j) {
+		c.abort(j, ErrPoolShutdown)
+		return j.future
+	}
+
+	j.onDone = func() { c.keyed.next(c, key) }
+	if c.keyed.enter(key, j) {
+		c.dispatch(j)
+		c.wg.Done()
+	}
+	return j.future
+}
+
+// enter queues j behind the in-flight job for key, or reports true if key was
+// idle and j may be dispatched right away
+func (k *keyedQueues) enter(key string, j *job) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.queues == nil {
+		k.queues = make(map[string][]*job)
+	}
+	if waiting, busy := k.queues[key]; busy {
+		k.queues[key] = append(waiting, j)
+		return false
+	}
+	k.queues[key] = nil
+	return true
+}
+
+// next dispatches the job waiting behind the one that just finished for key
+func (k *keyedQueues) next(c *poolCore, key string) {
+	k.mu.Lock()
+	waiting := k.queues[key]
+	if len(waiting) == 0 {
+		delete(k.queues, key)
+		k.mu.Unlock()
+		return
+	}
+	j := waiting[0]
+	waiting[0] = nil
+	k.queues[key] = waiting[1:]
+	k.mu.Unlock()
+
+	// Dispatch on a new goroutine: the finishing job may still hold the worker
+	// slot the next one needs
+	go func() {
+		defer c.wg.Done()
+		c.dispatch(j)
+	}()
+}
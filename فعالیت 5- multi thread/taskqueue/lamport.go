@@ -0,0 +1,151 @@
+package taskqueue
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multithread/clocks"
+)
+
+// ClockedConn returns a Conn that stamps every message sent on conn with c
+// and merges every message received
+func ClockedConn(conn Conn, c *clocks.Lamport) Conn {
+	return &clockedConn{Conn: conn, clock: c}
+}
+
+// clockedConn is the Conn returned by ClockedConn
+type clockedConn struct {
+	Conn
+	clock *clocks.Lamport
+}
+
+// Send implements Conn
+func (c *clockedConn) Send(m *Message) error {
+	m.Clock = c.clock.Tick()
+	return c.Conn.Send(m)
+}
+
+// Recv implements Conn
+func (c *clockedConn) Recv() (*Message, error) {
+	m, err := c.Conn.Recv()
+	if err == nil {
+		c.clock.Merge(m.Clock)
+	}
+	return m, err
+}
+
+// lamportEvent is one event recorded by SimulateLamport
+type lamportEvent struct {
+	node  int
+	clock uint64
+	kind  string
+	peer  string
+	msg   uint64
+}
+
+// SimulateLamport runs nodes simulated nodes over an in-memory network, each
+// doing steps events that are either local or a message to a random other
+// node, and writes every event to w in Lamport order: by time, ties broken
+// by node. It then checks that each message was sent at a lower time than
+// it was received
+func SimulateLamport(w io.Writer, nodes, steps int, seed uint64) error {
+	if nodes < 2 {
+		return fmt.Errorf("lamport: need at least 2 nodes, got %d", nodes)
+	}
+	net := NewMemoryNetwork()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var events []lamportEvent
+	var msgs atomic.Uint64
+	var delivered sync.WaitGroup
+	record := func(e lamportEvent) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+
+	lamport := make([]clocks.Lamport, nodes)
+	addr := func(i int) string { return fmt.Sprintf("node-%d", i) }
+	for i := range nodes {
+		l, err := net.Listen(addr(i))
+		if err != nil {
+			return err
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					m, err := conn.Recv()
+					if err != nil {
+						return
+					}
+					record(lamportEvent{node: i, clock: lamport[i].Merge(m.Clock), kind: "recv", peer: m.Worker, msg: m.ID})
+					delivered.Done()
+				}()
+			}
+		}()
+		context.AfterFunc(ctx, func() { l.Close() })
+	}
+
+	var wg sync.WaitGroup
+	for i := range nodes {
+		r := rand.New(rand.NewPCG(seed, uint64(i)))
+		wg.Go(func() {
+			for range steps {
+				if r.IntN(2) == 0 {
+					record(lamportEvent{node: i, clock: lamport[i].Tick(), kind: "local"})
+					continue
+				}
+				to := r.IntN(nodes - 1)
+				if to >= i {
+					to++
+				}
+				m := &Message{ID: msgs.Add(1), Worker: addr(i)}
+				m.Clock = lamport[i].Tick()
+				record(lamportEvent{node: i, clock: m.Clock, kind: "send", peer: addr(to), msg: m.ID})
+				delivered.Add(1)
+				if _, err := RoundTrip(ctx, net, addr(to), m, false, time.Second); err != nil {
+					delivered.Done()
+				}
+			}
+		})
+	}
+	wg.Wait()
+	delivered.Wait()
+
+	slices.SortFunc(events, func(a, b lamportEvent) int {
+		return cmp.Or(cmp.Compare(a.clock, b.clock), cmp.Compare(a.node, b.node))
+	})
+	sent := make(map[uint64]uint64)
+	for _, e := range events {
+		switch e.kind {
+		case "local":
+			fmt.Fprintf(w, "%4d  node-%d  local\n", e.clock, e.node)
+		case "send":
+			fmt.Fprintf(w, "%4d  node-%d  send m%d to %s\n", e.clock, e.node, e.msg, e.peer)
+			sent[e.msg] = e.clock
+		case "recv":
+			fmt.Fprintf(w, "%4d  node-%d  recv m%d from %s\n", e.clock, e.node, e.msg, e.peer)
+		}
+	}
+	for _, e := range events {
+		if e.kind == "recv" && sent[e.msg] >= e.clock {
+			return fmt.Errorf("lamport: m%d received at %d but sent at %d", e.msg, e.clock, sent[e.msg])
+		}
+	}
+	fmt.Fprintf(w, "%d events, %d messages: every send is ordered before its receive\n", len(events), len(sent))
+	return nil
+}
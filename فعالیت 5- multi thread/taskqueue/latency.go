@@ -0,0 +1,182 @@
+package taskqueue
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// lockedRand is a random source shared by concurrent callers
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// sample draws from d
+func (r *lockedRand) sample(d Distribution) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return d.Sample(r.rng)
+}
+
+// float64 draws a number in [0, 1)
+func (r *lockedRand) float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64()
+}
+
+// LatencyMiddleware delays every task by a duration drawn from dist, seeded
+// with seed, before running it, as though it waited on a slow dependency;
+// it holds its worker while waiting. Comparing the pools' latency
+// percentiles under a heavy-tailed dist, such as a ParetoDuration, shows how
+// each copes with stragglers. A task cancelled while waiting fails with its
+// context's cause
+func LatencyMiddleware(dist Distribution, seed uint64) Middleware {
+	r := &lockedRand{rng: rand.New(rand.NewPCG(seed, 0))}
+	return func(next TaskFunc) TaskFunc {
+		return func(ctx context.Context) (any, error) {
+			if d := r.sample(dist); d > 0 {
+				timer := time.NewTimer(d)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, context.Cause(ctx)
+				}
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// LatencyTransport wraps a Transport, delaying every message its
+// connections receive by a duration drawn from Dist, as a link with that
+// latency would. Messages keep their order: none is delivered before the
+// one ahead of it, but each one's delay starts when it arrives, so delays
+// behind a slow message run meanwhile instead of adding up. Create it with
+// NewLatencyTransport
+type LatencyTransport struct {
+	Transport
+	Dist Distribution
+
+	rng *lockedRand
+}
+
+// NewLatencyTransport wraps t, drawing delays from dist seeded with seed
+func NewLatencyTransport(t Transport, dist Distribution, seed uint64) *LatencyTransport {
+	return &LatencyTransport{Transport: t, Dist: dist, rng: &lockedRand{rng: rand.New(rand.NewPCG(seed, 0))}}
+}
+
+// Dial implements Transport
+func (t *LatencyTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(conn), nil
+}
+
+// Listen implements Transport
+func (t *LatencyTransport) Listen(addr string) (Listener, error) {
+	l, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &latencyListener{Listener: l, t: t}, nil
+}
+
+// wrap starts delaying the messages conn receives
+func (t *LatencyTransport) wrap(conn Conn) Conn {
+	c := &latencyConn{Conn: conn, t: t, arrivals: make(chan delayedMessage, 1024), done: make(chan struct{})}
+	go c.read()
+	return c
+}
+
+// latencyListener wraps the connections a LatencyTransport accepts
+type latencyListener struct {
+	Listener
+	t *LatencyTransport
+}
+
+func (l *latencyListener) Accept() (Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.t.wrap(conn), nil
+}
+
+// delayedMessage is a received message and when Recv may return it, or the
+// error that ended the connection
+type delayedMessage struct {
+	m   *Message
+	err error
+	due time.Time
+}
+
+// latencyConn reads its connection from another goroutine, stamping each
+// message with its due time, so delays overlap rather than add up
+type latencyConn struct {
+	Conn
+	t        *LatencyTransport
+	arrivals chan delayedMessage
+	done     chan struct{}
+	once     sync.Once
+}
+
+// read receives messages until the connection fails, the last error
+// included
+func (c *latencyConn) read() {
+	var last time.Time
+	for {
+		m, err := c.Conn.Recv()
+		due := time.Now()
+		if err == nil {
+			due = due.Add(c.t.rng.sample(c.t.Dist))
+		}
+		if due.Before(last) {
+			due = last
+		}
+		last = due
+		select {
+		case c.arrivals <- delayedMessage{m: m, err: err, due: due}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *latencyConn) Recv() (*Message, error) {
+	var d delayedMessage
+	select {
+	case d = <-c.arrivals:
+	case <-c.done:
+		return nil, net.ErrClosed
+	}
+	if wait := time.Until(d.due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.done:
+			return nil, net.ErrClosed
+		}
+	}
+	return d.m, d.err
+}
+
+func (c *latencyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// Peer passes through the identity of the wrapped connection
+func (c *latencyConn) Peer() (PeerIdentity, bool) {
+	return PeerOf(c.Conn)
+}
@@ -0,0 +1,156 @@
+package taskqueue
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+)
+
+// Candidate is a worker a Picker may hand a task to
+type Candidate struct {
+	// ID names the worker
+	ID string
+	// Capacity is how many tasks the worker runs at once
+	Capacity int
+	// Inflight is how many tasks the worker is running
+	Inflight int
+}
+
+// Picker chooses which of several workers with a free slot takes the next
+// task. Candidates are sorted by ID and never empty; Pick returns the index of
+// the chosen one. Pickers are safe for concurrent use
+type Picker interface {
+	Pick(candidates []Candidate) int
+}
+
+// NewPicker returns the picker of the named strategy: "round-robin",
+// "least-connections", "weighted" or "p2c"
+func NewPicker(name string) (Picker, error) {
+	switch name {
+	case "round-robin":
+		return NewRoundRobinPicker(), nil
+	case "least-connections":
+		return NewLeastConnectionsPicker(), nil
+	case "weighted":
+		return NewWeightedPicker(nil), nil
+	case "p2c":
+		return NewP2CPicker(), nil
+	default:
+		return nil, fmt.Errorf("unknown load balancer %q", name)
+	}
+}
+
+// roundRobinPicker takes the candidates in turn
+type roundRobinPicker struct {
+	mu   sync.Mutex
+	last string
+}
+
+// NewRoundRobinPicker returns a picker that takes the candidates in ID order,
+// starting after the one it picked last, so that every worker gets its turn
+// however the set of candidates changes between picks
+func NewRoundRobinPicker() Picker {
+	return &roundRobinPicker{}
+}
+
+func (p *roundRobinPicker) Pick(candidates []Candidate) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := 0
+	for j, c := range candidates {
+		if c.ID > p.last {
+			i = j
+			break
+		}
+	}
+	p.last = candidates[i].ID
+	return i
+}
+
+// leastConnectionsPicker takes the candidate running the fewest tasks
+type leastConnectionsPicker struct{}
+
+// NewLeastConnectionsPicker returns a picker that takes the candidate running
+// the fewest tasks, choosing at random between equally loaded ones
+func NewLeastConnectionsPicker() Picker {
+	return leastConnectionsPicker{}
+}
+
+func (leastConnectionsPicker) Pick(candidates []Candidate) int {
+	best, ties := 0, 1
+	for i := 1; i < len(candidates); i++ {
+		switch c := candidates[i].Inflight; {
+		case c < candidates[best].Inflight:
+			best, ties = i, 1
+		case c == candidates[best].Inflight:
+			// Reservoir sampling keeps each tie equally likely
+			if ties++; rand.N(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// weightedPicker is a smooth weighted round robin
+type weightedPicker struct {
+	mu      sync.Mutex
+	weights map[string]int
+	current map[string]int
+}
+
+// NewWeightedPicker returns a picker that gives each candidate a share of the
+// picks proportional to its weight, interleaving them rather than picking one
+// worker several times in a row. Workers missing from weights are weighted
+// by their capacity
+func NewWeightedPicker(weights map[string]int) Picker {
+	return &weightedPicker{weights: weights, current: make(map[string]int)}
+}
+
+func (p *weightedPicker) Pick(candidates []Candidate) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Every candidate gains its weight and the one that has gained the most
+	// is picked and pays back the total, as in nginx's smooth weighted round
+	// robin
+	best, total := 0, 0
+	for i, c := range candidates {
+		w, ok := p.weights[c.ID]
+		if !ok {
+			w = c.Capacity
+		}
+		w = max(w, 1)
+		total += w
+		p.current[c.ID] += w
+		if p.current[c.ID] > p.current[candidates[best].ID] {
+			best = i
+		}
+	}
+	p.current[candidates[best].ID] -= total
+	return best
+}
+
+// p2cPicker is the power of two choices
+type p2cPicker struct{}
+
+// NewP2CPicker returns a picker that samples two candidates at random and
+// takes the one running fewer tasks, which spreads load almost as well as
+// least connections while the candidates' counts are stale or contended
+func NewP2CPicker() Picker {
+	return p2cPicker{}
+}
+
+func (p2cPicker) Pick(candidates []Candidate) int {
+	if len(candidates) == 1 {
+		return 0
+	}
+	a := rand.N(len(candidates))
+	b := rand.N(len(candidates) - 1)
+	if b >= a {
+		b++
+	}
+	if candidates[b].Inflight < candidates[a].Inflight {
+		return b
+	}
+	return a
+}
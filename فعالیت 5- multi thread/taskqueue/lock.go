@@ -0,0 +1,407 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockRetryInterval is how often LockClient.Acquire retries a held lock
+const lockRetryInterval = 200 * time.Millisecond
+
+// minLockSweep is how many locks a LockManager tracks before it first sweeps
+// out the expired ones
+const minLockSweep = 64
+
+// Lock is a lock held under a lease. Token is a fencing token: it grows with
+// every acquisition, so a resource guarded by the lock can reject writes
+// carrying a lower token than one it has already seen, which stops a holder
+// that lost its lease without noticing
+type Lock struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// LockManager grants named locks under lease TTLs; a lock not renewed before
+// its lease runs out is free for the next owner. Expired locks are dropped
+// when next looked up, and swept out whenever the number tracked doubles,
+// so that locks nobody asks for again do not pile up. It is safe for
+// concurrent use
+type LockManager struct {
+	mu     sync.Mutex
+	locks  map[string]Lock
+	tokens uint64
+	now    func() time.Time
+	// sweepAt is how many locks may be tracked before the next sweep
+	sweepAt int
+}
+
+// NewLockManager creates a manager holding no locks
+func NewLockManager() *LockManager {
+	return &LockManager{locks: make(map[string]Lock), now: time.Now, sweepAt: minLockSweep}
+}
+
+// SetClock makes the manager time leases by now instead of time.Now, such
+// as a simulated node's SkewedClock; call it before the manager is used
+func (m *LockManager) SetClock(now func() time.Time) {
+	m.now = now
+}
+
+// Acquire grants name to owner for ttl, or fails with ErrLockHeld if another
+// owner holds it. An owner acquiring a lock it already holds extends the
+// lease and keeps its token
+func (m *LockManager) Acquire(name, owner string, ttl time.Duration) (Lock, error) {
+	if name == "" || owner == "" || ttl <= 0 {
+		return Lock{}, errors.New("lock: acquire needs a name, an owner and a positive TTL")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	l, held := m.locks[name]
+	if held && now.Before(l.Expires) {
+		if l.Owner != owner {
+			return Lock{}, fmt.Errorf("%w: %s by %s", ErrLockHeld, name, l.Owner)
+		}
+	} else {
+		m.tokens++
+		l = Lock{Name: name, Owner: owner, Token: m.tokens}
+	}
+	l.Expires = now.Add(ttl)
+	m.locks[name] = l
+	if len(m.locks) >= m.sweepAt {
+		m.sweep(now)
+	}
+	return l, nil
+}
+
+// sweep drops the locks whose lease ran out by now; the caller holds m.mu.
+// Waiting for the live locks to double again before the next sweep keeps
+// the cost per acquisition constant
+func (m *LockManager) sweep(now time.Time) {
+	for name, l := range m.locks {
+		if !now.Before(l.Expires) {
+			delete(m.locks, name)
+		}
+	}
+	m.sweepAt = max(2*len(m.locks), minLockSweep)
+}
+
+// Renew extends the lease of the acquisition identified by token to ttl
+// from now, or fails with ErrLockLost if that lease already ran out
+func (m *LockManager) Renew(name string, token uint64, ttl time.Duration) (Lock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, err := m.held(name, token)
+	if err != nil {
+		return Lock{}, err
+	}
+	l.Expires = m.now().Add(ttl)
+	m.locks[name] = l
+	return l, nil
+}
+
+// Release frees the lock held under token, or fails with ErrLockLost if its
+// lease already ran out
+func (m *LockManager) Release(name string, token uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.held(name, token); err != nil {
+		return err
+	}
+	delete(m.locks, name)
+	return nil
+}
+
+// Get returns the current holder of name, if any
+func (m *LockManager) Get(name string) (Lock, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[name]
+	if ok && !m.now().Before(l.Expires) {
+		delete(m.locks, name)
+		ok = false
+	}
+	if !ok {
+		return Lock{}, false
+	}
+	return l, true
+}
+
+// held returns the lock acquired under token if its lease is still running;
+// the caller holds m.mu
+func (m *LockManager) held(name string, token uint64) (Lock, error) {
+	l, ok := m.locks[name]
+	if ok && !m.now().Before(l.Expires) {
+		delete(m.locks, name)
+		ok = false
+	}
+	if !ok || l.Token != token {
+		return Lock{}, fmt.Errorf("%w: %s (token %d)", ErrLockLost, name, token)
+	}
+	return l, nil
+}
+
+// lockRequest is the JSON body of acquire and renew requests
+type lockRequest struct {
+	Owner string `json:"owner,omitempty"`
+	Token uint64 `json:"token,omitempty"`
+	TTL   string `json:"ttl"`
+}
+
+// LockHandler serves m over HTTP: POST /locks/{name} acquires the lock for
+// the owner and TTL in the JSON body, PUT /locks/{name} renews the
+// acquisition with the body's token, DELETE /locks/{name}?token=N releases
+// it and GET /locks/{name} returns the holder. Acquire and renew answer with
+// the Lock; a lock held by someone else is 409 Conflict and a lost one is
+// 410 Gone
+func LockHandler(m *LockManager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /locks/{name}", func(w http.ResponseWriter, req *http.Request) {
+		body, ttl, ok := decodeLockRequest(w, req)
+		if !ok {
+			return
+		}
+		l, err := m.Acquire(req.PathValue("name"), body.Owner, ttl)
+		writeLock(w, l, err)
+	})
+	mux.HandleFunc("PUT /locks/{name}", func(w http.ResponseWriter, req *http.Request) {
+		body, ttl, ok := decodeLockRequest(w, req)
+		if !ok {
+			return
+		}
+		l, err := m.Renew(req.PathValue("name"), body.Token, ttl)
+		writeLock(w, l, err)
+	})
+	mux.HandleFunc("DELETE /locks/{name}", func(w http.ResponseWriter, req *http.Request) {
+		token, err := strconv.ParseUint(req.URL.Query().Get("token"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid token", http.StatusBadRequest)
+			return
+		}
+		if err := m.Release(req.PathValue("name"), token); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /locks/{name}", func(w http.ResponseWriter, req *http.Request) {
+		l, ok := m.Get(req.PathValue("name"))
+		if !ok {
+			http.Error(w, "lock is free", http.StatusNotFound)
+			return
+		}
+		writeLock(w, l, nil)
+	})
+	return mux
+}
+
+// decodeLockRequest reads an acquire or renew body, answering 400 Bad
+// Request if it is malformed
+func decodeLockRequest(w http.ResponseWriter, req *http.Request) (lockRequest, time.Duration, bool) {
+	var body lockRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return body, 0, false
+	}
+	ttl, err := time.ParseDuration(body.TTL)
+	if err != nil || ttl <= 0 {
+		http.Error(w, "invalid ttl", http.StatusBadRequest)
+		return body, 0, false
+	}
+	return body, ttl, true
+}
+
+// writeLock answers with l as JSON, or with the status matching err
+func writeLock(w http.ResponseWriter, l Lock, err error) {
+	switch {
+	case errors.Is(err, ErrLockHeld):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrLockLost):
+		http.Error(w, err.Error(), http.StatusGone)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l)
+	}
+}
+
+// LockClient acquires locks from a server running LockHandler on behalf of
+// one owner
+type LockClient struct {
+	base   string
+	owner  string
+	client *http.Client
+}
+
+// NewLockClient creates a client for the lock server at baseURL that
+// acquires locks as owner
+func NewLockClient(baseURL, owner string) *LockClient {
+	return &LockClient{base: strings.TrimSuffix(baseURL, "/"), owner: owner, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// SetTLSConfig makes the client connect to https:// lock servers with cfg
+func (c *LockClient) SetTLSConfig(cfg *tls.Config) {
+	c.client.Transport = &http.Transport{TLSClientConfig: cfg}
+}
+
+// TryAcquire acquires name for ttl once, failing with ErrLockHeld if someone
+// else holds it. The returned lock renews itself in the background until it
+// is released or lost
+func (c *LockClient) TryAcquire(ctx context.Context, name string, ttl time.Duration) (*HeldLock, error) {
+	start := time.Now()
+	var l Lock
+	if err := c.do(ctx, http.MethodPost, "/locks/"+url.PathEscape(name), lockRequest{Owner: c.owner, TTL: ttl.String()}, &l); err != nil {
+		return nil, err
+	}
+	h := &HeldLock{Lock: l, client: c, ttl: ttl, stop: make(chan struct{}), lost: make(chan struct{}), renewed: start}
+	go h.renew()
+	return h, nil
+}
+
+// Acquire waits until it acquires name for ttl or ctx is done, retrying
+// while someone else holds it
+func (c *LockClient) Acquire(ctx context.Context, name string, ttl time.Duration) (*HeldLock, error) {
+	for {
+		h, err := c.TryAcquire(ctx, name, ttl)
+		if !errors.Is(err, ErrLockHeld) {
+			return h, err
+		}
+		select {
+		case <-time.After(lockRetryInterval/2 + rand.N(lockRetryInterval)):
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// do sends one request with a JSON body and decodes a JSON reply into out,
+// mapping 409 and 410 to ErrLockHeld and ErrLockLost
+func (c *LockClient) do(ctx context.Context, method, path string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// The server's message already starts with the sentinel's text
+	msg := strings.TrimSpace(string(b))
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return fmt.Errorf("%w: %s", ErrLockHeld, strings.TrimPrefix(msg, ErrLockHeld.Error()+": "))
+	case resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%w: %s", ErrLockLost, strings.TrimPrefix(msg, ErrLockLost.Error()+": "))
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("lock: %s %s: %s: %s", method, path, resp.Status, msg)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// HeldLock is a lock acquired through a LockClient. It renews its lease
+// every third of the TTL; if renewals keep failing until the lease must
+// have run out, or the server reports it lost, Lost is closed and the
+// holder must stop using the resource
+type HeldLock struct {
+	Lock
+	client *LockClient
+	ttl    time.Duration
+	stop   chan struct{}
+	lost   chan struct{}
+	once   sync.Once
+
+	mu sync.Mutex
+	// renewed is when the last successful renewal was sent; the lease runs
+	// at least until renewed+ttl whatever the clock skew with the server
+	renewed time.Time
+	err     error
+}
+
+// Lost is closed once the lock is lost
+func (h *HeldLock) Lost() <-chan struct{} {
+	return h.lost
+}
+
+// Err returns why the lock was lost, or nil while it is held
+func (h *HeldLock) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Release stops renewing and frees the lock
+func (h *HeldLock) Release(ctx context.Context) error {
+	h.once.Do(func() { close(h.stop) })
+	if err := h.Err(); err != nil {
+		return err
+	}
+	q := url.Values{"token": {strconv.FormatUint(h.Token, 10)}}
+	return h.client.do(ctx, http.MethodDelete, "/locks/"+url.PathEscape(h.Name)+"?"+q.Encode(), nil, nil)
+}
+
+// renew keeps the lease alive until the lock is released or lost
+func (h *HeldLock) renew() {
+	ticker := time.NewTicker(h.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		h.mu.Lock()
+		deadline := h.renewed.Add(h.ttl)
+		h.mu.Unlock()
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		start := time.Now()
+		var l Lock
+		err := h.client.do(ctx, http.MethodPut, "/locks/"+url.PathEscape(h.Name), lockRequest{Token: h.Token, TTL: h.ttl.String()}, &l)
+		cancel()
+
+		switch {
+		case err == nil:
+			h.mu.Lock()
+			h.renewed = start
+			h.mu.Unlock()
+		case errors.Is(err, ErrLockLost) || !time.Now().Before(deadline):
+			if !errors.Is(err, ErrLockLost) {
+				err = fmt.Errorf("%w: lease ran out while renewing: %w", ErrLockLost, err)
+			}
+			h.mu.Lock()
+			h.err = err
+			h.mu.Unlock()
+			close(h.lost)
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for a LockManager that moves only when advanced
+type fakeClock struct {
+	base    time.Time
+	elapsed atomic.Int64
+}
+
+func newLockManager() (*LockManager, *fakeClock) {
+	clock := &fakeClock{base: time.Unix(1_700_000_000, 0)}
+	m := NewLockManager()
+	m.SetClock(clock.now)
+	return m, clock
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.base.Add(time.Duration(c.elapsed.Load()))
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.elapsed.Add(int64(d))
+}
+
+// tracked returns how many locks m holds entries for, expired or not
+func (m *LockManager) tracked() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.locks)
+}
+
+func TestFencingTokensGrow(t *testing.T) {
+	m, clock := newLockManager()
+	var last uint64
+	acquire := func(name, owner string) Lock {
+		t.Helper()
+		l, err := m.Acquire(name, owner, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Token <= last {
+			t.Fatalf("%s acquired %s with token %d after token %d", owner, name, l.Token, last)
+		}
+		last = l.Token
+		return l
+	}
+
+	l := acquire("a", "o1")
+	if _, err := m.Acquire("a", "o2", time.Second); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("acquiring a held lock returned %v, want ErrLockHeld", err)
+	}
+	// Acquiring again extends the lease under the same token
+	clock.advance(500 * time.Millisecond)
+	again, err := m.Acquire("a", "o1", time.Second)
+	if err != nil || again.Token != l.Token || !again.Expires.After(l.Expires) {
+		t.Fatalf("re-acquiring returned %+v and %v, want token %d with a later lease", again, err, l.Token)
+	}
+
+	if err := m.Release("a", l.Token); err != nil {
+		t.Fatal(err)
+	}
+	l = acquire("a", "o2")
+	acquire("b", "o1")
+	clock.advance(time.Second)
+	// Dropping the expired entry must not reset the tokens
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("an expired lock is still held")
+	}
+	acquire("a", "o3")
+	if err := m.Release("a", l.Token); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("releasing with a stale token returned %v, want ErrLockLost", err)
+	}
+}
+
+func TestRenewAfterExpiry(t *testing.T) {
+	m, clock := newLockManager()
+	l, err := m.Acquire("a", "o1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Renew("a", l.Token, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Second)
+	if _, err := m.Renew("a", l.Token, time.Second); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("renewing an expired lock returned %v, want ErrLockLost", err)
+	}
+	if n := m.tracked(); n != 0 {
+		t.Errorf("%d expired locks kept after a failed renewal", n)
+	}
+}
+
+func TestExpiredLocksSwept(t *testing.T) {
+	m, clock := newLockManager()
+	for i := range 10 * minLockSweep {
+		if _, err := m.Acquire(fmt.Sprint("once-", i), "o1", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(100 * time.Millisecond)
+	}
+	// About the locks acquired in the last second are live, and the sweeps
+	// keep the expired ones to as many again
+	if n := m.tracked(); n >= 2*minLockSweep {
+		t.Errorf("%d locks tracked with 10 live", n)
+	}
+}
+
+func TestHeldLockLost(t *testing.T) {
+	const ttl = 150 * time.Millisecond
+	tests := []struct {
+		name string
+		// lose makes the server lose the lease of the lock held
+		lose func(clock *fakeClock, srv *httptest.Server)
+	}{
+		{"expired", func(clock *fakeClock, _ *httptest.Server) { clock.advance(time.Hour) }},
+		{"unreachable", func(_ *fakeClock, srv *httptest.Server) { srv.Close() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, clock := newLockManager()
+			srv := httptest.NewServer(LockHandler(m))
+			defer srv.Close()
+			h, err := NewLockClient(srv.URL, "o1").TryAcquire(context.Background(), "a", ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Renewals keep the lock held across several leases
+			time.Sleep(3 * ttl)
+			select {
+			case <-h.Lost():
+				t.Fatalf("a renewed lock was lost: %v", h.Err())
+			default:
+			}
+
+			tt.lose(clock, srv)
+			select {
+			case <-h.Lost():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Lost not closed after the lease was lost")
+			}
+			if err := h.Err(); !errors.Is(err, ErrLockLost) {
+				t.Errorf("lost lock reports %v, want ErrLockLost", err)
+			}
+			if err := h.Release(context.Background()); !errors.Is(err, ErrLockLost) {
+				t.Errorf("releasing a lost lock returned %v, want ErrLockLost", err)
+			}
+		})
+	}
+}
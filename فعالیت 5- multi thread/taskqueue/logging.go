@@ -0,0 +1,172 @@
+package taskqueue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// The keys of the fields components log with, so records of one task or
+// node can be picked out whichever component wrote them
+const (
+	// LogKeyComponent names the component that wrote a record, such as
+	// "pool" or "raft"; LogLevels sets a level for each
+	LogKeyComponent = "component"
+	LogKeyPool      = "pool"
+	LogKeyWorker    = "worker"
+	LogKeyTask      = "task"
+	LogKeyNode      = "node"
+	// LogKeyCorrelation is the correlation ID of a remote task, which the
+	// records of the task carry on every coordinator and worker
+	LogKeyCorrelation = "correlation"
+)
+
+// LogLevels is the least level logged for each component, and for the
+// components it does not name
+type LogLevels struct {
+	Default    slog.Level
+	Components map[string]slog.Level
+}
+
+// Level returns the least level logged for component
+func (l LogLevels) Level(component string) slog.Level {
+	if level, ok := l.Components[component]; ok {
+		return level
+	}
+	return l.Default
+}
+
+// String implements fmt.Stringer, in the format ParseLogLevels reads
+func (l LogLevels) String() string {
+	s := strings.ToLower(l.Default.String())
+	for _, component := range slices.Sorted(maps.Keys(l.Components)) {
+		s += "," + component + "=" + strings.ToLower(l.Components[component].String())
+	}
+	return s
+}
+
+// ParseLogLevels parses a comma-separated list of levels such as
+// "info,raft=debug,pool=warn": one without a component sets the default,
+// which is info if none does. Levels are named as slog names them, "debug",
+// "info", "warn" and "error", optionally with an offset such as "debug-4"
+func ParseLogLevels(spec string) (LogLevels, error) {
+	levels := LogLevels{Components: make(map[string]slog.Level)}
+	for item := range strings.SplitSeq(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		component, name, ok := strings.Cut(item, "=")
+		if !ok {
+			component, name = "", item
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return LogLevels{}, fmt.Errorf("log levels %q: %w", spec, err)
+		}
+		if ok {
+			levels.Components[component] = level
+		} else {
+			levels.Default = level
+		}
+	}
+	return levels, nil
+}
+
+// LogLevelVar holds LogLevels that may be changed while loggers use them,
+// as slog.LevelVar holds a level. It is safe for concurrent use
+type LogLevelVar struct {
+	levels atomic.Pointer[LogLevels]
+}
+
+// NewLogLevelVar creates a variable holding levels
+func NewLogLevelVar(levels LogLevels) *LogLevelVar {
+	v := new(LogLevelVar)
+	v.Set(levels)
+	return v
+}
+
+// Levels returns the levels held
+func (v *LogLevelVar) Levels() LogLevels {
+	return *v.levels.Load()
+}
+
+// Set replaces the levels held, for every logger using v
+func (v *LogLevelVar) Set(levels LogLevels) {
+	v.levels.Store(&levels)
+}
+
+// levelHandler passes on the records at or above the level of the
+// component its logger was created for
+type levelHandler struct {
+	next      slog.Handler
+	levels    *LogLevelVar
+	component string
+}
+
+// NewLevelHandler returns a handler passing on to next the records that
+// clear the level levels sets for their component, which is the last
+// LogKeyComponent attribute given to the logger with With; setting levels
+// takes effect at once. next should accept every level, leaving the
+// filtering to the returned handler. Records logged with a context carrying
+// a correlation ID get it as a LogKeyCorrelation attribute
+func NewLevelHandler(next slog.Handler, levels *LogLevelVar) slog.Handler {
+	return &levelHandler{next: next, levels: levels}
+}
+
+// Enabled implements slog.Handler
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.levels.Levels().Level(h.component) && h.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := CorrelationID(ctx); id != "" {
+		r.AddAttrs(slog.String(LogKeyCorrelation, id))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	component := h.component
+	for _, a := range attrs {
+		if a.Key == LogKeyComponent {
+			component = a.Value.String()
+		}
+	}
+	return &levelHandler{next: h.next.WithAttrs(attrs), levels: h.levels, component: component}
+}
+
+// WithGroup implements slog.Handler
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{next: h.next.WithGroup(name), levels: h.levels, component: h.component}
+}
+
+// NewLogger returns a logger writing to w at levels, as JSON lines if json
+// is set and as logfmt-style text otherwise
+func NewLogger(w io.Writer, levels *LogLevelVar, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: slog.Level(-1 << 10)}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if json {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(NewLevelHandler(h, levels))
+}
+
+// discardLogger is the logger of components that were given none
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// ComponentLogger returns l for component, or a logger discarding
+// everything if l is nil
+func ComponentLogger(l *slog.Logger, component string, attrs ...any) *slog.Logger {
+	if l == nil {
+		return discardLogger
+	}
+	return l.With(append([]any{LogKeyComponent, component}, attrs...)...)
+}
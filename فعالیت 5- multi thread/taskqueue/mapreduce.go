@@ -0,0 +1,313 @@
+package taskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"multithread/hashring"
+
+	"multithread/internal/wire"
+)
+
+// KeyValue is a pair emitted by a map or reduce function
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// MapFunc turns one input split into intermediate pairs passed to emit
+type MapFunc func(ctx context.Context, split []byte, emit func(key string, value []byte)) error
+
+// ReduceFunc folds every intermediate value of a key into its output value
+type ReduceFunc func(ctx context.Context, key string, values [][]byte) ([]byte, error)
+
+// MapReduceJob defines a MapReduce computation. The name identifies its tasks
+// on remote workers, which must have it installed with RegisterMapReduce
+type MapReduceJob struct {
+	Name   string
+	Map    MapFunc
+	Reduce ReduceFunc
+	// Combine, if set, pre-reduces each map task's values per key before
+	// they are shuffled; it must give the same final result as Reduce, which
+	// holds when Reduce is associative and commutative, as for counting
+	Combine ReduceFunc
+	// Reducers is the number of intermediate partitions, each reduced by one
+	// task; defaults to 1
+	Reducers int
+}
+
+// mapTask runs the map function on a split and returns its output
+// partitioned, and optionally combined, by key hash, encoded with
+// encodePartitions
+func (j *MapReduceJob) mapTask(ctx context.Context, split []byte) ([]byte, error) {
+	parts := make([][]KeyValue, j.reducers())
+	err := j.Map(ctx, split, func(key string, value []byte) {
+		p := hashring.Hash(key) % uint64(len(parts))
+		parts[p] = append(parts[p], KeyValue{Key: key, Value: slices.Clone(value)})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if j.Combine != nil {
+		for i, part := range parts {
+			if parts[i], err = reduceGroups(ctx, j.Combine, part); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return encodePartitions(parts), nil
+}
+
+// reduceTask runs the reduce function on one partition's pairs, encoded with
+// encodeKeyValues, and returns its sorted output encoded the same way
+func (j *MapReduceJob) reduceTask(ctx context.Context, payload []byte) ([]byte, error) {
+	kvs, err := decodeKeyValues(payload)
+	if err != nil {
+		return nil, err
+	}
+	out, err := reduceGroups(ctx, j.Reduce, kvs)
+	if err != nil {
+		return nil, err
+	}
+	return encodeKeyValues(out), nil
+}
+
+// reducers returns the number of partitions
+func (j *MapReduceJob) reducers() int {
+	return max(j.Reducers, 1)
+}
+
+// reduceGroups sorts kvs by key and folds the values of each key with fn,
+// keeping the values of a key in the order they were emitted
+func reduceGroups(ctx context.Context, fn ReduceFunc, kvs []KeyValue) ([]KeyValue, error) {
+	slices.SortStableFunc(kvs, func(a, b KeyValue) int { return strings.Compare(a.Key, b.Key) })
+	var out []KeyValue
+	for i := 0; i < len(kvs); {
+		end := i + 1
+		for end < len(kvs) && kvs[end].Key == kvs[i].Key {
+			end++
+		}
+		values := make([][]byte, 0, end-i)
+		for _, kv := range kvs[i:end] {
+			values = append(values, kv.Value)
+		}
+		v, err := fn(ctx, kvs[i].Key, values)
+		if err != nil {
+			return nil, fmt.Errorf("reduce %q: %w", kvs[i].Key, err)
+		}
+		out = append(out, KeyValue{Key: kvs[i].Key, Value: v})
+		i = end
+	}
+	return out, nil
+}
+
+// MapReduceRunner starts one task of a job, running the job's map task when
+// phase is "map" and its reduce task when it is "reduce", and returns a
+// future holding the task's output as a []byte
+type MapReduceRunner func(ctx context.Context, job *MapReduceJob, phase string, payload []byte) *Future
+
+// LocalRunner runs tasks on exec
+func LocalRunner(exec Executor) MapReduceRunner {
+	return func(ctx context.Context, job *MapReduceJob, phase string, payload []byte) *Future {
+		return exec.Call(func() (any, error) {
+			if phase == "map" {
+				return job.mapTask(ctx, payload)
+			}
+			return job.reduceTask(ctx, payload)
+		})
+	}
+}
+
+// RemoteRunner runs tasks on the workers of c, which must have the job
+// installed with RegisterMapReduce. Intermediate pairs pass through the
+// coordinator on their way from the map to the reduce tasks
+func RemoteRunner(c *Coordinator) MapReduceRunner {
+	return func(ctx context.Context, job *MapReduceJob, phase string, payload []byte) *Future {
+		return c.Submit(ctx, mapReduceTask(job.Name, phase), payload)
+	}
+}
+
+// mapReduceTask names the handler of a job's phase on a worker
+func mapReduceTask(job, phase string) string {
+	return "mapreduce/" + job + "/" + phase
+}
+
+// RegisterMapReduce installs the map and reduce handlers of job on node so
+// that a RemoteRunner can run the job's tasks there
+func RegisterMapReduce(node *WorkerNode, job *MapReduceJob) {
+	node.Handle(mapReduceTask(job.Name, "map"), job.mapTask)
+	node.Handle(mapReduceTask(job.Name, "reduce"), job.reduceTask)
+}
+
+// RunMapReduce runs job over splits with run: one map task per split, whose
+// output is partitioned by key hash, then after every map task finished one
+// reduce task per partition, fed its partition from every map task sorted
+// by key. It returns the reduced pairs sorted by key; a failed task fails the
+// job
+func RunMapReduce(ctx context.Context, run MapReduceRunner, job *MapReduceJob, splits [][]byte) ([]KeyValue, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	maps := make([]*Future, len(splits))
+	for i, split := range splits {
+		maps[i] = run(ctx, job, "map", split)
+	}
+	// Shuffle: gather each partition from every map task's output
+	parts := make([][]KeyValue, job.reducers())
+	for i, f := range maps {
+		out, err := awaitBytes(f)
+		if err != nil {
+			return nil, fmt.Errorf("mapreduce %s: map task %d: %w", job.Name, i, err)
+		}
+		mapped, err := decodePartitions(out)
+		if err == nil && len(mapped) != len(parts) {
+			err = fmt.Errorf("got %d partitions, want %d", len(mapped), len(parts))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mapreduce %s: map task %d: %w", job.Name, i, err)
+		}
+		for p, kvs := range mapped {
+			parts[p] = append(parts[p], kvs...)
+		}
+	}
+
+	reduces := make([]*Future, len(parts))
+	for p, kvs := range parts {
+		slices.SortStableFunc(kvs, func(a, b KeyValue) int { return strings.Compare(a.Key, b.Key) })
+		reduces[p] = run(ctx, job, "reduce", encodeKeyValues(kvs))
+	}
+	var result []KeyValue
+	for p, f := range reduces {
+		out, err := awaitBytes(f)
+		var kvs []KeyValue
+		if err == nil {
+			kvs, err = decodeKeyValues(out)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mapreduce %s: reduce task %d: %w", job.Name, p, err)
+		}
+		result = append(result, kvs...)
+	}
+	slices.SortFunc(result, func(a, b KeyValue) int { return strings.Compare(a.Key, b.Key) })
+	return result, nil
+}
+
+// awaitBytes waits for a task future holding a []byte
+func awaitBytes(f *Future) ([]byte, error) {
+	v, err := f.Get()
+	if err != nil {
+		return nil, err
+	}
+	b, _ := v.([]byte)
+	return b, nil
+}
+
+// SplitInput reads r into splits of about size bytes each, cutting only at
+// line ends so that no line is split across map tasks
+func SplitInput(r io.Reader, size int) ([][]byte, error) {
+	var splits [][]byte
+	var cur []byte
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		cur = append(cur, line...)
+		if len(cur) >= size || err != nil && len(cur) > 0 {
+			splits = append(splits, cur)
+			cur = nil
+		}
+		if err == io.EOF {
+			return splits, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WordCount is a job counting the words of its input, keyed by word with
+// the count as decimal text
+func WordCount(reducers int) *MapReduceJob {
+	sum := func(ctx context.Context, key string, values [][]byte) ([]byte, error) {
+		var n uint64
+		for _, v := range values {
+			var c uint64
+			if _, err := fmt.Sscan(string(v), &c); err != nil {
+				return nil, err
+			}
+			n += c
+		}
+		return fmt.Appendf(nil, "%d", n), nil
+	}
+	return &MapReduceJob{
+		Name: "wordcount",
+		Map: func(ctx context.Context, split []byte, emit func(string, []byte)) error {
+			for _, w := range bytes.Fields(split) {
+				emit(strings.ToLower(string(w)), []byte("1"))
+			}
+			return nil
+		},
+		Reduce:   sum,
+		Combine:  sum,
+		Reducers: reducers,
+	}
+}
+
+// encodeKeyValues encodes the count of kvs as a uvarint followed by each
+// key and value as uvarint-prefixed bytes
+func encodeKeyValues(kvs []KeyValue) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(kvs)))
+	for _, kv := range kvs {
+		b = wire.AppendBytes(b, []byte(kv.Key))
+		b = wire.AppendBytes(b, kv.Value)
+	}
+	return b
+}
+
+// decodeKeyValues decodes pairs encoded by encodeKeyValues
+func decodeKeyValues(b []byte) ([]KeyValue, error) {
+	r := wire.Reader{B: b}
+	n := r.Uvarint()
+	if n > uint64(len(r.B)) {
+		return nil, wire.ErrMalformed
+	}
+	kvs := make([]KeyValue, 0, n)
+	for range n {
+		key := string(r.Bytes())
+		kvs = append(kvs, KeyValue{Key: key, Value: r.Bytes()})
+	}
+	return kvs, r.Err
+}
+
+// encodePartitions encodes the partition count as a uvarint followed by each
+// partition encoded with encodeKeyValues as uvarint-prefixed bytes
+func encodePartitions(parts [][]KeyValue) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(parts)))
+	for _, p := range parts {
+		b = wire.AppendBytes(b, encodeKeyValues(p))
+	}
+	return b
+}
+
+// decodePartitions decodes partitions encoded by encodePartitions
+func decodePartitions(b []byte) ([][]KeyValue, error) {
+	r := wire.Reader{B: b}
+	n := r.Uvarint()
+	if n > uint64(len(r.B)) {
+		return nil, wire.ErrMalformed
+	}
+	parts := make([][]KeyValue, 0, n)
+	for range n {
+		kvs, err := decodeKeyValues(r.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, kvs)
+	}
+	return parts, r.Err
+}
@@ -0,0 +1,46 @@
+package taskqueue
+
+import "fmt"
+
+// MemberState is the state of a member as seen by the local node
+type MemberState int
+
+const (
+	// MemberAlive members answer probes
+	MemberAlive MemberState = iota
+	// MemberSuspect members missed a probe and are declared dead unless
+	// they refute the suspicion in time
+	MemberSuspect
+	// MemberDead members stayed suspect for the whole suspicion timeout
+	MemberDead
+	// MemberLeft members left the group on purpose
+	MemberLeft
+)
+
+// String returns the state name
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	case MemberLeft:
+		return "left"
+	default:
+		return fmt.Sprintf("MemberState(%d)", int(s))
+	}
+}
+
+// Member is one node of a group as another node sees it, such as a member
+// of a SWIM group tracked by package membership or a worker registered with
+// a Coordinator. Incarnation is raised only by the member itself, to refute
+// rumours that it is suspect or dead; higher incarnations override lower
+// ones
+type Member struct {
+	Name        string
+	Addr        string
+	State       MemberState
+	Incarnation uint64
+}
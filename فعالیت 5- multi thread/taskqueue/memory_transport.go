@@ -0,0 +1,406 @@
+package taskqueue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryConnBuffer is the number of messages a memory connection holds in
+// each direction before Send blocks, standing in for socket buffers
+const memoryConnBuffer = 128
+
+// MemoryNetwork is a Transport that connects nodes of one process through
+// channels, so distributed components can run without opening sockets;
+// addresses are arbitrary names. Components given a Host of the network can
+// be partitioned from each other, and the links between hosts can be given
+// latency and loss
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	dials     int
+	parts     partitions
+	links     map[[2]string]MemoryLink
+	rng       *lockedRand
+}
+
+// MemoryLink is how messages fare from one host to another
+type MemoryLink struct {
+	// Latency, if set, delays every message by a duration drawn from it;
+	// messages on a connection still arrive in order
+	Latency Distribution
+	// Loss is the probability that a message is lost
+	Loss float64
+}
+
+// NewMemoryNetwork creates an empty network whose links deliver every
+// message at once
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners: make(map[string]*memoryListener),
+		links:     make(map[[2]string]MemoryLink),
+		rng:       &lockedRand{rng: rand.New(rand.NewPCG(1, 0))},
+	}
+}
+
+// SetLink sets how messages sent from host from to host to fare, from then
+// on, on connections open or not; either name may be empty to mean any
+// host, so SetLink("", "", link) sets the default. The most specific
+// setting applies: from and to, then from to any host, then any host to
+// to. Messages between the network's own listeners and dials, which belong
+// to no host, follow the default
+func (n *MemoryNetwork) SetLink(from, to string, link MemoryLink) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[[2]string{from, to}] = link
+}
+
+// SetSeed reseeds the draws of latency and loss
+func (n *MemoryNetwork) SetSeed(seed uint64) {
+	n.rng.mu.Lock()
+	n.rng.rng = rand.New(rand.NewPCG(seed, 0))
+	n.rng.mu.Unlock()
+}
+
+// link returns the setting for messages from host from to host to
+func (n *MemoryNetwork) link(from, to string) (MemoryLink, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, key := range [][2]string{{from, to}, {from, ""}, {"", to}, {"", ""}} {
+		if l, ok := n.links[key]; ok {
+			return l, true
+		}
+	}
+	return MemoryLink{}, false
+}
+
+// Listen implements Transport
+func (n *MemoryNetwork) Listen(addr string) (Listener, error) {
+	return n.listen("", addr)
+}
+
+// Dial implements Transport
+func (n *MemoryNetwork) Dial(ctx context.Context, addr string) (Conn, error) {
+	return n.dial(ctx, "", addr)
+}
+
+// Host returns a view of the network for the host name: the addresses it
+// listens on belong to the host and its dials come from it, so Partition
+// can cut it off. Listeners and dials made on the network itself belong to
+// no host and are never cut off
+func (n *MemoryNetwork) Host(name string) Transport {
+	return &memoryHost{network: n, name: name}
+}
+
+// Partition splits the hosts into the given groups, each of which can only
+// reach itself, until Heal; hosts in no group form one more group together.
+// Dials across groups fail with ErrPartitioned and messages sent across
+// them on open connections are lost
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.parts.split(groups)
+}
+
+// Heal undoes Partition, letting every host reach every other again
+func (n *MemoryNetwork) Heal() {
+	n.parts.heal()
+}
+
+// Reachable reports whether host from can reach host to across the current
+// partition
+func (n *MemoryNetwork) Reachable(from, to string) bool {
+	return n.parts.connected(from, to)
+}
+
+// Crash takes host down as if its machine failed: its listeners close, it
+// reaches no one and messages to it are lost. Connections the host closes
+// while down are abandoned rather than closed, so their peers hear nothing
+// until host is restored and answers them with a reset, as a rebooted
+// machine answers a stale TCP connection
+func (n *MemoryNetwork) Crash(host string) {
+	n.parts.setDown(host, true)
+	n.mu.Lock()
+	var crashed []*memoryListener
+	for _, l := range n.listeners {
+		if l.host == host {
+			crashed = append(crashed, l)
+		}
+	}
+	n.mu.Unlock()
+	for _, l := range crashed {
+		l.Close()
+	}
+}
+
+// Restore brings a crashed host back on the network
+func (n *MemoryNetwork) Restore(host string) {
+	n.parts.setDown(host, false)
+}
+
+// memoryHost is a MemoryNetwork seen from one host
+type memoryHost struct {
+	network *MemoryNetwork
+	name    string
+}
+
+func (h *memoryHost) Listen(addr string) (Listener, error) {
+	return h.network.listen(h.name, addr)
+}
+
+func (h *memoryHost) Dial(ctx context.Context, addr string) (Conn, error) {
+	return h.network.dial(ctx, h.name, addr)
+}
+
+// listen opens addr for host, which is empty for the network itself
+func (n *MemoryNetwork) listen(host, addr string) (Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, taken := n.listeners[addr]; taken {
+		return nil, fmt.Errorf("memory network: address %q in use", addr)
+	}
+	l := &memoryListener{
+		network: n,
+		addr:    addr,
+		host:    host,
+		accept:  make(chan *memoryConn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// dial connects host, which is empty for the network itself, to addr
+func (n *MemoryNetwork) dial(ctx context.Context, host, addr string) (Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	n.dials++
+	client := fmt.Sprintf("mem-client-%d", n.dials)
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("memory network: dial %q: connection refused", addr)
+	}
+	if !n.parts.connected(host, l.host) {
+		return nil, fmt.Errorf("memory network: dial %q from %s: %w", addr, host, ErrPartitioned)
+	}
+
+	a, b := newMemoryPipe(addr, client)
+	a.network, a.parts, a.from, a.to = n, &n.parts, host, l.host
+	b.network, b.parts, b.from, b.to = n, &n.parts, l.host, host
+	select {
+	case l.accept <- b:
+		return a, nil
+	case <-l.done:
+		return nil, fmt.Errorf("memory network: dial %q: connection refused", addr)
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// memoryListener accepts the connections dialed to its address
+type memoryListener struct {
+	network *MemoryNetwork
+	addr    string
+	host    string
+	accept  chan *memoryConn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *memoryListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.network.mu.Lock()
+		if l.network.listeners[l.addr] == l {
+			delete(l.network.listeners, l.addr)
+		}
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() string { return l.addr }
+
+// memoryConn is one end of an in-process connection; closing either end
+// closes both, after which Recv still returns what was already delivered.
+// Messages still delayed by the link's latency are lost. An end closed by a
+// crashed host is only abandoned: its peer's messages are lost, and its
+// first message once the host is back closes both ends
+type memoryConn struct {
+	in     <-chan *Message
+	out    chan<- *Message
+	remote string
+	done   chan struct{}
+	once   *sync.Once
+	// abandoned is closed when this end is abandoned, and peerAbandoned
+	// when the other is
+	abandoned     chan struct{}
+	abandonOnce   sync.Once
+	peerAbandoned <-chan struct{}
+	// network and parts decide whether and how messages from the host from
+	// reach the host to
+	network  *MemoryNetwork
+	parts    *partitions
+	from, to string
+
+	// delayed feeds the goroutine delivering messages once their latency
+	// is over; it starts with the first delayed message, and from then on
+	// every message goes through it to keep their order. Both fields are
+	// guarded by delayMu
+	delayMu sync.Mutex
+	delayed chan delayedMessage
+	lastDue time.Time
+}
+
+// newMemoryPipe returns the dialer's and the listener's ends of a connection
+func newMemoryPipe(server, client string) (*memoryConn, *memoryConn) {
+	ab := make(chan *Message, memoryConnBuffer)
+	ba := make(chan *Message, memoryConnBuffer)
+	done := make(chan struct{})
+	once := new(sync.Once)
+	abandonedA, abandonedB := make(chan struct{}), make(chan struct{})
+	return &memoryConn{in: ba, out: ab, remote: server, done: done, once: once, abandoned: abandonedA, peerAbandoned: abandonedB},
+		&memoryConn{in: ab, out: ba, remote: client, done: done, once: once, abandoned: abandonedB, peerAbandoned: abandonedA}
+}
+
+func (c *memoryConn) Send(m *Message) error {
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	case <-c.abandoned:
+		return net.ErrClosed
+	default:
+	}
+	if !c.parts.connected(c.from, c.to) {
+		return nil
+	}
+	select {
+	case <-c.peerAbandoned:
+		// The peer's host crashed and is back: it resets the connection
+		c.once.Do(func() { close(c.done) })
+		return net.ErrClosed
+	default:
+	}
+	var delay time.Duration
+	link, ok := MemoryLink{}, false
+	if c.network != nil {
+		link, ok = c.network.link(c.from, c.to)
+	}
+	if ok {
+		if link.Loss > 0 && c.network.rng.float64() < link.Loss {
+			return nil
+		}
+		if link.Latency != nil {
+			delay = c.network.rng.sample(link.Latency)
+		}
+	}
+	// Copy so neither side sees the other mutate a message it holds
+	cp := *m
+	cp.Payload = slices.Clone(m.Payload)
+	c.delayMu.Lock()
+	if delay > 0 || c.delayed != nil {
+		defer c.delayMu.Unlock()
+		return c.sendDelayed(&cp, delay)
+	}
+	c.delayMu.Unlock()
+	select {
+	case c.out <- &cp:
+		return nil
+	case <-c.done:
+		return net.ErrClosed
+	case <-c.peerAbandoned:
+		return nil
+	}
+}
+
+// sendDelayed hands m to the delivery goroutine to arrive after delay, and
+// no sooner than the messages sent before it; c.delayMu must be held, which
+// keeps the queue in due order
+func (c *memoryConn) sendDelayed(m *Message, delay time.Duration) error {
+	if c.delayed == nil {
+		c.delayed = make(chan delayedMessage, memoryConnBuffer)
+		go c.deliver(c.delayed)
+	}
+	due := time.Now().Add(delay)
+	if due.Before(c.lastDue) {
+		due = c.lastDue
+	}
+	c.lastDue = due
+	select {
+	case c.delayed <- delayedMessage{m: m, due: due}:
+		return nil
+	case <-c.done:
+		return net.ErrClosed
+	case <-c.peerAbandoned:
+		return nil
+	}
+}
+
+// deliver passes delayed messages on as they fall due, until the
+// connection closes
+func (c *memoryConn) deliver(delayed <-chan delayedMessage) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		var d delayedMessage
+		select {
+		case d = <-delayed:
+		case <-c.done:
+			return
+		}
+		if wait := time.Until(d.due); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-c.done:
+				return
+			}
+		}
+		select {
+		case c.out <- d.m:
+		case <-c.done:
+			return
+		case <-c.peerAbandoned:
+			return
+		}
+	}
+}
+
+func (c *memoryConn) Recv() (*Message, error) {
+	select {
+	case m := <-c.in:
+		return m, nil
+	case <-c.abandoned:
+		return nil, net.ErrClosed
+	case <-c.done:
+		select {
+		case m := <-c.in:
+			return m, nil
+		default:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (c *memoryConn) Close() error {
+	if c.parts != nil && c.parts.isDown(c.from) {
+		c.abandonOnce.Do(func() { close(c.abandoned) })
+		return nil
+	}
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *memoryConn) RemoteAddr() string { return c.remote }
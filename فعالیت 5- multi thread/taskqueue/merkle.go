@@ -0,0 +1,306 @@
+package taskqueue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"multithread/hashring"
+
+	"multithread/internal/wire"
+)
+
+// merkleDepth is the depth of a quorum replica's Merkle tree: 1024 leaves,
+// each covering a range of the key hash space
+const merkleDepth = 10
+
+// MerkleTree summarises a set of entries so that two replicas can find where
+// they differ by comparing a few hashes. Entries fall into the leaf of their
+// key's range of the hash space; a leaf hashes its entries and every inner
+// node its two children, so equal roots mean equal sets and a difference can
+// be chased down to the leaves that hold it. Leaves combine their entries'
+// hashes with XOR, so the tree is updated entry by entry without rereading
+// the rest of its leaf. It is not safe for concurrent use
+type MerkleTree struct {
+	depth int
+	nodes [][sha256.Size]byte // nodes[1] is the root; node i has children 2i and 2i+1
+}
+
+// NewMerkleTree creates the tree of an empty set with 2^depth leaves
+func NewMerkleTree(depth int) *MerkleTree {
+	t := &MerkleTree{depth: depth, nodes: make([][sha256.Size]byte, 2<<depth)}
+	for i := 1<<depth - 1; i >= 1; i-- {
+		t.rehash(uint64(i))
+	}
+	return t
+}
+
+// Depth returns the number of levels below the root
+func (t *MerkleTree) Depth() int {
+	return t.depth
+}
+
+// Leaf returns the node index of the leaf key falls into
+func (t *MerkleTree) Leaf(key string) uint64 {
+	return 1<<t.depth + hashring.Hash(key)>>(64-t.depth)
+}
+
+// IsLeaf reports whether node is a leaf
+func (t *MerkleTree) IsLeaf(node uint64) bool {
+	return node >= 1<<t.depth
+}
+
+// Hash returns the hash of node, or false if the tree has no such node
+func (t *MerkleTree) Hash(node uint64) ([sha256.Size]byte, bool) {
+	if node == 0 || node >= uint64(len(t.nodes)) {
+		return [sha256.Size]byte{}, false
+	}
+	return t.nodes[node], true
+}
+
+// Root returns the hash of the whole set
+func (t *MerkleTree) Root() [sha256.Size]byte {
+	return t.nodes[1]
+}
+
+// Update replaces the entry old of key with new; either is nil for an entry
+// that is absent. An entry is any encoding of the key's state that replicas
+// agree on
+func (t *MerkleTree) Update(key string, old, new []byte) {
+	leaf := t.Leaf(key)
+	for _, entry := range [][]byte{old, new} {
+		if entry == nil {
+			continue
+		}
+		h := sha256.Sum256(entry)
+		for i := range h {
+			t.nodes[leaf][i] ^= h[i]
+		}
+	}
+	for node := leaf / 2; node >= 1; node /= 2 {
+		t.rehash(node)
+	}
+}
+
+// rehash recomputes an inner node from its children
+func (t *MerkleTree) rehash(node uint64) {
+	var b [2 * sha256.Size]byte
+	copy(b[:], t.nodes[2*node][:])
+	copy(b[sha256.Size:], t.nodes[2*node+1][:])
+	t.nodes[node] = sha256.Sum256(b[:])
+}
+
+// antiEntropyMsg is the payload of a digest or repair exchange: the tree
+// depth the sender uses, the nodes asked about, their hashes in a digest
+// reply, and the entries of the repaired leaves as encoded quorumMsgs
+type antiEntropyMsg struct {
+	Depth   int
+	Nodes   []uint64
+	Hashes  [][]byte
+	Entries [][]byte
+}
+
+// marshal encodes the message as uvarints for the depth and nodes, each list
+// preceded by its length, followed by the hashes and entries as
+// uvarint-prefixed bytes
+func (a *antiEntropyMsg) marshal() []byte {
+	b := binary.AppendUvarint(nil, uint64(a.Depth))
+	b = binary.AppendUvarint(b, uint64(len(a.Nodes)))
+	for _, n := range a.Nodes {
+		b = binary.AppendUvarint(b, n)
+	}
+	for _, list := range [][][]byte{a.Hashes, a.Entries} {
+		b = binary.AppendUvarint(b, uint64(len(list)))
+		for _, v := range list {
+			b = wire.AppendBytes(b, v)
+		}
+	}
+	return b
+}
+
+// unmarshal decodes a message encoded by marshal
+func (a *antiEntropyMsg) unmarshal(b []byte) error {
+	r := wire.Reader{B: b}
+	a.Depth = int(r.Uvarint())
+	n := r.Uvarint()
+	if n > uint64(len(r.B)) {
+		return wire.ErrMalformed
+	}
+	a.Nodes = make([]uint64, n)
+	for i := range a.Nodes {
+		a.Nodes[i] = r.Uvarint()
+	}
+	for _, list := range []*[][]byte{&a.Hashes, &a.Entries} {
+		n := r.Uvarint()
+		if n > uint64(len(r.B)) {
+			return wire.ErrMalformed
+		}
+		*list = make([][]byte, n)
+		for i := range *list {
+			(*list)[i] = r.Bytes()
+		}
+	}
+	return r.Err
+}
+
+// handleAntiEntropy answers a digest or repair request from a peer syncing
+// with the replica
+func (r *QuorumReplica) handleAntiEntropy(m *Message) *Message {
+	reply := &Message{Type: m.Type}
+	var req antiEntropyMsg
+	if err := req.unmarshal(m.Payload); err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+	if req.Depth != merkleDepth {
+		reply.Error = fmt.Sprintf("merkle tree depth is %d, peer uses %d", merkleDepth, req.Depth)
+		return reply
+	}
+	resp := antiEntropyMsg{Depth: merkleDepth}
+	switch m.Type {
+	case MsgDigest:
+		r.mu.Lock()
+		for _, node := range req.Nodes {
+			h, _ := r.tree.Hash(node)
+			resp.Hashes = append(resp.Hashes, h[:])
+		}
+		r.mu.Unlock()
+	case MsgRepair:
+		// Answer with the entries as they were before the peer's, so that
+		// the peer only gets what it is missing
+		resp.Entries = r.leafEntries(req.Nodes)
+		if _, err := r.storeEntries(req.Entries); err != nil {
+			reply.Error = err.Error()
+			return reply
+		}
+	}
+	reply.Payload = resp.marshal()
+	return reply
+}
+
+// leafEntries returns the encoded entries in the given leaves
+func (r *QuorumReplica) leafEntries(leaves []uint64) [][]byte {
+	want := make(map[uint64]bool, len(leaves))
+	for _, leaf := range leaves {
+		want[leaf] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var entries [][]byte
+	for key, v := range r.data {
+		if want[r.tree.Leaf(key)] {
+			entries = append(entries, (&quorumMsg{Key: key, Found: true, Versioned: *v}).marshal())
+		}
+	}
+	return entries
+}
+
+// storeEntries writes the encoded entries, returning how many were newer
+// than the replica's own
+func (r *QuorumReplica) storeEntries(entries [][]byte) (int, error) {
+	stored := 0
+	for _, b := range entries {
+		var q quorumMsg
+		if err := q.unmarshal(b); err != nil {
+			return stored, err
+		}
+		if r.write(q.Key, &q.Versioned) {
+			stored++
+		}
+	}
+	return stored, nil
+}
+
+// SyncWith runs one round of anti-entropy with the replica at addr: the two
+// compare their Merkle trees level by level from the root, then swap the
+// entries of the leaves that differ, each keeping the newer version of every
+// key. It returns how many keys the local replica took from the peer.
+// Replicas that sync must hold the same keys, as when every replica is one of
+// a key's N; the entries of both sides are merged otherwise
+func (r *QuorumReplica) SyncWith(ctx context.Context, addr string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*quorumTimeout)
+	defer cancel()
+	conn, err := r.transport.Dial(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	exchange := func(t MessageType, req *antiEntropyMsg) (*antiEntropyMsg, error) {
+		req.Depth = merkleDepth
+		if err := conn.Send(&Message{Type: t, Payload: req.marshal()}); err != nil {
+			return nil, err
+		}
+		m, err := conn.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if m.Error != "" {
+			return nil, errors.New(m.Error)
+		}
+		resp := new(antiEntropyMsg)
+		return resp, resp.unmarshal(m.Payload)
+	}
+
+	var leaves []uint64
+	for level := []uint64{1}; len(level) > 0; {
+		resp, err := exchange(MsgDigest, &antiEntropyMsg{Nodes: level})
+		if err != nil {
+			return 0, err
+		}
+		if len(resp.Hashes) != len(level) {
+			return 0, wire.ErrMalformed
+		}
+		var next []uint64
+		r.mu.Lock()
+		for i, node := range level {
+			if h, _ := r.tree.Hash(node); string(h[:]) == string(resp.Hashes[i]) {
+				continue
+			}
+			if r.tree.IsLeaf(node) {
+				leaves = append(leaves, node)
+			} else {
+				next = append(next, 2*node, 2*node+1)
+			}
+		}
+		r.mu.Unlock()
+		level = next
+	}
+	if len(leaves) == 0 {
+		return 0, nil
+	}
+
+	resp, err := exchange(MsgRepair, &antiEntropyMsg{Nodes: leaves, Entries: r.leafEntries(leaves)})
+	if err != nil {
+		return 0, err
+	}
+	return r.storeEntries(resp.Entries)
+}
+
+// RunAntiEntropy syncs with a random one of peers every interval until ctx
+// is cancelled, calling onRound, if not nil, with the outcome of each round
+func (r *QuorumReplica) RunAntiEntropy(ctx context.Context, peers []string, interval time.Duration, onRound func(peer string, repaired int, err error)) error {
+	if len(peers) == 0 {
+		return errors.New("anti-entropy: no peers")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-ticker.C:
+		}
+		peer := peers[rand.N(len(peers))]
+		repaired, err := r.SyncWith(ctx, peer)
+		if onRound != nil {
+			onRound(peer, repaired, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package taskqueue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencySmoothing is the weight of the newest sample in the latency average
+const latencySmoothing = 0.2
+
+// PoolMetrics holds the counters a pool updates as tasks move through it;
+// every field is safe for concurrent use
+type PoolMetrics struct {
+	submitted  atomic.Int64
+	cancelled  atomic.Int64
+	active     atomic.Int64
+	completed  atomic.Int64
+	failed     atomic.Int64
+	timedOut   atomic.Int64
+	retried    atomic.Int64
+	weight     atomic.Int64 // summed weight of running tasks
+	busyTime   atomic.Int64 // summed execution time in nanoseconds
+	latency    atomic.Int64 // moving average execution time in nanoseconds
+	firstSeen  atomic.Int64 // unix nanoseconds of the first submission
+	lastDone   atomic.Int64 // unix nanoseconds of the latest completion
+	queueWait  Histogram
+	execTime   Histogram
+	endToEnd   Histogram
+	throughput rateWindow
+	// seenCompleted is the highest completed count of a snapshot, only
+	// kept in builds with the pooldebug tag
+	seenCompleted atomic.Int64
+}
+
+// MetricsSnapshot is a point-in-time copy of a pool's metrics
+type MetricsSnapshot struct {
+	Submitted int64
+	Cancelled int64
+	Active    int64
+	Completed int64
+	Succeeded int64
+	Failed    int64
+	TimedOut  int64
+	Retried   int64
+	// InFlightWeight is the summed weight of running tasks under WithWeightBudget
+	InFlightWeight int64
+	// QueueDepth is the number of tasks waiting for a worker
+	QueueDepth int
+	// BusyTime is the execution time summed over all completed tasks
+	BusyTime time.Duration
+	// WallTime spans the first submission to the latest completion
+	WallTime time.Duration
+	// AverageLatency is a moving average of task execution time
+	AverageLatency time.Duration
+}
+
+// recordSubmit counts a newly submitted task
+func (m *PoolMetrics) recordSubmit() {
+	m.submitted.Add(1)
+	m.firstSeen.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+// recordCancel counts a task that finished without ever running
+func (m *PoolMetrics) recordCancel() {
+	m.cancelled.Add(1)
+}
+
+// recordStart marks a task as running after it waited for a worker for
+// wait
+func (m *PoolMetrics) recordStart(wait time.Duration) {
+	m.queueWait.Record(wait)
+	m.active.Add(1)
+}
+
+// recordFinish marks a running attempt as done after executing for d
+func (m *PoolMetrics) recordFinish(d time.Duration) {
+	m.busyTime.Add(int64(d))
+	m.observeLatency(d)
+	m.execTime.Record(d)
+	m.active.Add(-1)
+}
+
+// recordOutcome counts a task submitted at submitted whose final attempt
+// ended with err
+func (m *PoolMetrics) recordOutcome(submitted time.Time, err error) {
+	now := time.Now()
+	m.endToEnd.Record(now.Sub(submitted))
+	m.lastDone.Store(now.UnixNano())
+	m.throughput.record(now)
+	if err != nil {
+		m.failed.Add(1)
+	}
+	m.completed.Add(1)
+}
+
+// observeLatency folds d into the moving average of task execution time
+func (m *PoolMetrics) observeLatency(d time.Duration) {
+	for {
+		old := m.latency.Load()
+		next := int64(d)
+		if old != 0 {
+			next = int64(float64(old)*(1-latencySmoothing) + float64(d)*latencySmoothing)
+		}
+		if m.latency.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// snapshot copies the counters; queueDepth is supplied by the owning pool
+func (m *PoolMetrics) snapshot(queueDepth int) MetricsSnapshot {
+	completed := m.completed.Load()
+	failed := m.failed.Load()
+	snap := MetricsSnapshot{
+		Submitted:      m.submitted.Load(),
+		Cancelled:      m.cancelled.Load(),
+		Active:         m.active.Load(),
+		Completed:      completed,
+		Succeeded:      completed - failed,
+		Failed:         failed,
+		TimedOut:       m.timedOut.Load(),
+		Retried:        m.retried.Load(),
+		InFlightWeight: m.weight.Load(),
+		QueueDepth:     queueDepth,
+		BusyTime:       time.Duration(m.busyTime.Load()),
+		AverageLatency: time.Duration(m.latency.Load()),
+	}
+	if first, last := m.firstSeen.Load(), m.lastDone.Load(); first != 0 && last > first {
+		snap.WallTime = time.Duration(last - first)
+	}
+	if invariantChecks {
+		m.checkSnapshot(snap)
+	}
+	return snap
+}
@@ -0,0 +1,608 @@
+package taskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+)
+
+// msgpackMaxDepth bounds how deeply arrays and maps may nest in a decoded
+// value, so that a hostile frame cannot exhaust the stack
+const msgpackMaxDepth = 64
+
+// errMalformedMsgpack is reported for MessagePack input that does not decode
+var errMalformedMsgpack = errors.New("malformed msgpack value")
+
+// MsgpackMarshaler is a value that encodes itself as one MessagePack value
+type MsgpackMarshaler interface {
+	MarshalMsgpack() ([]byte, error)
+}
+
+// MsgpackUnmarshaler is a value that decodes itself from one MessagePack
+// value
+type MsgpackUnmarshaler interface {
+	UnmarshalMsgpack(b []byte) error
+}
+
+// MsgpackCodec encodes values as MessagePack, which is more compact than
+// JSON and has libraries in most languages. Without reflection it handles
+// nil, booleans, numbers, strings, []byte, []string, []any, map[string]any
+// and map[string]string, and values with MarshalMsgpack and UnmarshalMsgpack
+// methods such as Message; maps decode into map[string]any, integers into
+// int64, or uint64 for those above math.MaxInt64
+type MsgpackCodec struct{}
+
+// Name implements Codec
+func (MsgpackCodec) Name() string { return "msgpack" }
+
+// Marshal implements Codec
+func (MsgpackCodec) Marshal(v any) ([]byte, error) {
+	return appendMsgpack(nil, v)
+}
+
+// Unmarshal implements Codec
+func (MsgpackCodec) Unmarshal(b []byte, v any) error {
+	if u, ok := v.(MsgpackUnmarshaler); ok {
+		return u.UnmarshalMsgpack(b)
+	}
+	r := msgpackReader{b: b}
+	x := r.value(0)
+	if r.err == nil && len(r.b) > 0 {
+		r.err = errMalformedMsgpack
+	}
+	if r.err != nil {
+		return r.err
+	}
+	ok := true
+	switch p := v.(type) {
+	case *any:
+		*p = x
+	case *bool:
+		*p, ok = x.(bool)
+	case *string:
+		*p, ok = x.(string)
+	case *int:
+		var n int64
+		n, ok = msgpackInt(x)
+		*p = int(n)
+	case *int64:
+		*p, ok = msgpackInt(x)
+	case *uint64:
+		var n int64
+		if *p, ok = x.(uint64); !ok {
+			n, ok = msgpackInt(x)
+			ok = ok && n >= 0
+			*p = uint64(n)
+		}
+	case *float64:
+		switch x := x.(type) {
+		case float64:
+			*p = x
+		case int64:
+			*p = float64(x)
+		case uint64:
+			*p = float64(x)
+		default:
+			ok = false
+		}
+	case *[]byte:
+		switch x := x.(type) {
+		case []byte:
+			*p = x
+		case string:
+			*p = []byte(x)
+		case nil:
+			*p = nil
+		default:
+			ok = false
+		}
+	case *[]any:
+		*p, ok = x.([]any)
+		ok = ok || x == nil
+	case *[]string:
+		items, isArray := x.([]any)
+		ok = isArray || x == nil
+		*p = make([]string, 0, len(items))
+		for _, item := range items {
+			s, isString := item.(string)
+			ok = ok && isString
+			*p = append(*p, s)
+		}
+	case *map[string]any:
+		*p, ok = x.(map[string]any)
+		ok = ok || x == nil
+	case *map[string]string:
+		entries, isMap := x.(map[string]any)
+		ok = isMap || x == nil
+		*p = make(map[string]string, len(entries))
+		for k, e := range entries {
+			s, isString := e.(string)
+			ok = ok && isString
+			(*p)[k] = s
+		}
+	default:
+		return fmt.Errorf("msgpack codec: cannot decode into %T", v)
+	}
+	if !ok {
+		return fmt.Errorf("msgpack codec: cannot decode %T into %T", x, v)
+	}
+	return nil
+}
+
+// msgpackInt returns x as an int64 if it is an integer that fits
+func msgpackInt(x any) (int64, bool) {
+	switch x := x.(type) {
+	case int64:
+		return x, true
+	case uint64:
+		return int64(x), x <= math.MaxInt64
+	default:
+		return 0, false
+	}
+}
+
+// appendMsgpack appends v as one MessagePack value
+func appendMsgpack(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case MsgpackMarshaler:
+		out, err := v.MarshalMsgpack()
+		return append(b, out...), err
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return appendMsgpackInt(b, int64(v)), nil
+	case int8:
+		return appendMsgpackInt(b, int64(v)), nil
+	case int16:
+		return appendMsgpackInt(b, int64(v)), nil
+	case int32:
+		return appendMsgpackInt(b, int64(v)), nil
+	case int64:
+		return appendMsgpackInt(b, v), nil
+	case uint:
+		return appendMsgpackUint(b, uint64(v)), nil
+	case uint8:
+		return appendMsgpackUint(b, uint64(v)), nil
+	case uint16:
+		return appendMsgpackUint(b, uint64(v)), nil
+	case uint32:
+		return appendMsgpackUint(b, uint64(v)), nil
+	case uint64:
+		return appendMsgpackUint(b, v), nil
+	case float32:
+		return appendMsgpackFloat(b, float64(v)), nil
+	case float64:
+		return appendMsgpackFloat(b, v), nil
+	case string:
+		return appendMsgpackString(b, v), nil
+	case []byte:
+		return appendMsgpackBinary(b, v), nil
+	case []string:
+		b = appendMsgpackArray(b, len(v))
+		for _, s := range v {
+			b = appendMsgpackString(b, s)
+		}
+		return b, nil
+	case []any:
+		b = appendMsgpackArray(b, len(v))
+		for _, item := range v {
+			var err error
+			if b, err = appendMsgpack(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]string:
+		// Sorted keys keep the encoding of a map deterministic
+		b = appendMsgpackMap(b, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			b = appendMsgpackString(b, k)
+			b = appendMsgpackString(b, v[k])
+		}
+		return b, nil
+	case map[string]any:
+		b = appendMsgpackMap(b, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			b = appendMsgpackString(b, k)
+			var err error
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("msgpack codec: cannot encode %T", v)
+	}
+}
+
+// appendMsgpackUint appends v in the shortest unsigned integer format
+func appendMsgpackUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<7:
+		return append(b, byte(v))
+	case v < 1<<8:
+		return append(b, 0xcc, byte(v))
+	case v < 1<<16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v < 1<<32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+	}
+}
+
+// appendMsgpackInt appends v in the shortest integer format
+func appendMsgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return appendMsgpackUint(b, uint64(v))
+	case v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	}
+}
+
+// appendMsgpackFloat appends v as a float 64
+func appendMsgpackFloat(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+}
+
+// appendMsgpackString appends s as a str
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// appendMsgpackBinary appends v as a bin
+func appendMsgpackBinary(b, v []byte) []byte {
+	switch n := len(v); {
+	case n < 1<<8:
+		b = append(b, 0xc4, byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, v...)
+}
+
+// appendMsgpackArray appends the header of an array of n values
+func appendMsgpackArray(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+// appendMsgpackMap appends the header of a map of n entries
+func appendMsgpackMap(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+// msgpackReader decodes MessagePack values in order, remembering the first
+// error
+type msgpackReader struct {
+	b   []byte
+	err error
+}
+
+// take consumes the next n bytes
+func (r *msgpackReader) take(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.b)) {
+		r.err = errMalformedMsgpack
+		return nil
+	}
+	v := r.b[:n:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// size consumes a big-endian length of n bytes
+func (r *msgpackReader) size(n int) uint64 {
+	b := r.take(uint64(n))
+	if r.err != nil {
+		return 0
+	}
+	switch n {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	default:
+		return binary.BigEndian.Uint64(b)
+	}
+}
+
+// value decodes the next value, nested depth arrays and maps deep
+func (r *msgpackReader) value(depth int) any {
+	head := r.take(1)
+	if r.err != nil {
+		return nil
+	}
+	switch c := head[0]; {
+	case c <= 0x7f:
+		return int64(c)
+	case c >= 0xe0:
+		return int64(int8(c))
+	case c&0xf0 == 0x80:
+		return r.mapOf(uint64(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return r.arrayOf(uint64(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return string(r.take(uint64(c & 0x1f)))
+	}
+	switch c := head[0]; c {
+	case 0xc0:
+		return nil
+	case 0xc2:
+		return false
+	case 0xc3:
+		return true
+	case 0xc4, 0xc5, 0xc6:
+		return r.take(r.size(1 << (c - 0xc4)))
+	case 0xca:
+		return float64(math.Float32frombits(uint32(r.size(4))))
+	case 0xcb:
+		return math.Float64frombits(r.size(8))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v := r.size(1 << (c - 0xcc))
+		if v > math.MaxInt64 {
+			return v
+		}
+		return int64(v)
+	case 0xd0:
+		return int64(int8(r.size(1)))
+	case 0xd1:
+		return int64(int16(r.size(2)))
+	case 0xd2:
+		return int64(int32(r.size(4)))
+	case 0xd3:
+		return int64(r.size(8))
+	case 0xd9, 0xda, 0xdb:
+		return string(r.take(r.size(1 << (c - 0xd9))))
+	case 0xdc, 0xdd:
+		return r.arrayOf(r.size(2<<(c-0xdc)), depth)
+	case 0xde, 0xdf:
+		return r.mapOf(r.size(2<<(c-0xde)), depth)
+	default:
+		// Extension types have no meaning here
+		r.err = errMalformedMsgpack
+		return nil
+	}
+}
+
+// arrayOf decodes the n values of an array
+func (r *msgpackReader) arrayOf(n uint64, depth int) any {
+	// Every value takes at least a byte, which bounds what a length may
+	// claim before the values are read
+	if depth >= msgpackMaxDepth || n > uint64(len(r.b)) {
+		r.err = errMalformedMsgpack
+		return nil
+	}
+	items := make([]any, 0, n)
+	for ; n > 0 && r.err == nil; n-- {
+		items = append(items, r.value(depth+1))
+	}
+	return items
+}
+
+// mapOf decodes the n entries of a map, whose keys must be strings
+func (r *msgpackReader) mapOf(n uint64, depth int) any {
+	if depth >= msgpackMaxDepth || n > uint64(len(r.b))/2 {
+		r.err = errMalformedMsgpack
+		return nil
+	}
+	entries := make(map[string]any, n)
+	for ; n > 0 && r.err == nil; n-- {
+		k, ok := r.value(depth + 1).(string)
+		if !ok {
+			r.err = errMalformedMsgpack
+			return nil
+		}
+		entries[k] = r.value(depth + 1)
+	}
+	return entries
+}
+
+// uint decodes a non-negative integer
+func (r *msgpackReader) uint() uint64 {
+	switch v := r.value(0).(type) {
+	case uint64:
+		return v
+	case int64:
+		if v >= 0 {
+			return uint64(v)
+		}
+	}
+	if r.err == nil {
+		r.err = errMalformedMsgpack
+	}
+	return 0
+}
+
+// str decodes a string, or nil as the empty string
+func (r *msgpackReader) str() string {
+	switch v := r.value(0).(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	if r.err == nil {
+		r.err = errMalformedMsgpack
+	}
+	return ""
+}
+
+// bin decodes a bin or a string as bytes, or nil as no bytes
+func (r *msgpackReader) bin() []byte {
+	switch v := r.value(0).(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	case nil:
+		return nil
+	}
+	if r.err == nil {
+		r.err = errMalformedMsgpack
+	}
+	return nil
+}
+
+// mapLen decodes the header of a map and returns its number of entries
+func (r *msgpackReader) mapLen() uint64 {
+	head := r.take(1)
+	if r.err != nil {
+		return 0
+	}
+	switch c := head[0]; {
+	case c&0xf0 == 0x80:
+		return uint64(c & 0x0f)
+	case c == 0xde:
+		return r.size(2)
+	case c == 0xdf:
+		return r.size(4)
+	}
+	r.err = errMalformedMsgpack
+	return 0
+}
+
+// MarshalMsgpack encodes m as a map from the names of its set fields to
+// their values
+func (m *Message) MarshalMsgpack() ([]byte, error) {
+	var body []byte
+	n := 0
+	field := func(name string) []byte {
+		n++
+		return appendMsgpackString(body, name)
+	}
+	if m.Type != 0 {
+		body = appendMsgpackUint(field("Type"), uint64(m.Type))
+	}
+	if m.ID != 0 {
+		body = appendMsgpackUint(field("ID"), m.ID)
+	}
+	if m.Worker != "" {
+		body = appendMsgpackString(field("Worker"), m.Worker)
+	}
+	if m.Task != "" {
+		body = appendMsgpackString(field("Task"), m.Task)
+	}
+	if m.Capacity > 0 {
+		body = appendMsgpackUint(field("Capacity"), uint64(m.Capacity))
+	}
+	if len(m.Payload) > 0 {
+		body = appendMsgpackBinary(field("Payload"), m.Payload)
+	}
+	if m.Error != "" {
+		body = appendMsgpackString(field("Error"), m.Error)
+	}
+	if m.Redeliveries > 0 {
+		body = appendMsgpackUint(field("Redeliveries"), uint64(m.Redeliveries))
+	}
+	if m.Key != "" {
+		body = appendMsgpackString(field("Key"), m.Key)
+	}
+	if m.Clock != 0 {
+		body = appendMsgpackUint(field("Clock"), m.Clock)
+	}
+	if m.Trace != "" {
+		body = appendMsgpackString(field("Trace"), m.Trace)
+	}
+	if m.Token != "" {
+		body = appendMsgpackString(field("Token"), m.Token)
+	}
+	if m.Correlation != "" {
+		body = appendMsgpackString(field("Correlation"), m.Correlation)
+	}
+	if m.Route != "" {
+		body = appendMsgpackString(field("Route"), m.Route)
+	}
+	return append(appendMsgpackMap(nil, n), body...), nil
+}
+
+// UnmarshalMsgpack decodes a map encoded by MarshalMsgpack into m, skipping
+// names it does not know
+func (m *Message) UnmarshalMsgpack(b []byte) error {
+	*m = Message{}
+	r := msgpackReader{b: b}
+	for n := r.mapLen(); n > 0 && r.err == nil; n-- {
+		switch r.str() {
+		case "Type":
+			m.Type = MessageType(r.uint())
+		case "ID":
+			m.ID = r.uint()
+		case "Worker":
+			m.Worker = r.str()
+		case "Task":
+			m.Task = r.str()
+		case "Capacity":
+			m.Capacity = int(r.uint())
+		case "Payload":
+			m.Payload = r.bin()
+		case "Error":
+			m.Error = r.str()
+		case "Redeliveries":
+			m.Redeliveries = int(r.uint())
+		case "Key":
+			m.Key = r.str()
+		case "Clock":
+			m.Clock = r.uint()
+		case "Trace":
+			m.Trace = r.str()
+		case "Token":
+			m.Token = r.str()
+		case "Correlation":
+			m.Correlation = r.str()
+		case "Route":
+			m.Route = r.str()
+		default:
+			r.value(0)
+		}
+	}
+	if r.err == nil && len(r.b) > 0 {
+		r.err = errMalformedMsgpack
+	}
+	return r.err
+}
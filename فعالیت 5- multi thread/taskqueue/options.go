@@ -0,0 +1,215 @@
+package taskqueue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Option configures a pool at construction time
+type Option func(*poolConfig)
+
+// poolConfig collects the settings shared by every pool implementation
+type poolConfig struct {
+	name             string
+	ctx              context.Context
+	priorityDispatch bool
+	priorityAging    time.Duration
+	errorHandler     func(err error)
+	queueCapacity    int
+	rejection        RejectionPolicy
+	rateLimit        float64
+	rateBurst        int
+	retry            *RetryPolicy
+	hooks            hookList
+	middleware       []Middleware
+	maxWorkers       int
+	keepAlive        time.Duration
+	queue            TaskQueue
+	tracing          bool
+	failFast         bool
+	events           listenerList
+	weightBudget     int64
+	logger           *slog.Logger
+	taskTracking     bool
+}
+
+// RejectionPolicy decides what happens to a task submitted to a full queue
+type RejectionPolicy int
+
+const (
+	// BlockPolicy makes the submitter wait until the queue has room
+	BlockPolicy RejectionPolicy = iota
+	// RejectPolicy fails the new task with ErrQueueFull
+	RejectPolicy
+	// DropOldestPolicy evicts the oldest queued task with ErrTaskDropped
+	DropOldestPolicy
+	// CallerRunsPolicy runs the new task on the submitting goroutine
+	CallerRunsPolicy
+)
+
+// String returns the policy name
+func (r RejectionPolicy) String() string {
+	switch r {
+	case BlockPolicy:
+		return "block"
+	case RejectPolicy:
+		return "reject"
+	case DropOldestPolicy:
+		return "drop-oldest"
+	case CallerRunsPolicy:
+		return "caller-runs"
+	default:
+		return fmt.Sprintf("RejectionPolicy(%d)", int(r))
+	}
+}
+
+// defaultPoolConfig returns the configuration used when no options are given
+func defaultPoolConfig() poolConfig {
+	return poolConfig{
+		ctx: context.Background(),
+	}
+}
+
+// WithContext binds the pool to ctx; cancelling it stops dispatching queued
+// tasks and unblocks WaitForCompletion
+func WithContext(ctx context.Context) Option {
+	return func(c *poolConfig) {
+		c.ctx = ctx
+	}
+}
+
+// WithPriorityDispatch makes the Apache pool run higher priority tasks first;
+// a queued task is promoted one level for every aging interval it waits, and
+// an aging interval of zero disables promotion
+func WithPriorityDispatch(aging time.Duration) Option {
+	return func(c *poolConfig) {
+		c.priorityDispatch = true
+		c.priorityAging = aging
+	}
+}
+
+// WithErrorHandler registers fn to be called with the error of every task
+// that fails or panics
+func WithErrorHandler(fn func(err error)) Option {
+	return func(c *poolConfig) {
+		c.errorHandler = fn
+	}
+}
+
+// WithQueueCapacity bounds the Apache pool queue to capacity tasks and applies
+// policy to tasks submitted while it is full
+func WithQueueCapacity(capacity int, policy RejectionPolicy) Option {
+	return func(c *poolConfig) {
+		c.queueCapacity = capacity
+		c.rejection = policy
+	}
+}
+
+// WithRateLimit throttles task dispatch to perSecond tasks per second,
+// allowing bursts of up to burst tasks
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(c *poolConfig) {
+		c.rateLimit = perSecond
+		c.rateBurst = burst
+	}
+}
+
+// WithRetryPolicy re-queues failed tasks according to policy
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *poolConfig) {
+		c.retry = &policy
+	}
+}
+
+// WithHooks registers lifecycle callbacks; it may be given more than once
+func WithHooks(hooks Hooks) Option {
+	return func(c *poolConfig) {
+		c.hooks = append(c.hooks, hooks)
+	}
+}
+
+// WithMiddleware wraps the execution of every task in mw, outermost first
+func WithMiddleware(mw ...Middleware) Option {
+	return func(c *poolConfig) {
+		c.middleware = append(c.middleware, mw...)
+	}
+}
+
+// WithMaxWorkers lets the Apache pool grow beyond its core size up to n
+// workers while every worker is busy; workers above the core size retire
+// after being idle for keepAlive, and never retire if keepAlive is zero
+func WithMaxWorkers(n int, keepAlive time.Duration) Option {
+	return func(c *poolConfig) {
+		c.maxWorkers = n
+		c.keepAlive = keepAlive
+	}
+}
+
+// WithName sets the pool name reported by metrics exporters and traces
+func WithName(name string) Option {
+	return func(c *poolConfig) {
+		c.name = name
+	}
+}
+
+// WithLogger makes the pool log to l as component "pool", with its name
+// under LogKeyPool: tasks finishing, failing and being retried at debug,
+// panics at error and the pool failing fast at warn
+func WithLogger(l *slog.Logger) Option {
+	return func(c *poolConfig) {
+		c.logger = l
+	}
+}
+
+// WithExecutionTracing labels every task with its pool name and ID for pprof
+// and wraps it in a runtime/trace region
+func WithExecutionTracing() Option {
+	return func(c *poolConfig) {
+		c.tracing = true
+	}
+}
+
+// WithTaskQueue makes the Apache pool hold waiting tasks in q instead of its
+// built-in FIFO or priority queue; q must not be shared between pools
+func WithTaskQueue(q TaskQueue) Option {
+	return func(c *poolConfig) {
+		c.queue = q
+	}
+}
+
+// WithFailFast makes the first task error cancel the pool, like an errgroup:
+// queued tasks fail with that error, running ones see their context cancelled
+// and Wait returns it
+func WithFailFast() Option {
+	return func(c *poolConfig) {
+		c.failFast = true
+	}
+}
+
+// WithEventListener registers l for pool lifecycle events; it may be given
+// more than once
+func WithEventListener(l EventListener) Option {
+	return func(c *poolConfig) {
+		c.events = append(c.events, l)
+	}
+}
+
+// WithTaskTracking makes the pool keep track of its unfinished tasks, which
+// its Tasks method lists, at the cost of a lock taken as each one is
+// queued, starts and finishes
+func WithTaskTracking() Option {
+	return func(c *poolConfig) {
+		c.taskTracking = true
+	}
+}
+
+// WithWeightBudget caps the summed weight of running tasks at budget; a task
+// waits for enough weight to be freed before it starts, and tasks submitted
+// without SubmitWeighted weigh 1
+func WithWeightBudget(budget int64) Option {
+	return func(c *poolConfig) {
+		c.weightBudget = budget
+	}
+}
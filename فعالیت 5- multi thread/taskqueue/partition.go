@@ -0,0 +1,70 @@
+package taskqueue
+
+import "sync"
+
+// partitions tracks which hosts of a simulated network can reach each
+// other; the zero value has every host reach every other
+type partitions struct {
+	mu sync.Mutex
+	// group numbers the group of each host named in the partition, from 1;
+	// nil while the network is whole
+	group map[string]int
+	// down holds the hosts that crashed and reach no one
+	down map[string]bool
+}
+
+// split puts each of groups in a group of its own; hosts left out share
+// group 0
+func (p *partitions) split(groups [][]string) {
+	group := make(map[string]int)
+	for i, hosts := range groups {
+		for _, h := range hosts {
+			group[h] = i + 1
+		}
+	}
+	p.mu.Lock()
+	p.group = group
+	p.mu.Unlock()
+}
+
+// heal joins every group back together
+func (p *partitions) heal() {
+	p.mu.Lock()
+	p.group = nil
+	p.mu.Unlock()
+}
+
+// setDown marks host as crashed, or as back up
+func (p *partitions) setDown(host string, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down == nil {
+		p.down = make(map[string]bool)
+	}
+	if down {
+		p.down[host] = true
+	} else {
+		delete(p.down, host)
+	}
+}
+
+// isDown reports whether host crashed
+func (p *partitions) isDown(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.down[host]
+}
+
+// connected reports whether host a can reach host b; hosts that belong to
+// no host, named "", reach everyone that is up
+func (p *partitions) connected(a, b string) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down[a] || p.down[b] {
+		return false
+	}
+	return a == "" || b == "" || a == b || p.group == nil || p.group[a] == p.group[b]
+}
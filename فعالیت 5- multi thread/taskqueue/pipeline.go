@@ -0,0 +1,119 @@
+package taskqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// Pipeline chains pools into stages connected by bounded channels; the first
+// stage error cancels every stage
+type Pipeline struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+}
+
+// StageConfig sizes a pipeline stage
+type StageConfig struct {
+	// Workers is the number of inputs the stage processes concurrently
+	Workers int
+	// Buffer bounds both the stage's queue and its output channel
+	Buffer int
+	// Options are passed to the stage's pool
+	Options []Option
+}
+
+// NewPipeline creates a pipeline that stops when ctx is cancelled
+func NewPipeline(ctx context.Context) *Pipeline {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &Pipeline{ctx: ctx, cancel: cancel}
+}
+
+// Context returns the context every stage runs under
+func (pl *Pipeline) Context() context.Context {
+	return pl.ctx
+}
+
+// Cancel stops every stage; Wait returns err
+func (pl *Pipeline) Cancel(err error) {
+	pl.cancel(err)
+}
+
+// Wait blocks until every stage has finished and returns the error that
+// stopped the pipeline, if any
+func (pl *Pipeline) Wait() error {
+	pl.wg.Wait()
+	err := context.Cause(pl.ctx)
+	pl.cancel(nil)
+	return err
+}
+
+// PipelineSource feeds values into the pipeline
+func PipelineSource[T any](pl *Pipeline, values ...T) <-chan T {
+	out := make(chan T)
+	pl.wg.Go(func() {
+		defer close(out)
+		for _, v := range values {
+			select {
+			case out <- v:
+			case <-pl.ctx.Done():
+				return
+			}
+		}
+	})
+	return out
+}
+
+// AddStage fans the values received from in out to cfg.Workers workers
+// running fn and fans their results back into the returned channel. A worker
+// holds its slot until the next stage accepts its result, so a slow stage
+// pushes back on the ones before it instead of buffering without bound
+func AddStage[T, R any](pl *Pipeline, in <-chan T, cfg StageConfig, fn func(ctx context.Context, in T) (R, error)) <-chan R {
+	out := make(chan R, max(cfg.Buffer, 0))
+	opts := append([]Option{
+		WithContext(pl.ctx),
+		WithQueueCapacity(max(cfg.Buffer, 1), BlockPolicy),
+	}, cfg.Options...)
+	pool := NewApacheThreadPool(max(cfg.Workers, 1), opts...)
+
+	pl.wg.Go(func() {
+		defer close(out)
+		defer pool.Shutdown()
+		for {
+			var v T
+			var ok bool
+			select {
+			case v, ok = <-in:
+			case <-pl.ctx.Done():
+				return
+			}
+			if !ok {
+				return
+			}
+			pool.SubmitCtx(pl.ctx, func(ctx context.Context) error {
+				r, err := fn(ctx, v)
+				if err != nil {
+					pl.cancel(err)
+					return err
+				}
+				select {
+				case out <- r:
+					return nil
+				case <-ctx.Done():
+					return context.Cause(ctx)
+				}
+			})
+		}
+	})
+	return out
+}
+
+// Collect drains in and waits for the pipeline, returning everything
+// received and the error that stopped the pipeline, if any
+func Collect[T any](pl *Pipeline, in <-chan T) ([]T, error) {
+	var values []T
+	for v := range in {
+		values = append(values, v)
+	}
+	return values, pl.Wait()
+}
@@ -0,0 +1,472 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// job is a task together with the state the pool tracks for it
+type job struct {
+	id        uint64
+	submitted time.Time
+	enqueued  time.Time // when the current attempt was admitted
+	ctx       context.Context
+	cancel    context.CancelFunc
+	fn        TaskFunc
+	future    *Future
+	priority  int
+	timeout   time.Duration
+	attempts  int
+	weight    int64
+	accepted  bool
+	worker    *Worker // running the job, nil if no worker of the pool is
+	onDone    func()  // called once the job has finished for good
+	queued    QueuedTask
+	// callerRuns is set when the submitter runs the job itself, under
+	// CallerRunsPolicy
+	callerRuns bool
+}
+
+// poolCore holds the state and behaviour shared by every pool implementation
+type poolCore struct {
+	config    poolConfig
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	lifecycle sync.Mutex
+	stopped   bool
+	wg        sync.WaitGroup
+	metrics   PoolMetrics
+	nextID    atomic.Uint64
+	limiter   *atomic.Pointer[RateLimiter] // holds nil while unlimited
+	budget    *semaphore
+	timers    *timerQueue
+	keyed     keyedQueues
+	dispatch  func(j *job) // set by the owning pool
+	batch     func(jobs []*job)
+	failOnce  sync.Once
+	firstErr  error
+	// invariants is only used in builds with the pooldebug tag
+	invariants poolInvariants
+	log        *slog.Logger
+	// tasks is only set under WithTaskTracking
+	tasks *taskTable
+}
+
+// newPoolCore applies opts on top of the default configuration; name is used
+// unless WithName overrides it
+func newPoolCore(name string, opts []Option) poolCore {
+	config := defaultPoolConfig()
+	config.name = name
+	for _, opt := range opts {
+		opt(&config)
+	}
+	ctx, cancel := context.WithCancelCause(config.ctx)
+	limiter := new(atomic.Pointer[RateLimiter])
+	if config.rateLimit > 0 {
+		limiter.Store(NewRateLimiter(config.rateLimit, config.rateBurst))
+	}
+	var budget *semaphore
+	if config.weightBudget > 0 {
+		budget = newSemaphore(config.weightBudget)
+	}
+	timers := newTimerQueue()
+	context.AfterFunc(ctx, timers.close)
+	context.AfterFunc(ctx, func() { config.events.poolStopped(config.name) })
+	log := ComponentLogger(config.logger, "pool", LogKeyPool, config.name)
+	var tasks *taskTable
+	if config.taskTracking {
+		tasks = newTaskTable()
+	}
+	return poolCore{config: config, ctx: ctx, cancel: cancel, limiter: limiter, budget: budget, timers: timers, log: log, tasks: tasks}
+}
+
+// SetRateLimit throttles the tasks starting from now on to perSecond tasks
+// per second with bursts of up to burst, as WithRateLimit does; a rate that
+// is not positive lifts the limit
+func (c *poolCore) SetRateLimit(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		c.limiter.Store(nil)
+		return
+	}
+	if limiter := c.limiter.Load(); limiter != nil {
+		limiter.SetRate(perSecond, burst)
+		return
+	}
+	c.limiter.CompareAndSwap(nil, NewRateLimiter(perSecond, burst))
+}
+
+// Submit enqueues task for execution on the pool
+func (c *poolCore) Submit(task Task) *Future {
+	return c.submitJob(c.newJob(context.Background(), task.run))
+}
+
+// Call enqueues fn and returns a future holding its result
+func (c *poolCore) Call(fn Callable) *Future {
+	return c.submitJob(c.newJob(context.Background(), func(context.Context) (any, error) { return fn() }))
+}
+
+// SubmitCtx enqueues task, dropping it if ctx is cancelled before it starts
+func (c *poolCore) SubmitCtx(ctx context.Context, task ContextTask) *Future {
+	return c.submitJob(c.newJob(ctx, task.call))
+}
+
+// SubmitWithTimeout enqueues task and fails it with ErrTaskTimeout if it runs
+// for longer than timeout; the task context is cancelled at the deadline and
+// the worker moves on without waiting for the task to return
+func (c *poolCore) SubmitWithTimeout(timeout time.Duration, task ContextTask) *Future {
+	j := c.newJob(context.Background(), task.call)
+	j.timeout = timeout
+	return c.submitJob(j)
+}
+
+// SubmitWeighted enqueues task with the given weight, e.g. its expected cost;
+// under WithWeightBudget it starts only once the budget has room for it, and a
+// weight above the budget is clamped so the task runs alone
+func (c *poolCore) SubmitWeighted(weight int64, task Task) *Future {
+	j := c.newJob(context.Background(), task.run)
+	j.weight = max(weight, 0)
+	if c.budget != nil {
+		j.weight = min(j.weight, c.config.weightBudget)
+	}
+	return c.submitJob(j)
+}
+
+// SubmitAfter enqueues task once delay has elapsed
+func (c *poolCore) SubmitAfter(delay time.Duration, task Task) *Future {
+	return c.SubmitAt(time.Now().Add(delay), task)
+}
+
+// SubmitAt enqueues task at the given time; WaitForCompletion and Shutdown
+// wait for it like for any other submitted task
+func (c *poolCore) SubmitAt(at time.Time, task Task) *Future {
+	j := c.newJob(context.Background(), task.run)
+	if !c.admit(j) {
+		c.abort(j, ErrPoolShutdown)
+		return j.future
+	}
+	c.timers.schedule(at, func() {
+		defer c.wg.Done()
+		c.dispatch(j)
+	})
+	return j.future
+}
+
+// submitJob hands j to the owning pool and returns its future
+func (c *poolCore) submitJob(j *job) *Future {
+	c.dispatch(j)
+	return j.future
+}
+
+// dispatchBatch hands jobs to the owning pool in one step when it supports
+// that, falling back to dispatching them one by one
+func (c *poolCore) dispatchBatch(jobs []*job) {
+	if c.batch != nil {
+		c.batch(jobs)
+		return
+	}
+	for _, j := range jobs {
+		c.dispatch(j)
+	}
+}
+
+// admit registers j with the wait group unless the pool is shut down; delayed
+// jobs and retries accepted earlier are always admitted so Shutdown can drain them
+func (c *poolCore) admit(j *job) bool {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if c.stopped && !j.accepted {
+		return false
+	}
+	j.accepted = true
+	j.enqueued = time.Now()
+	c.wg.Add(1)
+	c.tasks.queued(j)
+	return true
+}
+
+// stopAccepting makes every later admit call fail
+func (c *poolCore) stopAccepting() {
+	c.lifecycle.Lock()
+	c.stopped = true
+	c.lifecycle.Unlock()
+}
+
+// newJob wraps fn in a job whose context is cancelled with either ctx or the pool
+func (c *poolCore) newJob(ctx context.Context, fn TaskFunc) *job {
+	c.metrics.recordSubmit()
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(c.ctx, func() { cancel(context.Cause(c.ctx)) })
+	j := &job{
+		id:        c.nextID.Add(1),
+		submitted: time.Now(),
+		ctx:       jobCtx,
+		cancel: func() {
+			stop()
+			cancel(context.Canceled)
+		},
+		fn:     fn,
+		future: newFuture(),
+		weight: 1,
+	}
+	j.queued.job = j
+	c.config.hooks.submit(j.info())
+	return j
+}
+
+// info describes j to hooks and middleware
+func (j *job) info() TaskInfo {
+	return TaskInfo{
+		ID:        j.id,
+		Attempt:   j.attempts,
+		Priority:  j.priority,
+		Submitted: j.submitted,
+	}
+}
+
+// abort fails j without running it
+func (c *poolCore) abort(j *job, err error) {
+	c.tasks.done(j)
+	c.metrics.recordCancel()
+	j.cancel()
+	j.future.complete(nil, err)
+	if j.onDone != nil {
+		j.onDone()
+	}
+}
+
+// unexecuted converts never-started jobs back into tasks the caller can resubmit
+func unexecuted(jobs []*job) []ContextTask {
+	tasks := make([]ContextTask, 0, len(jobs))
+	for _, j := range jobs {
+		fn := j.fn
+		tasks = append(tasks, func(ctx context.Context) error {
+			_, err := fn(ctx)
+			return err
+		})
+	}
+	return tasks
+}
+
+// run executes j on the calling goroutine unless it was cancelled while queued
+func (c *poolCore) run(j *job) {
+	if err := context.Cause(j.ctx); err != nil {
+		c.abort(j, err)
+		return
+	}
+	if limiter := c.limiter.Load(); limiter != nil {
+		if err := limiter.Wait(j.ctx); err != nil {
+			c.abort(j, err)
+			return
+		}
+	}
+	if c.budget != nil {
+		if err := c.budget.acquire(j.ctx, j.weight); err != nil {
+			c.abort(j, err)
+			return
+		}
+		c.metrics.weight.Add(j.weight)
+	}
+	j.attempts++
+	c.tasks.running(j)
+	info := j.info()
+	ctx := context.WithValue(j.ctx, taskInfoKey{}, info)
+	fn := chain(c.config.middleware, j.fn)
+
+	c.config.hooks.start(info)
+	// The wait includes any for the rate limiter and weight budget
+	c.metrics.recordStart(time.Since(j.enqueued))
+	var finished func()
+	if invariantChecks {
+		finished = c.checkStarted(j)
+	}
+	start := time.Now()
+	var value any
+	var err error
+	c.traceTask(ctx, info, func(ctx context.Context) {
+		if j.timeout > 0 {
+			value, err = c.executeWithTimeout(ctx, j.timeout, fn)
+		} else {
+			value, err = c.execute(ctx, fn)
+		}
+	})
+	elapsed := time.Since(start)
+	c.metrics.recordFinish(elapsed)
+	if invariantChecks {
+		finished()
+	}
+	if c.budget != nil {
+		c.metrics.weight.Add(-j.weight)
+		c.budget.release(j.weight)
+	}
+
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		c.config.hooks.panic(info, panicErr)
+		c.log.Error("task panicked", LogKeyTask, j.id, "value", panicErr.Value, "stack", string(panicErr.Stack))
+	}
+	if err != nil && c.retry(j, err) {
+		if c.log.Enabled(ctx, slog.LevelDebug) {
+			c.log.Debug("task retried", LogKeyTask, j.id, "attempt", j.attempts, "error", err)
+		}
+		return
+	}
+	if c.log.Enabled(ctx, slog.LevelDebug) {
+		if err != nil {
+			c.log.Debug("task failed", LogKeyTask, j.id, "attempts", j.attempts, "elapsed", elapsed, "error", err)
+		} else {
+			c.log.Debug("task finished", LogKeyTask, j.id, "attempts", j.attempts, "elapsed", elapsed)
+		}
+	}
+	c.tasks.done(j)
+	c.metrics.recordOutcome(j.submitted, err)
+	j.future.complete(value, err)
+	j.cancel()
+	c.config.hooks.complete(info, err, elapsed)
+	if j.onDone != nil {
+		j.onDone()
+	}
+
+	if err != nil && c.config.errorHandler != nil {
+		c.config.errorHandler(err)
+	}
+	if err != nil && c.config.failFast {
+		c.fail(err)
+	}
+}
+
+// fail records the first task error and cancels the pool with it, failing
+// every task that has not started yet
+func (c *poolCore) fail(err error) {
+	c.failOnce.Do(func() {
+		c.firstErr = err
+		c.log.Warn("pool failed fast", "error", err)
+		c.cancel(err)
+	})
+}
+
+// retry schedules another attempt of j after the retry policy's backoff;
+// the wait group keeps the job pending until it is dispatched again
+func (c *poolCore) retry(j *job, err error) bool {
+	policy := c.config.retry
+	if policy == nil || j.ctx.Err() != nil || !policy.ShouldRetry(j.attempts, err) {
+		return false
+	}
+
+	c.metrics.retried.Add(1)
+	c.tasks.queued(j)
+	c.wg.Add(1)
+	c.timers.schedule(time.Now().Add(policy.Backoff(j.attempts)), func() {
+		defer c.wg.Done()
+		c.dispatch(j)
+	})
+	return true
+}
+
+// execute calls fn, converting a panic into a *PanicError
+func (c *poolCore) execute(ctx context.Context, fn TaskFunc) (value any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn(ctx)
+}
+
+// executeWithTimeout runs fn on its own goroutine and gives up on it once
+// timeout elapses, leaving the task to observe its cancelled context
+func (c *poolCore) executeWithTimeout(ctx context.Context, timeout time.Duration, fn TaskFunc) (any, error) {
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, ErrTaskTimeout)
+	defer cancel()
+
+	type result struct {
+		value any
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := c.execute(ctx, fn)
+		done <- result{value, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		if context.Cause(ctx) != ErrTaskTimeout {
+			// Cancelled for another reason; let the task finish on its own terms
+			r := <-done
+			return r.value, r.err
+		}
+		c.metrics.timedOut.Add(1)
+		return nil, ErrTaskTimeout
+	}
+}
+
+// WaitForCompletion waits for all tasks to complete or the pool to be cancelled
+func (c *poolCore) WaitForCompletion() {
+	finished := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-c.ctx.Done():
+	}
+}
+
+// Wait blocks until every submitted task has finished, including those still
+// running after a cancellation, and returns the first task error when the pool
+// was created with WithFailFast
+func (c *poolCore) Wait() error {
+	c.wg.Wait()
+	c.failOnce.Do(func() {})
+	return c.firstErr
+}
+
+// Name returns the pool name used in metrics and traces
+func (c *poolCore) Name() string {
+	return c.config.name
+}
+
+// Tasks returns the unfinished tasks of a pool created WithTaskTracking, in
+// no particular order, and none for any other pool
+func (c *poolCore) Tasks() []TaskSnapshot {
+	return c.tasks.list()
+}
+
+// Latencies returns the histograms of the pool's task latencies by phase
+func (c *poolCore) Latencies() LatencyHistograms {
+	return LatencyHistograms{QueueWait: &c.metrics.queueWait, Execution: &c.metrics.execTime, EndToEnd: &c.metrics.endToEnd}
+}
+
+// GetCompletedTasks returns the number of completed tasks
+func (c *poolCore) GetCompletedTasks() int64 {
+	return c.metrics.completed.Load()
+}
+
+// ActiveWorkers returns the number of workers currently running a task
+func (c *poolCore) ActiveWorkers() int {
+	return int(c.metrics.active.Load())
+}
+
+// AverageLatency returns a moving average of task execution time
+func (c *poolCore) AverageLatency() time.Duration {
+	return time.Duration(c.metrics.latency.Load())
+}
+
+// GetSucceededTasks returns the number of tasks that finished without error
+func (c *poolCore) GetSucceededTasks() int64 {
+	return c.metrics.completed.Load() - c.metrics.failed.Load()
+}
+
+// GetFailedTasks returns the number of tasks that returned an error or panicked
+func (c *poolCore) GetFailedTasks() int64 {
+	return c.metrics.failed.Load()
+}
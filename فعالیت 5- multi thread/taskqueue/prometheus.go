@@ -0,0 +1,152 @@
+package taskqueue
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prometheusBuckets are the task latency histogram bounds exported to Prometheus
+var prometheusBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// HistogramSource is implemented by pools that keep task latency histograms
+type HistogramSource interface {
+	Latencies() LatencyHistograms
+}
+
+// PrometheusExporter serves the metrics of registered pools in the Prometheus
+// text exposition format, so it can be mounted wherever promhttp.Handler would be
+type PrometheusExporter struct {
+	mu    sync.Mutex
+	pools map[string]Executor
+}
+
+// NewPrometheusExporter creates an exporter with no pools registered
+func NewPrometheusExporter() *PrometheusExporter {
+	return &PrometheusExporter{pools: make(map[string]Executor)}
+}
+
+// Register exports pool under the given name, replacing any pool with the same name
+func (e *PrometheusExporter) Register(name string, pool Executor) {
+	e.mu.Lock()
+	e.pools[name] = pool
+	e.mu.Unlock()
+}
+
+// Unregister stops exporting the pool with the given name
+func (e *PrometheusExporter) Unregister(name string) {
+	e.mu.Lock()
+	delete(e.pools, name)
+	e.mu.Unlock()
+}
+
+// ServeHTTP implements http.Handler
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WriteTo(w)
+}
+
+// WriteTo writes the current metrics of every registered pool to w
+func (e *PrometheusExporter) WriteTo(w io.Writer) (int64, error) {
+	e.mu.Lock()
+	names := make([]string, 0, len(e.pools))
+	for name := range e.pools {
+		names = append(names, name)
+	}
+	pools := make([]Executor, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		pools[i] = e.pools[name]
+	}
+	e.mu.Unlock()
+
+	var b strings.Builder
+	metrics := make([]MetricsSnapshot, len(pools))
+	stats := make([]PoolStats, len(pools))
+	for i, pool := range pools {
+		metrics[i] = pool.Metrics()
+		stats[i] = pool.Stats()
+	}
+
+	counter := func(name, help string, value func(m MetricsSnapshot) int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for i, pool := range names {
+			fmt.Fprintf(&b, "%s{pool=\"%s\"} %d\n", name, escapeLabel(pool), value(metrics[i]))
+		}
+	}
+	gauge := func(name, help string, value func(s PoolStats) int) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for i, pool := range names {
+			fmt.Fprintf(&b, "%s{pool=\"%s\"} %d\n", name, escapeLabel(pool), value(stats[i]))
+		}
+	}
+
+	counter("pool_tasks_submitted_total", "Tasks submitted to the pool.",
+		func(m MetricsSnapshot) int64 { return m.Submitted })
+	counter("pool_tasks_completed_total", "Tasks that ran to completion, successfully or not.",
+		func(m MetricsSnapshot) int64 { return m.Completed })
+	counter("pool_tasks_failed_total", "Tasks that returned an error or panicked.",
+		func(m MetricsSnapshot) int64 { return m.Failed })
+	counter("pool_tasks_cancelled_total", "Tasks that finished without running.",
+		func(m MetricsSnapshot) int64 { return m.Cancelled })
+	counter("pool_tasks_timed_out_total", "Tasks that exceeded their timeout.",
+		func(m MetricsSnapshot) int64 { return m.TimedOut })
+	counter("pool_tasks_retried_total", "Task attempts re-queued by the retry policy.",
+		func(m MetricsSnapshot) int64 { return m.Retried })
+	gauge("pool_queue_depth", "Tasks waiting for a worker.",
+		func(s PoolStats) int { return s.Queued })
+	gauge("pool_workers", "Workers in the pool.",
+		func(s PoolStats) int { return s.Workers })
+	gauge("pool_workers_busy", "Workers currently running a task.",
+		func(s PoolStats) int { return s.Running })
+
+	histogram := func(name, help string, pick func(l LatencyHistograms) *Histogram) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for i, pool := range pools {
+			source, ok := pool.(HistogramSource)
+			if !ok {
+				continue
+			}
+			h := pick(source.Latencies())
+			label := escapeLabel(names[i])
+			for j, count := range h.Buckets(prometheusBuckets) {
+				fmt.Fprintf(&b, "%s_bucket{pool=\"%s\",le=\"%g\"} %d\n", name, label, prometheusBuckets[j].Seconds(), count)
+			}
+			fmt.Fprintf(&b, "%s_bucket{pool=\"%s\",le=\"+Inf\"} %d\n", name, label, h.Count())
+			fmt.Fprintf(&b, "%s_sum{pool=\"%s\"} %g\n", name, label, h.Sum().Seconds())
+			fmt.Fprintf(&b, "%s_count{pool=\"%s\"} %d\n", name, label, h.Count())
+		}
+	}
+
+	histogram("pool_task_queue_wait_seconds", "Time task attempts waited for a worker.",
+		func(l LatencyHistograms) *Histogram { return l.QueueWait })
+	histogram("pool_task_duration_seconds", "Task execution time.",
+		func(l LatencyHistograms) *Histogram { return l.Execution })
+	histogram("pool_task_latency_seconds", "Time from submitting a task to its outcome, retries included.",
+		func(l LatencyHistograms) *Histogram { return l.EndToEnd })
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
@@ -0,0 +1,386 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// propertyConfig configures checkProperty
+type propertyConfig struct {
+	// Runs is how many random inputs are tried, 100 by default
+	Runs int
+	// Seed seeds the generator; run i of a seed always sees the same input
+	Seed uint64
+	// MaxShrinks bounds how many smaller failing inputs are tried after a
+	// failure, 100 by default
+	MaxShrinks int
+}
+
+// propertyError reports an input for which a property does not hold: the
+// smallest one shrinking found, and the run and seed that first failed, so
+// the failure can be reproduced
+type propertyError struct {
+	Run     int
+	Seed    uint64
+	Shrinks int
+	Input   any
+	Err     error
+}
+
+// Error implements the error interface
+func (e *propertyError) Error() string {
+	return fmt.Sprintf("property failed on run %d of seed %d, after %d shrinks: %v\ninput: %v", e.Run, e.Seed, e.Shrinks, e.Err, e.Input)
+}
+
+// Unwrap returns the property's error
+func (e *propertyError) Unwrap() error {
+	return e.Err
+}
+
+// checkProperty tests prop against cfg.Runs inputs made by gen, returning
+// nil if it holds for all of them. On the first failure, it repeatedly
+// replaces the input with the first of its shrink candidates that still
+// fails, and reports the last one in a *propertyError. shrink may be nil;
+// its candidates should be smaller or simpler than the input
+func checkProperty[T any](cfg propertyConfig, gen func(r *rand.Rand) T, shrink func(T) []T, prop func(T) error) error {
+	if cfg.Runs <= 0 {
+		cfg.Runs = 100
+	}
+	if cfg.MaxShrinks <= 0 {
+		cfg.MaxShrinks = 100
+	}
+	for run := range cfg.Runs {
+		input := gen(rand.New(rand.NewPCG(cfg.Seed, uint64(run))))
+		err := prop(input)
+		if err == nil {
+			continue
+		}
+		shrinks := 0
+	shrinking:
+		for shrink != nil && shrinks < cfg.MaxShrinks {
+			for _, candidate := range shrink(input) {
+				if shrinks == cfg.MaxShrinks {
+					break shrinking
+				}
+				shrinks++
+				if cerr := prop(candidate); cerr != nil {
+					input, err = candidate, cerr
+					continue shrinking
+				}
+			}
+			break
+		}
+		return &propertyError{Run: run, Seed: cfg.Seed, Shrinks: shrinks, Input: input, Err: err}
+	}
+	return nil
+}
+
+// poolWorkload is a random workload for a pool: tasks submitted by several
+// goroutines at once, some of which fail, panic or are cancelled
+type poolWorkload struct {
+	Workers    int
+	Submitters int
+	Tasks      []workloadTask
+}
+
+// workloadTask is one task of a poolWorkload
+type workloadTask struct {
+	Duration time.Duration
+	Fail     bool
+	Panic    bool
+	// Cancel submits the task with a context cancelled CancelAfter after
+	// submission, which may be before or while it runs
+	Cancel      bool
+	CancelAfter time.Duration
+}
+
+// String implements fmt.Stringer
+func (w poolWorkload) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d workers, %d submitters, %d tasks:", w.Workers, w.Submitters, len(w.Tasks))
+	for _, t := range w.Tasks {
+		b.WriteString(" ")
+		b.WriteString(t.Duration.String())
+		switch {
+		case t.Panic:
+			b.WriteString("/panic")
+		case t.Fail:
+			b.WriteString("/fail")
+		}
+		if t.Cancel {
+			fmt.Fprintf(&b, "/cancel@%v", t.CancelAfter)
+		}
+	}
+	return b.String()
+}
+
+// genPoolWorkload returns a generator of workloads of up to maxTasks tasks
+// lasting up to maxDuration each, for up to maxWorkers workers
+func genPoolWorkload(maxWorkers, maxTasks int, maxDuration time.Duration) func(r *rand.Rand) poolWorkload {
+	return func(r *rand.Rand) poolWorkload {
+		w := poolWorkload{Workers: 1 + r.IntN(maxWorkers), Submitters: 1 + r.IntN(8)}
+		w.Tasks = make([]workloadTask, r.IntN(maxTasks+1))
+		for i := range w.Tasks {
+			t := &w.Tasks[i]
+			if r.IntN(4) > 0 {
+				t.Duration = time.Duration(r.Int64N(int64(maxDuration) + 1))
+			}
+			switch p := r.IntN(20); {
+			case p == 0:
+				t.Panic = true
+			case p < 3:
+				t.Fail = true
+			}
+			if r.IntN(10) == 0 {
+				t.Cancel = true
+				t.CancelAfter = time.Duration(r.Int64N(int64(maxDuration) + 1))
+			}
+		}
+		return w
+	}
+}
+
+// shrinkPoolWorkload returns simpler variants of w: halves of its tasks,
+// each task left out, one submitter, fewer workers, and tasks that neither
+// take time nor fail
+func shrinkPoolWorkload(w poolWorkload) []poolWorkload {
+	var out []poolWorkload
+	with := func(tasks []workloadTask) poolWorkload {
+		c := w
+		c.Tasks = tasks
+		return c
+	}
+	if n := len(w.Tasks); n > 1 {
+		out = append(out, with(w.Tasks[:n/2]), with(w.Tasks[n/2:]))
+	}
+	if len(w.Tasks) <= 32 {
+		for i := range w.Tasks {
+			out = append(out, with(append(w.Tasks[:i:i], w.Tasks[i+1:]...)))
+		}
+	}
+	if w.Submitters > 1 {
+		c := w
+		c.Submitters = 1
+		out = append(out, c)
+	}
+	if w.Workers > 1 {
+		c := w
+		c.Workers--
+		out = append(out, c)
+	}
+	for i, t := range w.Tasks {
+		if t.Duration > 0 || t.Fail || t.Panic || t.Cancel {
+			tasks := append([]workloadTask(nil), w.Tasks...)
+			tasks[i] = workloadTask{}
+			out = append(out, with(tasks))
+		}
+	}
+	return out
+}
+
+// errWorkloadTask is the error of a workloadTask set to fail
+var errWorkloadTask = errors.New("workload task failed")
+
+// poolProperties returns a property of workloads run on pools made by
+// pool.New: every task's future completes within timeout of the pool
+// draining, each task runs at most once and exactly once unless it was
+// cancelled, a task reports its own failure or panic, no more tasks run at
+// once than there are workers, and the pool's metrics never count more
+// tasks completed than submitted
+func poolProperties(pool BenchPool, timeout time.Duration) func(w poolWorkload) error {
+	return func(w poolWorkload) error {
+		p := pool.New(w.Workers)
+		defer p.Shutdown()
+
+		var running, peak atomic.Int64
+		runs := make([]atomic.Int32, len(w.Tasks))
+		futures := make([]*Future, len(w.Tasks))
+		task := func(i int) ContextTask {
+			t := w.Tasks[i]
+			return func(ctx context.Context) error {
+				runs[i].Add(1)
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					old := peak.Load()
+					if n <= old || peak.CompareAndSwap(old, n) {
+						break
+					}
+				}
+				if t.Duration > 0 {
+					timer := time.NewTimer(t.Duration)
+					defer timer.Stop()
+					select {
+					case <-timer.C:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+				switch {
+				case t.Panic:
+					panic(fmt.Sprintf("workload task %d", i))
+				case t.Fail:
+					return errWorkloadTask
+				}
+				return nil
+			}
+		}
+
+		// Submitters take turns over the tasks, all starting at once
+		var wg sync.WaitGroup
+		var cancels []context.CancelFunc
+		var mu sync.Mutex
+		start := make(chan struct{})
+		var overshoot atomic.Int64
+		for s := range w.Submitters {
+			wg.Go(func() {
+				<-start
+				for i := s; i < len(w.Tasks); i += w.Submitters {
+					ctx := context.Background()
+					if w.Tasks[i].Cancel {
+						var cancel context.CancelFunc
+						ctx, cancel = context.WithCancel(ctx)
+						mu.Lock()
+						cancels = append(cancels, cancel)
+						mu.Unlock()
+						time.AfterFunc(w.Tasks[i].CancelAfter, cancel)
+					}
+					futures[i] = p.SubmitCtx(ctx, task(i))
+					if m := p.Metrics(); m.Completed > m.Submitted {
+						overshoot.Store(m.Completed - m.Submitted)
+					}
+				}
+			})
+		}
+		close(start)
+		wg.Wait()
+		defer func() {
+			for _, cancel := range cancels {
+				cancel()
+			}
+		}()
+
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		for i, f := range futures {
+			select {
+			case <-f.Done():
+			case <-deadline.C:
+				return fmt.Errorf("task %d was lost: its future never completed", i)
+			}
+			t, err := w.Tasks[i], f.Err()
+			var panicErr *PanicError
+			switch n := runs[i].Load(); {
+			case n > 1:
+				return fmt.Errorf("task %d ran %d times", i, n)
+			case n == 0 && !t.Cancel:
+				return fmt.Errorf("task %d never ran but completed with %v", i, err)
+			case n == 0 && !errors.Is(err, context.Canceled):
+				return fmt.Errorf("cancelled task %d never ran but completed with %v", i, err)
+			case n == 1 && t.Panic && !errors.As(err, &panicErr) && !errors.Is(err, context.Canceled):
+				return fmt.Errorf("panicking task %d completed with %v", i, err)
+			case n == 1 && t.Fail && !t.Panic && !errors.Is(err, errWorkloadTask) && !errors.Is(err, context.Canceled):
+				return fmt.Errorf("failing task %d completed with %v", i, err)
+			case n == 1 && !t.Fail && !t.Panic && err != nil && !errors.Is(err, context.Canceled):
+				return fmt.Errorf("task %d completed with %v", i, err)
+			}
+		}
+
+		if n := peak.Load(); n > int64(w.Workers) {
+			return fmt.Errorf("%d tasks ran at once on %d workers", n, w.Workers)
+		}
+		if n := overshoot.Load(); n > 0 {
+			return fmt.Errorf("metrics counted %d more tasks completed than submitted", n)
+		}
+		p.WaitForCompletion()
+		m := p.Metrics()
+		if m.Submitted != int64(len(w.Tasks)) {
+			return fmt.Errorf("metrics counted %d tasks submitted, want %d", m.Submitted, len(w.Tasks))
+		}
+		if m.Completed > m.Submitted || m.Completed+m.Cancelled != m.Submitted {
+			return fmt.Errorf("metrics counted %d submitted, %d completed and %d cancelled", m.Submitted, m.Completed, m.Cancelled)
+		}
+		return nil
+	}
+}
+
+// Flags reproduce a failure reported with its seed, or check more
+// workloads than the default
+var (
+	propertyRuns  = flag.Int("props.runs", 100, "random workloads per pool for TestPoolProperties")
+	propertySeed  = flag.Uint64("props.seed", 1, "random seed of the workloads of TestPoolProperties")
+	propertyTasks = flag.Int("props.tasks", 200, "most tasks per workload of TestPoolProperties")
+)
+
+func TestPoolProperties(t *testing.T) {
+	cfg := propertyConfig{Runs: *propertyRuns, Seed: *propertySeed}
+	if testing.Short() {
+		cfg.Runs = min(cfg.Runs, 10)
+	}
+	gen := genPoolWorkload(16, *propertyTasks, 2*time.Millisecond)
+	for _, pool := range DefaultBenchPools() {
+		t.Run(pool.Name, func(t *testing.T) {
+			t.Parallel()
+			if err := checkProperty(cfg, gen, shrinkPoolWorkload, poolProperties(pool, 10*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckPropertyShrinks(t *testing.T) {
+	// Slices of digits summing to 10 or more fail; shrinking by dropping
+	// elements must end at a failing slice none of whose elements can go
+	gen := func(r *rand.Rand) []int {
+		s := make([]int, 5+r.IntN(10))
+		for i := range s {
+			s[i] = r.IntN(10)
+		}
+		return s
+	}
+	shrink := func(s []int) [][]int {
+		var out [][]int
+		for i := range s {
+			out = append(out, append(s[:i:i], s[i+1:]...))
+		}
+		return out
+	}
+	sum := func(s []int) int {
+		n := 0
+		for _, v := range s {
+			n += v
+		}
+		return n
+	}
+	prop := func(s []int) error {
+		if n := sum(s); n >= 10 {
+			return fmt.Errorf("sum %d", n)
+		}
+		return nil
+	}
+	err := checkProperty(propertyConfig{Seed: 1}, gen, shrink, prop)
+	var perr *propertyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("checkProperty returned %v, want a *propertyError", err)
+	}
+	input := perr.Input.([]int)
+	if sum(input) < 10 {
+		t.Fatalf("shrunk input %v passes the property", input)
+	}
+	for _, smaller := range shrink(input) {
+		if sum(smaller) >= 10 {
+			t.Fatalf("shrunk input %v still has a failing candidate %v", input, smaller)
+		}
+	}
+	if err := checkProperty(propertyConfig{Seed: 1}, gen, shrink, func([]int) error { return nil }); err != nil {
+		t.Fatalf("checkProperty failed a property that always holds: %v", err)
+	}
+}
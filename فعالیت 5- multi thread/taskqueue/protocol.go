@@ -0,0 +1,231 @@
+package taskqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"multithread/internal/wire"
+)
+
+// MessageType identifies what a Message asks of its receiver
+type MessageType uint8
+
+const (
+	// MsgRegister announces a worker and its capacity to the coordinator
+	MsgRegister MessageType = iota + 1
+	// MsgDispatch hands a task to a worker
+	MsgDispatch
+	// MsgResult returns a task's output or error to the coordinator
+	MsgResult
+	// MsgCancel asks a worker to cancel a dispatched task
+	MsgCancel
+	// MsgNack hands a dispatched task back to the coordinator for redelivery
+	MsgNack
+	// MsgHeartbeat tells the coordinator a worker is alive; between
+	// electing nodes it asks for, and answers with, the receiver's leader
+	MsgHeartbeat
+	// MsgElection asks a higher node to take over an election
+	MsgElection
+	// MsgAnswer tells an electing node that a higher node took over
+	MsgAnswer
+	// MsgVictory announces the sender as the elected leader
+	MsgVictory
+	// MsgRequestVote carries a Raft RequestVote call or its reply
+	MsgRequestVote
+	// MsgAppendEntries carries a Raft AppendEntries call or its reply
+	MsgAppendEntries
+	// MsgPrepare carries a Paxos prepare or the acceptor's promise, or a
+	// two-phase commit prepare or the participant's vote
+	MsgPrepare
+	// MsgAccept carries a Paxos accept request or the acceptor's reply
+	MsgAccept
+	// MsgLearn tells a Paxos learner that an acceptor accepted a value
+	MsgLearn
+	// MsgPing is a SWIM probe; it is answered with MsgAck
+	MsgPing
+	// MsgPingReq asks a SWIM member to probe another on the sender's behalf
+	MsgPingReq
+	// MsgAck answers a SWIM probe or ping request, a pub/sub publish,
+	// subscribe or delivery, or a quorum read or write
+	MsgAck
+	// MsgCommit tells a two-phase commit participant to commit
+	MsgCommit
+	// MsgAbort tells a two-phase commit participant to abort
+	MsgAbort
+	// MsgOutcome asks a two-phase commit coordinator for its decision
+	MsgOutcome
+	// MsgPublish publishes to a pub/sub topic, or delivers a publication to
+	// a subscriber
+	MsgPublish
+	// MsgSubscribe subscribes a connection to a pub/sub topic
+	MsgSubscribe
+	// MsgRead asks a quorum replica for its version of a key
+	MsgRead
+	// MsgWrite asks a quorum replica to store a version of a key
+	MsgWrite
+	// MsgDigest asks a replica for the hashes of Merkle tree nodes, or
+	// answers with them
+	MsgDigest
+	// MsgRepair swaps the entries of the Merkle tree leaves two replicas
+	// disagree on
+	MsgRepair
+	// MsgMarker is the Chandy-Lamport marker of the snapshot in ID
+	MsgMarker
+	// MsgInvalidate gossips that the cache key in Key changed on the node
+	// in Worker
+	MsgInvalidate
+	// MsgCall calls the RPC method in Task; MsgCancel with its ID cancels it
+	MsgCall
+	// MsgReply answers the MsgCall with the same ID
+	MsgReply
+	// MsgDrain tells the coordinator a worker takes no more tasks, as it is
+	// about to leave; the tasks it holds still return their results
+	MsgDrain
+	// MsgCapacity tells the coordinator a worker now runs up to Capacity
+	// tasks at once
+	MsgCapacity
+)
+
+// String returns the message type name
+func (t MessageType) String() string {
+	switch t {
+	case MsgRegister:
+		return "register"
+	case MsgDispatch:
+		return "dispatch"
+	case MsgResult:
+		return "result"
+	case MsgCancel:
+		return "cancel"
+	case MsgNack:
+		return "nack"
+	case MsgHeartbeat:
+		return "heartbeat"
+	case MsgElection:
+		return "election"
+	case MsgAnswer:
+		return "answer"
+	case MsgVictory:
+		return "victory"
+	case MsgRequestVote:
+		return "request vote"
+	case MsgAppendEntries:
+		return "append entries"
+	case MsgPrepare:
+		return "prepare"
+	case MsgAccept:
+		return "accept"
+	case MsgLearn:
+		return "learn"
+	case MsgPing:
+		return "ping"
+	case MsgPingReq:
+		return "ping request"
+	case MsgAck:
+		return "ack"
+	case MsgCommit:
+		return "commit"
+	case MsgAbort:
+		return "abort"
+	case MsgOutcome:
+		return "outcome"
+	case MsgPublish:
+		return "publish"
+	case MsgSubscribe:
+		return "subscribe"
+	case MsgRead:
+		return "read"
+	case MsgWrite:
+		return "write"
+	case MsgDigest:
+		return "digest"
+	case MsgRepair:
+		return "repair"
+	case MsgMarker:
+		return "marker"
+	case MsgInvalidate:
+		return "invalidate"
+	case MsgCall:
+		return "call"
+	case MsgReply:
+		return "reply"
+	case MsgDrain:
+		return "drain"
+	case MsgCapacity:
+		return "capacity"
+	default:
+		return fmt.Sprintf("MessageType(%d)", uint8(t))
+	}
+}
+
+// Message is the unit exchanged between coordinator and workers; fields a
+// message type does not use are left empty. Redeliveries counts how often a
+// dispatched task was handed out before, and results, nacks and cancels echo
+// it to name the delivery they refer to. Clock is the sender's Lamport time,
+// for senders that keep a clocks.Lamport, Trace the W3C traceparent of the
+// span a dispatch belongs to, for coordinators that trace their tasks,
+// Token the signed token a worker registers with, Correlation the
+// correlation ID of a dispatched task, which results and nacks echo, and
+// Route the routing key of a task submitted with SubmitKeyed
+type Message struct {
+	Type         MessageType
+	ID           uint64
+	Worker       string
+	Task         string
+	Capacity     int
+	Payload      []byte
+	Error        string
+	Redeliveries int
+	Key          string
+	Clock        uint64
+	Trace        string
+	Token        string
+	Correlation  string
+	Route        string
+}
+
+// MarshalBinary encodes m as its type, then ID, capacity and redelivery count
+// as uvarints, then the strings and payload, each prefixed with its uvarint
+// length, then the clock as a uvarint and last the trace, token,
+// correlation ID and routing key like the strings
+func (m *Message) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 1+10*binary.MaxVarintLen64+len(m.Worker)+len(m.Task)+len(m.Payload)+len(m.Error)+len(m.Key)+len(m.Trace)+len(m.Token)+len(m.Correlation)+len(m.Route))
+	b = append(b, byte(m.Type))
+	b = binary.AppendUvarint(b, m.ID)
+	b = binary.AppendUvarint(b, uint64(max(m.Capacity, 0)))
+	b = binary.AppendUvarint(b, uint64(max(m.Redeliveries, 0)))
+	b = wire.AppendBytes(b, []byte(m.Worker))
+	b = wire.AppendBytes(b, []byte(m.Task))
+	b = wire.AppendBytes(b, m.Payload)
+	b = wire.AppendBytes(b, []byte(m.Error))
+	b = wire.AppendBytes(b, []byte(m.Key))
+	b = binary.AppendUvarint(b, m.Clock)
+	b = wire.AppendBytes(b, []byte(m.Trace))
+	b = wire.AppendBytes(b, []byte(m.Token))
+	b = wire.AppendBytes(b, []byte(m.Correlation))
+	b = wire.AppendBytes(b, []byte(m.Route))
+	return b, nil
+}
+
+// UnmarshalBinary decodes a message encoded by MarshalBinary
+func (m *Message) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		return wire.ErrMalformed
+	}
+	r := wire.Reader{B: b[1:]}
+	m.Type = MessageType(b[0])
+	m.ID = r.Uvarint()
+	m.Capacity = int(r.Uvarint())
+	m.Redeliveries = int(r.Uvarint())
+	m.Worker = string(r.Bytes())
+	m.Task = string(r.Bytes())
+	m.Payload = r.Bytes()
+	m.Error = string(r.Bytes())
+	m.Key = string(r.Bytes())
+	m.Clock = r.Uvarint()
+	m.Trace = string(r.Bytes())
+	m.Token = string(r.Bytes())
+	m.Correlation = string(r.Bytes())
+	m.Route = string(r.Bytes())
+	return r.Err
+}
@@ -0,0 +1,256 @@
+package taskqueue
+
+import "fmt"
+
+// The typed messages of proto/taskqueue.proto carry the worker protocol in a
+// schema other languages can generate code from, instead of the generic
+// Envelope whose meaning depends on its type. Message stays the single
+// in-memory form: MarshalFrame and UnmarshalFrame convert between the two,
+// picking a typed message whenever it holds every field that is set
+
+// TaskEnvelope is a task handed to a worker
+type TaskEnvelope struct {
+	ID           uint64
+	Task         string
+	Payload      []byte
+	Key          string
+	Redeliveries int
+	Trace        string
+	Correlation  string
+	Route        string
+}
+
+// MarshalProto encodes t as the TaskEnvelope message
+func (t *TaskEnvelope) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, t.ID)
+	b = appendProtoBytes(b, 2, []byte(t.Task))
+	b = appendProtoBytes(b, 3, t.Payload)
+	b = appendProtoBytes(b, 4, []byte(t.Key))
+	b = appendProtoVarint(b, 5, uint64(max(t.Redeliveries, 0)))
+	b = appendProtoBytes(b, 6, []byte(t.Trace))
+	b = appendProtoBytes(b, 7, []byte(t.Correlation))
+	b = appendProtoBytes(b, 8, []byte(t.Route))
+	return b
+}
+
+// UnmarshalProto decodes a TaskEnvelope message into t
+func (t *TaskEnvelope) UnmarshalProto(b []byte) error {
+	*t = TaskEnvelope{}
+	return parseProto(b, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			t.ID = f.Varint
+		case 2:
+			t.Task = string(f.Bytes)
+		case 3:
+			t.Payload = f.Bytes
+		case 4:
+			t.Key = string(f.Bytes)
+		case 5:
+			t.Redeliveries = int(f.Varint)
+		case 6:
+			t.Trace = string(f.Bytes)
+		case 7:
+			t.Correlation = string(f.Bytes)
+		case 8:
+			t.Route = string(f.Bytes)
+		}
+		return nil
+	})
+}
+
+// TaskResult is a worker's answer to a TaskEnvelope; it is the Result
+// message of the schema, renamed here beside the generic Result of the typed
+// pool
+type TaskResult struct {
+	ID      uint64
+	Payload []byte
+	Error   string
+	// Nack hands the task back to be run elsewhere instead of answering it
+	Nack         bool
+	Redeliveries int
+	Correlation  string
+}
+
+// MarshalProto encodes r as the Result message
+func (r *TaskResult) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, r.ID)
+	b = appendProtoBytes(b, 2, r.Payload)
+	b = appendProtoBytes(b, 3, []byte(r.Error))
+	if r.Nack {
+		b = appendProtoVarint(b, 4, 1)
+	}
+	b = appendProtoVarint(b, 5, uint64(max(r.Redeliveries, 0)))
+	b = appendProtoBytes(b, 6, []byte(r.Correlation))
+	return b
+}
+
+// UnmarshalProto decodes a Result message into r
+func (r *TaskResult) UnmarshalProto(b []byte) error {
+	*r = TaskResult{}
+	return parseProto(b, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			r.ID = f.Varint
+		case 2:
+			r.Payload = f.Bytes
+		case 3:
+			r.Error = string(f.Bytes)
+		case 4:
+			r.Nack = f.Varint != 0
+		case 5:
+			r.Redeliveries = int(f.Varint)
+		case 6:
+			r.Correlation = string(f.Bytes)
+		}
+		return nil
+	})
+}
+
+// Heartbeat tells the coordinator a worker is alive
+type Heartbeat struct {
+	Worker string
+}
+
+// MarshalProto encodes h as the Heartbeat message
+func (h *Heartbeat) MarshalProto() []byte {
+	return appendProtoBytes(nil, 1, []byte(h.Worker))
+}
+
+// UnmarshalProto decodes a Heartbeat message into h
+func (h *Heartbeat) UnmarshalProto(b []byte) error {
+	*h = Heartbeat{}
+	return parseProto(b, func(f protoField) error {
+		if f.Num == 1 {
+			h.Worker = string(f.Bytes)
+		}
+		return nil
+	})
+}
+
+// Registration opens a worker session; it is the Register message of the
+// schema
+type Registration struct {
+	Worker   string
+	Capacity int
+	Token    string
+}
+
+// MarshalProto encodes r as the Register message
+func (r *Registration) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoBytes(b, 1, []byte(r.Worker))
+	b = appendProtoVarint(b, 2, uint64(max(r.Capacity, 0)))
+	b = appendProtoBytes(b, 3, []byte(r.Token))
+	return b
+}
+
+// UnmarshalProto decodes a Register message into r
+func (r *Registration) UnmarshalProto(b []byte) error {
+	*r = Registration{}
+	return parseProto(b, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			r.Worker = string(f.Bytes)
+		case 2:
+			r.Capacity = int(f.Varint)
+		case 3:
+			r.Token = string(f.Bytes)
+		}
+		return nil
+	})
+}
+
+// Field numbers of the Frame message's oneof
+const (
+	frameEnvelope  = 1
+	frameTask      = 2
+	frameResult    = 3
+	frameHeartbeat = 4
+	frameRegister  = 5
+)
+
+// MarshalFrame encodes m as the Frame message: as the typed message of its
+// type when that holds every field m sets, and as an Envelope otherwise
+func (m *Message) MarshalFrame() []byte {
+	switch {
+	case m.Type == MsgDispatch && m.Worker == "" && m.Capacity == 0 && m.Error == "" && m.Clock == 0 && m.Token == "":
+		t := TaskEnvelope{ID: m.ID, Task: m.Task, Payload: m.Payload, Key: m.Key, Redeliveries: m.Redeliveries, Trace: m.Trace, Correlation: m.Correlation, Route: m.Route}
+		return appendProtoMessage(nil, frameTask, t.MarshalProto())
+	case (m.Type == MsgResult || m.Type == MsgNack) && m.Worker == "" && m.Task == "" && m.Capacity == 0 && m.Key == "" && m.Clock == 0 && m.Trace == "" && m.Token == "" && m.Route == "":
+		r := TaskResult{ID: m.ID, Payload: m.Payload, Error: m.Error, Nack: m.Type == MsgNack, Redeliveries: m.Redeliveries, Correlation: m.Correlation}
+		return appendProtoMessage(nil, frameResult, r.MarshalProto())
+	case m.Type == MsgHeartbeat && m.Capacity == 0 && m.Token == "" && onlyWorkerFields(m):
+		h := Heartbeat{Worker: m.Worker}
+		return appendProtoMessage(nil, frameHeartbeat, h.MarshalProto())
+	case m.Type == MsgRegister && onlyWorkerFields(m):
+		r := Registration{Worker: m.Worker, Capacity: m.Capacity, Token: m.Token}
+		return appendProtoMessage(nil, frameRegister, r.MarshalProto())
+	default:
+		return appendProtoMessage(nil, frameEnvelope, m.MarshalProto())
+	}
+}
+
+// onlyWorkerFields reports whether m sets no field besides its type, worker,
+// capacity and token, the ones the Heartbeat and Register messages carry
+func onlyWorkerFields(m *Message) bool {
+	return m.ID == 0 && m.Task == "" && len(m.Payload) == 0 && m.Error == "" && m.Redeliveries == 0 && m.Key == "" && m.Clock == 0 && m.Trace == "" && m.Correlation == "" && m.Route == ""
+}
+
+// UnmarshalFrame decodes a Frame message into m
+func (m *Message) UnmarshalFrame(b []byte) error {
+	*m = Message{}
+	var kind int
+	err := parseProto(b, func(f protoField) error {
+		if f.Type != protoBytes {
+			return nil
+		}
+		// A oneof keeps the last member on the wire, as other decoders do
+		switch f.Num {
+		case frameEnvelope:
+			if err := m.UnmarshalProto(f.Bytes); err != nil {
+				return err
+			}
+		case frameTask:
+			var t TaskEnvelope
+			if err := t.UnmarshalProto(f.Bytes); err != nil {
+				return err
+			}
+			*m = Message{Type: MsgDispatch, ID: t.ID, Task: t.Task, Payload: t.Payload, Key: t.Key, Redeliveries: t.Redeliveries, Trace: t.Trace, Correlation: t.Correlation, Route: t.Route}
+		case frameResult:
+			var r TaskResult
+			if err := r.UnmarshalProto(f.Bytes); err != nil {
+				return err
+			}
+			*m = Message{Type: MsgResult, ID: r.ID, Payload: r.Payload, Error: r.Error, Redeliveries: r.Redeliveries, Correlation: r.Correlation}
+			if r.Nack {
+				m.Type = MsgNack
+			}
+		case frameHeartbeat:
+			var h Heartbeat
+			if err := h.UnmarshalProto(f.Bytes); err != nil {
+				return err
+			}
+			*m = Message{Type: MsgHeartbeat, Worker: h.Worker}
+		case frameRegister:
+			var r Registration
+			if err := r.UnmarshalProto(f.Bytes); err != nil {
+				return err
+			}
+			*m = Message{Type: MsgRegister, Worker: r.Worker, Capacity: r.Capacity, Token: r.Token}
+		default:
+			return nil
+		}
+		kind = f.Num
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if kind == 0 {
+		return fmt.Errorf("%w: frame holds no message", errMalformedProto)
+	}
+	return nil
+}
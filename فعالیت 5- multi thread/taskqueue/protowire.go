@@ -0,0 +1,146 @@
+package taskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Protocol buffer wire types used by the hand-written encoders
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+// errMalformedProto is reported for protobuf input that does not decode
+var errMalformedProto = errors.New("malformed protobuf message")
+
+// appendProtoVarint appends field num as a varint, omitting zero values as
+// proto3 does
+func appendProtoVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendProtoBytes appends field num as a length-delimited value, omitting
+// empty values
+func appendProtoBytes(b []byte, num int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendProtoMessage appends field num holding the encoded message v; unlike
+// appendProtoBytes it keeps an empty message, whose presence is what selects
+// a oneof member
+func appendProtoMessage(b []byte, num int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// protoField is one decoded field; Bytes is set for length-delimited fields
+// and Varint for varint ones
+type protoField struct {
+	Num    int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+// parseProto calls fn for every field of b in order; unknown wire types
+// other than varint and length-delimited are rejected
+func parseProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformedProto
+		}
+		b = b[n:]
+		f := protoField{Num: int(key >> 3), Type: int(key & 7)}
+		switch f.Type {
+		case protoVarint:
+			f.Varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errMalformedProto
+			}
+			b = b[n:]
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errMalformedProto
+			}
+			f.Bytes = b[n : n+int(size) : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			return errMalformedProto
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalProto encodes m as the Envelope message of proto/taskqueue.proto
+func (m *Message) MarshalProto() []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(m.Type))
+	b = appendProtoVarint(b, 2, m.ID)
+	b = appendProtoBytes(b, 3, []byte(m.Worker))
+	b = appendProtoBytes(b, 4, []byte(m.Task))
+	b = appendProtoVarint(b, 5, uint64(max(m.Capacity, 0)))
+	b = appendProtoBytes(b, 6, m.Payload)
+	b = appendProtoBytes(b, 7, []byte(m.Error))
+	b = appendProtoVarint(b, 8, uint64(max(m.Redeliveries, 0)))
+	b = appendProtoBytes(b, 9, []byte(m.Key))
+	b = appendProtoVarint(b, 10, m.Clock)
+	b = appendProtoBytes(b, 11, []byte(m.Trace))
+	b = appendProtoBytes(b, 12, []byte(m.Token))
+	b = appendProtoBytes(b, 13, []byte(m.Correlation))
+	b = appendProtoBytes(b, 14, []byte(m.Route))
+	return b
+}
+
+// UnmarshalProto decodes an Envelope message into m
+func (m *Message) UnmarshalProto(b []byte) error {
+	*m = Message{}
+	return parseProto(b, func(f protoField) error {
+		switch f.Num {
+		case 1:
+			m.Type = MessageType(f.Varint)
+		case 2:
+			m.ID = f.Varint
+		case 3:
+			m.Worker = string(f.Bytes)
+		case 4:
+			m.Task = string(f.Bytes)
+		case 5:
+			m.Capacity = int(f.Varint)
+		case 6:
+			m.Payload = f.Bytes
+		case 7:
+			m.Error = string(f.Bytes)
+		case 8:
+			m.Redeliveries = int(f.Varint)
+		case 9:
+			m.Key = string(f.Bytes)
+		case 10:
+			m.Clock = f.Varint
+		case 11:
+			m.Trace = string(f.Bytes)
+		case 12:
+			m.Token = string(f.Bytes)
+		case 13:
+			m.Correlation = string(f.Bytes)
+		case 14:
+			m.Route = string(f.Bytes)
+		}
+		return nil
+	})
+}
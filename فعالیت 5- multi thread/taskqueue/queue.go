@@ -0,0 +1,209 @@
+package taskqueue
+
+import (
+	"container/heap"
+	"time"
+)
+
+// QueuedTask is a task waiting in a TaskQueue
+type QueuedTask struct {
+	job *job
+}
+
+// Info describes the queued task
+func (t *QueuedTask) Info() TaskInfo {
+	return t.job.info()
+}
+
+// TaskQueue holds tasks waiting for a worker of the Apache pool. The pool
+// serializes every call, so implementations need no locking of their own.
+// A queue with a Cap() int method bounds the pool's queue capacity, and one
+// with a DropOldest() *QueuedTask method decides what DropOldestPolicy evicts;
+// otherwise Pop is used
+type TaskQueue interface {
+	// Push adds t to the queue, returning false if the queue is full
+	Push(t *QueuedTask) bool
+	// Pop removes and returns the next task, or nil if the queue is empty
+	Pop() *QueuedTask
+	// Len returns the number of queued tasks
+	Len() int
+}
+
+// jobQueue adapts a TaskQueue to the pool's jobs
+type jobQueue struct {
+	q TaskQueue
+}
+
+func (q jobQueue) push(j *job) bool {
+	if !invariantChecks {
+		return q.q.Push(&j.queued)
+	}
+	before := q.q.Len()
+	ok := q.q.Push(&j.queued)
+	if n := q.q.Len(); ok && n != before+1 || !ok && n != before {
+		violated("a push adds one task to the queue", "%T held %d tasks, and %d after pushing task %d (accepted %v)", q.q, before, n, j.id, ok)
+	}
+	return ok
+}
+
+func (q jobQueue) pop() *job {
+	if !invariantChecks {
+		if t := q.q.Pop(); t != nil {
+			return t.job
+		}
+		return nil
+	}
+	before := q.q.Len()
+	t := q.q.Pop()
+	if n := q.q.Len(); t == nil && before != 0 || t != nil && n != before-1 {
+		violated("a pop takes one task off a non-empty queue", "%T held %d tasks, and %d after a pop returning %v", q.q, before, n, t)
+	}
+	if t == nil {
+		return nil
+	}
+	return t.job
+}
+
+func (q jobQueue) len() int {
+	return q.q.Len()
+}
+
+// dropOldest removes the job that has been queued the longest
+func (q jobQueue) dropOldest() *job {
+	if d, ok := q.q.(interface{ DropOldest() *QueuedTask }); ok {
+		if t := d.DropOldest(); t != nil {
+			return t.job
+		}
+		return nil
+	}
+	return q.pop()
+}
+
+// capacity returns the queue's own bound, or zero if it is unbounded
+func (q jobQueue) capacity() int {
+	if b, ok := q.q.(interface{ Cap() int }); ok {
+		return b.Cap()
+	}
+	return 0
+}
+
+// fifoQueue dispatches tasks in submission order
+type fifoQueue struct {
+	tasks []*QueuedTask
+	head  int
+}
+
+func (q *fifoQueue) Push(t *QueuedTask) bool {
+	q.tasks = append(q.tasks, t)
+	return true
+}
+
+func (q *fifoQueue) Pop() *QueuedTask {
+	if q.head == len(q.tasks) {
+		return nil
+	}
+	t := q.tasks[q.head]
+	q.tasks[q.head] = nil
+	q.head++
+
+	// Reclaim the consumed prefix once it dominates the backing array
+	if q.head > 64 && q.head*2 >= len(q.tasks) {
+		q.tasks = append(q.tasks[:0], q.tasks[q.head:]...)
+		q.head = 0
+	}
+	return t
+}
+
+func (q *fifoQueue) Len() int {
+	return len(q.tasks) - q.head
+}
+
+// priorityQueue dispatches higher priority jobs first; with a non-zero aging
+// interval every queued job gains one priority level per interval waited, so
+// low priority work cannot starve
+type priorityQueue struct {
+	aging time.Duration
+	base  time.Time
+	seq   uint64
+	items priorityHeap
+}
+
+// NewHeapQueue creates a priority queue that ages tasks every interval; it is
+// what WithPriorityDispatch installs
+func NewHeapQueue(aging time.Duration) TaskQueue {
+	return newPriorityQueue(aging)
+}
+
+// newPriorityQueue creates a priority queue that ages tasks every interval
+func newPriorityQueue(aging time.Duration) *priorityQueue {
+	return &priorityQueue{aging: aging, base: time.Now()}
+}
+
+func (q *priorityQueue) Push(t *QueuedTask) bool {
+	// Comparing priority + age/aging between two tasks does not depend on the
+	// current time, so the rank can be fixed at enqueue time
+	rank := float64(t.job.priority)
+	if q.aging > 0 {
+		rank -= float64(time.Since(q.base)) / float64(q.aging)
+	}
+	q.seq++
+	heap.Push(&q.items, &priorityItem{task: t, rank: rank, seq: q.seq})
+	return true
+}
+
+func (q *priorityQueue) Pop() *QueuedTask {
+	if len(q.items) == 0 {
+		return nil
+	}
+	return heap.Pop(&q.items).(*priorityItem).task
+}
+
+func (q *priorityQueue) Len() int {
+	return len(q.items)
+}
+
+// DropOldest removes the task that has been queued the longest
+func (q *priorityQueue) DropOldest() *QueuedTask {
+	if len(q.items) == 0 {
+		return nil
+	}
+	oldest := 0
+	for i, item := range q.items {
+		if item.seq < q.items[oldest].seq {
+			oldest = i
+		}
+	}
+	return heap.Remove(&q.items, oldest).(*priorityItem).task
+}
+
+// priorityItem is a queued task with its precomputed rank
+type priorityItem struct {
+	task *QueuedTask
+	rank float64
+	seq  uint64
+}
+
+// priorityHeap implements heap.Interface ordered by rank, then submission order
+type priorityHeap []*priorityItem
+
+func (h priorityHeap) Len() int { return len(h) }
+
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank > h[j].rank
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityHeap) Push(x any) { *h = append(*h, x.(*priorityItem)) }
+
+func (h *priorityHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,373 @@
+package taskqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multithread/internal/wire"
+)
+
+// ChannelQueue is a bounded FIFO backed by a buffered channel
+type ChannelQueue struct {
+	ch chan *QueuedTask
+}
+
+// NewChannelQueue creates a channel queue holding up to capacity tasks
+func NewChannelQueue(capacity int) *ChannelQueue {
+	return &ChannelQueue{ch: make(chan *QueuedTask, max(capacity, 1))}
+}
+
+// Push implements TaskQueue
+func (q *ChannelQueue) Push(t *QueuedTask) bool {
+	select {
+	case q.ch <- t:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pop implements TaskQueue
+func (q *ChannelQueue) Pop() *QueuedTask {
+	select {
+	case t := <-q.ch:
+		return t
+	default:
+		return nil
+	}
+}
+
+// Len implements TaskQueue
+func (q *ChannelQueue) Len() int { return len(q.ch) }
+
+// Cap returns the capacity of the channel
+func (q *ChannelQueue) Cap() int { return cap(q.ch) }
+
+// RingQueue is a bounded lock-free multi-producer multi-consumer FIFO; every
+// slot carries a sequence number telling producers and consumers whose turn
+// it is, so it stays safe to use from several goroutines without the pool lock
+type RingQueue struct {
+	mask uint64
+	_    [56]byte // keep head and tail on separate cache lines
+	head atomic.Uint64
+	_    [56]byte
+	tail atomic.Uint64
+	_    [56]byte
+	ring []ringSlot
+}
+
+// ringSlot is one cell of a RingQueue
+type ringSlot struct {
+	seq  atomic.Uint64
+	task *QueuedTask
+}
+
+// NewRingQueue creates a ring queue holding at least capacity tasks; the
+// capacity is rounded up to a power of two
+func NewRingQueue(capacity int) *RingQueue {
+	size := uint64(1)
+	for size < uint64(max(capacity, 2)) {
+		size <<= 1
+	}
+	q := &RingQueue{mask: size - 1, ring: make([]ringSlot, size)}
+	for i := range q.ring {
+		q.ring[i].seq.Store(uint64(i))
+	}
+	return q
+}
+
+// Push implements TaskQueue
+func (q *RingQueue) Push(t *QueuedTask) bool {
+	for {
+		pos := q.tail.Load()
+		slot := &q.ring[pos&q.mask]
+		seq := slot.seq.Load()
+		switch {
+		case seq == pos:
+			if q.tail.CompareAndSwap(pos, pos+1) {
+				slot.task = t
+				slot.seq.Store(pos + 1)
+				return true
+			}
+		case seq < pos:
+			// The slot still holds a task from the previous lap
+			return false
+		default:
+			runtime.Gosched()
+		}
+	}
+}
+
+// Pop implements TaskQueue
+func (q *RingQueue) Pop() *QueuedTask {
+	for {
+		pos := q.head.Load()
+		slot := &q.ring[pos&q.mask]
+		seq := slot.seq.Load()
+		switch {
+		case seq == pos+1:
+			if q.head.CompareAndSwap(pos, pos+1) {
+				t := slot.task
+				slot.task = nil
+				slot.seq.Store(pos + q.mask + 1)
+				return t
+			}
+		case seq < pos+1:
+			return nil
+		default:
+			runtime.Gosched()
+		}
+	}
+}
+
+// Len implements TaskQueue; under concurrent use it is only an estimate
+func (q *RingQueue) Len() int {
+	head, tail := q.head.Load(), q.tail.Load()
+	if tail < head {
+		return 0
+	}
+	return int(tail - head)
+}
+
+// Cap returns the number of slots in the ring
+func (q *RingQueue) Cap() int { return len(q.ring) }
+
+// DiskQueue is a FIFO that journals every push and pop to a file. Tasks are
+// closures and cannot be written to disk, so the journal records what was
+// queued rather than the work itself: after a crash, Recovered lists the
+// tasks that had been queued but never dispatched so the caller can resubmit them
+type DiskQueue struct {
+	mu        sync.Mutex
+	mem       fifoQueue
+	file      *os.File
+	w         *bufio.Writer
+	err       error
+	recovered []diskQueueRecord
+	// nextPush and nextPop number the journal records of the tasks pushed
+	// and popped, which leave the FIFO in the order they entered it
+	nextPush, nextPop uint64
+}
+
+// Operations of a DiskQueue journal record
+const (
+	diskQueuePush = 1
+	diskQueuePop  = 2
+	// diskQueueDiscard retires a recovered task, as a pop does a queued one
+	diskQueueDiscard = 3
+)
+
+// diskQueueRecord is a journal record. Records are numbered by the queue
+// rather than by task ID, since the IDs of a recovered task and of one
+// pushed since may be the same
+type diskQueueRecord struct {
+	op   uint64
+	seq  uint64
+	info TaskInfo // of a push
+}
+
+// marshal encodes r as a record body
+func (r *diskQueueRecord) marshal() []byte {
+	b := binary.AppendUvarint(nil, r.op)
+	b = binary.AppendUvarint(b, r.seq)
+	if r.op == diskQueuePush {
+		b = binary.AppendUvarint(b, r.info.ID)
+		b = binary.AppendUvarint(b, uint64(int64(r.info.Priority)))
+		b = binary.AppendUvarint(b, uint64(r.info.Submitted.UnixNano()))
+	}
+	return b
+}
+
+// unmarshal decodes a record body encoded by marshal
+func (r *diskQueueRecord) unmarshal(b []byte) error {
+	d := wire.Reader{B: b}
+	r.op, r.seq = d.Uvarint(), d.Uvarint()
+	if r.op == diskQueuePush {
+		r.info.ID = d.Uvarint()
+		r.info.Priority = int(int64(d.Uvarint()))
+		r.info.Submitted = time.Unix(0, int64(d.Uvarint()))
+	}
+	return d.Err
+}
+
+// OpenDiskQueue opens or creates the journal at path and collects the tasks
+// an earlier process left queued. The journal is rewritten down to those
+// tasks, which it keeps until DiscardRecovered retires them
+func OpenDiskQueue(path string) (*DiskQueue, error) {
+	recovered, err := readQueueJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rewrite the survivors to a new file and swap it in atomically
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	q := &DiskQueue{file: file, w: bufio.NewWriter(file), recovered: recovered}
+	for _, r := range recovered {
+		q.nextPush = max(q.nextPush, r.seq+1)
+		q.err = wire.WriteRecord(q.w, r.marshal())
+		if q.err != nil {
+			break
+		}
+	}
+	q.nextPop = q.nextPush
+	if q.err == nil {
+		q.err = q.sync()
+	}
+	if q.err != nil {
+		file.Close()
+		return nil, q.err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// readQueueJournal returns the pushes in the journal at path that were
+// neither popped nor discarded, in submission order; a torn record at the
+// end is discarded
+func readQueueJournal(path string) ([]diskQueueRecord, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pending := make(map[uint64]diskQueueRecord)
+	br := bufio.NewReader(f)
+	for {
+		body, err := wire.ReadRecord(br)
+		if err != nil {
+			// io.EOF ends a clean journal; anything else is a torn tail
+			break
+		}
+		var r diskQueueRecord
+		if r.unmarshal(body) != nil {
+			break
+		}
+		switch r.op {
+		case diskQueuePush:
+			pending[r.seq] = r
+		case diskQueuePop, diskQueueDiscard:
+			delete(pending, r.seq)
+		}
+	}
+
+	recovered := make([]diskQueueRecord, 0, len(pending))
+	for _, r := range pending {
+		recovered = append(recovered, r)
+	}
+	sort.Slice(recovered, func(i, j int) bool { return recovered[i].seq < recovered[j].seq })
+	return recovered, nil
+}
+
+// Push implements TaskQueue
+func (q *DiskQueue) Push(t *QueuedTask) bool {
+	info := t.Info()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.journal(&diskQueueRecord{op: diskQueuePush, seq: q.nextPush, info: info})
+	q.nextPush++
+	return q.mem.Push(t)
+}
+
+// Pop implements TaskQueue
+func (q *DiskQueue) Pop() *QueuedTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.mem.Pop()
+	if t != nil {
+		q.journal(&diskQueueRecord{op: diskQueuePop, seq: q.nextPop})
+		q.nextPop++
+	}
+	return t
+}
+
+// Len implements TaskQueue
+func (q *DiskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.mem.Len()
+}
+
+// journal appends r; the first write error is kept and later records are
+// skipped, since a journal with gaps would recover the wrong tasks. The
+// caller holds q.mu
+func (q *DiskQueue) journal(r *diskQueueRecord) {
+	if q.err != nil {
+		return
+	}
+	if q.err = wire.WriteRecord(q.w, r.marshal()); q.err == nil {
+		q.err = q.w.Flush()
+	}
+}
+
+// sync flushes buffered records and syncs the file
+func (q *DiskQueue) sync() error {
+	if err := q.w.Flush(); err != nil {
+		return err
+	}
+	return q.file.Sync()
+}
+
+// Recovered returns the tasks an earlier process left queued, as found when
+// the journal was opened; their IDs refer to that process
+func (q *DiskQueue) Recovered() []TaskInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	infos := make([]TaskInfo, len(q.recovered))
+	for i, r := range q.recovered {
+		infos[i] = r.info
+	}
+	return infos
+}
+
+// DiscardRecovered durably retires the recovered tasks, once the caller has
+// resubmitted them; until then every reopen of the journal recovers them
+// again
+func (q *DiskQueue) DiscardRecovered() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, r := range q.recovered {
+		q.journal(&diskQueueRecord{op: diskQueueDiscard, seq: r.seq})
+	}
+	if q.err == nil {
+		q.err = q.file.Sync()
+	}
+	if q.err == nil {
+		q.recovered = nil
+	}
+	return q.err
+}
+
+// Err returns the first error writing the journal
+func (q *DiskQueue) Err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// Close syncs and closes the journal
+func (q *DiskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.sync(); err != nil {
+		q.file.Close()
+		return err
+	}
+	return q.file.Close()
+}
@@ -0,0 +1,85 @@
+package taskqueue
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// reopenDiskQueue closes q, if any, and opens the journal at path again,
+// checking how many tasks it recovers
+func reopenDiskQueue(t *testing.T, q *DiskQueue, path string, recovered int) *DiskQueue {
+	t.Helper()
+	if q != nil {
+		if err := q.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := OpenDiskQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := q.Recovered(); len(got) != recovered {
+		t.Fatalf("recovered %v, want %d tasks", got, recovered)
+	}
+	return q
+}
+
+func TestDiskQueueRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.journal")
+	q := reopenDiskQueue(t, nil, path, 0)
+
+	// One task runs and two stay queued when the process "crashes"
+	pool := NewApacheThreadPool(1, WithTaskQueue(q))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	pool.Submit(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	pool.Submit(func() {})
+	pool.Submit(func() {})
+	t.Cleanup(func() {
+		close(release)
+		pool.Shutdown()
+	})
+
+	// A write torn by the crash ends the journal
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1})
+	f.Close()
+
+	q = reopenDiskQueue(t, nil, path, 2)
+	got := q.Recovered()
+	if got[0].ID >= got[1].ID {
+		t.Errorf("recovered %v out of submission order", got)
+	}
+
+	// Survivors outlive a reopen, and the tasks of a new process, numbered
+	// from 1 again, do not retire them
+	q = reopenDiskQueue(t, q, path, 2)
+	next := NewApacheThreadPool(1, WithTaskQueue(q))
+	for range 3 {
+		next.Submit(func() {})
+	}
+	next.Shutdown()
+	q = reopenDiskQueue(t, q, path, 2)
+
+	if err := q.DiscardRecovered(); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.Recovered(); len(got) != 0 {
+		t.Errorf("recovered %v after DiscardRecovered", got)
+	}
+	q = reopenDiskQueue(t, q, path, 0)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("rewrite left %s.tmp behind: %v", path, err)
+	}
+}
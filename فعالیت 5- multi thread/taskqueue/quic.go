@@ -0,0 +1,1278 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// QUICTransport carries messages over QUIC on UDP. A lost packet only holds
+// up the stream it belongs to, and every connection keeps registrations and
+// liveness messages (heartbeats and SWIM probes) on a stream of their own,
+// so on lossy or distant links they are not stuck behind large task
+// payloads the way they are on TCP. Messages on one stream keep their order;
+// those of the two streams are interleaved as they arrive.
+//
+// The QUIC implementation covers what two nodes of this program need: it
+// does no connection migration, 0-RTT or key updates, and no flow control,
+// its peers advertising limits that let everything through while the
+// coordinator's capacity accounting bounds what is in flight
+type QUICTransport struct {
+	// TLS secures the connections as TCPTransport.TLS does. QUIC always
+	// encrypts, so without it listeners present a throwaway self-signed
+	// certificate that dialers accept unchecked: the traffic is private but
+	// neither end is authenticated
+	TLS *tls.Config
+	// IdleTimeout closes connections that received nothing for this long;
+	// connections with nothing else to send ping their peer after a third
+	// of it. Defaults to 30s
+	IdleTimeout time.Duration
+}
+
+// quicALPN is the application protocol the connections negotiate
+const quicALPN = "taskqueue"
+
+const (
+	// quicMaxDatagram is the size of the datagrams sent, the least every
+	// path has to carry
+	quicMaxDatagram = 1200
+	// quicCIDLen is the length of the connection IDs chosen
+	quicCIDLen = 8
+	// quicMaxAckDelay is how long an acknowledgement may wait to travel
+	// with other frames
+	quicMaxAckDelay = 25 * time.Millisecond
+	// quicInitialRTT is the round trip assumed until one is measured
+	quicInitialRTT = 333 * time.Millisecond
+	// quicSendBuffer is how much unsent data a stream holds before Send
+	// blocks
+	quicSendBuffer = 1 << 20
+	// quicInbox is how many datagrams a connection queues before it drops
+	// further ones as if they were lost
+	quicInbox = 256
+)
+
+// Packet number spaces, one per encryption level
+const (
+	quicInitial = iota
+	quicHandshake
+	quicApplication
+	quicSpaces
+)
+
+// quicLevels are the TLS encryption levels of the packet number spaces
+var quicLevels = [quicSpaces]tls.QUICEncryptionLevel{
+	tls.QUICEncryptionLevelInitial,
+	tls.QUICEncryptionLevelHandshake,
+	tls.QUICEncryptionLevelApplication,
+}
+
+// Streams of a connection. Each end sends on unidirectional streams of its
+// own, stream i having the ID 4*i+2 from the dialer and 4*i+3 from the
+// listener
+const (
+	quicDataStream = iota
+	quicControlStream
+	quicStreams
+)
+
+// quicStreamOf returns the stream m travels on. Registrations share the
+// control stream with the heartbeats so that none overtakes them
+func quicStreamOf(m *Message) int {
+	switch m.Type {
+	case MsgRegister, MsgHeartbeat, MsgPing, MsgPingReq:
+		return quicControlStream
+	default:
+		return quicDataStream
+	}
+}
+
+// idleTimeout returns the configured idle timeout or its default
+func (t *QUICTransport) idleTimeout() time.Duration {
+	if t.IdleTimeout > 0 {
+		return t.IdleTimeout
+	}
+	return 30 * time.Second
+}
+
+// Dial implements Transport
+func (t *QUICTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if t.TLS != nil {
+		cfg = t.TLS.Clone()
+		if cfg.ServerName == "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				cfg.ServerName = host
+			}
+		}
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	e := &quicEndpoint{udp: udp, idle: t.idleTimeout(), conns: make(map[string]*quicConn)}
+	c, err := e.dial(ctx, tlsWithNextProtos(cfg, quicALPN), raddr)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	go e.read()
+
+	select {
+	case <-c.established:
+		return c, nil
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, fmt.Errorf("quic: dial %s: %w", addr, c.err)
+	case <-ctx.Done():
+		c.Close()
+		return nil, context.Cause(ctx)
+	}
+}
+
+// Listen implements Transport
+func (t *QUICTransport) Listen(addr string) (Listener, error) {
+	cfg := t.TLS
+	if cfg == nil {
+		var err error
+		if cfg, err = quicSelfSigned(); err != nil {
+			return nil, err
+		}
+	}
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	e := &quicEndpoint{
+		udp:    udp,
+		idle:   t.idleTimeout(),
+		tls:    tlsWithNextProtos(cfg, quicALPN),
+		conns:  make(map[string]*quicConn),
+		accept: make(chan *quicConn),
+		done:   make(chan struct{}),
+	}
+	go e.read()
+	return &quicListener{e}, nil
+}
+
+// quicSelfSigned returns a server configuration with a certificate made up
+// on the spot
+func quicSelfSigned() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: quicALPN},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, nil
+}
+
+// quicEndpoint is a UDP socket and the connections it carries: the one
+// connection Dial opened, or those a listener accepted
+type quicEndpoint struct {
+	udp  *net.UDPConn
+	idle time.Duration
+	// tls configures the connections a listener accepts
+	tls *tls.Config
+
+	mu sync.Mutex
+	// conns are keyed by the connection IDs their packets are sent to
+	conns map[string]*quicConn
+	// accept hands established connections to the listener, and is nil on
+	// a dialing endpoint; done is closed with the listener
+	accept chan *quicConn
+	done   chan struct{}
+	closed bool
+}
+
+// read passes the datagrams the socket receives to their connections,
+// opening one for every new client, until the socket is closed
+func (e *quicEndpoint) read() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := e.udp.ReadFromUDP(buf)
+		if err != nil {
+			e.mu.Lock()
+			conns := make([]*quicConn, 0, len(e.conns))
+			for _, c := range e.conns {
+				conns = append(conns, c)
+			}
+			e.mu.Unlock()
+			for _, c := range conns {
+				c.abort(err)
+			}
+			return
+		}
+		d := buf[:n]
+		cid, ok := quicDestination(d)
+		if !ok {
+			continue
+		}
+		e.mu.Lock()
+		c := e.conns[string(cid)]
+		// Only a client's full-size Initial opens a connection
+		if c == nil && e.accept != nil && !e.closed && n >= quicMaxDatagram && d[0]&0xb0 == 0x80 && binary.BigEndian.Uint32(d[1:]) == quicVersion1 {
+			c = e.open(cid, from)
+		}
+		e.mu.Unlock()
+		if c == nil {
+			continue
+		}
+		select {
+		case c.in <- bytes.Clone(d):
+		default:
+		}
+	}
+}
+
+// quicDestination returns the destination connection ID of the first packet
+// in d
+func quicDestination(d []byte) ([]byte, bool) {
+	if len(d) == 0 {
+		return nil, false
+	}
+	if d[0]&0x80 == 0 {
+		if len(d) < 1+quicCIDLen {
+			return nil, false
+		}
+		return d[1 : 1+quicCIDLen], true
+	}
+	if len(d) < 6 || len(d) < 6+int(d[5]) {
+		return nil, false
+	}
+	return d[6 : 6+int(d[5])], true
+}
+
+// dial opens a connection to remote; the caller waits for its handshake
+func (e *quicEndpoint) dial(ctx context.Context, cfg *tls.Config, remote *net.UDPAddr) (*quicConn, error) {
+	c := newQUICConn(e, remote, true)
+	c.remoteCID = quicNewCID()
+	c.originalCID = c.remoteCID
+	client, server, err := quicInitialKeys(c.remoteCID)
+	if err != nil {
+		return nil, err
+	}
+	c.spaces[quicInitial].write, c.spaces[quicInitial].read = client, server
+	c.tls = tls.QUICClient(&tls.QUICConfig{TLSConfig: cfg})
+	c.tls.SetTransportParameters(c.transportParameters())
+
+	e.mu.Lock()
+	e.conns[string(c.localCID)] = c
+	e.mu.Unlock()
+	c.mu.Lock()
+	if err := c.tls.Start(ctx); err != nil {
+		c.fail(err)
+	} else if err := c.tlsEvents(); err != nil {
+		c.fail(err)
+	}
+	c.mu.Unlock()
+	go c.run()
+	return c, nil
+}
+
+// open starts the connection of a client whose first Initial was sent to
+// the connection ID odcid; e.mu must be held
+func (e *quicEndpoint) open(odcid []byte, remote *net.UDPAddr) *quicConn {
+	c := newQUICConn(e, remote, false)
+	c.originalCID = bytes.Clone(odcid)
+	client, server, err := quicInitialKeys(c.originalCID)
+	if err != nil {
+		return nil
+	}
+	c.spaces[quicInitial].read, c.spaces[quicInitial].write = client, server
+	c.tls = tls.QUICServer(&tls.QUICConfig{TLSConfig: e.tls})
+	if err := c.tls.Start(context.Background()); err != nil {
+		return nil
+	}
+	e.conns[string(c.localCID)] = c
+	e.conns[string(c.originalCID)] = c
+	go c.run()
+	return c
+}
+
+// deliver hands the established c to the listener, closing it if the
+// listener is closed first
+func (e *quicEndpoint) deliver(c *quicConn) {
+	select {
+	case e.accept <- c:
+	case <-e.done:
+		c.Close()
+	case <-c.done:
+	}
+}
+
+// remove forgets the finished c, closing the socket once it has no more
+// connections to carry
+func (e *quicEndpoint) remove(c *quicConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, conn := range e.conns {
+		if conn == c {
+			delete(e.conns, id)
+		}
+	}
+	if e.accept == nil || e.closed && len(e.conns) == 0 {
+		e.udp.Close()
+	}
+}
+
+// quicListener accepts the connections of a listening endpoint. Closing it
+// stops accepting, but the socket stays open for the connections already
+// accepted, as with TCP
+type quicListener struct {
+	e *quicEndpoint
+}
+
+func (l *quicListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.e.accept:
+		return c, nil
+	case <-l.e.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	e := l.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	close(e.done)
+	if len(e.conns) == 0 {
+		e.udp.Close()
+	}
+	return nil
+}
+
+func (l *quicListener) Addr() string { return l.e.udp.LocalAddr().String() }
+
+// quicSpace is the state of one packet number space
+type quicSpace struct {
+	read, write *quicKeys
+
+	nextPN      uint64
+	largestRecv uint64
+	recvd       quicRanges
+	// ackPending is set when received packets wait to be acknowledged,
+	// ackElicited counts those asking for it, which in the application
+	// space are acknowledged together until ackDeadline
+	ackPending  bool
+	ackElicited int
+	ackDeadline time.Time
+
+	// sent holds the packets in flight that need acknowledging
+	sent         map[uint64]*quicSentPacket
+	largestAcked uint64
+	acked        bool
+	// lossTime is when the earliest packet in flight counts as lost if it
+	// is still unacknowledged
+	lossTime time.Time
+
+	crypto       quicReassembly
+	cryptoOffset uint64
+	// queue holds the frames waiting to be sent, anew or again
+	queue []quicFrame
+}
+
+// quicSentPacket is a packet in flight
+type quicSentPacket struct {
+	time   time.Time
+	size   int
+	frames []quicFrame
+}
+
+// quicSendStream is the sending half of one of a connection's streams
+type quicSendStream struct {
+	id     uint64
+	offset uint64
+	// buf holds the framed messages not sent yet
+	buf []byte
+}
+
+// quicConn is a QUIC connection. A goroutine per connection receives and
+// sends its packets and keeps its timers; Send and Recv meet it in its
+// buffers
+type quicConn struct {
+	e      *quicEndpoint
+	remote *net.UDPAddr
+	client bool
+	idle   time.Duration
+	in     chan []byte
+	wake   chan struct{}
+	// established is closed once the handshake completed, done once the
+	// connection is gone
+	established, done chan struct{}
+
+	mu   sync.Mutex
+	cond sync.Cond
+	tls  *tls.QUICConn
+	// localCID is the ID the peer sends to and remoteCID the one sent to;
+	// originalCID is the one the client first sent to
+	localCID, remoteCID, originalCID []byte
+	learnedCID                       bool
+	spaces                           [quicSpaces]quicSpace
+	send                             [quicStreams]quicSendStream
+	recv                             [quicStreams]quicReassembly
+	inbox                            []*Message
+	handshaken                       bool
+	// err is what Send and Recv fail with from the moment the connection
+	// closes; closing is set by Close, after which the connection lingers
+	// until what was sent is acknowledged, and finished once it is gone
+	err      error
+	closing  bool
+	linger   time.Time
+	finished bool
+
+	// Loss recovery and congestion control, after RFC 9002 with a single
+	// probe timeout for all spaces
+	srtt, rttvar   time.Duration
+	measured       bool
+	ptoCount       int
+	probes         int
+	cwnd, ssthresh int
+	inFlight       int
+	recovery       time.Time
+	lastRecv       time.Time
+	lastEliciting  time.Time
+}
+
+// newQUICConn creates the state of a connection with remote
+func newQUICConn(e *quicEndpoint, remote *net.UDPAddr, client bool) *quicConn {
+	now := time.Now()
+	c := &quicConn{
+		e:             e,
+		remote:        remote,
+		client:        client,
+		idle:          e.idle,
+		in:            make(chan []byte, quicInbox),
+		wake:          make(chan struct{}, 1),
+		established:   make(chan struct{}),
+		done:          make(chan struct{}),
+		localCID:      quicNewCID(),
+		srtt:          quicInitialRTT,
+		rttvar:        quicInitialRTT / 2,
+		cwnd:          10 * quicMaxDatagram,
+		ssthresh:      math.MaxInt,
+		lastRecv:      now,
+		lastEliciting: now,
+	}
+	c.cond.L = &c.mu
+	for i := range c.spaces {
+		c.spaces[i].sent = make(map[uint64]*quicSentPacket)
+	}
+	for i := range c.send {
+		c.send[i].id = uint64(4*i + 2)
+		if !client {
+			c.send[i].id++
+		}
+	}
+	return c
+}
+
+// quicNewCID returns a random connection ID
+func quicNewCID() []byte {
+	cid := make([]byte, quicCIDLen)
+	rand.Read(cid)
+	return cid
+}
+
+// transportParameters returns the connection's QUIC transport parameters
+func (c *quicConn) transportParameters() []byte {
+	var b []byte
+	if !c.client {
+		b = quicAppendParam(b, quicParamOriginalCID, c.originalCID)
+	}
+	unlimited := quicAppendVarint(nil, 1<<62-1)
+	b = quicAppendParam(b, quicParamIdleTimeout, quicAppendVarint(nil, uint64(c.idle.Milliseconds())))
+	b = quicAppendParam(b, quicParamMaxData, unlimited)
+	b = quicAppendParam(b, quicParamMaxStreamUni, unlimited)
+	b = quicAppendParam(b, quicParamMaxStreamsUni, quicAppendVarint(nil, quicStreams))
+	return quicAppendParam(b, quicParamSourceCID, c.localCID)
+}
+
+func (c *quicConn) Send(m *Message) error {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(b) > maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &c.send[quicStreamOf(m)]
+	for c.err == nil && len(s.buf) > quicSendBuffer {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return c.err
+	}
+	s.buf = binary.BigEndian.AppendUint32(s.buf, uint32(len(b)))
+	s.buf = append(s.buf, b...)
+	c.notify()
+	return nil
+}
+
+// Recv returns the messages received before the peer closed the connection
+// or it timed out, and then the error it ended with
+func (c *quicConn) Recv() (*Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.inbox) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(c.inbox) == 0 || c.closing {
+		return nil, c.err
+	}
+	m := c.inbox[0]
+	c.inbox[0] = nil
+	c.inbox = c.inbox[1:]
+	return m, nil
+}
+
+// Close closes the connection at once for Send and Recv; what was already
+// sent is still delivered for up to the idle timeout
+func (c *quicConn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+		c.closing = true
+		c.linger = time.Now().Add(c.idle)
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+	c.notify()
+	return nil
+}
+
+func (c *quicConn) RemoteAddr() string { return c.remote.String() }
+
+// Peer returns the identity the other end proved during the handshake
+func (c *quicConn) Peer() (PeerIdentity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := c.tls.ConnectionState()
+	return peerIdentity(&state)
+}
+
+// notify wakes the connection's goroutine to send what is waiting
+func (c *quicConn) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// abort ends the connection with err without telling the peer
+func (c *quicConn) abort(err error) {
+	c.mu.Lock()
+	c.terminate(err)
+	c.mu.Unlock()
+	c.notify()
+}
+
+// terminate ends the connection with err; c.mu must be held
+func (c *quicConn) terminate(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.finished = true
+	c.cond.Broadcast()
+}
+
+// run is the connection's goroutine
+func (c *quicConn) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		now := time.Now()
+		c.onTimers(now)
+		c.flush(now)
+		finished, next := c.finished, c.nextTimer()
+		c.mu.Unlock()
+		if finished {
+			break
+		}
+		timer.Reset(time.Until(next))
+		select {
+		case d := <-c.in:
+			c.mu.Lock()
+			c.receive(d, time.Now())
+			// Take whatever else arrived before answering
+			for more := true; more; {
+				select {
+				case d := <-c.in:
+					c.receive(d, time.Now())
+				default:
+					more = false
+				}
+			}
+			c.mu.Unlock()
+		case <-c.wake:
+		case <-timer.C:
+		}
+	}
+	c.e.remove(c)
+	close(c.done)
+}
+
+// nextTimer returns when the connection next has something to do unless a
+// datagram arrives first; c.mu must be held
+func (c *quicConn) nextTimer() time.Time {
+	next := c.lastRecv.Add(c.idle)
+	earlier := func(t time.Time) {
+		if !t.IsZero() && t.Before(next) {
+			next = t
+		}
+	}
+	if c.closing {
+		earlier(c.linger)
+	} else if c.handshaken {
+		earlier(c.lastEliciting.Add(c.idle / 3))
+	}
+	for sp := range c.spaces {
+		s := &c.spaces[sp]
+		earlier(s.lossTime)
+		if s.ackPending && sp == quicApplication {
+			earlier(s.ackDeadline)
+		}
+	}
+	if pto, ok := c.ptoDeadline(); ok {
+		earlier(pto)
+	}
+	return next
+}
+
+// onTimers acts on the timers that expired by now; c.mu must be held
+func (c *quicConn) onTimers(now time.Time) {
+	if c.finished {
+		return
+	}
+	if !now.Before(c.lastRecv.Add(c.idle)) {
+		c.terminate(ErrIdleTimeout)
+		return
+	}
+	for sp := range c.spaces {
+		if t := c.spaces[sp].lossTime; !t.IsZero() && !now.Before(t) {
+			c.detectLoss(sp, now)
+		}
+	}
+	if pto, ok := c.ptoDeadline(); ok && !now.Before(pto) {
+		c.onProbeTimeout()
+	}
+	if c.handshaken && !c.closing && !now.Before(c.lastEliciting.Add(c.idle/3)) {
+		app := &c.spaces[quicApplication]
+		app.queue = append(app.queue, quicFrame{kind: quicFramePing})
+		c.lastEliciting = now
+	}
+}
+
+// ptoDeadline returns when the packets in flight are probed for, if there
+// are any; c.mu must be held
+func (c *quicConn) ptoDeadline() (time.Time, bool) {
+	var last time.Time
+	for sp := range c.spaces {
+		for _, p := range c.spaces[sp].sent {
+			if p.time.After(last) {
+				last = p.time
+			}
+		}
+	}
+	if last.IsZero() {
+		return time.Time{}, false
+	}
+	pto := c.srtt + max(4*c.rttvar, time.Millisecond) + quicMaxAckDelay
+	return last.Add(pto << min(c.ptoCount, 6)), true
+}
+
+// onProbeTimeout sends everything in flight again, having heard back about
+// none of it; c.mu must be held
+func (c *quicConn) onProbeTimeout() {
+	c.ptoCount++
+	for sp := range c.spaces {
+		s := &c.spaces[sp]
+		for pn, p := range s.sent {
+			delete(s.sent, pn)
+			c.inFlight -= p.size
+			s.queue = append(s.queue, p.frames...)
+		}
+	}
+	c.probes = 2
+}
+
+// detectLoss sends again the frames of the packets in sp that count as lost:
+// those acknowledged packets three numbers later were sent after, and those
+// older than a round trip and an eighth. c.mu must be held
+func (c *quicConn) detectLoss(sp int, now time.Time) {
+	s := &c.spaces[sp]
+	s.lossTime = time.Time{}
+	if !s.acked {
+		return
+	}
+	delay := max(c.srtt*9/8, time.Millisecond)
+	var lost time.Time
+	for pn, p := range s.sent {
+		if pn > s.largestAcked {
+			continue
+		}
+		if s.largestAcked >= pn+3 || !now.Before(p.time.Add(delay)) {
+			delete(s.sent, pn)
+			c.inFlight -= p.size
+			s.queue = append(s.queue, p.frames...)
+			if p.time.After(lost) {
+				lost = p.time
+			}
+			continue
+		}
+		if t := p.time.Add(delay); s.lossTime.IsZero() || t.Before(s.lossTime) {
+			s.lossTime = t
+		}
+	}
+	// One loss per round trip halves the window, packets sent before the
+	// last halving do not halve it again
+	if lost.After(c.recovery) {
+		c.recovery = now
+		c.ssthresh = max(c.cwnd/2, 2*quicMaxDatagram)
+		c.cwnd = c.ssthresh
+	}
+}
+
+// handleAck processes the acknowledgement of ranges in sp; c.mu must be held
+func (c *quicConn) handleAck(sp int, ranges quicRanges, now time.Time) error {
+	s := &c.spaces[sp]
+	largest := ranges[0].hi
+	if largest >= s.nextPN {
+		return fmt.Errorf("quic: acknowledgement of unsent packet %d", largest)
+	}
+	if !s.acked || largest > s.largestAcked {
+		s.largestAcked, s.acked = largest, true
+	}
+	for pn, p := range s.sent {
+		if !ranges.contains(pn) {
+			continue
+		}
+		delete(s.sent, pn)
+		c.inFlight -= p.size
+		c.ptoCount = 0
+		if pn == largest {
+			c.sampleRTT(now.Sub(p.time))
+		}
+		if p.time.After(c.recovery) {
+			if c.cwnd < c.ssthresh {
+				c.cwnd += p.size
+			} else {
+				c.cwnd += quicMaxDatagram * p.size / c.cwnd
+			}
+		}
+	}
+	c.detectLoss(sp, now)
+	return nil
+}
+
+// sampleRTT folds a measured round trip into the estimate; c.mu must be held
+func (c *quicConn) sampleRTT(rtt time.Duration) {
+	if !c.measured {
+		c.srtt, c.rttvar, c.measured = rtt, rtt/2, true
+		return
+	}
+	diff := c.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	c.rttvar = (3*c.rttvar + diff) / 4
+	c.srtt = (7*c.srtt + rtt) / 8
+}
+
+// receive processes the packets of a datagram; c.mu must be held
+func (c *quicConn) receive(d []byte, now time.Time) {
+	for len(d) > 0 && !c.finished {
+		d = d[c.receivePacket(d, now):]
+	}
+}
+
+// receivePacket processes the packet at the start of d and returns its
+// length. Packets that do not decrypt are dropped as if they were lost.
+// c.mu must be held
+func (c *quicConn) receivePacket(d []byte, now time.Time) int {
+	sp := quicApplication
+	pnOffset, end := 1+quicCIDLen, len(d)
+	var scid []byte
+	if d[0]&0x80 != 0 {
+		r := quicReader{b: d[1:]}
+		version := r.uint32()
+		r.bytes(uint64(r.byte()))
+		scid = r.bytes(uint64(r.byte()))
+		switch d[0] >> 4 & 3 {
+		case 0:
+			sp = quicInitial
+			r.bytes(r.varint())
+		case 2:
+			sp = quicHandshake
+		default:
+			// 0-RTT and Retry packets are never sent to this implementation
+			sp = -1
+		}
+		length := r.varint()
+		if r.err != nil || version != quicVersion1 || length > uint64(len(r.b)) {
+			return len(d)
+		}
+		pnOffset = len(d) - len(r.b)
+		end = pnOffset + int(length)
+		if sp < 0 {
+			return end
+		}
+	}
+	s := &c.spaces[sp]
+	if s.read == nil {
+		return end
+	}
+	pn, payload, err := s.read.open(d[:end], pnOffset, s.largestRecv)
+	if err != nil {
+		return end
+	}
+	c.lastRecv = now
+	if scid != nil && !c.learnedCID {
+		c.remoteCID, c.learnedCID = bytes.Clone(scid), true
+	}
+	if !s.recvd.add(pn) {
+		s.ackPending = true
+		return end
+	}
+	s.largestRecv = max(s.largestRecv, pn)
+	if !c.client && sp == quicHandshake {
+		// The client has its handshake keys, so no longer needs Initials
+		c.discard(quicInitial)
+	}
+	eliciting, err := c.handleFrames(sp, payload, now)
+	if err != nil {
+		c.fail(err)
+		return len(d)
+	}
+	if eliciting {
+		if !s.ackPending {
+			s.ackDeadline = now.Add(quicMaxAckDelay)
+		}
+		s.ackPending = true
+		s.ackElicited++
+	}
+	return end
+}
+
+// handleFrames processes the frames of a packet in sp and reports whether
+// any asks for an acknowledgement; c.mu must be held
+func (c *quicConn) handleFrames(sp int, payload []byte, now time.Time) (bool, error) {
+	r := quicReader{b: payload}
+	eliciting := false
+	for len(r.b) > 0 {
+		switch typ := r.varint(); {
+		case typ == quicFramePadding:
+		case typ == quicFramePing:
+			eliciting = true
+		case typ == quicFrameAck || typ == quicFrameAckECN:
+			ranges := quicReadAck(&r, typ == quicFrameAckECN)
+			if r.err == nil {
+				if err := c.handleAck(sp, ranges, now); err != nil {
+					return false, err
+				}
+			}
+		case typ == quicFrameCrypto:
+			off := r.varint()
+			data := r.bytes(r.varint())
+			eliciting = true
+			if r.err == nil {
+				if err := c.handleCrypto(sp, off, data); err != nil {
+					return false, err
+				}
+			}
+		case typ&^0x07 == quicFrameStream && sp == quicApplication:
+			id := r.varint()
+			var off uint64
+			if typ&0x04 != 0 {
+				off = r.varint()
+			}
+			var data []byte
+			if typ&0x02 != 0 {
+				data = r.bytes(r.varint())
+			} else {
+				data = r.bytes(uint64(len(r.b)))
+			}
+			eliciting = true
+			if r.err == nil {
+				if err := c.handleStream(id, off, data); err != nil {
+					return false, err
+				}
+			}
+		case typ == quicFrameClose || typ == quicFrameAppClose:
+			code := r.varint()
+			if typ == quicFrameClose {
+				r.varint()
+			}
+			reason := r.bytes(r.varint())
+			if r.err == nil {
+				if code == 0 {
+					c.terminate(io.EOF)
+				} else {
+					c.terminate(fmt.Errorf("quic: closed by peer with error %#x: %s", code, reason))
+				}
+				return false, nil
+			}
+		case typ == quicFrameHandshakeDone && c.client && sp == quicApplication:
+			eliciting = true
+			c.confirm()
+		default:
+			return false, fmt.Errorf("quic: unexpected frame type %#x", typ)
+		}
+	}
+	return eliciting, r.err
+}
+
+// handleCrypto passes the handshake data of a CRYPTO frame to TLS once it is
+// in order; c.mu must be held
+func (c *quicConn) handleCrypto(sp int, off uint64, data []byte) error {
+	s := &c.spaces[sp]
+	s.crypto.push(off, data)
+	if len(s.crypto.buf) == 0 {
+		return nil
+	}
+	b := s.crypto.buf
+	s.crypto.buf = nil
+	if err := c.tls.HandleData(quicLevels[sp], b); err != nil {
+		return err
+	}
+	return c.tlsEvents()
+}
+
+// tlsEvents acts on what the TLS handshake produced; c.mu must be held
+func (c *quicConn) tlsEvents() error {
+	for {
+		e := c.tls.NextEvent()
+		sp := -1
+		for i, level := range quicLevels {
+			if e.Level == level {
+				sp = i
+			}
+		}
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			if sp < 0 {
+				continue
+			}
+			keys, err := newQUICKeys(e.Suite, e.Data)
+			if err != nil {
+				return err
+			}
+			if e.Kind == tls.QUICSetReadSecret {
+				c.spaces[sp].read = keys
+			} else {
+				c.spaces[sp].write = keys
+			}
+		case tls.QUICWriteData:
+			s := &c.spaces[sp]
+			s.queue = append(s.queue, quicFrame{kind: quicFrameCrypto, offset: s.cryptoOffset, data: bytes.Clone(e.Data)})
+			s.cryptoOffset += uint64(len(e.Data))
+		case tls.QUICTransportParametersRequired:
+			c.tls.SetTransportParameters(c.transportParameters())
+		case tls.QUICHandshakeDone:
+			c.handshaken = true
+			close(c.established)
+			if !c.client {
+				app := &c.spaces[quicApplication]
+				app.queue = append(app.queue, quicFrame{kind: quicFrameHandshakeDone})
+				c.confirm()
+				go c.e.deliver(c)
+			}
+		}
+	}
+}
+
+// handleStream adds the data of a STREAM frame to its stream and takes the
+// messages it completes; c.mu must be held
+func (c *quicConn) handleStream(id, off uint64, data []byte) error {
+	i := int(id >> 2)
+	if id&0x02 == 0 || (id&0x01 == 0) == c.client || i >= quicStreams {
+		return fmt.Errorf("quic: data on unexpected stream %d", id)
+	}
+	s := &c.recv[i]
+	s.push(off, data)
+	consumed := 0
+	for {
+		b := s.buf[consumed:]
+		if len(b) < 4 {
+			break
+		}
+		n := binary.BigEndian.Uint32(b)
+		if n > maxFrameSize {
+			return ErrFrameTooLarge
+		}
+		if uint64(len(b)) < 4+uint64(n) {
+			break
+		}
+		m := new(Message)
+		if err := m.UnmarshalBinary(b[4 : 4+n]); err != nil {
+			return err
+		}
+		c.inbox = append(c.inbox, m)
+		consumed += 4 + int(n)
+	}
+	if consumed > 0 {
+		s.buf = s.buf[consumed:]
+		c.cond.Broadcast()
+	}
+	return nil
+}
+
+// confirm marks the handshake confirmed, after which the keys of the
+// handshake are not needed anymore; c.mu must be held
+func (c *quicConn) confirm() {
+	c.discard(quicInitial)
+	c.discard(quicHandshake)
+}
+
+// discard drops the keys and packets of sp; c.mu must be held
+func (c *quicConn) discard(sp int) {
+	s := &c.spaces[sp]
+	for _, p := range s.sent {
+		c.inFlight -= p.size
+	}
+	s.read, s.write = nil, nil
+	s.sent = make(map[uint64]*quicSentPacket)
+	s.queue = nil
+	s.ackPending = false
+	s.lossTime = time.Time{}
+}
+
+// fail closes the connection after a protocol or handshake error, telling
+// the peer why; c.mu must be held
+func (c *quicConn) fail(err error) {
+	code := uint64(0x0a) // PROTOCOL_VIOLATION
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		code = 0x100 + uint64(alert)
+	}
+	c.sendClose(quicFrameClose, code, err.Error())
+	c.terminate(err)
+}
+
+// sendClose sends a CONNECTION_CLOSE frame at the highest encryption level
+// there are keys for; c.mu must be held
+func (c *quicConn) sendClose(typ byte, code uint64, reason string) {
+	for sp := quicSpaces - 1; sp >= 0; sp-- {
+		if c.spaces[sp].write == nil {
+			continue
+		}
+		if sp != quicApplication {
+			// Application closes may reveal too much before the handshake
+			typ = quicFrameClose
+		}
+		if len(reason) > 256 {
+			reason = reason[:256]
+		}
+		b := []byte{typ}
+		b = quicAppendVarint(b, code)
+		if typ == quicFrameClose {
+			b = quicAppendVarint(b, 0)
+		}
+		b = quicAppendVarint(b, uint64(len(reason)))
+		c.writePacket(sp, append(b, reason...))
+		return
+	}
+}
+
+// flush sends what is waiting as far as the congestion window allows, and
+// finishes a closing connection once everything it sent arrived; c.mu must
+// be held
+func (c *quicConn) flush(now time.Time) {
+	for sp := range c.spaces {
+		for !c.finished && c.spaces[sp].write != nil && c.sendPacket(sp, now) {
+		}
+	}
+	if c.closing && !c.finished && (c.drained() || !now.Before(c.linger)) {
+		c.sendClose(quicFrameAppClose, 0, "")
+		c.terminate(net.ErrClosed)
+	}
+}
+
+// drained reports whether everything sent was acknowledged; c.mu must be held
+func (c *quicConn) drained() bool {
+	for sp := range c.spaces {
+		if len(c.spaces[sp].sent) > 0 || len(c.spaces[sp].queue) > 0 {
+			return false
+		}
+	}
+	for i := range c.send {
+		if len(c.send[i].buf) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sendPacket sends one packet in sp if there is anything to send and
+// reports whether it did; c.mu must be held
+func (c *quicConn) sendPacket(sp int, now time.Time) bool {
+	s := &c.spaces[sp]
+	ack := s.ackPending && len(s.recvd) > 0 && (sp != quicApplication || s.ackElicited >= 2 || !now.Before(s.ackDeadline))
+	open := c.inFlight < c.cwnd || c.probes > 0
+	streams := sp == quicApplication && c.handshaken
+	if !ack && !(open && (len(s.queue) > 0 || streams && c.unsent())) {
+		return false
+	}
+
+	var payload []byte
+	if s.ackPending && len(s.recvd) > 0 {
+		payload = quicAppendAck(payload, s.recvd)
+		s.ackPending, s.ackElicited = false, 0
+	}
+	room := quicMaxDatagram - c.headerLen(sp) - quicPNLen - s.write.aead.Overhead()
+	var frames []quicFrame
+	add := func(f quicFrame) {
+		payload = f.append(payload)
+		frames = append(frames, f)
+	}
+	if open {
+		for len(s.queue) > 0 {
+			f := s.queue[0]
+			if len(payload)+f.size() <= room {
+				s.queue = s.queue[1:]
+			} else if rest, ok := f.split(room - len(payload)); ok {
+				s.queue[0] = rest
+			} else {
+				break
+			}
+			add(f)
+		}
+		if streams {
+			// The control stream goes first
+			for i := quicStreams - 1; i >= 0; i-- {
+				st := &c.send[i]
+				for len(st.buf) > 0 {
+					f := quicFrame{kind: quicFrameStream, stream: st.id, offset: st.offset, data: st.buf}
+					if len(payload)+f.size() > room {
+						if _, ok := f.split(room - len(payload)); !ok {
+							break
+						}
+					}
+					st.buf = st.buf[len(f.data):]
+					st.offset += uint64(len(f.data))
+					add(f)
+				}
+			}
+			c.cond.Broadcast()
+		}
+	}
+	if len(payload) == 0 {
+		return false
+	}
+	if sp == quicInitial {
+		// Datagrams with Initials are padded to the full size, so that the
+		// path is known to carry it
+		payload = append(payload, make([]byte, max(room-len(payload), 0))...)
+	}
+	pn, size := c.writePacket(sp, payload)
+	if len(frames) > 0 {
+		s.sent[pn] = &quicSentPacket{time: now, size: size, frames: frames}
+		c.inFlight += size
+		c.lastEliciting = now
+		c.probes = max(c.probes-1, 0)
+	}
+	if c.client && sp == quicHandshake {
+		// Sending a Handshake packet proves the client got the server's
+		// Initials, so neither end needs them anymore
+		c.discard(quicInitial)
+	}
+	return true
+}
+
+// unsent reports whether a stream has data not sent yet; c.mu must be held
+func (c *quicConn) unsent() bool {
+	for i := range c.send {
+		if len(c.send[i].buf) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// headerLen returns the length of the header of a packet in sp up to its
+// packet number
+func (c *quicConn) headerLen(sp int) int {
+	switch sp {
+	case quicApplication:
+		return 1 + len(c.remoteCID)
+	case quicInitial:
+		return 1 + 4 + 1 + len(c.remoteCID) + 1 + len(c.localCID) + 1 + 2
+	default:
+		return 1 + 4 + 1 + len(c.remoteCID) + 1 + len(c.localCID) + 2
+	}
+}
+
+// writePacket sends payload in a packet of sp and returns its packet number
+// and size; c.mu must be held
+func (c *quicConn) writePacket(sp int, payload []byte) (uint64, int) {
+	s := &c.spaces[sp]
+	pn := s.nextPN
+	s.nextPN++
+	b := make([]byte, 0, c.headerLen(sp)+quicPNLen+len(payload)+s.write.aead.Overhead())
+	if sp == quicApplication {
+		b = append(b, 0x40|(quicPNLen-1))
+		b = append(b, c.remoteCID...)
+	} else {
+		var typ byte
+		if sp == quicHandshake {
+			typ = 2
+		}
+		b = append(b, 0xc0|typ<<4|(quicPNLen-1))
+		b = binary.BigEndian.AppendUint32(b, quicVersion1)
+		b = append(b, byte(len(c.remoteCID)))
+		b = append(b, c.remoteCID...)
+		b = append(b, byte(len(c.localCID)))
+		b = append(b, c.localCID...)
+		if sp == quicInitial {
+			b = append(b, 0) // no token
+		}
+		b = binary.BigEndian.AppendUint16(b, 0x4000|uint16(quicPNLen+len(payload)+s.write.aead.Overhead()))
+	}
+	pnOffset := len(b)
+	b = binary.BigEndian.AppendUint32(b, uint32(pn))
+	b = s.write.seal(b, pnOffset, pn, payload)
+	// A datagram the socket refuses is as good as lost
+	c.e.udp.WriteToUDP(b, c.remote)
+	return pn, len(b)
+}
@@ -0,0 +1,518 @@
+package taskqueue
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+)
+
+// The packet layer of QUIC version 1 (RFC 9000 and RFC 9001) as far as
+// QUICTransport needs it: variable-length integers, packet protection,
+// packet number ranges and the few frames the transport sends
+
+// quicVersion1 is the only QUIC version spoken
+const quicVersion1 = 1
+
+// quicInitialSalt derives the keys of Initial packets from the connection ID
+// the client picked, so that both ends can read them before the handshake
+var quicInitialSalt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+
+// errMalformedQUIC is reported for packets and frames that do not parse
+var errMalformedQUIC = errors.New("malformed QUIC packet")
+
+// Frame types
+const (
+	quicFramePadding       = 0x00
+	quicFramePing          = 0x01
+	quicFrameAck           = 0x02
+	quicFrameAckECN        = 0x03
+	quicFrameCrypto        = 0x06
+	quicFrameStream        = 0x08
+	quicFrameClose         = 0x1c
+	quicFrameAppClose      = 0x1d
+	quicFrameHandshakeDone = 0x1e
+)
+
+// quicAppendVarint appends v in the variable-length encoding
+func quicAppendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	case v < 1<<30:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	default:
+		return binary.BigEndian.AppendUint64(b, v|0xc000000000000000)
+	}
+}
+
+// quicVarintLen returns the length of v in the variable-length encoding
+func quicVarintLen(v uint64) int {
+	switch {
+	case v < 1<<6:
+		return 1
+	case v < 1<<14:
+		return 2
+	case v < 1<<30:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// quicReader reads the fields of a packet or frame; the first field that
+// does not fit makes it fail with errMalformedQUIC, and every read after
+// returns zero
+type quicReader struct {
+	b   []byte
+	err error
+}
+
+func (r *quicReader) fail() {
+	if r.err == nil {
+		r.err = errMalformedQUIC
+	}
+	r.b = nil
+}
+
+func (r *quicReader) byte() byte {
+	if r.err != nil || len(r.b) == 0 {
+		r.fail()
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *quicReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *quicReader) varint() uint64 {
+	if r.err != nil || len(r.b) == 0 {
+		r.fail()
+		return 0
+	}
+	n := 1 << (r.b[0] >> 6)
+	if len(r.b) < n {
+		r.fail()
+		return 0
+	}
+	v := uint64(r.b[0] & 0x3f)
+	for _, c := range r.b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *quicReader) bytes(n uint64) []byte {
+	if r.err != nil || uint64(len(r.b)) < n {
+		r.fail()
+		return nil
+	}
+	b := r.b[:n:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// quicKeys protect the packets of one direction at one encryption level
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newQUICKeys derives the keys of the TLS traffic secret of suite. Only the
+// AES suites are supported, the standard library not exposing ChaCha20 on
+// its own for header protection; they are the ones Go negotiates on
+// hardware with AES instructions
+func newQUICKeys(suite uint16, secret []byte) (*quicKeys, error) {
+	var h func() hash.Hash
+	var keyLen int
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	default:
+		return nil, fmt.Errorf("quic: unsupported cipher suite %s", tls.CipherSuiteName(suite))
+	}
+	key, err := quicExpandLabel(h, secret, "quic key", keyLen)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := quicExpandLabel(h, secret, "quic iv", 12)
+	if err != nil {
+		return nil, err
+	}
+	hpKey, err := quicExpandLabel(h, secret, "quic hp", keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	return &quicKeys{aead: aead, iv: iv, hp: hp}, nil
+}
+
+// quicInitialKeys derives the keys of the Initial packets of a connection
+// whose client first sent to the connection ID cid
+func quicInitialKeys(cid []byte) (client, server *quicKeys, err error) {
+	secret, err := hkdf.Extract(sha256.New, cid, quicInitialSalt)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, k := range []struct {
+		label string
+		keys  **quicKeys
+	}{{"client in", &client}, {"server in", &server}} {
+		s, err := quicExpandLabel(sha256.New, secret, k.label, 32)
+		if err != nil {
+			return nil, nil, err
+		}
+		if *k.keys, err = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, s); err != nil {
+			return nil, nil, err
+		}
+	}
+	return client, server, nil
+}
+
+// quicExpandLabel is the HKDF-Expand-Label function of TLS 1.3 with an
+// empty context
+func quicExpandLabel(h func() hash.Hash, secret []byte, label string, n int) ([]byte, error) {
+	label = "tls13 " + label
+	info := binary.BigEndian.AppendUint16(nil, uint16(n))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(h, secret, string(info), n)
+}
+
+// nonce returns the AEAD nonce of packet number pn
+func (k *quicKeys) nonce(pn uint64) []byte {
+	n := bytes.Clone(k.iv)
+	for i := range 8 {
+		n[len(n)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return n
+}
+
+// mask returns the header protection mask of a packet's sample
+func (k *quicKeys) mask(sample []byte) []byte {
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, sample)
+	return mask
+}
+
+// quicPNLen is the length of the packet numbers sent, the longest allowed,
+// which also leaves room for the header protection sample in any packet
+const quicPNLen = 4
+
+// seal appends payload encrypted to b, which holds the packet's header
+// ending in its 4-byte packet number at pnOffset, and protects the header
+func (k *quicKeys) seal(b []byte, pnOffset int, pn uint64, payload []byte) []byte {
+	b = k.aead.Seal(b, k.nonce(pn), payload, b)
+	mask := k.mask(b[pnOffset+quicPNLen : pnOffset+quicPNLen+aes.BlockSize])
+	if b[0]&0x80 != 0 {
+		b[0] ^= mask[0] & 0x0f
+	} else {
+		b[0] ^= mask[0] & 0x1f
+	}
+	for i := range quicPNLen {
+		b[pnOffset+i] ^= mask[1+i]
+	}
+	return b
+}
+
+// open removes the protection of pkt, whose packet number starts at
+// pnOffset, in place and returns its packet number, recovered from the
+// truncated one next to largest, the highest received so far, and payload
+func (k *quicKeys) open(pkt []byte, pnOffset int, largest uint64) (uint64, []byte, error) {
+	if len(pkt) < pnOffset+quicPNLen+aes.BlockSize {
+		return 0, nil, errMalformedQUIC
+	}
+	mask := k.mask(pkt[pnOffset+quicPNLen : pnOffset+quicPNLen+aes.BlockSize])
+	if pkt[0]&0x80 != 0 {
+		pkt[0] ^= mask[0] & 0x0f
+	} else {
+		pkt[0] ^= mask[0] & 0x1f
+	}
+	pnLen := int(pkt[0]&3) + 1
+	var truncated uint64
+	for i := range pnLen {
+		pkt[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | uint64(pkt[pnOffset+i])
+	}
+	pn := quicDecodePacketNumber(largest, truncated, pnLen*8)
+	header := pnOffset + pnLen
+	payload, err := k.aead.Open(pkt[header:header], k.nonce(pn), pkt[header:], pkt[:header])
+	if err != nil {
+		return 0, nil, err
+	}
+	return pn, payload, nil
+}
+
+// quicDecodePacketNumber recovers the full packet number closest to the
+// one after largest from its lowest bits
+func quicDecodePacketNumber(largest, truncated uint64, bits int) uint64 {
+	expected := largest + 1
+	win := uint64(1) << bits
+	candidate := expected&^(win-1) | truncated
+	switch {
+	case candidate+win/2 <= expected && candidate < 1<<62-win:
+		return candidate + win
+	case candidate > expected+win/2 && candidate >= win:
+		return candidate - win
+	default:
+		return candidate
+	}
+}
+
+// quicRange is an inclusive range of packet numbers
+type quicRange struct {
+	lo, hi uint64
+}
+
+// quicMaxRanges bounds the ranges remembered for acknowledgement; the oldest
+// are forgotten, which the peer's loss recovery copes with
+const quicMaxRanges = 32
+
+// quicRanges is a set of packet numbers as disjoint ranges, highest first
+type quicRanges []quicRange
+
+// add adds pn to the set and reports whether it was not in it yet
+func (rs *quicRanges) add(pn uint64) bool {
+	r := *rs
+	defer func() {
+		if len(r) > quicMaxRanges {
+			r = r[:quicMaxRanges]
+		}
+		*rs = r
+	}()
+	for i := range r {
+		switch {
+		case pn >= r[i].lo && pn <= r[i].hi:
+			return false
+		case pn == r[i].hi+1:
+			r[i].hi = pn
+			if i > 0 && r[i-1].lo == pn+1 {
+				r[i-1].lo = r[i].lo
+				r = slices.Delete(r, i, i+1)
+			}
+			return true
+		case pn+1 == r[i].lo:
+			r[i].lo = pn
+			if i+1 < len(r) && r[i+1].hi+1 == pn {
+				r[i].lo = r[i+1].lo
+				r = slices.Delete(r, i+1, i+2)
+			}
+			return true
+		case pn > r[i].hi:
+			r = slices.Insert(r, i, quicRange{pn, pn})
+			return true
+		}
+	}
+	r = append(r, quicRange{pn, pn})
+	return true
+}
+
+// contains reports whether pn is in the set
+func (rs quicRanges) contains(pn uint64) bool {
+	for _, r := range rs {
+		if pn >= r.lo && pn <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// quicAppendAck appends an ACK frame acknowledging ranges, which must not be
+// empty
+func quicAppendAck(b []byte, ranges quicRanges) []byte {
+	b = append(b, quicFrameAck)
+	b = quicAppendVarint(b, ranges[0].hi)
+	b = quicAppendVarint(b, 0)
+	b = quicAppendVarint(b, uint64(len(ranges)-1))
+	b = quicAppendVarint(b, ranges[0].hi-ranges[0].lo)
+	for i := 1; i < len(ranges); i++ {
+		b = quicAppendVarint(b, ranges[i-1].lo-ranges[i].hi-2)
+		b = quicAppendVarint(b, ranges[i].hi-ranges[i].lo)
+	}
+	return b
+}
+
+// quicReadAck reads the ranges of an ACK frame whose type was already read
+func quicReadAck(r *quicReader, ecn bool) quicRanges {
+	largest := r.varint()
+	r.varint() // ack delay, which the RTT estimate does without
+	count := r.varint()
+	first := r.varint()
+	if first > largest || count > uint64(len(r.b)) {
+		r.fail()
+		return nil
+	}
+	ranges := quicRanges{{largest - first, largest}}
+	for range count {
+		gap, n := r.varint(), r.varint()
+		lo := ranges[len(ranges)-1].lo
+		if lo < gap+2 || lo-gap-2 < n {
+			r.fail()
+			return nil
+		}
+		hi := lo - gap - 2
+		ranges = append(ranges, quicRange{hi - n, hi})
+	}
+	if ecn {
+		r.varint()
+		r.varint()
+		r.varint()
+	}
+	return ranges
+}
+
+// quicFrame is a frame that is sent again if the packet carrying it is lost:
+// a CRYPTO or STREAM frame, or a PING or HANDSHAKE_DONE
+type quicFrame struct {
+	kind   byte
+	stream uint64
+	offset uint64
+	data   []byte
+}
+
+// size returns the encoded length of f
+func (f *quicFrame) size() int {
+	switch f.kind {
+	case quicFrameCrypto:
+		return 1 + quicVarintLen(f.offset) + quicVarintLen(uint64(len(f.data))) + len(f.data)
+	case quicFrameStream:
+		return 1 + quicVarintLen(f.stream) + quicVarintLen(f.offset) + quicVarintLen(uint64(len(f.data))) + len(f.data)
+	default:
+		return 1
+	}
+}
+
+// split cuts the data of a CRYPTO or STREAM frame so that it encodes in at
+// most n bytes, returning the rest as a second frame, or reports false if
+// not even a byte of data fits
+func (f *quicFrame) split(n int) (quicFrame, bool) {
+	if f.kind != quicFrameCrypto && f.kind != quicFrameStream {
+		return quicFrame{}, false
+	}
+	head := *f
+	head.data = nil
+	fit := n - head.size() - 1 // the length may take another byte
+	if fit <= 0 {
+		return quicFrame{}, false
+	}
+	rest := *f
+	head.data, rest.data = f.data[:fit], f.data[fit:]
+	rest.offset += uint64(fit)
+	*f = head
+	return rest, true
+}
+
+// append appends f to b
+func (f *quicFrame) append(b []byte) []byte {
+	switch f.kind {
+	case quicFrameCrypto:
+		b = append(b, quicFrameCrypto)
+		b = quicAppendVarint(b, f.offset)
+	case quicFrameStream:
+		// With the offset and length bits; the streams never end
+		b = append(b, quicFrameStream|0x04|0x02)
+		b = quicAppendVarint(b, f.stream)
+		b = quicAppendVarint(b, f.offset)
+	default:
+		return append(b, f.kind)
+	}
+	b = quicAppendVarint(b, uint64(len(f.data)))
+	return append(b, f.data...)
+}
+
+// Transport parameter IDs
+const (
+	quicParamOriginalCID   = 0x00
+	quicParamIdleTimeout   = 0x01
+	quicParamMaxData       = 0x04
+	quicParamMaxStreamUni  = 0x07
+	quicParamMaxStreamsUni = 0x09
+	quicParamSourceCID     = 0x0f
+)
+
+// quicAppendParam appends one transport parameter
+func quicAppendParam(b []byte, id uint64, value []byte) []byte {
+	b = quicAppendVarint(b, id)
+	b = quicAppendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// quicReassembly puts the data of a CRYPTO or STREAM frame sequence back in
+// order
+type quicReassembly struct {
+	// offset is where the next data to be appended to buf starts
+	offset  uint64
+	pending map[uint64][]byte
+	// buf is the data received in order and not consumed yet
+	buf []byte
+}
+
+// push adds the data of a frame starting at offset off
+func (s *quicReassembly) push(off uint64, data []byte) {
+	end := off + uint64(len(data))
+	if end <= s.offset {
+		return
+	}
+	if off > s.offset {
+		if s.pending == nil {
+			s.pending = make(map[uint64][]byte)
+		}
+		if len(data) > len(s.pending[off]) {
+			s.pending[off] = data
+		}
+		return
+	}
+	s.buf = append(s.buf, data[s.offset-off:]...)
+	s.offset = end
+	for len(s.pending) > 0 {
+		progressed := false
+		for o, d := range s.pending {
+			if o > s.offset {
+				continue
+			}
+			delete(s.pending, o)
+			if e := o + uint64(len(d)); e > s.offset {
+				s.buf = append(s.buf, d[s.offset-o:]...)
+				s.offset = e
+			}
+			progressed = true
+		}
+		if !progressed {
+			break
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"multithread/clocks"
+	"multithread/hashring"
+
+	"multithread/internal/wire"
+)
+
+// quorumTimeout bounds each request a quorum client sends a replica
+const quorumTimeout = time.Second
+
+// Versioned is a value as a quorum replica stores it. Versions order the
+// writes of a key last-writer-wins: the newer hybrid logical clock time wins,
+// and the writer's ID breaks ties between equal times. A deletion is kept as
+// a tombstone so that it wins over the older value on stale replicas
+type Versioned struct {
+	Value   []byte
+	Version clocks.HLCTimestamp
+	Writer  string
+	Deleted bool
+}
+
+// newer reports whether v supersedes o
+func (v *Versioned) newer(o *Versioned) bool {
+	if c := v.Version.Compare(o.Version); c != 0 {
+		return c > 0
+	}
+	return v.Writer > o.Writer
+}
+
+// quorumMsg is the payload of a read or write between a quorum client and a
+// replica: the key and, for writes and read replies, the versioned value.
+// Found is false in the reply for a key the replica never stored
+type quorumMsg struct {
+	Key   string
+	Found bool
+	Versioned
+}
+
+// marshal encodes the message as its key, value and writer as
+// uvarint-prefixed bytes followed by the version and a flags byte
+func (q *quorumMsg) marshal() []byte {
+	b := wire.AppendBytes(nil, []byte(q.Key))
+	b = wire.AppendBytes(b, q.Value)
+	b = wire.AppendBytes(b, []byte(q.Writer))
+	stamp, _ := q.Version.MarshalBinary()
+	b = append(b, stamp...)
+	var flags byte
+	if q.Found {
+		flags |= 1
+	}
+	if q.Deleted {
+		flags |= 2
+	}
+	return append(b, flags)
+}
+
+// unmarshal decodes a message encoded by marshal
+func (q *quorumMsg) unmarshal(b []byte) error {
+	r := wire.Reader{B: b}
+	q.Key = string(r.Bytes())
+	q.Value = r.Bytes()
+	q.Writer = string(r.Bytes())
+	if r.Err != nil {
+		return r.Err
+	}
+	if len(r.B) != clocks.HLCTimestampSize+1 {
+		return wire.ErrMalformed
+	}
+	if err := q.Version.UnmarshalBinary(r.B[:clocks.HLCTimestampSize]); err != nil {
+		return err
+	}
+	flags := r.B[clocks.HLCTimestampSize]
+	q.Found, q.Deleted = flags&1 != 0, flags&2 != 0
+	return nil
+}
+
+// QuorumReplica is a storage node of a leaderless replicated store. It keeps
+// the newest version written to each key and answers reads with it; it takes
+// no part in deciding what is newest beyond comparing versions, leaving
+// quorum assembly to the clients. A Merkle tree of its entries lets it
+// converge with its peers through anti-entropy, see SyncWith
+type QuorumReplica struct {
+	addr      string
+	transport Transport
+
+	mu   sync.Mutex
+	data map[string]*Versioned
+	tree *MerkleTree
+}
+
+// NewQuorumReplica creates a replica serving on addr; Run starts it
+func NewQuorumReplica(addr string, t Transport) *QuorumReplica {
+	return &QuorumReplica{addr: addr, transport: t, data: make(map[string]*Versioned), tree: NewMerkleTree(merkleDepth)}
+}
+
+// Run serves reads, writes and anti-entropy until ctx is cancelled
+func (r *QuorumReplica) Run(ctx context.Context) error {
+	return ServeRequests(ctx, r.transport, r.addr, func(ctx context.Context, conn Conn, m *Message) {
+		// An anti-entropy session makes several exchanges on one connection
+		for m.Type == MsgDigest || m.Type == MsgRepair {
+			if conn.Send(r.handleAntiEntropy(m)) != nil {
+				return
+			}
+			var err error
+			if m, err = conn.Recv(); err != nil {
+				return
+			}
+		}
+
+		reply := &Message{Type: MsgAck}
+		var q quorumMsg
+		if err := q.unmarshal(m.Payload); err != nil {
+			reply.Error = err.Error()
+			conn.Send(reply)
+			return
+		}
+		switch m.Type {
+		case MsgRead:
+			reply.Payload = r.read(q.Key).marshal()
+		case MsgWrite:
+			r.write(q.Key, &q.Versioned)
+		default:
+			reply.Error = "unexpected " + m.Type.String() + " message"
+		}
+		conn.Send(reply)
+	})
+}
+
+// read returns the stored version of key
+func (r *QuorumReplica) read(key string) *quorumMsg {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q := &quorumMsg{Key: key}
+	if v, ok := r.data[key]; ok {
+		q.Found, q.Versioned = true, *v
+	}
+	return q
+}
+
+// write stores v unless the replica has the same or a newer version of key,
+// and reports whether it did
+func (r *QuorumReplica) write(key string, v *Versioned) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur, ok := r.data[key]
+	if ok && !v.newer(cur) {
+		return false
+	}
+	var old []byte
+	if ok {
+		old = (&quorumMsg{Key: key, Found: true, Versioned: *cur}).marshal()
+	}
+	stored := *v
+	r.data[key] = &stored
+	r.tree.Update(key, old, (&quorumMsg{Key: key, Found: true, Versioned: stored}).marshal())
+	return true
+}
+
+// Get returns the replica's own version of key, which may be stale
+func (r *QuorumReplica) Get(key string) (Versioned, bool) {
+	q := r.read(key)
+	return q.Versioned, q.Found
+}
+
+// QuorumConfig configures a QuorumClient
+type QuorumConfig struct {
+	// ID names the client as the writer of its versions; clients writing to
+	// the same store must have distinct IDs
+	ID string
+	// Replicas lists the addresses of every replica of the store
+	Replicas []string
+	// Transport carries the requests
+	Transport Transport
+	// N is how many replicas hold each key, chosen by consistent hashing;
+	// defaults to all of them, or 3 if there are more
+	N int
+	// R and W are how many of a key's replicas must answer a read or
+	// acknowledge a write. With R+W > N every read quorum overlaps every
+	// write quorum, so a read sees the latest completed write; lower values
+	// trade that for latency and availability. Both default to a majority
+	R, W int
+	// Timeout bounds each replica request; defaults to 1s
+	Timeout time.Duration
+}
+
+// QuorumClient reads and writes a leaderless replicated store: each request
+// goes to the key's N replicas in parallel and completes once R of them
+// answered a read or W acknowledged a write. A read returns the newest
+// version among its answers and repairs the replicas that answered with an
+// older one. Unlike ReplicatedKV there is no leader to fail over and no
+// single order of writes: concurrent writes to a key are resolved last
+// writer wins
+type QuorumClient struct {
+	cfg   QuorumConfig
+	ring  *hashring.Ring
+	clock *clocks.HLC
+}
+
+// NewQuorumClient creates a client, checking the quorum sizes
+func NewQuorumClient(cfg QuorumConfig) (*QuorumClient, error) {
+	if len(cfg.Replicas) == 0 {
+		return nil, errors.New("quorum: no replicas")
+	}
+	if cfg.N <= 0 {
+		cfg.N = min(len(cfg.Replicas), 3)
+	}
+	if cfg.N > len(cfg.Replicas) {
+		return nil, fmt.Errorf("quorum: N is %d but there are %d replicas", cfg.N, len(cfg.Replicas))
+	}
+	if cfg.R <= 0 {
+		cfg.R = cfg.N/2 + 1
+	}
+	if cfg.W <= 0 {
+		cfg.W = cfg.N/2 + 1
+	}
+	if cfg.R > cfg.N || cfg.W > cfg.N {
+		return nil, fmt.Errorf("quorum: R is %d and W is %d, neither can exceed N (%d)", cfg.R, cfg.W, cfg.N)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = quorumTimeout
+	}
+	ring := hashring.New(0)
+	ring.Add(cfg.Replicas...)
+	return &QuorumClient{cfg: cfg, ring: ring, clock: clocks.NewHLC(0, nil)}, nil
+}
+
+// Replicas returns the addresses of the replicas holding key
+func (c *QuorumClient) Replicas(key string) []string {
+	return c.ring.GetN(key, c.cfg.N)
+}
+
+// quorumReply is the answer of one replica
+type quorumReply struct {
+	addr string
+	msg  *quorumMsg
+	err  error
+}
+
+// broadcast sends q to the replicas of its key and returns a channel of their
+// replies
+func (c *QuorumClient) broadcast(ctx context.Context, t MessageType, q *quorumMsg) (<-chan quorumReply, int) {
+	replicas := c.Replicas(q.Key)
+	replies := make(chan quorumReply, len(replicas))
+	payload := q.marshal()
+	for _, addr := range replicas {
+		go func() {
+			reply, err := RoundTrip(ctx, c.cfg.Transport, addr, &Message{Type: t, Payload: payload}, true, c.cfg.Timeout)
+			res := quorumReply{addr: addr, err: err}
+			if err == nil && reply.Error != "" {
+				res.err = errors.New(reply.Error)
+			}
+			if res.err == nil && t == MsgRead {
+				res.msg = new(quorumMsg)
+				res.err = res.msg.unmarshal(reply.Payload)
+			}
+			replies <- res
+		}()
+	}
+	return replies, len(replicas)
+}
+
+// Get returns the newest value of key among R replicas, and whether it has
+// one; a deleted key has none
+func (c *QuorumClient) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := c.GetVersioned(ctx, key)
+	if err != nil || v == nil || v.Deleted {
+		return nil, false, err
+	}
+	return v.Value, true, nil
+}
+
+// GetVersioned is like Get but returns the newest version itself, which is
+// nil if no replica that answered ever stored key
+func (c *QuorumClient) GetVersioned(ctx context.Context, key string) (*Versioned, error) {
+	replies, n := c.broadcast(ctx, MsgRead, &quorumMsg{Key: key})
+	var answered []quorumReply
+	var errs []error
+	for range n {
+		r := <-replies
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.addr, r.err))
+			continue
+		}
+		answered = append(answered, r)
+		if len(answered) == c.cfg.R {
+			break
+		}
+	}
+	if len(answered) < c.cfg.R {
+		return nil, quorumError("read", key, len(answered), c.cfg.R, errs)
+	}
+
+	var newest *Versioned
+	for _, r := range answered {
+		if r.msg.Found && (newest == nil || r.msg.newer(newest)) {
+			newest = &r.msg.Versioned
+		}
+	}
+	if newest == nil {
+		return nil, nil
+	}
+	c.clock.Update(newest.Version)
+
+	// Repair the answers that were stale, without holding up the read
+	repair := &quorumMsg{Key: key, Versioned: *newest}
+	for _, r := range answered {
+		if !r.msg.Found || newest.newer(&r.msg.Versioned) {
+			go RoundTrip(context.WithoutCancel(ctx), c.cfg.Transport, r.addr, &Message{Type: MsgWrite, Payload: repair.marshal()}, true, c.cfg.Timeout)
+		}
+	}
+	return newest, nil
+}
+
+// Put writes value to key, returning once W replicas stored it
+func (c *QuorumClient) Put(ctx context.Context, key string, value []byte) error {
+	return c.write(ctx, &quorumMsg{Key: key, Versioned: Versioned{Value: value}})
+}
+
+// Delete removes key, returning once W replicas stored its tombstone
+func (c *QuorumClient) Delete(ctx context.Context, key string) error {
+	return c.write(ctx, &quorumMsg{Key: key, Versioned: Versioned{Deleted: true}})
+}
+
+// write stamps q with a new version and sends it to the replicas of its key.
+// Replicas that have not acknowledged when the quorum is reached still get
+// the write unless ctx is cancelled; a failed write may still have reached
+// some replicas
+func (c *QuorumClient) write(ctx context.Context, q *quorumMsg) error {
+	q.Version, q.Writer = c.clock.Now(), c.cfg.ID
+	replies, n := c.broadcast(ctx, MsgWrite, q)
+	acks := 0
+	var errs []error
+	for range n {
+		r := <-replies
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.addr, r.err))
+			continue
+		}
+		if acks++; acks == c.cfg.W {
+			return nil
+		}
+	}
+	return quorumError("write", q.Key, acks, c.cfg.W, errs)
+}
+
+// quorumError reports a request that too few replicas answered
+func quorumError(op, key string, got, want int, errs []error) error {
+	return fmt.Errorf("%w: %s of %q got %d of %d replies: %w", ErrQuorumNotReached, op, key, got, want, errors.Join(errs...))
+}
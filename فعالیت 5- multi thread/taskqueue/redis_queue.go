@@ -0,0 +1,299 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Lua scripts keep every queue transition atomic on the server. They build
+// task and result keys from the queue name, so the queue needs a single Redis
+// instance rather than a cluster
+const (
+	redisPushScript = `
+local id = redis.call('INCR', KEYS[2])
+redis.call('HSET', ARGV[1] .. ':task:' .. id, 'task', ARGV[2], 'payload', ARGV[3], 'attempts', 0)
+redis.call('LPUSH', KEYS[1], id)
+return id`
+
+	redisReserveScript = `
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[2])
+for _, id in ipairs(expired) do
+  redis.call('ZREM', KEYS[2], id)
+  redis.call('RPUSH', KEYS[1], id)
+end
+local id = redis.call('RPOP', KEYS[1])
+if not id then return nil end
+redis.call('ZADD', KEYS[2], ARGV[1], id)
+local key = ARGV[3] .. ':task:' .. id
+local attempts = redis.call('HINCRBY', key, 'attempts', 1)
+local fields = redis.call('HMGET', key, 'task', 'payload')
+return {id, fields[1], fields[2], attempts}`
+
+	redisAckScript = `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then return 0 end
+local result = ARGV[2] .. ':result:' .. ARGV[1]
+redis.call('HSET', result, 'payload', ARGV[3], 'error', ARGV[4])
+redis.call('PEXPIRE', result, ARGV[5])
+redis.call('DEL', ARGV[2] .. ':task:' .. ARGV[1])
+return 1`
+
+	redisNackScript = `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then return 0 end
+redis.call('RPUSH', KEYS[2], ARGV[1])
+return 1`
+)
+
+// RedisQueueConfig configures a RedisQueue
+type RedisQueueConfig struct {
+	// Addr is the Redis server address
+	Addr string
+	// Name prefixes every key of the queue; it defaults to "tasks"
+	Name string
+	// VisibilityTimeout is how long a reserved task stays hidden before it is
+	// redelivered; it defaults to 30 seconds
+	VisibilityTimeout time.Duration
+	// ResultTTL is how long results are kept for Result; it defaults to an hour
+	ResultTTL time.Duration
+}
+
+// RedisQueue is a durable queue of remote tasks shared by any number of
+// coordinators. Pool tasks are closures and stay in process; what goes to
+// Redis is the task name and payload a Coordinator dispatches. A reserved
+// task that is not acknowledged within the visibility timeout, e.g. because
+// its coordinator crashed, is delivered again, so tasks run at least once
+type RedisQueue struct {
+	client *redisClient
+	config RedisQueueConfig
+}
+
+// RedisTask is a task reserved from a RedisQueue
+type RedisTask struct {
+	ID       string
+	Task     string
+	Payload  []byte
+	Attempts int
+}
+
+// RedisResult is the stored outcome of a task; Error is empty on success
+type RedisResult struct {
+	Payload []byte
+	Error   string
+}
+
+// NewRedisQueue creates a queue client; no connection is made until first use
+func NewRedisQueue(config RedisQueueConfig) *RedisQueue {
+	if config.Name == "" {
+		config.Name = "tasks"
+	}
+	if config.VisibilityTimeout <= 0 {
+		config.VisibilityTimeout = 30 * time.Second
+	}
+	if config.ResultTTL <= 0 {
+		config.ResultTTL = time.Hour
+	}
+	return &RedisQueue{client: newRedisClient(config.Addr), config: config}
+}
+
+func (q *RedisQueue) key(suffix string) string {
+	return q.config.Name + ":" + suffix
+}
+
+// eval runs one of the queue scripts
+func (q *RedisQueue) eval(ctx context.Context, script string, keys []string, args ...string) (any, error) {
+	cmd := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	return q.client.do(ctx, append(cmd, args...)...)
+}
+
+// Push appends a call of the named handler to the queue and returns its ID
+func (q *RedisQueue) Push(ctx context.Context, task string, payload []byte) (string, error) {
+	reply, err := q.eval(ctx, redisPushScript, []string{q.key("ready"), q.key("seq")},
+		q.config.Name, task, string(payload))
+	if err != nil {
+		return "", err
+	}
+	id, ok := reply.(int64)
+	if !ok {
+		return "", errors.New("redis: unexpected push reply")
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// Reserve takes the oldest task and hides it for the visibility timeout,
+// first returning tasks whose timeout has run out to the front of the queue;
+// it returns nil if no task is ready
+func (q *RedisQueue) Reserve(ctx context.Context) (*RedisTask, error) {
+	now := time.Now()
+	reply, err := q.eval(ctx, redisReserveScript, []string{q.key("ready"), q.key("inflight")},
+		strconv.FormatInt(now.Add(q.config.VisibilityTimeout).UnixMilli(), 10),
+		strconv.FormatInt(now.UnixMilli(), 10),
+		q.config.Name)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	fields, ok := reply.([]any)
+	if !ok || len(fields) != 4 {
+		return nil, errors.New("redis: unexpected reserve reply")
+	}
+	t := &RedisTask{}
+	t.ID, _ = fields[0].(string)
+	t.Task, _ = fields[1].(string)
+	payload, _ := fields[2].(string)
+	t.Payload = []byte(payload)
+	attempts, _ := fields[3].(int64)
+	t.Attempts = int(attempts)
+	return t, nil
+}
+
+// Extend pushes the visibility timeout of a reserved task back, for tasks
+// that run longer than the timeout; it fails with ErrLeaseExpired if the task
+// has already been made visible again
+func (q *RedisQueue) Extend(ctx context.Context, id string) error {
+	deadline := time.Now().Add(q.config.VisibilityTimeout).UnixMilli()
+	reply, err := q.client.do(ctx, "ZADD", q.key("inflight"), "XX", "CH", strconv.FormatInt(deadline, 10), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		// CH counts changed scores; an unchanged deadline still means we hold it
+		score, err := q.client.do(ctx, "ZSCORE", q.key("inflight"), id)
+		if err != nil {
+			return err
+		}
+		if score == nil {
+			return ErrLeaseExpired
+		}
+	}
+	return nil
+}
+
+// Ack removes a reserved task and stores its result; it fails with
+// ErrLeaseExpired if the task was made visible again after its visibility
+// timeout ran out, since it may then be running elsewhere
+func (q *RedisQueue) Ack(ctx context.Context, id string, result RedisResult) error {
+	reply, err := q.eval(ctx, redisAckScript, []string{q.key("inflight")},
+		id, q.config.Name, string(result.Payload), result.Error,
+		strconv.FormatInt(q.config.ResultTTL.Milliseconds(), 10))
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// Nack returns a reserved task to the front of the queue for immediate
+// redelivery
+func (q *RedisQueue) Nack(ctx context.Context, id string) error {
+	reply, err := q.eval(ctx, redisNackScript, []string{q.key("inflight"), q.key("ready")}, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// Result returns the stored result of a task, or nil if it has not finished
+func (q *RedisQueue) Result(ctx context.Context, id string) (*RedisResult, error) {
+	reply, err := q.client.do(ctx, "HMGET", q.key("result:"+id), "payload", "error")
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]any)
+	if !ok || len(fields) != 2 || fields[0] == nil {
+		return nil, nil
+	}
+	payload, _ := fields[0].(string)
+	msg, _ := fields[1].(string)
+	return &RedisResult{Payload: []byte(payload), Error: msg}, nil
+}
+
+// Len returns the number of tasks waiting to be reserved
+func (q *RedisQueue) Len(ctx context.Context) (int, error) {
+	reply, err := q.client.do(ctx, "LLEN", q.key("ready"))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return int(n), nil
+}
+
+// Close closes the connection to Redis
+func (q *RedisQueue) Close() error {
+	return q.client.close()
+}
+
+// Consume feeds tasks from q to the coordinator's workers, keeping at most
+// limit of them reserved at once, until ctx is cancelled. Tasks whose worker
+// is lost go straight back to the queue; every other outcome is acknowledged
+// with its result
+func (c *Coordinator) Consume(ctx context.Context, q *RedisQueue, limit int) error {
+	slots := newSemaphore(int64(max(limit, 1)))
+	idle := time.NewTicker(100 * time.Millisecond)
+	defer idle.Stop()
+
+	for {
+		if err := slots.acquire(ctx, 1); err != nil {
+			return err
+		}
+		t, err := q.Reserve(ctx)
+		if err != nil || t == nil {
+			slots.release(1)
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			select {
+			case <-idle.C:
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+			continue
+		}
+		go func() {
+			defer slots.release(1)
+			c.process(ctx, q, t)
+		}()
+	}
+}
+
+// process runs one reserved task, extending its visibility timeout while it
+// runs
+func (c *Coordinator) process(ctx context.Context, q *RedisQueue, t *RedisTask) {
+	taskCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	future := c.Submit(taskCtx, t.Task, t.Payload)
+
+	extend := time.NewTicker(q.config.VisibilityTimeout / 3)
+	defer extend.Stop()
+wait:
+	for {
+		select {
+		case <-future.Done():
+			break wait
+		case <-extend.C:
+			if err := q.Extend(ctx, t.ID); errors.Is(err, ErrLeaseExpired) {
+				// Someone else owns the task now; let them report it
+				return
+			}
+		}
+	}
+
+	v, err := future.Get()
+	// Use a fresh context so results are still recorded while shutting down
+	ackCtx, done := context.WithTimeout(context.Background(), q.client.timeout)
+	defer done()
+	if errors.Is(err, ErrWorkerLost) || errors.Is(err, ErrCoordinatorClosed) || ctx.Err() != nil {
+		q.Nack(ackCtx, t.ID)
+		return
+	}
+	result := RedisResult{}
+	result.Payload, _ = v.([]byte)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	q.Ack(ackCtx, t.ID, result)
+}
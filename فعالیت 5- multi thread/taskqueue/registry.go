@@ -0,0 +1,681 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registryWatchBuffer is how many events a watcher of a MemoryRegistry may
+// fall behind by before its stream is closed
+const registryWatchBuffer = 64
+
+// WorkerInfo describes a worker node as advertised in a Registry
+type WorkerInfo struct {
+	ID       string            `json:"id"`
+	Addr     string            `json:"addr"`
+	Capacity int               `json:"capacity"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// Matches reports whether the worker carries every label in selector
+func (w WorkerInfo) Matches(selector map[string]string) bool {
+	for k, v := range selector {
+		if w.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Registry records the worker nodes available to coordinators
+type Registry interface {
+	// Register adds the worker or replaces its entry
+	Register(ctx context.Context, info WorkerInfo) error
+	// RegisterLease is like Register but the entry expires unless its lease
+	// is renewed within ttl
+	RegisterLease(ctx context.Context, info WorkerInfo, ttl time.Duration) error
+	// Renew extends the lease of the worker with the given ID to ttl from
+	// now, or fails with ErrNotRegistered if its entry is gone
+	Renew(ctx context.Context, id string, ttl time.Duration) error
+	// Deregister removes the worker with the given ID
+	Deregister(ctx context.Context, id string) error
+	// Lookup returns the workers matching selector, ordered by ID
+	Lookup(ctx context.Context, selector map[string]string) ([]WorkerInfo, error)
+	// Watch streams the changes to the workers matching selector, starting
+	// with an added event for each current one, until ctx is cancelled or
+	// the stream breaks, when the channel is closed
+	Watch(ctx context.Context, selector map[string]string) (<-chan RegistryEvent, error)
+}
+
+// RegistryEventKind says how a registry entry changed
+type RegistryEventKind int
+
+const (
+	// RegistryAdded is a worker that registered, or that now matches the
+	// watched selector
+	RegistryAdded RegistryEventKind = iota
+	// RegistryUpdated is a worker that registered again with a new entry
+	RegistryUpdated
+	// RegistryRemoved is a worker that deregistered, or that no longer
+	// matches the watched selector
+	RegistryRemoved
+	// RegistryExpired is a worker whose lease ran out
+	RegistryExpired
+)
+
+func (k RegistryEventKind) String() string {
+	switch k {
+	case RegistryAdded:
+		return "added"
+	case RegistryUpdated:
+		return "updated"
+	case RegistryRemoved:
+		return "removed"
+	case RegistryExpired:
+		return "expired"
+	default:
+		return fmt.Sprintf("RegistryEventKind(%d)", int(k))
+	}
+}
+
+// MarshalText encodes the kind as its name
+func (k RegistryEventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes a kind encoded by MarshalText
+func (k *RegistryEventKind) UnmarshalText(b []byte) error {
+	for kind := RegistryAdded; kind <= RegistryExpired; kind++ {
+		if kind.String() == string(b) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown registry event %q", b)
+}
+
+// RegistryEvent is a change to a registry entry seen by a watcher
+type RegistryEvent struct {
+	Kind   RegistryEventKind `json:"kind"`
+	Worker WorkerInfo        `json:"worker"`
+}
+
+// MemoryRegistry is a Registry held in process memory
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	workers  map[string]*registryEntry
+	watchers map[*registryWatcher]struct{}
+}
+
+// registryEntry is a registered worker and its lease, if it has one
+type registryEntry struct {
+	info    WorkerInfo
+	expires time.Time
+	timer   *time.Timer
+}
+
+// registryWatcher is the stream of one Watch call
+type registryWatcher struct {
+	selector map[string]string
+	events   chan RegistryEvent
+}
+
+// NewMemoryRegistry creates an empty registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{workers: make(map[string]*registryEntry), watchers: make(map[*registryWatcher]struct{})}
+}
+
+// Register implements Registry
+func (r *MemoryRegistry) Register(ctx context.Context, info WorkerInfo) error {
+	return r.register(info, 0)
+}
+
+// RegisterLease implements Registry
+func (r *MemoryRegistry) RegisterLease(ctx context.Context, info WorkerInfo, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("registry: lease needs a positive TTL")
+	}
+	return r.register(info, ttl)
+}
+
+// register stores info, under a lease of ttl unless it is 0
+func (r *MemoryRegistry) register(info WorkerInfo, ttl time.Duration) error {
+	if info.ID == "" || info.Addr == "" {
+		return fmt.Errorf("registry: worker needs an ID and an address")
+	}
+	info.Labels = maps.Clone(info.Labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var old *WorkerInfo
+	if e, ok := r.workers[info.ID]; ok {
+		old = &e.info
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+	}
+	e := &registryEntry{info: info}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+		e.timer = time.AfterFunc(ttl, func() { r.expire(e) })
+	}
+	r.workers[info.ID] = e
+	if old == nil || !sameWorker(*old, info) {
+		r.notify(old, &info, RegistryRemoved)
+	}
+	return nil
+}
+
+// sameWorker reports whether two entries of a worker are identical
+func sameWorker(a, b WorkerInfo) bool {
+	return a.ID == b.ID && a.Addr == b.Addr && a.Capacity == b.Capacity && maps.Equal(a.Labels, b.Labels)
+}
+
+// Renew implements Registry
+func (r *MemoryRegistry) Renew(ctx context.Context, id string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("registry: lease needs a positive TTL")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.workers[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, id)
+	}
+	e.expires = time.Now().Add(ttl)
+	if e.timer == nil {
+		e.timer = time.AfterFunc(ttl, func() { r.expire(e) })
+	} else {
+		e.timer.Reset(ttl)
+	}
+	return nil
+}
+
+// expire removes e once its lease ran out, unless it was replaced or renewed
+// in the meantime
+func (r *MemoryRegistry) expire(e *registryEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.workers[e.info.ID] != e || time.Now().Before(e.expires) {
+		return
+	}
+	delete(r.workers, e.info.ID)
+	r.notify(&e.info, nil, RegistryExpired)
+}
+
+// Deregister implements Registry
+func (r *MemoryRegistry) Deregister(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.workers[id]
+	if !ok {
+		return nil
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	delete(r.workers, id)
+	r.notify(&e.info, nil, RegistryRemoved)
+	return nil
+}
+
+// Lookup implements Registry
+func (r *MemoryRegistry) Lookup(ctx context.Context, selector map[string]string) ([]WorkerInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookup(selector), nil
+}
+
+// lookup returns the workers matching selector ordered by ID; the caller
+// holds r.mu
+func (r *MemoryRegistry) lookup(selector map[string]string) []WorkerInfo {
+	var found []WorkerInfo
+	for _, e := range r.workers {
+		if e.info.Matches(selector) {
+			found = append(found, e.info)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	return found
+}
+
+// Watch implements Registry. A watcher that falls registryWatchBuffer events
+// behind has its channel closed and must watch again
+func (r *MemoryRegistry) Watch(ctx context.Context, selector map[string]string) (<-chan RegistryEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.lookup(selector)
+	w := &registryWatcher{selector: maps.Clone(selector), events: make(chan RegistryEvent, len(current)+registryWatchBuffer)}
+	for _, info := range current {
+		w.events <- RegistryEvent{Kind: RegistryAdded, Worker: info}
+	}
+	r.watchers[w] = struct{}{}
+	context.AfterFunc(ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.unwatch(w)
+	})
+	return w.events, nil
+}
+
+// unwatch closes the stream of w unless it is already closed; the caller
+// holds r.mu
+func (r *MemoryRegistry) unwatch(w *registryWatcher) {
+	if _, ok := r.watchers[w]; ok {
+		delete(r.watchers, w)
+		close(w.events)
+	}
+}
+
+// notify tells each watcher about an entry that changed from old to new,
+// either of which is nil for an entry that is absent, as seen through its
+// selector; gone is the kind of event for an entry the watcher loses. The
+// caller holds r.mu
+func (r *MemoryRegistry) notify(old, new *WorkerInfo, gone RegistryEventKind) {
+	for w := range r.watchers {
+		was := old != nil && old.Matches(w.selector)
+		is := new != nil && new.Matches(w.selector)
+		var ev RegistryEvent
+		switch {
+		case was && is:
+			ev = RegistryEvent{Kind: RegistryUpdated, Worker: *new}
+		case is:
+			ev = RegistryEvent{Kind: RegistryAdded, Worker: *new}
+		case was:
+			ev = RegistryEvent{Kind: gone, Worker: *old}
+		default:
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			r.unwatch(w)
+		}
+	}
+}
+
+// RegistryHandler serves r over HTTP: PUT /workers/{id} registers the
+// WorkerInfo JSON in the body, under a lease if a ttl query parameter is
+// given, POST /workers/{id}/renew?ttl=D renews the lease, answering 404 Not
+// Found for a worker that is not registered, DELETE /workers/{id}
+// deregisters and GET /workers lists the workers whose labels match every
+// label=key=value query parameter. GET /watch takes the same parameters and
+// streams the changes to those workers as one JSON RegistryEvent per line
+func RegistryHandler(r Registry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /workers/{id}", func(w http.ResponseWriter, req *http.Request) {
+		var info WorkerInfo
+		if err := json.NewDecoder(req.Body).Decode(&info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info.ID = req.PathValue("id")
+		var err error
+		if ttl := req.URL.Query().Get("ttl"); ttl != "" {
+			d, perr := time.ParseDuration(ttl)
+			if perr != nil {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+			err = r.RegisterLease(req.Context(), info, d)
+		} else {
+			err = r.Register(req.Context(), info)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /workers/{id}/renew", func(w http.ResponseWriter, req *http.Request) {
+		ttl, err := time.ParseDuration(req.URL.Query().Get("ttl"))
+		if err != nil {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		switch err := r.Renew(req.Context(), req.PathValue("id"), ttl); {
+		case errors.Is(err, ErrNotRegistered):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("DELETE /workers/{id}", func(w http.ResponseWriter, req *http.Request) {
+		if err := r.Deregister(req.Context(), req.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /workers", func(w http.ResponseWriter, req *http.Request) {
+		selector, err := ParseLabels(strings.Join(req.URL.Query()["label"], ","))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		workers, err := r.Lookup(req.Context(), selector)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(workers)
+	})
+	mux.HandleFunc("GET /watch", func(w http.ResponseWriter, req *http.Request) {
+		selector, err := ParseLabels(strings.Join(req.URL.Query()["label"], ","))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events, err := r.Watch(req.Context(), selector)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		rc := http.NewResponseController(w)
+		enc := json.NewEncoder(w)
+		for {
+			// Flush before blocking so that the watcher sees the headers and
+			// every event as soon as it is sent
+			if rc.Flush() != nil {
+				return
+			}
+			ev, ok := <-events
+			if !ok || enc.Encode(ev) != nil {
+				return
+			}
+		}
+	})
+	return mux
+}
+
+// HTTPRegistry is a Registry client for a server running RegistryHandler
+type HTTPRegistry struct {
+	base   string
+	client *http.Client
+	// stream carries watches, which outlive the request timeout of client
+	stream *http.Client
+}
+
+// NewHTTPRegistry creates a client for the registry at baseURL
+func NewHTTPRegistry(baseURL string) *HTTPRegistry {
+	return &HTTPRegistry{base: strings.TrimSuffix(baseURL, "/"), client: &http.Client{Timeout: 10 * time.Second}, stream: &http.Client{}}
+}
+
+// SetTLSConfig makes the client connect to https:// registries with cfg
+func (r *HTTPRegistry) SetTLSConfig(cfg *tls.Config) {
+	r.client.Transport = &http.Transport{TLSClientConfig: cfg}
+	r.stream.Transport = &http.Transport{TLSClientConfig: cfg}
+}
+
+// Register implements Registry
+func (r *HTTPRegistry) Register(ctx context.Context, info WorkerInfo) error {
+	return r.register(ctx, info, "")
+}
+
+// RegisterLease implements Registry
+func (r *HTTPRegistry) RegisterLease(ctx context.Context, info WorkerInfo, ttl time.Duration) error {
+	return r.register(ctx, info, "?"+url.Values{"ttl": {ttl.String()}}.Encode())
+}
+
+// register sends info with the given query string
+func (r *HTTPRegistry) register(ctx context.Context, info WorkerInfo, query string) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = r.do(ctx, http.MethodPut, "/workers/"+url.PathEscape(info.ID)+query, body)
+	return err
+}
+
+// Renew implements Registry
+func (r *HTTPRegistry) Renew(ctx context.Context, id string, ttl time.Duration) error {
+	q := url.Values{"ttl": {ttl.String()}}
+	_, err := r.do(ctx, http.MethodPost, "/workers/"+url.PathEscape(id)+"/renew?"+q.Encode(), nil)
+	return err
+}
+
+// Deregister implements Registry
+func (r *HTTPRegistry) Deregister(ctx context.Context, id string) error {
+	_, err := r.do(ctx, http.MethodDelete, "/workers/"+url.PathEscape(id), nil)
+	return err
+}
+
+// Lookup implements Registry
+func (r *HTTPRegistry) Lookup(ctx context.Context, selector map[string]string) ([]WorkerInfo, error) {
+	q := url.Values{}
+	for k, v := range selector {
+		q.Add("label", k+"="+v)
+	}
+	path := "/workers"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	body, err := r.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var workers []WorkerInfo
+	if err := json.Unmarshal(body, &workers); err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
+
+// Watch implements Registry
+func (r *HTTPRegistry) Watch(ctx context.Context, selector map[string]string) (<-chan RegistryEvent, error) {
+	q := url.Values{}
+	for k, v := range selector {
+		q.Add("label", k+"="+v)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.base+"/watch?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.stream.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("registry: GET /watch: %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	events := make(chan RegistryEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev RegistryEvent
+			if dec.Decode(&ev) != nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// do sends one request and returns the response body of a 2xx reply
+func (r *HTTPRegistry) do(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, r.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodPost {
+		// Only renewals answer 404, with a message that already starts with
+		// the sentinel's text
+		return nil, fmt.Errorf("%w: %s", ErrNotRegistered, strings.TrimPrefix(strings.TrimSpace(string(b)), ErrNotRegistered.Error()+": "))
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("registry: %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
+
+// KeepRegistered renews the lease of info in r every third of ttl, the
+// worker's heartbeat to the registry, until ctx is cancelled, registering it
+// again if its lease ran out in the meantime. The caller registers info
+// first; failed renewals are retried on the next heartbeat
+func KeepRegistered(ctx context.Context, r Registry, info WorkerInfo, ttl time.Duration) error {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-ticker.C:
+		}
+		err := r.Renew(ctx, info.ID, ttl)
+		if errors.Is(err, ErrNotRegistered) {
+			r.RegisterLease(ctx, info, ttl)
+		}
+	}
+}
+
+// ParseLabels parses a comma-separated list of key=value pairs, such as the
+// labels of a worker or a registry selector
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for pair := range strings.SplitSeq(s, ",") {
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("label %q is not key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// ParsePeers parses a comma-separated list of id=address pairs
+func ParsePeers(s string) (map[uint64]string, error) {
+	pairs, err := ParseLabels(s)
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[uint64]string, len(pairs))
+	for k, addr := range pairs {
+		id, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: %w", k, err)
+		}
+		peers[id] = addr
+	}
+	return peers, nil
+}
+
+// Discover keeps the coordinator connected to the workers in r that match
+// selector. It watches r, dialing over t each worker as it is added and
+// disconnecting the workers it dialed once they are removed or their lease
+// expires, and every interval it also looks them up and dials each one it has
+// no connection to, which retries failed dials and a broken watch. It returns
+// once ctx is cancelled or the coordinator is closed
+func (c *Coordinator) Discover(ctx context.Context, r Registry, t Transport, selector map[string]string, interval time.Duration) error {
+	var mu sync.Mutex
+	sessions := make(map[string]bool)
+	connect := func(w WorkerInfo) {
+		c.mu.Lock()
+		_, connected := c.workers[w.ID]
+		c.mu.Unlock()
+		mu.Lock()
+		busy := connected || sessions[w.ID]
+		sessions[w.ID] = true
+		mu.Unlock()
+		if busy {
+			return
+		}
+		go func() {
+			defer func() {
+				mu.Lock()
+				delete(sessions, w.ID)
+				mu.Unlock()
+			}()
+			conn, err := t.Dial(ctx, w.Addr)
+			if err == nil {
+				c.handshake(conn)
+			}
+		}()
+	}
+	disconnect := func(ev RegistryEvent) {
+		mu.Lock()
+		dialed := sessions[ev.Worker.ID]
+		mu.Unlock()
+		c.mu.Lock()
+		w := c.workers[ev.Worker.ID]
+		c.mu.Unlock()
+		if dialed && w != nil {
+			c.drop(w, fmt.Errorf("%s from the registry", ev.Kind))
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var events <-chan RegistryEvent
+	for {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return ErrCoordinatorClosed
+		}
+		if events == nil {
+			events, _ = r.Watch(ctx, selector)
+		}
+		workers, _ := r.Lookup(ctx, selector)
+		for _, w := range workers {
+			connect(w)
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			case <-ticker.C:
+				break wait
+			case ev, ok := <-events:
+				switch {
+				case !ok:
+					events = nil
+				case ev.Kind == RegistryAdded || ev.Kind == RegistryUpdated:
+					connect(ev.Worker)
+				default:
+					disconnect(ev)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package taskqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SimEvent is one scheduling decision of a Sim: a task picked to run, or a
+// timer firing, such as a sleeper waking or a message arriving
+type SimEvent struct {
+	Seq uint64 `json:"seq"`
+	// At is the virtual time since the run started
+	At time.Duration `json:"at"`
+	// Kind is "run" or "timer"
+	Kind string `json:"kind"`
+	// What names the task run, or describes the timer, as in "deliver
+	// Prepare 3 from sim-client-2 to acceptor-1"
+	What string `json:"what"`
+}
+
+// String implements fmt.Stringer
+func (e SimEvent) String() string {
+	return fmt.Sprintf("#%-6d %10v  %-5s %s", e.Seq, e.At, e.Kind, e.What)
+}
+
+// Observe makes s call fn with every event of its run, from the scheduler
+// while every task is paused, so fn must not call s's methods; it may
+// block, to step through the run. Call it before Run
+func (s *Sim) Observe(fn func(SimEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer = fn
+}
+
+// emit reports an event to the observer; s.mu must be held
+func (s *Sim) emit(kind, what string) {
+	s.events++
+	if s.observer != nil {
+		s.observer(SimEvent{Seq: s.events, At: s.now.Sub(s.start), Kind: kind, What: what})
+	}
+}
+
+// SimTraceHeader is the first line of a trace: what was run, so a replay
+// can run it again
+type SimTraceHeader struct {
+	Scenario string `json:"scenario"`
+	Params   []int  `json:"params,omitempty"`
+	Seed     uint64 `json:"seed"`
+}
+
+// SimRecorder writes a trace of a Sim's run: a SimTraceHeader and then
+// every event, one JSON object per line
+type SimRecorder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error
+}
+
+// RecordSim writes header to w and records the run of s after it; s must
+// have been created with header.Seed. Call Flush once the run is over
+func RecordSim(s *Sim, w io.Writer, header SimTraceHeader) *SimRecorder {
+	bw := bufio.NewWriter(w)
+	r := &SimRecorder{w: bw, enc: json.NewEncoder(bw)}
+	r.err = r.enc.Encode(header)
+	s.Observe(func(e SimEvent) {
+		if r.err == nil {
+			r.err = r.enc.Encode(e)
+		}
+	})
+	return r
+}
+
+// Flush writes out what is buffered and returns the first error in writing
+// the trace
+func (r *SimRecorder) Flush() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.w.Flush()
+}
+
+// SimTrace is a recorded run
+type SimTrace struct {
+	Header SimTraceHeader
+	Events []SimEvent
+}
+
+// ReadSimTrace reads a trace written by a SimRecorder
+func ReadSimTrace(r io.Reader) (*SimTrace, error) {
+	dec := json.NewDecoder(r)
+	var t SimTrace
+	if err := dec.Decode(&t.Header); err != nil {
+		return nil, fmt.Errorf("sim trace: reading header: %w", err)
+	}
+	for {
+		var e SimEvent
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return &t, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sim trace: reading event %d: %w", len(t.Events)+1, err)
+		}
+		t.Events = append(t.Events, e)
+	}
+}
+
+// SimReplay checks a Sim's run against a trace, event by event
+type SimReplay struct {
+	sim   *Sim
+	trace *SimTrace
+	next  int
+}
+
+// ReplaySim replays trace on s, which must be set up like the recorded run
+// and created with the trace's seed. Since a run depends on nothing but its
+// seed, running s again takes the recorded path; each event is checked
+// against the trace, and the run fails with ErrReplayDiverged at the first
+// that differs, which means the code under simulation changed or depends on
+// something outside the Sim. step, if set, is called with every event before
+// it happens and may block, to go through the run one event at a time
+func ReplaySim(s *Sim, trace *SimTrace, step func(SimEvent)) *SimReplay {
+	r := &SimReplay{sim: s, trace: trace}
+	s.Observe(func(e SimEvent) {
+		if step != nil {
+			step(e)
+		}
+		if r.next >= len(trace.Events) {
+			s.fail(fmt.Errorf("%w: event %v was never recorded", ErrReplayDiverged, e))
+			return
+		}
+		if want := trace.Events[r.next]; want != e {
+			s.fail(fmt.Errorf("%w at event %d: recorded %v, replayed %v", ErrReplayDiverged, e.Seq, want, e))
+			return
+		}
+		r.next++
+	})
+	return r
+}
+
+// Finish reports whether the replay went through every recorded event;
+// call it once Run has returned
+func (r *SimReplay) Finish() error {
+	if r.next < len(r.trace.Events) {
+		return fmt.Errorf("%w: the run ended after %d of %d recorded events, before %v",
+			ErrReplayDiverged, r.next, len(r.trace.Events), r.trace.Events[r.next])
+	}
+	return nil
+}
+
+// fail makes Run return err unless it already failed; s.mu must be held
+func (s *Sim) fail(err error) {
+	if s.failure == nil {
+		s.failure = err
+	}
+}
+
+// SimScenario is a simulation that can be recorded and replayed: it runs
+// on s with the parameters of its trace header, writing its progress to w
+type SimScenario func(w io.Writer, s *Sim, params []int) error
+
+// RunSimScenario runs scenario on a new Sim seeded as header says,
+// recording its events to trace under header if that is set
+func RunSimScenario(w io.Writer, scenario SimScenario, header SimTraceHeader, trace io.Writer) error {
+	s := NewSim(header.Seed)
+	if trace == nil {
+		return scenario(w, s, header.Params)
+	}
+	r := RecordSim(s, trace, header)
+	err := scenario(w, s, header.Params)
+	if ferr := r.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// ReplaySimTrace runs scenario, the one trace recorded, again, checking that
+// it takes the same path, with step called before every event if it is set
+func ReplaySimTrace(w io.Writer, scenario SimScenario, trace *SimTrace, step func(SimEvent)) error {
+	s := NewSim(trace.Header.Seed)
+	r := ReplaySim(s, trace, step)
+	if err := scenario(w, s, trace.Header.Params); err != nil {
+		return err
+	}
+	return r.Finish()
+}
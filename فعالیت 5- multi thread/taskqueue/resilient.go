@@ -0,0 +1,234 @@
+package taskqueue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retryBudgetWindow is how far back a RetryBudget counts requests and
+// retries, in seconds
+const retryBudgetWindow = 10
+
+// retryBudgetSlot counts the requests and retries of one second
+type retryBudgetSlot struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// RetryBudget caps retries to a fraction of the requests they retry, so that
+// a failing dependency sees at most that much extra load instead of every
+// client multiplying its traffic by the number of attempts. A small floor of
+// retries per second keeps rarely used clients able to retry. It is safe for
+// concurrent use and may be shared between clients of the same dependency
+type RetryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu    sync.Mutex
+	slots [retryBudgetWindow]retryBudgetSlot
+}
+
+// NewRetryBudget creates a budget allowing ratio retries per request, plus
+// minPerSecond retries per second, over the last 10 seconds
+func NewRetryBudget(ratio float64, minPerSecond int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, minPerSecond: minPerSecond}
+}
+
+// Request records a request that may later be retried
+func (b *RetryBudget) Request() {
+	b.mu.Lock()
+	b.slot(time.Now()).requests++
+	b.mu.Unlock()
+}
+
+// Retry reports whether the budget has room for one more retry, and records
+// it if so
+func (b *RetryBudget) Retry() bool {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var requests, retries int
+	for _, s := range b.slots {
+		if now.Unix()-s.second < retryBudgetWindow {
+			requests += s.requests
+			retries += s.retries
+		}
+	}
+	if float64(retries) >= b.ratio*float64(requests)+float64(b.minPerSecond*retryBudgetWindow) {
+		return false
+	}
+	b.slot(now).retries++
+	return true
+}
+
+// slot returns the slot counting the second of now, clearing it if it last
+// counted an earlier one; b.mu must be held
+func (b *RetryBudget) slot(now time.Time) *retryBudgetSlot {
+	second := now.Unix()
+	s := &b.slots[second%retryBudgetWindow]
+	if s.second != second {
+		*s = retryBudgetSlot{second: second}
+	}
+	return s
+}
+
+// ResilientConfig configures a ResilientClient
+type ResilientConfig struct {
+	// Retry says which failed calls are attempted again and after how long;
+	// MaxAttempts defaults to 3
+	Retry RetryPolicy
+	// Budget caps the retries and hedges; defaults to 10% of calls plus 1
+	// per second
+	Budget *RetryBudget
+	// HedgeAfter, if positive, is how long an attempt may run before a
+	// hedged copy of it is submitted; the first copy to succeed wins and the
+	// others are cancelled. Set it to about the latency percentile past which
+	// waiting costs more than the duplicate work, such as the 95th
+	HedgeAfter time.Duration
+	// MaxHedges is how many copies of an attempt may run besides the
+	// original, each started HedgeAfter after the previous one; defaults to 1
+	MaxHedges int
+}
+
+// ResilientStats counts what a ResilientClient did
+type ResilientStats struct {
+	Calls uint64
+	// Retries counts the attempts made after a failed one
+	Retries uint64
+	// Hedges counts the hedged copies submitted, and HedgeWins those that
+	// succeeded before the attempt they copied
+	Hedges, HedgeWins uint64
+	// Exhausted counts the retries and hedges skipped because the budget had
+	// no room for them
+	Exhausted uint64
+}
+
+// ResilientClient runs tasks through a submit function such as
+// Coordinator.Submit, retrying failed attempts within a retry budget and
+// hedging slow ones. Hedging suits idempotent, latency-sensitive tasks
+// served by replicated workers: a hedged copy is queued like any task, so it
+// runs on a worker that has a free slot, which with single-slot workers is
+// never the one still running the original
+type ResilientClient struct {
+	submit func(ctx context.Context, task string, payload []byte) *Future
+	cfg    ResilientConfig
+
+	calls, retries, hedges, hedgeWins, exhausted atomic.Uint64
+}
+
+// NewResilientClient creates a client submitting tasks with submit, whose
+// futures must hold a []byte
+func NewResilientClient(submit func(ctx context.Context, task string, payload []byte) *Future, cfg ResilientConfig) *ResilientClient {
+	if cfg.Retry.MaxAttempts <= 0 {
+		cfg.Retry.MaxAttempts = 3
+	}
+	if cfg.Budget == nil {
+		cfg.Budget = NewRetryBudget(0.1, 1)
+	}
+	if cfg.MaxHedges <= 0 {
+		cfg.MaxHedges = 1
+	}
+	return &ResilientClient{submit: submit, cfg: cfg}
+}
+
+// Call runs the named task with payload and returns its output. A failed
+// attempt is retried while the retry policy allows it and the budget has
+// room, failing with ErrRetryBudgetExhausted once it has none
+func (c *ResilientClient) Call(ctx context.Context, task string, payload []byte) ([]byte, error) {
+	c.calls.Add(1)
+	c.cfg.Budget.Request()
+	for attempt := 1; ; attempt++ {
+		out, err := c.attempt(ctx, task, payload)
+		if err == nil {
+			return out, nil
+		}
+		if ctx.Err() != nil || !c.cfg.Retry.ShouldRetry(attempt, err) {
+			return nil, err
+		}
+		if !c.cfg.Budget.Retry() {
+			c.exhausted.Add(1)
+			return nil, fmt.Errorf("%w after %d attempts: %w", ErrRetryBudgetExhausted, attempt, err)
+		}
+		c.retries.Add(1)
+		select {
+		case <-time.After(c.cfg.Retry.Backoff(attempt)):
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// hedgeResult is the outcome of one copy of an attempt
+type hedgeResult struct {
+	out   []byte
+	err   error
+	hedge bool
+}
+
+// attempt runs the task once, hedged with further copies while it is slow,
+// and returns the first success, or the last failure once every copy failed
+func (c *ResilientClient) attempt(ctx context.Context, task string, payload []byte) ([]byte, error) {
+	// Cancelling the copies still running once one wins frees their workers
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 1+c.cfg.MaxHedges)
+	start := func(hedge bool) {
+		f := c.submit(ctx, task, payload)
+		go func() {
+			out, err := awaitBytes(f)
+			results <- hedgeResult{out, err, hedge}
+		}()
+	}
+	start(false)
+	running, hedges := 1, 0
+
+	var hedgeAfter <-chan time.Time
+	if c.cfg.HedgeAfter > 0 {
+		timer := time.NewTimer(c.cfg.HedgeAfter)
+		defer timer.Stop()
+		hedgeAfter = timer.C
+	}
+	for {
+		select {
+		case <-hedgeAfter:
+			hedgeAfter = nil
+			if !c.cfg.Budget.Retry() {
+				c.exhausted.Add(1)
+				continue
+			}
+			c.hedges.Add(1)
+			start(true)
+			running++
+			if hedges++; hedges < c.cfg.MaxHedges {
+				hedgeAfter = time.After(c.cfg.HedgeAfter)
+			}
+		case r := <-results:
+			running--
+			if r.err == nil {
+				if r.hedge {
+					c.hedgeWins.Add(1)
+				}
+				return r.out, nil
+			}
+			if running == 0 {
+				return nil, r.err
+			}
+		}
+	}
+}
+
+// Stats returns the client's counters
+func (c *ResilientClient) Stats() ResilientStats {
+	return ResilientStats{
+		Calls:     c.calls.Load(),
+		Retries:   c.retries.Load(),
+		Hedges:    c.hedges.Load(),
+		HedgeWins: c.hedgeWins.Load(),
+		Exhausted: c.exhausted.Load(),
+	}
+}
@@ -0,0 +1,46 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy describes how failed tasks are re-queued
+type RetryPolicy struct {
+	// MaxAttempts is the total number of runs, including the first one
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry; it doubles per attempt
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff; zero means no cap
+	MaxDelay time.Duration
+	// Jitter randomizes each delay by up to this fraction in either direction
+	Jitter float64
+	// Retryable decides whether err is worth retrying; nil retries every error
+	Retryable func(err error) bool
+}
+
+// ShouldRetry reports whether a task that failed with err on its given
+// attempt may run again
+func (r *RetryPolicy) ShouldRetry(attempt int, err error) bool {
+	if attempt >= r.MaxAttempts {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrPoolShutdown) {
+		return false
+	}
+	return r.Retryable == nil || r.Retryable(err)
+}
+
+// Backoff returns the delay before the run following attempt
+func (r *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := r.BaseDelay << min(attempt-1, 30)
+	if r.MaxDelay > 0 && (delay > r.MaxDelay || delay < 0) {
+		delay = r.MaxDelay
+	}
+	if r.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + r.Jitter*(2*rand.Float64()-1)))
+	}
+	return max(delay, 0)
+}
@@ -0,0 +1,499 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"multithread/internal/wire"
+)
+
+// Codec encodes the arguments and results of RPC calls
+type Codec interface {
+	// Name identifies the codec on the wire
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(b []byte, v any) error
+}
+
+// JSONCodec encodes values as JSON
+type JSONCodec struct{}
+
+// Name implements Codec
+func (JSONCodec) Name() string { return "json" }
+
+// Marshal implements Codec
+func (JSONCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal implements Codec
+func (JSONCodec) Unmarshal(b []byte, v any) error { return json.Unmarshal(b, v) }
+
+// BinaryCodec passes []byte through unchanged and otherwise uses the
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler methods of the
+// values, such as those of Message and clocks.HLCTimestamp
+type BinaryCodec struct{}
+
+// Name implements Codec
+func (BinaryCodec) Name() string { return "binary" }
+
+// Marshal implements Codec
+func (BinaryCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case *[]byte:
+		return *v, nil
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	default:
+		return nil, fmt.Errorf("binary codec: %T is not a BinaryMarshaler", v)
+	}
+}
+
+// Unmarshal implements Codec
+func (BinaryCodec) Unmarshal(b []byte, v any) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = b
+		return nil
+	case encoding.BinaryUnmarshaler:
+		return v.UnmarshalBinary(b)
+	default:
+		return fmt.Errorf("binary codec: %T is not a BinaryUnmarshaler", v)
+	}
+}
+
+// GobCodec encodes values with encoding/gob, which handles most Go types
+// without methods for it but is only read by Go peers
+type GobCodec struct{}
+
+// Name implements Codec
+func (GobCodec) Name() string { return "gob" }
+
+// Marshal implements Codec
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec
+func (GobCodec) Unmarshal(b []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// RPCCode classifies the outcome of an RPC call
+type RPCCode int
+
+const (
+	// RPCOK is a call that returned a result
+	RPCOK RPCCode = iota
+	// RPCFailed is a call whose method returned an error
+	RPCFailed
+	// RPCUnknownMethod is a call to a method the server does not have
+	RPCUnknownMethod
+	// RPCBadRequest is a call whose arguments or codec the server could not
+	// decode
+	RPCBadRequest
+	// RPCDeadlineExceeded is a call that ran past its deadline
+	RPCDeadlineExceeded
+	// RPCCanceled is a call the client cancelled
+	RPCCanceled
+)
+
+// String returns the code name
+func (c RPCCode) String() string {
+	switch c {
+	case RPCOK:
+		return "ok"
+	case RPCFailed:
+		return "failed"
+	case RPCUnknownMethod:
+		return "unknown method"
+	case RPCBadRequest:
+		return "bad request"
+	case RPCDeadlineExceeded:
+		return "deadline exceeded"
+	case RPCCanceled:
+		return "canceled"
+	default:
+		return fmt.Sprintf("RPCCode(%d)", int(c))
+	}
+}
+
+// RPCError is the error of a call that did not return a result. It unwraps
+// to ErrUnknownMethod, context.DeadlineExceeded or context.Canceled for the
+// matching codes
+type RPCError struct {
+	Method  string
+	Code    RPCCode
+	Message string
+}
+
+// Error implements the error interface
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc %s: %s: %s", e.Method, e.Code, e.Message)
+}
+
+// Unwrap returns the sentinel error matching the code, if any
+func (e *RPCError) Unwrap() error {
+	switch e.Code {
+	case RPCUnknownMethod:
+		return ErrUnknownMethod
+	case RPCDeadlineExceeded:
+		return context.DeadlineExceeded
+	case RPCCanceled:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+// rpcCall is the payload of a MsgCall: the codec name as uvarint-prefixed
+// bytes, the deadline in Unix nanoseconds as a uvarint, 0 for none, and then
+// the encoded arguments
+type rpcCall struct {
+	Codec    string
+	Deadline time.Time
+	Body     []byte
+}
+
+// marshal encodes the call
+func (c *rpcCall) marshal() []byte {
+	b := wire.AppendBytes(nil, []byte(c.Codec))
+	var deadline uint64
+	if !c.Deadline.IsZero() {
+		deadline = uint64(c.Deadline.UnixNano())
+	}
+	b = binary.AppendUvarint(b, deadline)
+	return append(b, c.Body...)
+}
+
+// unmarshal decodes a call encoded by marshal
+func (c *rpcCall) unmarshal(b []byte) error {
+	r := wire.Reader{B: b}
+	c.Codec = string(r.Bytes())
+	if deadline := r.Uvarint(); deadline != 0 {
+		c.Deadline = time.Unix(0, int64(deadline))
+	}
+	c.Body = r.B
+	return r.Err
+}
+
+// rpcMethod decodes the arguments of a call, runs it and encodes its result
+type rpcMethod func(ctx context.Context, codec Codec, args []byte) ([]byte, RPCCode, error)
+
+// RPCServer dispatches the calls of RPCClients to the methods registered
+// with HandleRPC. Requests carry an ID, so one connection multiplexes any
+// number of concurrent calls, the name of the codec their arguments are in,
+// so one server serves clients using any of its codecs, and the caller's
+// deadline, which bounds the method's context. It works over any Transport
+type RPCServer struct {
+	mu      sync.Mutex
+	methods map[string]rpcMethod
+	codecs  map[string]Codec
+}
+
+// NewRPCServer creates a server accepting calls in the given codecs, or in
+// JSON, binary, gob and MessagePack if none are given
+func NewRPCServer(codecs ...Codec) *RPCServer {
+	if len(codecs) == 0 {
+		codecs = []Codec{JSONCodec{}, BinaryCodec{}, GobCodec{}, MsgpackCodec{}}
+	}
+	s := &RPCServer{methods: make(map[string]rpcMethod), codecs: make(map[string]Codec)}
+	for _, c := range codecs {
+		s.codecs[c.Name()] = c
+	}
+	return s
+}
+
+// HandleRPC registers fn as the method named method of s, conventionally
+// "Service.Method". Arguments are decoded into a new Req, so with
+// BinaryCodec *Req must be a BinaryUnmarshaler, and with MsgpackCodec a
+// MsgpackUnmarshaler unless Req is one of the basic types it handles
+func HandleRPC[Req, Resp any](s *RPCServer, method string, fn func(ctx context.Context, req Req) (Resp, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[method] = func(ctx context.Context, codec Codec, args []byte) ([]byte, RPCCode, error) {
+		var req Req
+		if err := codec.Unmarshal(args, &req); err != nil {
+			return nil, RPCBadRequest, err
+		}
+		resp, err := fn(ctx, req)
+		if err != nil {
+			return nil, RPCFailed, err
+		}
+		out, err := codec.Marshal(resp)
+		if err != nil {
+			return nil, RPCFailed, err
+		}
+		return out, RPCOK, nil
+	}
+}
+
+// Methods returns the names of the registered methods, sorted
+func (s *RPCServer) Methods() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.methods))
+	for name := range s.methods {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Serve accepts connections on l and serves each until ctx is cancelled or
+// l fails
+func (s *RPCServer) Serve(ctx context.Context, l Listener) error {
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+		go s.ServeConn(ctx, conn)
+	}
+}
+
+// ServeConn serves the calls on conn until it fails or ctx is cancelled,
+// running each in a goroutine of its own; the calls still running are
+// cancelled when it returns
+func (s *RPCServer) ServeConn(ctx context.Context, conn Conn) error {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var mu sync.Mutex
+	running := make(map[uint64]context.CancelFunc)
+	for {
+		m, err := conn.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+		switch m.Type {
+		case MsgCall:
+			callCtx, cancelCall := context.WithCancel(ctx)
+			if peer, ok := PeerOf(conn); ok {
+				callCtx = context.WithValue(callCtx, peerKey{}, peer)
+			}
+			mu.Lock()
+			running[m.ID] = cancelCall
+			mu.Unlock()
+			go func() {
+				reply := s.call(callCtx, m)
+				mu.Lock()
+				delete(running, m.ID)
+				mu.Unlock()
+				cancelCall()
+				conn.Send(reply)
+			}()
+		case MsgCancel:
+			mu.Lock()
+			cancelCall, ok := running[m.ID]
+			mu.Unlock()
+			if ok {
+				cancelCall()
+			}
+		}
+	}
+}
+
+// call runs the call in m and returns its reply
+func (s *RPCServer) call(ctx context.Context, m *Message) *Message {
+	reply := &Message{Type: MsgReply, ID: m.ID, Task: m.Task}
+	fail := func(code RPCCode, err error) *Message {
+		reply.Payload = binary.AppendUvarint(nil, uint64(code))
+		reply.Error = err.Error()
+		return reply
+	}
+
+	var req rpcCall
+	if err := req.unmarshal(m.Payload); err != nil {
+		return fail(RPCBadRequest, err)
+	}
+	s.mu.Lock()
+	method, ok := s.methods[m.Task]
+	codec, known := s.codecs[req.Codec]
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		return fail(RPCUnknownMethod, fmt.Errorf("no method %q", m.Task))
+	case !known:
+		return fail(RPCBadRequest, fmt.Errorf("unsupported codec %q", req.Codec))
+	}
+	if !req.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, req.Deadline)
+		defer cancel()
+	}
+
+	out, code, err := method(ctx, codec, req.Body)
+	if err != nil {
+		switch {
+		case code != RPCFailed:
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			code = RPCDeadlineExceeded
+		case ctx.Err() != nil:
+			code = RPCCanceled
+		}
+		return fail(code, err)
+	}
+	reply.Payload = append(binary.AppendUvarint(nil, uint64(RPCOK)), out...)
+	return reply
+}
+
+// RPCClient calls the methods of an RPCServer at one address, multiplexing
+// concurrent calls over a single connection that it dials on first use and
+// again after a failure. It is safe for concurrent use
+type RPCClient struct {
+	transport Transport
+	addr      string
+	codec     Codec
+
+	mu      sync.Mutex
+	conn    Conn
+	pending map[uint64]chan *Message
+	nextID  uint64
+	closed  bool
+}
+
+// NewRPCClient creates a client of the server at addr encoding calls with
+// codec
+func NewRPCClient(t Transport, addr string, codec Codec) *RPCClient {
+	return &RPCClient{transport: t, addr: addr, codec: codec, pending: make(map[uint64]chan *Message)}
+}
+
+// Call calls method with args and decodes its result into reply, a pointer.
+// The deadline of ctx travels with the call; cancelling ctx abandons the
+// call and asks the server to cancel it
+func (c *RPCClient) Call(ctx context.Context, method string, args, reply any) error {
+	body, err := c.codec.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req := rpcCall{Codec: c.codec.Name(), Body: body}
+	req.Deadline, _ = ctx.Deadline()
+
+	conn, id, replies, err := c.start(ctx)
+	if err != nil {
+		return err
+	}
+	if err := conn.Send(&Message{Type: MsgCall, ID: id, Task: method, Payload: req.marshal()}); err != nil {
+		c.fail(conn)
+		return err
+	}
+
+	var m *Message
+	select {
+	case m = <-replies:
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		conn.Send(&Message{Type: MsgCancel, ID: id})
+		return context.Cause(ctx)
+	}
+	if m == nil {
+		return fmt.Errorf("rpc %s: connection to %s lost", method, c.addr)
+	}
+	r := wire.Reader{B: m.Payload}
+	code := RPCCode(r.Uvarint())
+	if r.Err != nil {
+		return r.Err
+	}
+	if code != RPCOK {
+		return &RPCError{Method: method, Code: code, Message: m.Error}
+	}
+	return c.codec.Unmarshal(r.B, reply)
+}
+
+// start returns the connection, dialing it if needed, and the ID and reply
+// channel of a new call
+func (c *RPCClient) start(ctx context.Context) (Conn, uint64, chan *Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, 0, nil, fmt.Errorf("rpc: client of %s is closed", c.addr)
+	}
+	if c.conn == nil {
+		conn, err := c.transport.Dial(ctx, c.addr)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		c.conn = conn
+		go c.receive(conn)
+	}
+	c.nextID++
+	replies := make(chan *Message, 1)
+	c.pending[c.nextID] = replies
+	return c.conn, c.nextID, replies, nil
+}
+
+// receive hands the replies on conn to their calls until it fails
+func (c *RPCClient) receive(conn Conn) {
+	for {
+		m, err := conn.Recv()
+		if err != nil {
+			c.fail(conn)
+			return
+		}
+		if m.Type != MsgReply {
+			continue
+		}
+		c.mu.Lock()
+		replies, ok := c.pending[m.ID]
+		delete(c.pending, m.ID)
+		c.mu.Unlock()
+		if ok {
+			replies <- m
+		}
+	}
+}
+
+// fail closes conn after it broke and ends the calls waiting on it, unless
+// the client already moved on to another connection
+func (c *RPCClient) fail(conn Conn) {
+	conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		return
+	}
+	c.conn = nil
+	for id, replies := range c.pending {
+		close(replies)
+		delete(c.pending, id)
+	}
+}
+
+// Close closes the connection, failing the calls in progress
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.fail(conn)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package taskqueue
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Scenario is a failure script for a simulated cluster: steps at points of
+// virtual time that partition and heal a SimNetwork, crash and restart its
+// hosts and check what must hold, written as a chain such as
+//
+//	NewScenario(sim, network).
+//		Node("n1", startN1).Node("n2", startN2).Node("n3", startN3).
+//		At(2*time.Second).Partition("n1", "n2").
+//		At(5*time.Second).KillNode("n3").Heal().
+//		At(8*time.Second).RestartNode("n3").
+//		At(10*time.Second).Check("one leader", oneLeader).
+//		Run(time.Minute)
+//
+// Steps at the same time happen in the order they were written, and the run
+// ends after the last one
+type Scenario struct {
+	sim     *Sim
+	network *SimNetwork
+	log     io.Writer
+
+	hosts []string
+	nodes map[string]func(life int)
+	lives map[string]int
+	at    time.Duration
+	steps []scenarioStep
+	err   error
+}
+
+// scenarioStep is one action of a Scenario
+type scenarioStep struct {
+	at   time.Duration
+	what string
+	do   func() error
+}
+
+// NewScenario creates an empty script for hosts of network on sim
+func NewScenario(sim *Sim, network *SimNetwork) *Scenario {
+	return &Scenario{sim: sim, network: network, nodes: make(map[string]func(int)), lives: make(map[string]int)}
+}
+
+// Log makes the scenario write every step to w as it happens
+func (sc *Scenario) Log(w io.Writer) *Scenario {
+	sc.log = w
+	return sc
+}
+
+// Node declares host, which Run starts by calling start on a task of the
+// host, and RestartNode again after a crash, with the number of times it
+// has been restarted. start should set the host's tasks going with Sim.Go
+// and reach the network through network.Host(host). What a node keeps
+// across restarts, start decides: state it does not recreate survives, as
+// on disk
+func (sc *Scenario) Node(host string, start func(life int)) *Scenario {
+	if _, ok := sc.nodes[host]; !ok {
+		sc.hosts = append(sc.hosts, host)
+	}
+	sc.nodes[host] = start
+	return sc
+}
+
+// At makes the steps that follow happen d after the run starts
+func (sc *Scenario) At(d time.Duration) *Scenario {
+	sc.at = d
+	return sc
+}
+
+// After makes the steps that follow happen d after the ones before
+func (sc *Scenario) After(d time.Duration) *Scenario {
+	sc.at += d
+	return sc
+}
+
+// step appends an action at the current time
+func (sc *Scenario) step(what string, do func() error) *Scenario {
+	sc.steps = append(sc.steps, scenarioStep{at: sc.at, what: what, do: do})
+	return sc
+}
+
+// Partition cuts hosts off from the others; they still reach each other
+func (sc *Scenario) Partition(hosts ...string) *Scenario {
+	return sc.step(fmt.Sprintf("partition %v from the rest", hosts), func() error {
+		sc.network.Partition(hosts)
+		return nil
+	})
+}
+
+// Split divides the network into groups that only reach within themselves;
+// hosts in none of them form one more group
+func (sc *Scenario) Split(groups ...[]string) *Scenario {
+	return sc.step(fmt.Sprintf("split into %v", groups), func() error {
+		sc.network.Partition(groups...)
+		return nil
+	})
+}
+
+// Heal undoes Partition and Split; crashed hosts stay down
+func (sc *Scenario) Heal() *Scenario {
+	return sc.step("heal the network", func() error {
+		sc.network.Heal()
+		return nil
+	})
+}
+
+// KillNode crashes host: its tasks stop for good wherever they are, its
+// listeners close and its messages are lost
+func (sc *Scenario) KillNode(host string) *Scenario {
+	return sc.step("kill "+host, func() error {
+		if _, ok := sc.nodes[host]; !ok {
+			return fmt.Errorf("no node %q", host)
+		}
+		sc.sim.Kill(host)
+		sc.network.Crash(host)
+		return nil
+	})
+}
+
+// RestartNode brings a killed host back and starts it again
+func (sc *Scenario) RestartNode(host string) *Scenario {
+	return sc.step("restart "+host, func() error {
+		start, ok := sc.nodes[host]
+		if !ok {
+			return fmt.Errorf("no node %q", host)
+		}
+		sc.network.Restore(host)
+		sc.lives[host]++
+		life := sc.lives[host]
+		sc.sim.GoOn(host, host, func() { start(life) })
+		return nil
+	})
+}
+
+// Do runs fn as a step described by what
+func (sc *Scenario) Do(what string, fn func()) *Scenario {
+	return sc.step(what, func() error {
+		fn()
+		return nil
+	})
+}
+
+// Check fails the run with the error of fn, if it returns one
+func (sc *Scenario) Check(what string, fn func() error) *Scenario {
+	return sc.step("check "+what, fn)
+}
+
+// Run starts every node and runs the simulation through the script, for at
+// most limit of virtual time. It returns the first failed step or the
+// error of Sim.Run
+func (sc *Scenario) Run(limit time.Duration) error {
+	for _, host := range sc.hosts {
+		start := sc.nodes[host]
+		sc.sim.GoOn(host, host, func() { start(0) })
+	}
+	steps := sc.steps
+	sc.sim.Go("scenario", func() {
+		for _, st := range steps {
+			if wait := st.at - sc.sim.Elapsed(); wait > 0 {
+				sc.sim.Sleep(wait)
+			}
+			err := st.do()
+			if sc.log != nil {
+				result := "--"
+				if err != nil {
+					result = "FAIL"
+				} else if strings.HasPrefix(st.what, "check ") {
+					result = "ok"
+				}
+				fmt.Fprintf(sc.log, "%10v  %-4s %s\n", sc.sim.Elapsed(), result, st.what)
+			}
+			if err != nil {
+				sc.err = fmt.Errorf("scenario: %s at %v: %w", st.what, sc.sim.Elapsed(), err)
+				break
+			}
+		}
+		sc.sim.Stop()
+	})
+	if err := sc.sim.Run(limit); err != nil {
+		return err
+	}
+	return sc.err
+}
@@ -0,0 +1,119 @@
+package taskqueue
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// semaphore is a resizable weighted semaphore that admits waiters in FIFO order
+type semaphore struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	waiters list.List
+}
+
+// semaphoreWaiter is a blocked acquire call
+type semaphoreWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// newSemaphore creates a semaphore admitting up to limit units at once
+func newSemaphore(limit int64) *semaphore {
+	return &semaphore{limit: limit}
+}
+
+// acquire blocks until n units are available or ctx is done
+func (s *semaphore) acquire(ctx context.Context, n int64) error {
+	s.mu.Lock()
+	if s.used+n <= s.limit && s.waiters.Len() == 0 {
+		s.used += n
+		s.mu.Unlock()
+		return nil
+	}
+
+	w := &semaphoreWaiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// Acquired just as ctx was cancelled; give the units back
+			s.used -= n
+			s.checkUsed()
+			s.notify()
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			if isFront {
+				s.notify()
+			}
+		}
+		s.mu.Unlock()
+		return context.Cause(ctx)
+	}
+}
+
+// release returns n units to the semaphore
+func (s *semaphore) release(n int64) {
+	s.mu.Lock()
+	s.used -= n
+	s.checkUsed()
+	s.notify()
+	s.mu.Unlock()
+}
+
+// checkUsed asserts that no more units were released than acquired; s.mu
+// must be held
+func (s *semaphore) checkUsed() {
+	if invariantChecks && s.used < 0 {
+		violated("a semaphore never releases more than was acquired", "%d units in use of %d", s.used, s.limit)
+	}
+}
+
+// resize changes the number of units the semaphore admits; units already in
+// use are not revoked when shrinking
+func (s *semaphore) resize(limit int64) {
+	s.mu.Lock()
+	s.limit = limit
+	s.notify()
+	s.mu.Unlock()
+}
+
+// size returns the current limit
+func (s *semaphore) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
+
+// waiting returns the number of blocked acquire calls
+func (s *semaphore) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters.Len()
+}
+
+// notify wakes waiters from the front of the queue while they fit; s.mu must be held
+func (s *semaphore) notify() {
+	for {
+		front := s.waiters.Front()
+		if front == nil {
+			return
+		}
+		w := front.Value.(*semaphoreWaiter)
+		if s.used+w.n > s.limit {
+			return
+		}
+		s.used += w.n
+		s.waiters.Remove(front)
+		close(w.ready)
+	}
+}
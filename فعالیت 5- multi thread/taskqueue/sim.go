@@ -0,0 +1,718 @@
+package taskqueue
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sim runs simulated goroutines, called tasks, one at a time on a virtual
+// clock. Which ready task runs next is picked by a random source seeded at
+// creation, the clock only moves when every task is blocked, jumping to the
+// next timer, and messages on a SimNetwork arrive after seeded delays, so a
+// run is a function of its seed: a schedule that breaks an invariant can
+// be replayed exactly by running the same seed again.
+//
+// Code under simulation must block only through the Sim, using Sleep,
+// SimQueue and SimNetwork rather than channels, sync.Cond or time, must draw
+// randomness from the Sim, and must not depend on map iteration order.
+// Mutexes are fine as long as they are not held across a blocking call
+type Sim struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	start   time.Time
+	now     time.Time
+	ready   []*simTask
+	timers  timerHeap
+	seq     uint64
+	tasks   uint64
+	live    map[*simTask]bool
+	current *simTask
+	parked  chan struct{}
+	steps   uint64
+	trace   hash.Hash64
+	stopped bool
+	failure error
+	// observer and events report each scheduling decision, see Observe
+	observer func(SimEvent)
+	events   uint64
+	// lives counts the times each host was killed; tasks of an earlier
+	// life are dead
+	lives map[string]uint64
+}
+
+// simTask is a goroutine run by a Sim; it runs only while it holds wake's
+// token and hands control back by signalling parked. It belongs to host,
+// if one is named, in the host's life at the time it was started
+type simTask struct {
+	id   uint64
+	name string
+	wake chan struct{}
+	host string
+	life uint64
+}
+
+// simEpoch is the time a Sim's clock starts at, so that runs print the same
+// times whenever they happen
+var simEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// NewSim creates a simulation whose every choice is drawn from seed
+func NewSim(seed uint64) *Sim {
+	return &Sim{
+		rng:    rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)),
+		start:  simEpoch,
+		now:    simEpoch,
+		live:   make(map[*simTask]bool),
+		parked: make(chan struct{}),
+		trace:  fnv.New64a(),
+		lives:  make(map[string]uint64),
+	}
+}
+
+// Go starts fn as a task named name; it may be called before Run or from
+// a task, whose host the new task belongs to
+func (s *Sim) Go(name string, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host := ""
+	if s.current != nil {
+		host = s.current.host
+	}
+	s.spawn(host, name, fn)
+}
+
+// GoOn starts fn as a task named name on host, so that it and the tasks it
+// starts die when Kill is called for the host
+func (s *Sim) GoOn(host, name string, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spawn(host, name, fn)
+}
+
+// Kill crashes host: its tasks never run again, wherever they are blocked,
+// as though the machine had stopped. Tasks started on the host afterwards
+// live on, as a restarted process does. It must not be called from a task
+// of the host itself
+func (s *Sim) Kill(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lives[host]++
+	for t := range s.live {
+		if t.host == host {
+			delete(s.live, t)
+		}
+	}
+}
+
+// dead reports whether t's host was killed after it started; s.mu must be
+// held
+func (s *Sim) dead(t *simTask) bool {
+	return t.host != "" && t.life != s.lives[t.host]
+}
+
+// spawn makes a task on host ready to run fn; s.mu must be held
+func (s *Sim) spawn(host, name string, fn func()) {
+	s.tasks++
+	t := &simTask{id: s.tasks, name: name, wake: make(chan struct{}), host: host, life: s.lives[host]}
+	s.live[t] = true
+	s.ready = append(s.ready, t)
+	go func() {
+		<-t.wake
+		defer func() {
+			r := recover()
+			s.mu.Lock()
+			if r != nil && s.failure == nil {
+				s.failure = fmt.Errorf("sim: task %q panicked at %v: %v", t.name, s.now.Sub(s.start), r)
+			}
+			delete(s.live, t)
+			s.current = nil
+			s.mu.Unlock()
+			s.parked <- struct{}{}
+		}()
+		fn()
+	}()
+}
+
+// Run runs tasks until all have returned, until Stop is called, until the
+// clock would pass limit, or until every task is blocked with no timer left
+// to wake one, in which case it returns ErrSimDeadlock. If a task panics,
+// Run returns the panic as an error. Tasks still blocked when Run returns
+// stay parked for good, so a Sim is meant for a single run
+func (s *Sim) Run(limit time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.failure == nil && !s.stopped {
+		if len(s.ready) == 0 {
+			if len(s.timers) == 0 {
+				if len(s.live) == 0 {
+					return nil
+				}
+				return fmt.Errorf("%w: %s at %v", ErrSimDeadlock, s.blocked(), s.now.Sub(s.start))
+			}
+			next := heap.Pop(&s.timers).(*timerEntry)
+			if next.at.Sub(s.start) > limit {
+				heap.Push(&s.timers, next)
+				return nil
+			}
+			s.now = next.at
+			s.emit("timer", next.what)
+			next.fn()
+			continue
+		}
+
+		i := s.rng.IntN(len(s.ready))
+		t := s.ready[i]
+		s.ready = slices.Delete(s.ready, i, i+1)
+		if s.dead(t) {
+			// Its goroutine stays parked for good
+			continue
+		}
+		s.steps++
+		s.trace.Write(binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, t.id), uint64(s.now.Sub(s.start))))
+		s.emit("run", t.name)
+		s.current = t
+		s.mu.Unlock()
+		t.wake <- struct{}{}
+		<-s.parked
+		s.mu.Lock()
+	}
+	return s.failure
+}
+
+// Stop makes Run return once the calling task blocks or returns, such as
+// when a test has seen what it waited for while servers still run
+func (s *Sim) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+}
+
+// blocked lists the tasks left blocked, by name; s.mu must be held
+func (s *Sim) blocked() string {
+	var names []string
+	for t := range s.live {
+		names = append(names, t.name)
+	}
+	slices.Sort(names)
+	return joinLimited(names, 5)
+}
+
+// joinLimited joins the first n names, noting how many were left out
+func joinLimited(names []string, n int) string {
+	if len(names) <= n {
+		return fmt.Sprint(names)
+	}
+	return fmt.Sprintf("%v and %d more", names[:n], len(names)-n)
+}
+
+// park blocks the current task until something makes it ready again;
+// s.mu must be held and is held again on return
+func (s *Sim) park() {
+	t := s.current
+	s.current = nil
+	s.mu.Unlock()
+	s.parked <- struct{}{}
+	<-t.wake
+	s.mu.Lock()
+}
+
+// at arranges for fn to run on the scheduler at time when, with s.mu held;
+// fn must not block. what describes it to observers
+func (s *Sim) at(when time.Time, what string, fn func()) {
+	s.seq++
+	heap.Push(&s.timers, &timerEntry{at: when, seq: s.seq, fn: fn, what: what})
+}
+
+// Now returns the virtual time
+func (s *Sim) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Elapsed returns how much virtual time has passed since the run started
+func (s *Sim) Elapsed() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now.Sub(s.start)
+}
+
+// Sleep blocks the calling task for d of virtual time
+func (s *Sim) Sleep(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.current
+	s.at(s.now.Add(d), "wake "+t.name, func() { s.ready = append(s.ready, t) })
+	s.park()
+}
+
+// Yield lets the scheduler run another ready task before the caller goes on
+func (s *Sim) Yield() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = append(s.ready, s.current)
+	s.park()
+}
+
+// AfterFunc starts fn as a new task after d of virtual time unless the
+// returned stop function is called first; stop reports whether it was
+func (s *Sim) AfterFunc(d time.Duration, name string, fn func()) (stop func() bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := 0 // 1 once fired, 2 once stopped
+	host, life := "", uint64(0)
+	if s.current != nil {
+		host, life = s.current.host, s.current.life
+	}
+	s.at(s.now.Add(d), "start "+name, func() {
+		if state == 0 && (host == "" || life == s.lives[host]) {
+			state = 1
+			s.spawn(host, name, fn)
+		}
+	})
+	return func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if state != 0 {
+			return false
+		}
+		state = 2
+		return true
+	}
+}
+
+// IntN returns a seeded random number in [0, n)
+func (s *Sim) IntN(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.IntN(n)
+}
+
+// Float64 returns a seeded random number in [0, 1)
+func (s *Sim) Float64() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64()
+}
+
+// Duration returns a seeded random duration in [lo, hi]
+func (s *Sim) Duration(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return lo + time.Duration(s.rng.Int64N(int64(hi-lo)+1))
+}
+
+// Steps returns the number of times a task was scheduled
+func (s *Sim) Steps() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.steps
+}
+
+// Fingerprint hashes the schedule so far, which task ran at what time;
+// two runs with equal fingerprints took the same path
+func (s *Sim) Fingerprint() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.trace.Sum64()
+}
+
+// SimQueue is an unbounded FIFO of values for tasks of one Sim, standing in
+// for a channel
+type SimQueue[T any] struct {
+	sim     *Sim
+	items   []T
+	waiters []*simWaiter
+	closed  bool
+}
+
+// simWaiter is a task blocked in SimQueue.Recv; done is set by whichever of
+// a Send, a Close or the timeout wakes it first
+type simWaiter struct {
+	task     *simTask
+	done     bool
+	timedOut bool
+}
+
+// NewSimQueue creates an empty queue on s
+func NewSimQueue[T any](s *Sim) *SimQueue[T] {
+	return &SimQueue[T]{sim: s}
+}
+
+// Send appends v, waking a task waiting in Recv; it reports false, dropping
+// v, once the queue is closed
+func (q *SimQueue[T]) Send(v T) bool {
+	q.sim.mu.Lock()
+	defer q.sim.mu.Unlock()
+	return q.send(v)
+}
+
+// send is Send with q.sim.mu held
+func (q *SimQueue[T]) send(v T) bool {
+	if q.closed {
+		return false
+	}
+	q.items = append(q.items, v)
+	q.wakeOne()
+	return true
+}
+
+// wakeOne makes the longest waiting task ready; q.sim.mu must be held
+func (q *SimQueue[T]) wakeOne() {
+	if len(q.waiters) > 0 {
+		w := q.waiters[0]
+		q.waiters = q.waiters[1:]
+		w.done = true
+		q.sim.ready = append(q.sim.ready, w.task)
+	}
+}
+
+// Recv removes and returns the oldest value, blocking the calling task
+// while the queue is empty. If timeout is positive it gives up after that
+// much virtual time. It reports false on timeout or once the queue is
+// closed and drained
+func (q *SimQueue[T]) Recv(timeout time.Duration) (T, bool) {
+	s := q.sim
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline := s.now.Add(timeout)
+	for len(q.items) == 0 {
+		var zero T
+		if q.closed || timeout > 0 && !s.now.Before(deadline) {
+			return zero, false
+		}
+		w := &simWaiter{task: s.current}
+		q.waiters = append(q.waiters, w)
+		if timeout > 0 {
+			s.at(deadline, "timeout "+w.task.name, func() {
+				if !w.done {
+					w.done, w.timedOut = true, true
+					q.waiters = slices.DeleteFunc(q.waiters, func(o *simWaiter) bool { return o == w })
+					s.ready = append(s.ready, w.task)
+				}
+			})
+		}
+		s.park()
+		if w.timedOut {
+			return zero, false
+		}
+	}
+	v := q.items[0]
+	var zero T
+	q.items[0] = zero
+	q.items = q.items[1:]
+	return v, true
+}
+
+// Len returns the number of values waiting
+func (q *SimQueue[T]) Len() int {
+	q.sim.mu.Lock()
+	defer q.sim.mu.Unlock()
+	return len(q.items)
+}
+
+// Close stops the queue taking values and wakes every waiting task; values
+// already queued can still be received
+func (q *SimQueue[T]) Close() {
+	q.sim.mu.Lock()
+	defer q.sim.mu.Unlock()
+	q.close()
+}
+
+// close is Close with q.sim.mu held
+func (q *SimQueue[T]) close() {
+	q.closed = true
+	for len(q.waiters) > 0 {
+		q.wakeOne()
+	}
+}
+
+// SimNetwork is a Transport for the tasks of a Sim, like MemoryNetwork but
+// with every message taking a seeded random delay to arrive. Messages on a
+// connection still arrive in order. As on a MemoryNetwork, hosts can be
+// partitioned from each other
+type SimNetwork struct {
+	sim *Sim
+	// MinLatency and MaxLatency bound the delay of each message
+	MinLatency, MaxLatency time.Duration
+
+	listeners map[string]*simListener
+	dials     int
+	parts     partitions
+}
+
+// NewSimNetwork creates an empty network on s whose messages take between
+// 1ms and 10ms to arrive
+func NewSimNetwork(s *Sim) *SimNetwork {
+	return &SimNetwork{
+		sim:        s,
+		MinLatency: time.Millisecond,
+		MaxLatency: 10 * time.Millisecond,
+		listeners:  make(map[string]*simListener),
+	}
+}
+
+// Listen implements Transport
+func (n *SimNetwork) Listen(addr string) (Listener, error) {
+	return n.listen("", addr)
+}
+
+// Dial implements Transport; the connection is set up at once and its
+// first message pays the latency
+func (n *SimNetwork) Dial(ctx context.Context, addr string) (Conn, error) {
+	return n.dial(ctx, "", addr)
+}
+
+// Host returns a view of the network for the host name, as
+// MemoryNetwork.Host does
+func (n *SimNetwork) Host(name string) Transport {
+	return &simHost{network: n, name: name}
+}
+
+// Partition splits the hosts into groups as MemoryNetwork.Partition does;
+// messages crossing groups are lost, including those already on their way
+func (n *SimNetwork) Partition(groups ...[]string) {
+	n.parts.split(groups)
+}
+
+// Heal undoes Partition
+func (n *SimNetwork) Heal() {
+	n.parts.heal()
+}
+
+// Crash takes host off the network: its listeners close, and until Restore
+// it reaches no one, nor anyone it, messages already on their way
+// included. Together with Sim.Kill it crashes the host's machine
+func (n *SimNetwork) Crash(host string) {
+	n.sim.mu.Lock()
+	defer n.sim.mu.Unlock()
+	n.parts.setDown(host, true)
+	var addrs []string
+	for addr, l := range n.listeners {
+		if l.host == host {
+			addrs = append(addrs, addr)
+		}
+	}
+	slices.Sort(addrs)
+	for _, addr := range addrs {
+		n.listeners[addr].accept.close()
+		delete(n.listeners, addr)
+	}
+}
+
+// Restore brings a crashed host back on the network
+func (n *SimNetwork) Restore(host string) {
+	n.parts.setDown(host, false)
+}
+
+// simHost is a SimNetwork seen from one host
+type simHost struct {
+	network *SimNetwork
+	name    string
+}
+
+func (h *simHost) Listen(addr string) (Listener, error) {
+	return h.network.listen(h.name, addr)
+}
+
+func (h *simHost) Dial(ctx context.Context, addr string) (Conn, error) {
+	return h.network.dial(ctx, h.name, addr)
+}
+
+// listen opens addr for host, which is empty for the network itself
+func (n *SimNetwork) listen(host, addr string) (Listener, error) {
+	n.sim.mu.Lock()
+	defer n.sim.mu.Unlock()
+	if _, taken := n.listeners[addr]; taken {
+		return nil, fmt.Errorf("sim network: address %q in use", addr)
+	}
+	l := &simListener{network: n, addr: addr, host: host, accept: NewSimQueue[*simConn](n.sim)}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// dial connects host, which is empty for the network itself, to addr
+func (n *SimNetwork) dial(ctx context.Context, host, addr string) (Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, context.Cause(ctx)
+	}
+	n.sim.mu.Lock()
+	defer n.sim.mu.Unlock()
+	l, ok := n.listeners[addr]
+	if !ok {
+		return nil, fmt.Errorf("sim network: dial %q: connection refused", addr)
+	}
+	if !n.parts.connected(host, l.host) {
+		return nil, fmt.Errorf("sim network: dial %q from %s: %w", addr, host, ErrPartitioned)
+	}
+	n.dials++
+	a := &simConn{network: n, in: NewSimQueue[*Message](n.sim), remote: addr, from: host, to: l.host}
+	b := &simConn{network: n, in: NewSimQueue[*Message](n.sim), remote: fmt.Sprintf("sim-client-%d", n.dials), from: l.host, to: host}
+	a.peer, b.peer = b, a
+	if !l.accept.send(b) {
+		return nil, fmt.Errorf("sim network: dial %q: connection refused", addr)
+	}
+	return a, nil
+}
+
+// latency draws the delay of one message; n.sim.mu must be held
+func (n *SimNetwork) latency() time.Duration {
+	if n.MaxLatency <= n.MinLatency {
+		return n.MinLatency
+	}
+	return n.MinLatency + time.Duration(n.sim.rng.Int64N(int64(n.MaxLatency-n.MinLatency)+1))
+}
+
+// simListener accepts the connections dialed to its address
+type simListener struct {
+	network *SimNetwork
+	addr    string
+	host    string
+	accept  *SimQueue[*simConn]
+}
+
+func (l *simListener) Accept() (Conn, error) {
+	c, ok := l.accept.Recv(0)
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+func (l *simListener) Close() error {
+	n := l.network
+	n.sim.mu.Lock()
+	defer n.sim.mu.Unlock()
+	l.accept.close()
+	if n.listeners[l.addr] == l {
+		delete(n.listeners, l.addr)
+	}
+	return nil
+}
+
+func (l *simListener) Addr() string { return l.addr }
+
+// simConn is one end of a simulated connection. Closing an end closes the
+// other once the messages sent before the close have reached it, like a
+// FIN; they can still be received
+type simConn struct {
+	network *SimNetwork
+	peer    *simConn
+	in      *SimQueue[*Message]
+	remote  string
+	// from and to are the hosts of this end and of the peer
+	from, to string
+	// arrival is when the last message sent arrives, which later ones may
+	// not precede
+	arrival time.Time
+	closed  bool
+}
+
+func (c *simConn) Send(m *Message) error {
+	s := c.network.sim
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	parts := &c.network.parts
+	if !parts.connected(c.from, c.to) {
+		return nil
+	}
+	cp := *m
+	cp.Payload = slices.Clone(m.Payload)
+	c.arrival = maxTime(c.arrival, s.now.Add(c.network.latency()))
+	peer := c.peer
+	s.at(c.arrival, "deliver "+cp.Type.String()+" "+strconv.FormatUint(cp.ID, 10)+" from "+peer.remote+" to "+c.remote, func() {
+		if parts.connected(c.from, c.to) {
+			peer.in.send(&cp)
+		}
+	})
+	return nil
+}
+
+func (c *simConn) Recv() (*Message, error) {
+	m, ok := c.in.Recv(0)
+	if !ok {
+		return nil, io.EOF
+	}
+	return m, nil
+}
+
+func (c *simConn) Close() error {
+	s := c.network.sim
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.in.close()
+	peer := c.peer
+	s.at(maxTime(c.arrival, s.now), "close from "+peer.remote+" to "+c.remote, func() {
+		peer.closed = true
+		peer.in.close()
+	})
+	return nil
+}
+
+func (c *simConn) RemoteAddr() string { return c.remote }
+
+// maxTime returns the later of a and b
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// SimRoundTrip is RoundTrip for tasks of s, waiting at most timeout of
+// virtual time for the reply
+func SimRoundTrip(ctx context.Context, s *Sim, t Transport, addr string, m *Message, wantReply bool, timeout time.Duration) (*Message, error) {
+	conn, err := t.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.Send(m); err != nil || !wantReply {
+		return nil, err
+	}
+	stop := s.AfterFunc(timeout, "timeout "+addr, func() { conn.Close() })
+	defer stop()
+	return conn.Recv()
+}
+
+// SimServeRequests is ServeRequests for tasks of s, handling every
+// connection on a task of its own. Tasks cannot watch ctx, so the server
+// runs until its listener is closed or the simulation stops
+func SimServeRequests(ctx context.Context, s *Sim, t Transport, addr string, handle func(context.Context, Conn, *Message)) error {
+	l, err := t.Listen(addr)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.Go("serve "+addr, func() {
+			defer conn.Close()
+			if m, err := conn.Recv(); err == nil {
+				handle(ctx, conn, m)
+			}
+		})
+	}
+}
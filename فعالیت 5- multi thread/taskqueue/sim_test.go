@@ -0,0 +1,98 @@
+package taskqueue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// simRun is what a run of simQueueWorkload did
+type simRun struct {
+	events      []SimEvent
+	received    []int
+	fingerprint uint64
+}
+
+// simQueue starts producers tasks on s sleeping for seeded times between
+// five sends each to a consumer, which appends what it receives to received
+func simQueue(s *Sim, producers int, received *[]int) {
+	q := NewSimQueue[int](s)
+	for i := range producers {
+		s.Go(fmt.Sprintf("producer-%d", i), func() {
+			for j := range 5 {
+				s.Sleep(s.Duration(time.Millisecond, 10*time.Millisecond))
+				q.Send(10*i + j)
+			}
+		})
+	}
+	s.Go("consumer", func() {
+		for range 5 * producers {
+			if v, ok := q.Recv(time.Second); ok {
+				*received = append(*received, v)
+			}
+		}
+	})
+}
+
+// simQueueWorkload runs simQueue with four producers under a Sim seeded
+// with seed
+func simQueueWorkload(t *testing.T, seed uint64) simRun {
+	t.Helper()
+	s := NewSim(seed)
+	var run simRun
+	s.Observe(func(e SimEvent) { run.events = append(run.events, e) })
+	simQueue(s, 4, &run.received)
+	if err := s.Run(time.Minute); err != nil {
+		t.Fatalf("seed %d: %v", seed, err)
+	}
+	run.fingerprint = s.Fingerprint()
+	return run
+}
+
+func TestSimSameSeedSameTrace(t *testing.T) {
+	first, again := simQueueWorkload(t, 7), simQueueWorkload(t, 7)
+	if !slices.Equal(first.events, again.events) {
+		t.Fatalf("seed 7 ran %d events, then %d different ones", len(first.events), len(again.events))
+	}
+	if !slices.Equal(first.received, again.received) || first.fingerprint != again.fingerprint {
+		t.Fatalf("seed 7 received %v with fingerprint %x, then %v with %x",
+			first.received, first.fingerprint, again.received, again.fingerprint)
+	}
+	if len(first.received) != 20 {
+		t.Fatalf("consumer received %d of 20 values", len(first.received))
+	}
+
+	other := simQueueWorkload(t, 8)
+	if other.fingerprint == first.fingerprint || slices.Equal(other.received, first.received) {
+		t.Errorf("seeds 7 and 8 took the same path")
+	}
+}
+
+func TestSimReplaysRecordedTrace(t *testing.T) {
+	scenario := func(_ io.Writer, s *Sim, params []int) error {
+		var received []int
+		simQueue(s, params[0], &received)
+		return s.Run(time.Minute)
+	}
+	var trace bytes.Buffer
+	header := SimTraceHeader{Scenario: "queue", Params: []int{3}, Seed: 3}
+	if err := RunSimScenario(io.Discard, scenario, header, &trace); err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := ReadSimTrace(&trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplaySimTrace(io.Discard, scenario, recorded, nil); err != nil {
+		t.Fatalf("replaying the trace of seed 3: %v", err)
+	}
+
+	recorded.Header.Seed = 4
+	if err := ReplaySimTrace(io.Discard, scenario, recorded, nil); !errors.Is(err, ErrReplayDiverged) {
+		t.Fatalf("replaying the trace of seed 3 with seed 4 returned %v, want ErrReplayDiverged", err)
+	}
+}
@@ -0,0 +1,88 @@
+package taskqueue
+
+import "time"
+
+// SimpleThreadPool represents a basic worker pool implementation
+type SimpleThreadPool struct {
+	poolCore
+	slots *semaphore
+}
+
+// NewSimpleThreadPool creates a new simple thread pool
+func NewSimpleThreadPool(numWorkers int, opts ...Option) *SimpleThreadPool {
+	pool := &SimpleThreadPool{
+		poolCore: newPoolCore("simple", opts),
+		slots:    newSemaphore(int64(numWorkers)),
+	}
+	pool.dispatch = pool.enqueue
+	pool.noteCapacity(numWorkers)
+	pool.config.events.poolStarted(pool.config.name, numWorkers)
+	return pool
+}
+
+// enqueue blocks until a worker slot is free and runs j on a new goroutine
+func (p *SimpleThreadPool) enqueue(j *job) {
+	if !p.admit(j) {
+		p.abort(j, ErrPoolShutdown)
+		return
+	}
+
+	// Acquire worker slot
+	if err := p.slots.acquire(j.ctx, 1); err != nil {
+		p.abort(j, err)
+		p.wg.Done()
+		return
+	}
+
+	go func() {
+		defer p.wg.Done()
+		defer p.slots.release(1) // Release worker slot
+
+		p.run(j)
+	}()
+}
+
+// Shutdown stops accepting new tasks and waits for the submitted ones to finish
+func (p *SimpleThreadPool) Shutdown() {
+	p.stopAccepting()
+	p.wg.Wait()
+	p.cancel(ErrPoolShutdown)
+}
+
+// ShutdownNow stops accepting new tasks and cancels the running ones; the
+// simple pool has no queue, so submitters still blocked on a worker slot fail
+// with ErrPoolShutdown and no tasks are returned
+func (p *SimpleThreadPool) ShutdownNow() []ContextTask {
+	p.stopAccepting()
+	p.cancel(ErrPoolShutdown)
+	return nil
+}
+
+// Resize changes the number of tasks allowed to run concurrently
+func (p *SimpleThreadPool) Resize(n int) {
+	p.noteCapacity(max(n, 1))
+	p.slots.resize(int64(max(n, 1)))
+}
+
+// Size returns the number of tasks allowed to run concurrently
+func (p *SimpleThreadPool) Size() int {
+	return int(p.slots.size())
+}
+
+// QueueDepth returns the number of submitters blocked waiting for a slot
+func (p *SimpleThreadPool) QueueDepth() int {
+	return p.slots.waiting()
+}
+
+// Metrics returns a snapshot of the pool metrics
+func (p *SimpleThreadPool) Metrics() MetricsSnapshot {
+	return p.metrics.snapshot(p.QueueDepth())
+}
+
+// ExecuteTasks runs n simulated tasks
+func (p *SimpleThreadPool) ExecuteTasks(n int) {
+	for i := 0; i < n && p.ctx.Err() == nil; i++ {
+		// Simulate work
+		p.Submit(func() { time.Sleep(100 * time.Millisecond) })
+	}
+}
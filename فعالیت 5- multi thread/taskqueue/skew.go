@@ -0,0 +1,261 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"multithread/clocks"
+)
+
+// SkewedClock is a node's physical clock disagreeing with a reference clock,
+// such as a Sim's true time: it starts skew ahead of the reference, gains
+// drift of a second every second, so 1e-4 gains 100µs a second and a
+// negative drift loses time, and can be stepped like a clock corrected by
+// NTP. Its Now can be handed to a clocks.HLC or to other time-reading
+// components of a simulated node. It is safe for concurrent use
+type SkewedClock struct {
+	reference func() time.Time
+	start     time.Time
+	drift     float64
+
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+// NewSkewedClock creates a clock reading reference; drift must be above -1,
+// or the clock would stop or run backwards
+func NewSkewedClock(reference func() time.Time, skew time.Duration, drift float64) *SkewedClock {
+	if drift <= -1 {
+		panic(fmt.Sprintf("skewed clock: drift %v would stop the clock", drift))
+	}
+	return &SkewedClock{reference: reference, start: reference(), drift: drift, offset: skew}
+}
+
+// Clock returns a clock for a simulated node that disagrees with the
+// simulation's true time by skew and drift
+func (s *Sim) Clock(skew time.Duration, drift float64) *SkewedClock {
+	return NewSkewedClock(s.Now, skew, drift)
+}
+
+// Now returns the clock's reading
+func (c *SkewedClock) Now() time.Time {
+	ref := c.reference()
+	return ref.Add(c.offsetAt(ref))
+}
+
+// Offset returns how far ahead of the reference the clock reads
+func (c *SkewedClock) Offset() time.Duration {
+	return c.offsetAt(c.reference())
+}
+
+// offsetAt is the clock's offset when the reference reads ref
+func (c *SkewedClock) offsetAt(ref time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset + time.Duration(float64(ref.Sub(c.start))*c.drift)
+}
+
+// Step jumps the clock by d, backwards if d is negative
+func (c *SkewedClock) Step(d time.Duration) {
+	c.mu.Lock()
+	c.offset += d
+	c.mu.Unlock()
+}
+
+// Real converts a duration measured on this clock to how long it lasts on
+// the reference: a node whose clock runs fast sleeps for less true time
+func (c *SkewedClock) Real(local time.Duration) time.Duration {
+	return time.Duration(float64(local) / (1 + c.drift))
+}
+
+// SimulateClockSkew runs nodes simulated nodes whose clocks start up to
+// maxSkew apart and drift by up to maxDrift, on a deterministic schedule
+// seeded with seed, and writes what it checks to w. First the nodes
+// exchange HLC timestamps bounded by bound: every receive must be ordered
+// after its send even though the physical clocks disagree, and timestamps
+// from a clock further ahead than bound are rejected. Then a lock holder
+// whose clock runs slow keeps using a lease the lock manager has already
+// expired and handed to another node; the fencing token must stop its late
+// writes
+func SimulateClockSkew(w io.Writer, nodes int, maxSkew time.Duration, maxDrift float64, bound time.Duration, seed uint64) error {
+	if nodes < 2 {
+		return fmt.Errorf("skew: need at least 2 nodes, got %d", nodes)
+	}
+	if maxDrift < 0 || maxDrift >= 1 {
+		return fmt.Errorf("skew: drift must be in [0, 1), got %v", maxDrift)
+	}
+	sim := NewSim(seed)
+	network := NewSimNetwork(sim)
+	ctx := context.Background()
+
+	physical := make([]*SkewedClock, nodes)
+	hlcs := make([]*clocks.HLC, nodes)
+	addr := func(i int) string { return fmt.Sprintf("node-%d", i) }
+	for i := range nodes {
+		physical[i] = sim.Clock(sim.Duration(-maxSkew, maxSkew), maxDrift*(2*sim.Float64()-1))
+		hlcs[i] = clocks.NewHLC(bound, physical[i].Now)
+	}
+
+	const rounds = 200
+	var failure error
+	fail := func(err error) {
+		if failure == nil {
+			failure = err
+			sim.Stop()
+		}
+	}
+	rejected := make([]int, nodes)
+	var maxLogical uint32
+	for i := range nodes {
+		l, err := network.Host(addr(i)).Listen(addr(i))
+		if err != nil {
+			return err
+		}
+		sim.Go(addr(i)+" server", func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				sim.Go(addr(i)+" receive", func() {
+					defer conn.Close()
+					m, err := conn.Recv()
+					if err != nil {
+						return
+					}
+					var sent clocks.HLCTimestamp
+					if err := sent.UnmarshalBinary(m.Payload); err != nil {
+						fail(err)
+						return
+					}
+					recv, err := hlcs[i].Update(sent)
+					switch {
+					case errors.Is(err, clocks.ErrClockDrift):
+						rejected[i]++
+					case err != nil:
+						fail(err)
+					case !sent.Before(recv):
+						fail(fmt.Errorf("skew: %s received %v at %v, not after it was sent", addr(i), sent, recv))
+					default:
+						maxLogical = max(maxLogical, recv.Logical)
+					}
+				})
+			}
+		})
+	}
+	remaining := nodes
+	for i := range nodes {
+		sim.Go(addr(i), func() {
+			t := network.Host(addr(i))
+			last := hlcs[i].Now()
+			for range rounds {
+				sim.Sleep(physical[i].Real(sim.Duration(time.Millisecond, 20*time.Millisecond)))
+				peer := (i + 1 + sim.IntN(nodes-1)) % nodes
+				ts := hlcs[i].Now()
+				if !last.Before(ts) {
+					fail(fmt.Errorf("skew: %s went from %v back to %v", addr(i), last, ts))
+					return
+				}
+				last = ts
+				b, _ := ts.MarshalBinary()
+				SimRoundTrip(ctx, sim, t, addr(peer), &Message{Type: MsgPing, Payload: b}, false, time.Second)
+			}
+			if remaining--; remaining == 0 {
+				sim.Sleep(time.Second)
+				sim.Stop()
+			}
+		})
+	}
+	if err := sim.Run(time.Hour); err != nil {
+		return err
+	}
+	if failure != nil {
+		return failure
+	}
+	for i, c := range physical {
+		fmt.Fprintf(w, "%s  offset %-14v drift %+.2e  rejected %d timestamps from clocks over %v ahead\n", addr(i), c.Offset(), c.drift, rejected[i], bound)
+	}
+	fmt.Fprintf(w, "ok  %d messages each, every receive ordered after its send, logical counters up to %d\n", rounds, maxLogical)
+
+	return simulateLeaseDrift(w, seed, maxDrift)
+}
+
+// simulateLeaseDrift has a node whose clock runs slow by up to maxDrift, at
+// least 1%, take a lock and keep using it until its own clock says the lease
+// ran out, while another node takes the lock as soon as the manager's clock
+// lets it. A resource checking fencing tokens must refuse the first node's
+// writes from then on
+func simulateLeaseDrift(w io.Writer, seed uint64, maxDrift float64) error {
+	const ttl = time.Second
+	sim := NewSim(seed)
+	locks := NewLockManager()
+	locks.SetClock(sim.Clock(0, 0).Now)
+	slow := sim.Clock(0, -max(maxDrift, 0.01))
+
+	// The guarded resource takes writes whose token is at least the highest
+	// it has seen
+	var highest uint64
+	var stale, accepted int
+	write := func(token uint64) bool {
+		if token < highest {
+			stale++
+			return false
+		}
+		highest = token
+		accepted++
+		return true
+	}
+
+	var overlap time.Duration
+	var takenOver time.Time
+	var failure error
+	next := func() {
+		for {
+			l, err := locks.Acquire("resource", "next", ttl)
+			if err == nil {
+				takenOver = sim.Now()
+				for range 10 {
+					write(l.Token)
+					sim.Sleep(10 * time.Millisecond)
+				}
+				return
+			}
+			sim.Sleep(5 * time.Millisecond)
+		}
+	}
+	sim.Go("slow holder", func() {
+		l, err := locks.Acquire("resource", "slow", ttl)
+		if err != nil {
+			failure = err
+			return
+		}
+		// The next node starts asking once the slow one holds the lock
+		sim.Go("next holder", next)
+		// Without renewing, the holder believes its lease lasts ttl on
+		// its own clock
+		believed := slow.Now().Add(ttl)
+		for slow.Now().Before(believed) {
+			write(l.Token)
+			sim.Sleep(10 * time.Millisecond)
+		}
+		if !takenOver.IsZero() {
+			overlap = sim.Now().Sub(takenOver)
+		}
+	})
+	if err := sim.Run(time.Minute); err != nil {
+		return err
+	}
+	if failure != nil {
+		return failure
+	}
+	if takenOver.IsZero() || stale == 0 {
+		return fmt.Errorf("skew: expected the slow holder to outlive its lease, took over %v, %d stale writes", takenOver, stale)
+	}
+	fmt.Fprintf(w, "ok  a holder whose clock loses %.1f%% kept using its %v lease %v after it was taken over; fencing refused %d writes and took %d\n",
+		-100*slow.drift, ttl, overlap.Round(time.Millisecond), stale, accepted)
+	return nil
+}
@@ -0,0 +1,443 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SendFunc sends an application message to the named peer
+type SendFunc func(to string, payload []byte)
+
+// SnapshotProcess is the application a SnapshotCluster node runs. The node
+// calls it from one goroutine, so it needs no locking of its own
+type SnapshotProcess interface {
+	// Receive handles a message from the named peer
+	Receive(from string, payload []byte, send SendFunc)
+	// Tick lets the process act on its own; it is called every tick interval
+	Tick(send SendFunc)
+	// State encodes the process's local state
+	State() []byte
+}
+
+// SnapshotChannel is the directed channel between two nodes
+type SnapshotChannel struct {
+	From, To string
+}
+
+// GlobalSnapshot is a consistent global state of a cluster: the state each
+// node recorded and the messages that were in flight on each channel. It is
+// a state the cluster could have been in: every message it counts as
+// received was also sent, and every message sent but not received is in
+// flight on its channel
+type GlobalSnapshot struct {
+	ID       uint64
+	States   map[string][]byte
+	InFlight map[SnapshotChannel][][]byte
+}
+
+// SnapshotClusterConfig configures a SnapshotCluster
+type SnapshotClusterConfig struct {
+	// Processes maps the node names to the processes they run; there must
+	// be at least two
+	Processes map[string]SnapshotProcess
+	// Transport carries the messages; defaults to a new MemoryNetwork. The
+	// node names are its addresses
+	Transport Transport
+	// TickInterval is how often each process's Tick is called; defaults to
+	// 10ms
+	TickInterval time.Duration
+}
+
+// SnapshotCluster runs processes on fully connected nodes whose channels
+// deliver in order, and takes Chandy-Lamport snapshots of them while they
+// run. A node starting a snapshot records its state and sends a marker down
+// every outgoing channel; a node seeing its first marker does the same, and
+// every node records what arrives on a channel between recording its state
+// and receiving that channel's marker. Because channels are FIFO the marker
+// separates the messages sent before the sender's recording from those sent
+// after, so no node has to pause
+type SnapshotCluster struct {
+	cfg   SnapshotClusterConfig
+	nodes map[string]*snapshotNode
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pendingSnapshot
+}
+
+// pendingSnapshot is a snapshot whose node parts are not all in yet
+type pendingSnapshot struct {
+	snap *GlobalSnapshot
+	left int
+	done chan struct{}
+}
+
+// NewSnapshotCluster creates a cluster; Run starts it
+func NewSnapshotCluster(cfg SnapshotClusterConfig) (*SnapshotCluster, error) {
+	if len(cfg.Processes) < 2 {
+		return nil, fmt.Errorf("snapshot: need at least 2 processes, got %d", len(cfg.Processes))
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = NewMemoryNetwork()
+	}
+	if cfg.TickInterval <= 0 {
+		cfg.TickInterval = 10 * time.Millisecond
+	}
+	c := &SnapshotCluster{cfg: cfg, nodes: make(map[string]*snapshotNode), pending: make(map[uint64]*pendingSnapshot)}
+	for name, p := range cfg.Processes {
+		c.nodes[name] = &snapshotNode{
+			name:      name,
+			proc:      p,
+			cluster:   c,
+			out:       make(map[string]Conn),
+			notify:    make(chan struct{}, 1),
+			recording: make(map[uint64]*localSnapshot),
+		}
+	}
+	return c, nil
+}
+
+// Run connects the nodes and runs them until ctx is cancelled
+func (c *SnapshotCluster) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	for name, n := range c.nodes {
+		l, err := c.cfg.Transport.Listen(name)
+		if err != nil {
+			return err
+		}
+		context.AfterFunc(ctx, func() { l.Close() })
+		go n.accept(l)
+	}
+	for _, n := range c.nodes {
+		for peer := range c.nodes {
+			if peer == n.name {
+				continue
+			}
+			conn, err := c.cfg.Transport.Dial(ctx, peer)
+			if err == nil {
+				// The first message names the dialer, as the channel's source
+				err = conn.Send(&Message{Type: MsgRegister, Worker: n.name})
+			}
+			if err != nil {
+				return err
+			}
+			context.AfterFunc(ctx, func() { conn.Close() })
+			n.out[peer] = conn
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, n := range c.nodes {
+		wg.Go(func() {
+			if err := n.run(ctx); err != nil {
+				cancel(err)
+			}
+		})
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// Snapshot takes a snapshot started by the named node and waits until every
+// node has recorded its part
+func (c *SnapshotCluster) Snapshot(ctx context.Context, initiator string) (*GlobalSnapshot, error) {
+	n, ok := c.nodes[initiator]
+	if !ok {
+		return nil, fmt.Errorf("snapshot: no node %q", initiator)
+	}
+	c.mu.Lock()
+	c.nextID++
+	p := &pendingSnapshot{
+		snap: &GlobalSnapshot{ID: c.nextID, States: make(map[string][]byte), InFlight: make(map[SnapshotChannel][][]byte)},
+		left: len(c.nodes),
+		done: make(chan struct{}),
+	}
+	c.pending[p.snap.ID] = p
+	c.mu.Unlock()
+
+	n.push(snapshotEvent{start: true, id: p.snap.ID})
+	select {
+	case <-p.done:
+		return p.snap, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, p.snap.ID)
+		c.mu.Unlock()
+		return nil, context.Cause(ctx)
+	}
+}
+
+// report adds a node's finished part to its snapshot
+func (c *SnapshotCluster) report(node string, id uint64, l *localSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[id]
+	if !ok {
+		return
+	}
+	p.snap.States[node] = l.state
+	for from, msgs := range l.channels {
+		if len(msgs) > 0 {
+			p.snap.InFlight[SnapshotChannel{From: from, To: node}] = msgs
+		}
+	}
+	if p.left--; p.left == 0 {
+		delete(c.pending, id)
+		close(p.done)
+	}
+}
+
+// snapshotEvent is an input of a node: a message from a peer, or a request
+// to start snapshot id
+type snapshotEvent struct {
+	from  string
+	msg   *Message
+	start bool
+	id    uint64
+}
+
+// localSnapshot is a node's part of a snapshot in progress: its recorded
+// state and the messages recorded on each incoming channel, which is open
+// until its marker arrives
+type localSnapshot struct {
+	state    []byte
+	open     map[string]bool
+	channels map[string][][]byte
+}
+
+// snapshotNode is one node of a SnapshotCluster
+type snapshotNode struct {
+	name    string
+	proc    SnapshotProcess
+	cluster *SnapshotCluster
+	out     map[string]Conn // peer name to the channel towards it
+
+	mu     sync.Mutex
+	inbox  []snapshotEvent
+	notify chan struct{}
+
+	recording map[uint64]*localSnapshot // only touched by run
+}
+
+// accept reads every incoming channel into the inbox until l is closed
+func (n *snapshotNode) accept(l Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			hello, err := conn.Recv()
+			if err != nil {
+				return
+			}
+			for {
+				m, err := conn.Recv()
+				if err != nil {
+					return
+				}
+				n.push(snapshotEvent{from: hello.Worker, msg: m})
+			}
+		}()
+	}
+}
+
+// push queues e for run; the inbox is unbounded so that nodes sending to
+// each other cannot deadlock
+func (n *snapshotNode) push(e snapshotEvent) {
+	n.mu.Lock()
+	n.inbox = append(n.inbox, e)
+	n.mu.Unlock()
+	select {
+	case n.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the node's events and ticks to its process until ctx is
+// cancelled or a send fails
+func (n *snapshotNode) run(ctx context.Context) error {
+	var sendErr error
+	send := func(to string, payload []byte) {
+		conn, ok := n.out[to]
+		if !ok {
+			sendErr = fmt.Errorf("snapshot: %s sent to unknown node %q", n.name, to)
+			return
+		}
+		if err := conn.Send(&Message{Type: MsgDispatch, Payload: payload}); err != nil && sendErr == nil {
+			sendErr = err
+		}
+	}
+
+	ticker := time.NewTicker(n.cluster.cfg.TickInterval)
+	defer ticker.Stop()
+	for sendErr == nil {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			n.proc.Tick(send)
+			continue
+		case <-n.notify:
+		}
+		n.mu.Lock()
+		events := n.inbox
+		n.inbox = nil
+		n.mu.Unlock()
+		for _, e := range events {
+			switch {
+			case e.start:
+				n.record(e.id, "")
+			case e.msg.Type == MsgMarker:
+				n.marker(e.msg.ID, e.from)
+			default:
+				for _, l := range n.recording {
+					if l.open[e.from] {
+						l.channels[e.from] = append(l.channels[e.from], e.msg.Payload)
+					}
+				}
+				n.proc.Receive(e.from, e.msg.Payload, send)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return sendErr
+}
+
+// record records the node's state for snapshot id and sends its markers;
+// from is the channel whose marker prompted it, which is recorded empty
+func (n *snapshotNode) record(id uint64, from string) {
+	l := &localSnapshot{state: n.proc.State(), open: make(map[string]bool), channels: make(map[string][][]byte)}
+	for peer := range n.out {
+		if peer != from {
+			l.open[peer] = true
+		}
+	}
+	n.recording[id] = l
+	for _, conn := range n.out {
+		conn.Send(&Message{Type: MsgMarker, ID: id})
+	}
+	n.finish(id, l)
+}
+
+// marker handles the marker of snapshot id arriving on the channel from
+func (n *snapshotNode) marker(id uint64, from string) {
+	l, ok := n.recording[id]
+	if !ok {
+		n.record(id, from)
+		return
+	}
+	delete(l.open, from)
+	n.finish(id, l)
+}
+
+// finish reports the node's part of snapshot id once every channel is closed
+func (n *snapshotNode) finish(id uint64, l *localSnapshot) {
+	if len(l.open) > 0 {
+		return
+	}
+	delete(n.recording, id)
+	n.cluster.report(n.name, id, l)
+}
+
+// BankProcess is a demo SnapshotProcess: an account that on every tick may
+// transfer part of its balance to a random peer. Money is only moved, never
+// created, so in any consistent snapshot the recorded balances plus the
+// transfers in flight add up to what the accounts started with
+type BankProcess struct {
+	balance uint64
+	peers   []string
+	r       *rand.Rand
+}
+
+// NewBankProcess creates an account holding balance that transfers to peers
+func NewBankProcess(balance uint64, peers []string, seed uint64) *BankProcess {
+	return &BankProcess{balance: balance, peers: peers, r: rand.New(rand.NewPCG(seed, balance))}
+}
+
+// Receive implements SnapshotProcess, crediting a transfer
+func (b *BankProcess) Receive(from string, payload []byte, send SendFunc) {
+	amount, _ := binary.Uvarint(payload)
+	b.balance += amount
+}
+
+// Tick implements SnapshotProcess, sending a random transfer half the time
+func (b *BankProcess) Tick(send SendFunc) {
+	if b.balance == 0 || b.r.IntN(2) == 0 {
+		return
+	}
+	amount := 1 + b.r.Uint64N(b.balance)
+	b.balance -= amount
+	send(b.peers[b.r.IntN(len(b.peers))], binary.AppendUvarint(nil, amount))
+}
+
+// State implements SnapshotProcess, encoding the balance as a uvarint
+func (b *BankProcess) State() []byte {
+	return binary.AppendUvarint(nil, b.balance)
+}
+
+// SimulateSnapshots runs nodes bank accounts of 100 each, transferring
+// between each other, takes snapshots of them from rotating initiators and
+// writes each snapshot's balances and money in flight to w. It fails if a
+// snapshot does not add up to the money the accounts started with
+func SimulateSnapshots(w io.Writer, nodes, snapshots int, seed uint64) error {
+	names := make([]string, nodes)
+	for i := range names {
+		names[i] = fmt.Sprintf("node-%d", i)
+	}
+	procs := make(map[string]SnapshotProcess, nodes)
+	for i, name := range names {
+		peers := slices.Delete(slices.Clone(names), i, i+1)
+		procs[name] = NewBankProcess(100, peers, seed+uint64(i))
+	}
+	c, err := NewSnapshotCluster(SnapshotClusterConfig{Processes: procs, TickInterval: time.Millisecond})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	want := 100 * uint64(nodes)
+	for i := range snapshots {
+		time.Sleep(20 * time.Millisecond)
+		select {
+		case err := <-errc:
+			return err
+		default:
+		}
+		snap, err := c.Snapshot(ctx, names[i%nodes])
+		if err != nil {
+			return err
+		}
+		var total, inFlight uint64
+		fmt.Fprintf(w, "snapshot %d from %s:", snap.ID, names[i%nodes])
+		for _, name := range names {
+			balance, _ := binary.Uvarint(snap.States[name])
+			total += balance
+			fmt.Fprintf(w, " %s=%d", name, balance)
+		}
+		for _, msgs := range snap.InFlight {
+			for _, m := range msgs {
+				amount, _ := binary.Uvarint(m)
+				inFlight += amount
+			}
+		}
+		fmt.Fprintf(w, " in flight=%d\n", inFlight)
+		if total+inFlight != want {
+			return fmt.Errorf("snapshot %d holds %d, want %d", snap.ID, total+inFlight, want)
+		}
+	}
+	return nil
+}
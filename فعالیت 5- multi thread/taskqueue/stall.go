@@ -0,0 +1,202 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Stallable is a pool a StallDetector can watch
+type Stallable interface {
+	// Name returns the pool's name
+	Name() string
+	// Metrics returns a snapshot of the pool metrics
+	Metrics() MetricsSnapshot
+}
+
+// StallConfig controls how a StallDetector watches its pool
+type StallConfig struct {
+	// After is how long the pool may keep tasks waiting without completing
+	// any before it counts as stalled, 10s by default
+	After time.Duration
+	// Interval is the sampling period, a tenth of After by default
+	Interval time.Duration
+	// OnStall is called with every stall; by default the stall is logged
+	// to slog's default logger and the stacks written to stderr
+	OnStall func(StallEvent)
+}
+
+// StallEvent describes a pool that stopped making progress: tasks were
+// waiting for a worker, yet none completed for a while, as when every
+// worker is blocked on something that needs a worker of the same pool
+type StallEvent struct {
+	Pool string
+	// Since is when the pool last made progress
+	Since time.Time
+	// Queued, Active and Completed are the pool's counts at detection
+	Queued    int
+	Active    int64
+	Completed int64
+	// Stacks is the stack of every goroutine of the process at detection,
+	// in the format of a panic
+	Stacks []byte
+}
+
+// String implements fmt.Stringer
+func (e StallEvent) String() string {
+	return fmt.Sprintf("pool %s stalled: %d tasks queued and %d running, none completed in %v (%d in all)",
+		e.Pool, e.Queued, e.Active, time.Since(e.Since).Round(time.Millisecond), e.Completed)
+}
+
+// StallDetector is a watchdog reporting when its pool stops making
+// progress. It reports a stall once; another is reported only after the
+// pool has completed a task or emptied its queue
+type StallDetector struct {
+	pool   Stallable
+	config StallConfig
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	// Used only by the sampling loop once started
+	completed int64
+	progress  time.Time
+	reported  bool
+}
+
+// NewStallDetector creates a detector for pool; call Start to begin sampling
+func NewStallDetector(pool Stallable, config StallConfig) *StallDetector {
+	if config.After <= 0 {
+		config.After = 10 * time.Second
+	}
+	if config.Interval <= 0 {
+		config.Interval = config.After / 10
+	}
+	if config.OnStall == nil {
+		config.OnStall = func(e StallEvent) {
+			slog.Warn("pool stalled", LogKeyPool, e.Pool, "since", e.Since, "queued", e.Queued, "active", e.Active, "completed", e.Completed)
+			os.Stderr.Write(e.Stacks)
+		}
+	}
+	return &StallDetector{
+		pool:   pool,
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start launches the sampling loop
+func (d *StallDetector) Start() {
+	d.progress = time.Now()
+	d.completed = d.pool.Metrics().Completed
+	go d.loop()
+}
+
+// Stop ends the sampling loop and waits for it to exit
+func (d *StallDetector) Stop() {
+	d.once.Do(func() { close(d.stop) })
+	<-d.done
+}
+
+// loop samples the pool once per interval
+func (d *StallDetector) loop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.check(time.Now())
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// check takes one sample, reporting a stall if the pool has had tasks
+// waiting and none completed for longer than After
+func (d *StallDetector) check(now time.Time) {
+	m := d.pool.Metrics()
+	if m.Completed != d.completed || m.QueueDepth == 0 {
+		d.completed, d.progress, d.reported = m.Completed, now, false
+		return
+	}
+	if d.reported || now.Sub(d.progress) < d.config.After {
+		return
+	}
+	d.reported = true
+	d.config.OnStall(StallEvent{
+		Pool:      d.pool.Name(),
+		Since:     d.progress,
+		Queued:    m.QueueDepth,
+		Active:    m.Active,
+		Completed: m.Completed,
+		Stacks:    allStacks(),
+	})
+}
+
+// allStacks returns the stack of every goroutine
+func allStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// SimulateStall deadlocks a simple pool on purpose and writes what a
+// StallDetector reports to w. The simple pool takes a worker slot before it
+// spawns a task's goroutine, and Submit blocks until it has one, so tasks
+// that submit subtasks to their own pool and wait for them deadlock once
+// every slot is held by a parent: the children block in Submit forever. The
+// stall is broken with ShutdownNow once reported
+func SimulateStall(w io.Writer, workers int, after time.Duration) error {
+	p := NewSimpleThreadPool(workers)
+	stalled := make(chan StallEvent, 1)
+	detector := NewStallDetector(p, StallConfig{After: after, OnStall: func(e StallEvent) { stalled <- e }})
+	detector.Start()
+	defer detector.Stop()
+
+	start := time.Now()
+	var parents sync.WaitGroup
+	for i := range 2 * workers {
+		parents.Go(func() {
+			p.SubmitCtx(context.Background(), func(ctx context.Context) error {
+				child := p.Submit(func() {})
+				select {
+				case <-child.Done():
+					return child.Err()
+				case <-ctx.Done():
+					return fmt.Errorf("parent %d: %w", i, context.Cause(ctx))
+				}
+			})
+		})
+	}
+
+	var e StallEvent
+	select {
+	case e = <-stalled:
+	case <-time.After(after + 10*time.Second):
+		p.ShutdownNow()
+		return fmt.Errorf("stall: no stall reported within %v of the deadlock", after+10*time.Second)
+	}
+	fmt.Fprintf(w, "detected after %v: %v\n", time.Since(start).Round(time.Millisecond), e)
+	blocked := bytes.Count(e.Stacks, []byte("(*semaphore).acquire"))
+	fmt.Fprintf(w, "%d goroutines dumped, %d of them waiting for a worker slot in SimpleThreadPool.enqueue\n",
+		bytes.Count(e.Stacks, []byte("\ngoroutine "))+1, blocked)
+	p.ShutdownNow()
+	parents.Wait()
+	fmt.Fprintln(w, "ShutdownNow broke the deadlock")
+	return nil
+}
@@ -0,0 +1,48 @@
+package taskqueue
+
+import "time"
+
+// PoolStats is a point-in-time view of a pool's load and latency
+type PoolStats struct {
+	// Workers is the number of workers, or of tasks allowed to run at once
+	Workers int
+	// Running is the number of tasks currently executing
+	Running int
+	// Queued is the number of tasks waiting for a worker
+	Queued int
+	// P50, P95 and P99 are task execution time percentiles
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+	// Throughput is the number of tasks completed per second over the
+	// last throughputWindow seconds
+	Throughput float64
+}
+
+// stats assembles PoolStats from the shared metrics and pool-specific sizes
+func (c *poolCore) stats(workers, queued int) PoolStats {
+	return PoolStats{
+		Workers:    workers,
+		Running:    int(c.metrics.active.Load()),
+		Queued:     queued,
+		P50:        c.metrics.execTime.Quantile(0.50),
+		P95:        c.metrics.execTime.Quantile(0.95),
+		P99:        c.metrics.execTime.Quantile(0.99),
+		Throughput: c.metrics.throughput.rate(time.Now()),
+	}
+}
+
+// Stats returns the current load and latency of the pool
+func (p *SimpleThreadPool) Stats() PoolStats {
+	return p.stats(p.Size(), p.QueueDepth())
+}
+
+// Stats returns the current load and latency of the pool
+func (p *ApacheThreadPool) Stats() PoolStats {
+	return p.stats(p.Size(), p.QueueDepth())
+}
+
+// Stats returns the current load and latency of the pool
+func (p *WorkStealingPool) Stats() PoolStats {
+	return p.stats(len(p.deques), p.QueueDepth())
+}
@@ -0,0 +1,138 @@
+package taskqueue
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// timerQueue fires callbacks at their deadlines from a single goroutine
+// driven by a min-heap of pending timers
+type timerQueue struct {
+	mu      sync.Mutex
+	timers  timerHeap
+	seq     uint64
+	wake    chan struct{}
+	stop    chan struct{}
+	running bool
+	stopped bool
+}
+
+// timerEntry is a callback waiting for its deadline
+type timerEntry struct {
+	at  time.Time
+	seq uint64
+	fn  func()
+	// what describes the timer in a Sim's events
+	what string
+}
+
+// newTimerQueue creates an idle timer queue; its goroutine starts with the
+// first scheduled timer
+func newTimerQueue() *timerQueue {
+	return &timerQueue{
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+}
+
+// schedule arranges for fn to be called on its own goroutine at at; after
+// close, fn is called immediately instead
+func (q *timerQueue) schedule(at time.Time, fn func()) {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		go fn()
+		return
+	}
+	q.seq++
+	heap.Push(&q.timers, &timerEntry{at: at, seq: q.seq, fn: fn})
+	if !q.running {
+		q.running = true
+		go q.loop()
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// len returns the number of pending timers
+func (q *timerQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.timers)
+}
+
+// close stops the queue and fires every pending timer right away so their
+// callbacks can observe the shutdown
+func (q *timerQueue) close() {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return
+	}
+	q.stopped = true
+	pending := q.timers
+	q.timers = nil
+	q.mu.Unlock()
+	close(q.stop)
+
+	for _, t := range pending {
+		go t.fn()
+	}
+}
+
+// loop sleeps until the earliest deadline and fires every due timer
+func (q *timerQueue) loop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		for len(q.timers) > 0 && !q.timers[0].at.After(now) {
+			go heap.Pop(&q.timers).(*timerEntry).fn()
+		}
+		wait := time.Hour
+		if len(q.timers) > 0 {
+			wait = q.timers[0].at.Sub(now)
+		}
+		q.mu.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// timerHeap implements heap.Interface ordered by deadline, then insertion order
+type timerHeap []*timerEntry
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h timerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timerHeap) Push(x any) { *h = append(*h, x.(*timerEntry)) }
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return entry
+}
@@ -0,0 +1,283 @@
+package taskqueue
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TLSConfig names the files a node's TLS credentials are loaded from
+type TLSConfig struct {
+	// CertFile and KeyFile hold the node's PEM certificate chain and private
+	// key; servers need them, clients only for mutual TLS
+	CertFile, KeyFile string
+	// CAFile holds the PEM certificates of the authorities the other end's
+	// certificate must chain to; defaults to the system roots
+	CAFile string
+	// ClientAuth makes servers require a client certificate signed by one of
+	// the authorities, for mutual TLS
+	ClientAuth bool
+	// ReloadInterval is how often Watch checks the files for changes;
+	// defaults to 10s
+	ReloadInterval time.Duration
+	// OnReload, if set, is called after Watch found the files changed, with
+	// the error if they did not load; the credentials loaded before stay in
+	// use then
+	OnReload func(err error)
+}
+
+// withDefaults fills in the unset fields
+func (c TLSConfig) withDefaults() TLSConfig {
+	if c.ReloadInterval <= 0 {
+		c.ReloadInterval = 10 * time.Second
+	}
+	return c
+}
+
+// tlsMaterial is one loaded generation of credentials
+type tlsMaterial struct {
+	cert  *tls.Certificate
+	roots *x509.CertPool
+	// stamp records the sizes and modification times of the files the
+	// material was loaded from
+	stamp string
+}
+
+// TLSCredentials are a node's certificate and the authorities it trusts,
+// reloaded when their files change so that certificates can be rotated
+// without a restart. Connections keep the credentials their handshake used.
+// They are safe for concurrent use
+type TLSCredentials struct {
+	cfg     TLSConfig
+	current atomic.Pointer[tlsMaterial]
+}
+
+// LoadTLSCredentials loads the files named by cfg
+func LoadTLSCredentials(cfg TLSConfig) (*TLSCredentials, error) {
+	c := &TLSCredentials{cfg: cfg.withDefaults()}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the files again if they changed since they were last loaded
+// and reports whether they did
+func (c *TLSCredentials) Reload() (bool, error) {
+	stamp, err := c.stamp()
+	if err != nil {
+		return false, err
+	}
+	if m := c.current.Load(); m != nil && m.stamp == stamp {
+		return false, nil
+	}
+	m := &tlsMaterial{stamp: stamp}
+	if c.cfg.CertFile != "" || c.cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		m.cert = &cert
+	}
+	if c.cfg.CAFile == "" {
+		if m.roots, err = x509.SystemCertPool(); err != nil {
+			return false, err
+		}
+	} else {
+		pem, err := os.ReadFile(c.cfg.CAFile)
+		if err != nil {
+			return false, err
+		}
+		m.roots = x509.NewCertPool()
+		if !m.roots.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("%s: no PEM certificates", c.cfg.CAFile)
+		}
+	}
+	c.current.Store(m)
+	return true, nil
+}
+
+// stamp returns the sizes and modification times of the files
+func (c *TLSCredentials) stamp() (string, error) {
+	var b strings.Builder
+	for _, path := range []string{c.cfg.CertFile, c.cfg.KeyFile, c.cfg.CAFile} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%d@%d;", fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// Watch reloads the credentials whenever their files change, until ctx is
+// done. A certificate and key replaced one after the other fail to load as
+// a pair in between, so a failed reload is retried on the next check
+func (c *TLSCredentials) Watch(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := c.Reload()
+			if (changed || err != nil) && c.cfg.OnReload != nil {
+				c.cfg.OnReload(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Config returns a configuration for both ends of connections, which picks
+// up the current credentials on every handshake. As a server it presents the
+// node's certificate and, with ClientAuth, verifies the client's; as a
+// client it verifies the server's certificate and presents the node's if the
+// server asks for one
+func (c *TLSCredentials) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: c.serverConfig,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert := c.current.Load().cert; cert != nil {
+				return cert, nil
+			}
+			return nil, errors.New("tls: no server certificate configured")
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := c.current.Load().cert; cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+		// The authorities may be rotated, so the server's chain is verified
+		// against the current ones instead of a pool fixed in the config
+		InsecureSkipVerify: true,
+		VerifyConnection:   c.verifyServer,
+	}
+}
+
+// serverConfig is the configuration of one handshake as a server
+func (c *TLSCredentials) serverConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	m := c.current.Load()
+	if m.cert == nil {
+		return nil, errors.New("tls: no server certificate configured")
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*m.cert}}
+	if c.cfg.ClientAuth {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = m.roots
+	}
+	return cfg, nil
+}
+
+// verifyServer verifies the chain a server presented for the name dialed
+func (c *TLSCredentials) verifyServer(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("tls: server presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         c.current.Load().roots,
+		DNSName:       state.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// tlsWithNextProtos returns a copy of cfg offering protos in ALPN, including
+// in the configurations its GetConfigForClient returns
+func tlsWithNextProtos(cfg *tls.Config, protos ...string) *tls.Config {
+	add := func(cfg *tls.Config) {
+		for _, p := range protos {
+			if !slices.Contains(cfg.NextProtos, p) {
+				cfg.NextProtos = append(cfg.NextProtos, p)
+			}
+		}
+	}
+	cfg = cfg.Clone()
+	add(cfg)
+	if get := cfg.GetConfigForClient; get != nil {
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if c != nil {
+				c = c.Clone()
+				add(c)
+			}
+			return c, err
+		}
+	}
+	return cfg
+}
+
+// PeerIdentity is what the certificate the other end of a connection
+// presented says about it. The certificate was verified unless the TLS
+// configuration skips verification without checking it otherwise
+type PeerIdentity struct {
+	// Name is the certificate's common name, or its first DNS name if it has
+	// no common name
+	Name     string
+	DNSNames []string
+	URIs     []string
+	// Certificate is the certificate itself
+	Certificate *x509.Certificate
+}
+
+// peerIdentity returns the identity in state, if the other end presented a
+// certificate
+func peerIdentity(state *tls.ConnectionState) (PeerIdentity, bool) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return PeerIdentity{}, false
+	}
+	cert := state.PeerCertificates[0]
+	p := PeerIdentity{Name: cert.Subject.CommonName, DNSNames: cert.DNSNames, Certificate: cert}
+	if p.Name == "" && len(cert.DNSNames) > 0 {
+		p.Name = cert.DNSNames[0]
+	}
+	for _, u := range cert.URIs {
+		p.URIs = append(p.URIs, u.String())
+	}
+	return p, true
+}
+
+// PeerOf returns the identity of the other end of conn, if it presented a
+// certificate; on an accepted connection it waits for the handshake
+func PeerOf(conn Conn) (PeerIdentity, bool) {
+	if c, ok := conn.(interface{ Peer() (PeerIdentity, bool) }); ok {
+		return c.Peer()
+	}
+	return PeerIdentity{}, false
+}
+
+// PeerFromRequest returns the identity of the client that sent r, if it
+// presented a certificate
+func PeerFromRequest(r *http.Request) (PeerIdentity, bool) {
+	return peerIdentity(r.TLS)
+}
+
+// peerKey is the context key under which workers and RPC servers pass the
+// identity of the other end of a connection to their handlers
+type peerKey struct{}
+
+// PeerFromContext returns the identity of the node whose connection a task
+// handler or RPC method is serving, if that node presented a certificate:
+// the coordinator for a worker's task handlers and the client for an
+// RPCServer's methods
+func PeerFromContext(ctx context.Context) (PeerIdentity, bool) {
+	p, ok := ctx.Value(peerKey{}).(PeerIdentity)
+	return p, ok
+}
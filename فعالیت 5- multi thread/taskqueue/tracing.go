@@ -0,0 +1,343 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"runtime/pprof"
+	"runtime/trace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceTask runs fn directly, or, when the pool was created with
+// WithExecutionTracing, under pprof labels identifying the pool and task and
+// inside a runtime/trace region so profiles and traces can be broken down per pool
+func (c *poolCore) traceTask(ctx context.Context, info TaskInfo, fn func(ctx context.Context)) {
+	if !c.config.tracing {
+		fn(ctx)
+		return
+	}
+	labels := pprof.Labels("pool", c.config.name, "task", strconv.FormatUint(info.ID, 10))
+	pprof.Do(ctx, labels, func(ctx context.Context) {
+		trace.WithRegion(ctx, c.config.name+".task", func() { fn(ctx) })
+	})
+}
+
+// SpanContext identifies a span within its trace, as carried between
+// processes in a W3C traceparent header
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span IDs are set
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != [16]byte{} && s.SpanID != [8]byte{}
+}
+
+// Traceparent encodes s as a W3C traceparent value, or returns "" if s is
+// not valid
+func (s SpanContext) Traceparent() string {
+	if !s.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent decodes a W3C traceparent value
+func ParseTraceparent(v string) (SpanContext, error) {
+	var s SpanContext
+	parts := strings.Split(v, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return s, fmt.Errorf("malformed traceparent %q", v)
+	}
+	_, err1 := hex.Decode(s.TraceID[:], []byte(parts[1]))
+	_, err2 := hex.Decode(s.SpanID[:], []byte(parts[2]))
+	flags, err3 := hex.DecodeString(parts[3])
+	if err := errors.Join(err1, err2, err3); err != nil || !s.IsValid() {
+		return SpanContext{}, fmt.Errorf("malformed traceparent %q", v)
+	}
+	s.Sampled = flags[0]&1 != 0
+	return s, nil
+}
+
+// Attribute is a key-value pair describing a span
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// Span is an operation within a trace. Its methods are safe for concurrent
+// use and do nothing once it has ended
+type Span interface {
+	// SpanContext returns the span's identity
+	SpanContext() SpanContext
+	// SetAttributes adds attributes, replacing any with the same key
+	SetAttributes(attrs ...Attribute)
+	// RecordError marks the span as failed with err
+	RecordError(err error)
+	// End completes the span
+	End()
+}
+
+// Tracer starts spans
+type Tracer interface {
+	// Start begins a span named name as a child of the span in ctx, if any,
+	// and returns it along with a context holding it
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// TracerProvider hands out the tracers of an instrumented component. It is
+// the point where an application plugs in its tracing backend, for instance
+// with an adapter to an OpenTelemetry SDK
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+// spanKey is the context key of the current span
+type spanKey struct{}
+
+// ContextWithSpan returns a context holding span as the current span;
+// Tracer implementations use it to parent the spans they start
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the current span of ctx, or a span that records
+// nothing if there is none
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// ContextWithRemoteSpanContext returns a context whose current span is the
+// span s identifies in another process, so that spans started from it join
+// that trace
+func ContextWithRemoteSpanContext(ctx context.Context, s SpanContext) context.Context {
+	return ContextWithSpan(ctx, noopSpan{s})
+}
+
+// noopSpan carries a span context without recording anything
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (s noopSpan) SpanContext() SpanContext { return s.sc }
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// noopTracer starts spans that record nothing but keep the parent's context
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := noopSpan{SpanFromContext(ctx).SpanContext()}
+	return ContextWithSpan(ctx, span), span
+}
+
+// tracerOf returns the tracer tp provides under name, or one that records
+// nothing if tp is nil
+func tracerOf(tp TracerProvider, name string) Tracer {
+	if tp == nil {
+		return noopTracer{}
+	}
+	return tp.Tracer(name)
+}
+
+// SpanData is a finished span as handed to a SpanExporter
+type SpanData struct {
+	Name        string
+	Tracer      string
+	SpanContext SpanContext
+	Parent      [8]byte
+	Start, End  time.Time
+	Attributes  []Attribute
+	Error       string
+}
+
+// Duration returns how long the span lasted
+func (d *SpanData) Duration() time.Duration {
+	return d.End.Sub(d.Start)
+}
+
+// SpanExporter receives every span a BasicTracerProvider records once it
+// ends; calls may come from any goroutine
+type SpanExporter interface {
+	ExportSpan(span *SpanData)
+}
+
+// BasicTracerProvider is a TracerProvider that records spans with random
+// IDs, sampling every trace, and hands them to an exporter
+type BasicTracerProvider struct {
+	exporter SpanExporter
+}
+
+// NewBasicTracerProvider creates a provider exporting to exporter
+func NewBasicTracerProvider(exporter SpanExporter) *BasicTracerProvider {
+	return &BasicTracerProvider{exporter: exporter}
+}
+
+// Tracer implements TracerProvider
+func (p *BasicTracerProvider) Tracer(name string) Tracer {
+	return &basicTracer{name: name, exporter: p.exporter}
+}
+
+// basicTracer starts the spans of a BasicTracerProvider
+type basicTracer struct {
+	name     string
+	exporter SpanExporter
+}
+
+func (t *basicTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent := SpanFromContext(ctx).SpanContext()
+	span := &basicSpan{exporter: t.exporter, data: SpanData{Name: name, Tracer: t.name, Start: time.Now()}}
+	span.data.SpanContext.Sampled = true
+	if parent.IsValid() {
+		span.data.SpanContext.TraceID = parent.TraceID
+		span.data.Parent = parent.SpanID
+	} else {
+		binary.LittleEndian.PutUint64(span.data.SpanContext.TraceID[:8], rand.Uint64())
+		binary.LittleEndian.PutUint64(span.data.SpanContext.TraceID[8:], rand.Uint64()|1)
+	}
+	binary.LittleEndian.PutUint64(span.data.SpanContext.SpanID[:], rand.Uint64()|1)
+	return ContextWithSpan(ctx, span), span
+}
+
+// basicSpan is a span recorded by a basicTracer
+type basicSpan struct {
+	exporter SpanExporter
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+func (s *basicSpan) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+func (s *basicSpan) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	for _, a := range attrs {
+		i := slices.IndexFunc(s.data.Attributes, func(b Attribute) bool { return b.Key == a.Key })
+		if i >= 0 {
+			s.data.Attributes[i] = a
+		} else {
+			s.data.Attributes = append(s.data.Attributes, a)
+		}
+	}
+}
+
+func (s *basicSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended && err != nil {
+		s.data.Error = err.Error()
+	}
+}
+
+func (s *basicSpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if s.exporter != nil {
+		s.exporter.ExportSpan(&data)
+	}
+}
+
+// SpanRecorder is a SpanExporter keeping the spans in memory, for tests and
+// tools that inspect traces in process
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// ExportSpan implements SpanExporter
+func (r *SpanRecorder) ExportSpan(span *SpanData) {
+	r.mu.Lock()
+	r.spans = append(r.spans, *span)
+	r.mu.Unlock()
+}
+
+// Spans returns the recorded spans in the order they ended
+func (r *SpanRecorder) Spans() []SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.spans)
+}
+
+// JSONSpanExporter writes each span as a line of JSON
+type JSONSpanExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONSpanExporter creates an exporter writing to w
+func NewJSONSpanExporter(w io.Writer) *JSONSpanExporter {
+	return &JSONSpanExporter{enc: json.NewEncoder(w)}
+}
+
+// ExportSpan implements SpanExporter
+func (e *JSONSpanExporter) ExportSpan(span *SpanData) {
+	attrs := make(map[string]string, len(span.Attributes))
+	for _, a := range span.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.enc.Encode(struct {
+		Name       string            `json:"name"`
+		Tracer     string            `json:"tracer"`
+		TraceID    string            `json:"trace_id"`
+		SpanID     string            `json:"span_id"`
+		Parent     string            `json:"parent_id,omitempty"`
+		Start      time.Time         `json:"start"`
+		DurationUS int64             `json:"duration_us"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+		Error      string            `json:"error,omitempty"`
+	}{
+		Name:       span.Name,
+		Tracer:     span.Tracer,
+		TraceID:    hex.EncodeToString(span.SpanContext.TraceID[:]),
+		SpanID:     hex.EncodeToString(span.SpanContext.SpanID[:]),
+		Parent:     parentID(span.Parent),
+		Start:      span.Start,
+		DurationUS: span.Duration().Microseconds(),
+		Attributes: attrs,
+		Error:      span.Error,
+	})
+}
+
+// parentID hex-encodes a parent span ID, or returns "" for a root span
+func parentID(id [8]byte) string {
+	if id == [8]byte{} {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,277 @@
+package taskqueue
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxFrameSize bounds a single message on the wire
+const maxFrameSize = 16 << 20
+
+// Conn is a message-oriented connection between two nodes; Send may be
+// called concurrently, Recv from one goroutine at a time
+type Conn interface {
+	Send(m *Message) error
+	Recv() (*Message, error)
+	Close() error
+	RemoteAddr() string
+}
+
+// Listener accepts incoming connections
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+	Addr() string
+}
+
+// Transport connects nodes; the distributed components only talk through it
+// so the network can be swapped for TLS, an in-memory fake or a faulty one
+type Transport interface {
+	Dial(ctx context.Context, addr string) (Conn, error)
+	Listen(addr string) (Listener, error)
+}
+
+// TCPTransport carries messages over TCP, as length-prefixed frames unless
+// the format streams them
+type TCPTransport struct {
+	Dialer net.Dialer
+	// Format is the wire format of the connections Dial opens; defaults to
+	// WireBinary. Listeners accept connections in every format
+	Format WireFormat
+	// TLS, if set, secures the connections Dial opens and Listen accepts;
+	// TLSCredentials.Config returns one that does both and, with ClientAuth,
+	// verifies the dialing end too
+	TLS *tls.Config
+}
+
+// Dial implements Transport
+func (t *TCPTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	var c net.Conn
+	var err error
+	if t.TLS != nil {
+		d := tls.Dialer{NetDialer: &t.Dialer, Config: t.TLS}
+		c, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		c, err = t.Dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	format := t.Format
+	if format == 0 {
+		format = WireBinary
+	}
+	return dialStreamConn(ctx, c, format)
+}
+
+// Listen implements Transport
+func (t *TCPTransport) Listen(addr string) (Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.TLS != nil {
+		// The handshake happens on the connection's first use rather than
+		// in Accept
+		l = tls.NewListener(l, t.TLS)
+	}
+	return &streamListener{l}, nil
+}
+
+// streamListener adapts a net.Listener to Listener
+type streamListener struct {
+	l net.Listener
+}
+
+func (l *streamListener) Accept() (Conn, error) {
+	c, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return acceptStreamConn(c), nil
+}
+
+func (l *streamListener) Close() error { return l.l.Close() }
+
+func (l *streamListener) Addr() string { return l.l.Addr().String() }
+
+// streamConn carries messages over any byte stream. The dialing end first
+// sends one byte naming the WireFormat, then both ends exchange messages in
+// it, in most formats each as a 4-byte big-endian length followed by the
+// encoded message
+type streamConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+	w    *bufio.Writer
+
+	// handshake reads the format byte of an accepted connection before its
+	// first Send or Recv, which both wait for it
+	handshake sync.Once
+	codec     wireCodec
+	err       error
+}
+
+// dialStreamConn wraps the dialed c and announces format to the other end
+// straight away, since that end may wait for it before sending anything
+func dialStreamConn(ctx context.Context, c net.Conn, format WireFormat) (*streamConn, error) {
+	s := &streamConn{conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	var err error
+	if s.codec, err = newWireCodec(format, s.r, s.w); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetWriteDeadline(deadline)
+		defer c.SetWriteDeadline(time.Time{})
+	}
+	if _, err := c.Write([]byte{byte(format)}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// acceptStreamConn wraps the accepted c, reading its format on first use
+// rather than holding up the accept loop for it
+func acceptStreamConn(c net.Conn) *streamConn {
+	return &streamConn{conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+}
+
+// ready waits for the connection's format to be known
+func (c *streamConn) ready() error {
+	c.handshake.Do(func() {
+		if c.codec != nil {
+			return
+		}
+		b, err := c.r.ReadByte()
+		if err == nil {
+			c.codec, err = newWireCodec(WireFormat(b), c.r, c.w)
+		}
+		if err != nil {
+			c.err = err
+			c.conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *streamConn) Send(m *Message) error {
+	if err := c.ready(); err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.codec.write(c.w, m); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *streamConn) Recv() (*Message, error) {
+	if err := c.ready(); err != nil {
+		return nil, err
+	}
+	return c.codec.read(c.r)
+}
+
+func (c *streamConn) Close() error { return c.conn.Close() }
+
+func (c *streamConn) RemoteAddr() string { return c.conn.RemoteAddr().String() }
+
+// Peer returns the identity the other end proved during the TLS handshake,
+// waiting for the handshake if it has not happened yet
+func (c *streamConn) Peer() (PeerIdentity, bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok || tc.Handshake() != nil {
+		return PeerIdentity{}, false
+	}
+	state := tc.ConnectionState()
+	return peerIdentity(&state)
+}
+
+// writeFrame writes b prefixed with its length
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(b)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads one length-prefixed frame
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// RoundTrip sends m to addr over a fresh connection and, if wantReply is
+// set, waits for the reply; the whole exchange is abandoned after timeout
+func RoundTrip(ctx context.Context, t Transport, addr string, m *Message, wantReply bool, timeout time.Duration) (*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := t.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := conn.Send(m); err != nil || !wantReply {
+		return nil, err
+	}
+	return conn.Recv()
+}
+
+// ServeRequests listens on addr and calls handle with the first message of
+// every connection, the server half of RoundTrip, until ctx is cancelled;
+// the connection is closed when handle returns
+func ServeRequests(ctx context.Context, t Transport, addr string, handle func(context.Context, Conn, *Message)) error {
+	l, err := t.Listen(addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if m, err := conn.Recv(); err == nil {
+				handle(ctx, conn, m)
+			}
+		}()
+	}
+}
@@ -0,0 +1,108 @@
+package taskqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// Pool is a worker pool applying one function from T to R to every input;
+// it runs on an ApacheThreadPool, so every Option applies
+type Pool[T, R any] struct {
+	pool *ApacheThreadPool
+	fn   func(ctx context.Context, in T) (R, error)
+}
+
+// Result pairs an input of a Pool with the value or error it produced
+type Result[T, R any] struct {
+	Input T
+	Value R
+	Err   error
+}
+
+// NewPool creates a typed pool of numWorkers workers running fn
+func NewPool[T, R any](numWorkers int, fn func(ctx context.Context, in T) (R, error), opts ...Option) *Pool[T, R] {
+	return &Pool[T, R]{pool: NewApacheThreadPool(numWorkers, opts...), fn: fn}
+}
+
+// Submit enqueues in and returns a future holding its result
+func (p *Pool[T, R]) Submit(in T) *TypedFuture[R] {
+	return p.SubmitCtx(context.Background(), in)
+}
+
+// SubmitCtx enqueues in, dropping it if ctx is cancelled before it starts;
+// the function observes ctx while it runs
+func (p *Pool[T, R]) SubmitCtx(ctx context.Context, in T) *TypedFuture[R] {
+	j := p.pool.newJob(ctx, func(ctx context.Context) (any, error) {
+		return p.fn(ctx, in)
+	})
+	return &TypedFuture[R]{future: p.pool.submitJob(j)}
+}
+
+// Stream submits every value received from in and delivers the results on
+// the returned channel in completion order; the channel is closed once in is
+// closed and every result has been delivered, or once ctx is cancelled
+func (p *Pool[T, R]) Stream(ctx context.Context, in <-chan T) <-chan Result[T, R] {
+	out := make(chan Result[T, R])
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(out)
+		}()
+		for {
+			var v T
+			var ok bool
+			select {
+			case v, ok = <-in:
+			case <-ctx.Done():
+				return
+			}
+			if !ok {
+				return
+			}
+			future := p.SubmitCtx(ctx, v)
+			wg.Go(func() {
+				value, err := future.Get()
+				select {
+				case out <- Result[T, R]{Input: v, Value: value, Err: err}:
+				case <-ctx.Done():
+				}
+			})
+		}
+	}()
+	return out
+}
+
+// Map runs every input and returns the results in input order together with
+// the first error encountered, if any
+func (p *Pool[T, R]) Map(inputs []T) ([]R, error) {
+	futures := make([]*TypedFuture[R], len(inputs))
+	for i, in := range inputs {
+		futures[i] = p.Submit(in)
+	}
+	results := make([]R, len(inputs))
+	var firstErr error
+	for i, f := range futures {
+		v, err := f.Get()
+		results[i] = v
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return results, firstErr
+}
+
+// Executor returns the underlying pool, e.g. for metrics or untyped tasks
+func (p *Pool[T, R]) Executor() *ApacheThreadPool {
+	return p.pool
+}
+
+// WaitForCompletion blocks until every submitted input has been processed
+func (p *Pool[T, R]) WaitForCompletion() {
+	p.pool.WaitForCompletion()
+}
+
+// Shutdown stops accepting inputs and waits for the submitted ones to finish
+func (p *Pool[T, R]) Shutdown() {
+	p.pool.Shutdown()
+}
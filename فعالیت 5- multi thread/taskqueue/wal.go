@@ -0,0 +1,265 @@
+package taskqueue
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"multithread/internal/wire"
+)
+
+// TaskLog is an append-only write-ahead log of remote tasks. A task is
+// logged, and the log synced, before Submit returns; its completion is
+// logged when its future completes. Reopening the log after a crash yields
+// the tasks that never completed
+type TaskLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	pending []*Message
+	maxID   uint64
+}
+
+// OpenTaskLog opens or creates the log at path, collects its unfinished tasks
+// and compacts the file down to them; a torn record at the end, left by a
+// crash mid-write, is discarded
+func OpenTaskLog(path string) (*TaskLog, error) {
+	pending, maxID, err := replayTaskLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rewrite the survivors to a new file and swap it in atomically
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	l := &TaskLog{file: file, w: bufio.NewWriter(file), pending: pending, maxID: maxID}
+	for _, m := range pending {
+		if err := l.write(m); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	// A completion record carries a highest ID that finished over to the
+	// next replay, so that no ID is handed out twice
+	if n := len(pending); maxID > 0 && (n == 0 || pending[n-1].ID < maxID) {
+		if err := l.write(&Message{Type: MsgResult, ID: maxID}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := l.sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// replayTaskLog returns the tasks logged at path without a completion, in
+// submission order, and the highest task ID seen
+func replayTaskLog(path string) ([]*Message, uint64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	open := make(map[uint64]*Message)
+	var maxID uint64
+	for {
+		m, err := readLogRecord(r)
+		if err != nil {
+			// io.EOF ends a clean log; anything else is a torn tail
+			break
+		}
+		maxID = max(maxID, m.ID)
+		switch m.Type {
+		case MsgDispatch:
+			open[m.ID] = m
+		case MsgResult:
+			delete(open, m.ID)
+		}
+	}
+
+	pending := make([]*Message, 0, len(open))
+	for _, m := range open {
+		pending = append(pending, m)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	return pending, maxID, nil
+}
+
+// Pending returns the tasks that were unfinished when the log was opened
+func (l *TaskLog) Pending() []*Message {
+	return l.pending
+}
+
+// logSubmit durably records a submitted task
+func (l *TaskLog) logSubmit(id uint64, key, route, correlation, task string, payload []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.write(&Message{Type: MsgDispatch, ID: id, Key: key, Route: route, Task: task, Payload: payload, Correlation: correlation}); err != nil {
+		return err
+	}
+	return l.sync()
+}
+
+// logDone records that a task completed; losing this record in a crash only
+// means the task is replayed, so it is not synced
+func (l *TaskLog) logDone(id uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.write(&Message{Type: MsgResult, ID: id}); err != nil {
+		return err
+	}
+	return l.w.Flush()
+}
+
+// write appends m as one record
+func (l *TaskLog) write(m *Message) error {
+	body, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return wire.WriteRecord(l.w, body)
+}
+
+// sync flushes buffered records and syncs the file
+func (l *TaskLog) sync() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// readLogRecord reads one message record
+func readLogRecord(r io.Reader) (*Message, error) {
+	body, err := wire.ReadRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Message)
+	return m, m.UnmarshalBinary(body)
+}
+
+// Close syncs and closes the log
+func (l *TaskLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.sync()
+	return errors.Join(err, l.file.Close())
+}
+
+// StateLog is an append-only log of the states of long-running operations,
+// such as 2PC transactions and sagas. Every record is a Message whose Key
+// identifies the operation and holds its whole state, until a MsgResult
+// record marks it finished. Only the latest record of an operation matters,
+// so opening the log compacts it down to the latest record of each
+// unfinished one
+type StateLog struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// OpenStateLog opens or creates the log at path and returns the latest
+// record of every unfinished operation, in the order they began; a torn
+// record at the end is discarded. An empty path gives a log that records
+// nothing
+func OpenStateLog(path string) (*StateLog, []*Message, error) {
+	if path == "" {
+		return &StateLog{}, nil, nil
+	}
+	latest := make(map[string]*Message)
+	var order []string
+	if f, err := os.Open(path); err == nil {
+		r := bufio.NewReader(f)
+		for {
+			m, err := readLogRecord(r)
+			if err != nil {
+				break
+			}
+			if _, seen := latest[m.Key]; !seen {
+				order = append(order, m.Key)
+			}
+			latest[m.Key] = m
+		}
+		f.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	var open []*Message
+	for _, id := range order {
+		if m := latest[id]; m.Type != MsgResult {
+			open = append(open, m)
+		}
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := &StateLog{file: file, w: bufio.NewWriter(file)}
+	for _, m := range open {
+		if err := l.Write(m, false); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+	if err := l.Write(nil, true); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return l, open, nil
+}
+
+// Write appends m, if not nil, and syncs the file if sync is set; records
+// that are only flushed can be lost in a crash, which must be harmless
+func (l *StateLog) Write(m *Message, sync bool) error {
+	if l.file == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m != nil {
+		body, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := wire.WriteRecord(l.w, body); err != nil {
+			return err
+		}
+	}
+	if err := l.w.Flush(); err != nil || !sync {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Close syncs and closes the log
+func (l *StateLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.Write(nil, true)
+	return errors.Join(err, l.file.Close())
+}
@@ -0,0 +1,103 @@
+package taskqueue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"multithread/internal/wire"
+)
+
+// pendingIDs returns the IDs of tasks, checking that each kept the payload
+// it was logged with
+func pendingIDs(t *testing.T, tasks []*Message) []uint64 {
+	t.Helper()
+	var ids []uint64
+	for _, m := range tasks {
+		if want := fmt.Sprintf("payload-%d", m.ID); m.Type != MsgDispatch || m.Task != "echo" || string(m.Payload) != want {
+			t.Errorf("task %d replayed as %v %q %q, want a dispatch of echo with %q", m.ID, m.Type, m.Task, m.Payload, want)
+		}
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestTaskLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.wal")
+	l, err := OpenTaskLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint64(1); id <= 6; id++ {
+		if err := l.logSubmit(id, "", "", "", "echo", fmt.Appendf(nil, "payload-%d", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The highest ID completing must still count towards the next one
+	for _, id := range []uint64{2, 4, 6} {
+		if err := l.logDone(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash mid-write leaves a torn record, whose ID must not count
+	var torn bytes.Buffer
+	body, _ := (&Message{Type: MsgDispatch, ID: 9, Task: "echo", Payload: []byte("payload-9")}).MarshalBinary()
+	if err := wire.WriteRecord(&torn, body); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(torn.Bytes()[:torn.Len()-3]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for range 2 {
+		// Reopening twice also checks the compacted log replays the same
+		l, err = OpenTaskLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := pendingIDs(t, l.Pending()), []uint64{1, 3, 5}; !slices.Equal(got, want) {
+			t.Fatalf("replayed tasks %v, want %v", got, want)
+		}
+		if l.maxID != 6 {
+			t.Fatalf("replayed highest ID %d, want 6", l.maxID)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err = OpenTaskLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c := NewCoordinator(WithTaskLog(l))
+	defer c.Close()
+	c.mu.Lock()
+	next, queued := c.nextID, len(c.queue)
+	c.mu.Unlock()
+	if next != 6 || queued != 3 {
+		t.Fatalf("coordinator resumed at ID %d with %d tasks queued, want 6 and 3", next, queued)
+	}
+	c.Submit(context.Background(), "echo", []byte("payload-7"))
+	pending, maxID, err := replayTaskLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pendingIDs(t, pending), []uint64{1, 3, 5, 7}; !slices.Equal(got, want) || maxID != 7 {
+		t.Fatalf("after a submit the log holds %v up to ID %d, want %v up to 7", got, maxID, want)
+	}
+}
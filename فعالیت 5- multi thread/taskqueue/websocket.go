@@ -0,0 +1,468 @@
+package taskqueue
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsGUID is appended to a handshake's key to prove the server speaks
+// WebSocket
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// errMalformedWebSocket is reported for frames breaking the protocol
+var errMalformedWebSocket = errors.New("malformed WebSocket frame")
+
+// wsConn exchanges WebSocket messages over a connection whose handshake is
+// done. Writes may be concurrent, reads come from one goroutine at a time
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// client is set on the dialing end, which masks what it sends and
+	// expects unmasked frames back
+	client bool
+
+	wmu sync.Mutex
+	// closeSent is set once a close frame was sent, after which nothing is
+	closeSent bool
+}
+
+// wsAcceptKey returns the Sec-WebSocket-Accept value answering key
+func wsAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerHasToken reports whether the comma-separated header value v lists
+// token, ignoring case
+func headerHasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket answers the opening handshake of r and takes over its
+// connection, or replies with an error and fails
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header.Get("Connection"), "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("websocket: not a handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "cannot take over the connection", http.StatusInternalServerError)
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAcceptKey(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// dialWebSocket opens a WebSocket connection to u, a ws or wss URL, sending
+// header with the handshake
+func dialWebSocket(ctx context.Context, u *url.URL, tlsConfig *tls.Config, header http.Header) (*wsConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	var d net.Dialer
+	var conn net.Conn
+	var err error
+	switch u.Scheme {
+	case "ws":
+		conn, err = d.DialContext(ctx, "tcp", host)
+	case "wss":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		td := tls.Dialer{NetDialer: &d, Config: tlsWithNextProtos(tlsConfig, "http/1.1")}
+		conn, err = td.DialContext(ctx, "tcp", host)
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: make(http.Header)}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		conn.Close()
+		return nil, fmt.Errorf("websocket: handshake refused: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return nil, errors.New("websocket: handshake answered with the wrong key")
+	}
+	if !stop() {
+		conn.Close()
+		return nil, context.Cause(ctx)
+	}
+	return &wsConn{conn: conn, r: r, client: true}, nil
+}
+
+// writeFrame sends one unfragmented frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closeSent = true
+	}
+	b := make([]byte, 0, 14+len(payload))
+	b = append(b, 0x80|opcode)
+	var mask byte
+	if c.client {
+		mask = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, mask|byte(n))
+	case n <= 0xffff:
+		b = append(b, mask|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, mask|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if c.client {
+		var key [4]byte
+		rand.Read(key[:])
+		b = append(b, key[:]...)
+		start := len(b)
+		b = append(b, payload...)
+		for i := range b[start:] {
+			b[start+i] ^= key[i%4]
+		}
+	} else {
+		b = append(b, payload...)
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// readMessage returns the next data message and whether it is text,
+// answering pings and closes on the way; a close from the other end is
+// io.EOF
+func (c *wsConn) readMessage() ([]byte, bool, error) {
+	var msg []byte
+	var text, started bool
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, false, err
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+		masked := header[1]&0x80 != 0
+		if header[0]&0x70 != 0 || masked == c.client {
+			// No extensions are negotiated, and only clients mask
+			return nil, false, errMalformedWebSocket
+		}
+		n := uint64(header[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return nil, false, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				return nil, false, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		control := opcode&0x08 != 0
+		if control && (n > 125 || !fin) || uint64(len(msg))+n > maxFrameSize {
+			return nil, false, errMalformedWebSocket
+		}
+		var key [4]byte
+		if masked {
+			if _, err := io.ReadFull(c.r, key[:]); err != nil {
+				return nil, false, err
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return nil, false, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= key[i%4]
+			}
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, false, err
+			}
+		case wsPong:
+		case wsClose:
+			// Echo the status code, as the closing handshake asks
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return nil, false, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, false, errMalformedWebSocket
+			}
+			started, text = true, opcode == wsText
+			msg = append(msg, payload...)
+		case wsContinuation:
+			if !started {
+				return nil, false, errMalformedWebSocket
+			}
+			msg = append(msg, payload...)
+		default:
+			return nil, false, errMalformedWebSocket
+		}
+		if started && fin && !control {
+			return msg, text, nil
+		}
+	}
+}
+
+// close sends a close frame with status 1000 and closes the connection
+func (c *wsConn) close() error {
+	c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, 1000))
+	return c.conn.Close()
+}
+
+// tlsState returns the TLS state of the connection, if it has one
+func (c *wsConn) tlsState() *tls.ConnectionState {
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+// WebSocketTransport carries messages over WebSocket connections, for
+// networks that only let HTTP through and for peers written against a
+// browser's WebSocket API. Messages travel as binary frames holding their
+// binary encoding, or as text frames holding their JSON: listeners answer a
+// peer in the form it last sent, so a script can take part with JSON alone
+type WebSocketTransport struct {
+	// TLS, if set, makes Dial use wss and Listen serve over TLS, as with
+	// TCPTransport
+	TLS *tls.Config
+	// Path is where listeners take connections; defaults to "/ws"
+	Path string
+	// Header is sent with every handshake Dial makes, such as an
+	// Authorization header for a proxy in front of the listener
+	Header http.Header
+}
+
+// path returns the configured path or its default
+func (t *WebSocketTransport) path() string {
+	if t.Path != "" {
+		return t.Path
+	}
+	return "/ws"
+}
+
+// Dial implements Transport; addr is host:port, or a ws or wss URL to dial
+// as it is
+func (t *WebSocketTransport) Dial(ctx context.Context, addr string) (Conn, error) {
+	raw := addr
+	if !strings.Contains(addr, "://") {
+		scheme := "ws"
+		if t.TLS != nil {
+			scheme = "wss"
+		}
+		raw = scheme + "://" + addr + t.path()
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := dialWebSocket(ctx, u, t.TLS, t.Header)
+	if err != nil {
+		return nil, err
+	}
+	return &wsMessageConn{ws: ws, remote: ws.conn.RemoteAddr().String()}, nil
+}
+
+// Listen implements Transport, serving the handshakes at the transport's
+// path over HTTP on addr
+func (t *WebSocketTransport) Listen(addr string) (Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	wl := &wsListener{addr: l.Addr().String(), conns: make(chan Conn), done: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.Handle(t.path(), wl)
+	wl.srv = &http.Server{Handler: mux}
+	if t.TLS != nil {
+		l = tls.NewListener(l, tlsWithNextProtos(t.TLS, "http/1.1"))
+	}
+	go wl.srv.Serve(l)
+	return wl, nil
+}
+
+// wsListener hands the connections upgraded by its HTTP server to Accept.
+// Closing it stops the server; the connections accepted stay open
+type wsListener struct {
+	addr  string
+	srv   *http.Server
+	conns chan Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// ServeHTTP upgrades r and waits for the connection to be accepted
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	c := &wsMessageConn{ws: ws, remote: r.RemoteAddr, tls: r.TLS}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		ws.close()
+	}
+}
+
+func (l *wsListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.srv.Close()
+	})
+	return err
+}
+
+func (l *wsListener) Addr() string { return l.addr }
+
+// wsMessageConn is a Conn over a WebSocket connection
+type wsMessageConn struct {
+	ws     *wsConn
+	remote string
+	tls    *tls.ConnectionState
+	// text is set once the peer sent JSON, which it is then answered in
+	text atomic.Bool
+}
+
+func (c *wsMessageConn) Send(m *Message) error {
+	if c.text.Load() {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return c.ws.writeFrame(wsText, b)
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.ws.writeFrame(wsBinary, b)
+}
+
+func (c *wsMessageConn) Recv() (*Message, error) {
+	b, text, err := c.ws.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	m := new(Message)
+	if text {
+		c.text.Store(true)
+		err = json.Unmarshal(b, m)
+	} else {
+		err = m.UnmarshalBinary(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *wsMessageConn) Close() error { return c.ws.close() }
+
+func (c *wsMessageConn) RemoteAddr() string { return c.remote }
+
+// Peer returns the identity the other end proved during the TLS handshake
+func (c *wsMessageConn) Peer() (PeerIdentity, bool) {
+	if c.tls != nil {
+		return peerIdentity(c.tls)
+	}
+	return peerIdentity(c.ws.tlsState())
+}
@@ -0,0 +1,132 @@
+package taskqueue
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// WireFormat is how a TCP connection encodes its messages. The dialing end
+// picks it and announces it in the first byte it sends, so a listener serves
+// peers using any format side by side
+type WireFormat byte
+
+const (
+	// WireBinary frames the compact encoding of Message.MarshalBinary
+	WireBinary WireFormat = 'b'
+	// WireProtobuf frames the Frame message of proto/taskqueue.proto, for
+	// workers generated from the schema in other languages
+	WireProtobuf WireFormat = 'p'
+	// WireGob streams messages with encoding/gob, which describes the type
+	// once per connection instead of once per message; only Go peers read it
+	WireGob WireFormat = 'g'
+	// WireMsgpack frames each message as a MessagePack map keyed by field
+	// name, compact and readable from most languages
+	WireMsgpack WireFormat = 'm'
+	// WireJSON frames each message as a JSON object, for reading the traffic
+	// while debugging
+	WireJSON WireFormat = 'j'
+)
+
+// String returns the format name
+func (f WireFormat) String() string {
+	switch f {
+	case WireBinary:
+		return "binary"
+	case WireProtobuf:
+		return "protobuf"
+	case WireGob:
+		return "gob"
+	case WireMsgpack:
+		return "msgpack"
+	case WireJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("WireFormat(%d)", int(f))
+	}
+}
+
+// ParseWireFormat returns the format named name
+func ParseWireFormat(name string) (WireFormat, error) {
+	for _, f := range []WireFormat{WireBinary, WireProtobuf, WireGob, WireMsgpack, WireJSON} {
+		if f.String() == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown wire format %q", name)
+}
+
+// wireCodec reads and writes the messages of one connection; the caller
+// serialises writes and flushes w after each
+type wireCodec interface {
+	write(w *bufio.Writer, m *Message) error
+	read(r *bufio.Reader) (*Message, error)
+}
+
+// newWireCodec returns the codec of format for a connection read through r
+// and written through w
+func newWireCodec(format WireFormat, r *bufio.Reader, w *bufio.Writer) (wireCodec, error) {
+	switch format {
+	case WireBinary:
+		return framedCodec{(*Message).MarshalBinary, (*Message).UnmarshalBinary}, nil
+	case WireProtobuf:
+		marshal := func(m *Message) ([]byte, error) { return m.MarshalFrame(), nil }
+		return framedCodec{marshal, (*Message).UnmarshalFrame}, nil
+	case WireGob:
+		return &gobWireCodec{enc: gob.NewEncoder(w), dec: gob.NewDecoder(r)}, nil
+	case WireMsgpack:
+		return framedCodec{(*Message).MarshalMsgpack, (*Message).UnmarshalMsgpack}, nil
+	case WireJSON:
+		marshal := func(m *Message) ([]byte, error) { return json.Marshal(m) }
+		unmarshal := func(m *Message, b []byte) error { return json.Unmarshal(b, m) }
+		return framedCodec{marshal, unmarshal}, nil
+	default:
+		return nil, fmt.Errorf("unknown wire format %q", byte(format))
+	}
+}
+
+// framedCodec sends every message as a length-prefixed frame
+type framedCodec struct {
+	marshal   func(m *Message) ([]byte, error)
+	unmarshal func(m *Message, b []byte) error
+}
+
+func (c framedCodec) write(w *bufio.Writer, m *Message) error {
+	b, err := c.marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, b)
+}
+
+func (c framedCodec) read(r *bufio.Reader) (*Message, error) {
+	b, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Message)
+	if err := c.unmarshal(m, b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// gobWireCodec keeps one gob stream per direction, so that the type of
+// Message is only described once
+type gobWireCodec struct {
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+func (c *gobWireCodec) write(_ *bufio.Writer, m *Message) error {
+	return c.enc.Encode(m)
+}
+
+func (c *gobWireCodec) read(_ *bufio.Reader) (*Message, error) {
+	m := new(Message)
+	if err := c.dec.Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,242 @@
+package taskqueue
+
+import (
+	"context"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WorkStealingPool gives every worker its own deque; workers run their own
+// jobs newest first and steal the oldest jobs of other workers when idle
+type WorkStealingPool struct {
+	poolCore
+	deques  []*workDeque
+	next    atomic.Uint64
+	pending atomic.Int64
+	mu      sync.Mutex
+	cond    *sync.Cond
+	closed  bool
+}
+
+// workDeque is a mutex-protected double-ended job queue owned by one worker
+type workDeque struct {
+	mu   sync.Mutex
+	jobs []*job
+}
+
+// pushBottom adds j at the owner's end
+func (d *workDeque) pushBottom(j *job) {
+	d.mu.Lock()
+	d.jobs = append(d.jobs, j)
+	d.mu.Unlock()
+}
+
+// popBottom removes the newest job; only the owner calls it
+func (d *workDeque) popBottom() *job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.jobs)
+	if n == 0 {
+		return nil
+	}
+	j := d.jobs[n-1]
+	d.jobs[n-1] = nil
+	d.jobs = d.jobs[:n-1]
+	return j
+}
+
+// stealTop removes the oldest job on behalf of another worker
+func (d *workDeque) stealTop() *job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.jobs) == 0 {
+		return nil
+	}
+	j := d.jobs[0]
+	d.jobs[0] = nil
+	d.jobs = d.jobs[1:]
+	return j
+}
+
+// drain removes and returns every queued job
+func (d *workDeque) drain() []*job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := d.jobs
+	d.jobs = nil
+	return jobs
+}
+
+// NewWorkStealingPool creates a work-stealing pool with numWorkers workers
+func NewWorkStealingPool(numWorkers int, opts ...Option) *WorkStealingPool {
+	numWorkers = max(numWorkers, 1)
+	pool := &WorkStealingPool{
+		poolCore: newPoolCore("work-stealing", opts),
+		deques:   make([]*workDeque, numWorkers),
+	}
+	pool.dispatch = pool.enqueue
+	pool.cond = sync.NewCond(&pool.mu)
+	pool.noteCapacity(numWorkers)
+
+	for i := range pool.deques {
+		pool.deques[i] = &workDeque{}
+	}
+	for i := range pool.deques {
+		go pool.work(&Worker{ID: i})
+	}
+
+	context.AfterFunc(pool.ctx, pool.close)
+	pool.config.events.poolStarted(pool.config.name, numWorkers)
+	return pool
+}
+
+// enqueue distributes jobs over the deques round-robin and wakes an idle worker
+func (p *WorkStealingPool) enqueue(j *job) {
+	if !p.admit(j) {
+		p.abort(j, ErrPoolShutdown)
+		return
+	}
+
+	// Push under the lock that guards closed, so closeDeques either sees the
+	// job in a deque or enqueue sees the pool closed
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.abort(j, context.Cause(p.ctx))
+		p.wg.Done()
+		return
+	}
+	target := p.next.Add(1) % uint64(len(p.deques))
+	p.pending.Add(1)
+	p.deques[target].pushBottom(j)
+	p.cond.Signal()
+	p.mu.Unlock()
+
+	// Fail the future as soon as the caller gives up, even while still queued
+	context.AfterFunc(j.ctx, func() { j.future.complete(nil, context.Cause(j.ctx)) })
+}
+
+// work runs jobs from the worker's own deque, stealing when it runs dry
+func (p *WorkStealingPool) work(worker *Worker) {
+	p.config.events.workerSpawned(p.config.name, worker.ID)
+	defer p.config.events.workerRetired(p.config.name, worker.ID)
+
+	own := p.deques[worker.ID]
+	for {
+		j := own.popBottom()
+		if j == nil {
+			j = p.steal(worker.ID)
+		}
+		if j == nil {
+			if p.pending.Load() > 0 {
+				// A job was counted but is not visible in a deque yet
+				runtime.Gosched()
+				continue
+			}
+			if !p.park() {
+				return
+			}
+			continue
+		}
+
+		p.pending.Add(-1)
+		j.worker = worker
+		p.run(j)
+		p.wg.Done()
+	}
+}
+
+// steal takes the oldest job of another worker, starting from a random victim
+func (p *WorkStealingPool) steal(self int) *job {
+	n := len(p.deques)
+	offset := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		victim := (offset + i) % n
+		if victim == self {
+			continue
+		}
+		if j := p.deques[victim].stealTop(); j != nil {
+			return j
+		}
+	}
+	return nil
+}
+
+// park blocks an idle worker until work is submitted; it returns false once
+// the pool is closed
+func (p *WorkStealingPool) park() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.pending.Load() == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	return !p.closed
+}
+
+// Shutdown stops accepting new tasks, waits for the deques to drain and then
+// stops the workers
+func (p *WorkStealingPool) Shutdown() {
+	p.stopAccepting()
+	p.wg.Wait()
+	p.cancel(ErrPoolShutdown)
+}
+
+// ShutdownNow stops accepting new tasks, cancels the running ones and returns
+// the tasks that were still queued
+func (p *WorkStealingPool) ShutdownNow() []ContextTask {
+	p.stopAccepting()
+	pending := p.closeDeques()
+	p.cancel(ErrPoolShutdown)
+
+	for _, j := range pending {
+		p.abort(j, ErrPoolShutdown)
+		p.wg.Done()
+	}
+	return unexecuted(pending)
+}
+
+// close stops the workers and fails every job that is still queued
+func (p *WorkStealingPool) close() {
+	for _, j := range p.closeDeques() {
+		p.abort(j, context.Cause(p.ctx))
+		p.wg.Done()
+	}
+}
+
+// closeDeques marks the pool closed, wakes the workers so they exit and
+// returns the jobs that never started
+func (p *WorkStealingPool) closeDeques() []*job {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	var pending []*job
+	for _, d := range p.deques {
+		jobs := d.drain()
+		p.pending.Add(-int64(len(jobs)))
+		pending = append(pending, jobs...)
+	}
+	return pending
+}
+
+// QueueDepth returns the number of tasks waiting in the deques
+func (p *WorkStealingPool) QueueDepth() int {
+	return int(max(p.pending.Load(), 0))
+}
+
+// Metrics returns a snapshot of the pool metrics
+func (p *WorkStealingPool) Metrics() MetricsSnapshot {
+	return p.metrics.snapshot(p.QueueDepth())
+}
+
+// ExecuteTasks runs n simulated tasks
+func (p *WorkStealingPool) ExecuteTasks(n int) {
+	for i := 0; i < n && p.ctx.Err() == nil; i++ {
+		// Simulate work
+		p.Submit(func() { time.Sleep(100 * time.Millisecond) })
+	}
+}
@@ -0,0 +1,389 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Handler runs a remote task: it receives the payload given to
+// Coordinator.Submit and returns the output sent back with the result. An
+// error wrapping ErrNack hands the task back for redelivery
+type Handler func(ctx context.Context, payload []byte) ([]byte, error)
+
+// WorkerNode is a process that registers with a coordinator and runs the
+// tasks dispatched to it on a local pool of capacity workers
+type WorkerNode struct {
+	id        string
+	transport Transport
+	opts      []Option
+
+	mu        sync.Mutex
+	capacity  int
+	handlers  map[string]Handler
+	heartbeat time.Duration
+	tracer    Tracer
+	token     string
+	// logger is the one given to SetLogger, for the local pool, and log
+	// the worker's own
+	logger *slog.Logger
+	log    *slog.Logger
+	// sessions are the connections to coordinators being served, with the
+	// pool of each, and running the tasks whose results they still owe;
+	// once draining is set no task is added to running
+	sessions map[Conn]*ApacheThreadPool
+	running  sync.WaitGroup
+	draining bool
+	// rateLimit, rateBurst and queueCapacity are the limits of the pools,
+	// as SetRateLimit and SetQueueCapacity last set them
+	rateLimit     float64
+	rateBurst     int
+	queueCapacity int
+}
+
+// NewWorkerNode creates a worker identified by id that runs up to capacity
+// tasks at once; opts configure its local pool
+func NewWorkerNode(id string, capacity int, transport Transport, opts ...Option) *WorkerNode {
+	return &WorkerNode{
+		id:        id,
+		capacity:  max(capacity, 1),
+		transport: transport,
+		opts:      opts,
+		handlers:  make(map[string]Handler),
+		sessions:  make(map[Conn]*ApacheThreadPool),
+		heartbeat: defaultHeartbeatInterval,
+		tracer:    noopTracer{},
+		log:       discardLogger,
+	}
+}
+
+// SetLogger makes the worker log to l as component "worker", with its ID
+// under LogKeyWorker: registering and losing its coordinator at info and
+// warn, and tasks failing at debug with their ID under LogKeyTask. Its
+// local pool logs to l too, unless its options give it a logger of its own
+func (n *WorkerNode) SetLogger(l *slog.Logger) {
+	n.mu.Lock()
+	n.logger, n.log = nil, ComponentLogger(l, "worker", LogKeyWorker, n.id)
+	if l != nil {
+		n.logger = l.With(LogKeyWorker, n.id)
+	}
+	n.mu.Unlock()
+}
+
+// SetTracerProvider traces the tasks the worker runs with a tracer from tp:
+// an execute span around each handler call, whose context the handler gets,
+// and an ack span around sending its result, both children of the dispatch
+// span of a coordinator traced with WithTracerProvider
+func (n *WorkerNode) SetTracerProvider(tp TracerProvider) {
+	n.mu.Lock()
+	n.tracer = tracerOf(tp, "worker")
+	n.mu.Unlock()
+}
+
+// SetToken makes the worker register with token, for coordinators created
+// with WithTokenAuth; it must grant ScopeWorker
+func (n *WorkerNode) SetToken(token string) {
+	n.mu.Lock()
+	n.token = token
+	n.mu.Unlock()
+}
+
+// SetCapacity changes how many tasks the worker runs at once: the pools of
+// the coordinators it serves are resized, and the coordinators told to
+// dispatch up to the new capacity
+func (n *WorkerNode) SetCapacity(capacity int) {
+	capacity = max(capacity, 1)
+	n.mu.Lock()
+	n.capacity = capacity
+	sessions := maps.Clone(n.sessions)
+	n.mu.Unlock()
+	for conn, pool := range sessions {
+		pool.Resize(capacity)
+		conn.Send(&Message{Type: MsgCapacity, Capacity: capacity})
+	}
+	n.log.Info("capacity changed", "capacity", capacity)
+}
+
+// SetRateLimit throttles the tasks the worker starts to perSecond tasks per
+// second with bursts of up to burst, or lifts the limit if perSecond is not
+// positive, as WithRateLimit among its options would
+func (n *WorkerNode) SetRateLimit(perSecond float64, burst int) {
+	n.mu.Lock()
+	n.rateLimit, n.rateBurst = perSecond, burst
+	sessions := maps.Clone(n.sessions)
+	n.mu.Unlock()
+	for _, pool := range sessions {
+		pool.SetRateLimit(perSecond, burst)
+	}
+}
+
+// SetQueueCapacity bounds the tasks waiting in each pool of the worker for
+// one of its workers, or lifts the bound if capacity is not positive, as
+// WithQueueCapacity among its options would with BlockPolicy. Tasks wait
+// only when the coordinator dispatches more than the worker's capacity,
+// as it may while a lowered capacity has not reached it yet
+func (n *WorkerNode) SetQueueCapacity(capacity int) {
+	n.mu.Lock()
+	n.queueCapacity = capacity
+	sessions := maps.Clone(n.sessions)
+	n.mu.Unlock()
+	for _, pool := range sessions {
+		pool.SetQueueCapacity(capacity)
+	}
+}
+
+// Handle registers h for tasks submitted under name
+func (n *WorkerNode) Handle(name string, h Handler) {
+	n.mu.Lock()
+	n.handlers[name] = h
+	n.mu.Unlock()
+}
+
+// handler returns the handler registered for name
+func (n *WorkerNode) handler(name string) (Handler, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	h, ok := n.handlers[name]
+	return h, ok
+}
+
+// Run connects to the coordinator at addr and serves tasks until ctx is
+// cancelled or the connection fails; tasks still running are cancelled
+func (n *WorkerNode) Run(ctx context.Context, addr string) error {
+	conn, err := n.transport.Dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return n.serve(ctx, conn)
+}
+
+// Listen accepts connections from coordinators that discovered the worker
+// through a Registry and serves tasks on each until ctx is cancelled; every
+// connection gets a pool of its own
+func (n *WorkerNode) Listen(ctx context.Context, l Listener) error {
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+		wg.Go(func() { n.serve(ctx, conn) })
+	}
+}
+
+// serve registers with the coordinator on the other end of conn and runs
+// the tasks it dispatches until ctx is cancelled or conn fails
+func (n *WorkerNode) serve(ctx context.Context, conn Conn) error {
+	defer conn.Close()
+	n.mu.Lock()
+	token, logger, log, capacity := n.token, n.logger, n.log, n.capacity
+	n.mu.Unlock()
+	if err := conn.Send(&Message{Type: MsgRegister, Worker: n.id, Capacity: capacity, Token: token}); err != nil {
+		log.Warn("registration failed", "coordinator", conn.RemoteAddr(), "error", err)
+		return err
+	}
+	log.Info("registered", "coordinator", conn.RemoteAddr(), "capacity", capacity)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if peer, ok := PeerOf(conn); ok {
+		ctx = context.WithValue(ctx, peerKey{}, peer)
+	}
+
+	n.mu.Lock()
+	interval, tracer := n.heartbeat, n.tracer
+	n.mu.Unlock()
+	if interval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go sendHeartbeats(conn, interval, done)
+	}
+
+	opts := []Option{WithContext(ctx), WithName("worker-" + n.id), WithLogger(logger)}
+	n.mu.Lock()
+	if n.rateLimit > 0 {
+		opts = append(opts, WithRateLimit(n.rateLimit, n.rateBurst))
+	}
+	if n.queueCapacity > 0 {
+		opts = append(opts, WithQueueCapacity(n.queueCapacity, BlockPolicy))
+	}
+	pool := NewApacheThreadPool(n.capacity, append(opts, n.opts...)...)
+	n.sessions[conn] = pool
+	draining, resized := n.draining, n.capacity != capacity
+	capacity = n.capacity
+	n.mu.Unlock()
+	defer pool.ShutdownNow()
+	defer func() {
+		n.mu.Lock()
+		delete(n.sessions, conn)
+		n.mu.Unlock()
+	}()
+	if draining {
+		conn.Send(&Message{Type: MsgDrain})
+	}
+	if resized {
+		// SetCapacity ran after the registration was sent
+		conn.Send(&Message{Type: MsgCapacity, Capacity: capacity})
+	}
+
+	// A task redelivered after its lease expired can arrive while the
+	// earlier delivery is still being cancelled, so deliveries are keyed by
+	// task ID and redelivery count
+	type delivery struct {
+		id           uint64
+		redeliveries int
+	}
+	var mu sync.Mutex
+	running := make(map[delivery]context.CancelFunc)
+	for {
+		m, err := conn.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			log.Warn("lost the coordinator", "coordinator", conn.RemoteAddr(), "error", err)
+			return err
+		}
+
+		switch m.Type {
+		case MsgDispatch:
+			n.mu.Lock()
+			draining := n.draining
+			if !draining {
+				n.running.Add(1)
+			}
+			n.mu.Unlock()
+			if draining {
+				// Dispatched before the coordinator saw MsgDrain
+				conn.Send(&Message{Type: MsgNack, ID: m.ID, Redeliveries: m.Redeliveries, Correlation: m.Correlation})
+				continue
+			}
+			key := delivery{m.ID, m.Redeliveries}
+			taskCtx, cancel := context.WithCancel(ctx)
+			if m.Key != "" {
+				taskCtx = context.WithValue(taskCtx, idempotencyKey{}, m.Key)
+			}
+			if m.Correlation != "" {
+				taskCtx = WithCorrelationID(taskCtx, m.Correlation)
+			}
+			if sc, err := ParseTraceparent(m.Trace); err == nil {
+				taskCtx = ContextWithRemoteSpanContext(taskCtx, sc)
+			}
+			attrs := []Attribute{{"task.name", m.Task}, {"task.id", strconv.FormatUint(m.ID, 10)}, {"task.correlation", m.Correlation}, {"worker.id", n.id}}
+			if log.Enabled(taskCtx, slog.LevelDebug) {
+				log.Debug("task started", LogKeyTask, m.ID, LogKeyCorrelation, m.Correlation, "name", m.Task, "redeliveries", m.Redeliveries)
+			}
+			mu.Lock()
+			running[key] = cancel
+			mu.Unlock()
+			j := pool.newJob(taskCtx, func(ctx context.Context) (any, error) {
+				ctx, span := tracer.Start(ctx, "execute")
+				defer span.End()
+				span.SetAttributes(attrs...)
+				out, err := n.call(ctx, m.Task, m.Payload)
+				span.RecordError(err)
+				return out, err
+			})
+			future := pool.submitJob(j)
+
+			// Report every task, including ones cancelled before they started,
+			// so the coordinator frees the slot
+			go func() {
+				defer n.running.Done()
+				v, err := future.Get()
+				mu.Lock()
+				delete(running, key)
+				mu.Unlock()
+				cancel()
+
+				out, _ := v.([]byte)
+				result := &Message{Type: MsgResult, ID: m.ID, Payload: out, Redeliveries: m.Redeliveries, Correlation: m.Correlation}
+				if err != nil && ctx.Err() != nil {
+					// Cut short by the worker stopping; the coordinator sees the
+					// connection close and decides what happens to the task
+					return
+				}
+				if errors.Is(err, ErrNack) {
+					result = &Message{Type: MsgNack, ID: m.ID, Redeliveries: m.Redeliveries, Correlation: m.Correlation}
+				}
+				if err != nil {
+					result.Error = err.Error()
+				}
+				if log.Enabled(taskCtx, slog.LevelDebug) {
+					log.Debug("task finished", LogKeyTask, m.ID, LogKeyCorrelation, m.Correlation, "name", m.Task, "error", err)
+				}
+				_, span := tracer.Start(taskCtx, "ack")
+				span.SetAttributes(attrs...)
+				span.RecordError(conn.Send(result))
+				span.End()
+			}()
+		case MsgRegister:
+			// The coordinator refused the registration
+			log.Error("registration refused", "coordinator", conn.RemoteAddr(), "error", m.Error)
+			return fmt.Errorf("worker %s: registration refused: %s", n.id, m.Error)
+		case MsgCancel:
+			mu.Lock()
+			cancel, ok := running[delivery{m.ID, m.Redeliveries}]
+			mu.Unlock()
+			if ok {
+				cancel()
+			}
+		}
+	}
+}
+
+// Drain stops the worker taking tasks and waits for the ones it runs to
+// finish and their results to be sent, or for ctx to be done. It tells the
+// coordinators it serves that it takes no more, and hands back any task
+// dispatched to it meanwhile; it goes on serving them until Run or Listen
+// returns, which is for the caller to bring about once Drain has
+func (n *WorkerNode) Drain(ctx context.Context) error {
+	n.mu.Lock()
+	n.draining = true
+	conns := make([]Conn, 0, len(n.sessions))
+	for conn := range n.sessions {
+		conns = append(conns, conn)
+	}
+	n.mu.Unlock()
+	n.log.Info("draining", "coordinators", len(conns))
+	for _, conn := range conns {
+		conn.Send(&Message{Type: MsgDrain})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		n.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("worker %s: drain: %w", n.id, context.Cause(ctx))
+	}
+}
+
+// call runs the handler registered for task, reporting a panic as a PanicError
+func (n *WorkerNode) call(ctx context.Context, task string, payload []byte) (out []byte, err error) {
+	h, ok := n.handler(task)
+	if !ok {
+		return nil, fmt.Errorf("no handler for task %q", task)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return h(ctx, payload)
+}
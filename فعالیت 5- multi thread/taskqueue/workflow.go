@@ -0,0 +1,229 @@
+package taskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCycle is reported by workflows whose dependencies form a cycle
+var ErrCycle = errors.New("workflow has a dependency cycle")
+
+// ErrDependencyFailed is reported for workflow tasks whose dependency failed
+var ErrDependencyFailed = errors.New("dependency failed")
+
+// FailurePolicy decides what happens to the dependents of a failed task
+type FailurePolicy int
+
+const (
+	// FailDependents marks every transitive dependent as failed
+	FailDependents FailurePolicy = iota
+	// SkipDependents marks every transitive dependent as skipped
+	SkipDependents
+)
+
+// NodeStatus is the final state of a workflow task
+type NodeStatus int
+
+const (
+	// NodePending is the state of a task that has not finished yet
+	NodePending NodeStatus = iota
+	// NodeSucceeded is the state of a task that ran without error
+	NodeSucceeded
+	// NodeFailed is the state of a task that failed or whose dependency failed
+	NodeFailed
+	// NodeSkipped is the state of a task not run because a dependency failed
+	NodeSkipped
+)
+
+// String returns the status name
+func (s NodeStatus) String() string {
+	switch s {
+	case NodePending:
+		return "pending"
+	case NodeSucceeded:
+		return "succeeded"
+	case NodeFailed:
+		return "failed"
+	case NodeSkipped:
+		return "skipped"
+	default:
+		return fmt.Sprintf("NodeStatus(%d)", int(s))
+	}
+}
+
+// Workflow is a DAG of named tasks executed in dependency order
+type Workflow struct {
+	policy FailurePolicy
+	nodes  map[string]*workflowNode
+	order  []string
+}
+
+// workflowNode is a task in the graph
+type workflowNode struct {
+	name       string
+	task       ContextTask
+	deps       []string
+	dependents []string
+}
+
+// WorkflowResult reports the outcome of every task of a workflow run
+type WorkflowResult struct {
+	Status map[string]NodeStatus
+	Errors map[string]error
+}
+
+// NewWorkflow creates an empty workflow applying policy to failed tasks
+func NewWorkflow(policy FailurePolicy) *Workflow {
+	return &Workflow{policy: policy, nodes: make(map[string]*workflowNode)}
+}
+
+// Add registers task under name, to be run after every task in deps
+func (w *Workflow) Add(name string, task ContextTask, deps ...string) error {
+	if _, ok := w.nodes[name]; ok {
+		return fmt.Errorf("workflow task %q already exists", name)
+	}
+	w.nodes[name] = &workflowNode{name: name, task: task, deps: deps}
+	w.order = append(w.order, name)
+	return nil
+}
+
+// Validate checks that every dependency exists and that the graph is acyclic
+func (w *Workflow) Validate() error {
+	for _, name := range w.order {
+		for _, dep := range w.nodes[name].deps {
+			if _, ok := w.nodes[dep]; !ok {
+				return fmt.Errorf("workflow task %q depends on unknown task %q", name, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(w.nodes))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			start := 0
+			for path[start] != name {
+				start++
+			}
+			cycle := append(append([]string{}, path[start:]...), name)
+			return fmt.Errorf("%w: %s", ErrCycle, strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range w.nodes[name].deps {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, name := range w.order {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run executes the workflow on pool, submitting every task as soon as all of
+// its dependencies have succeeded; the returned error joins every task failure
+func (w *Workflow) Run(ctx context.Context, pool Executor) (*WorkflowResult, error) {
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]int, len(w.nodes))
+	for _, name := range w.order {
+		node := w.nodes[name]
+		node.dependents = node.dependents[:0]
+	}
+	for _, name := range w.order {
+		node := w.nodes[name]
+		pending[name] = len(node.deps)
+		for _, dep := range node.deps {
+			w.nodes[dep].dependents = append(w.nodes[dep].dependents, name)
+		}
+	}
+
+	result := &WorkflowResult{
+		Status: make(map[string]NodeStatus, len(w.nodes)),
+		Errors: make(map[string]error),
+	}
+	type completion struct {
+		name string
+		err  error
+	}
+	done := make(chan completion, len(w.nodes))
+	running := 0
+	start := func(name string) {
+		running++
+		future := pool.SubmitCtx(ctx, w.nodes[name].task)
+		go func() {
+			_, err := future.Get()
+			done <- completion{name, err}
+		}()
+	}
+
+	for _, name := range w.order {
+		if pending[name] == 0 {
+			start(name)
+		}
+	}
+
+	var failures []error
+	for running > 0 {
+		c := <-done
+		running--
+
+		if c.err != nil {
+			result.Status[c.name] = NodeFailed
+			result.Errors[c.name] = c.err
+			failures = append(failures, fmt.Errorf("workflow task %q: %w", c.name, c.err))
+			w.propagateFailure(c.name, result)
+			continue
+		}
+
+		result.Status[c.name] = NodeSucceeded
+		for _, dependent := range w.nodes[c.name].dependents {
+			pending[dependent]--
+			if pending[dependent] == 0 && result.Status[dependent] == NodePending {
+				start(dependent)
+			}
+		}
+	}
+	return result, errors.Join(failures...)
+}
+
+// propagateFailure applies the failure policy to every transitive dependent
+// of the failed task
+func (w *Workflow) propagateFailure(failed string, result *WorkflowResult) {
+	queue := append([]string{}, w.nodes[failed].dependents...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if result.Status[name] != NodePending {
+			continue
+		}
+
+		if w.policy == SkipDependents {
+			result.Status[name] = NodeSkipped
+		} else {
+			result.Status[name] = NodeFailed
+			result.Errors[name] = fmt.Errorf("%w: %s", ErrDependencyFailed, failed)
+		}
+		queue = append(queue, w.nodes[name].dependents...)
+	}
+}
@@ -0,0 +1,135 @@
+// Package testutil holds the wait and metric helpers of the tests and
+// simulations of the taskqueue components
+package testutil
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+// pollInterval is how often the wait helpers check their condition
+const pollInterval = 20 * time.Millisecond
+
+// Eventually polls cond until it returns nil or timeout passes, returning
+// the last error cond reported in that case. It is meant for checks of
+// distributed components, where a condition holds only once messages have
+// been delivered and timers have fired
+func Eventually(timeout time.Duration, cond func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cond()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("after %v: %w", timeout, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// MetricsSource is anything reporting pool metrics, such as every
+// taskqueue.Executor
+type MetricsSource interface {
+	Metrics() taskqueue.MetricsSnapshot
+}
+
+// Metric returns the counter of s called name: "submitted", "cancelled",
+// "active", "completed", "succeeded", "failed", "timed_out", "retried",
+// "in_flight_weight" or "queue_depth"
+func Metric(s taskqueue.MetricsSnapshot, name string) (int64, error) {
+	switch name {
+	case "submitted":
+		return s.Submitted, nil
+	case "cancelled":
+		return s.Cancelled, nil
+	case "active":
+		return s.Active, nil
+	case "completed":
+		return s.Completed, nil
+	case "succeeded":
+		return s.Succeeded, nil
+	case "failed":
+		return s.Failed, nil
+	case "timed_out":
+		return s.TimedOut, nil
+	case "retried":
+		return s.Retried, nil
+	case "in_flight_weight":
+		return s.InFlightWeight, nil
+	case "queue_depth":
+		return int64(s.QueueDepth), nil
+	}
+	return 0, fmt.Errorf("unknown metric %q", name)
+}
+
+// WaitForMetric waits until the metric name of src, as named for Metric,
+// reaches at least want, or fails once timeout passes with the value it
+// got to
+func WaitForMetric(src MetricsSource, name string, want int64, timeout time.Duration) error {
+	if _, err := Metric(taskqueue.MetricsSnapshot{}, name); err != nil {
+		return err
+	}
+	return Eventually(timeout, func() error {
+		got, _ := Metric(src.Metrics(), name)
+		if got < want {
+			return fmt.Errorf("metric %s is %d, want at least %d", name, got, want)
+		}
+		return nil
+	})
+}
+
+// WaitForMetricBelow waits until the metric name of src drops to at most
+// want, as a queue draining would, or fails once timeout passes
+func WaitForMetricBelow(src MetricsSource, name string, want int64, timeout time.Duration) error {
+	if _, err := Metric(taskqueue.MetricsSnapshot{}, name); err != nil {
+		return err
+	}
+	return Eventually(timeout, func() error {
+		got, _ := Metric(src.Metrics(), name)
+		if got > want {
+			return fmt.Errorf("metric %s is %d, want at most %d", name, got, want)
+		}
+		return nil
+	})
+}
+
+// EventuallyConsistent polls reads, one per replica, until every one of
+// them succeeds with the same value, and returns that value; once timeout
+// passes it fails, describing what each replica last returned. It suits
+// replicated state that converges, such as a Raft key after a partition
+// heals or a CRDT after gossip
+func EventuallyConsistent[T comparable](timeout time.Duration, reads ...func() (T, error)) (T, error) {
+	var agreed T
+	if len(reads) == 0 {
+		return agreed, errors.New("no replicas to read")
+	}
+	err := Eventually(timeout, func() error {
+		values := make([]T, len(reads))
+		errs := make([]error, len(reads))
+		consistent := true
+		for i, read := range reads {
+			values[i], errs[i] = read()
+			consistent = consistent && errs[i] == nil && values[i] == values[0]
+		}
+		if consistent {
+			agreed = values[0]
+			return nil
+		}
+		var b strings.Builder
+		b.WriteString("replicas disagree:")
+		for i := range reads {
+			if errs[i] != nil {
+				fmt.Fprintf(&b, " %d: %v;", i, errs[i])
+			} else {
+				fmt.Fprintf(&b, " %d: %v;", i, values[i])
+			}
+		}
+		return errors.New(strings.TrimSuffix(b.String(), ";"))
+	})
+	return agreed, err
+}
@@ -0,0 +1,79 @@
+package testutil
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"multithread/taskqueue"
+)
+
+func TestEventually(t *testing.T) {
+	var polls atomic.Int32
+	if err := Eventually(time.Second, func() error {
+		if polls.Add(1) < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("condition holding on the third poll: %v", err)
+	}
+
+	never := errors.New("never")
+	err := Eventually(50*time.Millisecond, func() error { return never })
+	if !errors.Is(err, never) {
+		t.Fatalf("condition never holding reported %v, want it to wrap the last error", err)
+	}
+}
+
+func TestWaitForMetric(t *testing.T) {
+	pool := taskqueue.NewSimpleThreadPool(4)
+	defer pool.Shutdown()
+	release := make(chan struct{})
+	for range 4 {
+		pool.Submit(func() { <-release })
+	}
+	if err := WaitForMetric(pool, "submitted", 4, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitForMetric(pool, "completed", 1, 50*time.Millisecond); err == nil {
+		t.Fatal("blocked tasks reported completed")
+	}
+	close(release)
+	if err := WaitForMetric(pool, "completed", 4, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitForMetricBelow(pool, "active", 0, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitForMetric(pool, "no_such_metric", 0, time.Second); err == nil {
+		t.Fatal("unknown metric accepted")
+	}
+}
+
+func TestEventuallyConsistent(t *testing.T) {
+	var lagging atomic.Int32
+	reads := []func() (string, error){
+		func() (string, error) { return "new", nil },
+		func() (string, error) {
+			if lagging.Add(1) < 3 {
+				return "old", nil
+			}
+			return "new", nil
+		},
+	}
+	value, err := EventuallyConsistent(time.Second, reads...)
+	if err != nil || value != "new" {
+		t.Fatalf("converging replicas read %q, %v; want new", value, err)
+	}
+
+	_, err = EventuallyConsistent(50*time.Millisecond,
+		func() (int, error) { return 1, nil },
+		func() (int, error) { return 0, errors.New("unreachable") },
+	)
+	if err == nil || !strings.Contains(err.Error(), "1: unreachable") {
+		t.Fatalf("diverging replicas reported %v, want what each returned", err)
+	}
+}
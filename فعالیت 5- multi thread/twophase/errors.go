@@ -0,0 +1,7 @@
+package twophase
+
+import "errors"
+
+// ErrAborted is reported for a two-phase commit transaction that was
+// aborted, because a participant voted no or did not vote in time
+var ErrAborted = errors.New("transaction aborted")
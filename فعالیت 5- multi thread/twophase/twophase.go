@@ -0,0 +1,546 @@
+// Package twophase commits transactions atomically across participants
+// over a taskqueue Transport with two-phase commit
+package twophase
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"multithread/internal/wire"
+	"multithread/taskqueue"
+)
+
+// Config configures a Coordinator or a Participant
+type Config struct {
+	// Addr is the address the node accepts 2PC messages on: outcome queries
+	// for a coordinator, prepares and decisions for a participant
+	Addr string
+	// Transport carries the 2PC messages
+	Transport taskqueue.Transport
+	// LogPath is the file transactions are logged to, so that a restarted
+	// node finishes the ones it left unfinished; empty keeps no log
+	LogPath string
+	// Timeout bounds every exchange with another node, and so how long the
+	// coordinator waits for a vote; defaults to five seconds
+	Timeout time.Duration
+	// RetryInterval is how often a coordinator resends undelivered decisions
+	// and a prepared participant asks for a decision it has not received;
+	// defaults to one second
+	RetryInterval time.Duration
+}
+
+// withDefaults fills in the unset durations
+func (c Config) withDefaults() Config {
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = time.Second
+	}
+	return c
+}
+
+// txState is a coordinator's record of one transaction
+type txState struct {
+	participants []string
+	decided      bool
+	commit       bool
+	unacked      map[string]bool
+}
+
+// Coordinator commits transactions across participants with two-phase
+// commit: every participant must vote yes to a prepare before any is told to
+// commit. The decision is logged before it is sent, so a coordinator that
+// crashes in between sends it again once restarted. It presumes abort: a
+// transaction with no logged decision is aborted, which is what it answers
+// participants asking about a transaction it has no record of
+type Coordinator struct {
+	cfg Config
+	// log holds a MsgPrepare for every transaction begun, then a MsgCommit
+	// or MsgAbort for its decision
+	log *taskqueue.StateLog
+
+	mu  sync.Mutex
+	txs map[string]*txState
+}
+
+// NewCoordinator opens the coordinator's log; transactions it left undecided
+// are aborted and the decisions it did not deliver are resent once Run
+// starts
+func NewCoordinator(cfg Config) (*Coordinator, error) {
+	l, open, err := taskqueue.OpenStateLog(cfg.LogPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &Coordinator{cfg: cfg.withDefaults(), log: l, txs: make(map[string]*txState)}
+	for _, m := range open {
+		tx := &txState{participants: decodeStrings(m.Payload), decided: true, commit: m.Type == taskqueue.MsgCommit}
+		tx.unacked = make(map[string]bool)
+		for _, p := range tx.participants {
+			tx.unacked[p] = true
+		}
+		if m.Type == taskqueue.MsgPrepare {
+			// Crashed before deciding, so nobody can have been told to commit
+			if err := c.log.Write(&taskqueue.Message{Type: taskqueue.MsgAbort, Key: m.Key, Payload: m.Payload}, true); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+		c.txs[m.Key] = tx
+	}
+	return c, nil
+}
+
+// Run answers participants asking for decisions and resends the decisions
+// not yet acknowledged until ctx is cancelled
+func (c *Coordinator) Run(ctx context.Context) error {
+	errc := make(chan error, 1)
+	go func() { errc <- taskqueue.ServeRequests(ctx, c.cfg.Transport, c.cfg.Addr, c.handle) }()
+	ticker := time.NewTicker(c.cfg.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			var retry []string
+			for id, tx := range c.txs {
+				if tx.decided && len(tx.unacked) > 0 {
+					retry = append(retry, id)
+				}
+			}
+			c.mu.Unlock()
+			for _, id := range retry {
+				c.deliver(ctx, id)
+			}
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return <-errc
+		}
+	}
+}
+
+// Commit runs transaction id: it asks every participant in ops to prepare
+// its operation and, if all vote yes within the timeout, commits it on all
+// of them. It returns nil once the commit is decided, even if some
+// participants are yet to hear of it; Run keeps telling them. Otherwise the
+// transaction is aborted and the error wraps ErrAborted, unless the log
+// failed so that the decision is unknown: the coordinator then delivers
+// none and the transaction is settled when it restarts
+func (c *Coordinator) Commit(ctx context.Context, id string, ops map[string][]byte) error {
+	participants := slices.Sorted(maps.Keys(ops))
+	if id == "" || len(participants) == 0 {
+		return errors.New("2pc: a transaction needs an ID and at least one participant")
+	}
+	c.mu.Lock()
+	if _, dup := c.txs[id]; dup {
+		c.mu.Unlock()
+		return fmt.Errorf("2pc: transaction %q is already running", id)
+	}
+	tx := &txState{participants: participants}
+	c.txs[id] = tx
+	c.mu.Unlock()
+
+	list := encodeStrings(participants)
+	if err := c.log.Write(&taskqueue.Message{Type: taskqueue.MsgPrepare, Key: id, Payload: list}, true); err != nil {
+		c.mu.Lock()
+		delete(c.txs, id)
+		c.mu.Unlock()
+		return err
+	}
+
+	// Phase 1: collect the votes
+	pctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	votes := make(chan error, len(participants))
+	for _, p := range participants {
+		go func() {
+			m := &taskqueue.Message{Type: taskqueue.MsgPrepare, Key: id, Worker: c.cfg.Addr, Payload: ops[p]}
+			reply, err := taskqueue.RoundTrip(pctx, c.cfg.Transport, p, m, true, c.cfg.Timeout)
+			switch {
+			case err != nil:
+				votes <- fmt.Errorf("%s: %w", p, err)
+			case reply.Error != "":
+				votes <- fmt.Errorf("%s voted no: %s", p, reply.Error)
+			default:
+				votes <- nil
+			}
+		}()
+	}
+	var reason error
+	for range participants {
+		if err := <-votes; err != nil && reason == nil {
+			reason = err
+			cancel()
+		}
+	}
+	cancel()
+
+	// Phase 2: log the decision, which is the commit point, then send it
+	decision := taskqueue.MsgCommit
+	if reason != nil {
+		decision = taskqueue.MsgAbort
+	}
+	if err := c.log.Write(&taskqueue.Message{Type: decision, Key: id, Payload: list}, true); err != nil {
+		if decision == taskqueue.MsgCommit {
+			// The commit record may have reached the disk even though the
+			// sync failed, and a restart would then deliver it: abort only
+			// once an abort is logged over it, and otherwise stop, leaving
+			// the participants asking until a restart settles the outcome
+			abort := &taskqueue.Message{Type: taskqueue.MsgAbort, Key: id, Payload: list}
+			if aerr := c.log.Write(abort, true); aerr != nil {
+				return fmt.Errorf("2pc: %s: logging the decision: %w", id, errors.Join(err, aerr))
+			}
+		}
+		// A restart now finds an abort or no decision, which means abort
+		decision, reason = taskqueue.MsgAbort, err
+	}
+	c.mu.Lock()
+	tx.decided, tx.commit = true, decision == taskqueue.MsgCommit
+	tx.unacked = make(map[string]bool)
+	for _, p := range participants {
+		tx.unacked[p] = true
+	}
+	c.mu.Unlock()
+	c.deliver(ctx, id)
+
+	if reason != nil {
+		return fmt.Errorf("%w: %s: %w", ErrAborted, id, reason)
+	}
+	return nil
+}
+
+// deliver sends the decision of transaction id to every participant that
+// has not acknowledged it, and forgets the transaction once all have
+func (c *Coordinator) deliver(ctx context.Context, id string) {
+	c.mu.Lock()
+	tx := c.txs[id]
+	if tx == nil {
+		c.mu.Unlock()
+		return
+	}
+	decision := taskqueue.MsgAbort
+	if tx.commit {
+		decision = taskqueue.MsgCommit
+	}
+	pending := slices.Collect(maps.Keys(tx.unacked))
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range pending {
+		wg.Go(func() {
+			reply, err := taskqueue.RoundTrip(ctx, c.cfg.Transport, p, &taskqueue.Message{Type: decision, Key: id, Worker: c.cfg.Addr}, true, c.cfg.Timeout)
+			if err == nil && reply.Error == "" {
+				c.mu.Lock()
+				delete(tx.unacked, p)
+				c.mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	done := len(tx.unacked) == 0 && c.txs[id] == tx
+	if done {
+		delete(c.txs, id)
+	}
+	c.mu.Unlock()
+	if done {
+		c.log.Write(&taskqueue.Message{Type: taskqueue.MsgResult, Key: id}, false)
+	}
+}
+
+// handle answers a participant asking for the outcome of a transaction
+func (c *Coordinator) handle(ctx context.Context, conn taskqueue.Conn, m *taskqueue.Message) {
+	if m.Type != taskqueue.MsgOutcome {
+		return
+	}
+	c.mu.Lock()
+	tx, ok := c.txs[m.Key]
+	reply := &taskqueue.Message{Type: taskqueue.MsgAbort, Key: m.Key}
+	switch {
+	case ok && !tx.decided:
+		reply.Type = taskqueue.MsgOutcome
+	case ok && tx.commit:
+		reply.Type = taskqueue.MsgCommit
+	}
+	c.mu.Unlock()
+	conn.Send(reply)
+}
+
+// Close closes the coordinator's log
+func (c *Coordinator) Close() error {
+	return c.log.Close()
+}
+
+// Resource is the local store a Participant updates
+type Resource interface {
+	// Prepare stages op for transaction id and votes on it: nil promises
+	// that Commit will succeed, even after a restart, so the staged state
+	// must survive one if the participant keeps a log
+	Prepare(id string, op []byte) error
+	// Commit applies the staged operation
+	Commit(id string) error
+	// Abort discards the staged operation
+	Abort(id string) error
+}
+
+// Participant applies the operations of 2PC transactions to a Resource. Once
+// it votes yes it is bound to the coordinator's decision, so it logs the
+// vote and, if the decision is late, asks the coordinator for it
+type Participant struct {
+	cfg      Config
+	resource Resource
+	// log holds a MsgPrepare, naming the coordinator, for every yes vote
+	log *taskqueue.StateLog
+
+	mu       sync.Mutex
+	prepared map[string]preparedTx
+}
+
+// preparedTx is a transaction a participant voted yes to
+type preparedTx struct {
+	coordinator string
+	since       time.Time
+}
+
+// NewParticipant opens the participant's log; the transactions it was still
+// waiting on a decision for are settled with their coordinators once Run
+// starts
+func NewParticipant(cfg Config, resource Resource) (*Participant, error) {
+	l, open, err := taskqueue.OpenStateLog(cfg.LogPath)
+	if err != nil {
+		return nil, err
+	}
+	p := &Participant{cfg: cfg.withDefaults(), resource: resource, log: l, prepared: make(map[string]preparedTx)}
+	for _, m := range open {
+		p.prepared[m.Key] = preparedTx{coordinator: m.Worker}
+	}
+	return p, nil
+}
+
+// Run serves the coordinators and settles late decisions until ctx is
+// cancelled
+func (p *Participant) Run(ctx context.Context) error {
+	errc := make(chan error, 1)
+	go func() { errc <- taskqueue.ServeRequests(ctx, p.cfg.Transport, p.cfg.Addr, p.handle) }()
+	ticker := time.NewTicker(p.cfg.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.settle(ctx)
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return <-errc
+		}
+	}
+}
+
+// settle asks the coordinators of transactions prepared for longer than the
+// retry interval for their decisions
+func (p *Participant) settle(ctx context.Context) {
+	p.mu.Lock()
+	late := make(map[string]string)
+	for id, tx := range p.prepared {
+		if time.Since(tx.since) >= p.cfg.RetryInterval {
+			late[id] = tx.coordinator
+		}
+	}
+	p.mu.Unlock()
+
+	for id, coordinator := range late {
+		reply, err := taskqueue.RoundTrip(ctx, p.cfg.Transport, coordinator, &taskqueue.Message{Type: taskqueue.MsgOutcome, Key: id}, true, p.cfg.Timeout)
+		if err == nil && (reply.Type == taskqueue.MsgCommit || reply.Type == taskqueue.MsgAbort) {
+			p.finish(id, reply.Type)
+		}
+	}
+}
+
+// handle answers a prepare or a decision
+func (p *Participant) handle(ctx context.Context, conn taskqueue.Conn, m *taskqueue.Message) {
+	reply := &taskqueue.Message{Type: m.Type, Key: m.Key}
+	switch m.Type {
+	case taskqueue.MsgPrepare:
+		if err := p.prepare(m); err != nil {
+			reply.Error = err.Error()
+		}
+	case taskqueue.MsgCommit, taskqueue.MsgAbort:
+		if err := p.finish(m.Key, m.Type); err != nil {
+			reply.Error = err.Error()
+		}
+	default:
+		return
+	}
+	conn.Send(reply)
+}
+
+// prepare stages a transaction and logs the yes vote before casting it
+func (p *Participant) prepare(m *taskqueue.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.prepared[m.Key]; ok {
+		return nil
+	}
+	if err := p.resource.Prepare(m.Key, m.Payload); err != nil {
+		return err
+	}
+	if err := p.log.Write(&taskqueue.Message{Type: taskqueue.MsgPrepare, Key: m.Key, Worker: m.Worker}, true); err != nil {
+		p.resource.Abort(m.Key)
+		return err
+	}
+	p.prepared[m.Key] = preparedTx{coordinator: m.Worker, since: time.Now()}
+	return nil
+}
+
+// finish applies the decision for a transaction. A decision for one it did
+// not prepare is acknowledged without touching the resource: it either voted
+// no or finished the transaction already
+func (p *Participant) finish(id string, decision taskqueue.MessageType) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.prepared[id]; !ok {
+		return nil
+	}
+	var err error
+	if decision == taskqueue.MsgCommit {
+		err = p.resource.Commit(id)
+	} else {
+		err = p.resource.Abort(id)
+	}
+	if err != nil {
+		return err
+	}
+	delete(p.prepared, id)
+	p.log.Write(&taskqueue.Message{Type: taskqueue.MsgResult, Key: id}, false)
+	return nil
+}
+
+// Close closes the participant's log
+func (p *Participant) Close() error {
+	return p.log.Close()
+}
+
+// MemoryStore is an in-memory key-value Resource. An operation is a set of
+// writes encoded with EncodeWrites; preparing it locks the keys, so a
+// transaction touching a key another one has prepared gets a no vote. Its
+// staged writes do not survive a restart
+type MemoryStore struct {
+	mu     sync.Mutex
+	data   map[string][]byte
+	staged map[string]map[string][]byte
+	locked map[string]string
+}
+
+// NewMemoryStore creates an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte), staged: make(map[string]map[string][]byte), locked: make(map[string]string)}
+}
+
+// EncodeWrites encodes a set of writes as a MemoryStore operation
+func EncodeWrites(writes map[string][]byte) []byte {
+	var b []byte
+	for _, k := range slices.Sorted(maps.Keys(writes)) {
+		b = wire.AppendBytes(b, []byte(k))
+		b = wire.AppendBytes(b, writes[k])
+	}
+	return b
+}
+
+// Get returns the committed value of key
+func (s *MemoryStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+// Prepare implements Resource
+func (s *MemoryStore) Prepare(id string, op []byte) error {
+	writes := make(map[string][]byte)
+	r := wire.Reader{B: op}
+	for len(r.B) > 0 && r.Err == nil {
+		k := string(r.Bytes())
+		writes[k] = r.Bytes()
+	}
+	if r.Err != nil {
+		return r.Err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range writes {
+		if owner, ok := s.locked[k]; ok && owner != id {
+			return fmt.Errorf("key %q is locked by transaction %q", k, owner)
+		}
+	}
+	for k := range writes {
+		s.locked[k] = id
+	}
+	s.staged[id] = writes
+	return nil
+}
+
+// Commit implements Resource
+func (s *MemoryStore) Commit(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.staged[id] {
+		s.data[k] = v
+	}
+	s.release(id)
+	return nil
+}
+
+// Abort implements Resource
+func (s *MemoryStore) Abort(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(id)
+	return nil
+}
+
+// release drops the staged writes and locks of a transaction; the caller
+// holds s.mu
+func (s *MemoryStore) release(id string) {
+	for k := range s.staged[id] {
+		if s.locked[k] == id {
+			delete(s.locked, k)
+		}
+	}
+	delete(s.staged, id)
+}
+
+// encodeStrings encodes a list of strings as a uvarint count followed by
+// the uvarint-prefixed strings
+func encodeStrings(list []string) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(list)))
+	for _, s := range list {
+		b = wire.AppendBytes(b, []byte(s))
+	}
+	return b
+}
+
+// decodeStrings decodes a list encoded by encodeStrings, stopping at the
+// first string that does not decode
+func decodeStrings(b []byte) []string {
+	r := wire.Reader{B: b}
+	n := r.Uvarint()
+	if n > uint64(len(r.B)) {
+		return nil
+	}
+	list := make([]string, 0, n)
+	for range n {
+		s := string(r.Bytes())
+		if r.Err != nil {
+			break
+		}
+		list = append(list, s)
+	}
+	return list
+}
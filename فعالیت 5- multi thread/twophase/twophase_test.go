@@ -0,0 +1,342 @@
+package twophase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"multithread/taskqueue"
+	"multithread/testutil"
+)
+
+// store is a MemoryStore whose prepares can be held back and whose commits
+// can be made to fail, for a participant that is slow to vote or cannot
+// apply a decision yet
+type store struct {
+	*MemoryStore
+	hold       chan struct{} // if set, prepares wait for it to close
+	failCommit atomic.Bool
+}
+
+func newStore() *store {
+	return &store{MemoryStore: NewMemoryStore()}
+}
+
+func (s *store) Prepare(id string, op []byte) error {
+	if s.hold != nil {
+		<-s.hold
+	}
+	return s.MemoryStore.Prepare(id, op)
+}
+
+func (s *store) Commit(id string) error {
+	if s.failCommit.Load() {
+		return errors.New("store unavailable")
+	}
+	return s.MemoryStore.Commit(id)
+}
+
+// testCluster runs a coordinator on host "coord" and participants on hosts
+// p1, p2, ... of a memory network, each logging to a file of a temporary
+// directory so that it can be restarted from its log
+type testCluster struct {
+	t       *testing.T
+	network *taskqueue.MemoryNetwork
+	dir     string
+	coord   *Coordinator
+	parts   map[string]*Participant
+	stops   map[string]func()
+}
+
+// testConfig is the configuration of the node on host, logging to dir
+func testConfig(network *taskqueue.MemoryNetwork, dir, host string) Config {
+	return Config{
+		Addr:          host + "/2pc",
+		Transport:     network.Host(host),
+		LogPath:       filepath.Join(dir, host+".log"),
+		Timeout:       200 * time.Millisecond,
+		RetryInterval: 20 * time.Millisecond,
+	}
+}
+
+func newTestCluster(t *testing.T) *testCluster {
+	c := &testCluster{
+		t:       t,
+		network: taskqueue.NewMemoryNetwork(),
+		dir:     t.TempDir(),
+		parts:   make(map[string]*Participant),
+		stops:   make(map[string]func()),
+	}
+	t.Cleanup(func() {
+		for _, stop := range c.stops {
+			stop()
+		}
+	})
+	return c
+}
+
+// run runs a node under name until stop is called or the test ends, and
+// waits until it accepts connections on addr
+func (c *testCluster) run(name, addr string, run func(context.Context) error, shutdown func() error) {
+	c.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+	c.stops[name] = sync.OnceFunc(func() {
+		cancel()
+		<-done
+		shutdown()
+	})
+	err := testutil.Eventually(5*time.Second, func() error {
+		conn, err := c.network.Dial(context.Background(), addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// stop stops the node name, as a crash would once its log is written
+func (c *testCluster) stop(name string) {
+	c.stops[name]()
+}
+
+// startCoordinator starts the coordinator, restoring it from its log
+func (c *testCluster) startCoordinator() {
+	c.t.Helper()
+	cfg := testConfig(c.network, c.dir, "coord")
+	coord, err := NewCoordinator(cfg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.coord = coord
+	c.run("coord", cfg.Addr, coord.Run, coord.Close)
+}
+
+// startParticipant starts the participant on host over resource, restoring
+// it from its log; a restarted participant keeps its resource, as a durable
+// one would survive
+func (c *testCluster) startParticipant(host string, resource Resource) {
+	c.t.Helper()
+	cfg := testConfig(c.network, c.dir, host)
+	p, err := NewParticipant(cfg, resource)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.parts[host] = p
+	c.run(host, cfg.Addr, p.Run, p.Close)
+}
+
+// commit runs transaction id writing key=value on every one of hosts
+func (c *testCluster) commit(id, key, value string, hosts ...string) error {
+	ops := make(map[string][]byte)
+	for _, host := range hosts {
+		ops[host+"/2pc"] = EncodeWrites(map[string][]byte{key: []byte(value)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return c.coord.Commit(ctx, id, ops)
+}
+
+// settled waits until no participant among hosts waits on a decision
+func (c *testCluster) settled(hosts ...string) {
+	c.t.Helper()
+	err := testutil.Eventually(5*time.Second, func() error {
+		for _, host := range hosts {
+			p := c.parts[host]
+			p.mu.Lock()
+			n := len(p.prepared)
+			p.mu.Unlock()
+			if n > 0 {
+				return fmt.Errorf("%s still holds %d prepared transactions", host, n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// holds reports whether s committed value under key, failing the test if
+// it holds another value
+func holds(t *testing.T, s *store, key, value string) bool {
+	t.Helper()
+	v, ok := s.Get(key)
+	if ok && string(v) != value {
+		t.Fatalf("%s holds %q, want %q", key, v, value)
+	}
+	return ok
+}
+
+// unlocked fails the test unless s holds no staged writes or locks
+func unlocked(t *testing.T, name string, s *store) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.staged) > 0 || len(s.locked) > 0 {
+		t.Errorf("%s keeps %d staged transactions and %d locked keys", name, len(s.staged), len(s.locked))
+	}
+}
+
+func TestCommit(t *testing.T) {
+	c := newTestCluster(t)
+	c.startCoordinator()
+	s1, s2 := newStore(), newStore()
+	c.startParticipant("p1", s1)
+	c.startParticipant("p2", s2)
+
+	if err := c.commit("t1", "k", "v", "p1", "p2"); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]*store{"p1": s1, "p2": s2} {
+		if !holds(t, s, "k", "v") {
+			t.Errorf("%s did not apply the committed write", name)
+		}
+		unlocked(t, name, s)
+	}
+	c.settled("p1", "p2")
+}
+
+func TestAbortOnNoVote(t *testing.T) {
+	c := newTestCluster(t)
+	c.startCoordinator()
+	s1, s2 := newStore(), newStore()
+	c.startParticipant("p1", s1)
+	c.startParticipant("p2", s2)
+
+	// Another transaction holds the key on p2, so p2 votes no
+	if err := s2.MemoryStore.Prepare("other", EncodeWrites(map[string][]byte{"k": []byte("x")})); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.commit("t1", "k", "v", "p1", "p2"); !errors.Is(err, ErrAborted) {
+		t.Fatalf("Commit returned %v over a no vote, want ErrAborted", err)
+	}
+	c.settled("p1", "p2")
+	if holds(t, s1, "k", "v") || holds(t, s2, "k", "v") {
+		t.Error("an aborted write was applied")
+	}
+	unlocked(t, "p1", s1)
+}
+
+func TestAbortOnVoteTimeout(t *testing.T) {
+	c := newTestCluster(t)
+	c.startCoordinator()
+	s1, s2 := newStore(), newStore()
+	s2.hold = make(chan struct{})
+	release := sync.OnceFunc(func() { close(s2.hold) })
+	defer release()
+	c.startParticipant("p1", s1)
+	c.startParticipant("p2", s2)
+
+	start := time.Now()
+	if err := c.commit("t1", "k", "v", "p1", "p2"); !errors.Is(err, ErrAborted) {
+		t.Fatalf("Commit returned %v with a vote never cast, want ErrAborted", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Commit took %v to give up on a vote, timeout is 200ms", elapsed)
+	}
+
+	// The late yes vote binds p2 to a decision already taken and forgotten,
+	// which presumed abort settles
+	release()
+	c.settled("p1", "p2")
+	if holds(t, s1, "k", "v") || holds(t, s2, "k", "v") {
+		t.Error("an aborted write was applied")
+	}
+	unlocked(t, "p1", s1)
+	unlocked(t, "p2", s2)
+}
+
+func TestCoordinatorRestartDeliversCommit(t *testing.T) {
+	c := newTestCluster(t)
+	c.startCoordinator()
+	s1, s2 := newStore(), newStore()
+	c.startParticipant("p1", s1)
+	c.startParticipant("p2", s2)
+
+	// p2 cannot apply the commit, so the coordinator stops with it
+	// undelivered
+	s2.failCommit.Store(true)
+	if err := c.commit("t1", "k", "v", "p1", "p2"); err != nil {
+		t.Fatal(err)
+	}
+	c.stop("coord")
+	s2.failCommit.Store(false)
+	if holds(t, s2, "k", "v") {
+		t.Fatal("p2 applied a commit it failed")
+	}
+
+	c.startCoordinator()
+	c.settled("p1", "p2")
+	if !holds(t, s1, "k", "v") || !holds(t, s2, "k", "v") {
+		t.Error("the restarted coordinator did not deliver the logged commit")
+	}
+	unlocked(t, "p2", s2)
+}
+
+func TestCoordinatorRestartAbortsUndecided(t *testing.T) {
+	c := newTestCluster(t)
+	s1 := newStore()
+	c.startParticipant("p1", s1)
+
+	// A coordinator that crashed after logging the prepare but before the
+	// decision, and after p1 voted yes
+	cfg := testConfig(c.network, c.dir, "coord")
+	l, _, err := taskqueue.OpenStateLog(cfg.LogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(&taskqueue.Message{Type: taskqueue.MsgPrepare, Key: "t1", Payload: encodeStrings([]string{"p1/2pc"})}, true); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	prepare := &taskqueue.Message{Type: taskqueue.MsgPrepare, Key: "t1", Worker: cfg.Addr, Payload: EncodeWrites(map[string][]byte{"k": []byte("v")})}
+	reply, err := taskqueue.RoundTrip(context.Background(), c.network.Host("coord"), "p1/2pc", prepare, true, time.Second)
+	if err != nil || reply.Error != "" {
+		t.Fatalf("p1 did not vote yes: %v %v", err, reply)
+	}
+
+	c.startCoordinator()
+	c.settled("p1")
+	if holds(t, s1, "k", "v") {
+		t.Error("an undecided transaction was committed")
+	}
+	unlocked(t, "p1", s1)
+}
+
+func TestParticipantRestartSettles(t *testing.T) {
+	c := newTestCluster(t)
+	c.startCoordinator()
+	s1, s2 := newStore(), newStore()
+	c.startParticipant("p1", s1)
+	c.startParticipant("p2", s2)
+
+	// p2 votes yes, then goes down before it applies the commit
+	s2.failCommit.Store(true)
+	if err := c.commit("t1", "k", "v", "p1", "p2"); err != nil {
+		t.Fatal(err)
+	}
+	c.stop("p2")
+	s2.failCommit.Store(false)
+
+	// Only the vote in its log tells the restarted p2 that it is bound to
+	// the commit rather than free to acknowledge it untouched
+	c.startParticipant("p2", s2)
+	c.settled("p2")
+	if !holds(t, s2, "k", "v") {
+		t.Error("the restarted participant did not apply the commit")
+	}
+	unlocked(t, "p2", s2)
+}